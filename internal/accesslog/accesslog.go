@@ -0,0 +1,146 @@
+package accesslog
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Entry struct {
+	Protocol string
+	Method   string
+	Database string
+	User     string
+	Remote   string
+	Status   string
+	Rows     int64
+	Bytes    int64
+	Duration time.Duration
+	Error    error
+}
+
+var (
+	logger     *slog.Logger
+	sampleRate float64
+)
+
+// Configure enables the access log, written as JSON lines to w. Only a
+// fraction (sample, from 0 to 1) of the successful requests is logged, errors
+// are always logged.
+func Configure(w io.Writer, sample float64) {
+	logger = slog.New(slog.NewJSONHandler(w, nil))
+	sampleRate = sample
+}
+
+func Enabled() bool {
+	return logger != nil
+}
+
+func Log(e Entry) {
+	if logger == nil {
+		return
+	}
+	if e.Error == nil && sampleRate < 1 && rand.Float64() >= sampleRate {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("protocol", e.Protocol),
+		slog.String("method", e.Method),
+		slog.String("database", e.Database),
+		slog.String("user", e.User),
+		slog.String("remote", e.Remote),
+		slog.String("status", e.Status),
+		slog.Int64("rows", e.Rows),
+		slog.Int64("bytes", e.Bytes),
+		slog.Float64("duration_ms", float64(e.Duration.Microseconds())/1000),
+	}
+	if e.Error != nil {
+		attrs = append(attrs, slog.String("error", e.Error.Error()))
+	}
+	logger.LogAttrs(context.Background(), slog.LevelInfo, "access", attrs...)
+}
+
+type entryKey struct{}
+
+// NewContext returns a context carrying the entry, so handlers can report the
+// number of rows with SetRows.
+func NewContext(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, e)
+}
+
+// FromContext returns the entry carried by the context.
+func FromContext(ctx context.Context) (*Entry, bool) {
+	e, ok := ctx.Value(entryKey{}).(*Entry)
+	return e, ok
+}
+
+// SetRows reports the number of rows returned or affected by the request.
+func SetRows(ctx context.Context, rows int64) {
+	if e, ok := ctx.Value(entryKey{}).(*Entry); ok {
+		e.Rows = rows
+	}
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func Middleware(next http.Handler) http.Handler {
+	if logger == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &Entry{
+			Protocol: "http",
+			Remote:   r.RemoteAddr,
+		}
+		entry.User, _, _ = r.BasicAuth()
+		rw := &responseWriter{ResponseWriter: w}
+		req := r.WithContext(NewContext(r.Context(), entry))
+		next.ServeHTTP(rw, req)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		entry.Method = r.Method + " " + r.URL.Path
+		entry.Database = req.PathValue("id")
+		entry.Status = strconv.Itoa(rw.status)
+		entry.Bytes = rw.bytes
+		entry.Duration = time.Since(start)
+		if rw.status >= http.StatusInternalServerError {
+			entry.Error = errors.New(http.StatusText(rw.status))
+		}
+		Log(*entry)
+	})
+}
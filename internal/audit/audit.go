@@ -0,0 +1,364 @@
+// Package audit keeps an append-only log of the write statements executed by
+// the clients of the HTTP, PostgreSQL, MySQL and MCP interfaces: in a SQLite
+// database searched by GET /audit, and/or published to a NATS JetStream
+// subject.
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/metrics"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// StreamName is the stream created for the subject when no stream captures
+// it.
+const StreamName = "HA_AUDIT"
+
+const (
+	schema = `CREATE TABLE IF NOT EXISTS ha_audit(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TEXT NOT NULL,
+	node TEXT NOT NULL,
+	protocol TEXT NOT NULL,
+	database TEXT NOT NULL,
+	user TEXT NOT NULL,
+	remote TEXT NOT NULL,
+	sql TEXT NOT NULL,
+	params TEXT,
+	rows_affected INTEGER NOT NULL,
+	error TEXT
+);
+CREATE INDEX IF NOT EXISTS ha_audit_time ON ha_audit(time);
+CREATE INDEX IF NOT EXISTS ha_audit_database ON ha_audit(database, id);
+CREATE INDEX IF NOT EXISTS ha_audit_user ON ha_audit(user, id);
+CREATE TRIGGER IF NOT EXISTS ha_audit_no_update BEFORE UPDATE ON ha_audit
+BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS ha_audit_no_delete BEFORE DELETE ON ha_audit
+BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;`
+
+	errorsName = "ha_audit_errors_total"
+
+	// timeFormat stores the UTC times with a fixed width, so they sort as
+	// text
+	timeFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+var ErrDisabled = errors.New("the audit log database is disabled, inform flag --audit-log at startup")
+
+type Config struct {
+	// File is the SQLite database of the audit log.
+	File string
+	// Subject publishes the entries to JetStream.
+	Subject  string
+	Replicas int
+	Node     string
+}
+
+// Entry is a write statement executed for a client. RowsAffected is the
+// number of rows returned by a RETURNING clause.
+type Entry struct {
+	ID           int64     `json:"id,omitempty"`
+	Time         time.Time `json:"time"`
+	Node         string    `json:"node"`
+	Protocol     string    `json:"protocol"`
+	Database     string    `json:"database"`
+	User         string    `json:"user,omitempty"`
+	Remote       string    `json:"remote,omitempty"`
+	SQL          string    `json:"sql"`
+	Params       any       `json:"params,omitempty"`
+	RowsAffected int64     `json:"rows_affected"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type Log struct {
+	cfg Config
+	db  *sql.DB
+	js  jetstream.JetStream
+
+	// mu keeps the failures of a series logged once
+	mu      sync.Mutex
+	lastErr error
+}
+
+var current *Log
+
+// Open opens the audit log database and the JetStream subject of the
+// configuration, nc is only used with a subject.
+func Open(ctx context.Context, cfg Config, nc *nats.Conn) (*Log, error) {
+	l := &Log{cfg: cfg}
+	if cfg.File != "" {
+		db, err := sqlite.OpenFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		// the pragmas are set on the connection
+		db.SetMaxOpenConns(1)
+		db.SetConnMaxLifetime(0)
+		for _, stmt := range []string{
+			"PRAGMA journal_mode = WAL",
+			"PRAGMA synchronous = NORMAL",
+			"PRAGMA busy_timeout = 5000",
+			schema,
+		} {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				db.Close()
+				return nil, fmt.Errorf("open audit log: %w", err)
+			}
+		}
+		l.db = db
+	}
+	if cfg.Subject != "" {
+		js, err := jetstream.New(nc, jetstream.WithPublishAsyncErrHandler(func(_ jetstream.JetStream, msg *nats.Msg, err error) {
+			metrics.AddCounter(errorsName, "Audit log entries not recorded", nil, 1)
+			slog.Error("failed to publish the audit log entry", "subject", msg.Subject, "error", err)
+		}))
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		_, err = js.StreamNameBySubject(ctx, cfg.Subject)
+		if errors.Is(err, jetstream.ErrStreamNotFound) {
+			_, err = js.CreateStream(ctx, jetstream.StreamConfig{
+				Name:     StreamName,
+				Subjects: []string{cfg.Subject},
+				Storage:  jetstream.FileStorage,
+				Replicas: max(cfg.Replicas, 1),
+			})
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("audit stream for subject %q: %w", cfg.Subject, err)
+		}
+		l.js = js
+	}
+	return l, nil
+}
+
+// SetLog sets the log recording the statements, nil disables the audit.
+func SetLog(l *Log) {
+	current = l
+}
+
+func Enabled() bool {
+	return current != nil
+}
+
+// Record appends the entry to the audit log when the statement writes, the
+// queries and the transaction statements are ignored. A failure is logged
+// and does not fail the statement.
+func Record(e Entry) {
+	if current == nil || !IsWrite(e.SQL) {
+		return
+	}
+	current.record(e)
+}
+
+// RowsAffected returns the rows affected by the statement of the response.
+func RowsAffected(res *sqlite.Response) int64 {
+	switch {
+	case res == nil:
+		return 0
+	case res.NoReturning:
+		return res.RowsAffected
+	default:
+		return int64(len(res.Rows))
+	}
+}
+
+// ErrorString returns the message of err, empty when nil.
+func ErrorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (l *Log) record(e Entry) {
+	e.Time = time.Now().UTC()
+	e.Node = l.cfg.Node
+	var err error
+	if l.db != nil {
+		err = l.insert(e)
+	}
+	if l.js != nil {
+		err = errors.Join(err, l.publish(e))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		metrics.AddCounter(errorsName, "Audit log entries not recorded", nil, 1)
+		// Log the first error of a series only.
+		if l.lastErr == nil {
+			slog.Error("failed to write the audit log", "error", err)
+		}
+	}
+	l.lastErr = err
+}
+
+func (l *Log) insert(e Entry) error {
+	var params any
+	if e.Params != nil {
+		data, err := json.Marshal(e.Params)
+		if err != nil {
+			return err
+		}
+		params = string(data)
+	}
+	_, err := l.db.Exec(`INSERT INTO ha_audit(time, node, protocol, database, user, remote, sql, params, rows_affected, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))`,
+		e.Time.Format(timeFormat), e.Node, e.Protocol, e.Database, e.User, e.Remote, e.SQL, params, e.RowsAffected, e.Error)
+	return err
+}
+
+func (l *Log) publish(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// acknowledged in the background, the failures are logged by the
+	// handler of the JetStream context
+	_, err = l.js.PublishAsync(l.cfg.Subject, data)
+	return err
+}
+
+func (l *Log) Close() error {
+	if l.js != nil {
+		select {
+		case <-l.js.PublishAsyncComplete():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	if l.db != nil {
+		return l.db.Close()
+	}
+	return nil
+}
+
+// IsWrite reports whether the statement may change the database: any
+// statement but the queries, the PRAGMA reads, the transaction control and
+// the session statements. A
+// WITH statement writes when it has an INSERT, UPDATE, DELETE or REPLACE.
+func IsWrite(query string) bool {
+	upper := strings.ToUpper(query)
+	words := strings.FieldsFunc(upper, func(r rune) bool {
+		return !('A' <= r && r <= 'Z' || r == '_')
+	})
+	if len(words) == 0 {
+		return false
+	}
+	switch words[0] {
+	case "SELECT", "EXPLAIN", "VALUES", "BEGIN", "COMMIT", "END", "ROLLBACK", "SAVEPOINT", "RELEASE",
+		// session statements of the MySQL and PostgreSQL clients
+		"SET", "SHOW", "USE", "DESCRIBE", "DESC":
+		return false
+	case "PRAGMA":
+		return strings.Contains(upper, "=")
+	case "WITH":
+		for _, word := range words {
+			switch word {
+			case "INSERT", "UPDATE", "DELETE", "REPLACE":
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Filter selects the entries returned by Search, the zero values match any
+// entry. SQL matches the statements containing it.
+type Filter struct {
+	Database string
+	User     string
+	Protocol string
+	Node     string
+	SQL      string
+	Since    time.Time
+	Until    time.Time
+	// Failed returns the failed statements only.
+	Failed bool
+	// Before returns the entries older than this id, the next page.
+	Before int64
+	Limit  int
+}
+
+// Search returns the entries matching the filter, the most recent first.
+func (l *Log) Search(ctx context.Context, f Filter) ([]Entry, error) {
+	if l == nil || l.db == nil {
+		return nil, ErrDisabled
+	}
+	var (
+		where []string
+		args  []any
+	)
+	add := func(cond string, arg any) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+	for cond, value := range map[string]string{
+		"database = ?": f.Database,
+		"user = ?":     f.User,
+		"protocol = ?": f.Protocol,
+		"node = ?":     f.Node,
+	} {
+		if value != "" {
+			add(cond, value)
+		}
+	}
+	if f.SQL != "" {
+		add("instr(sql, ?) > 0", f.SQL)
+	}
+	if !f.Since.IsZero() {
+		add("time >= ?", f.Since.UTC().Format(timeFormat))
+	}
+	if !f.Until.IsZero() {
+		add("time < ?", f.Until.UTC().Format(timeFormat))
+	}
+	if f.Failed {
+		where = append(where, "error IS NOT NULL")
+	}
+	if f.Before > 0 {
+		add("id < ?", f.Before)
+	}
+	query := "SELECT id, time, node, protocol, database, user, remote, sql, params, rows_affected, error FROM ha_audit"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, f.Limit)
+	rows, err := l.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]Entry, 0)
+	for rows.Next() {
+		var (
+			e           Entry
+			t           string
+			params, msg sql.NullString
+		)
+		if err := rows.Scan(&e.ID, &t, &e.Node, &e.Protocol, &e.Database, &e.User, &e.Remote, &e.SQL, &params, &e.RowsAffected, &msg); err != nil {
+			return nil, err
+		}
+		e.Time, _ = time.Parse(timeFormat, t)
+		if params.Valid {
+			e.Params = json.RawMessage(params.String)
+		}
+		e.Error = msg.String
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
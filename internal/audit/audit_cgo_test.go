@@ -0,0 +1,93 @@
+//go:build cgo
+
+package audit_test
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/litesql/go-sqlite3"
+
+	"github.com/litesql/ha/internal/audit"
+)
+
+func TestIsWrite(t *testing.T) {
+	for query, want := range map[string]bool{
+		"INSERT INTO users(name) VALUES('a')":                  true,
+		"  update users SET name = 'b'":                        true,
+		"DELETE FROM users":                                    true,
+		"CREATE TABLE t(id INTEGER)":                           true,
+		"PRAGMA user_version = 2":                              true,
+		"WITH old AS (SELECT id FROM users) DELETE FROM users": true,
+		"SELECT * FROM users":                                  false,
+		"WITH t AS (SELECT 1) SELECT * FROM t":                 false,
+		"PRAGMA table_info(users)":                             false,
+		"BEGIN":                                                false,
+		"COMMIT;":                                              false,
+		"SET search_path = public":                             false,
+		"SHOW DATABASES":                                       false,
+		"EXPLAIN QUERY PLAN DELETE FROM users":                 false,
+		"":                                                     false,
+	} {
+		if got := audit.IsWrite(query); got != want {
+			t.Errorf("IsWrite(%q) = %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	l, err := audit.Open(ctx, audit.Config{File: filepath.Join(t.TempDir(), "audit.db"), Node: "node1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	audit.SetLog(l)
+	defer audit.SetLog(nil)
+
+	audit.Record(audit.Entry{Protocol: "http", Database: "ha.db", User: "alice", SQL: "INSERT INTO t VALUES(1)", RowsAffected: 1})
+	audit.Record(audit.Entry{Protocol: "http", Database: "ha.db", User: "alice", SQL: "SELECT * FROM t"})
+	audit.Record(audit.Entry{Protocol: "postgresql", Database: "ha.db", User: "bob", SQL: "DELETE FROM t WHERE id = :id", Params: map[string]any{"id": 1}, Error: "boom"})
+	audit.Record(audit.Entry{Protocol: "mysql", Database: "other.db", User: "alice", SQL: "UPDATE t SET v = 2"})
+
+	entries, err := l.Search(ctx, audit.Filter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want the 3 writes", len(entries))
+	}
+	if entries[0].SQL != "UPDATE t SET v = 2" || entries[0].Node != "node1" {
+		t.Errorf("most recent entry = %+v", entries[0])
+	}
+
+	entries, err = l.Search(ctx, audit.Filter{User: "alice", Database: "ha.db", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].RowsAffected != 1 {
+		t.Errorf("alice on ha.db = %+v, want the insert", entries)
+	}
+
+	entries, err = l.Search(ctx, audit.Filter{Failed: true, SQL: "DELETE", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Error != "boom" || entries[0].User != "bob" {
+		t.Fatalf("failed deletes = %+v", entries)
+	}
+	if got := string(entries[0].Params.(json.RawMessage)); got != `{"id":1}` {
+		t.Errorf("params = %s", got)
+	}
+
+	entries, err = l.Search(ctx, audit.Filter{Before: entries[0].ID, Until: time.Now().Add(time.Minute), Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Protocol != "http" {
+		t.Errorf("before the delete = %+v, want the insert", entries)
+	}
+}
@@ -0,0 +1,195 @@
+// Package batch coalesces the changesets of small transactions into a single
+// replication message.
+package batch
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats.go"
+)
+
+var ErrClosed = errors.New("batch publisher closed")
+
+type Config struct {
+	// Size is the number of changes that flushes the batch.
+	Size int
+	// MaxBytes bounds the encoded size of a batch, the maximum payload of the
+	// stream. A larger changeset is published alone. 0 is unlimited.
+	MaxBytes int
+	// Interval is the maximum time a changeset waits to be published.
+	Interval time.Duration
+	// Timeout is the maximum time a commit waits for room in the queue, and
+	// for its batch to be published while the replication is failing.
+	Timeout time.Duration
+}
+
+// Publisher queues the changesets and publishes them from a single goroutine,
+// merged in commit order, when Size changes or MaxBytes are pending or
+// Interval elapses since the first pending changeset. A commit waits for the
+// stream acknowledgement of its batch, and fails with it.
+type Publisher struct {
+	pub ha.Publisher
+	cfg Config
+
+	mu     sync.RWMutex // guards the queue send against close
+	closed atomic.Bool
+	queue  chan *pending
+	done   chan struct{}
+}
+
+// pending is a changeset waiting in the batch, done receives the result of
+// its publish.
+type pending struct {
+	cs   *ha.ChangeSet
+	size int
+	done chan error
+}
+
+func New(pub ha.Publisher, cfg Config) *Publisher {
+	p := &Publisher{
+		pub:   pub,
+		cfg:   cfg,
+		queue: make(chan *pending, max(cfg.Size, 1)),
+		done:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *Publisher) Publish(cs *ha.ChangeSet) error {
+	data, err := json.Marshal(cs)
+	if err != nil {
+		return err
+	}
+	// the changeset is reused by the connection once the commit hook returns,
+	// after the publish
+	req := &pending{cs: cs, size: len(data), done: make(chan error, 1)}
+	if err := p.enqueue(req); err != nil {
+		return err
+	}
+	return <-req.done
+}
+
+func (p *Publisher) enqueue(req *pending) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed.Load() {
+		return ErrClosed
+	}
+	select {
+	case p.queue <- req:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(p.cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case p.queue <- req:
+		return nil
+	case <-timer.C:
+		return errors.New("replication batch queue is full")
+	}
+}
+
+// Sequence returns the stream sequence of the last published batch.
+func (p *Publisher) Sequence() uint64 {
+	return p.pub.Sequence()
+}
+
+// Close publishes the pending changesets and closes the wrapped publisher.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	if !p.closed.Swap(true) {
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	<-p.done
+	if closer, ok := p.pub.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (p *Publisher) run() {
+	defer close(p.done)
+	// next is the changeset over the size of the previous batch
+	var next *pending
+	for {
+		first := next
+		next = nil
+		if first == nil {
+			var ok bool
+			if first, ok = <-p.queue; !ok {
+				return
+			}
+		}
+		batch := []*pending{first}
+		changes, size := len(first.cs.Changes), first.size
+		timer := time.NewTimer(p.cfg.Interval)
+	collect:
+		for changes < p.cfg.Size {
+			select {
+			case req, ok := <-p.queue:
+				if !ok {
+					break collect
+				}
+				if p.cfg.MaxBytes > 0 && size+req.size > p.cfg.MaxBytes {
+					next = req
+					break collect
+				}
+				batch = append(batch, req)
+				changes += len(req.cs.Changes)
+				size += req.size
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		changesets := make([]*ha.ChangeSet, len(batch))
+		for i, req := range batch {
+			changesets[i] = req.cs
+		}
+		err := p.flush(Merge(changesets))
+		for _, req := range batch {
+			req.done <- err
+		}
+	}
+}
+
+// flush publishes the batch, retrying the failures until the timeout. A
+// batch over the maximum payload is not retried.
+func (p *Publisher) flush(cs *ha.ChangeSet) error {
+	deadline := time.Now().Add(p.cfg.Timeout)
+	backoff := 100 * time.Millisecond
+	for {
+		err := p.pub.Publish(cs)
+		if err == nil || errors.Is(err, nats.ErrMaxPayload) || p.closed.Load() || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		slog.Warn("failed to publish replication batch, retrying", "error", err, "changes", len(cs.Changes), "backoff", backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
+
+// Merge concatenates the changes of the changesets in order. The merged
+// changeset is applied by the subscribers in a single transaction.
+func Merge(batch []*ha.ChangeSet) *ha.ChangeSet {
+	if len(batch) == 1 {
+		return batch[0]
+	}
+	merged := *batch[0]
+	merged.Changes = nil
+	for _, cs := range batch {
+		merged.Changes = append(merged.Changes, cs.Changes...)
+	}
+	merged.Timestamp = batch[len(batch)-1].Timestamp
+	return &merged
+}
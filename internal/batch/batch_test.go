@@ -0,0 +1,146 @@
+package batch_test
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats.go"
+
+	"github.com/litesql/ha/internal/batch"
+)
+
+type recorder struct {
+	mu       sync.Mutex
+	err      error
+	attempts int
+	messages [][]string
+}
+
+func (r *recorder) Publish(cs *ha.ChangeSet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if r.err != nil {
+		return r.err
+	}
+	var tables []string
+	for _, change := range cs.Changes {
+		tables = append(tables, change.Table)
+	}
+	r.messages = append(r.messages, tables)
+	return nil
+}
+
+func (r *recorder) Sequence() uint64 {
+	return 0
+}
+
+// publishAll publishes a changeset per table at once, like concurrent
+// commits, and returns their errors.
+func publishAll(pub *batch.Publisher, tables ...string) []error {
+	errs := make([]error, len(tables))
+	var wg sync.WaitGroup
+	for i, table := range tables {
+		wg.Go(func() {
+			errs[i] = pub.Publish(&ha.ChangeSet{Node: "n1", Changes: []ha.Change{{Table: table}}})
+		})
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestPublisher(t *testing.T) {
+	var rec recorder
+	pub := batch.New(&rec, batch.Config{Size: 3, Interval: time.Hour, Timeout: time.Second})
+	// the commits return once their batch is published
+	for _, err := range publishAll(pub, "a", "b", "c") {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rec.messages) != 1 || len(rec.messages[0]) != 3 {
+		t.Fatalf("got messages %v, want a batch of 3", rec.messages)
+	}
+	if got := slices.Sorted(slices.Values(rec.messages[0])); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Fatalf("got batch %v, want a, b and c", rec.messages[0])
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- pub.Publish(&ha.ChangeSet{Changes: []ha.Change{{Table: "d"}}})
+	}()
+	// the pending changeset is published on close, not after the interval
+	time.Sleep(50 * time.Millisecond)
+	if err := pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.messages) != 2 || !slices.Equal(rec.messages[1], []string{"d"}) {
+		t.Fatalf("got messages %v, want d published on close", rec.messages)
+	}
+	if err := pub.Publish(&ha.ChangeSet{}); !errors.Is(err, batch.ErrClosed) {
+		t.Errorf("publish after close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestPublisherInterval(t *testing.T) {
+	var rec recorder
+	pub := batch.New(&rec, batch.Config{Size: 100, Interval: 10 * time.Millisecond, Timeout: time.Second})
+	defer pub.Close()
+	if err := pub.Publish(&ha.ChangeSet{Changes: []ha.Change{{Table: "a"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.messages) != 1 {
+		t.Fatalf("got messages %v, want the batch published after the interval", rec.messages)
+	}
+}
+
+func TestPublisherMaxBytes(t *testing.T) {
+	data, err := json.Marshal(&ha.ChangeSet{Node: "n1", Changes: []ha.Change{{Table: "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec recorder
+	pub := batch.New(&rec, batch.Config{Size: 100, MaxBytes: len(data) + 1, Interval: 50 * time.Millisecond, Timeout: time.Second})
+	defer pub.Close()
+	for _, err := range publishAll(pub, "a", "b") {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rec.messages) != 2 {
+		t.Fatalf("got messages %v, want a message per changeset over the max bytes", rec.messages)
+	}
+}
+
+func TestPublisherErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{name: "permanent", err: nats.ErrMaxPayload, attempts: 1},
+		{name: "retried until the timeout", err: nats.ErrTimeout, attempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := recorder{err: tt.err}
+			pub := batch.New(&rec, batch.Config{Size: 1, Timeout: 500 * time.Millisecond})
+			defer pub.Close()
+			// the commit fails with the publish
+			if err := pub.Publish(&ha.ChangeSet{Changes: []ha.Change{{Table: "a"}}}); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if rec.attempts != tt.attempts {
+				t.Errorf("published %d times, want %d", rec.attempts, tt.attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package changeset
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/litesql/go-ha"
+)
+
+// The tags of the binary values in format 3. JSON encodes a []byte as a
+// base64 string the subscribers apply as text, and replaces the invalid UTF-8
+// of a string, so these values are written as {"$blob": "<base64>"} and
+// {"$text": "<base64>"}.
+const (
+	blobTag = "$blob"
+	textTag = "$text"
+)
+
+// Encode returns the changeset with its binary values tagged, in format 3.
+// The changeset is not modified, it is copied when it has binary values.
+func Encode(cs *ha.ChangeSet) *ha.ChangeSet {
+	var changes []ha.Change
+	for i, change := range cs.Changes {
+		oldValues, oldTagged := encodeValues(change.OldValues)
+		newValues, newTagged := encodeValues(change.NewValues)
+		args, argsTagged := encodeValues(change.Args)
+		if !oldTagged && !newTagged && !argsTagged {
+			continue
+		}
+		if changes == nil {
+			changes = slices.Clone(cs.Changes)
+		}
+		change.OldValues, change.NewValues, change.Args = oldValues, newValues, args
+		changes[i] = change
+	}
+	if changes == nil {
+		return cs
+	}
+	encoded := *cs
+	encoded.Changes = changes
+	return &encoded
+}
+
+func encodeValues(values []any) ([]any, bool) {
+	var encoded []any
+	for i, v := range values {
+		var tagged map[string]any
+		switch v := v.(type) {
+		case []byte:
+			tagged = map[string]any{blobTag: base64.StdEncoding.EncodeToString(v)}
+		case string:
+			if !utf8.ValidString(v) {
+				tagged = map[string]any{textTag: base64.StdEncoding.EncodeToString([]byte(v))}
+			}
+		}
+		if tagged == nil {
+			continue
+		}
+		if encoded == nil {
+			encoded = slices.Clone(values)
+		}
+		encoded[i] = tagged
+	}
+	if encoded == nil {
+		return values, false
+	}
+	return encoded, true
+}
+
+// Decode restores in place the changes compressed by Compress and the binary
+// values tagged by Encode. The changes of formats 1 and 2 are left as they
+// are.
+func Decode(cs *ha.ChangeSet) error {
+	if err := decompress(cs); err != nil {
+		return err
+	}
+	for i := range cs.Changes {
+		change := &cs.Changes[i]
+		decodeValues(change.OldValues)
+		decodeValues(change.NewValues)
+		decodeValues(change.Args)
+	}
+	return nil
+}
+
+func decodeValues(values []any) {
+	for i, v := range values {
+		tagged, ok := v.(map[string]any)
+		if !ok || len(tagged) != 1 {
+			continue
+		}
+		for tag, encoded := range tagged {
+			s, ok := encoded.(string)
+			if !ok || tag != blobTag && tag != textTag {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				continue
+			}
+			if tag == blobTag {
+				values[i] = data
+			} else {
+				values[i] = string(data)
+			}
+		}
+	}
+}
+
+// Decoder is a ha.ChangeSetInterceptor decoding the changesets before they
+// are applied.
+type Decoder struct{}
+
+func (Decoder) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	return false, Decode(cs)
+}
+
+func (Decoder) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	return err
+}
@@ -0,0 +1,60 @@
+package changeset_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/changeset"
+)
+
+func TestEncode(t *testing.T) {
+	blob := []byte{0x00, 0xff, 0xfe, 'a'}
+	invalid := string([]byte{'x', 0xc3, 0x28})
+	cs := &ha.ChangeSet{Changes: []ha.Change{
+		{Table: "files", Operation: "UPDATE", Columns: []string{"id", "data", "name"}, OldValues: []any{1, blob, invalid}, NewValues: []any{1, blob, "plain"}},
+		{Table: "users", Operation: "INSERT", Columns: []string{"id", "name"}, NewValues: []any{2, "ü"}},
+		{Operation: "SQL", Command: "INSERT INTO files(data) VALUES(?)", Args: []any{blob}},
+	}}
+
+	encoded := changeset.Encode(cs)
+	if cs.Changes[0].OldValues[1] == nil || !bytes.Equal(cs.Changes[0].OldValues[1].([]byte), blob) {
+		t.Fatal("the changeset published by the session was modified")
+	}
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscribers decode the messages
+	var received ha.ChangeSet
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	if err := changeset.Decode(&received); err != nil {
+		t.Fatal(err)
+	}
+
+	files := received.Changes[0]
+	if got, ok := files.OldValues[1].([]byte); !ok || !bytes.Equal(got, blob) {
+		t.Errorf("got blob %#v, want %v", files.OldValues[1], blob)
+	}
+	if got, ok := files.OldValues[2].(string); !ok || got != invalid {
+		t.Errorf("got text %#v, want the bytes %q", files.OldValues[2], invalid)
+	}
+	if got := files.NewValues[2]; got != "plain" {
+		t.Errorf("got %#v, want plain", got)
+	}
+	if got := received.Changes[1].NewValues[1]; got != "ü" {
+		t.Errorf("got %#v, want ü", got)
+	}
+	if got, ok := received.Changes[2].Args[0].([]byte); !ok || !bytes.Equal(got, blob) {
+		t.Errorf("got argument %#v, want %v", received.Changes[2].Args[0], blob)
+	}
+
+	plain := &ha.ChangeSet{Changes: received.Changes[1:2]}
+	if changeset.Encode(plain) != plain {
+		t.Error("changeset without binary values copied")
+	}
+}
@@ -0,0 +1,163 @@
+package changeset
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/compress"
+)
+
+const (
+	controlTableName = "ha_stats"
+	// compressedOperation is the change of format 4 holding the other
+	// changes of the changeset, compressed with the codec it names.
+	compressedOperation = "COMPRESSED"
+	// compressMinSize is the size of the changes under which compressing
+	// them is not worth it.
+	compressMinSize = 1024
+)
+
+// Compress returns the changeset with its changes compressed with codec in a
+// single COMPRESSED change, in format 4. The changes of the control table,
+// read before the apply like the chunk of a transaction or the identity of
+// the session, are kept before it. The changeset is not modified, it is
+// returned as is without codec or when its changes are small.
+func Compress(cs *ha.ChangeSet, codec compress.Codec) (*ha.ChangeSet, error) {
+	if codec == compress.None {
+		return cs, nil
+	}
+	var control, changes []ha.Change
+	for _, change := range cs.Changes {
+		if change.Table == controlTableName {
+			control = append(control, change)
+		} else {
+			changes = append(changes, change)
+		}
+	}
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < compressMinSize {
+		return cs, nil
+	}
+	var buf bytes.Buffer
+	if _, err := compress.Encode(codec, &buf, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("compress the changes: %w", err)
+	}
+	if buf.Len() >= len(data) {
+		return cs, nil
+	}
+	compressed := *cs
+	compressed.Changes = append(control, ha.Change{
+		Table:     controlTableName,
+		Operation: compressedOperation,
+		Columns:   []string{"encoding", "changes"},
+		NewValues: []any{string(codec), base64.StdEncoding.EncodeToString(buf.Bytes())},
+		TsNs:      cs.Timestamp,
+	})
+	return &compressed, nil
+}
+
+// decompress replaces in place the COMPRESSED changes by the changes they
+// hold. The changes of a chunked transaction hold one per chunk.
+func decompress(cs *ha.ChangeSet) error {
+	if !slices.ContainsFunc(cs.Changes, isCompressed) {
+		return nil
+	}
+	changes := make([]ha.Change, 0, len(cs.Changes))
+	for _, change := range cs.Changes {
+		if !isCompressed(change) {
+			changes = append(changes, change)
+			continue
+		}
+		data, err := inflate(change)
+		if err != nil {
+			return err
+		}
+		var held []ha.Change
+		if err := json.Unmarshal(data, &held); err != nil {
+			return fmt.Errorf("decompress the changes: %w", err)
+		}
+		changes = append(changes, held...)
+	}
+	cs.Changes = changes
+	return nil
+}
+
+// Expand returns the JSON of a published changeset with its COMPRESSED
+// changes replaced by the JSON of the changes they hold, for the readers of
+// the stream that don't apply it. The values are kept as published, the
+// binary values of format 3 stay tagged. The data is returned as is when it
+// holds no compressed change.
+func Expand(data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	var changes []json.RawMessage
+	if err := json.Unmarshal(fields["changes"], &changes); err != nil {
+		return nil, err
+	}
+	expanded := make([]json.RawMessage, 0, len(changes))
+	found := false
+	for _, raw := range changes {
+		var change ha.Change
+		if err := json.Unmarshal(raw, &change); err != nil {
+			return nil, err
+		}
+		if !isCompressed(change) {
+			expanded = append(expanded, raw)
+			continue
+		}
+		held, err := inflate(change)
+		if err != nil {
+			return nil, err
+		}
+		var list []json.RawMessage
+		if err := json.Unmarshal(held, &list); err != nil {
+			return nil, fmt.Errorf("decompress the changes: %w", err)
+		}
+		expanded = append(expanded, list...)
+		found = true
+	}
+	if !found {
+		return data, nil
+	}
+	changesData, err := json.Marshal(expanded)
+	if err != nil {
+		return nil, err
+	}
+	fields["changes"] = changesData
+	return json.Marshal(fields)
+}
+
+// inflate returns the JSON of the changes held by a COMPRESSED change.
+func inflate(change ha.Change) ([]byte, error) {
+	codec, _ := change.NewValues[0].(string)
+	encoded, _ := change.NewValues[1].(string)
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode the compressed changes: %w", err)
+	}
+	r, err := compress.NewReader(compress.Codec(codec), io.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decompress the changes: %w", err)
+	}
+	defer r.Close()
+	held, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompress the changes: %w", err)
+	}
+	return held, nil
+}
+
+func isCompressed(change ha.Change) bool {
+	return change.Table == controlTableName && change.Operation == compressedOperation && len(change.NewValues) == 2
+}
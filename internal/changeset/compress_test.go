@@ -0,0 +1,119 @@
+package changeset_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/changeset"
+	"github.com/litesql/ha/internal/compress"
+)
+
+// received returns the changeset as a subscriber decodes the message.
+func received(t *testing.T, cs *ha.ChangeSet) *ha.ChangeSet {
+	t.Helper()
+	data, err := json.Marshal(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ha.ChangeSet
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	return &got
+}
+
+func TestCompress(t *testing.T) {
+	blob := []byte{0x00, 0xff, 0xfe, 'a'}
+	cs := &ha.ChangeSet{Node: "node1", Changes: []ha.Change{
+		{Table: "ha_stats", Operation: "SESSION", Columns: []string{"user"}, NewValues: []any{"alice"}},
+	}}
+	for i := range 100 {
+		cs.Changes = append(cs.Changes, ha.Change{Table: "items", Operation: "INSERT", Columns: []string{"id", "name", "data"}, NewValues: []any{i, fmt.Sprintf("item %d", i), blob}})
+	}
+	want := received(t, changeset.Encode(cs))
+	if err := changeset.Decode(want); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, codec := range []compress.Codec{compress.Gzip, compress.Zstd, compress.Snappy} {
+		t.Run(string(codec), func(t *testing.T) {
+			compressed, err := changeset.Compress(changeset.Encode(cs), codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cs.Changes) != 101 {
+				t.Fatal("the changeset published by the session was modified")
+			}
+			if len(compressed.Changes) != 2 || compressed.Changes[0].Operation != "SESSION" || compressed.Changes[1].Operation != "COMPRESSED" {
+				t.Fatalf("got changes %+v, want the control change and the compressed ones", compressed.Changes)
+			}
+			got := received(t, compressed)
+			if err := changeset.Decode(got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Changes, want.Changes) {
+				t.Errorf("got changes %+v, want %+v", got.Changes, want.Changes)
+			}
+			if data, ok := got.Changes[1].NewValues[2].([]byte); !ok || !bytes.Equal(data, blob) {
+				t.Errorf("got blob %#v, want %v", got.Changes[1].NewValues[2], blob)
+			}
+		})
+	}
+
+	small := &ha.ChangeSet{Changes: cs.Changes[:2]}
+	if compressed, err := changeset.Compress(small, compress.Zstd); err != nil || compressed != small {
+		t.Errorf("small changeset compressed: %v", err)
+	}
+	if compressed, err := changeset.Compress(cs, compress.None); err != nil || compressed != cs {
+		t.Errorf("changeset compressed without codec: %v", err)
+	}
+
+	unknown := &ha.ChangeSet{Changes: []ha.Change{
+		{Table: "ha_stats", Operation: "COMPRESSED", Columns: []string{"encoding", "changes"}, NewValues: []any{"lz4", "AAAA"}},
+	}}
+	if err := changeset.Decode(unknown); err == nil {
+		t.Error("changes of an unknown codec decoded")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	cs := &ha.ChangeSet{Node: "node1", Timestamp: 42}
+	for i := range 100 {
+		cs.Changes = append(cs.Changes, ha.Change{Table: "items", Operation: "INSERT", Columns: []string{"id", "data"}, NewValues: []any{i, []byte{0x00, 0xff}}})
+	}
+	encoded, err := json.Marshal(changeset.Encode(cs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := changeset.Compress(changeset.Encode(cs), compress.Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := changeset.Expand(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotValue, wantValue any
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, &wantValue); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("got %s, want %s", got, encoded)
+	}
+
+	if got, err := changeset.Expand(encoded); err != nil || !bytes.Equal(got, encoded) {
+		t.Errorf("changeset without compressed changes modified: %s, %v", got, err)
+	}
+}
@@ -0,0 +1,214 @@
+// Package changeset negotiates the ChangeSet wire format between the nodes of
+// a cluster, so a rolling upgrade never publishes changes that a subscriber
+// still running an older release is not able to apply.
+package changeset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/compress"
+	"github.com/litesql/ha/internal/txlimit"
+)
+
+// Version is the ChangeSet format written by this build. Version 1 is the
+// go-ha JSON encoding, version 2, encoded like 1, also applies the chunked
+// transactions at once (see txlimit.Assembler), version 3 tags the binary
+// values (see Encode) and version 4 compresses the changes (see Compress).
+const Version = 4
+
+// Supported lists the ChangeSet formats this build is able to apply.
+var Supported = []int{1, 2, 3, 4}
+
+// MetadataKey is the JetStream consumer metadata advertising the formats the
+// subscriber is able to apply, e.g. "1,2".
+const MetadataKey = "ha_changeset_versions"
+
+var ErrNoCommonVersion = errors.New("no changeset format supported by all subscribers")
+
+// Versions parses the formats advertised in the consumer metadata. Consumers
+// created by releases without negotiation have no metadata and only apply
+// version 1.
+func Versions(metadata map[string]string) []int {
+	value, ok := metadata[MetadataKey]
+	if !ok {
+		return []int{1}
+	}
+	var versions []int
+	for _, s := range strings.Split(value, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || v <= 0 {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func formatVersions(versions []int) string {
+	list := make([]string, len(versions))
+	for i, v := range versions {
+		list[i] = strconv.Itoa(v)
+	}
+	return strings.Join(list, ",")
+}
+
+// Negotiate returns the newest local format applied by every subscriber.
+func Negotiate(local []int, subscribers [][]int) (int, error) {
+	candidates := slices.Clone(local)
+	slices.Sort(candidates)
+	for _, v := range slices.Backward(candidates) {
+		if !slices.ContainsFunc(subscribers, func(supported []int) bool {
+			return !slices.Contains(supported, v)
+		}) {
+			return v, nil
+		}
+	}
+	return 0, ErrNoCommonVersion
+}
+
+// Advertise stores the formats supported by this build in the metadata of the
+// subscriber consumer.
+func Advertise(ctx context.Context, js jetstream.JetStream, stream, consumer string) error {
+	c, err := js.Consumer(ctx, stream, consumer)
+	if err != nil {
+		return err
+	}
+	cfg := c.CachedInfo().Config
+	value := formatVersions(Supported)
+	if cfg.Metadata[MetadataKey] == value {
+		return nil
+	}
+	if cfg.Metadata == nil {
+		cfg.Metadata = make(map[string]string)
+	}
+	cfg.Metadata[MetadataKey] = value
+	_, err = js.UpdateConsumer(ctx, stream, cfg)
+	return err
+}
+
+// Negotiator resolves the format to publish from the formats advertised by the
+// durable consumers of the replication subject.
+type Negotiator struct {
+	js      jetstream.JetStream
+	stream  string
+	subject string
+	refresh time.Duration
+
+	mu      sync.Mutex
+	version int
+	err     error
+	checked time.Time
+}
+
+func NewNegotiator(js jetstream.JetStream, stream, subject string, refresh time.Duration) *Negotiator {
+	return &Negotiator{
+		js:      js,
+		stream:  stream,
+		subject: subject,
+		refresh: refresh,
+	}
+}
+
+// Version returns the negotiated format, looking up the consumers at most once
+// every refresh interval. When the consumers cannot be listed the previous
+// result is kept, or the current Version is assumed before the first lookup.
+func (n *Negotiator) Version(ctx context.Context) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.checked.IsZero() && time.Since(n.checked) < n.refresh {
+		return n.version, n.err
+	}
+	subscribers, err := n.subscribers(ctx)
+	if err != nil {
+		slog.Warn("failed to list replication consumers", "error", err, "stream", n.stream)
+		if n.checked.IsZero() {
+			return Version, nil
+		}
+		return n.version, n.err
+	}
+	version, err := Negotiate(Supported, subscribers)
+	if version != n.version || !errors.Is(err, n.err) {
+		slog.Info("changeset format negotiated", "subject", n.subject, "version", version, "error", err)
+	}
+	n.version, n.err, n.checked = version, err, time.Now()
+	return version, err
+}
+
+func (n *Negotiator) subscribers(ctx context.Context) ([][]int, error) {
+	stream, err := n.js.Stream(ctx, n.stream)
+	if err != nil {
+		return nil, err
+	}
+	lister := stream.ListConsumers(ctx)
+	var subscribers [][]int
+	for info := range lister.Info() {
+		cfg := info.Config
+		if cfg.Durable == "" {
+			// history and undo readers
+			continue
+		}
+		if cfg.FilterSubject != n.subject && !slices.Contains(cfg.FilterSubjects, n.subject) {
+			continue
+		}
+		subscribers = append(subscribers, Versions(cfg.Metadata))
+	}
+	return subscribers, lister.Err()
+}
+
+type publisher struct {
+	ha.Publisher
+	negotiator *Negotiator
+	timeout    time.Duration
+	codec      compress.Codec
+}
+
+// Publisher wraps the publisher to publish the changes in the format
+// negotiated with the subscribers, refusing the formats this build does not
+// write. The changes are compressed with codec in format 4.
+func Publisher(pub ha.Publisher, negotiator *Negotiator, timeout time.Duration, codec compress.Codec) ha.Publisher {
+	return &publisher{
+		Publisher:  pub,
+		negotiator: negotiator,
+		timeout:    timeout,
+		codec:      codec,
+	}
+}
+
+func (p *publisher) Publish(cs *ha.ChangeSet) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	version, err := p.negotiator.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version < 2 && txlimit.IsChunk(cs) {
+		// an older release would apply each chunk on its own
+		return fmt.Errorf("%w: a subscriber applies changeset format %d, without chunked transactions", txlimit.ErrTooLarge, version)
+	}
+	switch version {
+	case Version:
+		compressed, err := Compress(Encode(cs), p.codec)
+		if err != nil {
+			return err
+		}
+		return p.Publisher.Publish(compressed)
+	case 3:
+		// a subscriber still runs a release applying the uncompressed changes
+		return p.Publisher.Publish(Encode(cs))
+	case 1, 2:
+		// a subscriber still runs a release applying the untagged values
+		return p.Publisher.Publish(cs)
+	}
+	return fmt.Errorf("subscribers negotiated changeset format %d, this node writes formats 1 to %d", version, Version)
+}
@@ -0,0 +1,54 @@
+package changeset_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/litesql/ha/internal/changeset"
+)
+
+func TestVersions(t *testing.T) {
+	tests := []struct {
+		metadata map[string]string
+		want     []int
+	}{
+		{nil, []int{1}},
+		{map[string]string{"other": "x"}, []int{1}},
+		{map[string]string{changeset.MetadataKey: "1,2"}, []int{1, 2}},
+		{map[string]string{changeset.MetadataKey: " 2, x, 3"}, []int{2, 3}},
+		{map[string]string{changeset.MetadataKey: ""}, nil},
+	}
+	for _, tt := range tests {
+		if got := changeset.Versions(tt.metadata); !slices.Equal(got, tt.want) {
+			t.Errorf("Versions(%v) = %v, want %v", tt.metadata, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name        string
+		local       []int
+		subscribers [][]int
+		want        int
+		err         error
+	}{
+		{"no subscribers", []int{1, 2}, nil, 2, nil},
+		{"all upgraded", []int{1, 2}, [][]int{{1, 2}, {2, 1}}, 2, nil},
+		{"mixed versions", []int{2, 1}, [][]int{{1, 2}, {1}}, 1, nil},
+		{"newer subscriber", []int{1}, [][]int{{1, 2, 3}}, 1, nil},
+		{"no common version", []int{1}, [][]int{{2}}, 0, changeset.ErrNoCommonVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := changeset.Negotiate(tt.local, tt.subscribers)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got version %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -182,19 +182,7 @@ func Start(remote string, token string) {
 					slog.Error("databases", "error", err)
 					continue
 				}
-				t := table.New().
-					Border(lipgloss.NormalBorder()).
-					BorderStyle(lipgloss.NewStyle().Foreground(white)).
-					StyleFunc(func(row, col int) lipgloss.Style {
-						switch {
-						case row == table.HeaderRow:
-							return headerStyle
-						case row%2 == 0:
-							return evenRowStyle
-						default:
-							return oddRowStyle
-						}
-					}).Headers("Databases")
+				t := newTable("Databases")
 				for _, row := range resp.ReplicationId {
 					t.Row(row)
 				}
@@ -255,19 +243,7 @@ func Start(remote string, token string) {
 					fmt.Printf("Query OK, %d rows affected (%s)\n", resp.RowsAffected, time.Since(start))
 					continue
 				}
-				t := table.New().
-					Border(lipgloss.NormalBorder()).
-					BorderStyle(lipgloss.NewStyle().Foreground(white)).
-					StyleFunc(func(row, col int) lipgloss.Style {
-						switch {
-						case row == table.HeaderRow:
-							return headerStyle
-						case row%2 == 0:
-							return evenRowStyle
-						default:
-							return oddRowStyle
-						}
-					}).Headers(resp.ResultSet.Columns...)
+				t := newTable(resp.ResultSet.Columns...)
 				for _, row := range resp.ResultSet.Rows {
 					var cells []string
 					for _, val := range row.Values {
@@ -291,6 +267,22 @@ func Start(remote string, token string) {
 	}
 }
 
+func newTable(headers ...string) *table.Table {
+	return table.New().
+		Border(lipgloss.NormalBorder()).
+		BorderStyle(lipgloss.NewStyle().Foreground(white)).
+		StyleFunc(func(row, col int) lipgloss.Style {
+			switch {
+			case row == table.HeaderRow:
+				return headerStyle
+			case row%2 == 0:
+				return evenRowStyle
+			default:
+				return oddRowStyle
+			}
+		}).Headers(headers...)
+}
+
 type grpcCredentials struct {
 	token string
 }
@@ -0,0 +1,182 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// OneShotConfig configures the statements run by ha query and ha exec.
+type OneShotConfig struct {
+	// DB is the SQLite file opened directly, or with Remote the id of the
+	// database on the node, the default database when empty.
+	DB     string
+	Remote string
+	Token  string
+	// Output is table, json or csv.
+	Output string
+	// Write allows the statements changing the database.
+	Write bool
+}
+
+// RunOnce runs the statements, in one transaction when there are many, and
+// prints their results to w. A SQLite file is changed without replication.
+func RunOnce(ctx context.Context, cfg OneShotConfig, statements []string, w io.Writer) error {
+	if len(statements) == 0 {
+		return errors.New("no statement given")
+	}
+	if cfg.Output == "" {
+		cfg.Output = "table"
+	}
+	if !slices.Contains([]string{"table", "json", "csv"}, cfg.Output) {
+		return fmt.Errorf("invalid output %q, use table, json or csv", cfg.Output)
+	}
+	if !cfg.Write {
+		for _, stmt := range statements {
+			if !sqlite.IsQuery(stmt) {
+				return fmt.Errorf("%q changes the database, use ha exec", stmt)
+			}
+		}
+	}
+	var (
+		results []*sqlite.Response
+		err     error
+	)
+	if cfg.Remote != "" {
+		results, err = runRemote(ctx, cfg, statements)
+	} else {
+		results, err = runLocal(ctx, cfg.DB, statements)
+	}
+	if err != nil {
+		return err
+	}
+	for i, res := range results {
+		if err := printResult(w, cfg.Output, res, i > 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runLocal(ctx context.Context, path string, statements []string) ([]*sqlite.Response, error) {
+	if path == "" {
+		return nil, errors.New("--db or --remote is required")
+	}
+	// opening a missing file would create an empty database
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sqlite.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if len(statements) == 1 {
+		res, err := sqlite.Exec(ctx, db, statements[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		return []*sqlite.Response{res}, nil
+	}
+	queries := make([]sqlite.Request, len(statements))
+	for i, stmt := range statements {
+		queries[i] = sqlite.Request{Sql: stmt}
+	}
+	return sqlite.Transaction(ctx, db, queries)
+}
+
+// runRemote posts the statements to the HTTP API of the node, as a
+// transaction.
+func runRemote(ctx context.Context, cfg OneShotConfig, statements []string) ([]*sqlite.Response, error) {
+	endpoint := strings.TrimSuffix(cfg.Remote, "/") + "/query"
+	if cfg.DB != "" {
+		endpoint = strings.TrimSuffix(cfg.Remote, "/") + "/databases/" + url.PathEscape(cfg.DB)
+	}
+	queries := make([]sqlite.Request, len(statements))
+	for i, stmt := range statements {
+		queries[i] = sqlite.Request{Sql: stmt}
+	}
+	body, err := json.Marshal(queries)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", cfg.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var res struct {
+		Results []*sqlite.Response `json:"results"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&res); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return res.Results, nil
+}
+
+func printResult(w io.Writer, output string, res *sqlite.Response, separate bool) error {
+	switch output {
+	case "json":
+		return json.NewEncoder(w).Encode(res)
+	case "csv":
+		if separate {
+			fmt.Fprintln(w)
+		}
+		cw := csv.NewWriter(w)
+		cw.Write(res.Columns)
+		for _, row := range res.Rows {
+			cw.Write(cells(row))
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	if slices.Equal(res.Columns, []string{"rows_affected", "last_insert_id"}) && len(res.Rows) == 1 {
+		_, err := fmt.Fprintf(w, "%v rows affected\n", res.Rows[0][0])
+		return err
+	}
+	t := newTable(res.Columns...)
+	for _, row := range res.Rows {
+		t.Row(cells(row)...)
+	}
+	_, err := fmt.Fprintln(w, t.Render())
+	return err
+}
+
+func cells(row []any) []string {
+	list := make([]string, len(row))
+	for i, v := range row {
+		switch v := v.(type) {
+		case nil:
+		case []byte:
+			list[i] = string(v)
+		default:
+			list[i] = fmt.Sprint(v)
+		}
+	}
+	return list
+}
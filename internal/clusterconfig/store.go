@@ -0,0 +1,267 @@
+// Package clusterconfig keeps the dynamic cluster configuration in a NATS
+// JetStream KV bucket watched by every node, so a change made through any
+// node reaches the others instead of drifting per node.
+package clusterconfig
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	ErrNotFound     = errors.New("config key not found")
+	ErrConflict     = errors.New("config key was changed by another request")
+	ErrInvalidKey   = errors.New("invalid config key, use letters, digits and - _ = / . without a leading or trailing dot")
+	ErrInvalidValue = errors.New("config value is not valid JSON")
+)
+
+var reKey = regexp.MustCompile(`^[-/_=\.a-zA-Z0-9]+$`)
+
+type Config struct {
+	Bucket   string
+	Replicas int
+	// History is the number of revisions kept per key.
+	History int
+}
+
+// Entry is a configuration value, always a JSON document.
+type Entry struct {
+	Key      string          `json:"key"`
+	Value    json.RawMessage `json:"value"`
+	Revision uint64          `json:"revision"`
+	Updated  time.Time       `json:"updated"`
+}
+
+type watcher struct {
+	prefix string
+	fn     func(key string, value json.RawMessage)
+}
+
+// Store mirrors the bucket in memory, the reads never reach NATS.
+type Store struct {
+	kv jetstream.KeyValue
+
+	// notifyMu keeps the watchers notified in revision order
+	notifyMu sync.Mutex
+	mu       sync.RWMutex
+	values   map[string]Entry
+	watchers []watcher
+	revision uint64
+	applied  chan struct{}
+
+	stop context.CancelFunc
+}
+
+// New creates the bucket if needed and returns once the current values are
+// loaded.
+func New(ctx context.Context, nc *nats.Conn, cfg Config) (*Store, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:   cfg.Bucket,
+		History:  uint8(min(max(cfg.History, 1), jetstream.KeyValueMaxHistory)),
+		Storage:  jetstream.FileStorage,
+		Replicas: cfg.Replicas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create config bucket %q: %w", cfg.Bucket, err)
+	}
+	watchCtx, stop := context.WithCancel(context.Background())
+	w, err := kv.WatchAll(watchCtx)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	s := &Store{
+		kv:      kv,
+		values:  make(map[string]Entry),
+		applied: make(chan struct{}),
+		stop:    stop,
+	}
+	loaded := make(chan struct{})
+	go func() {
+		defer w.Stop()
+		for update := range w.Updates() {
+			if update == nil {
+				// the initial values were delivered
+				close(loaded)
+				continue
+			}
+			s.apply(update)
+		}
+	}()
+	select {
+	case <-loaded:
+	case <-ctx.Done():
+		stop()
+		return nil, fmt.Errorf("load config bucket %q: %w", cfg.Bucket, ctx.Err())
+	}
+	slog.Info("cluster config loaded", "bucket", cfg.Bucket, "keys", len(s.List("")))
+	return s, nil
+}
+
+func (s *Store) apply(update jetstream.KeyValueEntry) {
+	key := update.Key()
+	var value json.RawMessage
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	s.mu.Lock()
+	if update.Operation() == jetstream.KeyValuePut {
+		value = json.RawMessage(slices.Clone(update.Value()))
+		s.values[key] = Entry{
+			Key:      key,
+			Value:    value,
+			Revision: update.Revision(),
+			Updated:  update.Created(),
+		}
+	} else {
+		delete(s.values, key)
+	}
+	s.revision = max(s.revision, update.Revision())
+	close(s.applied)
+	s.applied = make(chan struct{})
+	var notify []watcher
+	for _, w := range s.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			notify = append(notify, w)
+		}
+	}
+	s.mu.Unlock()
+	slog.Debug("cluster config changed", "key", key, "revision", update.Revision(), "operation", update.Operation())
+	for _, w := range notify {
+		w.fn(key, value)
+	}
+}
+
+// wait blocks until the watcher delivered the revision, so the node reads
+// its own writes.
+func (s *Store) wait(ctx context.Context, revision uint64) error {
+	for {
+		s.mu.RLock()
+		done, applied := s.revision >= revision, s.applied
+		s.mu.RUnlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Get returns the current value of the key.
+func (s *Store) Get(key string) (Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.values[key]
+	return entry, ok
+}
+
+// List returns the entries with the key prefix ordered by key.
+func (s *Store) List(prefix string) []Entry {
+	s.mu.RLock()
+	entries := make([]Entry, 0, len(s.values))
+	for key, entry := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, entry)
+		}
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return entries
+}
+
+// Put stores the JSON value. A revision greater than zero only replaces the
+// value with that revision, to update without losing concurrent changes.
+func (s *Store) Put(ctx context.Context, key string, value json.RawMessage, revision uint64) (Entry, error) {
+	if !validKey(key) {
+		return Entry{}, ErrInvalidKey
+	}
+	if !json.Valid(value) {
+		return Entry{}, fmt.Errorf("%q: %w", key, ErrInvalidValue)
+	}
+	var err error
+	if revision > 0 {
+		revision, err = s.kv.Update(ctx, key, value, revision)
+	} else {
+		revision, err = s.kv.Put(ctx, key, value)
+	}
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return Entry{}, fmt.Errorf("%q: %w", key, ErrConflict)
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	if err := s.wait(ctx, revision); err != nil {
+		return Entry{}, err
+	}
+	entry, _ := s.Get(key)
+	return entry, nil
+}
+
+// Delete removes the key, the revisions are kept by the bucket history.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	if _, ok := s.Get(key); !ok {
+		return fmt.Errorf("%q: %w", key, ErrNotFound)
+	}
+	if err := s.kv.Delete(ctx, key); err != nil {
+		return err
+	}
+	status, err := s.kv.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if info, ok := status.(*jetstream.KeyValueBucketStatus); ok {
+		return s.wait(ctx, info.StreamInfo().State.LastSeq)
+	}
+	return nil
+}
+
+// Watch calls fn with the current values under the prefix and then on every
+// change, with a nil value when the key is deleted. fn runs on the watcher
+// goroutine and must not block.
+func (s *Store) Watch(prefix string, fn func(key string, value json.RawMessage)) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	s.mu.Lock()
+	s.watchers = append(s.watchers, watcher{prefix: prefix, fn: fn})
+	var current []Entry
+	for key, entry := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			current = append(current, entry)
+		}
+	}
+	s.mu.Unlock()
+	for _, entry := range current {
+		fn(entry.Key, entry.Value)
+	}
+}
+
+func (s *Store) Close() {
+	s.stop()
+}
+
+func validKey(key string) bool {
+	return reKey.MatchString(key) && !strings.HasPrefix(key, ".") && !strings.HasSuffix(key, ".")
+}
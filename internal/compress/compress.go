@@ -0,0 +1,116 @@
+// Package compress encodes the snapshot uploads with the codec named in the
+// Ha-Encoding header (or object metadata) stored next to them, so a reader
+// decodes whatever codec the writer used and objects written without the
+// header are read as is.
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Header names the codec of the encoded content.
+const Header = "Ha-Encoding"
+
+type Codec string
+
+const (
+	None   Codec = ""
+	Gzip   Codec = "gzip"
+	Zstd   Codec = "zstd"
+	Snappy Codec = "snappy"
+)
+
+// Parse validates the codec name, "none" and "" disable the compression.
+func Parse(name string) (Codec, error) {
+	switch codec := Codec(strings.ToLower(strings.TrimSpace(name))); codec {
+	case None, "none":
+		return None, nil
+	case Gzip, Zstd, Snappy:
+		return codec, nil
+	default:
+		return None, fmt.Errorf("unsupported compression %q, use none, gzip, zstd or snappy", name)
+	}
+}
+
+// NewWriter returns a writer encoding to w, it must be closed to flush the
+// encoded content.
+func NewWriter(codec Codec, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Snappy:
+		return s2.NewWriter(w, s2.WriterSnappyCompat()), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", codec)
+	}
+}
+
+// NewReader returns a reader decoding r, closing it also closes r.
+func NewReader(codec Codec, r io.ReadCloser) (io.ReadCloser, error) {
+	switch codec {
+	case None:
+		return r, nil
+	case Gzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return readCloser{Reader: zr, close: func() { zr.Close() }, src: r}, nil
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return readCloser{Reader: zr, close: zr.Close, src: r}, nil
+	case Snappy:
+		return readCloser{Reader: s2.NewReader(r), src: r}, nil
+	default:
+		r.Close()
+		return nil, fmt.Errorf("unsupported compression %q", codec)
+	}
+}
+
+// Encode copies src encoded to dst and returns the size of src.
+func Encode(codec Codec, dst io.Writer, src io.Reader) (int64, error) {
+	w, err := NewWriter(codec, dst)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		w.Close()
+		return n, err
+	}
+	return n, w.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type readCloser struct {
+	io.Reader
+	close func()
+	src   io.Closer
+}
+
+func (r readCloser) Close() error {
+	if r.close != nil {
+		r.close()
+	}
+	return r.src.Close()
+}
@@ -0,0 +1,48 @@
+package compress_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/litesql/ha/internal/compress"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("INSERT INTO users(name) VALUES('ha');"), 1000)
+	for _, name := range []string{"none", "gzip", "zstd", "snappy"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := compress.Parse(name)
+			if err != nil {
+				t.Fatalf("failed to parse codec: %v", err)
+			}
+			var encoded bytes.Buffer
+			n, err := compress.Encode(codec, &encoded, bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			if n != int64(len(data)) {
+				t.Errorf("got size %d, want %d", n, len(data))
+			}
+			if codec != compress.None && encoded.Len() >= len(data) {
+				t.Errorf("encoded %d bytes into %d", len(data), encoded.Len())
+			}
+			r, err := compress.NewReader(codec, io.NopCloser(&encoded))
+			if err != nil {
+				t.Fatalf("failed to create reader: %v", err)
+			}
+			defer r.Close()
+			decoded, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Error("decoded content differs")
+			}
+		})
+	}
+
+	if _, err := compress.Parse("lz4"); err == nil {
+		t.Error("unsupported codec: want error")
+	}
+}
@@ -0,0 +1,448 @@
+// Package consistency detects the replicas silently diverging: each node
+// hashes the rows of the tables of its databases, on demand or on a schedule,
+// and publishes the checksums over NATS, where the other nodes compare them
+// with their own at the same stream sequence.
+package consistency
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats.go"
+
+	"github.com/litesql/ha/internal/metrics"
+)
+
+// The status of the comparison with a peer.
+const (
+	StatusConsistent = "consistent"
+	StatusDivergent  = "divergent"
+	// StatusNotComparable is a peer at another stream sequence, its rows are
+	// expected to differ until it applied the same changes.
+	StatusNotComparable = "not_comparable"
+)
+
+const (
+	divergentName = "ha_consistency_divergent_tables"
+	maxAttempts   = 3
+)
+
+// Table is the checksum of the rows of a table.
+type Table struct {
+	Rows int64  `json:"rows"`
+	Hash string `json:"hash"`
+}
+
+// Report is the checksum of the tables of a database on a node, at the
+// stream sequence its rows reflect.
+type Report struct {
+	Node       string           `json:"node"`
+	Database   string           `json:"database"`
+	Seq        uint64           `json:"seq"`
+	ComputedAt time.Time        `json:"computed_at"`
+	Tables     map[string]Table `json:"tables"`
+}
+
+// Peer is the comparison of the local report with the one of another node.
+type Peer struct {
+	Node            string    `json:"node"`
+	Seq             uint64    `json:"seq"`
+	ComputedAt      time.Time `json:"computed_at"`
+	Status          string    `json:"status"`
+	DivergentTables []string  `json:"divergent_tables,omitempty"`
+}
+
+type Comparison struct {
+	Database string `json:"database"`
+	Local    Report `json:"local"`
+	Peers    []Peer `json:"peers"`
+}
+
+// Checksum hashes the rows of the tables of the database in one read
+// transaction. The rows are read ordered by primary key, or by all their
+// columns for the tables without one, so the hash does not depend on the
+// rowids. The sqlite_ and ha_ internal tables are left out, like the tables
+// match rejects when it is set.
+func Checksum(ctx context.Context, db *sql.DB, match func(table string) bool) (map[string]Table, error) {
+	ctx = ha.ContextLocalDB(ctx, true)
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	tables, err := names(ctx, tx, `SELECT name FROM pragma_table_list
+		WHERE schema = 'main' AND type = 'table' AND name NOT GLOB 'sqlite_*' AND name NOT GLOB 'ha_*'
+		ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]Table, len(tables))
+	for _, table := range tables {
+		if match != nil && !match(table) {
+			continue
+		}
+		checksum, err := tableChecksum(ctx, tx, table)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", table, err)
+		}
+		checksums[table] = checksum
+	}
+	return checksums, nil
+}
+
+func tableChecksum(ctx context.Context, tx *sql.Tx, table string) (Table, error) {
+	order, err := names(ctx, tx, "SELECT name FROM pragma_table_info(?) WHERE pk > 0 ORDER BY pk", table)
+	if err != nil {
+		return Table{}, err
+	}
+	if len(order) == 0 {
+		if order, err = names(ctx, tx, "SELECT name FROM pragma_table_info(?) ORDER BY cid", table); err != nil {
+			return Table{}, err
+		}
+	}
+	for i, column := range order {
+		order[i] = quote(column)
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s ORDER BY %s", quote(table), strings.Join(order, ", ")))
+	if err != nil {
+		return Table{}, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return Table{}, err
+	}
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	enc.Encode(columns)
+	var checksum Table
+	values := make([]any, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return Table{}, err
+		}
+		if err := enc.Encode(values); err != nil {
+			return Table{}, err
+		}
+		checksum.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		return Table{}, err
+	}
+	checksum.Hash = hex.EncodeToString(h.Sum(nil))
+	return checksum, nil
+}
+
+func names(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		list = append(list, name)
+	}
+	return list, rows.Err()
+}
+
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Compare returns the comparison of the local report with the one of a peer.
+func Compare(local, peer Report) Peer {
+	p := Peer{
+		Node:       peer.Node,
+		Seq:        peer.Seq,
+		ComputedAt: peer.ComputedAt,
+		Status:     StatusConsistent,
+	}
+	if local.Seq != peer.Seq {
+		p.Status = StatusNotComparable
+		return p
+	}
+	for table, checksum := range local.Tables {
+		if other, ok := peer.Tables[table]; !ok || other != checksum {
+			p.DivergentTables = append(p.DivergentTables, table)
+		}
+	}
+	for table := range peer.Tables {
+		if _, ok := local.Tables[table]; !ok {
+			p.DivergentTables = append(p.DivergentTables, table)
+		}
+	}
+	if len(p.DivergentTables) > 0 {
+		slices.Sort(p.DivergentTables)
+		p.Status = StatusDivergent
+	}
+	return p
+}
+
+// Config sets how the checker reads the databases of the node.
+type Config struct {
+	Node      string
+	Subject   string
+	Interval  time.Duration
+	Databases func() []string
+	DB        func(id string) (*sql.DB, error)
+	// Seq returns the stream sequence the rows of the database reflect.
+	Seq func(id string) uint64
+	// Match reports whether the table is replicated, nil for all of them.
+	Match func(table string) bool
+}
+
+type request struct {
+	Database string `json:"database"`
+}
+
+// Checker computes the reports of the local databases and keeps the latest
+// report of each peer.
+type Checker struct {
+	cfg Config
+	nc  *nats.Conn
+
+	mu      sync.Mutex
+	local   map[string]Report
+	peers   map[string]map[string]Report
+	updated chan struct{}
+}
+
+// New returns the checker publishing the reports on the subject, and
+// answering the requests of the peers to compute them. Without a NATS
+// connection, the checker only reports the local checksums.
+func New(ctx context.Context, nc *nats.Conn, cfg Config) (*Checker, error) {
+	c := &Checker{
+		cfg:     cfg,
+		nc:      nc,
+		local:   make(map[string]Report),
+		peers:   make(map[string]map[string]Report),
+		updated: make(chan struct{}),
+	}
+	if nc == nil {
+		return c, nil
+	}
+	reports, err := nc.Subscribe(cfg.Subject+".report", func(msg *nats.Msg) {
+		var report Report
+		if err := json.Unmarshal(msg.Data, &report); err != nil || report.Node == "" || report.Database == "" {
+			slog.Debug("ignoring invalid consistency report", "error", err)
+			return
+		}
+		if report.Node != cfg.Node {
+			c.receive(report)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	requests, err := nc.Subscribe(cfg.Subject+".request", func(msg *nats.Msg) {
+		var req request
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return
+		}
+		if !slices.Contains(cfg.Databases(), req.Database) {
+			return
+		}
+		go func() {
+			if _, err := c.Check(ctx, req.Database); err != nil {
+				slog.Warn("failed to compute the requested consistency checksums", "database", req.Database, "error", err)
+			}
+		}()
+	})
+	if err != nil {
+		reports.Unsubscribe()
+		return nil, err
+	}
+	context.AfterFunc(ctx, func() {
+		reports.Unsubscribe()
+		requests.Unsubscribe()
+	})
+	return c, nil
+}
+
+// Start computes the reports of every database each interval until the
+// context is done.
+func (c *Checker) Start(ctx context.Context) {
+	if c.cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, id := range c.cfg.Databases() {
+			if _, err := c.Check(ctx, id); err != nil {
+				slog.Warn("failed to compute the consistency checksums", "database", id, "error", err)
+			}
+		}
+	}
+}
+
+// Check computes the report of the database, publishes it to the peers and
+// compares it with their latest reports.
+func (c *Checker) Check(ctx context.Context, id string) (Report, error) {
+	db, err := c.cfg.DB(id)
+	if err != nil {
+		return Report{}, err
+	}
+	// the rows are read again while changes are applied meanwhile, the
+	// checksums must match the sequence
+	var (
+		seq    uint64
+		tables map[string]Table
+	)
+	for attempt := 0; ; attempt++ {
+		seq = c.cfg.Seq(id)
+		if tables, err = Checksum(ctx, db, c.cfg.Match); err != nil {
+			return Report{}, err
+		}
+		if c.cfg.Seq(id) == seq {
+			break
+		}
+		if attempt == maxAttempts-1 {
+			return Report{}, fmt.Errorf("database %s changed while computing its checksums", id)
+		}
+	}
+	report := Report{
+		Node:       c.cfg.Node,
+		Database:   id,
+		Seq:        seq,
+		ComputedAt: time.Now().UTC(),
+		Tables:     tables,
+	}
+	c.mu.Lock()
+	c.local[id] = report
+	c.mu.Unlock()
+	c.compare(id)
+	if c.nc != nil {
+		data, err := json.Marshal(report)
+		if err == nil {
+			err = c.nc.Publish(c.cfg.Subject+".report", data)
+		}
+		if err != nil {
+			slog.Warn("failed to publish the consistency report", "database", id, "error", err)
+		}
+	}
+	return report, nil
+}
+
+// Refresh computes the report of the database and asks the peers to compute
+// theirs, waiting for the known peers to answer until the context is done.
+func (c *Checker) Refresh(ctx context.Context, id string) error {
+	started := time.Now().UTC()
+	if _, err := c.Check(ctx, id); err != nil {
+		return err
+	}
+	if c.nc == nil {
+		return nil
+	}
+	data, _ := json.Marshal(request{Database: id})
+	if err := c.nc.Publish(c.cfg.Subject+".request", data); err != nil {
+		return err
+	}
+	for {
+		c.mu.Lock()
+		answered := !slices.ContainsFunc(slices.Collect(maps.Values(c.peers[id])), func(r Report) bool { return r.ComputedAt.Before(started) })
+		updated := c.updated
+		c.mu.Unlock()
+		if answered {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			// the peers not answering keep their previous report
+			return nil
+		case <-updated:
+		}
+	}
+}
+
+// Comparison compares the latest local report of the database with the ones
+// of the peers.
+func (c *Checker) Comparison(id string) (Comparison, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	local, ok := c.local[id]
+	if !ok {
+		return Comparison{}, errors.New("no checksum computed yet for database " + id)
+	}
+	comparison := Comparison{Database: id, Local: local, Peers: []Peer{}}
+	for _, peer := range c.peers[id] {
+		comparison.Peers = append(comparison.Peers, Compare(local, peer))
+	}
+	slices.SortFunc(comparison.Peers, func(a, b Peer) int { return strings.Compare(a.Node, b.Node) })
+	return comparison, nil
+}
+
+// Warnings lists the peers diverging from the local databases, for /healthz.
+func (c *Checker) Warnings() []string {
+	var warnings []string
+	for _, id := range c.cfg.Databases() {
+		comparison, err := c.Comparison(id)
+		if err != nil {
+			continue
+		}
+		for _, peer := range comparison.Peers {
+			if peer.Status == StatusDivergent {
+				warnings = append(warnings, fmt.Sprintf("database %q diverges from node %s at seq %d on tables %s",
+					id, peer.Node, peer.Seq, strings.Join(peer.DivergentTables, ", ")))
+			}
+		}
+	}
+	return warnings
+}
+
+func (c *Checker) receive(report Report) {
+	c.mu.Lock()
+	if c.peers[report.Database] == nil {
+		c.peers[report.Database] = make(map[string]Report)
+	}
+	c.peers[report.Database][report.Node] = report
+	close(c.updated)
+	c.updated = make(chan struct{})
+	c.mu.Unlock()
+	c.compare(report.Database)
+}
+
+// compare logs and counts the tables diverging from the peers reports at the
+// same sequence as the local one.
+func (c *Checker) compare(id string) {
+	comparison, err := c.Comparison(id)
+	if err != nil {
+		return
+	}
+	for _, peer := range comparison.Peers {
+		if peer.Status == StatusNotComparable {
+			continue
+		}
+		metrics.SetGauge(divergentName, "Tables whose rows differ from a peer at the same stream sequence",
+			metrics.Labels{"database": id, "peer": peer.Node}, float64(len(peer.DivergentTables)))
+		if peer.Status == StatusDivergent {
+			slog.Error("database diverges from a peer", "database", id, "peer", peer.Node, "seq", peer.Seq, "tables", peer.DivergentTables)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+//go:build cgo
+
+package consistency_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/litesql/go-sqlite3"
+
+	"github.com/litesql/ha/internal/consistency"
+)
+
+func TestChecksum(t *testing.T) {
+	open := func(name, rows string) map[string]consistency.Table {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec(`CREATE TABLE users(id INTEGER PRIMARY KEY, name TEXT, avatar BLOB);
+			CREATE TABLE events(kind TEXT, payload TEXT);
+			CREATE TABLE ha_stats(node TEXT);` + rows); err != nil {
+			t.Fatal(err)
+		}
+		tables, err := consistency.Checksum(context.Background(), db, func(table string) bool { return table != "skipped" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tables
+	}
+	// the same rows inserted in another order, under other rowids
+	a := open("a.db", `INSERT INTO users VALUES(1, 'ann', x'00ff'), (2, 'bob', NULL);
+		INSERT INTO events VALUES('a', '1'), ('b', '2');
+		INSERT INTO ha_stats VALUES('a')`)
+	b := open("b.db", `INSERT INTO users VALUES(2, 'bob', NULL), (1, 'ann', x'00ff');
+		INSERT INTO events VALUES('z', '0'), ('b', '2'), ('a', '1');
+		DELETE FROM events WHERE kind = 'z'`)
+	if _, ok := a["ha_stats"]; ok {
+		t.Errorf("internal table checksummed")
+	}
+	if a["users"] != b["users"] || a["events"] != b["events"] {
+		t.Errorf("same rows, different checksums: %v and %v", a, b)
+	}
+	if a["users"].Rows != 2 {
+		t.Errorf("got %d rows, want 2", a["users"].Rows)
+	}
+
+	c := open("c.db", `INSERT INTO users VALUES(1, 'ann', x'00fe'), (2, 'bob', NULL);
+		INSERT INTO events VALUES('a', '1'), ('b', '2')`)
+	local := consistency.Report{Node: "a", Seq: 10, Tables: a}
+	if peer := consistency.Compare(local, consistency.Report{Node: "b", Seq: 10, Tables: b}); peer.Status != consistency.StatusConsistent {
+		t.Errorf("got status %s, want %s", peer.Status, consistency.StatusConsistent)
+	}
+	peer := consistency.Compare(local, consistency.Report{Node: "c", Seq: 10, Tables: c})
+	if peer.Status != consistency.StatusDivergent || len(peer.DivergentTables) != 1 || peer.DivergentTables[0] != "users" {
+		t.Errorf("got %+v, want users divergent", peer)
+	}
+	if peer := consistency.Compare(local, consistency.Report{Node: "c", Seq: 11, Tables: c}); peer.Status != consistency.StatusNotComparable {
+		t.Errorf("got status %s, want %s", peer.Status, consistency.StatusNotComparable)
+	}
+}
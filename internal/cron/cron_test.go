@@ -0,0 +1,34 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/litesql/ha/internal/cron"
+)
+
+func TestScheduleNext(t *testing.T) {
+	from := time.Date(2026, time.March, 14, 10, 30, 0, 0, time.UTC) // Saturday
+	for _, tt := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, time.March, 14, 10, 31, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2026, time.March, 15, 3, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		{"*/20 10 * * *", time.Date(2026, time.March, 14, 10, 40, 0, 0, time.UTC)},
+		{"15 4 * * 1-5", time.Date(2026, time.March, 16, 4, 15, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1,7 *", time.Date(2026, time.July, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2026, time.March, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := cron.Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
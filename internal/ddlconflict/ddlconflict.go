@@ -0,0 +1,318 @@
+// Package ddlconflict detects the replicated DDL statements that fail on the
+// schema of this node, because it diverged from the node that ran them: a
+// column already added, a table missing. Instead of failing the changeset on
+// every delivery, the conflict is recorded and handled by the policy.
+package ddlconflict
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/metrics"
+)
+
+var ErrConflict = errors.New("replicated DDL conflicts with the local schema")
+
+type Policy string
+
+const (
+	// Halt pauses the replication of the database until the schema is fixed
+	// and the apply resumed.
+	Halt Policy = "halt"
+	// Skip applies the changeset without the conflicting statements.
+	Skip Policy = "skip"
+	// Reconcile skips the statements whose change the schema already has,
+	// like a column added with the same type, and halts on the others.
+	Reconcile Policy = "reconcile"
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case Halt, Skip, Reconcile:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid DDL conflict policy %q, use halt, skip or reconcile", s)
+}
+
+// Conflict is a replicated DDL statement that failed on the local schema,
+// kept in the ha_ddl_conflicts table of the database.
+type Conflict struct {
+	Seq        uint64    `json:"seq"`
+	Node       string    `json:"node"`
+	Statement  string    `json:"statement"`
+	Error      string    `json:"error"`
+	Action     string    `json:"action"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// The actions taken on a conflict.
+const (
+	ActionHalted     = "halted"
+	ActionSkipped    = "skipped"
+	ActionReconciled = "reconciled"
+)
+
+const (
+	tableName   = "ha_ddl_conflicts"
+	createTable = `CREATE TABLE IF NOT EXISTS ` + tableName + `(
+	seq INTEGER NOT NULL,
+	statement TEXT NOT NULL,
+	node TEXT,
+	error TEXT,
+	action TEXT,
+	detected_at TEXT,
+	PRIMARY KEY(seq, statement)
+)`
+	conflictsName = "ha_ddl_conflicts_total"
+)
+
+var (
+	reDDL = regexp.MustCompile(`(?is)^\s*(CREATE|ALTER|DROP)\s`)
+	// the errors of a statement on a schema without the objects it expects,
+	// or with the ones it creates
+	reDivergence = regexp.MustCompile(`(?i)duplicate column name|already exists|no such (table|column|index|view|trigger)`)
+
+	reAddColumn    = regexp.MustCompile(`(?is)^\s*ALTER\s+TABLE\s+(\S+)\s+ADD\s+(?:COLUMN\s+)?(\S+)\s*([A-Za-z]*)`)
+	reDropColumn   = regexp.MustCompile(`(?is)^\s*ALTER\s+TABLE\s+(\S+)\s+DROP\s+(?:COLUMN\s+)?(\S+)`)
+	reRenameColumn = regexp.MustCompile(`(?is)^\s*ALTER\s+TABLE\s+(\S+)\s+RENAME\s+(?:COLUMN\s+)?(\S+)\s+TO\s+(\S+)`)
+	reRenameTable  = regexp.MustCompile(`(?is)^\s*ALTER\s+TABLE\s+(\S+)\s+RENAME\s+TO\s+(\S+)`)
+)
+
+// Guard is a ha.ChangeSetInterceptor trying the DDL statements of the
+// changesets on the local schema before they are applied.
+type Guard struct {
+	policy Policy
+	pause  func(id string)
+
+	mu     sync.Mutex
+	halted map[string]Conflict
+}
+
+// New returns the guard applying the policy, pause stops the apply of a
+// database until it is resumed.
+func New(policy Policy, pause func(id string)) *Guard {
+	return &Guard{
+		policy: policy,
+		pause:  pause,
+		halted: make(map[string]Conflict),
+	}
+}
+
+func (g *Guard) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	if !slices.ContainsFunc(cs.Changes, isDDL) {
+		return false, nil
+	}
+	ctx := ha.ContextLocalDB(context.Background(), true)
+	failed, err := try(ctx, conn, cs.Changes)
+	if err != nil || len(failed) == 0 {
+		return false, err
+	}
+	if _, err := conn.ExecContext(ctx, createTable); err != nil {
+		return false, err
+	}
+	var halt []Conflict
+	conflicts := make(map[int]bool)
+	for i, cause := range failed {
+		c := Conflict{
+			Seq:        cs.StreamSeq,
+			Node:       cs.Node,
+			Statement:  cs.Changes[i].Command,
+			Error:      cause.Error(),
+			DetectedAt: time.Now().UTC(),
+		}
+		switch {
+		case g.policy == Skip:
+			c.Action = ActionSkipped
+		case g.policy == Reconcile && applied(ctx, conn, cs.Changes[i].Command):
+			c.Action = ActionReconciled
+		default:
+			c.Action = ActionHalted
+			halt = append(halt, c)
+		}
+		conflicts[i] = true
+		if err := record(ctx, conn, c); err != nil {
+			slog.Error("failed to record the DDL conflict", "database", cs.Filename, "seq", c.Seq, "error", err)
+		}
+		metrics.AddCounter(conflictsName, "Replicated DDL statements conflicting with the local schema",
+			metrics.Labels{"database": cs.Filename, "action": c.Action}, 1)
+	}
+	if len(halt) > 0 {
+		c := halt[0]
+		slog.Error("replication halted on a DDL conflict, fix the schema and resume the apply", "database", cs.Filename,
+			"seq", c.Seq, "node", c.Node, "statement", c.Statement, "error", c.Error)
+		g.mu.Lock()
+		g.halted[cs.Filename] = c
+		g.mu.Unlock()
+		if g.pause != nil {
+			g.pause(cs.Filename)
+		}
+		return false, fmt.Errorf("%w: %s: %s", ErrConflict, c.Statement, c.Error)
+	}
+	changes := make([]ha.Change, 0, len(cs.Changes)-len(conflicts))
+	for i, change := range cs.Changes {
+		if !conflicts[i] {
+			changes = append(changes, change)
+		} else {
+			slog.Warn("replicated DDL statement skipped", "database", cs.Filename, "seq", cs.StreamSeq, "statement", change.Command, "policy", g.policy)
+		}
+	}
+	cs.Changes = changes
+	return false, nil
+}
+
+func (g *Guard) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if err == nil {
+		g.mu.Lock()
+		delete(g.halted, cs.Filename)
+		g.mu.Unlock()
+	}
+	return err
+}
+
+// Warnings lists the databases halted on a conflict, for /healthz.
+func (g *Guard) Warnings() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var warnings []string
+	for id, c := range g.halted {
+		warnings = append(warnings, fmt.Sprintf("database %q replication halted at seq %d on the DDL conflict %q: %s", id, c.Seq, c.Statement, c.Error))
+	}
+	slices.Sort(warnings)
+	return warnings
+}
+
+// Halted returns the conflict the replication of the database is halted on.
+func (g *Guard) Halted(id string) (Conflict, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.halted[id]
+	return c, ok
+}
+
+func isDDL(change ha.Change) bool {
+	return change.Operation == "SQL" && reDDL.MatchString(change.Command)
+}
+
+// try runs the DDL statements in order in a transaction rolled back, and
+// returns the ones failing with a divergence of the schema by index.
+func try(ctx context.Context, conn *sql.Conn, changes []ha.Change) (map[int]error, error) {
+	if _, err := conn.ExecContext(ctx, "SAVEPOINT ha_ddl_try"); err != nil {
+		return nil, err
+	}
+	defer func() {
+		conn.ExecContext(ctx, "ROLLBACK TO ha_ddl_try")
+		conn.ExecContext(ctx, "RELEASE ha_ddl_try")
+	}()
+	failed := make(map[int]error)
+	for i, change := range changes {
+		if !isDDL(change) {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, "SAVEPOINT ha_ddl_statement"); err != nil {
+			return nil, err
+		}
+		_, err := conn.ExecContext(ctx, change.Command, change.Args...)
+		if err != nil {
+			if _, err := conn.ExecContext(ctx, "ROLLBACK TO ha_ddl_statement"); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := conn.ExecContext(ctx, "RELEASE ha_ddl_statement"); err != nil {
+			return nil, err
+		}
+		if err != nil && reDivergence.MatchString(err.Error()) {
+			failed[i] = err
+		}
+	}
+	return failed, nil
+}
+
+// applied reports whether the schema already has the change of the failed
+// statement: the column added with the same type, the column or table
+// dropped or renamed.
+func applied(ctx context.Context, conn *sql.Conn, statement string) bool {
+	if m := reAddColumn.FindStringSubmatch(statement); m != nil {
+		typ, ok := columnType(ctx, conn, m[1], m[2])
+		return ok && strings.EqualFold(typ, m[3])
+	}
+	if m := reRenameTable.FindStringSubmatch(statement); m != nil {
+		return !exists(ctx, conn, m[1]) && exists(ctx, conn, m[2])
+	}
+	if m := reRenameColumn.FindStringSubmatch(statement); m != nil {
+		_, from := columnType(ctx, conn, m[1], m[2])
+		_, to := columnType(ctx, conn, m[1], m[3])
+		return !from && to
+	}
+	if m := reDropColumn.FindStringSubmatch(statement); m != nil {
+		_, ok := columnType(ctx, conn, m[1], m[2])
+		return exists(ctx, conn, m[1]) && !ok
+	}
+	// CREATE and DROP are replicated with IF [NOT] EXISTS, they do not fail
+	// on an object already created or dropped
+	return false
+}
+
+func columnType(ctx context.Context, conn *sql.Conn, table, column string) (string, bool) {
+	var typ string
+	err := conn.QueryRowContext(ctx, "SELECT type FROM pragma_table_info(?) WHERE name = ? COLLATE NOCASE", unquote(table), unquote(column)).Scan(&typ)
+	return typ, err == nil
+}
+
+func exists(ctx context.Context, conn *sql.Conn, table string) bool {
+	var n int
+	err := conn.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_schema WHERE type = 'table' AND name = ? COLLATE NOCASE", unquote(table)).Scan(&n)
+	return err == nil && n > 0
+}
+
+func unquote(name string) string {
+	if len(name) >= 2 {
+		switch name[0] {
+		case '"', '`', '[':
+			return name[1 : len(name)-1]
+		}
+	}
+	return name
+}
+
+func record(ctx context.Context, conn *sql.Conn, c Conflict) error {
+	_, err := conn.ExecContext(ctx, "REPLACE INTO "+tableName+"(seq, statement, node, error, action, detected_at) VALUES(?, ?, ?, ?, ?, ?)",
+		c.Seq, c.Statement, c.Node, c.Error, c.Action, c.DetectedAt.Format(time.RFC3339Nano))
+	return err
+}
+
+// List returns the conflicts recorded in the database, the most recent first.
+func List(ctx context.Context, db *sql.DB) ([]Conflict, error) {
+	ctx = ha.ContextLocalDB(ctx, true)
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_schema WHERE name = ?", tableName).Scan(&n); err != nil || n == 0 {
+		return []Conflict{}, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT seq, statement, COALESCE(node, ''), COALESCE(error, ''), COALESCE(action, ''), COALESCE(detected_at, '') FROM "+tableName+" ORDER BY seq DESC, detected_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Conflict{}
+	for rows.Next() {
+		var (
+			c          Conflict
+			detectedAt string
+		)
+		if err := rows.Scan(&c.Seq, &c.Statement, &c.Node, &c.Error, &c.Action, &detectedAt); err != nil {
+			return nil, err
+		}
+		c.DetectedAt, _ = time.Parse(time.RFC3339Nano, detectedAt)
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
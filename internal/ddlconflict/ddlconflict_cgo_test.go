@@ -0,0 +1,93 @@
+//go:build cgo
+
+package ddlconflict_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/litesql/go-ha"
+	_ "github.com/litesql/go-sqlite3"
+
+	"github.com/litesql/ha/internal/ddlconflict"
+)
+
+func TestGuard(t *testing.T) {
+	ddl := func(statements ...string) *ha.ChangeSet {
+		cs := &ha.ChangeSet{Node: "node2", Filename: "ha.db", StreamSeq: 7}
+		for _, s := range statements {
+			cs.Changes = append(cs.Changes, ha.Change{Operation: "SQL", Command: s})
+		}
+		return cs
+	}
+	tests := []struct {
+		name    string
+		policy  ddlconflict.Policy
+		cs      *ha.ChangeSet
+		changes int
+		halted  bool
+		action  string
+	}{
+		{"no conflict", ddlconflict.Halt, ddl("ALTER TABLE users ADD COLUMN age INTEGER"), 1, false, ""},
+		{"halt", ddlconflict.Halt, ddl("ALTER TABLE users ADD COLUMN email TEXT"), 1, true, ddlconflict.ActionHalted},
+		{"skip", ddlconflict.Skip, ddl("ALTER TABLE orders ADD COLUMN total REAL", "CREATE TABLE IF NOT EXISTS logs(id)"), 1, false, ddlconflict.ActionSkipped},
+		{"reconcile same type", ddlconflict.Reconcile, ddl("ALTER TABLE users ADD COLUMN email TEXT"), 0, false, ddlconflict.ActionReconciled},
+		{"reconcile other type", ddlconflict.Reconcile, ddl("ALTER TABLE users ADD COLUMN email BLOB"), 1, true, ddlconflict.ActionHalted},
+		{"reconcile dropped column", ddlconflict.Reconcile, ddl("ALTER TABLE users DROP COLUMN phone"), 0, false, ddlconflict.ActionReconciled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "ha.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if _, err := db.Exec("CREATE TABLE users(id INTEGER PRIMARY KEY, email TEXT)"); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			var paused string
+			guard := ddlconflict.New(tt.policy, func(id string) { paused = id })
+			_, err = guard.BeforeApply(tt.cs, conn)
+			if got := errors.Is(err, ddlconflict.ErrConflict); got != tt.halted {
+				t.Fatalf("got error %v, want halted %v", err, tt.halted)
+			}
+			if tt.halted && paused != "ha.db" {
+				t.Errorf("paused %q, want ha.db", paused)
+			}
+			if !tt.halted && len(tt.cs.Changes) != tt.changes {
+				t.Errorf("got %d changes to apply, want %d", len(tt.cs.Changes), tt.changes)
+			}
+			// the statements tried are rolled back
+			var columns int
+			if err := conn.QueryRowContext(context.Background(), "SELECT count(*) FROM pragma_table_info('users')").Scan(&columns); err != nil {
+				t.Fatal(err)
+			}
+			if columns != 2 {
+				t.Errorf("users has %d columns after the check, want 2", columns)
+			}
+
+			conflicts, err := ddlconflict.List(context.Background(), db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.action == "" {
+				if len(conflicts) != 0 {
+					t.Errorf("recorded %+v, want no conflict", conflicts)
+				}
+				return
+			}
+			if len(conflicts) != 1 || conflicts[0].Action != tt.action || conflicts[0].Seq != 7 {
+				t.Errorf("recorded %+v, want one %s conflict at seq 7", conflicts, tt.action)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+// Package flowcontrol throttles the replicated changesets applied by the
+// node, so a replica catching up on a long stream backlog leaves room for the
+// foreground queries. The subscribers apply one changeset at a time per
+// database: waiting before the apply holds the next messages in the stream.
+package flowcontrol
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litesql/go-ha"
+)
+
+var (
+	ErrPaused = errors.New("replication apply paused")
+	ErrBusy   = errors.New("replication apply concurrency exhausted")
+)
+
+// maxWait bounds a single wait before the apply, below the 30s the stream
+// waits for an ack before delivering the message again. A changeset still
+// paused after it fails and is delivered again later.
+var maxWait = 20 * time.Second
+
+type Config struct {
+	// Concurrency is the number of changesets applied at once across the
+	// databases, 0 is unlimited.
+	Concurrency int
+	// RateLimit is the number of row changes applied per second, 0 is
+	// unlimited.
+	RateLimit int
+	// BatchSize is the number of changes applied at full speed before the
+	// rate limit applies, RateLimit when 0.
+	BatchSize int
+	// Windows pause or throttle the apply on a schedule.
+	Windows []Window
+}
+
+type Status struct {
+	Concurrency int      `json:"concurrency"`
+	RateLimit   int      `json:"rate_limit"`
+	BatchSize   int      `json:"batch_size"`
+	PausedAll   bool     `json:"paused_all"`
+	Paused      []string `json:"paused"`
+	Applying    int64    `json:"applying"`
+	Waiting     int64    `json:"waiting"`
+	Throttled   uint64   `json:"throttled"`
+	// Windows are the scheduled windows, Active when the apply is paused or
+	// throttled by them now.
+	Windows []WindowStatus `json:"windows,omitempty"`
+}
+
+// Controller is a ha.ChangeSetInterceptor delaying the apply of the
+// changesets while paused, above the concurrency or above the rate limit.
+type Controller struct {
+	cfg   Config
+	slots chan struct{}
+
+	mu        sync.Mutex
+	pausedAll bool
+	paused    map[string]bool
+	resumed   chan struct{}
+	windows   []Window
+
+	bucketMu sync.Mutex
+	tokens   float64
+	last     time.Time
+
+	// started holds the changesets being applied, and whether they took a
+	// concurrency slot.
+	started   sync.Map
+	applying  atomic.Int64
+	waiting   atomic.Int64
+	throttled atomic.Uint64
+}
+
+func New(cfg Config) *Controller {
+	if cfg.RateLimit > 0 && cfg.BatchSize <= 0 {
+		cfg.BatchSize = cfg.RateLimit
+	}
+	c := &Controller{
+		cfg:     cfg,
+		paused:  make(map[string]bool),
+		resumed: make(chan struct{}),
+		windows: cfg.Windows,
+		tokens:  float64(cfg.BatchSize),
+		last:    time.Now(),
+	}
+	if cfg.Concurrency > 0 {
+		c.slots = make(chan struct{}, cfg.Concurrency)
+	}
+	return c
+}
+
+func (c *Controller) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	c.waiting.Add(1)
+	defer c.waiting.Add(-1)
+	start := time.Now()
+	deadline := time.NewTimer(maxWait)
+	defer deadline.Stop()
+	for {
+		paused, resumed, until := c.pausedFor(cs.Filename, time.Now())
+		if !paused {
+			break
+		}
+		// a window ends by itself, without Resume
+		var ended <-chan time.Time
+		if !until.IsZero() {
+			timer := time.NewTimer(time.Until(until))
+			defer timer.Stop()
+			ended = timer.C
+		}
+		select {
+		case <-resumed:
+		case <-ended:
+		case <-deadline.C:
+			return false, ErrPaused
+		}
+	}
+	slot := c.slots != nil
+	if slot {
+		select {
+		case c.slots <- struct{}{}:
+		case <-deadline.C:
+			return false, ErrBusy
+		}
+	}
+	c.started.Store(cs, slot)
+	c.applying.Add(1)
+	if d := c.reserve(len(cs.Changes)); d > 0 {
+		c.throttled.Add(1)
+		time.Sleep(min(d, maxWait-time.Since(start)))
+	}
+	return false, nil
+}
+
+func (c *Controller) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if slot, ok := c.started.LoadAndDelete(cs); ok {
+		c.applying.Add(-1)
+		if slot.(bool) {
+			<-c.slots
+		}
+	}
+	return err
+}
+
+// reserve takes n changes from the bucket and returns how long to wait for
+// them. The bucket may go negative, a changeset larger than the batch size
+// delays the next ones.
+func (c *Controller) reserve(n int) time.Duration {
+	now := time.Now()
+	rate, batch := c.limits(now)
+	if rate <= 0 {
+		return 0
+	}
+	c.bucketMu.Lock()
+	defer c.bucketMu.Unlock()
+	c.tokens = min(float64(batch), c.tokens+now.Sub(c.last).Seconds()*float64(rate))
+	c.last = now
+	c.tokens -= float64(n)
+	if c.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-c.tokens / float64(rate) * float64(time.Second))
+}
+
+// limits returns the rate limit and batch size now, the lowest of the
+// configuration and of the active throttle windows.
+func (c *Controller) limits(now time.Time) (rate, batch int) {
+	rate, batch = c.cfg.RateLimit, c.cfg.BatchSize
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.windows {
+		if w.Action != WindowThrottle {
+			continue
+		}
+		if _, ok := w.active(now); ok && (rate <= 0 || w.RateLimit < rate) {
+			rate = w.RateLimit
+		}
+	}
+	if batch <= 0 || batch > rate {
+		batch = rate
+	}
+	return rate, batch
+}
+
+// pausedFor reports whether the apply of the database is paused, until the
+// end of a pause window or, when until is zero, until resumed.
+func (c *Controller) pausedFor(id string, now time.Time) (paused bool, resumed <-chan struct{}, until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pausedAll || c.paused[id] {
+		return true, c.resumed, time.Time{}
+	}
+	for _, w := range c.windows {
+		if w.Action != WindowPause {
+			continue
+		}
+		if end, ok := w.active(now); ok && end.After(until) {
+			paused, until = true, end
+		}
+	}
+	return paused, c.resumed, until
+}
+
+// SetWindows replaces the scheduled windows.
+func (c *Controller) SetWindows(windows []Window) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.windows = windows
+	// the changesets waiting for a window removed are applied now
+	close(c.resumed)
+	c.resumed = make(chan struct{})
+}
+
+// Pause stops applying the changesets of the database id, of every database
+// when id is empty. The changesets wait in the stream.
+func (c *Controller) Pause(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == "" {
+		c.pausedAll = true
+		return
+	}
+	c.paused[id] = true
+}
+
+// Resume applies again the changesets of the database id, of every database
+// when id is empty.
+func (c *Controller) Resume(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == "" {
+		c.pausedAll = false
+		clear(c.paused)
+	} else {
+		delete(c.paused, id)
+	}
+	close(c.resumed)
+	c.resumed = make(chan struct{})
+}
+
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	paused := make([]string, 0, len(c.paused))
+	for id := range c.paused {
+		paused = append(paused, id)
+	}
+	pausedAll := c.pausedAll
+	now := time.Now()
+	windows := make([]WindowStatus, 0, len(c.windows))
+	for _, w := range c.windows {
+		end, active := w.active(now)
+		next := end
+		if !active {
+			next = w.Schedule.Next(now)
+		}
+		windows = append(windows, WindowStatus{Window: w, Active: active, Next: next})
+	}
+	c.mu.Unlock()
+	slices.Sort(paused)
+	return Status{
+		Concurrency: c.cfg.Concurrency,
+		RateLimit:   c.cfg.RateLimit,
+		BatchSize:   c.cfg.BatchSize,
+		PausedAll:   pausedAll,
+		Paused:      paused,
+		Applying:    c.applying.Load(),
+		Waiting:     c.waiting.Load(),
+		Throttled:   c.throttled.Load(),
+		Windows:     windows,
+	}
+}
@@ -0,0 +1,124 @@
+package flowcontrol_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/flowcontrol"
+)
+
+func TestPauseResume(t *testing.T) {
+	c := flowcontrol.New(flowcontrol.Config{})
+	c.Pause("a.db")
+	done := make(chan error, 1)
+	cs := ha.NewChangeSet("node", "a.db")
+	go func() {
+		_, err := c.BeforeApply(cs, nil)
+		done <- err
+	}()
+	other := ha.NewChangeSet("node", "b.db")
+	if _, err := c.BeforeApply(other, nil); err != nil {
+		t.Fatal(err)
+	}
+	c.AfterApply(other, nil, nil)
+	select {
+	case err := <-done:
+		t.Fatalf("applied while paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if st := c.Status(); len(st.Paused) != 1 || st.Waiting != 1 {
+		t.Errorf("unexpected status %+v", st)
+	}
+	c.Resume("a.db")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not resumed")
+	}
+	c.AfterApply(cs, nil, nil)
+}
+
+func TestConcurrency(t *testing.T) {
+	c := flowcontrol.New(flowcontrol.Config{Concurrency: 1})
+	first := ha.NewChangeSet("node", "a.db")
+	if _, err := c.BeforeApply(first, nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	second := ha.NewChangeSet("node", "b.db")
+	go func() {
+		_, err := c.BeforeApply(second, nil)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("second changeset applied before the first finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.AfterApply(first, nil, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.AfterApply(second, nil, nil)
+	if st := c.Status(); st.Applying != 0 {
+		t.Errorf("applying = %d, want 0", st.Applying)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := flowcontrol.New(flowcontrol.Config{RateLimit: 100, BatchSize: 10})
+	cs := ha.NewChangeSet("node", "a.db")
+	cs.Changes = make([]ha.Change, 15)
+	start := time.Now()
+	for range 2 {
+		if _, err := c.BeforeApply(cs, nil); err != nil {
+			t.Fatal(err)
+		}
+		c.AfterApply(cs, nil, nil)
+	}
+	// 30 changes with 10 at full speed wait for 20 at 100/s
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("applied in %s, want about 200ms", elapsed)
+	}
+	if st := c.Status(); st.Throttled == 0 {
+		t.Error("expected throttled changesets")
+	}
+}
+
+func TestWindows(t *testing.T) {
+	windows, err := flowcontrol.ParseWindows("pause 1h=* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := flowcontrol.New(flowcontrol.Config{Windows: windows})
+	if st := c.Status(); len(st.Windows) != 1 || !st.Windows[0].Active {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	done := make(chan error, 1)
+	cs := ha.NewChangeSet("node", "a.db")
+	go func() {
+		_, err := c.BeforeApply(cs, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("applied in a pause window: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.SetWindows(nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.AfterApply(cs, nil, nil)
+
+	for _, spec := range []string{"pause=@daily", "pause 1h", "throttle 1h=@daily", "pause 10 1h=@daily", "stop 1h=@daily", "pause 0s=@daily"} {
+		if _, err := flowcontrol.ParseWindows(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
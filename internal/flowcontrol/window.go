@@ -0,0 +1,150 @@
+package flowcontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litesql/ha/internal/cron"
+)
+
+var ErrInvalidWindow = errors.New("invalid apply window")
+
+const (
+	// WindowPause holds the changesets in the stream during the window.
+	WindowPause = "pause"
+	// WindowThrottle applies the changesets at the rate limit of the window.
+	WindowThrottle = "throttle"
+)
+
+// Window pauses or throttles the apply for Duration from each time matching
+// the schedule, the changesets waiting in the stream are applied at full
+// speed once it ends.
+type Window struct {
+	Action   string
+	Schedule *cron.Schedule
+	Duration time.Duration
+	// RateLimit is the row changes applied per second by a throttle window.
+	RateLimit int
+}
+
+type windowJSON struct {
+	Action    string `json:"action"`
+	Schedule  string `json:"schedule"`
+	Duration  string `json:"duration"`
+	RateLimit int    `json:"rate_limit,omitempty"`
+}
+
+func (w Window) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.json())
+}
+
+func (w Window) json() windowJSON {
+	return windowJSON{
+		Action:    w.Action,
+		Schedule:  w.Schedule.String(),
+		Duration:  w.Duration.String(),
+		RateLimit: w.RateLimit,
+	}
+}
+
+func (w *Window) UnmarshalJSON(b []byte) error {
+	var v windowJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(v.Duration)
+	if err != nil {
+		return fmt.Errorf("%w: duration %q: %w", ErrInvalidWindow, v.Duration, err)
+	}
+	window, err := newWindow(v.Action, v.RateLimit, duration, v.Schedule)
+	if err != nil {
+		return err
+	}
+	*w = window
+	return nil
+}
+
+func newWindow(action string, rateLimit int, duration time.Duration, schedule string) (Window, error) {
+	action = strings.ToLower(strings.TrimSpace(action))
+	switch {
+	case action != WindowPause && action != WindowThrottle:
+		return Window{}, fmt.Errorf("%w: action %q, use pause or throttle", ErrInvalidWindow, action)
+	case action == WindowThrottle && rateLimit <= 0:
+		return Window{}, fmt.Errorf("%w: a throttle window needs a positive rate limit", ErrInvalidWindow)
+	case action == WindowPause && rateLimit != 0:
+		return Window{}, fmt.Errorf("%w: a pause window has no rate limit", ErrInvalidWindow)
+	case duration <= 0:
+		return Window{}, fmt.Errorf("%w: the duration must be positive", ErrInvalidWindow)
+	}
+	s, err := cron.Parse(schedule)
+	if err != nil {
+		return Window{}, fmt.Errorf("%w: %w", ErrInvalidWindow, err)
+	}
+	return Window{Action: action, Schedule: s, Duration: duration, RateLimit: rateLimit}, nil
+}
+
+// ParseWindows parses a semicolon separated list of "pause duration=cron" or
+// "throttle rate duration=cron", e.g. "pause 2h=0 1 * * *;throttle 100
+// 8h=0 9 * * 1-5".
+func ParseWindows(spec string) ([]Window, error) {
+	var windows []Window
+	for entry := range strings.SplitSeq(spec, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		head, schedule, ok := strings.Cut(entry, "=")
+		fields := strings.Fields(head)
+		if !ok || len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%w %q: use pause duration=cron or throttle rate duration=cron", ErrInvalidWindow, entry)
+		}
+		var rateLimit int
+		if len(fields) == 3 {
+			var err error
+			if rateLimit, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, fmt.Errorf("%w %q: invalid rate limit", ErrInvalidWindow, entry)
+			}
+		}
+		duration, err := time.ParseDuration(fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", ErrInvalidWindow, entry, err)
+		}
+		window, err := newWindow(fields[0], rateLimit, duration, schedule)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// active returns the end of the window when now is in it.
+func (w Window) active(now time.Time) (time.Time, bool) {
+	start := w.Schedule.Next(now.Add(-w.Duration))
+	if start.IsZero() || start.After(now) {
+		return time.Time{}, false
+	}
+	return start.Add(w.Duration), true
+}
+
+type WindowStatus struct {
+	Window
+	Active bool `json:"active"`
+	// Next is the start of the next window, or the end of the active one.
+	Next time.Time `json:"next"`
+}
+
+func (s WindowStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		windowJSON
+		Active bool      `json:"active"`
+		Next   time.Time `json:"next"`
+	}{
+		windowJSON: s.json(),
+		Active:     s.Active,
+		Next:       s.Next,
+	})
+}
@@ -0,0 +1,194 @@
+// Package handoff records the replication position of the nodes in a NATS
+// JetStream KV bucket, so a restarted node resumes the replication from its
+// last applied sequence even when its durable consumers were removed, instead
+// of replaying the stream from the start.
+//
+// A node records its position periodically while running, announces that it
+// is restarting when it receives a shutdown signal and records its final
+// position once its clients are gone.
+package handoff
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateStopped    = "stopped"
+)
+
+type Config struct {
+	Bucket   string
+	Replicas int
+	Node     string
+}
+
+// Record is the replication position of a node: the last stream sequence
+// applied to each of its databases.
+type Record struct {
+	Node      string            `json:"node"`
+	State     string            `json:"state"`
+	Sequences map[string]uint64 `json:"sequences"`
+	Updated   time.Time         `json:"updated"`
+}
+
+type Handoff struct {
+	kv  jetstream.KeyValue
+	cfg Config
+
+	// mu keeps the final record from being overwritten by a periodic one
+	mu      sync.Mutex
+	stopped bool
+}
+
+// New creates the bucket if needed.
+func New(ctx context.Context, nc *nats.Conn, cfg Config) (*Handoff, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:   cfg.Bucket,
+		History:  1,
+		Storage:  jetstream.FileStorage,
+		Replicas: cfg.Replicas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create handoff bucket %q: %w", cfg.Bucket, err)
+	}
+	return &Handoff{kv: kv, cfg: cfg}, nil
+}
+
+// Load returns the record of the previous run of the node, false when there
+// is none.
+func (h *Handoff) Load(ctx context.Context) (Record, bool, error) {
+	entry, err := h.kv.Get(ctx, key(h.cfg.Node))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return Record{}, false, nil
+	}
+	if err != nil {
+		return Record{}, false, err
+	}
+	var record Record
+	if err := json.Unmarshal(entry.Value(), &record); err != nil {
+		return Record{}, false, fmt.Errorf("invalid handoff record of node %s: %w", h.cfg.Node, err)
+	}
+	return record, true, nil
+}
+
+// Save records the state and the sequences of the node. Nothing is recorded
+// after the stopped state, the periodic saves can't overwrite the final
+// position.
+func (h *Handoff) Save(ctx context.Context, state string, sequences map[string]uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		return nil
+	}
+	data, err := json.Marshal(Record{
+		Node:      h.cfg.Node,
+		State:     state,
+		Sequences: sequences,
+		Updated:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := h.kv.Put(ctx, key(h.cfg.Node), data); err != nil {
+		return fmt.Errorf("save handoff record: %w", err)
+	}
+	h.stopped = state == StateStopped
+	return nil
+}
+
+// Start saves the running state with the sequences every interval until ctx
+// is done.
+func (h *Handoff) Start(ctx context.Context, interval time.Duration, sequences func() map[string]uint64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.Save(ctx, StateRunning, sequences()); err != nil {
+				slog.Warn("failed to record the replication position", "error", err)
+			}
+		}
+	}
+}
+
+// Forget removes the record of the node, a decommissioned node starts again
+// from its own database or from scratch.
+func (h *Handoff) Forget(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = true
+	err := h.kv.Delete(ctx, key(h.cfg.Node))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+// List returns the records of every node, sorted by node.
+func (h *Handoff) List(ctx context.Context) ([]Record, error) {
+	keys, err := h.kv.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer keys.Stop()
+	var names []string
+	for k := range keys.Keys() {
+		names = append(names, k)
+	}
+	records := make(map[string]Record)
+	for _, name := range names {
+		entry, err := h.kv.Get(ctx, name)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var record Record
+		if err := json.Unmarshal(entry.Value(), &record); err != nil {
+			continue
+		}
+		records[record.Node] = record
+	}
+	list := make([]Record, 0, len(records))
+	for _, node := range slices.Sorted(maps.Keys(records)) {
+		list = append(list, records[node])
+	}
+	return list, nil
+}
+
+// key escapes the node name to the characters of the KV keys, = and the
+// other ones become =XX.
+func key(node string) string {
+	var sb strings.Builder
+	for i := 0; i < len(node); i++ {
+		c := node[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "=%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,112 @@
+package handoff_test
+
+import (
+	"context"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/litesql/ha/internal/handoff"
+)
+
+func runJetStream(t *testing.T) *nats.Conn {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestHandoff(t *testing.T) {
+	ctx := context.Background()
+	nc := runJetStream(t)
+	node1, err := handoff.New(ctx, nc, handoff.Config{Bucket: "handoff", Node: "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the name is escaped to a key of the bucket
+	other, err := handoff.New(ctx, nc, handoff.Config{Bucket: "handoff", Node: "node.2 b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := node1.Load(ctx); err != nil || ok {
+		t.Fatalf("got a record %v, %v before the first save", ok, err)
+	}
+	running := map[string]uint64{"ha.db": 5}
+	if err := node1.Save(ctx, handoff.StateRunning, running); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Save(ctx, handoff.StateRestarting, nil); err != nil {
+		t.Fatal(err)
+	}
+	record, ok, err := node1.Load(ctx)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v after the save", ok, err)
+	}
+	if record.Node != "node1" || record.State != handoff.StateRunning || !maps.Equal(record.Sequences, running) {
+		t.Errorf("got %+v, want the running record", record)
+	}
+
+	// the final position is not overwritten by a periodic save
+	stopped := map[string]uint64{"ha.db": 7}
+	if err := node1.Save(ctx, handoff.StateStopped, stopped); err != nil {
+		t.Fatal(err)
+	}
+	if err := node1.Save(ctx, handoff.StateRunning, running); err != nil {
+		t.Fatal(err)
+	}
+	record, _, err = node1.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.State != handoff.StateStopped || !maps.Equal(record.Sequences, stopped) {
+		t.Errorf("got %+v, want the stopped record", record)
+	}
+
+	list, err := node1.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Node != "node.2 b" || list[1].Node != "node1" {
+		t.Fatalf("got %+v, want the records of both nodes sorted", list)
+	}
+
+	if err := other.Forget(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := other.Load(ctx); err != nil || ok {
+		t.Errorf("got a record %v, %v after forget", ok, err)
+	}
+	list, err = node1.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Node != "node1" {
+		t.Errorf("got %+v, want the record of node1", list)
+	}
+	if err := other.Forget(ctx); err != nil {
+		t.Errorf("forget without record: %v", err)
+	}
+}
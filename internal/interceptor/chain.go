@@ -0,0 +1,45 @@
+package interceptor
+
+import (
+	"database/sql"
+
+	"github.com/litesql/go-ha"
+)
+
+type chain []ha.ChangeSetInterceptor
+
+// Chain combines interceptors into a single ha.ChangeSetInterceptor.
+// BeforeApply stops at the first interceptor asking to skip or returning an error,
+// AfterApply passes the error returned by each interceptor to the next one.
+func Chain(interceptors ...ha.ChangeSetInterceptor) ha.ChangeSetInterceptor {
+	list := make(chain, 0, len(interceptors))
+	for _, i := range interceptors {
+		if i != nil {
+			list = append(list, i)
+		}
+	}
+	switch len(list) {
+	case 0:
+		return nil
+	case 1:
+		return list[0]
+	}
+	return list
+}
+
+func (c chain) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	for _, i := range c {
+		skip, err := i.BeforeApply(cs, conn)
+		if err != nil || skip {
+			return skip, err
+		}
+	}
+	return false, nil
+}
+
+func (c chain) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	for _, i := range c {
+		err = i.AfterApply(cs, conn, err)
+	}
+	return err
+}
@@ -1,13 +1,18 @@
 package interceptor
 
 import (
+	"cmp"
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/litesql/go-ha"
 	"github.com/traefik/yaegi/interp"
 	"github.com/traefik/yaegi/stdlib"
+
+	"github.com/litesql/ha/internal/session"
 )
 
 //go:generate go run github.com/traefik/yaegi/cmd/yaegi extract github.com/litesql/go-ha
@@ -17,7 +22,7 @@ type beforeFn func(changeSet *ha.ChangeSet, conn *sql.Conn) (bool, error)
 
 type afterFn func(changeSet *ha.ChangeSet, conn *sql.Conn, err error) error
 
-func Load(filename string) (ha.ChangeSetInterceptor, error) {
+func eval(filename string) (*interp.Interpreter, error) {
 	src, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
@@ -28,6 +33,14 @@ func Load(filename string) (ha.ChangeSetInterceptor, error) {
 	if err != nil {
 		return nil, err
 	}
+	return i, nil
+}
+
+func Load(filename string) (ha.ChangeSetInterceptor, error) {
+	i, err := eval(filename)
+	if err != nil {
+		return nil, err
+	}
 
 	var (
 		before beforeFn
@@ -50,7 +63,11 @@ func Load(filename string) (ha.ChangeSetInterceptor, error) {
 		}
 	}
 
-	return newInterceptor(before, after), nil
+	interceptor := newInterceptor(before, after)
+	if interceptor == nil {
+		return nil, nil
+	}
+	return interceptor, nil
 }
 
 func newInterceptor(before beforeFn, after afterFn) *baseInterceptor {
@@ -88,3 +105,111 @@ func noopBefore(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
 func noopAfter(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
 	return err
 }
+
+type beforeQueryFn func(ctx context.Context, database string, stmt *ha.Statement) (string, error)
+
+type afterQueryFn func(ctx context.Context, database string, stmt *ha.Statement, err error)
+
+// LoadQuery returns the query hooks of the script, nil when it has none. The
+// interceptor calls ha.Query with the statements of the clients before they
+// are executed, then ha.BeforeQuery with each parsed statement. The observer
+// calls ha.AfterQuery once the statements are executed.
+func LoadQuery(filename string) (session.QueryInterceptor, session.QueryObserver, error) {
+	i, err := eval(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		query session.QueryInterceptor
+		after afterQueryFn
+	)
+	if queryReflect, err := i.Eval("ha.Query"); err == nil {
+		fn, ok := queryReflect.Interface().(func(ctx context.Context, database, query string) (string, error))
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid ha.Query signature")
+		}
+		query = fn
+	}
+	if beforeReflect, err := i.Eval("ha.BeforeQuery"); err == nil {
+		before, ok := beforeReflect.Interface().(func(ctx context.Context, database string, stmt *ha.Statement) (string, error))
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid ha.BeforeQuery signature")
+		}
+		query = withBeforeQuery(query, before)
+	}
+	if afterReflect, err := i.Eval("ha.AfterQuery"); err == nil {
+		fn, ok := afterReflect.Interface().(func(ctx context.Context, database string, stmt *ha.Statement, err error))
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid ha.AfterQuery signature")
+		}
+		after = fn
+	}
+	if after == nil {
+		return query, nil, nil
+	}
+	return query, observer(after), nil
+}
+
+// withBeforeQuery calls before with the statements returned by query. The
+// statements the parser does not understand are rejected, the script could
+// not filter them.
+func withBeforeQuery(query session.QueryInterceptor, before beforeQueryFn) session.QueryInterceptor {
+	return func(ctx context.Context, database, sql string) (string, error) {
+		if query != nil {
+			var err error
+			if sql, err = query(ctx, database, sql); err != nil {
+				return "", err
+			}
+		}
+		stmts, err := parse(ctx, sql)
+		if err != nil {
+			return "", fmt.Errorf("statement not understood by the query interceptor: %w", err)
+		}
+		var (
+			rewritten = make([]string, len(stmts))
+			changed   bool
+		)
+		for i, stmt := range stmts {
+			source, err := before(ctx, database, stmt)
+			if err != nil {
+				return "", err
+			}
+			if source == "" {
+				source = stmt.Source()
+			} else {
+				changed = true
+			}
+			rewritten[i] = source
+		}
+		if !changed {
+			return sql, nil
+		}
+		return strings.Join(rewritten, ";\n"), nil
+	}
+}
+
+func observer(after afterQueryFn) session.QueryObserver {
+	return func(ctx context.Context, database, sql string, err error) {
+		stmts, parseErr := parse(ctx, sql)
+		if parseErr != nil {
+			return
+		}
+		for _, stmt := range stmts {
+			after(ctx, database, stmt, err)
+		}
+	}
+}
+
+// parse falls back to ParseStatement for the statements it handles without
+// the parser, like the PostgreSQL BEGIN.
+func parse(ctx context.Context, sql string) ([]*ha.Statement, error) {
+	stmts, err := ha.Parse(ctx, sql)
+	if err == nil && len(stmts) > 0 {
+		return stmts, nil
+	}
+	stmt, stmtErr := ha.ParseStatement(ctx, sql)
+	if stmtErr != nil {
+		return nil, cmp.Or(err, stmtErr)
+	}
+	return []*ha.Statement{stmt}, nil
+}
@@ -1,11 +1,16 @@
 package interceptor_test
 
 import (
+	"context"
 	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/litesql/go-ha"
 	"github.com/litesql/ha/internal/interceptor"
+	"github.com/litesql/ha/internal/session"
 )
 
 func TestLoad(t *testing.T) {
@@ -22,3 +27,83 @@ func TestLoad(t *testing.T) {
 		t.Errorf("expect nil error, got %v", err)
 	}
 }
+
+func TestLoadQuery(t *testing.T) {
+	query, _, err := interceptor.LoadQuery("./testdata/row_level_security.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := session.NewContext(context.Background(), session.Identity{User: "alice", Protocol: "postgresql"})
+	got, err := query(ctx, "ha.db", "SELECT id FROM orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SELECT id FROM (SELECT * FROM orders WHERE owner = 'alice') AS orders"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+	if _, err := query(ctx, "ha.db", "UPDATE prices SET value = 0"); err == nil {
+		t.Error("expect the write to prices to be rejected")
+	}
+	admin := session.NewContext(context.Background(), session.Identity{User: "admin", Protocol: "http"})
+	if got, err := query(admin, "ha.db", "UPDATE prices SET value = 0"); err != nil || got != "UPDATE prices SET value = 0" {
+		t.Errorf("admin query = %q, %v", got, err)
+	}
+
+	i, err := interceptor.Load("./testdata/row_level_security.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := new(ha.ChangeSet)
+	cs.AddChange(ha.Change{Table: "prices", Operation: "UPDATE"})
+	session.Attach(cs, session.Identity{User: "alice", Protocol: "postgresql"})
+	if skip, err := i.BeforeApply(cs, nil); err != nil || !skip {
+		t.Errorf("BeforeApply(alice) = %v, %v, want skip", skip, err)
+	}
+	cs.Changes = cs.Changes[1:]
+	session.Attach(cs, session.Identity{User: "admin", Protocol: "http"})
+	if skip, err := i.BeforeApply(cs, nil); err != nil || skip {
+		t.Errorf("BeforeApply(admin) = %v, %v, want apply", skip, err)
+	}
+}
+
+func TestLoadBeforeAfterQuery(t *testing.T) {
+	query, observer, err := interceptor.LoadQuery("./testdata/audit_queries.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if query == nil || observer == nil {
+		t.Fatal("expect the query interceptor and observer")
+	}
+	ctx := session.NewContext(context.Background(), session.Identity{User: "alice", Protocol: "mysql"})
+	got, err := query(ctx, "ha.db", "SELECT id FROM orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(got, " LIMIT 100") {
+		t.Errorf("query = %q, want a LIMIT", got)
+	}
+	if got, err := query(ctx, "ha.db", "INSERT INTO orders(id) VALUES(1)"); err != nil || got != "INSERT INTO orders(id) VALUES(1)" {
+		t.Errorf("insert = %q, %v, want it unchanged", got, err)
+	}
+	for _, stmt := range []string{"DELETE FROM orders", "DROP TABLE orders", "INSERT INTO orders(id) VALUES(1); DELETE FROM orders"} {
+		if _, err := query(ctx, "ha.db", stmt); err == nil {
+			t.Errorf("expect %q to be rejected", stmt)
+		}
+	}
+	admin := session.NewContext(context.Background(), session.Identity{User: "admin", Protocol: "http"})
+	if got, err := query(admin, "ha.db", "DELETE FROM orders"); err != nil || got != "DELETE FROM orders" {
+		t.Errorf("admin delete = %q, %v", got, err)
+	}
+
+	observer(ctx, "ha.db", "INSERT INTO orders(id) VALUES(1)", nil)
+	observer(admin, "ha.db", "DELETE FROM orders", errors.New("locked"))
+	data, err := os.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "alice ha.db INSERT <nil>\nadmin ha.db DELETE locked\n"; string(data) != want {
+		t.Errorf("audit log = %q, want %q", data, want)
+	}
+}
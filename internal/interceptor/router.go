@@ -0,0 +1,213 @@
+package interceptor
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/litesql/go-ha"
+)
+
+// controlTableName is the go-ha table of the changes every release skips
+// when applying, like the session identity.
+const controlTableName = "ha_stats"
+
+// Route sends the changes of the tables matching Tables, in the changesets
+// of the nodes matching Nodes, to its interceptor. An empty list matches
+// everything.
+type Route struct {
+	Tables      []string
+	Nodes       []string
+	Interceptor ha.ChangeSetInterceptor
+}
+
+// ParseRoutes parses a semicolon separated list of match=script, match being
+// a comma separated list of table:glob and node:glob, e.g.
+// "table:orders*,table:payments=billing.go;node:eu-*=eu.go". The scripts are
+// loaded with Load.
+func ParseRoutes(spec string) ([]Route, error) {
+	var routes []Route
+	for entry := range strings.SplitSeq(spec, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		match, script, ok := strings.Cut(entry, "=")
+		script = strings.TrimSpace(script)
+		if !ok || script == "" {
+			return nil, fmt.Errorf("invalid interceptor route %q, use table:glob,node:glob=script.go", entry)
+		}
+		var route Route
+		for item := range strings.SplitSeq(match, ",") {
+			kind, pattern, ok := strings.Cut(strings.TrimSpace(item), ":")
+			pattern = strings.TrimSpace(pattern)
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return nil, fmt.Errorf("invalid pattern %q in interceptor route %q", item, entry)
+			}
+			switch {
+			case ok && kind == "table":
+				route.Tables = append(route.Tables, strings.ToLower(pattern))
+			case ok && kind == "node":
+				route.Nodes = append(route.Nodes, pattern)
+			default:
+				return nil, fmt.Errorf("invalid match %q in interceptor route %q, use table:glob or node:glob", item, entry)
+			}
+		}
+		i, err := Load(script)
+		if err != nil {
+			return nil, fmt.Errorf("interceptor route %q: %w", entry, err)
+		}
+		if i == nil {
+			return nil, fmt.Errorf("interceptor route %q: the script has no ha.Before nor ha.After", entry)
+		}
+		route.Interceptor = i
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (r Route) matchNode(node string) bool {
+	return len(r.Nodes) == 0 || slices.ContainsFunc(r.Nodes, func(pattern string) bool {
+		ok, _ := path.Match(pattern, node)
+		return ok
+	})
+}
+
+func (r Route) matchTable(table string) bool {
+	table = strings.ToLower(table)
+	return len(r.Tables) == 0 || slices.ContainsFunc(r.Tables, func(pattern string) bool {
+		ok, _ := path.Match(pattern, table)
+		return ok
+	})
+}
+
+// router is a ha.ChangeSetInterceptor splitting the changesets between the
+// routes. Each change goes to the first route matching it, the changes no
+// route matches are applied as they are.
+type router struct {
+	routes []Route
+	// parts holds the changesets each route got from BeforeApply, for
+	// AfterApply.
+	parts sync.Map
+}
+
+// Router returns the interceptor of the routes, nil without routes.
+func Router(routes []Route) ha.ChangeSetInterceptor {
+	if len(routes) == 0 {
+		return nil
+	}
+	return &router{routes: routes}
+}
+
+// part is the changeset given to the interceptor of a route: the control
+// changes, then the changes of the route at the positions of the original.
+type part struct {
+	route     int
+	cs        *ha.ChangeSet
+	positions []int
+}
+
+func (r *router) split(cs *ha.ChangeSet) []*part {
+	var control []ha.Change
+	for _, change := range cs.Changes {
+		if change.Table == controlTableName {
+			control = append(control, change)
+		}
+	}
+	var parts []*part
+	byRoute := make(map[int]*part)
+	for pos, change := range cs.Changes {
+		if change.Table == controlTableName {
+			continue
+		}
+		idx := slices.IndexFunc(r.routes, func(route Route) bool {
+			return route.matchNode(cs.Node) && route.matchTable(change.Table)
+		})
+		if idx < 0 {
+			continue
+		}
+		p, ok := byRoute[idx]
+		if !ok {
+			sub := *cs
+			sub.Changes = slices.Clone(control)
+			p = &part{route: idx, cs: &sub}
+			byRoute[idx] = p
+			parts = append(parts, p)
+		}
+		p.cs.Changes = append(p.cs.Changes, change)
+		p.positions = append(p.positions, pos)
+	}
+	return parts
+}
+
+func (r *router) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	parts := r.split(cs)
+	if len(parts) == 0 {
+		return false, nil
+	}
+	replaced := make(map[int][]ha.Change)
+	for i, p := range parts {
+		skip, err := r.routes[p.route].Interceptor.BeforeApply(p.cs, conn)
+		if err != nil {
+			r.parts.Store(cs, parts[:i+1])
+			return false, err
+		}
+		var changes []ha.Change
+		if !skip {
+			for _, change := range p.cs.Changes {
+				if change.Table != controlTableName {
+					changes = append(changes, change)
+				}
+			}
+		}
+		if len(changes) == len(p.positions) {
+			// in place, the order of the changes across the routes is kept
+			for i, pos := range p.positions {
+				replaced[pos] = []ha.Change{changes[i]}
+			}
+			continue
+		}
+		// the route added or removed changes: they take the position of
+		// the first change of the route
+		replaced[p.positions[0]] = changes
+		for _, pos := range p.positions[1:] {
+			replaced[pos] = nil
+		}
+	}
+	changes := make([]ha.Change, 0, len(cs.Changes))
+	rows := 0
+	for pos, change := range cs.Changes {
+		list, ok := replaced[pos]
+		if !ok {
+			list = []ha.Change{change}
+		}
+		for _, c := range list {
+			if c.Table != controlTableName {
+				rows++
+			}
+		}
+		changes = append(changes, list...)
+	}
+	cs.Changes = changes
+	r.parts.Store(cs, parts)
+	// every change was skipped by its route
+	return rows == 0, nil
+}
+
+func (r *router) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	parts, ok := r.parts.LoadAndDelete(cs)
+	if !ok {
+		return err
+	}
+	// each route sees the error of the apply, which is cleared when every
+	// route returns nil
+	var result error
+	for _, p := range parts.([]*part) {
+		if routeErr := r.routes[p.route].Interceptor.AfterApply(p.cs, conn, err); routeErr != nil && result == nil {
+			result = routeErr
+		}
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+package interceptor_test
+
+import (
+	"database/sql"
+	"slices"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/interceptor"
+)
+
+type funcInterceptor struct {
+	before func(cs *ha.ChangeSet) bool
+	seen   []string
+}
+
+func (f *funcInterceptor) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	for _, change := range cs.Changes {
+		f.seen = append(f.seen, change.Table)
+	}
+	return f.before(cs), nil
+}
+
+func (f *funcInterceptor) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	return err
+}
+
+func TestRouter(t *testing.T) {
+	// drops the deletes of the orders tables
+	orders := &funcInterceptor{before: func(cs *ha.ChangeSet) bool {
+		cs.Changes = slices.DeleteFunc(cs.Changes, func(c ha.Change) bool { return c.Operation == "DELETE" })
+		return false
+	}}
+	// skips the users changes of the eu nodes
+	users := &funcInterceptor{before: func(cs *ha.ChangeSet) bool { return true }}
+	router := interceptor.Router([]interceptor.Route{
+		{Tables: []string{"order*"}, Interceptor: orders},
+		{Tables: []string{"users"}, Nodes: []string{"eu-*"}, Interceptor: users},
+	})
+
+	cs := ha.NewChangeSet("eu-1", "ha.db")
+	cs.Changes = []ha.Change{
+		{Table: "orders", Operation: "INSERT"},
+		{Table: "users", Operation: "UPDATE"},
+		{Table: "order_items", Operation: "DELETE"},
+		{Table: "logs", Operation: "INSERT"},
+	}
+	skip, err := router.BeforeApply(cs, nil)
+	if err != nil || skip {
+		t.Fatalf("BeforeApply = %v, %v", skip, err)
+	}
+	var tables []string
+	for _, change := range cs.Changes {
+		tables = append(tables, change.Table)
+	}
+	if !slices.Equal(tables, []string{"orders", "logs"}) {
+		t.Errorf("applied tables = %v, want [orders logs]", tables)
+	}
+	if !slices.Equal(orders.seen, []string{"orders", "order_items"}) || !slices.Equal(users.seen, []string{"users"}) {
+		t.Errorf("routes saw %v and %v", orders.seen, users.seen)
+	}
+	if err := router.AfterApply(cs, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the users route does not match the other nodes
+	users.seen = nil
+	cs = ha.NewChangeSet("us-1", "ha.db")
+	cs.Changes = []ha.Change{{Table: "users", Operation: "UPDATE"}}
+	if skip, err := router.BeforeApply(cs, nil); err != nil || skip || len(users.seen) != 0 {
+		t.Errorf("BeforeApply(us-1) = %v, %v, users saw %v", skip, err, users.seen)
+	}
+	router.AfterApply(cs, nil, nil)
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := interceptor.ParseRoutes("table:orders*,node:eu-*=./testdata/ignore_alter_table_errors.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || !slices.Equal(routes[0].Tables, []string{"orders*"}) || !slices.Equal(routes[0].Nodes, []string{"eu-*"}) {
+		t.Errorf("unexpected routes %+v", routes)
+	}
+	for _, spec := range []string{"orders=x.go", "table:orders", "table:[=x.go"} {
+		if _, err := interceptor.ParseRoutes(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
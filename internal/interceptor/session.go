@@ -0,0 +1,19 @@
+package interceptor
+
+import (
+	"reflect"
+
+	"github.com/litesql/ha/internal/session"
+)
+
+// the scripts import the session package as github.com/litesql/ha/session
+func init() {
+	Symbols["github.com/litesql/ha/session/session"] = map[string]reflect.Value{
+		"ChangeSetUser": reflect.ValueOf(session.ChangeSetUser),
+		"FromChangeSet": reflect.ValueOf(session.FromChangeSet),
+		"FromContext":   reflect.ValueOf(session.FromContext),
+		"User":          reflect.ValueOf(session.User),
+
+		"Identity": reflect.ValueOf((*session.Identity)(nil)),
+	}
+}
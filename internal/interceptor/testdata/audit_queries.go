@@ -0,0 +1,37 @@
+package ha
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/litesql/go-ha"
+	"github.com/litesql/ha/session"
+)
+
+// BeforeQuery rejects the DDL and DELETE statements of the users other than
+// admin and limits the rows of their queries.
+func BeforeQuery(ctx context.Context, database string, stmt *ha.Statement) (string, error) {
+	if session.User(ctx) == "admin" {
+		return "", nil
+	}
+	if stmt.DDL() || stmt.Type() == ha.TypeDrop || stmt.IsDelete() {
+		return "", errors.New("only admin can change the schema or delete rows")
+	}
+	if stmt.IsSelect() && !strings.Contains(strings.ToUpper(stmt.Source()), " LIMIT ") {
+		return stmt.Source() + " LIMIT 100", nil
+	}
+	return "", nil
+}
+
+// AfterQuery appends the statements executed to the audit.log file.
+func AfterQuery(ctx context.Context, database string, stmt *ha.Statement, err error) {
+	f, openErr := os.OpenFile("audit.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if openErr != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s %s %v\n", session.User(ctx), database, stmt.Type(), err)
+}
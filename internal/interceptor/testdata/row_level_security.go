@@ -0,0 +1,39 @@
+package ha
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/litesql/go-ha"
+	"github.com/litesql/ha/session"
+)
+
+// Query lets the users other than admin read only their own orders and
+// rejects their writes to the prices table.
+func Query(ctx context.Context, database, query string) (string, error) {
+	user := session.User(ctx)
+	if user == "admin" {
+		return query, nil
+	}
+	upper := strings.ToUpper(query)
+	if strings.Contains(upper, "PRICES") && !strings.HasPrefix(strings.TrimSpace(upper), "SELECT") {
+		return "", errors.New("only admin can change the prices")
+	}
+	return strings.ReplaceAll(query, "FROM orders", "FROM (SELECT * FROM orders WHERE owner = '"+strings.ReplaceAll(user, "'", "''")+"') AS orders"), nil
+}
+
+// Before skips the replicated changes to the prices table not committed by
+// admin.
+func Before(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	if session.ChangeSetUser(cs) == "admin" {
+		return false, nil
+	}
+	for _, change := range cs.Changes {
+		if change.Table == "prices" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,239 @@
+package invalidation
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats.go"
+)
+
+// AllTables is reported when a change modifies the schema and the affected
+// table cannot be derived from the changeset (DDL statements).
+const AllTables = "*"
+
+const controlTableName = "ha_stats"
+
+type Event struct {
+	Database  string    `json:"database"`
+	Tables    []string  `json:"tables"`
+	Node      string    `json:"node"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Callback func(Event)
+
+type Config struct {
+	Node     string
+	Debounce time.Duration
+	// MaxWait caps the time the notifications of a database are delayed while
+	// new ones keep resetting the debounce timer.
+	MaxWait    time.Duration
+	WebhookURL string
+	Subject    string
+}
+
+type Notifier struct {
+	node       string
+	debounce   time.Duration
+	maxWait    time.Duration
+	webhookURL string
+	subject    string
+	natsConn   *nats.Conn
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	pending   map[string]*batch
+	callbacks map[int]Callback
+	nextID    int
+}
+
+// batch holds the tables notified for a database until they are flushed.
+type batch struct {
+	tables   map[string]struct{}
+	timer    *time.Timer
+	deadline time.Time
+}
+
+func New(cfg Config) *Notifier {
+	return &Notifier{
+		node:       cfg.Node,
+		debounce:   cfg.Debounce,
+		maxWait:    max(cfg.MaxWait, cfg.Debounce),
+		webhookURL: cfg.WebhookURL,
+		subject:    cfg.Subject,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		pending:    make(map[string]*batch),
+		callbacks:  make(map[int]Callback),
+	}
+}
+
+// SetNatsConn enables publishing invalidation events to the configured subject.
+func (n *Notifier) SetNatsConn(nc *nats.Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.natsConn = nc
+}
+
+// Subscribe registers an in-process callback and returns a function to remove it.
+func (n *Notifier) Subscribe(cb Callback) func() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	id := n.nextID
+	n.nextID++
+	n.callbacks[id] = cb
+	return func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.callbacks, id)
+	}
+}
+
+// Notify records the tables as modified. Events are emitted per database once
+// the debounce interval elapses without new notifications, or when the first
+// pending notification is older than the max wait.
+func (n *Notifier) Notify(database string, tables ...string) {
+	if len(tables) == 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b, scheduled := n.pending[database]
+	if !scheduled {
+		b = &batch{
+			tables:   make(map[string]struct{}),
+			deadline: time.Now().Add(n.maxWait),
+		}
+		n.pending[database] = b
+	}
+	for _, table := range tables {
+		b.tables[table] = struct{}{}
+	}
+	if n.debounce <= 0 {
+		if !scheduled {
+			go n.flush(database, b)
+		}
+		return
+	}
+	wait := min(n.debounce, time.Until(b.deadline))
+	if b.timer == nil {
+		b.timer = time.AfterFunc(wait, func() {
+			n.flush(database, b)
+		})
+		return
+	}
+	b.timer.Reset(wait)
+}
+
+func (n *Notifier) flush(database string, b *batch) {
+	n.mu.Lock()
+	// a timer reset after it fired runs again once the batch is flushed
+	if n.pending[database] != b {
+		n.mu.Unlock()
+		return
+	}
+	delete(n.pending, database)
+	set := b.tables
+	callbacks := make([]Callback, 0, len(n.callbacks))
+	for _, cb := range n.callbacks {
+		callbacks = append(callbacks, cb)
+	}
+	nc := n.natsConn
+	n.mu.Unlock()
+	if len(set) == 0 {
+		return
+	}
+
+	tables := make([]string, 0, len(set))
+	for table := range set {
+		tables = append(tables, table)
+	}
+	slices.Sort(tables)
+	event := Event{
+		Database:  database,
+		Tables:    tables,
+		Node:      n.node,
+		Timestamp: time.Now(),
+	}
+	slog.Debug("tables invalidated", "database", database, "tables", tables)
+
+	for _, cb := range callbacks {
+		cb(event)
+	}
+
+	if n.webhookURL == "" && (nc == nil || n.subject == "") {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("failed to marshal invalidation event", "error", err)
+		return
+	}
+	if nc != nil && n.subject != "" {
+		if err := nc.Publish(n.subject, data); err != nil {
+			slog.Error("failed to publish invalidation event", "error", err, "subject", n.subject)
+		}
+	}
+	if n.webhookURL != "" {
+		if err := n.postWebhook(data); err != nil {
+			slog.Error("failed to send invalidation webhook", "error", err, "url", n.webhookURL)
+		}
+	}
+}
+
+func (n *Notifier) postWebhook(data []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, n.webhookURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	return false, nil
+}
+
+func (n *Notifier) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if err == nil {
+		n.Notify(cs.Filename, Tables(cs)...)
+	}
+	return err
+}
+
+// Tables returns the distinct tables modified by the changeset.
+func Tables(cs *ha.ChangeSet) []string {
+	var tables []string
+	for _, change := range cs.Changes {
+		table := change.Table
+		if table == controlTableName {
+			continue
+		}
+		if table == "" {
+			if change.Operation != "SQL" {
+				continue
+			}
+			table = AllTables
+		}
+		if !slices.Contains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
@@ -0,0 +1,92 @@
+package invalidation_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/litesql/ha/internal/invalidation"
+)
+
+func subscribe(t *testing.T, n *invalidation.Notifier) <-chan invalidation.Event {
+	events := make(chan invalidation.Event, 10)
+	t.Cleanup(n.Subscribe(func(e invalidation.Event) {
+		events <- e
+	}))
+	return events
+}
+
+func TestNotifyCoalesces(t *testing.T) {
+	n := invalidation.New(invalidation.Config{Node: "node", Debounce: 50 * time.Millisecond, MaxWait: time.Second})
+	events := subscribe(t, n)
+	n.Notify("app.db", "users")
+	n.Notify("app.db", "orders", "users")
+	n.Notify("other.db", "logs")
+
+	got := make(map[string][]string)
+	for range 2 {
+		select {
+		case e := <-events:
+			got[e.Database] = e.Tables
+		case <-time.After(time.Second):
+			t.Fatalf("missing events, got %v", got)
+		}
+	}
+	if !slices.Equal(got["app.db"], []string{"orders", "users"}) {
+		t.Errorf("want the coalesced tables of app.db, got %v", got["app.db"])
+	}
+	if !slices.Equal(got["other.db"], []string{"logs"}) {
+		t.Errorf("want the tables of other.db, got %v", got["other.db"])
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestNotifyResetsTimer(t *testing.T) {
+	debounce := 100 * time.Millisecond
+	n := invalidation.New(invalidation.Config{Debounce: debounce, MaxWait: time.Minute})
+	events := subscribe(t, n)
+	// every notification arrives before the debounce interval elapses
+	for range 5 {
+		n.Notify("app.db", "users")
+		select {
+		case e := <-events:
+			t.Fatalf("event emitted while notifications keep arriving: %+v", e)
+		case <-time.After(debounce / 2):
+		}
+	}
+	last := time.Now()
+	select {
+	case <-events:
+		if elapsed := time.Since(last); elapsed < debounce/2 {
+			t.Errorf("event emitted %s after the last notification, want the debounce interval", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("missing event after the notifications stopped")
+	}
+}
+
+func TestNotifyMaxWait(t *testing.T) {
+	debounce := 50 * time.Millisecond
+	maxWait := 200 * time.Millisecond
+	n := invalidation.New(invalidation.Config{Debounce: debounce, MaxWait: maxWait})
+	events := subscribe(t, n)
+	start := time.Now()
+	timeout := time.After(time.Second)
+	for {
+		n.Notify("app.db", "users")
+		select {
+		case <-events:
+			if elapsed := time.Since(start); elapsed < maxWait {
+				t.Errorf("event emitted after %s, before the max wait", elapsed)
+			}
+			return
+		case <-timeout:
+			t.Fatal("the notifications delayed the event past the max wait")
+		case <-time.After(debounce / 5):
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package journal records the replicated changesets applied by the node to
+// compressed local files, so a postmortem can reconstruct what a replica
+// executed. The changes are written before the apply and the outcome after
+// it: a changeset without outcome was being applied when the node stopped.
+package journal
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/compress"
+)
+
+const (
+	// EventApply is written before the apply, with the changes.
+	EventApply   = "apply"
+	EventApplied = "applied"
+	EventFailed  = "failed"
+	// EventSkipped is a changeset an interceptor skipped, it is written
+	// with the changes.
+	EventSkipped = "skipped"
+)
+
+// prefix names the journal files, followed by the UTC time the file was
+// started.
+const prefix = "apply-"
+
+type Config struct {
+	Dir         string
+	Compression compress.Codec
+	// Rotate starts a new file after this long, 1h when 0.
+	Rotate time.Duration
+	// Retention removes the files older than this, 0 keeps them all.
+	Retention time.Duration
+}
+
+type Record struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Database  string    `json:"database"`
+	Subject   string    `json:"subject,omitempty"`
+	StreamSeq uint64    `json:"stream_seq"`
+	// Node and ProcessID identify the origin of the changeset, Timestamp is
+	// its commit time on the origin.
+	Node       string      `json:"node,omitempty"`
+	ProcessID  int64       `json:"process_id,omitempty"`
+	Timestamp  int64       `json:"timestamp_ns,omitempty"`
+	Changes    []ha.Change `json:"changes,omitempty"`
+	DurationMS float64     `json:"duration_ms,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Journal is a ha.ChangeSetInterceptor writing the records, it goes last in
+// the chain to see the changes as the other interceptors left them.
+type Journal struct {
+	cfg Config
+
+	started sync.Map
+
+	mu      sync.Mutex
+	file    *os.File
+	buf     *bufio.Writer
+	enc     io.WriteCloser
+	openAt  time.Time
+	lastErr error
+}
+
+func Open(cfg Config) (*Journal, error) {
+	if cfg.Rotate <= 0 {
+		cfg.Rotate = time.Hour
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	j := &Journal{cfg: cfg}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	now := time.Now()
+	j.started.Store(cs, now)
+	rec := record(cs, EventApply, now)
+	rec.Changes = cs.Changes
+	j.write(rec)
+	return false, nil
+}
+
+func (j *Journal) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	now := time.Now()
+	start, applied := j.started.LoadAndDelete(cs)
+	rec := record(cs, EventApplied, now)
+	switch {
+	case applied:
+		rec.DurationMS = float64(now.Sub(start.(time.Time)).Microseconds()) / 1000
+		if err != nil {
+			rec.Event = EventFailed
+		}
+	case err != nil:
+		// An interceptor rejected the changeset before the journal.
+		rec.Event = EventFailed
+	default:
+		rec.Event = EventSkipped
+		rec.Changes = cs.Changes
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	j.write(rec)
+	return err
+}
+
+func record(cs *ha.ChangeSet, event string, now time.Time) Record {
+	return Record{
+		Time:      now.UTC(),
+		Event:     event,
+		Database:  cs.Filename,
+		Subject:   cs.Subject,
+		StreamSeq: cs.StreamSeq,
+		Node:      cs.Node,
+		ProcessID: cs.ProcessID,
+		Timestamp: cs.Timestamp,
+	}
+}
+
+// write appends the record and flushes it to the file, a failure is logged
+// and does not stop the apply.
+func (j *Journal) write(rec Record) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		slog.Warn("failed to encode apply journal record", "database", rec.Database, "stream_seq", rec.StreamSeq, "error", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.append(rec.Time, append(data, '\n')); err != nil {
+		// Log the first error of a series only.
+		if j.lastErr == nil {
+			slog.Error("failed to write the apply journal", "dir", j.cfg.Dir, "error", err)
+		}
+		j.lastErr = err
+		return
+	}
+	j.lastErr = nil
+}
+
+func (j *Journal) append(now time.Time, data []byte) error {
+	if j.enc == nil || now.Sub(j.openAt) >= j.cfg.Rotate {
+		if err := j.rotate(now); err != nil {
+			return err
+		}
+	}
+	if _, err := j.enc.Write(data); err != nil {
+		return err
+	}
+	// Flush the codec on every record, the journal must be readable up to
+	// the last record after a crash.
+	if f, ok := j.enc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return j.buf.Flush()
+}
+
+func (j *Journal) rotate(now time.Time) error {
+	if err := j.closeFile(); err != nil {
+		slog.Warn("failed to close the apply journal", "file", j.file.Name(), "error", err)
+	}
+	name := filepath.Join(j.cfg.Dir, prefix+now.UTC().Format("20060102T150405.000Z")+".jsonl"+extension(j.cfg.Compression))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(f)
+	enc, err := compress.NewWriter(j.cfg.Compression, buf)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file, j.buf, j.enc, j.openAt = f, buf, enc, now
+	j.prune(now)
+	return nil
+}
+
+func (j *Journal) closeFile() error {
+	if j.enc == nil {
+		return nil
+	}
+	enc, buf, f := j.enc, j.buf, j.file
+	j.enc = nil
+	err := enc.Close()
+	if ferr := buf.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// prune removes the files older than the retention, the current file is
+// never removed.
+func (j *Journal) prune(now time.Time) {
+	if j.cfg.Retention <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(j.cfg.Dir)
+	if err != nil {
+		slog.Warn("failed to list the apply journal files", "dir", j.cfg.Dir, "error", err)
+		return
+	}
+	current := filepath.Base(j.file.Name())
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) || entry.Name() == current {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < j.cfg.Retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(j.cfg.Dir, entry.Name())); err != nil {
+			slog.Warn("failed to remove an expired apply journal file", "file", entry.Name(), "error", err)
+		}
+	}
+}
+
+// Close finishes the current file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.closeFile(); err != nil {
+		return fmt.Errorf("close apply journal: %w", err)
+	}
+	return nil
+}
+
+func extension(codec compress.Codec) string {
+	switch codec {
+	case compress.Gzip:
+		return ".gz"
+	case compress.Zstd:
+		return ".zst"
+	case compress.Snappy:
+		return ".sz"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,101 @@
+package journal_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/compress"
+	"github.com/litesql/ha/internal/journal"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	j, err := journal.Open(journal.Config{Dir: dir, Compression: compress.Gzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := ha.NewChangeSet("node1", "ha.db")
+	applied.StreamSeq = 1
+	applied.AddChange(ha.Change{Table: "users", Operation: "INSERT", Columns: []string{"id"}, NewValues: []any{int64(1)}})
+	if _, err := j.BeforeApply(applied, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.AfterApply(applied, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := ha.NewChangeSet("node1", "ha.db")
+	failed.StreamSeq = 2
+	j.BeforeApply(failed, nil)
+	errApply := errors.New("UNIQUE constraint failed")
+	if err := j.AfterApply(failed, nil, errApply); !errors.Is(err, errApply) {
+		t.Fatalf("AfterApply returned %v", err)
+	}
+
+	skipped := ha.NewChangeSet("node2", "ha.db")
+	skipped.StreamSeq = 3
+	skipped.AddChange(ha.Change{Table: "audit", Operation: "DELETE"})
+	j.AfterApply(skipped, nil, nil)
+
+	// The records are flushed before Close.
+	records := read(t, dir)
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		event   string
+		seq     uint64
+		changes int
+	}{
+		{journal.EventApply, 1, 1},
+		{journal.EventApplied, 1, 0},
+		{journal.EventApply, 2, 0},
+		{journal.EventFailed, 2, 0},
+		{journal.EventSkipped, 3, 1},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %+v", len(records), len(want), records)
+	}
+	for i, w := range want {
+		r := records[i]
+		if r.Event != w.event || r.StreamSeq != w.seq || len(r.Changes) != w.changes {
+			t.Errorf("record %d = %s seq %d with %d changes, want %s seq %d with %d changes", i, r.Event, r.StreamSeq, len(r.Changes), w.event, w.seq, w.changes)
+		}
+	}
+	if records[3].Error != errApply.Error() {
+		t.Errorf("failed record error = %q", records[3].Error)
+	}
+}
+
+func read(t *testing.T, dir string) []journal.Record {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "apply-*.jsonl.gz"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("journal files %v: %v", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := compress.NewReader(compress.Gzip, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var records []journal.Record
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec journal.Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
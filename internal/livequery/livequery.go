@@ -0,0 +1,426 @@
+// Package livequery re-executes the registered SELECT statements when the
+// changesets applied or published by the node modify the tables they read,
+// so the clients are pushed the new results instead of polling.
+package livequery
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/invalidation"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+var (
+	ErrNotFound = errors.New("live query not found")
+	ErrTooMany  = errors.New("too many live queries")
+	ErrNotQuery = errors.New("live queries must be a SELECT")
+)
+
+type Config struct {
+	// Debounce coalesces the changes of the tables before the queries are
+	// executed again.
+	Debounce time.Duration
+	// TTL removes the queries without clients for longer.
+	TTL time.Duration
+	Max int
+}
+
+// Result is the result of a query execution, Version increases each time
+// the rows change.
+type Result struct {
+	Version uint64   `json:"version"`
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Diff are the rows added and removed by the Version execution of the query,
+// compared with the previous one.
+type Diff struct {
+	Version uint64  `json:"version"`
+	Added   [][]any `json:"added"`
+	Removed [][]any `json:"removed"`
+}
+
+type Query struct {
+	Token  string         `json:"token"`
+	DB     string         `json:"database"`
+	SQL    string         `json:"sql"`
+	Params map[string]any `json:"params,omitempty"`
+	// Tables read by the query, "*" when they could not be determined.
+	Tables []string `json:"tables"`
+
+	refresh sync.Mutex
+
+	mu       sync.RWMutex
+	result   *Result
+	keys     []string
+	diff     *Diff
+	changed  chan struct{}
+	watchers int
+	lastSeen time.Time
+}
+
+// Result returns the last result and the diff from the previous one, nil for
+// the first execution.
+func (q *Query) Result() (*Result, *Diff) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.result, q.diff
+}
+
+// Wait blocks until the result version differs from version or the context
+// is done, and returns the last result.
+func (q *Query) Wait(ctx context.Context, version uint64) (*Result, *Diff) {
+	q.mu.Lock()
+	q.watchers++
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.watchers--
+		q.lastSeen = time.Now()
+		q.mu.Unlock()
+	}()
+	for {
+		q.mu.RLock()
+		result, diff, changed := q.result, q.diff, q.changed
+		q.mu.RUnlock()
+		if result.Version != version {
+			return result, diff
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return result, diff
+		}
+	}
+}
+
+type Manager struct {
+	cfg Config
+
+	mu      sync.Mutex
+	queries map[string]*Query
+	pending map[string]map[string]struct{}
+}
+
+func New(cfg Config) *Manager {
+	return &Manager{
+		cfg:     cfg,
+		queries: make(map[string]*Query),
+		pending: make(map[string]map[string]struct{}),
+	}
+}
+
+// Register executes the query and keeps it live. The token identifies it
+// in the next requests.
+func (m *Manager) Register(ctx context.Context, id, query string, params map[string]any) (*Query, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, fmt.Errorf("sql %w", sqlite.ErrMissingParameter)
+	}
+	if !sqlite.IsQuery(query) {
+		return nil, ErrNotQuery
+	}
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		id = sqlite.DefaultDatabase()
+	}
+	tables, err := ReadTables(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+	q := &Query{
+		Token:    rand.Text(),
+		DB:       id,
+		SQL:      query,
+		Params:   params,
+		Tables:   tables,
+		changed:  make(chan struct{}),
+		lastSeen: time.Now(),
+	}
+	if err := m.execute(ctx, q); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cfg.Max > 0 && len(m.queries) >= m.cfg.Max {
+		return nil, fmt.Errorf("%w, the limit is %d", ErrTooMany, m.cfg.Max)
+	}
+	m.queries[q.Token] = q
+	slog.Debug("live query registered", "token", q.Token, "database", id, "tables", tables)
+	return q, nil
+}
+
+func (m *Manager) Get(token string) (*Query, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.queries[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return q, nil
+}
+
+func (m *Manager) Remove(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.queries[token]; !ok {
+		return ErrNotFound
+	}
+	delete(m.queries, token)
+	return nil
+}
+
+// Start removes the queries without clients for longer than the TTL.
+func (m *Manager) Start(ctx context.Context) {
+	if m.cfg.TTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(m.cfg.TTL/2, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		for token, q := range m.queries {
+			q.mu.RLock()
+			expired := q.watchers == 0 && time.Since(q.lastSeen) > m.cfg.TTL
+			q.mu.RUnlock()
+			if expired {
+				delete(m.queries, token)
+				slog.Debug("live query expired", "token", token)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Notify records the tables modified by the changeset, published by this
+// node or applied from another.
+func (m *Manager) Notify(cs *ha.ChangeSet) {
+	tables := invalidation.Tables(cs)
+	if len(tables) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.queries) == 0 {
+		return
+	}
+	set, scheduled := m.pending[cs.Filename]
+	if !scheduled {
+		set = make(map[string]struct{})
+		m.pending[cs.Filename] = set
+	}
+	for _, table := range tables {
+		set[table] = struct{}{}
+	}
+	if scheduled {
+		return
+	}
+	time.AfterFunc(m.cfg.Debounce, func() {
+		m.flush(cs.Filename)
+	})
+}
+
+func (m *Manager) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	return false, nil
+}
+
+func (m *Manager) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if err == nil {
+		m.Notify(cs)
+	}
+	return err
+}
+
+func (m *Manager) flush(id string) {
+	m.mu.Lock()
+	set := m.pending[id]
+	delete(m.pending, id)
+	var affected []*Query
+	for _, q := range m.queries {
+		if q.DB == id && reads(q, set) {
+			affected = append(affected, q)
+		}
+	}
+	m.mu.Unlock()
+	for _, q := range affected {
+		go func() {
+			ctx, cancel := sqlite.QueryContext(context.Background(), 0)
+			defer cancel()
+			if err := m.execute(ctx, q); err != nil {
+				slog.Warn("live query failed", "token", q.Token, "error", err)
+			}
+		}()
+	}
+}
+
+func reads(q *Query, tables map[string]struct{}) bool {
+	if _, ok := tables[invalidation.AllTables]; ok {
+		return true
+	}
+	for _, table := range q.Tables {
+		if table == invalidation.AllTables {
+			return true
+		}
+		if _, ok := tables[table]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// execute runs the query and publishes the result when the rows changed. A
+// failure is kept in the result, the next change may fix it.
+func (m *Manager) execute(ctx context.Context, q *Query) error {
+	q.refresh.Lock()
+	defer q.refresh.Unlock()
+	db, err := sqlite.DB(q.DB)
+	if err != nil {
+		return err
+	}
+	var (
+		result Result
+		keys   []string
+	)
+	resp, err := sqlite.Exec(ctx, db, q.SQL, q.Params)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Columns, result.Rows = resp.Columns, resp.Rows
+		keys = make([]string, len(resp.Rows))
+		for i, row := range resp.Rows {
+			b, _ := json.Marshal(row)
+			keys[i] = string(b)
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.result == nil {
+		if err != nil {
+			// the registration fails
+			return err
+		}
+		result.Version = 1
+		q.result, q.keys = &result, keys
+		return nil
+	}
+	if result.Error == q.result.Error && slices.Equal(keys, q.keys) {
+		return err
+	}
+	result.Version = q.result.Version + 1
+	q.diff = diff(result.Version, q.result.Rows, q.keys, result.Rows, keys)
+	q.result, q.keys = &result, keys
+	close(q.changed)
+	q.changed = make(chan struct{})
+	return err
+}
+
+// diff compares the rows as multisets, the order changes are not reported.
+func diff(version uint64, oldRows [][]any, oldKeys []string, newRows [][]any, newKeys []string) *Diff {
+	d := Diff{
+		Version: version,
+		Added:   make([][]any, 0),
+		Removed: make([][]any, 0),
+	}
+	count := make(map[string]int, len(oldKeys))
+	for _, key := range oldKeys {
+		count[key]++
+	}
+	for i, key := range newKeys {
+		if count[key] > 0 {
+			count[key]--
+			continue
+		}
+		d.Added = append(d.Added, newRows[i])
+	}
+	for i, key := range oldKeys {
+		if count[key] > 0 {
+			count[key]--
+			d.Removed = append(d.Removed, oldRows[i])
+		}
+	}
+	return &d
+}
+
+// ReadTables returns the tables opened by the query plan, the views and the
+// subqueries resolved by SQLite. The indexes are mapped to their table.
+func ReadTables(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN "+query)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	var pages []any
+	for rows.Next() {
+		values := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		// addr, opcode, p1, p2 (root page), p3 (schema, 0 is main), ...
+		opcode := fmt.Sprint(text(values[1]))
+		if (opcode == "OpenRead" || opcode == "ReopenIdx") && fmt.Sprint(values[4]) == "0" {
+			pages = append(pages, values[3])
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		// virtual tables, table-valued functions: any change refreshes
+		return []string{invalidation.AllTables}, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(pages)), ",")
+	rows, err = db.QueryContext(ctx, "SELECT DISTINCT tbl_name FROM sqlite_schema WHERE rootpage IN ("+placeholders+") ORDER BY tbl_name", pages...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+func text(v any) any {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
@@ -0,0 +1,95 @@
+//go:build cgo
+
+package livequery_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/livequery"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestLiveQuery(t *testing.T) {
+	ctx := context.Background()
+	if err := sqlite.Load(ctx, "file:"+filepath.Join(t.TempDir(), "live.db"), sqlite.LoadConfig{MaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB("live.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT)",
+		"CREATE TABLE other(id INTEGER PRIMARY KEY)",
+		"CREATE VIEW names AS SELECT name FROM items",
+		"INSERT INTO items VALUES (1, 'a'), (2, 'b')",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	tables, err := livequery.ReadTables(ctx, db, "SELECT * FROM names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tables, []string{"items"}) {
+		t.Errorf("got the tables %v read by the view, want items", tables)
+	}
+
+	m := livequery.New(livequery.Config{Debounce: 10 * time.Millisecond, Max: 2})
+	q, err := m.Register(ctx, "live.db", "SELECT id, name FROM items ORDER BY id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, diff := q.Result()
+	if result.Version != 1 || len(result.Rows) != 2 || diff != nil {
+		t.Fatalf("got %+v, %+v, want the first execution with 2 rows", result, diff)
+	}
+
+	// a change of another table does not run the query again
+	m.Notify(&ha.ChangeSet{Filename: "live.db", Changes: []ha.Change{{Table: "other", Operation: "INSERT"}}})
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	if result, _ := q.Wait(waitCtx, 1); result.Version != 1 {
+		t.Errorf("version %d after a change of another table, want 1", result.Version)
+	}
+	cancel()
+
+	if _, err := db.ExecContext(ctx, "UPDATE items SET name = 'c' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	m.Notify(&ha.ChangeSet{Filename: "live.db", Changes: []ha.Change{{Table: "items", Operation: "UPDATE"}}})
+	waitCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	result, diff = q.Wait(waitCtx, 1)
+	if result.Version != 2 || diff == nil {
+		t.Fatalf("got %+v, want the second execution", result)
+	}
+	if fmt.Sprint(diff.Added) != "[[2 c]]" || fmt.Sprint(diff.Removed) != "[[2 b]]" {
+		t.Errorf("got the rows %v added and %v removed, want the updated row", diff.Added, diff.Removed)
+	}
+
+	if _, err := m.Register(ctx, "live.db", "DELETE FROM items", nil); !errors.Is(err, livequery.ErrNotQuery) {
+		t.Errorf("register of a DELETE: got %v, want ErrNotQuery", err)
+	}
+	if _, err := m.Register(ctx, "live.db", "SELECT count(*) FROM other", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Register(ctx, "live.db", "SELECT 1", nil); !errors.Is(err, livequery.ErrTooMany) {
+		t.Errorf("register over the limit: got %v, want ErrTooMany", err)
+	}
+	if err := m.Remove(q.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(q.Token); !errors.Is(err, livequery.ErrNotFound) {
+		t.Errorf("get after the removal: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,245 @@
+// Package locks provides distributed locks to the applications, kept in a
+// NATS JetStream KV bucket so every node of the cluster agrees on the holder.
+//
+// A lock expires after its TTL unless renewed by its holder, the expiry is
+// compared to the clock of the node serving the request: the node clocks
+// must be synchronized within a small fraction of the TTL.
+package locks
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	ErrLocked      = errors.New("lock is held by another owner")
+	ErrNotHeld     = errors.New("lock is not held")
+	ErrInvalidName = errors.New("invalid lock name, use letters, digits and - _ = / . without a leading or trailing dot")
+)
+
+var reName = regexp.MustCompile(`^[-/_=\.a-zA-Z0-9]+$`)
+
+type Config struct {
+	Bucket   string
+	Replicas int
+	// Node is recorded as the node granting the locks.
+	Node string
+	// DefaultTTL applies to the requests without a TTL, MaxTTL bounds the
+	// requested ones.
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+}
+
+// Lock is a lock held. Token proves the ownership, it renews and releases
+// the lock. Revision increases with every acquisition and renewal, a fencing
+// token the protected resource can check.
+type Lock struct {
+	Name     string    `json:"name"`
+	Owner    string    `json:"owner,omitempty"`
+	Node     string    `json:"node"`
+	Token    string    `json:"token,omitempty"`
+	Revision uint64    `json:"revision"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Request asks for a lock. Token is the one of the lock held to renew it,
+// empty to acquire it.
+type Request struct {
+	Owner string
+	Token string
+	TTL   time.Duration
+}
+
+type Manager struct {
+	kv  jetstream.KeyValue
+	cfg Config
+}
+
+// New creates the bucket if needed. The bucket keeps a key no longer than
+// MaxTTL after its last renewal, so the expired locks are removed.
+func New(ctx context.Context, nc *nats.Conn, cfg Config) (*Manager, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:   cfg.Bucket,
+		History:  1,
+		TTL:      cfg.MaxTTL,
+		Storage:  jetstream.FileStorage,
+		Replicas: cfg.Replicas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create locks bucket %q: %w", cfg.Bucket, err)
+	}
+	return &Manager{kv: kv, cfg: cfg}, nil
+}
+
+// DefaultTTL is the TTL of the locks requested without one.
+func (m *Manager) DefaultTTL() time.Duration {
+	return m.cfg.DefaultTTL
+}
+
+// Acquire takes the lock when it is free or expired, or renews it when the
+// request has its token. It fails with ErrLocked while another owner holds
+// it.
+func (m *Manager) Acquire(ctx context.Context, name string, req Request) (Lock, error) {
+	if err := validName(name); err != nil {
+		return Lock{}, err
+	}
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = m.cfg.DefaultTTL
+	}
+	if m.cfg.MaxTTL > 0 {
+		ttl = min(ttl, m.cfg.MaxTTL)
+	}
+	now := time.Now()
+	lock := Lock{
+		Name:     name,
+		Owner:    req.Owner,
+		Node:     m.cfg.Node,
+		Token:    req.Token,
+		Acquired: now,
+		Expires:  now.Add(ttl),
+	}
+	held, revision, err := m.get(ctx, name)
+	switch {
+	case errors.Is(err, ErrNotHeld):
+		if req.Token != "" {
+			return Lock{}, fmt.Errorf("%q %w, acquire it again", name, ErrNotHeld)
+		}
+		lock.Token = newToken()
+		if revision == 0 {
+			lock.Revision, err = m.kv.Create(ctx, name, encode(lock))
+		} else {
+			// expired, replaced unless another owner takes it first
+			lock.Revision, err = m.kv.Update(ctx, name, encode(lock), revision)
+		}
+	case err != nil:
+		return Lock{}, err
+	case req.Token == "" || req.Token != held.Token:
+		return Lock{}, lockedError(held)
+	default:
+		lock.Acquired = held.Acquired
+		lock.Owner = cmp.Or(req.Owner, held.Owner)
+		lock.Revision, err = m.kv.Update(ctx, name, encode(lock), revision)
+	}
+	if errors.Is(err, jetstream.ErrKeyExists) || isWrongSequence(err) {
+		return Lock{}, fmt.Errorf("%q %w", name, ErrLocked)
+	}
+	if err != nil {
+		return Lock{}, err
+	}
+	return lock, nil
+}
+
+// Release frees the lock held with token.
+func (m *Manager) Release(ctx context.Context, name, token string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	held, revision, err := m.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	if token != held.Token {
+		return lockedError(held)
+	}
+	err = m.kv.Delete(ctx, name, jetstream.LastRevision(revision))
+	if isWrongSequence(err) {
+		// renewed or taken over meanwhile
+		return fmt.Errorf("%q %w", name, ErrLocked)
+	}
+	return err
+}
+
+// Get returns the holder of the lock, without its token.
+func (m *Manager) Get(ctx context.Context, name string) (Lock, error) {
+	if err := validName(name); err != nil {
+		return Lock{}, err
+	}
+	lock, _, err := m.get(ctx, name)
+	lock.Token = ""
+	return lock, err
+}
+
+// get returns the lock held and the revision of its key, ErrNotHeld with the
+// revision of an expired lock.
+func (m *Manager) get(ctx context.Context, name string) (Lock, uint64, error) {
+	entry, err := m.kv.Get(ctx, name)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return Lock{}, 0, fmt.Errorf("%q %w", name, ErrNotHeld)
+	}
+	if err != nil {
+		return Lock{}, 0, err
+	}
+	var lock Lock
+	if err := json.Unmarshal(entry.Value(), &lock); err != nil {
+		return Lock{}, entry.Revision(), fmt.Errorf("%q %w", name, ErrNotHeld)
+	}
+	if !time.Now().Before(lock.Expires) {
+		return Lock{}, entry.Revision(), fmt.Errorf("%q %w", name, ErrNotHeld)
+	}
+	lock.Name = name
+	lock.Revision = entry.Revision()
+	return lock, entry.Revision(), nil
+}
+
+func lockedError(held Lock) error {
+	return fmt.Errorf("%q %w %q on node %s until %s", held.Name, ErrLocked, held.Owner, held.Node, held.Expires.Format(time.RFC3339))
+}
+
+func isWrongSequence(err error) bool {
+	var apiErr *jetstream.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence
+}
+
+func validName(name string) error {
+	if !reName.MatchString(name) || name[0] == '.' || name[len(name)-1] == '.' {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+func encode(lock Lock) []byte {
+	b, _ := json.Marshal(lock)
+	return b
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// TryLock acquires the lock for the SQL function ha_lock, the token is empty
+// while another owner holds it.
+func (m *Manager) TryLock(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	lock, err := m.Acquire(ctx, name, Request{Owner: "sql", TTL: ttl})
+	if errors.Is(err, ErrLocked) {
+		return "", nil
+	}
+	return lock.Token, err
+}
+
+// Unlock releases the lock for the SQL function ha_unlock, false when token
+// does not hold it.
+func (m *Manager) Unlock(ctx context.Context, name, token string) (bool, error) {
+	err := m.Release(ctx, name, token)
+	if errors.Is(err, ErrLocked) || errors.Is(err, ErrNotHeld) {
+		return false, nil
+	}
+	return err == nil, err
+}
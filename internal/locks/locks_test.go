@@ -0,0 +1,155 @@
+package locks_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/litesql/ha/internal/locks"
+)
+
+func runJetStream(t *testing.T) *nats.Conn {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func newManager(t *testing.T) *locks.Manager {
+	t.Helper()
+	m, err := locks.New(context.Background(), runJetStream(t), locks.Config{
+		Bucket:     "locks",
+		Node:       "node1",
+		DefaultTTL: time.Minute,
+		MaxTTL:     time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	m := newManager(t)
+
+	lock, err := m.Acquire(ctx, "jobs/nightly", locks.Request{Owner: "worker1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.Token == "" || lock.Node != "node1" || time.Until(lock.Expires) <= 0 {
+		t.Fatalf("got %+v, want a lock with a token held by node1", lock)
+	}
+	if _, err := m.Acquire(ctx, "jobs/nightly", locks.Request{Owner: "worker2"}); !errors.Is(err, locks.ErrLocked) {
+		t.Errorf("acquire of a held lock: got %v, want ErrLocked", err)
+	}
+	if _, err := m.Acquire(ctx, "jobs/nightly", locks.Request{Owner: "worker2", Token: "other"}); !errors.Is(err, locks.ErrLocked) {
+		t.Errorf("renew with another token: got %v, want ErrLocked", err)
+	}
+
+	renewed, err := m.Acquire(ctx, "jobs/nightly", locks.Request{Token: lock.Token, TTL: 2 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Revision <= lock.Revision || !renewed.Acquired.Equal(lock.Acquired) || renewed.Owner != "worker1" {
+		t.Errorf("got %+v, want the lock of worker1 renewed with a new revision", renewed)
+	}
+
+	held, err := m.Get(ctx, "jobs/nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held.Token != "" || held.Owner != "worker1" || held.Revision != renewed.Revision {
+		t.Errorf("got %+v, want the holder without its token", held)
+	}
+
+	if err := m.Release(ctx, "jobs/nightly", "other"); !errors.Is(err, locks.ErrLocked) {
+		t.Errorf("release with another token: got %v, want ErrLocked", err)
+	}
+	if err := m.Release(ctx, "jobs/nightly", lock.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(ctx, "jobs/nightly"); !errors.Is(err, locks.ErrNotHeld) {
+		t.Errorf("get after the release: got %v, want ErrNotHeld", err)
+	}
+	if _, err := m.Acquire(ctx, "jobs/nightly", locks.Request{Token: lock.Token}); !errors.Is(err, locks.ErrNotHeld) {
+		t.Errorf("renew after the release: got %v, want ErrNotHeld", err)
+	}
+
+	for _, name := range []string{"", ".hidden", "trailing.", "with space", "a*"} {
+		if _, err := m.Acquire(ctx, name, locks.Request{}); !errors.Is(err, locks.ErrInvalidName) {
+			t.Errorf("acquire %q: got %v, want ErrInvalidName", name, err)
+		}
+	}
+}
+
+// TestExpiry lets another owner take an expired lock, the previous holder
+// can no longer renew or release it.
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	m := newManager(t)
+
+	lock, err := m.Acquire(ctx, "expiring", locks.Request{Owner: "worker1", TTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	taken, err := m.Acquire(ctx, "expiring", locks.Request{Owner: "worker2"})
+	if err != nil {
+		t.Fatalf("acquire of an expired lock: %v", err)
+	}
+	if taken.Revision <= lock.Revision {
+		t.Errorf("revision %d, want a fencing token after %d", taken.Revision, lock.Revision)
+	}
+	if _, err := m.Acquire(ctx, "expiring", locks.Request{Token: lock.Token}); !errors.Is(err, locks.ErrLocked) {
+		t.Errorf("renew by the previous holder: got %v, want ErrLocked", err)
+	}
+	if err := m.Release(ctx, "expiring", lock.Token); !errors.Is(err, locks.ErrLocked) {
+		t.Errorf("release by the previous holder: got %v, want ErrLocked", err)
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	ctx := context.Background()
+	m := newManager(t)
+
+	token, err := m.TryLock(ctx, "sql", time.Minute)
+	if err != nil || token == "" {
+		t.Fatalf("got %q, %v, want a token", token, err)
+	}
+	if other, err := m.TryLock(ctx, "sql", time.Minute); err != nil || other != "" {
+		t.Errorf("got %q, %v for a held lock, want no token", other, err)
+	}
+	if ok, err := m.Unlock(ctx, "sql", "other"); err != nil || ok {
+		t.Errorf("unlock with another token: got %v, %v", ok, err)
+	}
+	if ok, err := m.Unlock(ctx, "sql", token); err != nil || !ok {
+		t.Errorf("unlock: got %v, %v", ok, err)
+	}
+	if ok, err := m.Unlock(ctx, "sql", token); err != nil || ok {
+		t.Errorf("unlock of a released lock: got %v, %v", ok, err)
+	}
+}
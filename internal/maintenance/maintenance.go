@@ -0,0 +1,360 @@
+// Package maintenance runs the SQLite housekeeping of the databases of the
+// node on a cron-like schedule: integrity checks, reclaiming the free pages,
+// compacted copies and planner statistics. The tasks only change the local
+// files and are not replicated, every node runs its own schedule.
+package maintenance
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/cron"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+const (
+	// IntegrityCheck runs PRAGMA integrity_check.
+	IntegrityCheck = "integrity_check"
+	// IncrementalVacuum returns the free pages to the file system, for the
+	// databases with auto_vacuum=incremental.
+	IncrementalVacuum = "incremental_vacuum"
+	// VacuumInto writes a compacted copy of the database to the maintenance
+	// directory.
+	VacuumInto = "vacuum_into"
+	// Analyze refreshes the query planner statistics.
+	Analyze = "analyze"
+)
+
+var ErrInvalid = errors.New("invalid maintenance task")
+
+// maxIntegrityErrors bounds the problems reported by an integrity check.
+const maxIntegrityErrors = 100
+
+type Job struct {
+	Task     string
+	Schedule *cron.Schedule
+}
+
+// ParseJobs parses a semicolon separated list of task=schedule, e.g.
+// "integrity_check=0 3 * * *;analyze=@daily".
+func ParseJobs(spec string) ([]Job, error) {
+	var jobs []Job
+	for entry := range strings.SplitSeq(spec, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		task, expr, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: expected task=schedule, got %q", ErrInvalid, entry)
+		}
+		task = strings.ToLower(strings.TrimSpace(task))
+		if !validTask(task) {
+			return nil, fmt.Errorf("%w %q: use integrity_check, incremental_vacuum, vacuum_into or analyze", ErrInvalid, task)
+		}
+		schedule, err := cron.Parse(expr)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, Job{Task: task, Schedule: schedule})
+	}
+	return jobs, nil
+}
+
+func validTask(task string) bool {
+	switch task {
+	case IntegrityCheck, IncrementalVacuum, VacuumInto, Analyze:
+		return true
+	}
+	return false
+}
+
+type Result struct {
+	Database   string    `json:"database"`
+	Task       string    `json:"task"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+	OK         bool      `json:"ok"`
+	// Output holds the integrity problems, the pages freed or the file
+	// written.
+	Output []string `json:"output,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+type JobStatus struct {
+	Task     string    `json:"task"`
+	Schedule string    `json:"schedule"`
+	Next     time.Time `json:"next"`
+}
+
+type Status struct {
+	Jobs    []JobStatus `json:"jobs"`
+	Results []Result    `json:"results"`
+}
+
+// Scheduler runs the jobs on every database of the node, one task at a time.
+type Scheduler struct {
+	jobs []Job
+	dir  string
+
+	// running serializes the tasks, scheduled or run on demand.
+	running sync.Mutex
+
+	mu      sync.Mutex
+	next    []time.Time
+	results map[string]Result
+}
+
+// New returns a scheduler of the jobs. dir receives the copies of the
+// vacuum_into task.
+func New(jobs []Job, dir string) (*Scheduler, error) {
+	for _, job := range jobs {
+		if job.Task == VacuumInto && dir == "" {
+			return nil, fmt.Errorf("%w: %s needs a directory for the copies", ErrInvalid, VacuumInto)
+		}
+	}
+	s := &Scheduler{
+		jobs:    jobs,
+		dir:     dir,
+		next:    make([]time.Time, len(jobs)),
+		results: make(map[string]Result),
+	}
+	now := time.Now()
+	for i, job := range jobs {
+		s.next[i] = job.Schedule.Next(now)
+	}
+	return s, nil
+}
+
+// Start runs the jobs when due until ctx is done.
+func (s *Scheduler) Start(ctx context.Context) {
+	for {
+		wake := s.nextRun()
+		if wake.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		now := time.Now()
+		var due []Job
+		s.mu.Lock()
+		for i, job := range s.jobs {
+			if !s.next[i].IsZero() && !s.next[i].After(now) {
+				due = append(due, job)
+				s.next[i] = job.Schedule.Next(now)
+			}
+		}
+		s.mu.Unlock()
+		for _, job := range due {
+			ids := sqlite.Databases()
+			slices.Sort(ids)
+			for _, id := range ids {
+				if ctx.Err() != nil {
+					return
+				}
+				s.Run(ctx, id, job.Task)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) nextRun() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var wake time.Time
+	for _, next := range s.next {
+		if !next.IsZero() && (wake.IsZero() || next.Before(wake)) {
+			wake = next
+		}
+	}
+	return wake
+}
+
+// Run runs the task on the database now, after the task in progress if any.
+func (s *Scheduler) Run(ctx context.Context, id, task string) (Result, error) {
+	if !validTask(task) {
+		return Result{}, fmt.Errorf("%w %q", ErrInvalid, task)
+	}
+	if task == VacuumInto && s.dir == "" {
+		return Result{}, fmt.Errorf("%w: %s needs --maintenance-dir", ErrInvalid, VacuumInto)
+	}
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return Result{}, err
+	}
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	res := Result{Database: id, Task: task, StartedAt: time.Now().UTC()}
+	res.Output, err = s.run(ha.ContextLocalDB(ctx, true), db, id, task)
+	res.DurationMS = time.Since(res.StartedAt).Milliseconds()
+	res.OK = err == nil && !(task == IntegrityCheck && len(res.Output) > 0)
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+		slog.Error("maintenance task failed", "id", id, "task", task, "error", err)
+	case !res.OK:
+		slog.Error("integrity check failed", "id", id, "problems", res.Output)
+	default:
+		slog.Info("maintenance task done", "id", id, "task", task, "duration_ms", res.DurationMS, "output", res.Output)
+	}
+	s.mu.Lock()
+	s.results[id+"/"+task] = res
+	s.mu.Unlock()
+	return res, nil
+}
+
+func (s *Scheduler) run(ctx context.Context, db *sql.DB, id, task string) ([]string, error) {
+	switch task {
+	case IntegrityCheck:
+		return integrityCheck(ctx, db)
+	case IncrementalVacuum:
+		return incrementalVacuum(ctx, db)
+	case VacuumInto:
+		if err := os.MkdirAll(s.dir, 0o755); err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(id), filepath.Ext(id))
+		file := filepath.Join(s.dir, fmt.Sprintf("%s-%s.db", name, time.Now().UTC().Format("20060102T150405Z")))
+		if err := vacuumInto(ctx, db, file); err != nil {
+			os.Remove(file)
+			return nil, err
+		}
+		return []string{file}, nil
+	default:
+		_, err := db.ExecContext(ctx, "ANALYZE")
+		return nil, err
+	}
+}
+
+// vacuumInto writes a compacted copy of the database to file. The replicated
+// connections do not parse VACUUM, the copy is a backup vacuumed without
+// replication.
+func vacuumInto(ctx context.Context, db *sql.DB, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := sqlite.Backup(ctx, db, f); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	copied, err := sqlite.OpenFile(file)
+	if err != nil {
+		return err
+	}
+	defer copied.Close()
+	_, err = copied.ExecContext(ctx, "VACUUM")
+	return err
+}
+
+// integrityCheck returns the problems found, none when the database is sound.
+func integrityCheck(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA integrity_check(%d)", maxIntegrityErrors))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
+
+func incrementalVacuum(ctx context.Context, db *sql.DB) ([]string, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var mode int
+	if err := conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return nil, err
+	}
+	// 2 is incremental, the free pages of the other modes stay in the file
+	// until a full VACUUM.
+	if mode != 2 {
+		return []string{"skipped: auto_vacuum is not incremental"}, nil
+	}
+	var before, after int64
+	if err := conn.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&before); err != nil {
+		return nil, err
+	}
+	// Each step frees one page, the rows must be read to the end.
+	rows, err := conn.QueryContext(ctx, "PRAGMA incremental_vacuum")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := conn.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&after); err != nil {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("%d pages freed", before-after)}, nil
+}
+
+func (s *Scheduler) Status() Status {
+	ids := sqlite.Databases()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := Status{
+		Jobs:    make([]JobStatus, 0, len(s.jobs)),
+		Results: make([]Result, 0, len(s.results)),
+	}
+	for i, job := range s.jobs {
+		status.Jobs = append(status.Jobs, JobStatus{Task: job.Task, Schedule: job.Schedule.String(), Next: s.next[i]})
+	}
+	for _, res := range s.results {
+		if slices.Contains(ids, res.Database) {
+			status.Results = append(status.Results, res)
+		}
+	}
+	slices.SortFunc(status.Results, func(a, b Result) int {
+		return strings.Compare(a.Database+"/"+a.Task, b.Database+"/"+b.Task)
+	})
+	return status
+}
+
+// Warnings describes the last failed task of each database, for the health
+// checks.
+func (s *Scheduler) Warnings() []string {
+	var warnings []string
+	for _, res := range s.Status().Results {
+		switch {
+		case res.Error != "":
+			warnings = append(warnings, fmt.Sprintf("database %q: %s failed at %s: %s", res.Database, res.Task, res.StartedAt.Format(time.RFC3339), res.Error))
+		case !res.OK:
+			warnings = append(warnings, fmt.Sprintf("database %q: %s found %d problems at %s, first: %s", res.Database, res.Task, len(res.Output), res.StartedAt.Format(time.RFC3339), res.Output[0]))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,65 @@
+//go:build cgo
+
+package maintenance_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/litesql/ha/internal/maintenance"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	if err := sqlite.Load(ctx, "file:"+filepath.Join(t.TempDir(), "maintenance.db"), sqlite.LoadConfig{MaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB("maintenance.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT)",
+		"INSERT INTO items VALUES (1, 'a')",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	s, err := maintenance.New(nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range []string{maintenance.IntegrityCheck, maintenance.IncrementalVacuum, maintenance.Analyze, maintenance.VacuumInto} {
+		res, err := s.Run(ctx, "maintenance.db", task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.OK {
+			t.Errorf("%s failed: %+v", task, res)
+		}
+	}
+
+	res := s.Status().Results
+	var file string
+	for _, r := range res {
+		if r.Task == maintenance.VacuumInto && len(r.Output) == 1 {
+			file = r.Output[0]
+		}
+	}
+	if file == "" {
+		t.Fatalf("got the results %+v, want the file of the copy", res)
+	}
+	copied, err := sql.Open("sqlite3", "file:"+file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	var name string
+	if err := copied.QueryRowContext(ctx, "SELECT name FROM items WHERE id = 1").Scan(&name); err != nil || name != "a" {
+		t.Errorf("got %q, %v in the copy, want a", name, err)
+	}
+}
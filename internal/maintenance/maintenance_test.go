@@ -0,0 +1,22 @@
+package maintenance_test
+
+import (
+	"testing"
+
+	"github.com/litesql/ha/internal/maintenance"
+)
+
+func TestParseJobs(t *testing.T) {
+	jobs, err := maintenance.ParseJobs("integrity_check=0 3 * * *; analyze=@daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].Task != maintenance.IntegrityCheck || jobs[1].Schedule.String() != "@daily" {
+		t.Errorf("unexpected jobs %+v", jobs)
+	}
+	for _, spec := range []string{"vacuum=@daily", "analyze", "analyze=0 3 * *", "analyze=60 * * * *", "analyze=5-1 * * * *", "analyze=*/0 * * * *"} {
+		if _, err := maintenance.ParseJobs(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
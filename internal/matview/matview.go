@@ -0,0 +1,539 @@
+// Package matview maintains materialized views: tables holding the result of
+// a SELECT, refreshed when the changesets published by the node modify the
+// tables it reads. The refresh is written like any statement, so the view is
+// replicated to the other nodes instead of being computed by each of them.
+package matview
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/invalidation"
+	"github.com/litesql/ha/internal/livequery"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+var (
+	ErrNotFound = errors.New("materialized view not found")
+	ErrExists   = errors.New("materialized view already exists")
+	ErrInvalid  = errors.New("invalid materialized view")
+)
+
+// Refresh modes. Incremental writes only the rows added and removed since the
+// last refresh, full deletes and inserts every row.
+const (
+	Incremental = "incremental"
+	Full        = "full"
+)
+
+const definitionsTable = "ha_materialized_views"
+
+const createDefinitionsTable = `CREATE TABLE IF NOT EXISTS ` + definitionsTable + `(
+	name TEXT PRIMARY KEY,
+	sql TEXT NOT NULL,
+	refresh TEXT NOT NULL DEFAULT 'incremental',
+	debounce TEXT,
+	tables TEXT NOT NULL,
+	created_at TEXT
+)`
+
+// View is a materialized view of a database. The definition is stored in the
+// ha_materialized_views table, RefreshedAt and Error are the state of the
+// last refresh run by this node.
+type View struct {
+	Name string `json:"name"`
+	DB   string `json:"database"`
+	SQL  string `json:"sql"`
+	// Refresh is incremental or full.
+	Refresh string `json:"refresh"`
+	// Debounce coalesces the changes of the source tables before the view
+	// is refreshed.
+	Debounce string `json:"debounce,omitempty"`
+	// Tables read by the query, "*" when they could not be determined.
+	Tables      []string `json:"tables"`
+	CreatedAt   string   `json:"created_at,omitempty"`
+	RefreshedAt string   `json:"refreshed_at,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type view struct {
+	View
+	debounce time.Duration
+
+	// serializes the refreshes
+	refresh   sync.Mutex
+	scheduled bool
+}
+
+type Manager struct {
+	mu sync.Mutex
+	// views by database, loaded from the definitions table on first use
+	// and again once stale
+	views map[string]map[string]*view
+	stale map[string]bool
+}
+
+func New() *Manager {
+	return &Manager{
+		views: make(map[string]map[string]*view),
+		stale: make(map[string]bool),
+	}
+}
+
+// Create stores the definition and creates the table of the view filled with
+// the rows of the query.
+func (m *Manager) Create(ctx context.Context, id string, def View) (*View, error) {
+	def.Name = strings.TrimSpace(def.Name)
+	def.SQL = strings.TrimRight(strings.TrimSpace(def.SQL), "; \t\n")
+	if def.Name == "" {
+		return nil, fmt.Errorf("name %w", sqlite.ErrMissingParameter)
+	}
+	if def.SQL == "" {
+		return nil, fmt.Errorf("sql %w", sqlite.ErrMissingParameter)
+	}
+	if strings.HasPrefix(strings.ToLower(def.Name), "ha_") || strings.HasPrefix(strings.ToLower(def.Name), "sqlite_") {
+		return nil, fmt.Errorf("%w: the name prefixes ha_ and sqlite_ are reserved", ErrInvalid)
+	}
+	if !sqlite.IsQuery(def.SQL) {
+		return nil, fmt.Errorf("%w: the sql must be a SELECT", ErrInvalid)
+	}
+	def.Refresh = cmp.Or(strings.ToLower(def.Refresh), Incremental)
+	if def.Refresh != Incremental && def.Refresh != Full {
+		return nil, fmt.Errorf("%w: refresh must be %s or %s", ErrInvalid, Incremental, Full)
+	}
+	if def.Debounce != "" {
+		if d, err := time.ParseDuration(def.Debounce); err != nil || d < 0 {
+			return nil, fmt.Errorf("%w: debounce must be a duration like 500ms", ErrInvalid)
+		}
+	}
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return nil, err
+	}
+	def.DB = cmp.Or(id, sqlite.DefaultDatabase())
+	if sqlite.ReadOnly(def.DB) {
+		return nil, fmt.Errorf("database %q: %w", def.DB, sqlite.ErrReadOnly)
+	}
+	tables, err := livequery.ReadTables(ctx, db, def.SQL)
+	if err != nil {
+		return nil, err
+	}
+	if slices.ContainsFunc(tables, func(table string) bool { return strings.EqualFold(table, def.Name) }) {
+		return nil, fmt.Errorf("%w: the query reads the view table", ErrInvalid)
+	}
+	def.Tables = tables
+	def.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	def.RefreshedAt, def.Error = "", ""
+
+	encodedTables, _ := json.Marshal(def.Tables)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, createDefinitionsTable); err != nil {
+		return nil, fmt.Errorf("create materialized views table: %w", err)
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM sqlite_schema WHERE name = ? COLLATE NOCASE)", def.Name).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%w: %q is already used", ErrExists, def.Name)
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO "+definitionsTable+"(name, sql, refresh, debounce, tables, created_at) VALUES(?, ?, ?, ?, ?, ?)",
+		def.Name, def.SQL, def.Refresh, def.Debounce, string(encodedTables), def.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "CREATE TABLE "+quote(def.Name)+" AS SELECT * FROM ("+def.SQL+") LIMIT 0"); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO "+quote(def.Name)+" SELECT * FROM ("+def.SQL+")"); err != nil {
+		return nil, err
+	}
+	if err := sqlite.CommitError(tx.Commit()); err != nil {
+		return nil, err
+	}
+	def.RefreshedAt = def.CreatedAt
+	m.forget(def.DB)
+	slog.Info("materialized view created", "database", def.DB, "name", def.Name, "tables", def.Tables)
+	return &def, nil
+}
+
+// Drop removes the definition and the table of the view.
+func (m *Manager) Drop(ctx context.Context, id, name string) error {
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return err
+	}
+	id = cmp.Or(id, sqlite.DefaultDatabase())
+	v, err := m.get(ctx, id, name)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+definitionsTable+" WHERE name = ?", v.Name); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DROP TABLE IF EXISTS "+quote(v.Name)); err != nil {
+		return err
+	}
+	if err := sqlite.CommitError(tx.Commit()); err != nil {
+		return err
+	}
+	m.forget(id)
+	return nil
+}
+
+// List returns the views of the database ordered by name.
+func (m *Manager) List(ctx context.Context, id string) ([]View, error) {
+	if _, err := sqlite.DB(id); err != nil {
+		return nil, err
+	}
+	views, err := m.load(ctx, cmp.Or(id, sqlite.DefaultDatabase()))
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]View, 0, len(views))
+	for _, v := range views {
+		list = append(list, v.View)
+	}
+	slices.SortFunc(list, func(a, b View) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return list, nil
+}
+
+// Refresh refreshes the view now and returns its state.
+func (m *Manager) Refresh(ctx context.Context, id, name string) (*View, error) {
+	if _, err := sqlite.DB(id); err != nil {
+		return nil, err
+	}
+	v, err := m.get(ctx, cmp.Or(id, sqlite.DefaultDatabase()), name)
+	if err != nil {
+		return nil, err
+	}
+	err = m.refresh(ctx, v)
+	m.mu.Lock()
+	state := v.View
+	m.mu.Unlock()
+	return &state, err
+}
+
+// Notify schedules the refresh of the views reading the tables modified by
+// the changeset published by this node.
+func (m *Manager) Notify(cs *ha.ChangeSet) {
+	tables := invalidation.Tables(cs)
+	if len(tables) == 0 {
+		return
+	}
+	if slices.Contains(tables, definitionsTable) || slices.Contains(tables, invalidation.AllTables) {
+		m.forget(cs.Filename)
+	}
+	// called by the commit hook, the definitions are read by another
+	// connection
+	go m.changed(cs.Filename, tables)
+}
+
+func (m *Manager) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	return false, nil
+}
+
+// AfterApply reloads the definitions replicated from another node. The
+// views themselves are refreshed by the node writing to their tables.
+func (m *Manager) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if err != nil {
+		return err
+	}
+	for _, table := range invalidation.Tables(cs) {
+		if table == definitionsTable || table == invalidation.AllTables {
+			m.forget(cs.Filename)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *Manager) changed(id string, tables []string) {
+	if sqlite.ReadOnly(id) {
+		return
+	}
+	views, err := m.load(context.Background(), id)
+	if err != nil {
+		slog.Warn("failed to load the materialized views", "database", id, "error", err)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// the refreshes write only to the view tables, they never trigger one
+	changed := make(map[string]struct{}, len(tables))
+	for _, table := range tables {
+		if _, ok := views[strings.ToLower(table)]; !ok && table != definitionsTable {
+			changed[table] = struct{}{}
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	for _, v := range views {
+		if !reads(v, changed) || v.scheduled {
+			continue
+		}
+		v.scheduled = true
+		time.AfterFunc(v.debounce, func() {
+			m.mu.Lock()
+			v.scheduled = false
+			m.mu.Unlock()
+			ctx, cancel := sqlite.QueryContext(context.Background(), 0)
+			defer cancel()
+			if err := m.refresh(ctx, v); err != nil {
+				slog.Warn("materialized view refresh failed", "database", v.DB, "name", v.Name, "error", err)
+			}
+		})
+	}
+}
+
+func reads(v *view, tables map[string]struct{}) bool {
+	if _, ok := tables[invalidation.AllTables]; ok {
+		return true
+	}
+	for _, table := range v.Tables {
+		if table == invalidation.AllTables {
+			return true
+		}
+		if _, ok := tables[table]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh writes the rows of the query to the view table in a transaction,
+// published like the other writes. The failure is kept in the view state.
+func (m *Manager) refresh(ctx context.Context, v *view) error {
+	v.refresh.Lock()
+	defer v.refresh.Unlock()
+	err := m.write(ctx, v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		v.Error = err.Error()
+		return err
+	}
+	v.Error = ""
+	v.RefreshedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	return nil
+}
+
+func (m *Manager) write(ctx context.Context, v *view) error {
+	db, err := sqlite.DB(v.DB)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if v.Refresh == Full {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+quote(v.Name)); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+quote(v.Name)+" SELECT * FROM ("+v.SQL+")"); err != nil {
+			return err
+		}
+		return sqlite.CommitError(tx.Commit())
+	}
+
+	current, err := queryRows(ctx, tx, "SELECT rowid, * FROM "+quote(v.Name))
+	if err != nil {
+		return err
+	}
+	next, err := queryRows(ctx, tx, v.SQL)
+	if err != nil {
+		return err
+	}
+	removed, added := diff(current, next)
+	if len(removed) == 0 && len(added) == 0 {
+		return nil
+	}
+	for _, rowid := range removed {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+quote(v.Name)+" WHERE rowid = ?", rowid); err != nil {
+			return err
+		}
+	}
+	if len(added) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(added[0])), ",")
+		stmt, err := tx.PrepareContext(ctx, "INSERT INTO "+quote(v.Name)+" VALUES("+placeholders+")")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, row := range added {
+			if _, err := stmt.ExecContext(ctx, row...); err != nil {
+				return fmt.Errorf("the columns of the query no longer match the view, drop and create it again: %w", err)
+			}
+		}
+	}
+	return sqlite.CommitError(tx.Commit())
+}
+
+// diff compares the rows as multisets: current rows start with their rowid,
+// the rowids of the rows the query no longer returns are removed and the
+// query rows missing from the view are added.
+func diff(current, next [][]any) (removed []any, added [][]any) {
+	count := make(map[string]int, len(next))
+	for _, row := range next {
+		count[key(row)]++
+	}
+	kept := make(map[string]int, len(current))
+	for _, row := range current {
+		k := key(row[1:])
+		if kept[k] < count[k] {
+			kept[k]++
+			continue
+		}
+		removed = append(removed, row[0])
+	}
+	for _, row := range next {
+		k := key(row)
+		if kept[k] > 0 {
+			kept[k]--
+			continue
+		}
+		added = append(added, row)
+	}
+	return removed, added
+}
+
+// key distinguishes the storage classes, 1 and 1.0 or '1' are different rows.
+func key(row []any) string {
+	var sb strings.Builder
+	for _, value := range row {
+		fmt.Fprintf(&sb, "%T:%v\x00", value, value)
+	}
+	return sb.String()
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func queryRows(ctx context.Context, q querier, query string) ([][]any, error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var list [][]any
+	for rows.Next() {
+		values := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		list = append(list, values)
+	}
+	return list, rows.Err()
+}
+
+func (m *Manager) get(ctx context.Context, id, name string) (*view, error) {
+	views, err := m.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := views[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	return v, nil
+}
+
+// load returns the views of the database by lower case name, read from the
+// definitions table when they are not cached.
+func (m *Manager) load(ctx context.Context, id string) (map[string]*view, error) {
+	m.mu.Lock()
+	views, ok := m.views[id]
+	stale := m.stale[id]
+	m.mu.Unlock()
+	if ok && !stale {
+		return views, nil
+	}
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT name, sql, refresh, debounce, tables, created_at FROM "+definitionsTable)
+	if err != nil && !strings.Contains(err.Error(), "no such table") {
+		return nil, err
+	}
+	views = make(map[string]*view)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				v                           view
+				debounce, tables, createdAt sql.NullString
+			)
+			if err := rows.Scan(&v.Name, &v.SQL, &v.Refresh, &debounce, &tables, &createdAt); err != nil {
+				return nil, err
+			}
+			v.DB, v.Debounce, v.CreatedAt = id, debounce.String, createdAt.String
+			if err := json.Unmarshal([]byte(cmp.Or(tables.String, "[]")), &v.Tables); err != nil || len(v.Tables) == 0 {
+				v.Tables = []string{invalidation.AllTables}
+			}
+			v.debounce, _ = time.ParseDuration(cmp.Or(v.Debounce, "0s"))
+			views[strings.ToLower(v.Name)] = &v
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// keep the state of the last refresh
+	for name, v := range views {
+		if previous, ok := m.views[id][name]; ok && previous.SQL == v.SQL {
+			v.RefreshedAt, v.Error = previous.RefreshedAt, previous.Error
+		}
+	}
+	delete(m.stale, id)
+	m.views[id] = views
+	return views, nil
+}
+
+// forget reloads the definitions on the next use.
+func (m *Manager) forget(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stale[id] = true
+}
+
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
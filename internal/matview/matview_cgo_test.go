@@ -0,0 +1,125 @@
+//go:build cgo
+
+package matview_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/matview"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// names returns the names in the view table.
+func names(t *testing.T, db *sql.DB, view string) string {
+	t.Helper()
+	var list sql.NullString
+	if err := db.QueryRow("SELECT group_concat(name) FROM (SELECT name FROM " + view + " ORDER BY name)").Scan(&list); err != nil {
+		t.Fatal(err)
+	}
+	return list.String
+}
+
+func TestView(t *testing.T) {
+	ctx := context.Background()
+	if err := sqlite.Load(ctx, "file:"+filepath.Join(t.TempDir(), "matview.db"), sqlite.LoadConfig{MaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB("matview.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT, active INTEGER)",
+		"INSERT INTO items VALUES (1, 'a', 1), (2, 'b', 0), (3, 'c', 1)",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	m := matview.New()
+	for _, refresh := range []string{matview.Incremental, matview.Full} {
+		v, err := m.Create(ctx, "matview.db", matview.View{
+			Name:    "active_" + refresh,
+			SQL:     "SELECT name FROM items WHERE active = 1;",
+			Refresh: refresh,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(v.Tables, []string{"items"}) || v.RefreshedAt == "" {
+			t.Errorf("got %+v, want a view of items refreshed on creation", v)
+		}
+		if got := names(t, db, v.Name); got != "a,c" {
+			t.Errorf("view %s holds %q, want a,c", v.Name, got)
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE items SET active = 1 - active"); err != nil {
+		t.Fatal(err)
+	}
+	m.Notify(&ha.ChangeSet{Filename: "matview.db", Changes: []ha.Change{{Table: "items", Operation: "UPDATE"}}})
+	for _, view := range []string{"active_incremental", "active_full"} {
+		deadline := time.Now().Add(5 * time.Second)
+		for names(t, db, view) != "b" {
+			if time.Now().After(deadline) {
+				t.Fatalf("view %s holds %q after the change, want b", view, names(t, db, view))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "INSERT INTO items VALUES (4, 'd', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	v, err := m.Refresh(ctx, "matview.db", "active_incremental")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Error != "" || names(t, db, "active_incremental") != "b,d" {
+		t.Errorf("got %+v holding %q, want b,d", v, names(t, db, "active_incremental"))
+	}
+
+	list, err := m.List(ctx, "matview.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "active_full" || list[1].Name != "active_incremental" {
+		t.Errorf("got %+v, want the 2 views by name", list)
+	}
+	if err := m.Drop(ctx, "matview.db", "active_full"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Refresh(ctx, "matview.db", "active_full"); !errors.Is(err, matview.ErrNotFound) {
+		t.Errorf("refresh of a dropped view: got %v, want ErrNotFound", err)
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_schema WHERE name = 'active_full')").Scan(&exists); err != nil || exists {
+		t.Errorf("the table of the dropped view exists: %v", err)
+	}
+
+	for _, tt := range []struct {
+		view matview.View
+		err  error
+	}{
+		{view: matview.View{Name: "ha_view", SQL: "SELECT 1"}, err: matview.ErrInvalid},
+		{view: matview.View{Name: "deleted", SQL: "DELETE FROM items"}, err: matview.ErrInvalid},
+		{view: matview.View{Name: "other", SQL: "SELECT 1", Refresh: "lazy"}, err: matview.ErrInvalid},
+		{view: matview.View{Name: "other", SQL: "SELECT 1", Debounce: "soon"}, err: matview.ErrInvalid},
+		{view: matview.View{Name: "Items", SQL: "SELECT 1"}, err: matview.ErrExists},
+		{view: matview.View{Name: "active_incremental", SQL: "SELECT * FROM active_incremental"}, err: matview.ErrInvalid},
+		{view: matview.View{Name: "other"}, err: sqlite.ErrMissingParameter},
+	} {
+		if _, err := m.Create(ctx, "matview.db", tt.view); !errors.Is(err, tt.err) {
+			t.Errorf("create %+v: got %v, want %v", tt.view, err, tt.err)
+		}
+	}
+}
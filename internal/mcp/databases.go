@@ -12,9 +12,11 @@ type DatabasesInput struct {
 
 type DatabasesOutput struct {
 	Databases []string `json:"databases" jsonschema:"The list of database identifiers.,example=[\"ha.db\", \"test.db\"]"`
+	Default   string   `json:"default" jsonschema:"The database used when no identifier is informed."`
 }
 
 func Databases(ctx context.Context, req *mcp.CallToolRequest, input DatabasesInput) (result *mcp.CallToolResult, output DatabasesOutput, err error) {
 	output.Databases = sqlite.Databases()
+	output.Default = sqlite.DefaultDatabase()
 	return
 }
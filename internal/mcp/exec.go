@@ -0,0 +1,84 @@
+package mcp
+
+import (
+	"cmp"
+	"context"
+	"errors"
+
+	"github.com/litesql/ha/internal/audit"
+	"github.com/litesql/ha/internal/session"
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+type ExecInput struct {
+	DatabaseID string `json:"database_id" jsonschema:"The identifier of the database to modify.,example=ha.db"`
+	// The write statement to be executed.
+	Statement string `json:"statement" jsonschema:"The INSERT, UPDATE, DELETE or DDL statement to be executed.,example=UPDATE users SET active = false WHERE id = :id"`
+	// Optional parameters for the statement.
+	Params map[string]any `json:"params,omitempty" jsonschema:"Optional parameters for the statement.,example={\"id\": 1}"`
+}
+
+type ExecOutput struct {
+	RowsAffected int64                `json:"rows_affected" jsonschema:"The number of rows inserted, updated or deleted."`
+	LastInsertID int64                `json:"last_insert_id" jsonschema:"The rowid of the last inserted row."`
+	Columns      []string             `json:"columns,omitempty" jsonschema:"The columns of the RETURNING clause."`
+	Rows         [][]any              `json:"rows,omitempty" jsonschema:"The rows of the RETURNING clause."`
+	Warnings     []sqlite.LintWarning `json:"warnings,omitempty" jsonschema:"Risky patterns found in the statement, like UPDATE or DELETE without WHERE."`
+}
+
+func Exec(ctx context.Context, req *mcp.CallToolRequest, input ExecInput) (result *mcp.CallToolResult, output ExecOutput, err error) {
+	if sqlite.IsQuery(input.Statement) {
+		err = errors.New("the statement returns rows, use the query tool")
+		return
+	}
+	db, err := sqlite.DB(input.DatabaseID)
+	if err != nil {
+		return
+	}
+	if input.Statement, err = sqlite.InterceptQuery(ctx, input.DatabaseID, input.Statement); err != nil {
+		return
+	}
+	if output.Warnings, err = sqlite.CheckLint(input.Statement, lintPolicy); err != nil {
+		return
+	}
+	if err = sqlite.CheckWritable(ctx, input.DatabaseID, input.Statement); err != nil {
+		return
+	}
+	res, err := sqlite.Exec(ctx, db, input.Statement, input.Params)
+	sqlite.AfterQuery(ctx, input.DatabaseID, input.Statement, err)
+	auditStatement(ctx, input.DatabaseID, input.Statement, input.Params, res, err)
+	if err != nil {
+		return
+	}
+	if !res.NoReturning {
+		output.RowsAffected = int64(len(res.Rows))
+		output.Columns, output.Rows = res.Columns, res.Rows
+		return
+	}
+	output.RowsAffected = res.RowsAffected
+	if len(res.Rows) == 1 && len(res.Rows[0]) == 2 {
+		output.LastInsertID, _ = res.Rows[0][1].(int64)
+	}
+	return
+}
+
+// auditStatement records the statement executed for the tool call in the
+// audit log, as the user of the session.
+func auditStatement(ctx context.Context, dbID, query string, params map[string]any, res *sqlite.Response, err error) {
+	if !audit.Enabled() {
+		return
+	}
+	entry := audit.Entry{
+		Protocol:     "mcp",
+		Database:     cmp.Or(dbID, sqlite.DefaultDatabase()),
+		User:         session.User(ctx),
+		SQL:          query,
+		RowsAffected: audit.RowsAffected(res),
+		Error:        audit.ErrorString(err),
+	}
+	if len(params) > 0 {
+		entry.Params = params
+	}
+	audit.Record(entry)
+}
@@ -18,6 +18,8 @@ type QueryInput struct {
 type QueryOutput struct {
 	// The results of the query.
 	Results [][]any `json:"results" jsonschema:"The results of the query.,example=[{\"id\": 1, \"name\": \"Alice\"}, {\"id\": 2, \"name\": \"Bob\"}]"`
+	// Risky patterns found in the query.
+	Warnings []sqlite.LintWarning `json:"warnings,omitempty" jsonschema:"Risky patterns found in the query, like SELECT * or a missing LIMIT."`
 }
 
 func Query(ctx context.Context, req *mcp.CallToolRequest, input QueryInput) (result *mcp.CallToolResult, output QueryOutput, err error) {
@@ -25,7 +27,14 @@ func Query(ctx context.Context, req *mcp.CallToolRequest, input QueryInput) (res
 	if err != nil {
 		return
 	}
+	if input.Query, err = sqlite.InterceptQuery(ctx, input.DatabaseID, input.Query); err != nil {
+		return
+	}
+	if output.Warnings, err = sqlite.CheckLint(input.Query, lintPolicy); err != nil {
+		return
+	}
 	res, err := sqlite.Exec(ctx, db, input.Query, input.Params)
+	sqlite.AfterQuery(ctx, input.DatabaseID, input.Query, err)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,28 @@
+package mcp
+
+import (
+	"context"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+type SchemaInput struct {
+	DatabaseID string `json:"database_id" jsonschema:"The identifier of the database to describe.,example=ha.db"`
+}
+
+type SchemaOutput struct {
+	Tables []sqlite.Table `json:"tables" jsonschema:"The tables and views with their columns and indexes."`
+}
+
+func Schema(ctx context.Context, req *mcp.CallToolRequest, input SchemaInput) (result *mcp.CallToolResult, output SchemaOutput, err error) {
+	db, err := sqlite.DB(input.DatabaseID)
+	if err != nil {
+		return
+	}
+	output.Tables, err = sqlite.Schema(ctx, db)
+	if output.Tables == nil {
+		output.Tables = []sqlite.Table{}
+	}
+	return
+}
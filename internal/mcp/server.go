@@ -3,13 +3,40 @@ package mcp
 import (
 	"net/http"
 
+	"github.com/litesql/ha/internal/sqlite"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
+var destructive = true
+
+// lintPolicy applies the SQL lint to the statements of the tools, a guardrail
+// for the generated SQL.
+var lintPolicy = sqlite.LintWarn
+
+// SetLintPolicy sets the SQL lint policy of the statements of the tools.
+func SetLintPolicy(policy sqlite.LintPolicy) {
+	lintPolicy = policy
+}
+
 func NewServer() *mcp.Server {
 	server := mcp.NewServer(&mcp.Implementation{Name: "ha", Version: "v1.0.0"}, nil)
 	mcp.AddTool(server, &mcp.Tool{Name: "databases", Description: "list loaded databases"}, Databases)
 	mcp.AddTool(server, &mcp.Tool{Name: "query", Description: "execute a query"}, Query)
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "exec",
+		Description: "execute a write statement (INSERT, UPDATE, DELETE or DDL) and return the affected rows",
+		Annotations: &mcp.ToolAnnotations{DestructiveHint: &destructive},
+	}, Exec)
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "schema",
+		Description: "list the tables and views of a database with their columns and indexes",
+		Annotations: &mcp.ToolAnnotations{ReadOnlyHint: true},
+	}, Schema)
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "transaction",
+		Description: "execute statements atomically in a single transaction, all of them are committed or none",
+		Annotations: &mcp.ToolAnnotations{DestructiveHint: &destructive},
+	}, Transaction)
 	return server
 }
 
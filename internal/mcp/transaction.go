@@ -0,0 +1,78 @@
+package mcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+type Statement struct {
+	Statement string         `json:"statement" jsonschema:"The statement to be executed.,example=INSERT INTO users(name) VALUES(:name)"`
+	Params    map[string]any `json:"params,omitempty" jsonschema:"Optional parameters for the statement.,example={\"name\": \"Alice\"}"`
+}
+
+type TransactionInput struct {
+	DatabaseID string      `json:"database_id" jsonschema:"The identifier of the database.,example=ha.db"`
+	Statements []Statement `json:"statements" jsonschema:"The statements executed in order, all of them are committed or none."`
+}
+
+type StatementResult struct {
+	Columns      []string             `json:"columns,omitempty" jsonschema:"The result columns of a query."`
+	Rows         [][]any              `json:"rows,omitempty" jsonschema:"The result rows of a query."`
+	RowsAffected int64                `json:"rows_affected,omitempty" jsonschema:"The number of rows changed by a write statement."`
+	Warnings     []sqlite.LintWarning `json:"warnings,omitempty" jsonschema:"Risky patterns found in the statement."`
+}
+
+type TransactionOutput struct {
+	Results []StatementResult `json:"results" jsonschema:"The result of each statement, in order."`
+}
+
+func Transaction(ctx context.Context, req *mcp.CallToolRequest, input TransactionInput) (result *mcp.CallToolResult, output TransactionOutput, err error) {
+	if len(input.Statements) == 0 {
+		err = errors.New("no statements")
+		return
+	}
+	db, err := sqlite.DB(input.DatabaseID)
+	if err != nil {
+		return
+	}
+	queries := make([]sqlite.Request, len(input.Statements))
+	warnings := make([][]sqlite.LintWarning, len(input.Statements))
+	for i, stmt := range input.Statements {
+		if stmt.Statement, err = sqlite.InterceptQuery(ctx, input.DatabaseID, stmt.Statement); err != nil {
+			err = fmt.Errorf("statement %d: %w", i+1, err)
+			return
+		}
+		if warnings[i], err = sqlite.CheckLint(stmt.Statement, lintPolicy); err != nil {
+			err = fmt.Errorf("statement %d: %w", i+1, err)
+			return
+		}
+		if err = sqlite.CheckWritable(ctx, input.DatabaseID, stmt.Statement); err != nil {
+			return
+		}
+		queries[i] = sqlite.Request{Sql: stmt.Statement, Params: stmt.Params}
+	}
+	list, err := sqlite.Transaction(ctx, db, queries)
+	for i, query := range queries {
+		sqlite.AfterQuery(ctx, input.DatabaseID, query.Sql, err)
+		var res *sqlite.Response
+		if i < len(list) {
+			res = list[i]
+		}
+		auditStatement(ctx, input.DatabaseID, query.Sql, query.Params, res, err)
+	}
+	if err != nil {
+		return
+	}
+	for i, res := range list {
+		if res.NoReturning {
+			output.Results = append(output.Results, StatementResult{RowsAffected: res.RowsAffected, Warnings: warnings[i]})
+			continue
+		}
+		output.Results = append(output.Results, StatementResult{Columns: res.Columns, Rows: res.Rows, Warnings: warnings[i]})
+	}
+	return
+}
@@ -0,0 +1,213 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type Labels map[string]string
+
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%q", k, l[k])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+type family struct {
+	name   string
+	help   string
+	kind   kind
+	series map[string]*series
+}
+
+type series struct {
+	labels Labels
+	value  float64
+	// histogram
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var (
+	families = make(map[string]*family)
+	mu       sync.Mutex
+)
+
+func getSeries(name, help string, k kind, labels Labels) *series {
+	f, ok := families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: k, series: make(map[string]*series)}
+		families[name] = f
+	}
+	key := labels.String()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if k == kindHistogram {
+			s.counts = make([]uint64, len(DefaultBuckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func AddCounter(name, help string, labels Labels, v float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	getSeries(name, help, kindCounter, labels).value += v
+}
+
+func SetGauge(name, help string, labels Labels, v float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	getSeries(name, help, kindGauge, labels).value = v
+}
+
+func Observe(name, help string, labels Labels, v float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	s := getSeries(name, help, kindHistogram, labels)
+	for i, bound := range DefaultBuckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+type HistogramSummary struct {
+	Labels Labels  `json:"labels"`
+	Count  uint64  `json:"count"`
+	Sum    float64 `json:"sum"`
+	P50    float64 `json:"p50"`
+	P99    float64 `json:"p99"`
+}
+
+// Histograms returns the summary of every series of the histogram.
+func Histograms(name string) []HistogramSummary {
+	mu.Lock()
+	defer mu.Unlock()
+	f, ok := families[name]
+	if !ok {
+		return nil
+	}
+	list := make([]HistogramSummary, 0, len(f.series))
+	for _, s := range f.series {
+		list = append(list, HistogramSummary{
+			Labels: s.labels,
+			Count:  s.count,
+			Sum:    s.sum,
+			P50:    s.quantile(0.5),
+			P99:    s.quantile(0.99),
+		})
+	}
+	slices.SortFunc(list, func(a, b HistogramSummary) int {
+		return strings.Compare(a.Labels.String(), b.Labels.String())
+	})
+	return list
+}
+
+// quantile estimates the quantile using linear interpolation inside the bucket,
+// like the Prometheus histogram_quantile function.
+func (s *series) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := q * float64(s.count)
+	var prevCount uint64
+	prevBound := 0.0
+	for i, bound := range DefaultBuckets {
+		if float64(s.counts[i]) >= rank {
+			bucketCount := s.counts[i] - prevCount
+			if bucketCount == 0 {
+				return bound
+			}
+			return prevBound + (bound-prevBound)*(rank-float64(prevCount))/float64(bucketCount)
+		}
+		prevCount = s.counts[i]
+		prevBound = bound
+	}
+	return DefaultBuckets[len(DefaultBuckets)-1]
+}
+
+// WriteText writes all metrics using the Prometheus text exposition format.
+func WriteText(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != kindHistogram {
+				fmt.Fprintf(w, "%s%s %s\n", f.name, key, formatFloat(s.value))
+				continue
+			}
+			for i, bound := range DefaultBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", formatFloat(bound)), s.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, key, formatFloat(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, key, s.count)
+		}
+	}
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteText(w)
+}
+
+func withLabel(labels Labels, key, value string) string {
+	l := make(Labels, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[key] = value
+	return l.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
@@ -0,0 +1,46 @@
+package metrics_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/litesql/ha/internal/metrics"
+)
+
+func TestHistogram(t *testing.T) {
+	labels := metrics.Labels{"origin": "node1"}
+	for range 98 {
+		metrics.Observe("test_latency_seconds", "test", labels, 0.004)
+	}
+	metrics.Observe("test_latency_seconds", "test", labels, 2)
+	metrics.Observe("test_latency_seconds", "test", labels, 2)
+
+	list := metrics.Histograms("test_latency_seconds")
+	if len(list) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(list))
+	}
+	h := list[0]
+	if h.Count != 100 {
+		t.Errorf("count = %d, want 100", h.Count)
+	}
+	if h.P50 <= 0.0025 || h.P50 > 0.005 {
+		t.Errorf("p50 = %v, want in (0.0025, 0.005]", h.P50)
+	}
+	if h.P99 <= 1 || h.P99 > 2.5 {
+		t.Errorf("p99 = %v, want in (1, 2.5]", h.P99)
+	}
+
+	var buf bytes.Buffer
+	metrics.WriteText(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{le="+Inf",origin="node1"} 100`,
+		`test_latency_seconds_count{origin="node1"} 100`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
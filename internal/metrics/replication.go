@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/litesql/go-ha"
+)
+
+const ReplicationLatency = "ha_replication_latency_seconds"
+
+// LatencyInterceptor records the end-to-end replication latency, from the
+// origin commit (changeset timestamp) until the change is applied locally.
+type LatencyInterceptor struct{}
+
+func (LatencyInterceptor) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	return false, nil
+}
+
+func (LatencyInterceptor) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if err != nil || cs.Timestamp == 0 {
+		return err
+	}
+	latency := time.Since(time.Unix(0, cs.Timestamp)).Seconds()
+	if latency < 0 {
+		// clock skew between nodes
+		latency = 0
+	}
+	Observe(ReplicationLatency, "End-to-end replication latency from origin commit to local apply",
+		Labels{"database": cs.Filename, "origin": cs.Node}, latency)
+	return nil
+}
@@ -0,0 +1,220 @@
+package probe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/metrics"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+const (
+	tableName = "ha_probe"
+	delayName = "ha_probe_delay_seconds"
+
+	// staleIntervals is the number of probe intervals an origin can stay
+	// silent while another one writes before it is forgotten.
+	staleIntervals = 3
+)
+
+type observation struct {
+	delay time.Duration
+	at    time.Time
+}
+
+// source is a writer of probes to a database.
+type source struct {
+	database string
+	origin   string
+}
+
+// Probe periodically writes to the ha_probe table of every database this
+// node leads and measures when the replicas observe the writes.
+type Probe struct {
+	node     string
+	interval time.Duration
+	maxDelay time.Duration
+
+	mu       sync.Mutex
+	observed map[source]observation
+	// failed holds the last write error of the databases whose probe this
+	// node failed to write, the leader has no probe to observe.
+	failed map[string]error
+}
+
+func New(node string, interval, maxDelay time.Duration) *Probe {
+	return &Probe{
+		node:     node,
+		interval: interval,
+		maxDelay: maxDelay,
+		observed: make(map[source]observation),
+		failed:   make(map[string]error),
+	}
+}
+
+func (p *Probe) Start(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	created := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			databases := sqlite.Databases()
+			p.forget(databases)
+			for _, id := range databases {
+				connector, err := sqlite.Connector(id)
+				if err != nil || !connector.LeaderProvider().IsLeader() {
+					p.written(id, nil)
+					continue
+				}
+				db, err := sqlite.DB(id)
+				if err != nil {
+					continue
+				}
+				if !created[id] {
+					_, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+tableName+"(node TEXT PRIMARY KEY, written_at INTEGER NOT NULL)")
+					p.written(id, err)
+					if err != nil {
+						slog.Warn("failed to create probe table", "database", id, "error", err)
+						continue
+					}
+					created[id] = true
+				}
+				_, err = db.ExecContext(ctx, "INSERT INTO "+tableName+"(node, written_at) VALUES(?, ?) ON CONFLICT(node) DO UPDATE SET written_at = excluded.written_at",
+					p.node, time.Now().UnixNano())
+				p.written(id, err)
+				if err != nil {
+					slog.Warn("failed to write probe", "database", id, "error", err)
+				}
+			}
+		}
+	}
+}
+
+func (p *Probe) written(database string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failed[database] = err
+		return
+	}
+	delete(p.failed, database)
+}
+
+// forget drops the state of the databases no longer loaded.
+func (p *Probe) forget(databases []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for src := range p.observed {
+		if !slices.Contains(databases, src.database) {
+			delete(p.observed, src)
+		}
+	}
+	for database := range p.failed {
+		if !slices.Contains(databases, database) {
+			delete(p.failed, database)
+		}
+	}
+}
+
+// Ready fails when this node failed to write the probe of a database it
+// leads, or when the last observed propagation delay of a database exceeds
+// the bound or its probe writes stopped arriving. An origin silent for
+// staleIntervals intervals while another one writes to the same database,
+// like the former leader, is forgotten.
+func (p *Probe) Ready() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	databases := make([]string, 0, len(p.failed))
+	for database := range p.failed {
+		databases = append(databases, database)
+	}
+	if len(databases) > 0 {
+		slices.Sort(databases)
+		return fmt.Errorf("failed to write the probe of %q: %w", databases[0], p.failed[databases[0]])
+	}
+
+	latest := make(map[string]time.Time)
+	for src, obs := range p.observed {
+		if obs.at.After(latest[src.database]) {
+			latest[src.database] = obs.at
+		}
+	}
+	sources := make([]source, 0, len(p.observed))
+	for src, obs := range p.observed {
+		if latest[src.database].Sub(obs.at) > staleIntervals*p.interval {
+			delete(p.observed, src)
+			continue
+		}
+		sources = append(sources, src)
+	}
+	slices.SortFunc(sources, func(a, b source) int {
+		if c := strings.Compare(a.database, b.database); c != 0 {
+			return c
+		}
+		return strings.Compare(a.origin, b.origin)
+	})
+	for _, src := range sources {
+		obs := p.observed[src]
+		if obs.delay > p.maxDelay {
+			return fmt.Errorf("probe of %q from %q took %s to be applied (max %s)", src.database, src.origin, obs.delay, p.maxDelay)
+		}
+		if since := time.Since(obs.at); since > p.interval+p.maxDelay {
+			return fmt.Errorf("no probe of %q from %q received for %s", src.database, src.origin, since.Truncate(time.Millisecond))
+		}
+	}
+	return nil
+}
+
+func (p *Probe) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	return false, nil
+}
+
+func (p *Probe) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, change := range cs.Changes {
+		if change.Table != tableName || (change.Operation != "INSERT" && change.Operation != "UPDATE") {
+			continue
+		}
+		i := slices.Index(change.Columns, "written_at")
+		if i < 0 || i >= len(change.NewValues) {
+			continue
+		}
+		writtenAt, ok := toInt64(change.NewValues[i])
+		if !ok {
+			continue
+		}
+		delay := max(now.Sub(time.Unix(0, writtenAt)), 0)
+		metrics.SetGauge(delayName, "Propagation delay of the last canary probe write",
+			metrics.Labels{"database": cs.Filename, "origin": cs.Node}, delay.Seconds())
+		p.mu.Lock()
+		p.observed[source{database: cs.Filename, origin: cs.Node}] = observation{delay: delay, at: now}
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+func toInt64(v any) (int64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return x, true
+	case float64:
+		return int64(x), true
+	case int:
+		return int64(x), true
+	}
+	return 0, false
+}
@@ -0,0 +1,59 @@
+//go:build cgo
+
+package probe_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/probe"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+type failingPublisher struct{}
+
+func (failingPublisher) Publish(*ha.ChangeSet) error {
+	return errors.New("stream unavailable")
+}
+
+func (failingPublisher) Sequence() uint64 { return 0 }
+
+// TestReadyWriteFailure fails the readiness of the leader when it can't
+// write its probes: it has no probe of its own to observe.
+func TestReadyWriteFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := sqlite.Load(ctx, "file:"+filepath.Join(t.TempDir(), "probe_leader.db"), sqlite.LoadConfig{
+		MaxConns: 1,
+		Publisher: func(string, string) (ha.Publisher, error) {
+			return failingPublisher{}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := 10 * time.Millisecond
+	p := probe.New("leader", interval, 50*time.Millisecond)
+	go p.Start(ctx)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		err := p.Ready()
+		if err != nil {
+			if !strings.Contains(err.Error(), "probe_leader.db") {
+				t.Fatalf("want the failed probe of probe_leader.db, got %v", err)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the leader is ready without writing its probes")
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,87 @@
+package probe_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/probe"
+)
+
+func canary(p *probe.Probe, node string, writtenAt time.Time) error {
+	return canaryOf(p, "probe.db", node, writtenAt)
+}
+
+func canaryOf(p *probe.Probe, database, node string, writtenAt time.Time) error {
+	return p.AfterApply(&ha.ChangeSet{
+		Node:     node,
+		Filename: database,
+		Changes: []ha.Change{{
+			Table:     "ha_probe",
+			Operation: "UPDATE",
+			Columns:   []string{"node", "written_at"},
+			NewValues: []any{node, writtenAt.UnixNano()},
+		}},
+	}, nil, nil)
+}
+
+func TestReadyLeaderChange(t *testing.T) {
+	interval := 20 * time.Millisecond
+	p := probe.New("replica", interval, 50*time.Millisecond)
+	if err := canary(p, "old-leader", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Ready(); err != nil {
+		t.Fatalf("ready after a canary: %v", err)
+	}
+
+	// the old leader stops writing
+	time.Sleep(4 * interval)
+	if err := p.Ready(); err == nil || !strings.Contains(err.Error(), "old-leader") {
+		t.Fatalf("want the missing probe from the old leader, got %v", err)
+	}
+
+	// the new leader writes, the old one is forgotten
+	if err := canary(p, "new-leader", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Ready(); err != nil {
+		t.Fatalf("ready after the leader change: %v", err)
+	}
+}
+
+func TestReadyDelay(t *testing.T) {
+	p := probe.New("replica", time.Second, 50*time.Millisecond)
+	if err := canary(p, "leader", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Ready(); err == nil || !strings.Contains(err.Error(), "took") {
+		t.Fatalf("want a propagation delay error, got %v", err)
+	}
+}
+
+// TestReadyDatabases follows the probes of every database: the writes to one
+// database don't hide the missing probes of another one.
+func TestReadyDatabases(t *testing.T) {
+	interval := 20 * time.Millisecond
+	p := probe.New("replica", interval, 50*time.Millisecond)
+	for _, database := range []string{"orders.db", "stock.db"} {
+		if err := canaryOf(p, database, "leader", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Ready(); err != nil {
+		t.Fatalf("ready after the canaries: %v", err)
+	}
+
+	// the leader stops writing to stock.db
+	time.Sleep(4 * interval)
+	if err := canaryOf(p, "orders.db", "leader", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Ready(); err == nil || !strings.Contains(err.Error(), "stock.db") {
+		t.Fatalf("want the missing probe of stock.db, got %v", err)
+	}
+}
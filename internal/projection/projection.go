@@ -0,0 +1,243 @@
+package projection
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/litesql/go-ha"
+)
+
+const (
+	anyTable         = "*"
+	controlTableName = "ha_stats"
+
+	// EachChange executes the SQL of the projection once for every matching
+	// change, with the values of the change as parameters.
+	EachChange = "change"
+	// EachChangeSet executes the SQL of the projection once for every
+	// changeset with at least one matching change.
+	EachChangeSet = "changeset"
+)
+
+type Projection struct {
+	Name string `json:"name"`
+	// Database restricts the projection to the changesets of a database id.
+	Database string `json:"database,omitempty"`
+	// Tables are the table names, or path.Match patterns, of the changes
+	// that trigger the projection. Empty or "*" matches every table.
+	Tables []string `json:"tables,omitempty"`
+	// Operations are the INSERT, UPDATE and DELETE operations that trigger
+	// the projection. Empty matches every operation.
+	Operations []string `json:"operations,omitempty"`
+	SQL        string   `json:"sql"`
+	Each       string   `json:"each,omitempty"`
+}
+
+// Projector maintains local read models from the replicated changes: after a
+// changeset is applied it executes the SQL of the projections matching its
+// changes. The writes of the projections are not replicated.
+type Projector struct {
+	projections []Projection
+	// applying holds the changesets not skipped by the interceptors before
+	// the projector in the chain.
+	applying sync.Map
+}
+
+// Load reads the projections from a JSON file.
+func Load(path string) (*Projector, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var projections []Projection
+	if err := json.Unmarshal(data, &projections); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", path, err)
+	}
+	return New(projections)
+}
+
+func New(projections []Projection) (*Projector, error) {
+	for i := range projections {
+		p := &projections[i]
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("projection %d", i)
+		}
+		if strings.TrimSpace(p.SQL) == "" {
+			return nil, fmt.Errorf("%s: sql is required", p.Name)
+		}
+		if len(p.Tables) == 0 {
+			p.Tables = []string{anyTable}
+		}
+		for j, table := range p.Tables {
+			table = strings.ToLower(table)
+			if _, err := path.Match(table, ""); err != nil {
+				return nil, fmt.Errorf("%s: invalid table pattern %q: %w", p.Name, table, err)
+			}
+			p.Tables[j] = table
+		}
+		for j, op := range p.Operations {
+			op = strings.ToUpper(op)
+			switch op {
+			case "INSERT", "UPDATE", "DELETE":
+			default:
+				return nil, fmt.Errorf("%s: invalid operation %q. Valid values: INSERT, UPDATE, DELETE", p.Name, op)
+			}
+			p.Operations[j] = op
+		}
+		switch strings.ToLower(p.Each) {
+		case "", EachChange:
+			p.Each = EachChange
+		case EachChangeSet:
+			p.Each = EachChangeSet
+		default:
+			return nil, fmt.Errorf("%s: invalid each %q. Valid values: change, changeset", p.Name, p.Each)
+		}
+	}
+	return &Projector{projections: projections}, nil
+}
+
+func (p *Projector) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	p.applying.Store(cs, struct{}{})
+	return false, nil
+}
+
+// AfterApply executes the projections of the changeset applied. A failed
+// projection is logged and does not fail the changeset, as applying it again
+// would run the successful projections twice.
+func (p *Projector) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if _, ok := p.applying.LoadAndDelete(cs); !ok || err != nil {
+		return err
+	}
+	if errProject := p.Project(context.Background(), cs, conn); errProject != nil {
+		slog.Error("failed to execute projection", "database", cs.Filename, "stream_seq", cs.StreamSeq, "error", errProject)
+	}
+	return nil
+}
+
+// Project executes the projections matching the changes of cs on conn, in a
+// single transaction.
+func (p *Projector) Project(ctx context.Context, cs *ha.ChangeSet, conn *sql.Conn) error {
+	var tx *sql.Tx
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	exec := func(proj *Projection, args []any) error {
+		if tx == nil {
+			var err error
+			if tx, err = conn.BeginTx(ctx, nil); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, proj.SQL, args...); err != nil {
+			return fmt.Errorf("%s: %w", proj.Name, err)
+		}
+		return nil
+	}
+	for i := range p.projections {
+		proj := &p.projections[i]
+		if proj.Database != "" && proj.Database != cs.Filename {
+			continue
+		}
+		var matched []ha.Change
+		for _, change := range cs.Changes {
+			if proj.match(change) {
+				matched = append(matched, change)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		if proj.Each == EachChangeSet {
+			tables := make([]string, 0, len(matched))
+			for _, change := range matched {
+				if !slices.Contains(tables, change.Table) {
+					tables = append(tables, change.Table)
+				}
+			}
+			if err := exec(proj, []any{
+				sql.Named("database", cs.Filename),
+				sql.Named("node", cs.Node),
+				sql.Named("tables", strings.Join(tables, ",")),
+				sql.Named("changes", len(matched)),
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, change := range matched {
+			if err := exec(proj, changeArgs(cs, change)); err != nil {
+				return err
+			}
+		}
+	}
+	if tx == nil {
+		return nil
+	}
+	err := tx.Commit()
+	tx = nil
+	return err
+}
+
+func (proj *Projection) match(change ha.Change) bool {
+	if change.Table == "" || change.Table == controlTableName {
+		return false
+	}
+	switch change.Operation {
+	case "INSERT", "UPDATE", "DELETE":
+	default:
+		return false
+	}
+	if len(proj.Operations) > 0 && !slices.Contains(proj.Operations, change.Operation) {
+		return false
+	}
+	table := strings.ToLower(change.Table)
+	return slices.ContainsFunc(proj.Tables, func(pattern string) bool {
+		ok, _ := path.Match(pattern, table)
+		return pattern == anyTable || ok
+	})
+}
+
+// changeArgs returns the named parameters of a change: :database, :node,
+// :table, :operation, and :new_<column> and :old_<column> for the values.
+func changeArgs(cs *ha.ChangeSet, change ha.Change) []any {
+	args := make([]any, 0, 4+2*len(change.Columns))
+	args = append(args,
+		sql.Named("database", cs.Filename),
+		sql.Named("node", cs.Node),
+		sql.Named("table", change.Table),
+		sql.Named("operation", change.Operation))
+	for i, column := range change.Columns {
+		var newValue, oldValue any
+		if i < len(change.NewValues) {
+			newValue = change.NewValues[i]
+		}
+		if i < len(change.OldValues) {
+			oldValue = change.OldValues[i]
+		}
+		name := parameterName(column)
+		args = append(args, sql.Named("new_"+name, newValue), sql.Named("old_"+name, oldValue))
+	}
+	return args
+}
+
+// parameterName replaces the characters of a column name not allowed in a
+// named parameter by underscores.
+func parameterName(column string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, column)
+}
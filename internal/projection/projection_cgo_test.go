@@ -0,0 +1,91 @@
+//go:build cgo
+
+package projection_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/litesql/go-ha"
+	_ "github.com/litesql/go-sqlite3"
+
+	"github.com/litesql/ha/internal/projection"
+)
+
+func TestProject(t *testing.T) {
+	p, err := projection.New([]projection.Projection{
+		{
+			Name:       "totals",
+			Tables:     []string{"orders"},
+			Operations: []string{"insert"},
+			SQL: `INSERT INTO totals(customer, total) VALUES(:new_customer, :new_amount)
+				ON CONFLICT(customer) DO UPDATE SET total = total + excluded.total`,
+		},
+		{
+			Name:   "refresh",
+			Tables: []string{"order*"},
+			Each:   projection.EachChangeSet,
+			SQL:    "INSERT INTO refreshes(tables, changes) VALUES(:tables, :changes)",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `CREATE TABLE totals(customer TEXT PRIMARY KEY, total INTEGER);
+		CREATE TABLE refreshes(tables TEXT, changes INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cs := ha.NewChangeSet("node1", "ha.db")
+	cs.Changes = []ha.Change{
+		{Table: "orders", Operation: "INSERT", Columns: []string{"customer", "amount"}, NewValues: []any{"acme", int64(10)}},
+		{Table: "orders", Operation: "INSERT", Columns: []string{"customer", "amount"}, NewValues: []any{"acme", int64(5)}},
+		{Table: "orders", Operation: "DELETE", Columns: []string{"customer", "amount"}, OldValues: []any{"acme", int64(5)}},
+		{Table: "customers", Operation: "INSERT", Columns: []string{"name"}, NewValues: []any{"acme"}},
+		{Table: "ha_stats", Operation: "LINK", Columns: []string{"id"}, NewValues: []any{"x"}},
+	}
+	if err := p.Project(ctx, cs, conn); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	if err := conn.QueryRowContext(ctx, "SELECT total FROM totals WHERE customer = 'acme'").Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if total != 15 {
+		t.Errorf("total = %d, want 15", total)
+	}
+	var tables string
+	var changes int64
+	if err := conn.QueryRowContext(ctx, "SELECT tables, changes FROM refreshes").Scan(&tables, &changes); err != nil {
+		t.Fatal(err)
+	}
+	if tables != "orders" || changes != 3 {
+		t.Errorf("refresh = %q, %d, want orders, 3", tables, changes)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, p := range []projection.Projection{
+		{Tables: []string{"t"}},
+		{SQL: "SELECT 1", Operations: []string{"MERGE"}},
+		{SQL: "SELECT 1", Each: "row"},
+		{SQL: "SELECT 1", Tables: []string{"[x"}},
+	} {
+		if _, err := projection.New([]projection.Projection{p}); err == nil {
+			t.Errorf("expected error for %+v", p)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package querylog logs the statements executed by the clients of the HTTP,
+// PostgreSQL and MySQL interfaces, sampled or only the slow ones, with the
+// literal values redacted.
+package querylog
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// Sample is the fraction (from 0 to 1) of the statements logged.
+	Sample float64
+	// SlowThreshold logs the statements taking longer regardless of Sample.
+	SlowThreshold time.Duration
+	// Values logs the literals and parameter values instead of redacting
+	// them.
+	Values bool
+}
+
+// Entry is a statement executed on a connection.
+type Entry struct {
+	Protocol string
+	Database string
+	User     string
+	Remote   string
+	// Session identifies the connection when the protocol has one, like the
+	// PostgreSQL backend pid.
+	Session  string
+	SQL      string
+	Params   any
+	Duration time.Duration
+	Error    error
+}
+
+var cfg Config
+
+// SlowStatement is a slow statement kept for the support bundle, redacted
+// like in the log.
+type SlowStatement struct {
+	Time       time.Time `json:"time"`
+	Protocol   string    `json:"protocol"`
+	Database   string    `json:"database"`
+	User       string    `json:"user,omitempty"`
+	SQL        string    `json:"sql"`
+	DurationMs float64   `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// slowKept is the number of recent slow statements kept.
+const slowKept = 100
+
+var slow struct {
+	sync.Mutex
+	list []SlowStatement
+}
+
+// SlowStatements returns the most recent slow statements, the oldest first.
+func SlowStatements() []SlowStatement {
+	slow.Lock()
+	defer slow.Unlock()
+	return slices.Clone(slow.list)
+}
+
+func Configure(c Config) {
+	cfg = c
+}
+
+func Enabled() bool {
+	return cfg.Sample > 0 || cfg.SlowThreshold > 0
+}
+
+// Log writes the entry when it is sampled or slow. The failed statements are
+// logged as long as the query log is enabled.
+func Log(e Entry) {
+	if !Enabled() {
+		return
+	}
+	isSlow := cfg.SlowThreshold > 0 && e.Duration >= cfg.SlowThreshold
+	if !isSlow && e.Error == nil && (cfg.Sample <= 0 || cfg.Sample < 1 && rand.Float64() >= cfg.Sample) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("protocol", e.Protocol),
+		slog.String("database", e.Database),
+		slog.String("user", e.User),
+		slog.String("remote", e.Remote),
+	}
+	if e.Session != "" {
+		attrs = append(attrs, slog.String("session", e.Session))
+	}
+	sql, params := e.SQL, e.Params
+	if !cfg.Values {
+		sql, params = Redact(sql), redactParams(params)
+	}
+	attrs = append(attrs, slog.String("sql", sql))
+	if params != nil {
+		attrs = append(attrs, slog.Any("params", params))
+	}
+	attrs = append(attrs, slog.Float64("duration_ms", float64(e.Duration.Microseconds())/1000))
+	level, msg := slog.LevelInfo, "statement"
+	if isSlow {
+		level, msg = slog.LevelWarn, "slow statement"
+		keepSlow(e, sql)
+	}
+	if e.Error != nil {
+		attrs = append(attrs, slog.String("error", e.Error.Error()))
+	}
+	slog.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+func keepSlow(e Entry, sql string) {
+	stmt := SlowStatement{
+		Time:       time.Now().UTC(),
+		Protocol:   e.Protocol,
+		Database:   e.Database,
+		User:       e.User,
+		SQL:        sql,
+		DurationMs: float64(e.Duration.Microseconds()) / 1000,
+	}
+	if e.Error != nil {
+		stmt.Error = e.Error.Error()
+	}
+	slow.Lock()
+	defer slow.Unlock()
+	if len(slow.list) == slowKept {
+		slow.list = slices.Delete(slow.list, 0, 1)
+	}
+	slow.list = append(slow.list, stmt)
+}
+
+// redactParams keeps the names of the named parameters and the number of the
+// positional ones.
+func redactParams(params any) any {
+	switch p := params.(type) {
+	case map[string]any:
+		if len(p) == 0 {
+			return nil
+		}
+		names := make([]string, 0, len(p))
+		for name := range p {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	case []any:
+		if len(p) == 0 {
+			return nil
+		}
+		return len(p)
+	}
+	return nil
+}
+
+// Redact replaces the string, blob and numeric literals of the statement
+// with ?. The identifiers, quoted or not, and the comments are kept.
+func Redact(sql string) string {
+	var sb strings.Builder
+	sb.Grow(len(sql))
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\'':
+			i = skipQuoted(sql, i, '\'')
+			sb.WriteByte('?')
+		case (c == 'x' || c == 'X') && i+1 < len(sql) && sql[i+1] == '\'' && !identPart(sql, i):
+			i = skipQuoted(sql, i+1, '\'')
+			sb.WriteByte('?')
+		case c == '"' || c == '`':
+			end := skipQuoted(sql, i, c)
+			sb.WriteString(sql[i:end])
+			i = end
+		case c == '[':
+			end := strings.IndexByte(sql[i:], ']')
+			if end < 0 {
+				end = len(sql) - i - 1
+			}
+			sb.WriteString(sql[i : i+end+1])
+			i += end + 1
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			sb.WriteString(sql[i : i+end])
+			i += end
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql) - i - 2
+			} else {
+				end += 2
+			}
+			sb.WriteString(sql[i : i+end+2])
+			i += end + 2
+		case c == '$' && i+1 < len(sql) && (sql[i+1] == '$' || isIdent(sql[i+1])) && !isDigit(sql[i+1]):
+			// PostgreSQL dollar quoted string, $$...$$ or $tag$...$tag$
+			tag := strings.IndexByte(sql[i+1:], '$')
+			if tag < 0 {
+				sb.WriteString(sql[i:])
+				i = len(sql)
+				continue
+			}
+			delim := sql[i : i+tag+2]
+			end := strings.Index(sql[i+len(delim):], delim)
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += len(delim) + end + len(delim)
+			}
+			sb.WriteByte('?')
+		case isDigit(c) && !identPart(sql, i) || c == '.' && i+1 < len(sql) && isDigit(sql[i+1]) && !identPart(sql, i):
+			i++
+			for i < len(sql) && (isIdent(sql[i]) || sql[i] == '.' ||
+				(sql[i] == '+' || sql[i] == '-') && (sql[i-1] == 'e' || sql[i-1] == 'E')) {
+				i++
+			}
+			sb.WriteByte('?')
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return sb.String()
+}
+
+// skipQuoted returns the index after the quoted text starting at i, the
+// doubled quotes are escapes.
+func skipQuoted(sql string, i int, quote byte) int {
+	for i++; i < len(sql); i++ {
+		if sql[i] != quote {
+			continue
+		}
+		if i+1 < len(sql) && sql[i+1] == quote {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(sql)
+}
+
+// identPart reports whether the byte at i continues an identifier, like the
+// digits of t1 or the parameter ?1.
+func identPart(sql string, i int) bool {
+	if i == 0 {
+		return false
+	}
+	p := sql[i-1]
+	return isIdent(p) || p == '?' || p == '$' || p == ':' || p == '@'
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
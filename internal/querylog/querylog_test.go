@@ -0,0 +1,25 @@
+package querylog_test
+
+import (
+	"testing"
+
+	"github.com/litesql/ha/internal/querylog"
+)
+
+func TestRedact(t *testing.T) {
+	tests := map[string]string{
+		"SELECT * FROM users WHERE email = 'a@b.com'":                   "SELECT * FROM users WHERE email = ?",
+		"INSERT INTO t1(a, b) VALUES (42, 'it''s'), (-1.5e-3, X'00ff')": "INSERT INTO t1(a, b) VALUES (?, ?), (-?, ?)",
+		`SELECT "col 1", [col2], ` + "`col3`" + ` FROM t2 LIMIT 10`:     `SELECT "col 1", [col2], ` + "`col3`" + ` FROM t2 LIMIT ?`,
+		"UPDATE t SET a = ?1, b = :name, c = $2 WHERE id = @id":         "UPDATE t SET a = ?1, b = :name, c = $2 WHERE id = @id",
+		"SELECT 1 -- ping\n":                            "SELECT ? -- ping\n",
+		"SELECT /* hint */ .5, $$secret$$, $tag$x$tag$": "SELECT /* hint */ ?, ?, ?",
+		"SELECT 'unterminated":                          "SELECT ?",
+		"SELECT t.x1 FROM t":                            "SELECT t.x1 FROM t",
+	}
+	for sql, want := range tests {
+		if got := querylog.Redact(sql); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
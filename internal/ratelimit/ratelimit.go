@@ -0,0 +1,203 @@
+// Package ratelimit bounds what a single client can take from the wire
+// servers: its open connections and its request rate, counted per client IP,
+// so a misbehaving client can't exhaust the SQLite connection pool.
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/litesql/ha/internal/metrics"
+)
+
+const rejectedName = "ha_rate_limited_total"
+
+type Config struct {
+	// MaxConnections is the number of connections open at once per client IP,
+	// 0 is unlimited.
+	MaxConnections int
+	// Rate is the number of requests per second per client IP, 0 is
+	// unlimited. A client may burst up to Rate requests at once.
+	Rate int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter counts the connections and the requests of the clients.
+type Limiter struct {
+	cfg Config
+
+	mu      sync.Mutex
+	conns   map[string]int
+	buckets map[string]*bucket
+}
+
+func New(cfg Config) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		conns:   make(map[string]int),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Enabled reports whether a limit is set.
+func (l *Limiter) Enabled() bool {
+	return l != nil && (l.cfg.MaxConnections > 0 || l.cfg.Rate > 0)
+}
+
+// Allow takes a request of the client from its bucket, false when it is
+// empty.
+func (l *Limiter) Allow(addr string) bool {
+	if l == nil || l.cfg.Rate <= 0 {
+		return true
+	}
+	ip := host(addr)
+	now := time.Now()
+	rate := float64(l.cfg.Rate)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		if len(l.buckets) >= 1024 {
+			l.prune(now)
+		}
+		b = &bucket{tokens: rate, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = min(rate, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets the buckets refilled, l.mu held.
+func (l *Limiter) prune(now time.Time) {
+	for ip, b := range l.buckets {
+		if now.Sub(b.last).Seconds()*float64(l.cfg.Rate)+b.tokens >= float64(l.cfg.Rate) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// acquire counts a connection of the client, false above the limit.
+func (l *Limiter) acquire(ip string) bool {
+	if l.cfg.MaxConnections <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.cfg.MaxConnections {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *Limiter) release(ip string) {
+	if l.cfg.MaxConnections <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// Listener counts the connections accepted per client IP. The connections
+// above the limit are handed to reject, writing the error of the protocol,
+// then closed.
+func (l *Limiter) Listener(ln net.Listener, server string, reject func(net.Conn)) net.Listener {
+	if l == nil || l.cfg.MaxConnections <= 0 {
+		return ln
+	}
+	return &listener{Listener: ln, limiter: l, server: server, reject: reject}
+}
+
+type listener struct {
+	net.Listener
+	limiter *Limiter
+	server  string
+	reject  func(net.Conn)
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := host(conn.RemoteAddr().String())
+		if ln.limiter.acquire(ip) {
+			return &limitedConn{Conn: conn, release: sync.OnceFunc(func() { ln.limiter.release(ip) })}, nil
+		}
+		Rejected(ln.server, "connections")
+		go func() {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			if ln.reject != nil {
+				ln.reject(conn)
+			}
+			conn.Close()
+		}()
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// Rejected counts a connection or a request refused by a limit.
+func Rejected(server, limit string) {
+	metrics.AddCounter(rejectedName, "Connections and requests refused by the per client limits",
+		metrics.Labels{"server": server, "limit": limit}, 1)
+}
+
+// Middleware answers 429 Too Many Requests to the clients above the rate
+// limit. The health probes are not limited.
+func Middleware(l *Limiter, next http.Handler) http.Handler {
+	if l == nil || l.cfg.Rate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/livez", "/readyz":
+		default:
+			if !l.Allow(r.RemoteAddr) {
+				Rejected("http", "rate")
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RejectHTTP answers 429 Too Many Requests to a connection above the limit.
+func RejectHTTP(conn net.Conn) {
+	const body = "too many connections\n"
+	conn.Write([]byte("HTTP/1.1 429 Too Many Requests\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\nRetry-After: 1\r\nContent-Length: " +
+		strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+}
+
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
@@ -0,0 +1,74 @@
+package ratelimit_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/litesql/ha/internal/ratelimit"
+)
+
+func TestAllow(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{Rate: 3})
+	for i := range 3 {
+		if !limiter.Allow("10.0.0.1:5000") {
+			t.Fatalf("request %d refused within the burst", i)
+		}
+	}
+	if limiter.Allow("10.0.0.1:5001") {
+		t.Errorf("request above the rate allowed")
+	}
+	if !limiter.Allow("10.0.0.2:5000") {
+		t.Errorf("request of another client refused")
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := ratelimit.New(ratelimit.Config{MaxConnections: 1})
+	ln = limiter.Listener(ln, "http", ratelimit.RejectHTTP)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	conn := <-accepted
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	res, err := http.ReadResponse(bufio.NewReader(second), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("got status %d, want %d", res.StatusCode, http.StatusTooManyRequests)
+	}
+
+	// the slot is released when the connection closes
+	conn.Close()
+	third, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	(<-accepted).Close()
+}
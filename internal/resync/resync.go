@@ -0,0 +1,217 @@
+package resync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// Watcher detects the databases that missed replication messages, because
+// their durable consumer was deleted or the stream discarded messages they
+// did not apply yet (max age, purge), and resyncs them from the latest
+// snapshot instead of silently diverging.
+type Watcher struct {
+	js       jetstream.JetStream
+	node     string
+	interval time.Duration
+
+	// reported keeps the applied sequence of the gaps no snapshot recovers,
+	// logged once
+	reported map[string]uint64
+}
+
+func New(js jetstream.JetStream, node string, interval time.Duration) *Watcher {
+	return &Watcher{
+		js:       js,
+		node:     node,
+		interval: interval,
+		reported: make(map[string]uint64),
+	}
+}
+
+func (w *Watcher) Start(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ids := sqlite.Databases()
+			slices.Sort(ids)
+			for _, id := range ids {
+				w.check(ctx, id)
+			}
+		}
+	}
+}
+
+func (w *Watcher) check(ctx context.Context, id string) {
+	applied, err := sqlite.AppliedSeq(id)
+	if err != nil {
+		return
+	}
+	gap, minSequence, err := w.Gap(ctx, id, applied)
+	if err != nil {
+		slog.Debug("failed to check the replication stream", "id", id, "error", err)
+		return
+	}
+	if gap == "" {
+		delete(w.reported, id)
+		return
+	}
+	if seq, ok := w.reported[id]; ok && seq == applied {
+		return
+	}
+	slog.Warn("replication gap detected", "id", id, "applied_seq", applied, "reason", gap)
+	sequence, err := sqlite.Resync(ctx, id, minSequence)
+	if err != nil {
+		w.reported[id] = applied
+		slog.Error("failed to resync database, changes are missing", "id", id, "error", err)
+		return
+	}
+	delete(w.reported, id)
+	slog.Info("database resynced", "id", id, "snapshot_seq", sequence)
+}
+
+// Gap returns why the database missed replication messages, or an empty
+// string, and the minimum snapshot sequence resyncing it. The node has
+// applied the messages up to the applied sequence.
+func (w *Watcher) Gap(ctx context.Context, id string, applied uint64) (string, uint64, error) {
+	streamName, _, err := sqlite.ReplicationSubject(id)
+	if err != nil {
+		return "", 0, err
+	}
+	stream, err := w.js.Stream(ctx, streamName)
+	if err != nil {
+		return "", 0, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	// the messages before the first one are gone
+	minSequence := info.State.FirstSeq - 1
+	_, err = stream.Consumer(ctx, sqlite.ConsumerName(id, w.node))
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return "durable consumer deleted", minSequence, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	// with nothing applied yet, the subscription starts where it was
+	// configured
+	if applied > 0 && minSequence > applied {
+		return fmt.Sprintf("stream first sequence %d is past the next sequence %d", info.State.FirstSeq, applied+1), minSequence, nil
+	}
+	return "", 0, nil
+}
+
+var (
+	ErrInvalidSequence = errors.New("invalid rewind sequence")
+	ErrNoSnapshot      = errors.New("no retained snapshot at or before the sequence")
+)
+
+// SnapshotFinder returns the most recent snapshot of the database at or
+// before the sequence, or a nil reader if there is none.
+type SnapshotFinder func(ctx context.Context, id string, sequence uint64) (uint64, io.ReadCloser, error)
+
+// Rewind rebuilds the database from the most recent snapshot at or before
+// the sequence found by the finders and replays the stream forward from
+// there. The stream must still hold the messages after the snapshot. It
+// returns the snapshot sequence.
+func Rewind(ctx context.Context, js jetstream.JetStream, id string, sequence uint64, finders ...SnapshotFinder) (uint64, error) {
+	applied, err := sqlite.AppliedSeq(id)
+	if err != nil {
+		return 0, err
+	}
+	if sequence > applied {
+		return 0, fmt.Errorf("%w: the database applied the stream up to %d", ErrInvalidSequence, applied)
+	}
+	streamName, _, err := sqlite.ReplicationSubject(id)
+	if err != nil {
+		return 0, err
+	}
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return 0, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	snapshotSeq, reader, err := FindSnapshot(ctx, id, sequence, finders...)
+	if err != nil {
+		return 0, err
+	}
+	// the messages before the first one are gone
+	if snapshotSeq+1 < info.State.FirstSeq {
+		reader.Close()
+		return 0, fmt.Errorf("%w: the snapshot %d is before the stream first sequence %d", sqlite.ErrSnapshotTooOld, snapshotSeq, info.State.FirstSeq)
+	}
+	if err := sqlite.Rewind(ctx, id, snapshotSeq, reader); err != nil {
+		return 0, err
+	}
+	return snapshotSeq, nil
+}
+
+// FindSnapshot returns the most recent snapshot at or before the sequence
+// found by the finders, ErrNoSnapshot when there is none.
+func FindSnapshot(ctx context.Context, id string, sequence uint64, finders ...SnapshotFinder) (uint64, io.ReadCloser, error) {
+	var (
+		snapshotSeq uint64
+		reader      io.ReadCloser
+	)
+	for _, find := range finders {
+		seq, r, err := find(ctx, id, sequence)
+		if err != nil {
+			slog.Warn("failed to look up a snapshot", "id", id, "sequence", sequence, "error", err)
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		if reader != nil && seq <= snapshotSeq {
+			r.Close()
+			continue
+		}
+		if reader != nil {
+			reader.Close()
+		}
+		snapshotSeq, reader = seq, r
+	}
+	if reader == nil {
+		return 0, nil, fmt.Errorf("%w %d", ErrNoSnapshot, sequence)
+	}
+	return snapshotSeq, reader, nil
+}
+
+// LatestSnapshot is a SnapshotFinder of the latest snapshot of the database,
+// the one loaded at startup, when it is at or before the sequence.
+func LatestSnapshot(ctx context.Context, id string, sequence uint64) (uint64, io.ReadCloser, error) {
+	connector, err := sqlite.Connector(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	seq, reader, err := connector.LatestSnapshot(ctx)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return 0, nil, nil
+	}
+	if err != nil || reader == nil {
+		return 0, nil, err
+	}
+	if seq > sequence {
+		reader.Close()
+		return 0, nil, nil
+	}
+	return seq, reader, nil
+}
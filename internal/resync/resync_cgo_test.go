@@ -0,0 +1,338 @@
+//go:build cgo
+
+package resync_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/resync"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+const node = "node1"
+
+func runJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+// replica is a database of node1 replicated from its stream, rebuilt from
+// the snapshot taken by takeSnapshot.
+type replica struct {
+	id       string
+	file     string
+	stream   string
+	subject  string
+	js       jetstream.JetStream
+	db       *sql.DB
+	snapshot string
+	// snapshotSeq is the sequence of the snapshot, 0 when there is none
+	snapshotSeq atomic.Uint64
+}
+
+func loadReplica(t *testing.T, js jetstream.JetStream, id string) *replica {
+	t.Helper()
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := &replica{
+		id:       id,
+		file:     filepath.Join(dir, id),
+		stream:   "resync_" + id[:len(id)-len(filepath.Ext(id))],
+		js:       js,
+		snapshot: filepath.Join(dir, "snapshot.db"),
+	}
+	url := js.Conn().ConnectedUrl()
+	err := sqlite.Load(ctx, "file:"+r.file, sqlite.LoadConfig{
+		MaxConns: 2,
+		Stream:   r.stream,
+		Options: []ha.Option{
+			ha.WithName(node),
+			ha.WithReplicationURL(url),
+			ha.WithReplicationStream(r.stream),
+		},
+		SnapshotSource: func(context.Context, string) (uint64, io.ReadCloser, error) {
+			seq := r.snapshotSeq.Load()
+			if seq == 0 {
+				return 0, nil, nil
+			}
+			f, err := os.Open(r.snapshot)
+			return seq, f, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, r.subject, err = sqlite.ReplicationSubject(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.db, err = sqlite.DB(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// publish publishes the statements as a changeset of another node and returns
+// its stream sequence.
+func (r *replica) publish(t *testing.T, statements ...string) uint64 {
+	t.Helper()
+	cs := ha.ChangeSet{Node: "node2", Filename: r.id, Timestamp: time.Now().UnixNano()}
+	for _, s := range statements {
+		cs.Changes = append(cs.Changes, ha.Change{Operation: "SQL", Command: s})
+	}
+	data, err := json.Marshal(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := r.js.Publish(context.Background(), r.subject, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ack.Sequence
+}
+
+// waitApplied waits until the replica applied the stream up to the sequence.
+func (r *replica) waitApplied(t *testing.T, sequence uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		applied, err := sqlite.AppliedSeq(r.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied >= sequence {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("applied the stream up to %d, want %d", applied, sequence)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// takeSnapshot copies the replica as the snapshot of the sequence.
+func (r *replica) takeSnapshot(t *testing.T, sequence uint64) {
+	t.Helper()
+	os.Remove(r.snapshot)
+	db, err := sql.Open("sqlite3", "file:"+r.file+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("VACUUM INTO ?", r.snapshot); err != nil {
+		t.Fatal(err)
+	}
+	r.snapshotSeq.Store(sequence)
+}
+
+func (r *replica) count(t *testing.T) int {
+	t.Helper()
+	db, err := sqlite.DB(r.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRowContext(context.Background(), "SELECT count(*) FROM items").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func (r *replica) deleteConsumer(t *testing.T) {
+	t.Helper()
+	if err := r.js.DeleteConsumer(context.Background(), r.stream, sqlite.ConsumerName(r.id, node)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGap(t *testing.T) {
+	ctx := context.Background()
+	js := runJetStream(t)
+	r := loadReplica(t, js, "gap.db")
+	r.waitApplied(t, r.publish(t, "CREATE TABLE items(id INTEGER PRIMARY KEY)", "INSERT INTO items VALUES (1)"))
+	applied, err := sqlite.AppliedSeq(r.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := resync.New(js, node, time.Second)
+
+	if gap, _, err := w.Gap(ctx, r.id, applied); err != nil || gap != "" {
+		t.Fatalf("gap %q, %v before any message was lost", gap, err)
+	}
+
+	r.publish(t, "INSERT INTO items VALUES (2)")
+	r.waitApplied(t, r.publish(t, "INSERT INTO items VALUES (3)"))
+	stream, err := js.Stream(ctx, r.stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Purge(ctx, jetstream.WithPurgeSequence(applied+2)); err != nil {
+		t.Fatal(err)
+	}
+	gap, minSequence, err := w.Gap(ctx, r.id, applied)
+	if err != nil || gap == "" {
+		t.Fatalf("gap %q, %v after the stream discarded the next messages", gap, err)
+	}
+	if minSequence != applied+1 {
+		t.Errorf("min snapshot sequence %d, want %d", minSequence, applied+1)
+	}
+
+	r.deleteConsumer(t)
+	if gap, _, err := w.Gap(ctx, r.id, applied+2); err != nil || gap != "durable consumer deleted" {
+		t.Fatalf("gap %q, %v after the consumer was deleted", gap, err)
+	}
+}
+
+// TestWatcherResync rebuilds a database whose durable consumer was deleted
+// from the latest snapshot: the messages published while it was gone are
+// applied again.
+func TestWatcherResync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	js := runJetStream(t)
+	r := loadReplica(t, js, "watched.db")
+	seq := r.publish(t, "CREATE TABLE items(id INTEGER PRIMARY KEY)", "INSERT INTO items VALUES (1)")
+	r.waitApplied(t, seq)
+	r.takeSnapshot(t, seq)
+
+	r.deleteConsumer(t)
+	r.publish(t, "INSERT INTO items VALUES (2)")
+	w := resync.New(js, node, 20*time.Millisecond)
+	go w.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.count(t) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d rows, want the message published without consumer", r.count(t))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	applied, err := sqlite.AppliedSeq(r.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gap, _, err := w.Gap(ctx, r.id, applied); err != nil || gap != "" {
+		t.Errorf("gap %q, %v after the resync", gap, err)
+	}
+}
+
+// TestWatcherOwnChanges keeps a database whose durable consumer was deleted
+// when the latest snapshot misses changes the node published: the resync
+// would lose them.
+func TestWatcherOwnChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	js := runJetStream(t)
+	r := loadReplica(t, js, "own.db")
+	seq := r.publish(t, "CREATE TABLE items(id INTEGER PRIMARY KEY)")
+	r.waitApplied(t, seq)
+	r.takeSnapshot(t, seq)
+	if _, err := r.db.ExecContext(ctx, "INSERT INTO items VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	r.deleteConsumer(t)
+	w := resync.New(js, node, 20*time.Millisecond)
+	go w.Start(ctx)
+	time.Sleep(200 * time.Millisecond)
+
+	if got := r.count(t); got != 1 {
+		t.Errorf("%d rows, want the row written by the node", got)
+	}
+	if _, err := sqlite.Resync(ctx, r.id, 0); !errors.Is(err, sqlite.ErrOwnChanges) {
+		t.Errorf("resync: got %v, want ErrOwnChanges", err)
+	}
+}
+
+func TestRewind(t *testing.T) {
+	ctx := context.Background()
+	js := runJetStream(t)
+	r := loadReplica(t, js, "rewind.db")
+	first := r.publish(t, "CREATE TABLE items(id INTEGER PRIMARY KEY)", "INSERT INTO items VALUES (1)")
+	r.waitApplied(t, first)
+	r.takeSnapshot(t, first)
+	last := r.publish(t, "INSERT INTO items VALUES (2)")
+	r.waitApplied(t, last)
+	finder := func(_ context.Context, _ string, sequence uint64) (uint64, io.ReadCloser, error) {
+		if sequence < first {
+			return 0, nil, nil
+		}
+		f, err := os.Open(r.snapshot)
+		return first, f, err
+	}
+
+	if _, err := resync.Rewind(ctx, js, r.id, last+1, finder); !errors.Is(err, resync.ErrInvalidSequence) {
+		t.Errorf("rewind after the applied sequence: got %v, want ErrInvalidSequence", err)
+	}
+	if _, err := resync.Rewind(ctx, js, r.id, first-1, finder); !errors.Is(err, resync.ErrNoSnapshot) {
+		t.Errorf("rewind before the snapshots: got %v, want ErrNoSnapshot", err)
+	}
+
+	sequence, err := resync.Rewind(ctx, js, r.id, last, finder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence != first {
+		t.Errorf("rewound to %d, want %d", sequence, first)
+	}
+	// the stream is replayed after the snapshot
+	deadline := time.Now().Add(5 * time.Second)
+	for r.count(t) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d rows, want the rows replayed after the snapshot", r.count(t))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	stream, err := js.Stream(ctx, r.stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the message after the snapshot is gone
+	if err := stream.Purge(ctx, jetstream.WithPurgeSequence(last+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resync.Rewind(ctx, js, r.id, last, finder); !errors.Is(err, sqlite.ErrSnapshotTooOld) {
+		t.Errorf("rewind to a snapshot before the stream: got %v, want ErrSnapshotTooOld", err)
+	}
+}
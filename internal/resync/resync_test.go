@@ -0,0 +1,53 @@
+package resync_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/litesql/ha/internal/resync"
+)
+
+type snapshot struct {
+	io.Reader
+	closed bool
+}
+
+func (s *snapshot) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestFindSnapshot(t *testing.T) {
+	ctx := context.Background()
+	older := &snapshot{Reader: strings.NewReader("older")}
+	newer := &snapshot{Reader: strings.NewReader("newer")}
+	found := func(seq uint64, s *snapshot) resync.SnapshotFinder {
+		return func(context.Context, string, uint64) (uint64, io.ReadCloser, error) {
+			return seq, s, nil
+		}
+	}
+	none := func(context.Context, string, uint64) (uint64, io.ReadCloser, error) {
+		return 0, nil, nil
+	}
+	failing := func(context.Context, string, uint64) (uint64, io.ReadCloser, error) {
+		return 0, nil, errors.New("object store unavailable")
+	}
+
+	seq, reader, err := resync.FindSnapshot(ctx, "find.db", 10, found(5, older), failing, none, found(8, newer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 8 || reader != newer {
+		t.Errorf("got the snapshot %d, want the most recent one 8", seq)
+	}
+	if !older.closed || newer.closed {
+		t.Errorf("closed older %v newer %v, want only the older snapshot closed", older.closed, newer.closed)
+	}
+
+	if _, _, err := resync.FindSnapshot(ctx, "find.db", 10, none, failing); !errors.Is(err, resync.ErrNoSnapshot) {
+		t.Errorf("got %v, want ErrNoSnapshot", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Package rowidentify chooses, per table, how the replicated changes target
+// the rows on the subscribers.
+package rowidentify
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/litesql/go-ha"
+)
+
+const rowidColumn = "rowid"
+
+// Parse reads a comma separated list of table=pk|rowid overrides.
+func Parse(s string) (map[string]ha.RowIdentify, error) {
+	tables := make(map[string]ha.RowIdentify)
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		table, mode, ok := strings.Cut(item, "=")
+		table = strings.ToLower(strings.TrimSpace(table))
+		if !ok || table == "" {
+			return nil, fmt.Errorf("invalid row identify override %q, use table=pk or table=rowid", item)
+		}
+		switch identify := ha.RowIdentify(strings.ToLower(strings.TrimSpace(mode))); identify {
+		case ha.PK, ha.Rowid:
+			tables[table] = identify
+		default:
+			return nil, fmt.Errorf("invalid row identify %q for table %s, use pk or rowid", mode, table)
+		}
+	}
+	return tables, nil
+}
+
+type publisher struct {
+	ha.Publisher
+	tables map[string]ha.RowIdentify
+}
+
+// Publisher wraps the publisher of a node replicating with the pk strategy.
+// The changes carry the declared primary key, so the subscribers target the
+// rows by key, which works for WITHOUT ROWID tables and after a VACUUM
+// renumbers the rowids. Tables without a primary key, or overridden to rowid,
+// fall back to the rowid: it is added to the replicated columns so the
+// subscribers insert the rows with the same rowid as the publisher.
+func Publisher(pub ha.Publisher, tables map[string]ha.RowIdentify) ha.Publisher {
+	return &publisher{
+		Publisher: pub,
+		tables:    tables,
+	}
+}
+
+func (p *publisher) Publish(cs *ha.ChangeSet) error {
+	var changes []ha.Change
+	for i, change := range cs.Changes {
+		identified, ok := p.identify(change)
+		if !ok {
+			continue
+		}
+		if changes == nil {
+			changes = slices.Clone(cs.Changes)
+		}
+		changes[i] = identified
+	}
+	if changes == nil {
+		return p.Publisher.Publish(cs)
+	}
+	identified := *cs
+	identified.Changes = changes
+	return p.Publisher.Publish(&identified)
+}
+
+// identify returns the change as published, reporting whether it was modified.
+func (p *publisher) identify(change ha.Change) (ha.Change, bool) {
+	switch change.Operation {
+	case "INSERT", "UPDATE", "DELETE":
+	default:
+		return change, false
+	}
+	override := len(change.PKColumns) > 0 && p.tables[strings.ToLower(change.Table)] == ha.Rowid
+	if override {
+		change.PKColumns = nil
+	}
+	if len(change.PKColumns) > 0 || slices.ContainsFunc(change.Columns, isRowidColumn) {
+		// a column named rowid hides the rowid, the subscriber targets the
+		// column like the publisher's statements do
+		return change, override
+	}
+	// the columns, from the table schema cache, are shared across changes
+	change.Columns = append(slices.Clip(change.Columns), rowidColumn)
+	if len(change.OldValues) > 0 {
+		change.OldValues = append(slices.Clip(change.OldValues), change.OldRowID)
+	}
+	if len(change.NewValues) > 0 {
+		change.NewValues = append(slices.Clip(change.NewValues), change.NewRowID)
+	}
+	return change, true
+}
+
+func isRowidColumn(column string) bool {
+	return strings.EqualFold(column, rowidColumn)
+}
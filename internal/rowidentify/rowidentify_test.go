@@ -0,0 +1,79 @@
+package rowidentify_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/rowidentify"
+)
+
+type recorder struct {
+	published []*ha.ChangeSet
+}
+
+func (r *recorder) Publish(cs *ha.ChangeSet) error {
+	r.published = append(r.published, cs)
+	return nil
+}
+
+func (r *recorder) Sequence() uint64 {
+	return uint64(len(r.published))
+}
+
+func TestParse(t *testing.T) {
+	tables, err := rowidentify.Parse(" Logs=rowid, users = pk ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 2 || tables["logs"] != ha.Rowid || tables["users"] != ha.PK {
+		t.Errorf("got %v", tables)
+	}
+	for _, s := range []string{"logs", "=rowid", "logs=full"} {
+		if _, err := rowidentify.Parse(s); err == nil {
+			t.Errorf("Parse(%q): expected error", s)
+		}
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	rec := &recorder{}
+	pub := rowidentify.Publisher(rec, map[string]ha.RowIdentify{"logs": ha.Rowid})
+
+	columns := []string{"id", "name"}
+	cs := &ha.ChangeSet{Changes: []ha.Change{
+		{Table: "users", Operation: "UPDATE", Columns: columns, PKColumns: []string{"id"}, OldValues: []any{1, "a"}, NewValues: []any{1, "b"}, OldRowID: 7, NewRowID: 7},
+		{Table: "notes", Operation: "DELETE", Columns: columns, OldValues: []any{2, "c"}, OldRowID: 8},
+		{Table: "logs", Operation: "INSERT", Columns: columns, PKColumns: []string{"id"}, NewValues: []any{3, "d"}, NewRowID: 9},
+		{Operation: "SQL", Command: "CREATE TABLE t(a)"},
+	}}
+	if err := pub.Publish(cs); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.published) != 1 {
+		t.Fatalf("got %d changesets", len(rec.published))
+	}
+	changes := rec.published[0].Changes
+
+	if !slices.Equal(changes[0].Columns, columns) || !slices.Equal(changes[0].PKColumns, []string{"id"}) {
+		t.Errorf("change with primary key modified: %+v", changes[0])
+	}
+	if !slices.Equal(changes[1].Columns, []string{"id", "name", "rowid"}) || !slices.Equal(changes[1].OldValues, []any{2, "c", int64(8)}) {
+		t.Errorf("rowid not added to the change without primary key: %+v", changes[1])
+	}
+	if changes[2].PKColumns != nil || !slices.Equal(changes[2].NewValues, []any{3, "d", int64(9)}) {
+		t.Errorf("rowid override not applied: %+v", changes[2])
+	}
+	if changes[3].Command != "CREATE TABLE t(a)" || changes[3].Columns != nil {
+		t.Errorf("statement modified: %+v", changes[3])
+	}
+
+	// the published changeset and the shared schema columns are not modified
+	if !slices.Equal(columns, []string{"id", "name"}) || len(cs.Changes[1].Columns) != 2 {
+		t.Errorf("source changeset modified: %+v", cs.Changes[1])
+	}
+	if cs.Changes[2].PKColumns == nil {
+		t.Error("source changeset override modified")
+	}
+}
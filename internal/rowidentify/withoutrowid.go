@@ -0,0 +1,227 @@
+package rowidentify
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/litesql/go-ha"
+)
+
+type withoutRowid struct {
+	next ha.ChangeSetInterceptor
+	// the changes of the changesets being applied, as received
+	received sync.Map
+}
+
+// WithoutRowid wraps the interceptor of the subscribers to apply the changes
+// of the WITHOUT ROWID tables by primary key, whatever the row
+// identification: they have no rowid to target, and the publisher may have
+// replaced their key by a rowid it does not have. The changes are rewritten
+// into statements on the local primary key after the wrapped interceptor
+// accepted them, and restored before its AfterApply, so it sees the changes
+// as replicated.
+func WithoutRowid(next ha.ChangeSetInterceptor) ha.ChangeSetInterceptor {
+	return &withoutRowid{next: next}
+}
+
+func (w *withoutRowid) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	if w.next != nil {
+		skip, err := w.next.BeforeApply(cs, conn)
+		if err != nil || skip {
+			return skip, err
+		}
+	}
+	changes, err := rewrite(conn, cs.Changes)
+	if err != nil || changes == nil {
+		return false, err
+	}
+	w.received.Store(cs, cs.Changes)
+	cs.Changes = changes
+	return false, nil
+}
+
+func (w *withoutRowid) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if received, ok := w.received.LoadAndDelete(cs); ok {
+		cs.Changes = received.([]ha.Change)
+	}
+	if w.next != nil {
+		return w.next.AfterApply(cs, conn, err)
+	}
+	return err
+}
+
+// table is the local schema of a WITHOUT ROWID table.
+type table struct {
+	columns []string
+	pk      []string
+}
+
+// rewrite returns the changes with the ones of the WITHOUT ROWID tables as
+// SQL statements, nil when there is none.
+func rewrite(conn *sql.Conn, changes []ha.Change) ([]ha.Change, error) {
+	ctx := ha.ContextLocalDB(context.Background(), true)
+	tables := make(map[string]*table)
+	var rewritten []ha.Change
+	for i, change := range changes {
+		switch change.Operation {
+		case "INSERT", "UPDATE", "DELETE":
+		default:
+			if rewritten != nil {
+				rewritten = append(rewritten, change)
+			}
+			continue
+		}
+		database := change.Database
+		if database == "" {
+			database = "main"
+		}
+		key := database + "." + strings.ToLower(change.Table)
+		t, ok := tables[key]
+		if !ok {
+			var err error
+			t, err = lookup(ctx, conn, database, change.Table)
+			if err != nil {
+				return nil, err
+			}
+			tables[key] = t
+		}
+		if t == nil {
+			if rewritten != nil {
+				rewritten = append(rewritten, change)
+			}
+			continue
+		}
+		if rewritten == nil {
+			rewritten = slices.Clone(changes[:i])
+		}
+		rewritten = append(rewritten, statements(database, t, change)...)
+	}
+	return rewritten, nil
+}
+
+// lookup returns the schema of the table when it is a WITHOUT ROWID table.
+func lookup(ctx context.Context, conn *sql.Conn, database, name string) (*table, error) {
+	var withoutRowid bool
+	err := conn.QueryRowContext(ctx, "SELECT wr FROM pragma_table_list WHERE schema = ? AND name = ? COLLATE NOCASE AND type = 'table'", database, name).Scan(&withoutRowid)
+	if err == sql.ErrNoRows || err == nil && !withoutRowid {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := new(table)
+	if t.columns, err = names(ctx, conn, "SELECT name FROM pragma_table_info(?, ?) ORDER BY cid", name, database); err != nil {
+		return nil, err
+	}
+	if t.pk, err = names(ctx, conn, "SELECT name FROM pragma_table_info(?, ?) WHERE pk > 0 ORDER BY pk", name, database); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func names(ctx context.Context, conn *sql.Conn, query string, args ...any) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		list = append(list, name)
+	}
+	return list, rows.Err()
+}
+
+// statements returns the change as statements on the primary key of the
+// table. An INSERT or UPDATE upserts the row, so an update of a row missing
+// on this node inserts it, like the other identifications do; an update of
+// the key deletes the row under the old key first.
+func statements(database string, t *table, change ha.Change) []ha.Change {
+	name := quote(database) + "." + quote(change.Table)
+	var (
+		columns   []string
+		oldValues = make(map[string]any)
+		newValues []any
+	)
+	for i, column := range change.Columns {
+		// the rowid added by the publisher to target the row, when the table
+		// has no column with this name
+		if isRowidColumn(column) && !slices.ContainsFunc(t.columns, isRowidColumn) {
+			continue
+		}
+		if i < len(change.OldValues) {
+			oldValues[strings.ToLower(column)] = change.OldValues[i]
+		}
+		if i < len(change.NewValues) {
+			columns = append(columns, column)
+			newValues = append(newValues, change.NewValues[i])
+		}
+	}
+	where := make([]string, len(t.pk))
+	oldKey := make([]any, len(t.pk))
+	for i, column := range t.pk {
+		where[i] = quote(column) + " = ?"
+		oldKey[i] = oldValues[strings.ToLower(column)]
+	}
+	sqlChange := func(command string, args []any) ha.Change {
+		return ha.Change{
+			Database:  change.Database,
+			Table:     change.Table,
+			Operation: "SQL",
+			Command:   command,
+			Args:      args,
+			TsNs:      change.TsNs,
+		}
+	}
+	var list []ha.Change
+	if change.Operation == "DELETE" || change.Operation == "UPDATE" && keyChanged(t.pk, change.Columns, change.OldValues, change.NewValues) {
+		list = append(list, sqlChange(fmt.Sprintf("DELETE FROM %s WHERE %s", name, strings.Join(where, " AND ")), oldKey))
+	}
+	if change.Operation == "DELETE" {
+		return list
+	}
+	quoted := make([]string, len(columns))
+	set := make([]string, 0, len(columns))
+	for i, column := range columns {
+		quoted[i] = quote(column)
+		if !slices.ContainsFunc(t.pk, func(pk string) bool { return strings.EqualFold(pk, column) }) {
+			set = append(set, fmt.Sprintf("%s = excluded.%s", quoted[i], quoted[i]))
+		}
+	}
+	pk := make([]string, len(t.pk))
+	for i, column := range t.pk {
+		pk[i] = quote(column)
+	}
+	command := fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s) ON CONFLICT(%s) DO ", name, strings.Join(quoted, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "), strings.Join(pk, ", "))
+	if len(set) == 0 {
+		command += "NOTHING"
+	} else {
+		command += "UPDATE SET " + strings.Join(set, ", ")
+	}
+	return append(list, sqlChange(command, newValues))
+}
+
+func keyChanged(pk, columns []string, oldValues, newValues []any) bool {
+	for i, column := range columns {
+		if i >= len(oldValues) || i >= len(newValues) {
+			break
+		}
+		if slices.ContainsFunc(pk, func(pk string) bool { return strings.EqualFold(pk, column) }) && fmt.Sprint(oldValues[i]) != fmt.Sprint(newValues[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,93 @@
+//go:build cgo
+
+package rowidentify_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/litesql/go-ha"
+	_ "github.com/litesql/go-sqlite3"
+
+	"github.com/litesql/ha/internal/rowidentify"
+)
+
+func TestWithoutRowid(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "ha.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE kv(bucket TEXT, key TEXT, value TEXT, PRIMARY KEY(key, bucket)) WITHOUT ROWID;
+		CREATE TABLE notes(id INTEGER PRIMARY KEY, body TEXT);
+		INSERT INTO kv VALUES('a', 'k1', 'v1'), ('a', 'k2', 'v2')`); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	columns := []string{"bucket", "key", "value"}
+	received := []ha.Change{
+		{Database: "main", Table: "kv", Operation: "INSERT", Columns: columns, PKColumns: []string{"key", "bucket"}, NewValues: []any{"a", "k3", "v3"}},
+		// the publisher overrode the key with a rowid the table does not have
+		{Database: "main", Table: "kv", Operation: "UPDATE", Columns: append(columns, "rowid"), OldValues: []any{"a", "k1", "v1", 0}, NewValues: []any{"a", "k1", "v1b", 0}},
+		{Database: "main", Table: "kv", Operation: "UPDATE", Columns: columns, PKColumns: []string{"key", "bucket"}, OldValues: []any{"a", "k2", "v2"}, NewValues: []any{"b", "k2", "v2"}},
+		{Database: "main", Table: "kv", Operation: "UPDATE", Columns: columns, PKColumns: []string{"key", "bucket"}, OldValues: []any{"z", "k9", "v9"}, NewValues: []any{"z", "k9", "v10"}},
+		{Database: "main", Table: "kv", Operation: "DELETE", Columns: columns, PKColumns: []string{"key", "bucket"}, OldValues: []any{"a", "k3", "v3"}},
+		{Database: "main", Table: "notes", Operation: "INSERT", Columns: []string{"id", "body"}, NewValues: []any{1, "n"}, NewRowID: 1},
+	}
+	cs := &ha.ChangeSet{Filename: "ha.db", Changes: received}
+	interceptor := rowidentify.WithoutRowid(nil)
+	if _, err := interceptor.BeforeApply(cs, conn); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range cs.Changes {
+		if change.Table == "notes" {
+			if change.Operation != "INSERT" {
+				t.Errorf("change of a rowid table rewritten: %+v", change)
+			}
+			continue
+		}
+		if change.Operation != "SQL" {
+			t.Fatalf("change of a WITHOUT ROWID table not rewritten: %+v", change)
+		}
+		if _, err := conn.ExecContext(context.Background(), change.Command, change.Args...); err != nil {
+			t.Fatalf("%s: %v", change.Command, err)
+		}
+	}
+	if err := interceptor.AfterApply(cs, conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(cs.Changes) != len(received) || cs.Changes[0].Operation != "INSERT" {
+		t.Errorf("the changes as received are not restored after the apply")
+	}
+
+	rows, err := conn.QueryContext(context.Background(), "SELECT bucket, key, value FROM kv ORDER BY key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got [][3]string
+	for rows.Next() {
+		var row [3]string
+		if err := rows.Scan(&row[0], &row[1], &row[2]); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	want := [][3]string{{"a", "k1", "v1b"}, {"b", "k2", "v2"}, {"z", "k9", "v10"}}
+	if len(got) != len(want) {
+		t.Fatalf("got rows %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got rows %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package s3backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/litesql/ha/internal/compress"
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/tracing"
+)
+
+// Backup pushes database snapshots to an S3-compatible bucket, keeping the
+// latest Retention snapshots of each database. Objects are stored as
+// <prefix><id>/<sequence>.db, the sequence zero padded so the keys sort in
+// replication order.
+type Backup struct {
+	client      *Client
+	prefix      string
+	retention   int
+	compression compress.Codec
+
+	mu       sync.Mutex
+	uploaded map[string]uint64
+}
+
+func New(cfg Config, retention int) (*Backup, error) {
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimPrefix(cfg.Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &Backup{
+		client:      client,
+		prefix:      prefix,
+		retention:   retention,
+		compression: cfg.Compression,
+		uploaded:    make(map[string]uint64),
+	}, nil
+}
+
+// Start uploads a snapshot of every database on each interval. Only the leader
+// uploads, and only when new changes were applied since the last upload.
+func (b *Backup) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, id := range sqlite.Databases() {
+				connector, err := sqlite.Connector(id)
+				if err != nil || !connector.LeaderProvider().IsLeader() {
+					continue
+				}
+				if _, err := b.Upload(ctx, id); err != nil {
+					slog.Error("failed to upload snapshot to S3", "id", id, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// Upload stores a snapshot of the database and removes the snapshots exceeding
+// the retention. It returns the snapshot sequence, 0 when the latest snapshot
+// is already up to date.
+func (b *Backup) Upload(ctx context.Context, id string) (sequence uint64, err error) {
+	ctx, span := tracing.Start(ctx, "snapshot s3 upload", attribute.String("ha.database", id))
+	defer func() {
+		span.SetAttributes(attribute.Int64("ha.snapshot_seq", int64(sequence)))
+		tracing.End(span, err)
+	}()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	connector, err := sqlite.Connector(id)
+	if err != nil {
+		return 0, err
+	}
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return 0, err
+	}
+	sequence = connector.LatestSeq()
+	if sequence <= b.uploaded[id] {
+		return 0, nil
+	}
+
+	f, err := os.CreateTemp("", "ha-s3-*.db")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := sqlite.Backup(ctx, db, f); err != nil {
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	metadata := map[string]string{"seq": strconv.FormatUint(sequence, 10)}
+	body, bodySize := io.ReadSeeker(f), size
+	if b.compression != compress.None {
+		// the upload needs the encoded size up front
+		encoded, err := os.CreateTemp("", "ha-s3-*.db."+string(b.compression))
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(encoded.Name())
+		defer encoded.Close()
+		if _, err := compress.Encode(b.compression, encoded, f); err != nil {
+			return 0, fmt.Errorf("compress: %w", err)
+		}
+		if bodySize, err = encoded.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		if _, err := encoded.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		body = encoded
+		metadata[compress.Header] = string(b.compression)
+	}
+	key := b.key(id, sequence)
+	if err := b.client.Put(ctx, key, body, bodySize, metadata); err != nil {
+		return 0, err
+	}
+	b.uploaded[id] = sequence
+	slog.Info("snapshot uploaded to S3", "id", id, "key", key, "sequence", sequence, "size", size)
+
+	if err := b.prune(ctx, id); err != nil {
+		slog.Warn("failed to remove old S3 snapshots", "id", id, "error", err)
+	}
+	return sequence, nil
+}
+
+// Check lists the prefix to verify the bucket exists and the credentials can
+// read it.
+func (b *Backup) Check(ctx context.Context) error {
+	_, err := b.client.List(ctx, b.prefix)
+	return err
+}
+
+// Latest returns the most recent snapshot of the database, or a nil reader
+// if there is none.
+func (b *Backup) Latest(ctx context.Context, id string) (uint64, io.ReadCloser, error) {
+	return b.Before(ctx, id, math.MaxUint64)
+}
+
+// Before returns the most recent snapshot of the database at or before the
+// sequence, or a nil reader if there is none.
+func (b *Backup) Before(ctx context.Context, id string, maxSequence uint64) (_ uint64, _ io.ReadCloser, err error) {
+	ctx, span := tracing.Start(ctx, "snapshot s3 download", attribute.String("ha.database", id))
+	defer func() { tracing.End(span, err) }()
+	objects, err := b.client.List(ctx, b.prefix+id+"/")
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := len(objects) - 1; i >= 0; i-- {
+		sequence, ok := sequenceFromKey(objects[i].Key)
+		if !ok || sequence > maxSequence {
+			continue
+		}
+		reader, metadata, err := b.client.Get(ctx, objects[i].Key)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader, err = compress.NewReader(compress.Codec(metadata[strings.ToLower(compress.Header)]), reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		slog.Info("found S3 snapshot", "id", id, "key", objects[i].Key, "sequence", sequence)
+		return sequence, reader, nil
+	}
+	return 0, nil, nil
+}
+
+func (b *Backup) prune(ctx context.Context, id string) error {
+	if b.retention <= 0 {
+		return nil
+	}
+	objects, err := b.client.List(ctx, b.prefix+id+"/")
+	if err != nil {
+		return err
+	}
+	var snapshots []string
+	for _, obj := range objects {
+		if _, ok := sequenceFromKey(obj.Key); ok {
+			snapshots = append(snapshots, obj.Key)
+		}
+	}
+	for len(snapshots) > b.retention {
+		if err := b.client.Delete(ctx, snapshots[0]); err != nil {
+			return err
+		}
+		slog.Debug("removed S3 snapshot", "key", snapshots[0])
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+func (b *Backup) key(id string, sequence uint64) string {
+	return fmt.Sprintf("%s%s/%020d.db", b.prefix, id, sequence)
+}
+
+func sequenceFromKey(key string) (uint64, bool) {
+	name, ok := strings.CutSuffix(path.Base(key), ".db")
+	if !ok {
+		return 0, false
+	}
+	sequence, err := strconv.ParseUint(name, 10, 64)
+	return sequence, err == nil
+}
@@ -0,0 +1,191 @@
+package s3backup_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/litesql/ha/internal/s3backup"
+)
+
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	meta    map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AK/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") ||
+		!strings.Contains(auth, "SignedHeaders=host;") || r.Header.Get("X-Amz-Date") == "" {
+		http.Error(w, "bad auth "+auth, http.StatusForbidden)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "backups" {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+		f.meta[key] = r.Header.Get("X-Amz-Meta-Seq")
+	case r.Method == http.MethodGet && key == "":
+		type content struct {
+			Key  string
+			Size int64
+		}
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		prefix := r.URL.Query().Get("prefix")
+		for k, v := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				result.Contents = append(result.Contents, content{Key: k, Size: int64(len(v))})
+			}
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Amz-Meta-Seq", f.meta[key])
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(&fakeS3{objects: make(map[string][]byte), meta: make(map[string]string)})
+	defer srv.Close()
+
+	client, err := s3backup.NewClient(s3backup.Config{
+		Endpoint:  srv.URL,
+		Bucket:    "backups",
+		AccessKey: "AK",
+		SecretKey: "SK",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 3; i > 0; i-- {
+		body := fmt.Sprintf("snapshot %d", i)
+		err := client.Put(ctx, fmt.Sprintf("db/%d.db", i), strings.NewReader(body), int64(len(body)), map[string]string{"seq": fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Put(ctx, "other/1.db", strings.NewReader("x"), 1, nil)
+
+	objects, err := client.List(ctx, "db/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	if want := []string{"db/1.db", "db/2.db", "db/3.db"}; !slices.Equal(keys, want) {
+		t.Fatalf("List() = %v, want %v", keys, want)
+	}
+
+	reader, metadata, err := client.Get(ctx, "db/2.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(data) != "snapshot 2" || metadata["seq"] != "2" {
+		t.Fatalf("Get() = %q, %v", data, metadata)
+	}
+
+	if err := client.Delete(ctx, "db/1.db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.Get(ctx, "db/1.db"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Get() of deleted object error = %v", err)
+	}
+}
+
+// signedS3 checks the AWS Signature V4 of the requests over the path as sent,
+// like S3 does.
+type signedS3 struct {
+	secretKey string
+}
+
+func (f *signedS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	_, signedHeaders, _ := strings.Cut(auth, "SignedHeaders=")
+	signedHeaders, sig, _ := strings.Cut(signedHeaders, ", Signature=")
+	_, credential, _ := strings.Cut(auth, "Credential=")
+	credential, _, _ = strings.Cut(credential, ",")
+	// access key, date, region, service and aws4_request
+	scope := strings.Split(credential, "/")
+
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	var headers strings.Builder
+	for name := range strings.SplitSeq(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	canonicalRequest := strings.Join([]string{r.Method, path, r.URL.RawQuery, headers.String(), signedHeaders, r.Header.Get("X-Amz-Content-Sha256")}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", r.Header.Get("X-Amz-Date"), strings.Join(scope[1:], "/"), hex.EncodeToString(hash[:])}, "\n")
+	key := []byte("AWS4" + f.secretKey)
+	for _, part := range append(scope[1:], stringToSign) {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(part))
+		key = h.Sum(nil)
+	}
+	if hex.EncodeToString(key) != sig {
+		http.Error(w, "SignatureDoesNotMatch "+path, http.StatusForbidden)
+		return
+	}
+	w.Write([]byte(path))
+}
+
+func TestClientSignsEscapedKeys(t *testing.T) {
+	srv := httptest.NewServer(&signedS3{secretKey: "SK"})
+	defer srv.Close()
+
+	client, err := s3backup.NewClient(s3backup.Config{
+		Endpoint:  srv.URL,
+		Bucket:    "backups",
+		AccessKey: "AK",
+		SecretKey: "SK",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, _, err := client.Get(context.Background(), "db/a+b=c:d@e,f g.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	path, _ := io.ReadAll(reader)
+	if want := "/backups/db/a%2Bb%3Dc%3Ad%40e%2Cf%20g.db"; string(path) != want {
+		t.Errorf("sent path %s, want %s", path, want)
+	}
+}
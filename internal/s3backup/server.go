@@ -0,0 +1,573 @@
+package s3backup
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/snapshots"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+const (
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	// maxClockSkew is the tolerance of the request date, as enforced by AWS.
+	maxClockSkew = 15 * time.Minute
+	// objectTTL is how long a spooled snapshot serves the ranged requests of a
+	// download before it is read again from the Object Store.
+	objectTTL = time.Minute
+)
+
+type ServerConfig struct {
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// Server exposes the database snapshots through a read-only S3-compatible API,
+// so S3 tooling can download them without NATS credentials. The bucket holds
+// the keys
+//
+//	<id>/latest.db                   latest snapshot of the database
+//	<id>/history/<sequence>.db       retained snapshots (--snapshot-history)
+//
+// Requests are authenticated with AWS Signature V4, in the Authorization
+// header or as a presigned URL.
+type Server struct {
+	cfg     ServerConfig
+	history *snapshots.History
+	now     func() time.Time
+
+	mu      sync.Mutex
+	objects map[string]*object
+}
+
+type object struct {
+	ready   chan struct{}
+	err     error
+	path    string
+	size    int64
+	etag    string
+	modTime time.Time
+	expires time.Time
+}
+
+func NewServer(cfg ServerConfig, history *snapshots.History) (*Server, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("credentials are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &Server{
+		cfg:     cfg,
+		history: history,
+		now:     time.Now,
+		objects: make(map[string]*object),
+	}, nil
+}
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+	status   int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func errNoSuchKey(key string) *s3Error {
+	return &s3Error{Code: "NoSuchKey", Message: "The specified key does not exist.", Resource: key, status: http.StatusNotFound}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.authenticate(r); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		s.writeError(w, r, &s3Error{Code: "MethodNotAllowed", Message: "The snapshots are read-only.", status: http.StatusMethodNotAllowed})
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "" {
+		s.listBuckets(w)
+		return
+	}
+	bucket, key, _ := strings.Cut(path, "/")
+	if bucket != s.cfg.Bucket {
+		s.writeError(w, r, &s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist.", Resource: bucket, status: http.StatusNotFound})
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case key == "" && query.Has("location"):
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+			Region  string   `xml:",chardata"`
+		}{Xmlns: s3Namespace, Region: s.cfg.Region})
+	case key == "" && r.Method == http.MethodHead:
+		w.Header().Set("X-Amz-Bucket-Region", s.cfg.Region)
+	case key == "":
+		s.listObjects(w, r)
+	default:
+		s.getObject(w, r, key)
+	}
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter) {
+	type bucket struct {
+		Name         string    `xml:"Name"`
+		CreationDate time.Time `xml:"CreationDate"`
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID string `xml:"ID"`
+		} `xml:"Owner"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Buckets: []bucket{{Name: s.cfg.Bucket, CreationDate: time.Unix(0, 0).UTC()}}})
+}
+
+type listEntry struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag,omitempty"`
+	Size         int64     `xml:"Size"`
+	StorageClass string    `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listObjects implements ListObjects and ListObjectsV2 with prefix,
+// delimiter and pagination.
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	after := query.Get("marker")
+	if v2 {
+		after = max(query.Get("start-after"), query.Get("continuation-token"))
+	}
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s.writeError(w, r, &s3Error{Code: "InvalidArgument", Message: "invalid max-keys", status: http.StatusBadRequest})
+			return
+		}
+		maxKeys = min(n, 1000)
+	}
+
+	entries, err := s.entries(r.Context(), prefix)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	var (
+		contents  []listEntry
+		prefixes  []commonPrefix
+		truncated bool
+		last      string
+	)
+	for _, entry := range entries {
+		name := entry.Key
+		if delimiter != "" {
+			if i := strings.Index(entry.Key[len(prefix):], delimiter); i >= 0 {
+				name = entry.Key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if name <= after || name == last {
+			continue
+		}
+		if len(contents)+len(prefixes) >= maxKeys {
+			truncated = true
+			break
+		}
+		last = name
+		if name != entry.Key {
+			prefixes = append(prefixes, commonPrefix{Prefix: name})
+			continue
+		}
+		contents = append(contents, entry)
+	}
+
+	result := struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Xmlns                 string         `xml:"xmlns,attr"`
+		Name                  string         `xml:"Name"`
+		Prefix                string         `xml:"Prefix"`
+		Delimiter             string         `xml:"Delimiter,omitempty"`
+		Marker                *string        `xml:"Marker"`
+		NextMarker            string         `xml:"NextMarker,omitempty"`
+		StartAfter            string         `xml:"StartAfter,omitempty"`
+		ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		KeyCount              *int           `xml:"KeyCount"`
+		MaxKeys               int            `xml:"MaxKeys"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		Contents              []listEntry    `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}{
+		Xmlns:          s3Namespace,
+		Name:           s.cfg.Bucket,
+		Prefix:         prefix,
+		Delimiter:      delimiter,
+		MaxKeys:        maxKeys,
+		IsTruncated:    truncated,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	}
+	if v2 {
+		count := len(contents) + len(prefixes)
+		result.KeyCount = &count
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		if truncated {
+			result.NextContinuationToken = last
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		if truncated {
+			result.NextMarker = last
+		}
+	}
+	writeXML(w, result)
+}
+
+// entries returns the objects with the key prefix sorted by key.
+func (s *Server) entries(ctx context.Context, prefix string) ([]listEntry, error) {
+	ids := sqlite.Databases()
+	slices.Sort(ids)
+	var entries []listEntry
+	for _, id := range ids {
+		// skip the databases out of the prefix without reading their snapshots
+		if dir := id + "/"; !strings.HasPrefix(dir, prefix) && !strings.HasPrefix(prefix, dir) {
+			continue
+		}
+		if key := latestKey(id); strings.HasPrefix(key, prefix) {
+			obj, err := s.object(ctx, key)
+			var s3Err *s3Error
+			switch {
+			case errors.As(err, &s3Err) && s3Err.Code == "NoSuchKey":
+			case err != nil:
+				return nil, err
+			default:
+				entries = append(entries, listEntry{Key: key, LastModified: obj.modTime, ETag: obj.etag, Size: obj.size, StorageClass: "STANDARD"})
+			}
+		}
+		if s.history == nil || !strings.HasPrefix(id+"/history/", prefix) && !strings.HasPrefix(prefix, id+"/history/") {
+			continue
+		}
+		list, err := s.history.List(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, snapshot := range list {
+			key := historyKey(id, snapshot.Sequence)
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			entries = append(entries, listEntry{Key: key, LastModified: snapshot.Time.UTC(), Size: int64(snapshot.Size), StorageClass: "STANDARD"})
+		}
+	}
+	slices.SortFunc(entries, func(a, b listEntry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries, nil
+}
+
+// getObject implements GetObject and HeadObject, with range requests.
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj, err := s.object(r.Context(), key)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	f, err := os.Open(obj.path)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("ETag", obj.etag)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, "", obj.modTime, f)
+}
+
+// object spools the snapshot of the key to a temporary file, shared by the
+// concurrent and following requests until it expires.
+func (s *Server) object(ctx context.Context, key string) (*object, error) {
+	id, sequence, latest, ok := parseKey(key)
+	if !ok || (!latest && s.history == nil) {
+		return nil, errNoSuchKey(key)
+	}
+	if _, err := sqlite.DB(id); err != nil {
+		return nil, errNoSuchKey(key)
+	}
+
+	s.mu.Lock()
+	s.evict()
+	obj, ok := s.objects[key]
+	if ok {
+		s.mu.Unlock()
+		select {
+		case <-obj.ready:
+			return obj, obj.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	obj = &object{ready: make(chan struct{})}
+	s.objects[key] = obj
+	s.mu.Unlock()
+
+	// a client disconnecting must not fail the requests waiting for the file
+	obj.err = obj.spool(context.WithoutCancel(ctx), func(ctx context.Context) (io.ReadCloser, error) {
+		if latest {
+			connector, err := sqlite.Connector(id)
+			if err != nil {
+				return nil, err
+			}
+			_, reader, err := connector.LatestSnapshot(ctx)
+			if errors.Is(err, jetstream.ErrObjectNotFound) {
+				return nil, errNoSuchKey(key)
+			}
+			return reader, err
+		}
+		reader, err := s.history.Get(ctx, id, sequence)
+		if errors.Is(err, snapshots.ErrNotFound) {
+			return nil, errNoSuchKey(key)
+		}
+		return reader, err
+	})
+	obj.expires = s.now().Add(objectTTL)
+	close(obj.ready)
+	if obj.err != nil {
+		s.mu.Lock()
+		if s.objects[key] == obj {
+			delete(s.objects, key)
+		}
+		s.mu.Unlock()
+	}
+	return obj, obj.err
+}
+
+func (obj *object) spool(ctx context.Context, open func(context.Context) (io.ReadCloser, error)) error {
+	reader, err := open(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	f, err := os.CreateTemp("", "ha-s3-*.db")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := md5.New()
+	obj.size, err = io.Copy(io.MultiWriter(f, h), reader)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	obj.path = f.Name()
+	// the single part ETag of S3 is the MD5 of the content, clients check it
+	obj.etag = `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+	obj.modTime = time.Now().UTC().Truncate(time.Second)
+	return nil
+}
+
+// evict removes the expired spooled files. A file still being sent stays
+// readable until it is closed.
+func (s *Server) evict() {
+	now := s.now()
+	for key, obj := range s.objects {
+		select {
+		case <-obj.ready:
+		default:
+			continue
+		}
+		if now.After(obj.expires) {
+			os.Remove(obj.path)
+			delete(s.objects, key)
+		}
+	}
+}
+
+// Close removes the spooled files.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, obj := range s.objects {
+		select {
+		case <-obj.ready:
+			os.Remove(obj.path)
+			delete(s.objects, key)
+		default:
+		}
+	}
+	return nil
+}
+
+func latestKey(id string) string {
+	return id + "/latest.db"
+}
+
+func historyKey(id string, sequence uint64) string {
+	return fmt.Sprintf("%s/history/%020d.db", id, sequence)
+}
+
+func parseKey(key string) (id string, sequence uint64, latest bool, ok bool) {
+	if id, ok := strings.CutSuffix(key, "/latest.db"); ok && id != "" {
+		return id, 0, true, true
+	}
+	i := strings.LastIndex(key, "/history/")
+	if i <= 0 || !strings.HasSuffix(key, ".db") {
+		return "", 0, false, false
+	}
+	sequence, err := strconv.ParseUint(strings.TrimSuffix(key[i+len("/history/"):], ".db"), 10, 64)
+	if err != nil {
+		return "", 0, false, false
+	}
+	return key[:i], sequence, false, true
+}
+
+// authenticate verifies the AWS Signature V4 of the request, sent in the
+// Authorization header or in the query string of a presigned URL.
+func (s *Server) authenticate(r *http.Request) error {
+	denied := func(msg string) error {
+		return &s3Error{Code: "AccessDenied", Message: msg, status: http.StatusForbidden}
+	}
+	query := r.URL.Query()
+	var (
+		credential, signedHeaders, sig, amzDate, payloadHash string
+		expires                                              time.Duration
+	)
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+			return denied("unsupported signature algorithm")
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		sig = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds <= 0 || seconds > 7*24*3600 {
+			return denied("invalid X-Amz-Expires")
+		}
+		expires = time.Duration(seconds) * time.Second
+		payloadHash = cmp.Or(query.Get("X-Amz-Content-Sha256"), unsignedPayload)
+		query.Del("X-Amz-Signature")
+	} else {
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+		if !ok {
+			return denied("missing AWS Signature V4 authorization")
+		}
+		for field := range strings.SplitSeq(auth, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				sig = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = cmp.Or(r.Header.Get("X-Amz-Content-Sha256"), emptyPayloadHash)
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return denied("malformed credential")
+	}
+	if !hmac.Equal([]byte(parts[0]), []byte(s.cfg.AccessKey)) {
+		return &s3Error{Code: "InvalidAccessKeyId", Message: "The access key does not exist.", status: http.StatusForbidden}
+	}
+	date, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil || parts[1] != amzDate[:8] {
+		return denied("invalid X-Amz-Date")
+	}
+	now := s.now()
+	if expires > 0 {
+		if now.Before(date.Add(-maxClockSkew)) || now.After(date.Add(expires)) {
+			return denied("Request has expired")
+		}
+	} else if now.Sub(date).Abs() > maxClockSkew {
+		return &s3Error{Code: "RequestTimeTooSkewed", Message: "The difference between the request time and the server's time is too large.", status: http.StatusForbidden}
+	}
+
+	var canonicalHeaders strings.Builder
+	for name := range strings.SplitSeq(signedHeaders, ";") {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	_, want := signature(s.cfg.SecretKey, parts[2], amzDate, canonicalRequest)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return &s3Error{Code: "SignatureDoesNotMatch", Message: "The request signature we calculated does not match the signature you provided.", status: http.StatusForbidden}
+	}
+	return nil
+}
+
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	if !errors.As(err, &s3Err) {
+		slog.ErrorContext(r.Context(), "s3 snapshot request", "error", err, "path", r.URL.Path)
+		s3Err = &s3Error{Code: "InternalError", Message: err.Error(), status: http.StatusInternalServerError}
+	}
+	if s3Err.Resource == "" {
+		s3Err.Resource = r.URL.Path
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(s3Err.status)
+	if r.Method != http.MethodHead {
+		xml.NewEncoder(w).Encode(s3Err)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,100 @@
+package s3backup_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/litesql/ha/internal/s3backup"
+)
+
+func TestServer(t *testing.T) {
+	srv, err := s3backup.NewServer(s3backup.ServerConfig{
+		Bucket:    "snapshots",
+		AccessKey: "AK",
+		SecretKey: "SK",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	client := func(bucket, secret string) *s3backup.Client {
+		c, err := s3backup.NewClient(s3backup.Config{
+			Endpoint:  ts.URL,
+			Bucket:    bucket,
+			AccessKey: "AK",
+			SecretKey: secret,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	ctx := context.Background()
+
+	objects, err := client("snapshots", "SK").List(ctx, "")
+	if err != nil {
+		t.Fatalf("List with valid signature: %v", err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("List = %v, want no objects", objects)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		want string
+	}{
+		{
+			name: "wrong secret",
+			call: func() error {
+				_, err := client("snapshots", "other").List(ctx, "")
+				return err
+			},
+			want: "SignatureDoesNotMatch",
+		},
+		{
+			name: "unknown bucket",
+			call: func() error {
+				_, err := client("other", "SK").List(ctx, "")
+				return err
+			},
+			want: "NoSuchBucket",
+		},
+		{
+			name: "unknown key",
+			call: func() error {
+				_, _, err := client("snapshots", "SK").Get(ctx, "ha.db/latest.db")
+				return err
+			},
+			want: "NoSuchKey",
+		},
+		{
+			name: "history disabled",
+			call: func() error {
+				_, _, err := client("snapshots", "SK").Get(ctx, "ha.db/history/00000000000000000001.db")
+				return err
+			},
+			want: "NoSuchKey",
+		},
+		{
+			name: "write",
+			call: func() error {
+				return client("snapshots", "SK").Put(ctx, "ha.db/latest.db", strings.NewReader("x"), 1, nil)
+			},
+			want: "MethodNotAllowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
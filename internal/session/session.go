@@ -0,0 +1,85 @@
+// Package session carries the identity of the client issuing the statements:
+// in the context, to the query interceptor, and in the replicated changesets,
+// to the changeset interceptor of every node.
+package session
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/litesql/go-ha"
+)
+
+// Identity is the client of a session: the PostgreSQL or MySQL user, or the
+// user of the HTTP basic authorization.
+type Identity struct {
+	User     string `json:"user"`
+	Protocol string `json:"protocol"`
+}
+
+// QueryInterceptor is called with the statements of the clients before they
+// are executed. It returns the statement to execute, rewritten to filter the
+// rows the user may read, or an error to reject it.
+type QueryInterceptor func(ctx context.Context, database, query string) (string, error)
+
+// QueryObserver is called with the statements of the clients once executed,
+// err is the failure of the execution.
+type QueryObserver func(ctx context.Context, database, query string, err error)
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
+
+// User returns the user of the session, empty when unknown.
+func User(ctx context.Context) string {
+	id, _ := FromContext(ctx)
+	return id.User
+}
+
+// The identity is published as a change of the go-ha control table, which
+// every release skips when applying the changeset.
+const (
+	controlTableName = "ha_stats"
+	operation        = "SESSION"
+)
+
+// Attach adds the identity to the changeset, before its changes.
+func Attach(cs *ha.ChangeSet, id Identity) {
+	change := ha.Change{
+		Table:     controlTableName,
+		Operation: operation,
+		Columns:   []string{"user", "protocol"},
+		NewValues: []any{id.User, id.Protocol},
+	}
+	cs.Changes = append([]ha.Change{change}, cs.Changes...)
+}
+
+// FromChangeSet returns the identity of the client that committed the
+// changes. A changeset batching several transactions has the identity of the
+// first one.
+func FromChangeSet(cs *ha.ChangeSet) (Identity, bool) {
+	for _, change := range cs.Changes {
+		if change.Table != controlTableName || change.Operation != operation || len(change.NewValues) != 2 {
+			continue
+		}
+		return Identity{
+			User:     fmt.Sprint(change.NewValues[0]),
+			Protocol: fmt.Sprint(change.NewValues[1]),
+		}, true
+	}
+	return Identity{}, false
+}
+
+// ChangeSetUser returns the user that committed the changes, empty when
+// unknown.
+func ChangeSetUser(cs *ha.ChangeSet) string {
+	id, _ := FromChangeSet(cs)
+	return id.User
+}
@@ -0,0 +1,53 @@
+package session_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/session"
+)
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := session.FromContext(ctx); ok || session.User(ctx) != "" {
+		t.Error("identity found in a context without session")
+	}
+	ctx = session.NewContext(ctx, session.Identity{User: "alice", Protocol: "postgresql"})
+	id, ok := session.FromContext(ctx)
+	if !ok || id.User != "alice" || id.Protocol != "postgresql" || session.User(ctx) != "alice" {
+		t.Errorf("got %+v, %v, want the identity of alice", id, ok)
+	}
+}
+
+// TestChangeSet sends the identity to another node, the changeset is
+// replicated as JSON.
+func TestChangeSet(t *testing.T) {
+	cs := ha.ChangeSet{
+		Node:     "node1",
+		Filename: "ha.db",
+		Changes:  []ha.Change{{Table: "items", Operation: "INSERT", Columns: []string{"id"}, NewValues: []any{1}}},
+	}
+	if _, ok := session.FromChangeSet(&cs); ok || session.ChangeSetUser(&cs) != "" {
+		t.Error("identity found in a changeset without session")
+	}
+	session.Attach(&cs, session.Identity{User: "alice", Protocol: "mysql"})
+	if len(cs.Changes) != 2 || cs.Changes[1].Table != "items" {
+		t.Fatalf("got the changes %+v, want the identity before the insert", cs.Changes)
+	}
+
+	data, err := json.Marshal(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received ha.ChangeSet
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	id, ok := session.FromChangeSet(&received)
+	if !ok || id.User != "alice" || id.Protocol != "mysql" || session.ChangeSetUser(&received) != "alice" {
+		t.Errorf("got %+v, %v, want the identity of alice", id, ok)
+	}
+}
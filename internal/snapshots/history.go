@@ -0,0 +1,398 @@
+// Package snapshots keeps a history of database snapshots in the NATS
+// JetStream Object Store, next to the single latest snapshot maintained by
+// go-ha.
+package snapshots
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/litesql/ha/internal/compress"
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/tracing"
+)
+
+var ErrNotFound = errors.New("snapshot not found")
+
+type Config struct {
+	Replicas int
+	// Retention is the number of snapshots kept per database, 0 keeps all.
+	Retention int
+	// MaxAge removes the snapshots older than it, except the most recent one.
+	MaxAge time.Duration
+	// Stream resolves the replication stream of the database, the snapshots
+	// are stored in the <stream>_SNAPSHOTS bucket.
+	Stream func(id string) string
+	// Compression encodes the new snapshots, the codec is stored in the
+	// object headers so any snapshot is read back.
+	Compression compress.Codec
+	// ChunkSize stores the snapshots in parts of this size, uploaded and
+	// retried one by one. 0 stores each snapshot in a single object.
+	ChunkSize int64
+	// ChunkRetries is the number of retries of a failed part.
+	ChunkRetries int
+}
+
+type Snapshot struct {
+	Sequence uint64    `json:"sequence"`
+	Name     string    `json:"name"`
+	Size     uint64    `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// History stores versioned snapshots named history/<id>/<sequence>, the
+// sequence zero padded so the names sort in replication order.
+type History struct {
+	js  jetstream.JetStream
+	cfg Config
+
+	mu      sync.Mutex
+	buckets map[string]jetstream.ObjectStore
+	kept    map[string]uint64
+}
+
+func New(nc *nats.Conn, cfg Config) (*History, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	return &History{
+		js:      js,
+		cfg:     cfg,
+		buckets: make(map[string]jetstream.ObjectStore),
+		kept:    make(map[string]uint64),
+	}, nil
+}
+
+// Start keeps a snapshot of every database on each interval. Only the leader
+// takes snapshots, and only when new changes were applied since the last one.
+func (h *History) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, id := range sqlite.Databases() {
+				connector, err := sqlite.Connector(id)
+				if err != nil || !connector.LeaderProvider().IsLeader() {
+					continue
+				}
+				if _, err := h.Keep(ctx, id); err != nil {
+					slog.Error("failed to keep snapshot", "id", id, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// Keep stores a versioned snapshot of the database and removes the snapshots
+// exceeding the retention. It returns the snapshot sequence, 0 when the most
+// recent snapshot is already up to date.
+func (h *History) Keep(ctx context.Context, id string) (sequence uint64, err error) {
+	ctx, span := tracing.Start(ctx, "snapshot history keep", attribute.String("ha.database", id))
+	defer func() {
+		span.SetAttributes(attribute.Int64("ha.snapshot_seq", int64(sequence)))
+		tracing.End(span, err)
+	}()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	connector, err := sqlite.Connector(id)
+	if err != nil {
+		return 0, err
+	}
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return 0, err
+	}
+	store, err := h.bucket(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	sequence = connector.LatestSeq()
+	if sequence <= h.kept[id] {
+		return 0, nil
+	}
+	name := objectName(id, sequence)
+	if _, err := store.GetInfo(ctx, name); err == nil {
+		h.kept[id] = sequence
+		return 0, nil
+	} else if !errors.Is(err, jetstream.ErrObjectNotFound) {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp("", "ha-snapshot-*.db")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := sqlite.Backup(ctx, db, f); err != nil {
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	headers := make(nats.Header)
+	headers.Set("seq", strconv.FormatUint(sequence, 10))
+	headers.Set("size", strconv.FormatInt(size, 10))
+	if h.cfg.Compression != compress.None {
+		headers.Set(compress.Header, string(h.cfg.Compression))
+	}
+	var stored uint64
+	if h.cfg.ChunkSize > 0 {
+		stored, err = h.putInParts(ctx, store, id, sequence, name, headers, f, size)
+	} else {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := compress.Encode(h.cfg.Compression, pw, f)
+			pw.CloseWithError(err)
+		}()
+		var info *jetstream.ObjectInfo
+		info, err = store.Put(ctx, jetstream.ObjectMeta{
+			Name:    name,
+			Headers: headers,
+		}, pr)
+		pr.Close()
+		if info != nil {
+			stored = info.Size
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	h.kept[id] = sequence
+	slog.Info("snapshot kept", "id", id, "name", name, "sequence", sequence, "size", size, "stored", stored)
+
+	if err := h.prune(ctx, store, id); err != nil {
+		slog.Warn("failed to remove old snapshots", "id", id, "error", err)
+	}
+	return sequence, nil
+}
+
+// putInParts encodes the backup to a file, so its byte ranges are uploaded
+// as parts, then stores the snapshot object listing them.
+func (h *History) putInParts(ctx context.Context, store jetstream.ObjectStore, id string, sequence uint64, name string, headers nats.Header, f *os.File, size int64) (uint64, error) {
+	encoded := f
+	if h.cfg.Compression != compress.None {
+		var err error
+		encoded, err = os.CreateTemp("", "ha-snapshot-*.enc")
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(encoded.Name())
+		defer encoded.Close()
+		if _, err := compress.Encode(h.cfg.Compression, encoded, f); err != nil {
+			return 0, fmt.Errorf("encode: %w", err)
+		}
+		size, err = encoded.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+	}
+	parts, err := h.putParts(ctx, store, id, sequence, encoded, size)
+	if err != nil {
+		return 0, err
+	}
+	headers.Set(partsHeader, strconv.Itoa(parts))
+	if _, err := store.Put(ctx, jetstream.ObjectMeta{
+		Name:    name,
+		Headers: headers,
+	}, strings.NewReader("")); err != nil {
+		return 0, err
+	}
+	if err := removeIncomplete(ctx, store, id, sequence); err != nil {
+		slog.Warn("failed to remove incomplete snapshot uploads", "id", id, "error", err)
+	}
+	return uint64(size), nil
+}
+
+// SetRetention replaces the configured retention and max age, the next
+// snapshot prunes the history with them.
+func (h *History) SetRetention(retention int, maxAge time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cfg.Retention = retention
+	h.cfg.MaxAge = maxAge
+}
+
+// List returns the retained snapshots of the database, most recent first.
+func (h *History) List(ctx context.Context, id string) ([]Snapshot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	store, err := h.bucket(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return list(ctx, store, id)
+}
+
+// Before returns the most recent retained snapshot of the database at or
+// before the sequence, or a nil reader if there is none.
+func (h *History) Before(ctx context.Context, id string, sequence uint64) (uint64, io.ReadCloser, error) {
+	list, err := h.List(ctx, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, snapshot := range list {
+		if snapshot.Sequence <= sequence {
+			reader, err := h.Get(ctx, id, snapshot.Sequence)
+			return snapshot.Sequence, reader, err
+		}
+	}
+	return 0, nil, nil
+}
+
+// Get returns the retained snapshot of the database with the sequence.
+func (h *History) Get(ctx context.Context, id string, sequence uint64) (io.ReadCloser, error) {
+	h.mu.Lock()
+	store, err := h.bucket(ctx, id)
+	h.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := store.Get(ctx, objectName(id, sequence))
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil, fmt.Errorf("%w: database %q sequence %d", ErrNotFound, id, sequence)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := reader.Info()
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if parts := partsOf(info.Headers); parts > 0 {
+		reader.Close()
+		return compress.NewReader(compress.Codec(info.Headers.Get(compress.Header)), &partsReader{
+			ctx:      ctx,
+			store:    store,
+			id:       id,
+			sequence: sequence,
+			parts:    parts,
+		})
+	}
+	return compress.NewReader(compress.Codec(info.Headers.Get(compress.Header)), reader)
+}
+
+func (h *History) prune(ctx context.Context, store jetstream.ObjectStore, id string) error {
+	if h.cfg.Retention <= 0 && h.cfg.MaxAge <= 0 {
+		return nil
+	}
+	snapshots, err := list(ctx, store, id)
+	if err != nil {
+		return err
+	}
+	for i, snapshot := range snapshots {
+		if i == 0 {
+			continue
+		}
+		expired := h.cfg.MaxAge > 0 && time.Since(snapshot.Time) > h.cfg.MaxAge
+		if !expired && (h.cfg.Retention <= 0 || i < h.cfg.Retention) {
+			continue
+		}
+		if err := deleteSnapshot(ctx, store, id, snapshot.Name); err != nil {
+			return err
+		}
+		slog.Debug("removed snapshot", "id", id, "name", snapshot.Name)
+	}
+	return nil
+}
+
+func (h *History) bucket(ctx context.Context, id string) (jetstream.ObjectStore, error) {
+	bucket := h.cfg.Stream(id) + "_SNAPSHOTS"
+	if store, ok := h.buckets[bucket]; ok {
+		return store, nil
+	}
+	store, err := h.js.CreateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      bucket,
+		Storage:     jetstream.FileStorage,
+		Compression: true,
+		Replicas:    h.cfg.Replicas,
+	})
+	if err != nil {
+		if !errors.Is(err, jetstream.ErrBucketExists) {
+			return nil, err
+		}
+		store, err = h.js.ObjectStore(ctx, bucket)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.buckets[bucket] = store
+	return store, nil
+}
+
+func list(ctx context.Context, store jetstream.ObjectStore, id string) ([]Snapshot, error) {
+	objects, err := store.List(ctx)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	prefix := objectPrefix(id)
+	var snapshots []Snapshot
+	for _, obj := range objects {
+		if obj.Deleted || !strings.HasPrefix(obj.Name, prefix) {
+			continue
+		}
+		sequence, ok := SequenceFromName(obj.Name)
+		if !ok {
+			continue
+		}
+		size := obj.Size
+		// the size of the database, not of the compressed object
+		if v, err := strconv.ParseUint(obj.Headers.Get("size"), 10, 64); err == nil {
+			size = v
+		}
+		snapshots = append(snapshots, Snapshot{
+			Sequence: sequence,
+			Name:     obj.Name,
+			Size:     size,
+			Time:     obj.ModTime,
+		})
+	}
+	slices.SortFunc(snapshots, func(a, b Snapshot) int {
+		return cmp.Compare(b.Sequence, a.Sequence)
+	})
+	return snapshots, nil
+}
+
+func objectPrefix(id string) string {
+	return "history/" + id + "/"
+}
+
+func objectName(id string, sequence uint64) string {
+	return fmt.Sprintf("%s%020d", objectPrefix(id), sequence)
+}
+
+// SequenceFromName returns the sequence of a versioned snapshot object.
+func SequenceFromName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "history/") {
+		return 0, false
+	}
+	sequence, err := strconv.ParseUint(path.Base(name), 10, 64)
+	return sequence, err == nil
+}
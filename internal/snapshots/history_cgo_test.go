@@ -0,0 +1,217 @@
+//go:build cgo
+
+package snapshots_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/litesql/ha/internal/compress"
+	"github.com/litesql/ha/internal/snapshots"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func runJetStream(t *testing.T) *nats.Conn {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// loadDB loads a database replicated by the stream and returns it.
+func loadDB(t *testing.T, nc *nats.Conn, id, stream string) *sql.DB {
+	t.Helper()
+	ctx := context.Background()
+	err := sqlite.Load(ctx, "file:"+filepath.Join(t.TempDir(), id), sqlite.LoadConfig{
+		MaxConns: 1,
+		Stream:   stream,
+		Options: []ha.Option{
+			ha.WithName("node1"),
+			ha.WithReplicationURL(nc.ConnectedUrl()),
+			ha.WithReplicationStream(stream),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE TABLE items(id INTEGER PRIMARY KEY, data BLOB)"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// insert writes a row and waits until the node applied its changeset.
+func insert(t *testing.T, db *sql.DB, id string) {
+	t.Helper()
+	before, err := sqlite.AppliedSeq(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(context.Background(), "INSERT INTO items(data) VALUES (randomblob(10000))"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		applied, err := sqlite.AppliedSeq(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied > before {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the changeset after %d was not applied", before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rows returns the rows of the snapshot.
+func rows(t *testing.T, reader io.ReadCloser) int {
+	t.Helper()
+	defer reader.Close()
+	file := filepath.Join(t.TempDir(), "snapshot.db")
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM items").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	nc := runJetStream(t)
+	db := loadDB(t, nc, "history.db", "history")
+	h, err := snapshots.New(nc, snapshots.Config{
+		Retention: 2,
+		Stream:    func(string) string { return "history" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sequences []uint64
+	for range 3 {
+		insert(t, db, "history.db")
+		sequence, err := h.Keep(ctx, "history.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sequence == 0 {
+			t.Fatal("no snapshot kept after a change")
+		}
+		sequences = append(sequences, sequence)
+	}
+	if sequence, err := h.Keep(ctx, "history.db"); err != nil || sequence != 0 {
+		t.Errorf("got the snapshot %d, %v without change, want none", sequence, err)
+	}
+
+	list, err := h.List(ctx, "history.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Sequence != sequences[2] || list[1].Sequence != sequences[1] {
+		t.Fatalf("got %+v, want the 2 most recent snapshots %v", list, sequences[1:])
+	}
+
+	sequence, reader, err := h.Before(ctx, "history.db", sequences[2]-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence != sequences[1] {
+		t.Errorf("got the snapshot %d, want %d", sequence, sequences[1])
+	}
+	if got := rows(t, reader); got != 2 {
+		t.Errorf("%d rows in the snapshot, want 2", got)
+	}
+	if _, reader, err := h.Before(ctx, "history.db", sequences[1]-1); err != nil || reader != nil {
+		t.Errorf("got a snapshot, %v before the retained ones", err)
+	}
+	if _, err := h.Get(ctx, "history.db", sequences[0]); !errors.Is(err, snapshots.ErrNotFound) {
+		t.Errorf("pruned snapshot: got %v, want ErrNotFound", err)
+	}
+}
+
+// TestHistoryParts stores compressed snapshots in parts and reads them back.
+func TestHistoryParts(t *testing.T) {
+	ctx := context.Background()
+	nc := runJetStream(t)
+	db := loadDB(t, nc, "parts.db", "parts")
+	h, err := snapshots.New(nc, snapshots.Config{
+		Retention:   1,
+		Stream:      func(string) string { return "parts" },
+		Compression: compress.Zstd,
+		ChunkSize:   4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sequence uint64
+	for range 2 {
+		insert(t, db, "parts.db")
+		sequence, err = h.Keep(ctx, "parts.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader, err := h.Get(ctx, "parts.db", sequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rows(t, reader); got != 2 {
+		t.Errorf("%d rows in the snapshot, want 2", got)
+	}
+	list, err := h.List(ctx, "parts.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Sequence != sequence {
+		t.Errorf("got %+v, want the snapshot %d", list, sequence)
+	}
+}
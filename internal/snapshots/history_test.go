@@ -0,0 +1,27 @@
+package snapshots_test
+
+import (
+	"testing"
+
+	"github.com/litesql/ha/internal/snapshots"
+)
+
+func TestSequenceFromName(t *testing.T) {
+	tests := []struct {
+		name     string
+		sequence uint64
+		ok       bool
+	}{
+		{name: "history/ha.db/00000000000000000042", sequence: 42, ok: true},
+		{name: "history/my.db/00000000000000000000", sequence: 0, ok: true},
+		{name: "parts/ha.db/00000000000000000042/000001"},
+		{name: "history/ha.db/latest"},
+		{name: "ha.db"},
+	}
+	for _, tt := range tests {
+		sequence, ok := snapshots.SequenceFromName(tt.name)
+		if sequence != tt.sequence || ok != tt.ok {
+			t.Errorf("SequenceFromName(%q) = %d, %v, want %d, %v", tt.name, sequence, ok, tt.sequence, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package snapshots
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// partsHeader is set on the snapshots stored in parts, the object itself is
+// empty.
+const partsHeader = "parts"
+
+const maxPartBackoff = 30 * time.Second
+
+func partsPrefix(id string) string {
+	return "parts/" + id + "/"
+}
+
+func partName(id string, sequence uint64, part int) string {
+	return fmt.Sprintf("%s%020d/%06d", partsPrefix(id), sequence, part)
+}
+
+// putParts stores the content in parts of the chunk size. The parts already
+// stored with the same digest by a previous attempt are kept, so an
+// interrupted upload resumes where it stopped. Each part is retried with
+// backoff.
+func (h *History) putParts(ctx context.Context, store jetstream.ObjectStore, id string, sequence uint64, content io.ReaderAt, size int64) (int, error) {
+	chunk := h.cfg.ChunkSize
+	parts := int((size + chunk - 1) / chunk)
+	for part := range parts {
+		offset := int64(part) * chunk
+		section := io.NewSectionReader(content, offset, min(chunk, size-offset))
+		name := partName(id, sequence, part)
+		digest, err := digestOf(section)
+		if err != nil {
+			return 0, err
+		}
+		if info, err := store.GetInfo(ctx, name); err == nil && info.Digest == digest && int64(info.Size) == section.Size() {
+			slog.Debug("snapshot part already stored", "id", id, "name", name)
+			continue
+		}
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			_, err = store.Put(ctx, jetstream.ObjectMeta{Name: name}, io.NewSectionReader(section, 0, section.Size()))
+			if err == nil || attempt >= h.cfg.ChunkRetries || ctx.Err() != nil {
+				break
+			}
+			slog.Warn("failed to store snapshot part, retrying", "id", id, "name", name, "attempt", attempt+1, "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxPartBackoff)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("store part %d of %d: %w", part+1, parts, err)
+		}
+	}
+	return parts, nil
+}
+
+func digestOf(r io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return "SHA-256=" + base64.URLEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// partsReader reads the parts of a snapshot in order.
+type partsReader struct {
+	ctx      context.Context
+	store    jetstream.ObjectStore
+	id       string
+	sequence uint64
+	parts    int
+
+	next    int
+	current jetstream.ObjectResult
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next >= r.parts {
+				return 0, io.EOF
+			}
+			current, err := r.store.Get(r.ctx, partName(r.id, r.sequence, r.next))
+			if err != nil {
+				return 0, fmt.Errorf("part %d of %d: %w", r.next+1, r.parts, err)
+			}
+			r.current = current
+			r.next++
+		}
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+func partsOf(headers nats.Header) int {
+	parts, _ := strconv.Atoi(headers.Get(partsHeader))
+	return parts
+}
+
+// deleteSnapshot removes the snapshot object and its parts.
+func deleteSnapshot(ctx context.Context, store jetstream.ObjectStore, id, name string) error {
+	info, err := store.GetInfo(ctx, name)
+	if err != nil {
+		return err
+	}
+	if sequence, ok := SequenceFromName(name); ok {
+		for part := range partsOf(info.Headers) {
+			if err := store.Delete(ctx, partName(id, sequence, part)); err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+				return err
+			}
+		}
+	}
+	return store.Delete(ctx, name)
+}
+
+// removeIncomplete removes the parts of the uploads older than the sequence
+// that never completed, they will not be resumed.
+func removeIncomplete(ctx context.Context, store jetstream.ObjectStore, id string, sequence uint64) error {
+	objects, err := store.List(ctx)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrNoObjectsFound) {
+			return nil
+		}
+		return err
+	}
+	prefix := partsPrefix(id)
+	complete := make(map[uint64]bool)
+	for _, obj := range objects {
+		if obj.Deleted || !strings.HasPrefix(obj.Name, prefix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.Split(strings.TrimPrefix(obj.Name, prefix), "/")[0], 10, 64)
+		if err != nil || seq >= sequence {
+			continue
+		}
+		ok, checked := complete[seq]
+		if !checked {
+			_, err := store.GetInfo(ctx, objectName(id, seq))
+			if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+				return err
+			}
+			ok = err == nil
+			complete[seq] = ok
+		}
+		if ok {
+			continue
+		}
+		if err := store.Delete(ctx, obj.Name); err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+)
+
+const statsTableName = "sqlite_stat1"
+
+// statsTables are the planner statistics tables replicated to the replicas.
+// sqlite_stat4 only exists when SQLite is compiled with SQLITE_ENABLE_STAT4.
+var statsTables = []statTable{
+	{name: statsTableName, columns: "tbl, idx, stat"},
+	{name: "sqlite_stat4", columns: "tbl, idx, neq, nlt, ndlt, sample"},
+}
+
+var (
+	statsFingerprints   = make(map[string]string)
+	muStatsFingerprints sync.Mutex
+)
+
+type statTable struct {
+	name    string
+	columns string
+	rows    [][]any
+}
+
+// SyncStats periodically checks the sqlite_stat1 and sqlite_stat4 planner
+// statistics and publishes them to the replicas when they change on the leader
+// (after ANALYZE or PRAGMA optimize), so replicas don't need to run ANALYZE
+// themselves. The statistics found at startup are published on the first check.
+func SyncStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			muDBs.Lock()
+			list := make(map[string]*connectorDB, len(dbs))
+			for id, connDB := range dbs {
+				list[id] = connDB
+			}
+			muDBs.Unlock()
+			for id, connDB := range list {
+				if err := syncStats(ctx, id, connDB); err != nil {
+					slog.Warn("failed to sync planner statistics", "id", id, "error", err)
+				}
+			}
+		}
+	}
+}
+
+func syncStats(ctx context.Context, id string, connDB *connectorDB) error {
+	if !connDB.connector.LeaderProvider().IsLeader() || connDB.connector.Publisher() == nil {
+		return nil
+	}
+	tables, err := statTables(ha.ContextLocalDB(ctx, true), connDB.db)
+	if err != nil {
+		return err
+	}
+	fingerprint := statsFingerprint(tables)
+	muStatsFingerprints.Lock()
+	previous, known := statsFingerprints[id]
+	statsFingerprints[id] = fingerprint
+	muStatsFingerprints.Unlock()
+	if previous == fingerprint || (!known && len(tables) == 0) {
+		return nil
+	}
+
+	cs := ha.NewChangeSet(connDB.connector.NodeName(), id)
+	// ANALYZE sqlite_schema creates the stat tables if needed and reloads the
+	// statistics into the query planner without scanning user tables.
+	cs.AddChange(statsChange(statsTableName, "ANALYZE sqlite_schema"))
+	var count int
+	for _, table := range tables {
+		cs.AddChange(statsChange(table.name, "DELETE FROM "+table.name))
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", strings.Count(table.columns, ",")+1), ", ")
+		insert := fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", table.name, table.columns, placeholders)
+		for _, row := range table.rows {
+			cs.AddChange(statsChange(table.name, insert, row...))
+		}
+		count += len(table.rows)
+	}
+	cs.AddChange(statsChange(statsTableName, "ANALYZE sqlite_schema"))
+	if err := cs.Send(connDB.connector.Publisher()); err != nil {
+		return fmt.Errorf("publish: %w", err)
+	}
+	slog.Info("planner statistics replicated", "id", id, "rows", count)
+	return nil
+}
+
+func statsChange(table, command string, args ...any) ha.Change {
+	return ha.Change{
+		Table:     table,
+		Operation: "SQL",
+		Command:   command,
+		Args:      args,
+	}
+}
+
+// statTables reads the rows of the existing statistics tables, in the order
+// they were written by ANALYZE.
+func statTables(ctx context.Context, querier querier) ([]statTable, error) {
+	var list []statTable
+	for _, table := range statsTables {
+		rows, err := statRows(ctx, querier, table)
+		if err != nil {
+			// the stat tables only exist after the first ANALYZE
+			if strings.Contains(err.Error(), "no such table") {
+				continue
+			}
+			return nil, err
+		}
+		table.rows = rows
+		list = append(list, table)
+	}
+	return list, nil
+}
+
+func statRows(ctx context.Context, querier querier, table statTable) ([][]any, error) {
+	rows, err := querier.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s ORDER BY rowid", table.columns, table.name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var list [][]any
+	for rows.Next() {
+		values := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		list = append(list, values)
+	}
+	return list, rows.Err()
+}
+
+func statsFingerprint(tables []statTable) string {
+	h := sha256.New()
+	for _, table := range tables {
+		fmt.Fprintf(h, "%s\n", table.name)
+		for _, row := range table.rows {
+			for _, v := range row {
+				fmt.Fprintf(h, "%T\x00%v\x00", v, v)
+			}
+			fmt.Fprintln(h)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// StatsInterceptor records the statistics received from the leader so they are
+// not published again by this node.
+type StatsInterceptor struct{}
+
+func (StatsInterceptor) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	return false, nil
+}
+
+func (StatsInterceptor) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if err != nil || len(cs.Changes) == 0 || cs.Changes[0].Table != statsTableName {
+		return err
+	}
+	tables, statErr := statTables(ha.ContextLocalDB(context.Background(), true), conn)
+	if statErr != nil {
+		slog.Warn("failed to read replicated planner statistics", "id", cs.Filename, "error", statErr)
+		return nil
+	}
+	muStatsFingerprints.Lock()
+	statsFingerprints[cs.Filename] = statsFingerprint(tables)
+	muStatsFingerprints.Unlock()
+	return nil
+}
@@ -0,0 +1,81 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// BeginMode is the SQLite transaction begin mode.
+type BeginMode string
+
+const (
+	// BeginDeferred takes the write lock on the first write, two deferred
+	// transactions upgrading their read lock can fail with SQLITE_BUSY.
+	BeginDeferred BeginMode = "deferred"
+	// BeginImmediate takes the write lock at the start of the transaction,
+	// waiting for the busy timeout.
+	BeginImmediate BeginMode = "immediate"
+	// BeginExclusive is the same as immediate in WAL mode.
+	BeginExclusive BeginMode = "exclusive"
+)
+
+// ParseBeginMode parses deferred, immediate or exclusive, case insensitive.
+// An empty string is deferred.
+func ParseBeginMode(s string) (BeginMode, error) {
+	switch mode := BeginMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case "":
+		return BeginDeferred, nil
+	case BeginDeferred, BeginImmediate, BeginExclusive:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid begin mode %q, use deferred, immediate or exclusive", s)
+	}
+}
+
+type beginModeKey struct{}
+
+// ContextBeginMode sets the begin mode of the transactions run by
+// Transaction.
+func ContextBeginMode(ctx context.Context, mode BeginMode) context.Context {
+	return context.WithValue(ctx, beginModeKey{}, mode)
+}
+
+func beginModeOf(ctx context.Context) BeginMode {
+	mode, _ := ctx.Value(beginModeKey{}).(BeginMode)
+	return mode
+}
+
+// beginner is a *sql.DB or a *sql.Conn.
+type beginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// BeginTx begins a transaction in the mode. The drivers always run a deferred
+// BEGIN, so the immediate and exclusive transactions take the write lock
+// right away by rewriting the user_version with its own value: nothing is
+// replicated, and a concurrent writer makes the transaction wait at its start
+// instead of deadlocking when its read lock is upgraded.
+func BeginTx(ctx context.Context, db beginner, mode BeginMode) (*sql.Tx, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelReadCommitted,
+		ReadOnly:  false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if mode != BeginImmediate && mode != BeginExclusive {
+		return tx, nil
+	}
+	var version int64
+	err = tx.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version))
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("begin %s: %w", mode, err)
+	}
+	return tx, nil
+}
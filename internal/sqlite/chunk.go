@@ -0,0 +1,240 @@
+package sqlite
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Chunked is an UPDATE or DELETE statement that can be executed in rowid
+// ranges of its table, giving a progress report and a cancellation point
+// between the ranges.
+type Chunked struct {
+	// Schema and Table are the unquoted names of the target table.
+	Schema, Table string
+	// Name is the table as written in the statement.
+	Name string
+	// Assigned lists the columns set by an UPDATE.
+	Assigned []string
+
+	head  string // statement up to the table name
+	body  string // SET clause of an UPDATE
+	where string
+}
+
+type sqlToken struct {
+	text  string
+	upper string
+	start int
+	end   int
+	ident bool // bare or quoted identifier
+}
+
+// ChunkStatement parses statements of the forms
+//
+//	DELETE FROM table [WHERE expr]
+//	UPDATE [OR action] table SET assignments [WHERE expr]
+//
+// Statements with a CTE, an alias, an index clause, UPDATE FROM, RETURNING,
+// ORDER BY or LIMIT are not chunked.
+func ChunkStatement(query string) (*Chunked, bool) {
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+	tokens, ok := topLevelTokens(query)
+	if !ok || len(tokens) < 3 {
+		return nil, false
+	}
+	for _, token := range tokens {
+		if token.text == ";" {
+			return nil, false
+		}
+	}
+	i := 1
+	var update bool
+	switch tokens[0].upper {
+	case "DELETE":
+		if tokens[1].upper != "FROM" {
+			return nil, false
+		}
+		i = 2
+	case "UPDATE":
+		update = true
+		if tokens[1].upper == "OR" {
+			i = 3
+		}
+	default:
+		return nil, false
+	}
+
+	var c Chunked
+	if i >= len(tokens) || !tokens[i].ident {
+		return nil, false
+	}
+	c.Table = unquoteIdent(tokens[i].text)
+	nameStart, nameEnd := tokens[i].start, tokens[i].end
+	i++
+	if i+1 < len(tokens) && tokens[i].text == "." && tokens[i+1].ident {
+		c.Schema, c.Table = c.Table, unquoteIdent(tokens[i+1].text)
+		nameEnd = tokens[i+1].end
+		i += 2
+	}
+	c.Name = query[nameStart:nameEnd]
+	c.head = query[:nameEnd]
+
+	bodyEnd := len(query)
+	if update {
+		if i >= len(tokens) || tokens[i].upper != "SET" {
+			return nil, false
+		}
+		expectTarget := true
+		for i++; i < len(tokens) && tokens[i].upper != "WHERE"; i++ {
+			switch {
+			case tokens[i].text == ",":
+				expectTarget = true
+			case expectTarget:
+				if !tokens[i].ident {
+					// row value assignment (a, b) = (...)
+					return nil, false
+				}
+				c.Assigned = append(c.Assigned, unquoteIdent(tokens[i].text))
+				expectTarget = false
+			}
+			switch tokens[i].upper {
+			case "FROM", "RETURNING", "ORDER", "LIMIT":
+				return nil, false
+			}
+		}
+		if len(c.Assigned) == 0 {
+			return nil, false
+		}
+		if i < len(tokens) {
+			bodyEnd = tokens[i].start
+		}
+		c.body = strings.TrimSpace(query[nameEnd:bodyEnd])
+	} else if i < len(tokens) && tokens[i].upper != "WHERE" {
+		return nil, false
+	}
+	if i < len(tokens) {
+		whereStart := tokens[i].end
+		for _, token := range tokens[i+1:] {
+			switch token.upper {
+			case "RETURNING", "ORDER", "LIMIT":
+				return nil, false
+			}
+		}
+		c.where = strings.TrimSpace(query[whereStart:])
+		if c.where == "" {
+			return nil, false
+		}
+	}
+	return &c, true
+}
+
+// Range returns the statement restricted to the rows with lo <= rowid <= hi.
+// NOT INDEXED keeps SQLite on the rowid b-tree, each range reads only its rows
+// whatever the indexes on the filtered columns.
+func (c *Chunked) Range(rowid string, lo, hi int64) string {
+	var b strings.Builder
+	b.WriteString(c.head)
+	b.WriteString(" NOT INDEXED")
+	if c.body != "" {
+		b.WriteString(" ")
+		b.WriteString(c.body)
+	}
+	// the clauses may end with a line comment
+	fmt.Fprintf(&b, "\nWHERE %s BETWEEN %d AND %d", rowid, lo, hi)
+	if c.where != "" {
+		fmt.Fprintf(&b, " AND (%s\n)", c.where)
+	}
+	return b.String()
+}
+
+// topLevelTokens returns the words, identifiers and punctuation outside
+// parentheses, skipping literals and comments. A parenthesis at the top level
+// is returned as a "(" token.
+func topLevelTokens(query string) ([]sqlToken, bool) {
+	var tokens []sqlToken
+	depth := 0
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return tokens, depth == 0
+			}
+			i += end + 1
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, false
+			}
+			i += end + 4
+		case ch == '\'' || ch == '"' || ch == '`' || ch == '[':
+			closing := ch
+			if ch == '[' {
+				closing = ']'
+			}
+			j := i + 1
+			for {
+				end := strings.IndexByte(query[j:], closing)
+				if end < 0 {
+					return nil, false
+				}
+				j += end + 1
+				// doubled quotes escape the quote
+				if closing != ']' && j < len(query) && query[j] == closing {
+					j++
+					continue
+				}
+				break
+			}
+			if depth == 0 {
+				tokens = append(tokens, sqlToken{text: query[i:j], start: i, end: j, ident: ch != '\''})
+			}
+			i = j
+		case ch == '(':
+			if depth == 0 {
+				tokens = append(tokens, sqlToken{text: "(", start: i, end: i + 1})
+			}
+			depth++
+			i++
+		case ch == ')':
+			depth--
+			if depth < 0 {
+				return nil, false
+			}
+			i++
+		case isWordChar(ch):
+			j := i
+			for j < len(query) && isWordChar(query[j]) {
+				j++
+			}
+			if depth == 0 {
+				text := query[i:j]
+				ident := ch < '0' || ch > '9'
+				tokens = append(tokens, sqlToken{text: text, upper: strings.ToUpper(text), start: i, end: j, ident: ident})
+			}
+			i = j
+		default:
+			if depth == 0 {
+				tokens = append(tokens, sqlToken{text: query[i : i+1], start: i, end: i + 1})
+			}
+			i++
+		}
+	}
+	return tokens, depth == 0
+}
+
+func unquoteIdent(s string) string {
+	if len(s) < 2 {
+		return s
+	}
+	switch s[0] {
+	case '"', '`':
+		return strings.ReplaceAll(s[1:len(s)-1], s[:1]+s[:1], s[:1])
+	case '[':
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,65 @@
+package sqlite_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestChunkStatement(t *testing.T) {
+	tests := []struct {
+		sql      string
+		name     string
+		assigned []string
+		want     string
+	}{
+		{
+			sql:  "DELETE FROM logs",
+			name: "logs",
+			want: "DELETE FROM logs NOT INDEXED\nWHERE rowid BETWEEN 1 AND 10",
+		},
+		{
+			sql:  "delete from main.\"old logs\" where ts < :ts -- expired;",
+			name: "main.\"old logs\"",
+			want: "delete from main.\"old logs\" NOT INDEXED\nWHERE rowid BETWEEN 1 AND 10 AND (ts < :ts -- expired\n)",
+		},
+		{
+			sql:      "UPDATE OR IGNORE users SET name = upper(name), note = 'a, b where' WHERE id IN (SELECT id FROM x WHERE y LIMIT 1);",
+			name:     "users",
+			assigned: []string{"name", "note"},
+			want:     "UPDATE OR IGNORE users NOT INDEXED SET name = upper(name), note = 'a, b where'\nWHERE rowid BETWEEN 1 AND 10 AND (id IN (SELECT id FROM x WHERE y LIMIT 1)\n)",
+		},
+	}
+	for _, tt := range tests {
+		c, ok := sqlite.ChunkStatement(tt.sql)
+		if !ok {
+			t.Errorf("ChunkStatement(%q) not chunkable", tt.sql)
+			continue
+		}
+		if c.Name != tt.name || !slices.Equal(c.Assigned, tt.assigned) {
+			t.Errorf("ChunkStatement(%q) = %q %v", tt.sql, c.Name, c.Assigned)
+		}
+		if got := c.Range("rowid", 1, 10); got != tt.want {
+			t.Errorf("Range(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT * FROM users",
+		"INSERT INTO users VALUES (1)",
+		"WITH x AS (SELECT 1) DELETE FROM users",
+		"DELETE FROM users AS u WHERE u.id = 1",
+		"DELETE FROM users INDEXED BY idx WHERE id = 1",
+		"DELETE FROM users WHERE id > 1 RETURNING id",
+		"DELETE FROM users WHERE id > 1 ORDER BY id LIMIT 10",
+		"UPDATE users SET (a, b) = (1, 2)",
+		"UPDATE users SET a = x.a FROM x WHERE x.id = users.id",
+		"DELETE FROM users; DELETE FROM logs",
+		"DELETE FROM users WHERE",
+	} {
+		if _, ok := sqlite.ChunkStatement(sql); ok {
+			t.Errorf("ChunkStatement(%q) chunkable", sql)
+		}
+	}
+}
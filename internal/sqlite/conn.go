@@ -6,21 +6,112 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/litesql/go-ha"
 	sqliteha "github.com/litesql/go-sqlite-ha"
+	msqlite "modernc.org/sqlite"
+	sqlite3lib "modernc.org/sqlite/lib"
 )
 
+func init() {
+	// modernc registers the functions for every connection of the driver
+	msqlite.MustRegisterScalarFunction("ha_flag", -1, func(ctx *msqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("ha_flag(name [, subject]): wrong number of arguments")
+		}
+		var subject string
+		if len(args) == 2 && args[1] != nil {
+			subject = fmt.Sprint(args[1])
+		}
+		return FlagEnabled(fmt.Sprint(args[0]), subject), nil
+	})
+	msqlite.MustRegisterScalarFunction("ha_flag_value", 1, func(ctx *msqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if value, ok := FlagValue(fmt.Sprint(args[0])); ok {
+			return string(value), nil
+		}
+		return nil, nil
+	})
+	msqlite.MustRegisterScalarFunction("regexp", 2, func(ctx *msqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return regexpMatch(args[0], args[1])
+	})
+	msqlite.MustRegisterScalarFunction("ha_lock", -1, func(ctx *msqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("ha_lock(name [, ttl_seconds]): wrong number of arguments")
+		}
+		var ttl any
+		if len(args) == 2 {
+			ttl = args[1]
+		}
+		return lockFunc(args[0], ttl)
+	})
+	msqlite.MustRegisterScalarFunction("ha_unlock", 2, func(ctx *msqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return unlockFunc(args[0], args[1])
+	})
+	msqlite.MustRegisterScalarFunction("ha_node", 0, func(ctx *msqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return nodeFunc(), nil
+	})
+	msqlite.MustRegisterScalarFunction("ha_version", 0, func(ctx *msqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return versionFunc(), nil
+	})
+	// the function can't tell the database of the connection, the default
+	// one is reported
+	msqlite.MustRegisterScalarFunction("ha_database", 0, func(ctx *msqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return databaseOf(DefaultDatabase()), nil
+	})
+	msqlite.MustRegisterScalarFunction("ha_seq", -1, func(ctx *msqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		switch len(args) {
+		case 0:
+			return seqFunc(databaseOf(DefaultDatabase())), nil
+		case 1:
+			return seqFunc(args[0]), nil
+		}
+		return nil, fmt.Errorf("ha_seq([database]): wrong number of arguments")
+	})
+}
+
 func Backup(ctx context.Context, db *sql.DB, w io.Writer) error {
 	return sqliteha.Backup(ctx, db, w)
 }
 
+// OpenFile opens a database file without replication.
+func OpenFile(path string) (*sql.DB, error) {
+	return sql.Open("sqlite", path)
+}
+
+// OpenMemory opens a private in-memory database, with the SQL functions of
+// the replicated ones.
+func OpenMemory() (*sql.DB, error) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// every connection would open a distinct database
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
 func newConnector(dsn string, options ...ha.Option) (*ha.Connector, error) {
 	return sqliteha.NewConnector(dsn, options...)
 }
 
+func isCommitHookError(err error) bool {
+	var sqliteErr *msqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3lib.SQLITE_CONSTRAINT_COMMITHOOK
+}
+
+// ErrorCode returns the SQLite extended result code of err, the primary
+// result code is its least significant byte.
+func ErrorCode(err error) (int, bool) {
+	var sqliteErr *msqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code(), true
+	}
+	return 0, false
+}
+
 func deserializerConn(conn driver.Conn) (deserializer, error) {
 	switch c := conn.(type) {
 	case deserializer:
@@ -30,3 +121,19 @@ func deserializerConn(conn driver.Conn) (deserializer, error) {
 	}
 
 }
+
+// execLocal executes the query on the SQLite connection under conn.
+func execLocal(conn *sql.Conn, query string, args ...driver.Value) error {
+	return conn.Raw(func(driverConn any) error {
+		execer, ok := driverConn.(driver.ExecerContext)
+		if !ok {
+			return fmt.Errorf("not a sqlite connection")
+		}
+		named := make([]driver.NamedValue, len(args))
+		for i, arg := range args {
+			named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+		}
+		_, err := execer.ExecContext(context.Background(), query, named)
+		return err
+	})
+}
@@ -6,19 +6,105 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/litesql/go-ha"
+	"github.com/litesql/go-sqlite3"
 	sqlite3ha "github.com/litesql/go-sqlite3-ha"
 )
 
+const memoryDriver = "sqlite3-ha-memory"
+
+func init() {
+	sql.Register(memoryDriver, &sqlite3.SQLiteDriver{ConnectHook: registerFunctions})
+}
+
 func Backup(ctx context.Context, db *sql.DB, w io.Writer) error {
 	return sqlite3ha.Backup(ctx, db, w)
 }
 
+// OpenFile opens a database file without replication.
+func OpenFile(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", path)
+}
+
+// OpenMemory opens a private in-memory database, with the SQL functions of
+// the replicated ones.
+func OpenMemory() (*sql.DB, error) {
+	db, err := sql.Open(memoryDriver, ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// every connection would open a distinct database
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
 func newConnector(dsn string, options ...ha.Option) (*ha.Connector, error) {
-	return sqlite3ha.NewConnector(dsn, options...)
+	// the driver is built like sqlite3ha.NewConnector does, plus the hook
+	// registering the HA SQL functions on every connection
+	dsn, nameOptions, err := ha.NameToOptions(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	drv := sqlite3ha.Driver{
+		ConnectHook: registerFunctions,
+		Options:     append(options, nameOptions...),
+	}
+	connector, err := drv.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return connector.(*ha.Connector), nil
+}
+
+func registerFunctions(conn *sqlite3.SQLiteConn) error {
+	database := databaseOf(conn.GetFilename("main"))
+	functions := []struct {
+		name string
+		impl any
+	}{
+		{"ha_flag", func(name string) bool { return FlagEnabled(name, "") }},
+		{"ha_flag", FlagEnabled},
+		{"ha_flag_value", func(name string) any {
+			if value, ok := FlagValue(name); ok {
+				return string(value)
+			}
+			return nil
+		}},
+		{"regexp", regexpMatch},
+		{"ha_lock", func(name any) (any, error) { return lockFunc(name, nil) }},
+		{"ha_lock", lockFunc},
+		{"ha_unlock", unlockFunc},
+		{"ha_node", nodeFunc},
+		{"ha_version", versionFunc},
+		{"ha_database", func() any { return database }},
+		{"ha_seq", func() any { return seqFunc(database) }},
+		{"ha_seq", seqFunc},
+	}
+	for _, fn := range functions {
+		if err := conn.RegisterFunc(fn.name, fn.impl, false); err != nil {
+			return fmt.Errorf("register %s: %w", fn.name, err)
+		}
+	}
+	return nil
+}
+
+func isCommitHookError(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintCommitHook
+}
+
+// ErrorCode returns the SQLite extended result code of err, the primary
+// result code is its least significant byte.
+func ErrorCode(err error) (int, bool) {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return int(sqliteErr.ExtendedCode), true
+	}
+	return 0, false
 }
 
 func deserializerConn(conn driver.Conn) (deserializer, error) {
@@ -32,3 +118,17 @@ func deserializerConn(conn driver.Conn) (deserializer, error) {
 	}
 
 }
+
+// execLocal executes the query on the SQLite connection under conn, without
+// the statement parsing of the replicated connections: it rejects ATTACH
+// and DETACH.
+func execLocal(conn *sql.Conn, query string, args ...driver.Value) error {
+	return conn.Raw(func(driverConn any) error {
+		c, ok := driverConn.(*sqlite3ha.Conn)
+		if !ok {
+			return fmt.Errorf("not a sqlite3 connection")
+		}
+		_, err := c.SQLiteConn.Exec(query, args)
+		return err
+	})
+}
@@ -0,0 +1,81 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSeqNotApplied is returned by WaitApplied when the database did not apply
+// the stream sequence in time.
+var ErrSeqNotApplied = errors.New("replication sequence not applied yet")
+
+const defaultMinSeqTimeout = 5 * time.Second
+
+// minSeqTimeout is changed by the reload of the configuration while the
+// reads wait, nil is the default.
+var minSeqTimeout atomic.Pointer[time.Duration]
+
+// SetMinSeqTimeout sets how long the reads wait for their min_seq to be
+// applied.
+func SetMinSeqTimeout(timeout time.Duration) {
+	minSeqTimeout.Store(&timeout)
+}
+
+func minSeqWait() time.Duration {
+	if timeout := minSeqTimeout.Load(); timeout != nil {
+		return *timeout
+	}
+	return defaultMinSeqTimeout
+}
+
+// PublishedSeq returns the stream sequence of the last changeset published by
+// the node for the database, 0 when nothing was published. A commit returns
+// once its changeset is acknowledged, the sequence read after it is at least
+// the one of its changeset. It is 0 with the async replication, the
+// changesets are published after their commit.
+func PublishedSeq(id string) uint64 {
+	muDBs.Lock()
+	connDB, ok := lookup(id)
+	muDBs.Unlock()
+	if !ok || connDB.publisher.async() {
+		return 0
+	}
+	return connDB.publishedSeq()
+}
+
+// WaitApplied blocks until the database applied the stream sequence, so a
+// read sees the writes made on any node up to that sequence: the
+// read-your-writes consistency of the clients sending back the sequence of
+// their last write.
+func WaitApplied(ctx context.Context, id string, seq uint64) error {
+	if seq == 0 {
+		return nil
+	}
+	applied, err := AppliedSeq(id)
+	if err != nil || applied >= seq {
+		return err
+	}
+	if timeout := minSeqWait(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("%w: applied %d, want %d", ErrSeqNotApplied, applied, seq)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if applied, err = AppliedSeq(id); err != nil || applied >= seq {
+			return err
+		}
+	}
+}
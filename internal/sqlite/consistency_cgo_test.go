@@ -0,0 +1,72 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// TestPublishedSeq returns the sequence of the last write once committed, and
+// none when the write is published after its commit.
+func TestPublishedSeq(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	stream := new(atomic.Uint64)
+	// the other nodes publish to the stream too
+	stream.Store(41)
+	tests := []struct {
+		id    string
+		async bool
+		want  uint64
+	}{
+		{id: "seq_sync.db", want: 43},
+		{id: "seq_async.db", async: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			cfg := sqlite.LoadConfig{
+				MaxConns: 1,
+				Publisher: func(replicationID, subject string) (ha.Publisher, error) {
+					pub := &streamPublisher{stream: stream}
+					if !tt.async {
+						return pub, nil
+					}
+					asyncPub, err := sqlite.NewAsyncPublisher(sqlite.OutboxConfig{Dir: dir, RetryBackoff: time.Millisecond}, replicationID, subject, pub, nil)
+					if err != nil {
+						return nil, err
+					}
+					return asyncPub, nil
+				},
+			}
+			if tt.async {
+				cfg.OutboxDir = dir
+			}
+			if err := sqlite.Load(ctx, "file:"+filepath.Join(dir, tt.id), cfg); err != nil {
+				t.Fatal(err)
+			}
+			db, err := sqlite.DB(tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range []string{
+				"CREATE TABLE items(id INTEGER PRIMARY KEY)",
+				"INSERT INTO items VALUES (1)",
+			} {
+				if _, err := sqlite.Exec(ctx, db, s, nil); err != nil {
+					t.Fatalf("%s: %v", s, err)
+				}
+			}
+			if got := sqlite.PublishedSeq(tt.id); got != tt.want {
+				t.Errorf("PublishedSeq = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/litesql/ha/internal/session"
+)
+
+var ErrCrossDatabase = errors.New("invalid cross-database transaction")
+
+const (
+	controlTableName = "ha_stats"
+	linkOperation    = "LINK"
+)
+
+// attachedDB is a database attached to the connection of a cross-database
+// transaction.
+type attachedDB struct {
+	id       string
+	filename string
+	*connectorDB
+}
+
+// AttachedSchema returns the schema name of a database attached to a
+// cross-database transaction: its id without extension.
+func AttachedSchema(id string) string {
+	return strings.TrimSuffix(id, filepath.Ext(id))
+}
+
+// AttachedTransaction runs the queries in a transaction of the database id
+// with the attach databases of the node attached, their tables qualified by
+// AttachedSchema. The transaction commits atomically on the node and each
+// database publishes the changes to its tables on its own stream, the
+// changesets linked by a LINK change of the control table.
+func AttachedTransaction(ctx context.Context, id string, attach []string, queries []Request) ([]*Response, error) {
+	muDBs.Lock()
+	primary, ok := lookup(id)
+	muDBs.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	id = cmp.Or(id, DefaultDatabase())
+	if primary.outbox != "" {
+		return nil, fmt.Errorf("%w: not supported with --async-replication", ErrCrossDatabase)
+	}
+	routes := make(map[string]*attachedDB, len(attach))
+	for _, attachedID := range attach {
+		muDBs.Lock()
+		connDB, ok := dbs[attachedID]
+		muDBs.Unlock()
+		if !ok || attachedID == "" {
+			return nil, fmt.Errorf("database with id %q %w", attachedID, ErrNotFound)
+		}
+		schema := AttachedSchema(attachedID)
+		switch {
+		case connDB == primary:
+			return nil, fmt.Errorf("%w: %q is the database of the transaction", ErrCrossDatabase, attachedID)
+		case strings.EqualFold(schema, "main") || strings.EqualFold(schema, "temp"):
+			return nil, fmt.Errorf("%w: %q can not be attached as %s", ErrCrossDatabase, attachedID, schema)
+		case routes[strings.ToLower(schema)] != nil:
+			return nil, fmt.Errorf("%w: %q is attached twice as %s", ErrCrossDatabase, attachedID, schema)
+		case connDB.outbox != "":
+			return nil, fmt.Errorf("%w: not supported with --async-replication", ErrCrossDatabase)
+		case connDB.publisher != nil && primary.publisher == nil:
+			return nil, fmt.Errorf("%w: database %q does not replicate the changes of %q", ErrCrossDatabase, id, attachedID)
+		}
+		var filename string
+		err := connDB.db.QueryRowContext(ctx, "SELECT file FROM pragma_database_list WHERE name = ?", "main").Scan(&filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get db filename: %w", err)
+		}
+		if filename == "" {
+			return nil, fmt.Errorf("%w: the in-memory database %q can not be attached", ErrCrossDatabase, attachedID)
+		}
+		routes[strings.ToLower(schema)] = &attachedDB{id: attachedID, filename: filename, connectorDB: connDB}
+	}
+
+	conn, err := primary.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for schema, attached := range routes {
+		if err := execLocal(conn, "ATTACH DATABASE ? AS "+quoteIdentifier(schema), attached.filename); err != nil {
+			return nil, fmt.Errorf("attach %q: %w", attached.id, err)
+		}
+		defer func() {
+			if err := execLocal(conn, "DETACH DATABASE "+quoteIdentifier(schema)); err != nil {
+				slog.Warn("failed to detach database", "database", id, "attached", attached.id, "error", err)
+			}
+		}()
+	}
+
+	tx, err := BeginTx(ctx, conn, beginModeOf(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var list []*Response
+	for _, query := range queries {
+		queryCtx, cancel := QueryContext(ctx, time.Duration(query.TimeoutMs)*time.Millisecond)
+		res, err := Exec(queryCtx, tx, query.Sql, query.Params)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, res)
+	}
+	if primary.publisher == nil {
+		return list, CommitError(tx.Commit())
+	}
+	pub := primary.publisher
+	pub.commitMu.Lock()
+	defer pub.commitMu.Unlock()
+	if identity, ok := session.FromContext(ctx); ok && publishIdentity {
+		pub.identity.Store(&identity)
+		defer pub.identity.Store(nil)
+	}
+	if traced := trace.SpanContextFromContext(ctx); traced.IsSampled() {
+		pub.spanContext.Store(&traced)
+		defer pub.spanContext.Store(nil)
+	}
+	pub.routes.Store(&routes)
+	defer pub.routes.Store(nil)
+	if err := CommitError(tx.Commit()); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// RetryAttachedTransaction runs AttachedTransaction again on a lock conflict
+// like RetryTransaction.
+func RetryAttachedTransaction(ctx context.Context, id string, attach []string, queries []Request) ([]*Response, int, error) {
+	return retry(ctx, func() ([]*Response, error) {
+		return AttachedTransaction(ctx, id, attach, queries)
+	})
+}
+
+// publishLinked publishes the changes of the attached databases to their
+// streams, and leaves the changes of the primary database in cs. Every
+// changeset starts with the same LINK change. The streams can't drop a
+// changeset: when a publish fails, the changesets already published are
+// compensated by changesets reverting them, and retract does the same for a
+// failure to publish cs.
+func publishLinked(cs *ha.ChangeSet, routes map[string]*attachedDB, identity *session.Identity) (retract func() error, err error) {
+	parts := make(map[*attachedDB][]ha.Change)
+	var changes []ha.Change
+	for _, change := range cs.Changes {
+		attached, ok := routes[strings.ToLower(change.Database)]
+		if !ok {
+			changes = append(changes, change)
+			continue
+		}
+		if attached.publisher == nil {
+			continue
+		}
+		change.Database = "main"
+		parts[attached] = append(parts[attached], change)
+	}
+	var published []*attachedDB
+	link := ha.Change{
+		Table:     controlTableName,
+		Operation: linkOperation,
+		Columns:   []string{"id", "databases"},
+		TsNs:      cs.Timestamp,
+	}
+	publish := func(attached *attachedDB, part []ha.Change) error {
+		linked := ha.NewChangeSet(cs.Node, attached.id)
+		linked.ProcessID = cs.ProcessID
+		linked.Timestamp = cs.Timestamp
+		linked.Changes = append([]ha.Change{link}, part...)
+		if identity != nil {
+			session.Attach(linked, *identity)
+		}
+		return attached.publisher.Publish(linked)
+	}
+	retract = func() error {
+		var errs []error
+		for _, attached := range published {
+			part, ok := reverted(parts[attached])
+			if !ok {
+				errs = append(errs, fmt.Errorf("the changes of %q can not be reverted", attached.id))
+				continue
+			}
+			if err := publish(attached, part); err != nil {
+				errs = append(errs, fmt.Errorf("revert the changes of %q: %w", attached.id, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+	if len(parts) == 0 {
+		cs.Changes = changes
+		return retract, nil
+	}
+	attached := slices.SortedFunc(maps.Keys(parts), func(a, b *attachedDB) int {
+		return strings.Compare(a.id, b.id)
+	})
+	var ids []string
+	if len(changes) > 0 {
+		ids = append(ids, cs.Filename)
+	}
+	for _, a := range attached {
+		ids = append(ids, a.id)
+	}
+	link.NewValues = []any{rand.Text(), strings.Join(ids, ",")}
+	for _, a := range attached {
+		if err := publish(a, parts[a]); err != nil {
+			err = fmt.Errorf("publish the changes of %q: %w", a.id, err)
+			return nil, errors.Join(err, retract())
+		}
+		published = append(published, a)
+	}
+	if len(changes) > 0 {
+		changes = append([]ha.Change{link}, changes...)
+	}
+	cs.Changes = changes
+	return retract, nil
+}
+
+// reverted returns the changes undoing the changes, last first, false when a
+// change is not a row change.
+func reverted(changes []ha.Change) ([]ha.Change, bool) {
+	var undo []ha.Change
+	for _, change := range slices.Backward(changes) {
+		switch change.Operation {
+		case "INSERT", "UPDATE", "DELETE":
+			undo = append(undo, change.Reverse())
+		default:
+			return nil, false
+		}
+	}
+	return undo, true
+}
@@ -0,0 +1,122 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// failingPublisher rejects the changesets while failing is set.
+type failingPublisher struct {
+	recorder
+	failing atomic.Bool
+}
+
+func (p *failingPublisher) Publish(cs *ha.ChangeSet) error {
+	if p.failing.Load() {
+		return errors.New("stream unavailable")
+	}
+	return p.recorder.Publish(cs)
+}
+
+// TestAttachedTransactionRetract reverts the changes published to the
+// stream of an attached database when the changes of the primary database
+// can't be published: the transaction rolls back on the node.
+func TestAttachedTransactionRetract(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	orders := new(failingPublisher)
+	stock := new(recorder)
+	for dsn, pub := range map[string]ha.Publisher{
+		"file:" + filepath.Join(dir, "xorders.db"): orders,
+		"file:" + filepath.Join(dir, "xstock.db"):  stock,
+	} {
+		err := sqlite.Load(ctx, dsn, sqlite.LoadConfig{
+			MaxConns: 2,
+			Publisher: func(string, string) (ha.Publisher, error) {
+				return pub, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ordersDB, err := sqlite.DB("xorders.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stockDB, err := sqlite.DB("xstock.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for db, s := range map[*sql.DB]string{
+		ordersDB: "CREATE TABLE orders(id INTEGER PRIMARY KEY, item INTEGER)",
+		stockDB:  "CREATE TABLE items(id INTEGER PRIMARY KEY, stock INTEGER)",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	if _, err := stockDB.ExecContext(ctx, "INSERT INTO items VALUES (42, 10)"); err != nil {
+		t.Fatal(err)
+	}
+	queries := []sqlite.Request{
+		{Sql: "INSERT INTO orders VALUES (1, 42)"},
+		{Sql: "UPDATE xstock.items SET stock = stock - 2 WHERE id = 42"},
+	}
+
+	orders.failing.Store(true)
+	published := len(stock.messages)
+	if _, err := sqlite.AttachedTransaction(ctx, "xorders.db", []string{"xstock.db"}, queries); err == nil {
+		t.Fatal("the transaction committed without publishing the changes of xorders.db")
+	}
+	if len(stock.messages) != published+2 {
+		t.Fatalf("published %d changesets to xstock.db, want the changes and their revert", len(stock.messages)-published)
+	}
+	var linked, revert ha.ChangeSet
+	if err := json.Unmarshal(stock.messages[published], &linked); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(stock.messages[published+1], &revert); err != nil {
+		t.Fatal(err)
+	}
+	if len(revert.Changes) != 2 || revert.Changes[0].Operation != "LINK" || revert.Changes[1].Operation != "UPDATE" {
+		t.Fatalf("unexpected revert %+v", revert.Changes)
+	}
+	if linked.Changes[0].NewValues[0] != revert.Changes[0].NewValues[0] {
+		t.Errorf("the revert links %v, want %v", revert.Changes[0].NewValues, linked.Changes[0].NewValues)
+	}
+	update := linked.Changes[1]
+	if got := revert.Changes[1]; got.NewValues[1] != update.OldValues[1] || got.OldValues[1] != update.NewValues[1] {
+		t.Errorf("the revert sets %v over %v, want %v over %v", got.NewValues, got.OldValues, update.OldValues, update.NewValues)
+	}
+	var stockLeft, ordered int
+	if err := stockDB.QueryRowContext(ctx, "SELECT stock FROM items WHERE id = 42").Scan(&stockLeft); err != nil {
+		t.Fatal(err)
+	}
+	if err := ordersDB.QueryRowContext(ctx, "SELECT count(*) FROM orders").Scan(&ordered); err != nil {
+		t.Fatal(err)
+	}
+	if stockLeft != 10 || ordered != 0 {
+		t.Errorf("stock %d and %d orders after the rollback, want 10 and none", stockLeft, ordered)
+	}
+
+	orders.failing.Store(false)
+	published = len(stock.messages)
+	if _, err := sqlite.AttachedTransaction(ctx, "xorders.db", []string{"xstock.db"}, queries); err != nil {
+		t.Fatal(err)
+	}
+	if len(stock.messages) != published+1 {
+		t.Errorf("published %d changesets to xstock.db, want 1", len(stock.messages)-published)
+	}
+}
@@ -1,9 +1,11 @@
 package sqlite
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -13,8 +15,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/go-mysql-org/go-mysql/driver"
@@ -27,11 +31,21 @@ import (
 	"github.com/nats-io/nats.go/jetstream"
 	_ "github.com/sijms/go-ora/v2"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/litesql/ha/internal/tracing"
 )
 
 type connectorDB struct {
 	db        *sql.DB
 	connector *ha.Connector
+	outbox    string
+	publisher *lazyPublisher
+	readOnly  *atomic.Bool
+	stream    string
+	subject   string
+	dsn       string
+	cfg       LoadConfig
 }
 
 type stoppableSubscription interface {
@@ -47,20 +61,57 @@ var (
 	dbs                 = make(map[string]*connectorDB)
 	proxiedSubscription = make(map[string]stoppableSubscription)
 	muDBs               sync.Mutex
+	// defaultID is the id of the database addressed by the empty id, the
+	// first one loaded unless changed by SetDefaultDatabase. It is written
+	// under muDBs and read without it, see DefaultDatabase.
+	defaultID atomic.Pointer[string]
+)
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyAdded  = errors.New("already added")
+	ErrDropDefaultDB = errors.New("the default database cannot be dropped")
 )
 
+// ErrStreamConflict is returned when the stream template names the stream of
+// a database like the stream of another one, their ids only differing by the
+// characters replaced or the extension.
+var ErrStreamConflict = errors.New("replication stream of another database")
+
 var reDateTime = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}`)
 
+var reInvalidStreamChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
 type LoadConfig struct {
 	Dir                string
 	MemDB              bool
 	FromLatestSnapshot bool
 	DeliverPolicy      string
 	MaxConns           int
+	Stream             string
+	StreamTemplate     string
+	Publisher          PublisherFactory
+	SnapshotSource     SnapshotSource
+	OutboxDir          string
 	ProxiedDBConfig    ProxiedDBConfig
 	Options            []ha.Option
+	// ResumePosition starts the durable consumers created again after the
+	// position of the previous run.
+	ResumePosition ResumePosition
+
+	// snapshot is loaded instead of the latest one by Resync
+	snapshot *loadedSnapshot
 }
 
+type loadedSnapshot struct {
+	sequence uint64
+	reader   io.ReadCloser
+}
+
+// SnapshotSource returns the latest snapshot of the database id from an
+// external storage, or a nil reader if there is none.
+type SnapshotSource func(ctx context.Context, id string) (sequence uint64, reader io.ReadCloser, err error)
+
 type ProxiedDBConfig struct {
 	PgDSN             string
 	PgPublicationName string
@@ -88,15 +139,32 @@ type ProxiedDBConfig struct {
 func Load(ctx context.Context, dsn string, cfg LoadConfig) error {
 	muDBs.Lock()
 	defer muDBs.Unlock()
-	defaultDB := false
-	if len(dbs) == 0 {
-		defaultDB = true
-	}
+	return load(ctx, dsn, cfg)
+}
+
+func load(ctx context.Context, dsn string, cfg LoadConfig) error {
+	// the first database loaded is the default one, with the feature flags
+	first := DefaultDatabase() == ""
 	id := IdFromDSN(dsn)
 	if _, exists := dbs[id]; exists {
-		return fmt.Errorf("database with id %q already added", id)
+		return fmt.Errorf("database with id %q %w", id, ErrAlreadyAdded)
+	}
+	baseOptions, stream := replicationOptions(id, cfg)
+	if cfg.StreamTemplate != "" {
+		for otherID, other := range dbs {
+			if other.cfg.StreamTemplate != "" && other.stream == stream {
+				return fmt.Errorf("database with id %q: %w %q: %q", id, ErrStreamConflict, otherID, stream)
+			}
+		}
+		slog.Info("using database replication stream", "id", id, "stream", stream)
+	}
+	options := slices.Clone(baseOptions)
+	readOnly := new(atomic.Bool)
+	var publisher *lazyPublisher
+	if cfg.Publisher != nil {
+		publisher = &lazyPublisher{readOnly: readOnly}
+		options = append(options, ha.WithReplicationPublisher(publisher))
 	}
-	options := slices.Clone(cfg.Options)
 
 	var proxiedPositionProvider baseProxiedPositionTracker
 	if cfg.ProxiedDBConfig.LocalDB == id && !cfg.ProxiedDBConfig.DisableRedirect {
@@ -151,14 +219,27 @@ func Load(ctx context.Context, dsn string, cfg LoadConfig) error {
 	options = append(options, ha.WithWaitFor(waitFor))
 	var connector *ha.Connector
 	if cfg.FromLatestSnapshot {
-		slog.Info("loading latest snapshot from NATS JetStream Object Store", "dsn", dsn)
-		sequence, reader, err := ha.LatestSnapshot(ctx, dsn, cfg.Options...)
-		if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
-			return fmt.Errorf("failed to load latest snapshot: %w", err)
+		var (
+			sequence uint64
+			reader   io.ReadCloser
+			err      error
+		)
+		if cfg.snapshot != nil {
+			sequence, reader = cfg.snapshot.sequence, cfg.snapshot.reader
+		} else {
+			sequence, reader, err = latestSnapshot(ctx, id, dsn, cfg, baseOptions)
+			if err != nil {
+				return fmt.Errorf("failed to load latest snapshot: %w", err)
+			}
+		}
+		if reader != nil {
+			defer reader.Close()
 		}
 
 		if sequence > 0 && cfg.DeliverPolicy == "" {
-			policy := fmt.Sprintf("by_start_sequence=%d", sequence)
+			// the snapshot holds the changeset of its sequence, applying
+			// it again would fail on its DDL
+			policy := fmt.Sprintf("by_start_sequence=%d", sequence+1)
 			options = append(options, ha.WithDeliverPolicy(policy))
 		}
 		if reader != nil {
@@ -173,16 +254,9 @@ func Load(ctx context.Context, dsn string, cfg LoadConfig) error {
 				}
 			} else {
 				filename := filenameFromDSN(dsn)
-				f, err := os.Create(filename)
-				if err != nil {
-					return fmt.Errorf("failed to create snapshot file %q: %w", filename, err)
-				}
-				_, err = io.Copy(f, reader)
-				if err != nil {
-					f.Close()
+				if err := replaceFile(filename, reader); err != nil {
 					return fmt.Errorf("failed to write snapshot file %q: %w", filename, err)
 				}
-				f.Close()
 				slog.Info("loading snapshot", "filename", filename)
 				connector, err = newConnector(dsn, options...)
 				if err != nil {
@@ -191,6 +265,13 @@ func Load(ctx context.Context, dsn string, cfg LoadConfig) error {
 			}
 		}
 	} else {
+		if cfg.ResumePosition != nil && cfg.DeliverPolicy == "" {
+			// a durable consumer still there keeps its own position
+			if policy, ok := resumePolicy(ctx, id, dsn, cfg.MemDB, cfg.ResumePosition); ok {
+				slog.Info("resuming the replication", "id", id, "policy", policy)
+				options = append(options, ha.WithDeliverPolicy(policy))
+			}
+		}
 		if cfg.MemDB {
 			slog.Info("using in-memory database", "dsn", dsn)
 			filename := filenameFromDSN(dsn)
@@ -232,6 +313,13 @@ func Load(ctx context.Context, dsn string, cfg LoadConfig) error {
 		}
 	}
 
+	if publisher != nil {
+		if err := publisher.start(cfg.Publisher, id, stream); err != nil {
+			connector.Close()
+			return fmt.Errorf("failed to start replication publisher: %w", err)
+		}
+	}
+
 	if len(dbs) == 0 {
 		slog.Debug("waiting for the leader...")
 		<-connector.LeaderProvider().Ready()
@@ -316,28 +404,122 @@ func Load(ctx context.Context, dsn string, cfg LoadConfig) error {
 	}
 	close(waitFor)
 
+	flag, err := loadReadOnly(ha.ContextLocalDB(ctx, true), db)
+	if err != nil {
+		return fmt.Errorf("load read-only flag: %w", err)
+	}
+	readOnly.Store(flag)
+	if flag {
+		slog.Warn("database is read-only", "id", id)
+	}
+	if first {
+		if err := loadFlags(ha.ContextLocalDB(ctx, true), id, db); err != nil {
+			return fmt.Errorf("load feature flags: %w", err)
+		}
+	}
+
 	connDB := &connectorDB{
 		db:        db,
 		connector: connector,
+		publisher: publisher,
+		readOnly:  readOnly,
+		stream:    stream,
+		subject:   NatsSubject(stream, id),
+		dsn:       dsn,
+		cfg:       cfg,
+	}
+	connDB.cfg.snapshot = nil
+	if cfg.OutboxDir != "" {
+		connDB.outbox = OutboxFile(cfg.OutboxDir, id)
 	}
 	dbs[id] = connDB
-	if defaultDB {
-		dbs[""] = connDB
+	connectors.Store(id, connector)
+	if first {
+		defaultID.Store(&id)
 	}
 
 	return nil
 }
 
+// replicationOptions returns the options of the database replication
+// stream, named by the stream template.
+func replicationOptions(id string, cfg LoadConfig) ([]ha.Option, string) {
+	options := slices.Clone(cfg.Options)
+	stream := cfg.Stream
+	if cfg.StreamTemplate != "" {
+		stream = StreamName(cfg.StreamTemplate, id)
+		options = append(options, ha.WithReplicationStream(stream))
+	}
+	return options, stream
+}
+
+// latestSnapshot returns the latest snapshot from the external storage, or
+// from the JetStream object store. The reader is nil if there is none.
+func latestSnapshot(ctx context.Context, id, dsn string, cfg LoadConfig, options []ha.Option) (sequence uint64, reader io.ReadCloser, err error) {
+	ctx, span := tracing.Start(ctx, "snapshot restore", attribute.String("ha.database", id))
+	defer func() {
+		span.SetAttributes(attribute.Int64("ha.snapshot_seq", int64(sequence)))
+		tracing.End(span, err)
+	}()
+	if cfg.SnapshotSource != nil {
+		slog.Info("loading latest snapshot from external storage", "dsn", dsn)
+		sequence, reader, err := cfg.SnapshotSource(ctx, id)
+		if err != nil || reader != nil {
+			return sequence, reader, err
+		}
+	}
+	slog.Info("loading latest snapshot from NATS JetStream Object Store", "dsn", dsn)
+	sequence, reader, err = ha.LatestSnapshot(ctx, dsn, options...)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return 0, nil, nil
+	}
+	return sequence, reader, err
+}
+
 type Request struct {
-	Sql    string         `json:"sql"`
-	Params map[string]any `json:"params"`
+	Sql       string         `json:"sql"`
+	Params    map[string]any `json:"params"`
+	TimeoutMs int64          `json:"timeout_ms,omitempty"`
+	// Limit, Offset and Cursor return a page of the rows of a SELECT, see
+	// Paginate.
+	Limit  *int   `json:"limit,omitempty"`
+	Offset int    `json:"offset,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// UnmarshalJSON binds the positional args array to the ? placeholders in
+// order, as the $1..$N params.
+func (r *Request) UnmarshalJSON(b []byte) error {
+	type request Request
+	var req struct {
+		request
+		Args []any `json:"args"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if len(req.Args) > 0 {
+		if len(req.Params) > 0 {
+			return errors.New("use either params or args, not both")
+		}
+		req.Params = make(map[string]any, len(req.Args))
+		for i, arg := range req.Args {
+			req.Params["$"+strconv.Itoa(i+1)] = arg
+		}
+	}
+	*r = Request(req.request)
+	return nil
 }
 
 type Response struct {
-	Columns      []string `json:"columns"`
-	Rows         [][]any  `json:"rows"`
-	RowsAffected int64    `json:"-"`
-	NoReturning  bool     `json:"-"`
+	Columns      []string      `json:"columns"`
+	Rows         [][]any       `json:"rows"`
+	Types        []string      `json:"types,omitempty"`
+	Meta         []ColumnMeta  `json:"meta,omitempty"`
+	Warnings     []LintWarning `json:"warnings,omitempty"`
+	NextCursor   string        `json:"next_cursor,omitempty"`
+	RowsAffected int64         `json:"-"`
+	NoReturning  bool          `json:"-"`
 }
 
 type execerQuerier interface {
@@ -345,62 +527,159 @@ type execerQuerier interface {
 	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
 }
 
-func Exec(ctx context.Context, eq execerQuerier, sql string, params map[string]any) (*Response, error) {
+// queryTimeout is changed by the reload of the configuration while the
+// statements run.
+var queryTimeout atomic.Int64
+
+// SetQueryTimeout sets the default timeout for statements executed without a
+// deadline.
+func SetQueryTimeout(timeout time.Duration) {
+	queryTimeout.Store(int64(timeout))
+}
+
+// QueryContext bounds the statement execution by the timeout, or by the
+// default query timeout when zero.
+func QueryContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = time.Duration(queryTimeout.Load())
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func Exec(ctx context.Context, eq execerQuerier, sql string, params map[string]any) (res *Response, err error) {
 	slog.Debug("Executing statement", "sql", sql, "params", params)
-	upper := strings.ToUpper(strings.TrimSpace(sql))
-	if strings.HasPrefix(upper, "SELECT") || strings.HasPrefix(upper, "EXPLAIN") {
+	ctx, span := tracing.Start(ctx, "sqlite exec",
+		attribute.String("db.system.name", "sqlite"),
+		attribute.String("db.query.text", sql),
+	)
+	defer func() { tracing.End(span, err) }()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = QueryContext(ctx, 0)
+		defer cancel()
+	}
+	if err := checkStatementParameters(ctx, sql, params); err != nil {
+		return nil, err
+	}
+	if IsQuery(sql) {
 		return doQuery(ctx, eq, sql, params)
 	}
 
-	return doExec(ctx, eq, sql, params)
+	return execWithIdentity(ctx, eq, sql, params)
 }
 
 func Databases() []string {
-	var list []string
+	muDBs.Lock()
+	defer muDBs.Unlock()
+	list := make([]string, 0, len(dbs))
 	for id := range dbs {
-		if id == "" {
-			continue
-		}
 		list = append(list, id)
 	}
 	return list
 }
 
+// DefaultDatabase returns the id of the default database.
+func DefaultDatabase() string {
+	if id := defaultID.Load(); id != nil {
+		return *id
+	}
+	return ""
+}
+
+// SetDefaultDatabase makes the database id the one addressed by the empty id.
+func SetDefaultDatabase(id string) error {
+	muDBs.Lock()
+	defer muDBs.Unlock()
+	if _, ok := dbs[id]; !ok || id == "" {
+		return fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	if from := DefaultDatabase(); id != from {
+		slog.Info("default database changed", "from", from, "to", id)
+		defaultID.Store(&id)
+	}
+	return nil
+}
+
+// lookup returns the database id, the default database for the empty id.
+func lookup(id string) (*connectorDB, bool) {
+	connDB, ok := dbs[cmp.Or(id, DefaultDatabase())]
+	return connDB, ok
+}
+
 func DB(id string) (*sql.DB, error) {
-	dbConnector, ok := dbs[id]
+	dbConnector, ok := lookup(id)
 	if !ok {
-		return nil, fmt.Errorf("database with id %q not found", id)
+		return nil, fmt.Errorf("database with id %q %w", id, ErrNotFound)
 	}
 	return dbConnector.db, nil
 }
 
 func Connector(id string) (*ha.Connector, error) {
-	dbConnector, ok := dbs[id]
+	dbConnector, ok := lookup(id)
 	if !ok {
-		return nil, fmt.Errorf("database with id %q not found", id)
+		return nil, fmt.Errorf("database with id %q %w", id, ErrNotFound)
 	}
 	return dbConnector.connector, nil
 }
 
+// TakeSnapshot stores a snapshot of the database in the JetStream object
+// store and returns its sequence.
+func TakeSnapshot(ctx context.Context, id string) (sequence uint64, err error) {
+	ctx, span := tracing.Start(ctx, "snapshot take", attribute.String("ha.database", cmp.Or(id, DefaultDatabase())))
+	defer func() {
+		span.SetAttributes(attribute.Int64("ha.snapshot_seq", int64(sequence)))
+		tracing.End(span, err)
+	}()
+	connector, err := Connector(id)
+	if err != nil {
+		return 0, err
+	}
+	return connector.TakeSnapshot(ctx)
+}
+
+// ReplicationSubject returns the JetStream stream and the subject where the
+// changesets of the database are published.
+func ReplicationSubject(id string) (stream, subject string, err error) {
+	muDBs.Lock()
+	defer muDBs.Unlock()
+	connDB, ok := lookup(id)
+	if !ok {
+		return "", "", fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	return connDB.stream, connDB.subject, nil
+}
+
 func Transaction(ctx context.Context, db *sql.DB, queries []Request) ([]*Response, error) {
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{
-		Isolation: sql.LevelReadCommitted,
-		ReadOnly:  false,
-	})
+	tx, err := BeginTx(ctx, db, beginModeOf(ctx))
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
 	var list []*Response
+	var statements []ha.Change
+	replicable := statementReplication()
 	for _, query := range queries {
-		res, err := Exec(ctx, tx, query.Sql, query.Params)
+		queryCtx, cancel := QueryContext(ctx, time.Duration(query.TimeoutMs)*time.Millisecond)
+		res, err := Exec(queryCtx, tx, query.Sql, query.Params)
+		cancel()
 		if err != nil {
 			return nil, err
 		}
 		list = append(list, res)
+		if replicable && !IsQuery(query.Sql) {
+			stmt, ok := statementChange(ctx, tx, query.Sql, query.Params)
+			replicable = ok
+			statements = append(statements, stmt)
+		}
 	}
-	if err := tx.Commit(); err != nil {
+	if !replicable {
+		statements = nil
+	}
+	if err := CommitError(withStatements(ctx, db, statements, tx.Commit)); err != nil {
 		return nil, err
 	}
 	return list, nil
@@ -409,9 +688,12 @@ func Transaction(ctx context.Context, db *sql.DB, queries []Request) ([]*Respons
 func Drop(ctx context.Context, id string) (string, error) {
 	muDBs.Lock()
 	defer muDBs.Unlock()
+	if id == "" || id == DefaultDatabase() {
+		return "", ErrDropDefaultDB
+	}
 	dbConnector, ok := dbs[id]
 	if !ok {
-		return "", fmt.Errorf("database with id %q not found", id)
+		return "", fmt.Errorf("database with id %q %w", id, ErrNotFound)
 	}
 	var filename string
 	err := dbConnector.db.QueryRowContext(ctx, "SELECT file FROM pragma_database_list WHERE name = ?", "main").Scan(&filename)
@@ -424,6 +706,7 @@ func Drop(ctx context.Context, id string) (string, error) {
 	}
 	dbConnector.connector.Close()
 	delete(dbs, id)
+	connectors.Delete(id)
 	return filename, nil
 }
 
@@ -470,7 +753,8 @@ type querier interface {
 
 func doQuery(ctx context.Context, querier querier, query string, args map[string]any) (*Response, error) {
 	slog.Warn("Query", "q", querier, "query", query, "ctx", ctx)
-	rows, err := querier.QueryContext(ctx, query, getArgs(args)...)
+	queryArgs := getArgs(args)
+	rows, err := querier.QueryContext(ctx, query, queryArgs...)
 	if err != nil {
 		return nil, err
 	}
@@ -480,6 +764,13 @@ func doQuery(ctx context.Context, querier querier, query string, args map[string
 	if err != nil {
 		return nil, err
 	}
+	var columnTypes []*sql.ColumnType
+	if columnMetaEnabled(ctx) || typedValuesEnabled(ctx) {
+		columnTypes, err = rows.ColumnTypes()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	columnsCount := len(columns)
 	if columnsCount == 0 {
@@ -500,11 +791,25 @@ func doQuery(ctx context.Context, querier querier, query string, args map[string
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	rows.Close()
+
+	var meta []ColumnMeta
+	if columnMetaEnabled(ctx) {
+		meta, err = queryColumnMeta(ctx, querier, query, queryArgs, columnTypes)
+		if err != nil {
+			return nil, fmt.Errorf("column metadata: %w", err)
+		}
+	}
 
-	return &Response{
+	res := &Response{
 		Columns: columns,
 		Rows:    dataRows,
-	}, nil
+		Meta:    meta,
+	}
+	if typedValuesEnabled(ctx) {
+		typeValues(res, columnTypes)
+	}
+	return res, nil
 }
 
 type execer interface {
@@ -515,16 +820,20 @@ func doExec(ctx context.Context, execer execer, query string, params map[string]
 	args := getArgs(params)
 	res, err := execer.ExecContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, CommitError(err)
 	}
 	rowsAffected, _ := res.RowsAffected()
 	lastInsertID, _ := res.LastInsertId()
 
-	return &Response{
+	response := &Response{
 		Columns:      []string{"rows_affected", "last_insert_id"},
 		Rows:         [][]any{{rowsAffected, lastInsertID}},
 		RowsAffected: rowsAffected,
-		NoReturning:  true}, nil
+		NoReturning:  true}
+	if typedValuesEnabled(ctx) {
+		typeValues(response, nil)
+	}
+	return response, nil
 }
 
 func getArgs(params map[string]any) []any {
@@ -580,6 +889,14 @@ func filenameFromDSN(dsn string) string {
 	return filename
 }
 
+// StreamName resolves the replication stream of a database from the template,
+// replacing {db} by the database id without extension.
+func StreamName(template, id string) string {
+	name := strings.TrimSuffix(id, filepath.Ext(id))
+	name = reInvalidStreamChars.ReplaceAllString(name, "_")
+	return strings.ReplaceAll(template, "{db}", name)
+}
+
 func IdFromDSN(dsn string) string {
 	var filename string
 	u, err := url.Parse(dsn)
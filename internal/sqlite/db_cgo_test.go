@@ -0,0 +1,34 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// TestLoadStreamConflict refuses to load a database whose stream name is the
+// stream of another database, their ids only differing by the characters the
+// template replaces.
+func TestLoadStreamConflict(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := sqlite.LoadConfig{MaxConns: 1, StreamTemplate: "ha_{db}"}
+	if err := sqlite.Load(ctx, "file:"+filepath.Join(dir, "stream.conflict.db"), cfg); err != nil {
+		t.Fatal(err)
+	}
+	err := sqlite.Load(ctx, "file:"+filepath.Join(dir, "stream_conflict.db"), cfg)
+	if !errors.Is(err, sqlite.ErrStreamConflict) {
+		t.Fatalf("got %v, want ErrStreamConflict", err)
+	}
+	if _, err := sqlite.DB("stream_conflict.db"); !errors.Is(err, sqlite.ErrNotFound) {
+		t.Errorf("the conflicting database was loaded: %v", err)
+	}
+	if err := sqlite.Load(ctx, "file:"+filepath.Join(dir, "stream_other.db"), cfg); err != nil {
+		t.Errorf("database with another stream: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package sqlite_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestStreamName(t *testing.T) {
+	tests := []struct {
+		template string
+		id       string
+		want     string
+	}{
+		{template: "ha_{db}", id: "ha.db", want: "ha_ha"},
+		{template: "ha_{db}", id: "orders.sqlite", want: "ha_orders"},
+		{template: "{db}_replication", id: "my db.v2.db", want: "my_db_v2_replication"},
+		{template: "ha_{db}", id: "users", want: "ha_users"},
+	}
+	for _, tt := range tests {
+		if got := sqlite.StreamName(tt.template, tt.id); got != tt.want {
+			t.Errorf("StreamName(%q, %q) = %q, want %q", tt.template, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestCheckParameters(t *testing.T) {
+	tests := []struct {
+		names   []string
+		params  map[string]any
+		missing bool
+	}{
+		{names: []string{":name"}, params: map[string]any{"name": nil}},
+		{names: []string{":name"}, params: map[string]any{":name": "x"}},
+		{names: []string{"@name", "$other"}, params: map[string]any{"name": 1, "other": ""}},
+		{names: []string{"$1", "$2"}, params: map[string]any{"$1": 1, "$2": nil}},
+		{names: []string{"?", "?2"}, params: nil},
+		{names: []string{":name"}, params: nil, missing: true},
+		{names: []string{":name", ":other"}, params: map[string]any{"name": 1}, missing: true},
+		{names: []string{"$1", "$2"}, params: map[string]any{"$1": 1}, missing: true},
+	}
+	for _, tt := range tests {
+		err := sqlite.CheckParameters(tt.names, tt.params)
+		if got := errors.Is(err, sqlite.ErrMissingParameter); got != tt.missing {
+			t.Errorf("CheckParameters(%v, %v) = %v, want missing %v", tt.names, tt.params, err, tt.missing)
+		}
+	}
+}
+
+func TestRequestArgs(t *testing.T) {
+	var req sqlite.Request
+	if err := json.Unmarshal([]byte(`{"sql": "SELECT ?, ?", "args": ["a", null]}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Params) != 2 || req.Params["$1"] != "a" || req.Params["$2"] != nil {
+		t.Errorf("Params = %v, want the args as $1 and $2", req.Params)
+	}
+	if _, ok := req.Params["$2"]; !ok {
+		t.Error("a null arg must be bound as NULL")
+	}
+	err := json.Unmarshal([]byte(`{"sql": "SELECT :a, ?", "params": {"a": 1}, "args": [2]}`), &req)
+	if err == nil {
+		t.Error("params and args together should fail")
+	}
+}
+
+func TestParseBeginMode(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    sqlite.BeginMode
+		invalid bool
+	}{
+		{s: "", want: sqlite.BeginDeferred},
+		{s: "deferred", want: sqlite.BeginDeferred},
+		{s: "IMMEDIATE", want: sqlite.BeginImmediate},
+		{s: " Exclusive ", want: sqlite.BeginExclusive},
+		{s: "serializable", invalid: true},
+	}
+	for _, tt := range tests {
+		got, err := sqlite.ParseBeginMode(tt.s)
+		if (err != nil) != tt.invalid || got != tt.want {
+			t.Errorf("ParseBeginMode(%q) = %q, %v, want %q", tt.s, got, err, tt.want)
+		}
+	}
+}
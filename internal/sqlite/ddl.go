@@ -0,0 +1,183 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+var ErrNotDDL = errors.New("only CREATE, ALTER and DROP statements are allowed")
+
+// ApplyDDL executes the statements of the DDL script in a single transaction.
+// The transaction is published as one changeset, so the replicas apply the
+// whole schema change in order, or nothing of it. It returns the number of
+// statements executed.
+func ApplyDDL(ctx context.Context, id, script string) (int, error) {
+	db, err := DB(id)
+	if err != nil {
+		return 0, err
+	}
+	statements := SplitStatements(script)
+	if len(statements) == 0 {
+		return 0, fmt.Errorf("%w: the script has no statement", ErrNotDDL)
+	}
+	for i, stmt := range statements {
+		switch firstWord(stmt) {
+		case "CREATE", "ALTER", "DROP":
+		default:
+			return 0, fmt.Errorf("statement %d: %w", i+1, ErrNotDDL)
+		}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// the tables rebuilt by the script are checked at the commit
+	if _, err := tx.ExecContext(ctx, "PRAGMA defer_foreign_keys = 1"); err != nil {
+		return 0, err
+	}
+	for i, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return 0, fmt.Errorf("statement %d: %w", i+1, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	slog.Info("DDL script applied", "id", id, "statements", len(statements))
+	return len(statements), nil
+}
+
+// SplitStatements splits the SQL script into its statements, without the
+// trailing semicolons. The semicolons of the strings, the quoted identifiers,
+// the comments and the bodies of the triggers don't end a statement.
+func SplitStatements(script string) []string {
+	var (
+		statements []string
+		start      int
+		words      []string
+		// caseDepth counts the CASE expressions not ended in a trigger body,
+		// bodyEnd is set by the END of the body
+		caseDepth int
+		bodyEnd   bool
+	)
+	add := func(end int) {
+		if stmt := strings.TrimSpace(script[start:end]); stmt != "" && len(words) > 0 {
+			statements = append(statements, stmt)
+		}
+		start = end + 1
+		words = words[:0]
+		caseDepth = 0
+		bodyEnd = false
+	}
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			i = closing(script, i+1, c)
+		case c == '[':
+			i = closing(script, i+1, ']')
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			if end := strings.IndexByte(script[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(script)
+			}
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			if end := strings.Index(script[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(script)
+			}
+		case isWordChar(c):
+			j := i
+			for j < len(script) && isWordChar(script[j]) {
+				j++
+			}
+			word := strings.ToUpper(script[i:j])
+			words = append(words, word)
+			bodyEnd = false
+			if inTriggerBody(words) {
+				switch {
+				case word == "CASE":
+					caseDepth++
+				case word == "END" && caseDepth > 0:
+					caseDepth--
+				case word == "END":
+					bodyEnd = true
+				}
+			}
+			i = j - 1
+		case c == ';':
+			// the statements of a trigger body end with the END of the body
+			if inTriggerBody(words) && !bodyEnd {
+				continue
+			}
+			add(i)
+		}
+	}
+	add(len(script))
+	return statements
+}
+
+// inTriggerBody reports whether the words are of a CREATE TRIGGER statement
+// after its BEGIN.
+func inTriggerBody(words []string) bool {
+	if len(words) < 2 || words[0] != "CREATE" {
+		return false
+	}
+	trigger := words[1] == "TRIGGER" ||
+		len(words) > 2 && (words[1] == "TEMP" || words[1] == "TEMPORARY") && words[2] == "TRIGGER"
+	if !trigger {
+		return false
+	}
+	for _, word := range words {
+		if word == "BEGIN" {
+			return true
+		}
+	}
+	return false
+}
+
+// closing returns the index of the quote closing the quoted text starting at
+// i, a doubled quote is escaped.
+func closing(script string, i int, quote byte) int {
+	for ; i < len(script); i++ {
+		if script[i] != quote {
+			continue
+		}
+		if quote != ']' && i+1 < len(script) && script[i+1] == quote {
+			i++
+			continue
+		}
+		return i
+	}
+	return len(script)
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// firstWord returns the first keyword of the statement in upper case, after
+// the comments.
+func firstWord(stmt string) string {
+	for {
+		stmt = strings.TrimSpace(stmt)
+		switch {
+		case strings.HasPrefix(stmt, "--"):
+			_, stmt, _ = strings.Cut(stmt, "\n")
+		case strings.HasPrefix(stmt, "/*"):
+			_, stmt, _ = strings.Cut(stmt, "*/")
+		default:
+			end := 0
+			for end < len(stmt) && isWordChar(stmt[end]) {
+				end++
+			}
+			return strings.ToUpper(stmt[:end])
+		}
+	}
+}
@@ -0,0 +1,66 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestApplyDDL(t *testing.T) {
+	ctx := context.Background()
+	if err := sqlite.Load(ctx, "file:"+filepath.Join(t.TempDir(), "ddl.db"), sqlite.LoadConfig{MaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB("ddl.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := func() []string {
+		rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_schema WHERE type = 'table' AND name NOT GLOB 'sqlite_*' AND name NOT GLOB 'ha_*' ORDER BY name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+
+	if _, err := sqlite.ApplyDDL(ctx, "ddl.db", "CREATE TABLE a(x); INSERT INTO a VALUES(1)"); !errors.Is(err, sqlite.ErrNotDDL) {
+		t.Fatalf("got error %v, want ErrNotDDL", err)
+	}
+	if _, err := sqlite.ApplyDDL(ctx, "ddl.db", "CREATE TABLE a(x); ALTER TABLE missing ADD COLUMN y"); err == nil {
+		t.Fatal("expected the failure of the second statement")
+	}
+	if got := tables(); len(got) != 0 {
+		t.Fatalf("a failed script left the tables %v", got)
+	}
+
+	n, err := sqlite.ApplyDDL(ctx, "ddl.db", `CREATE TABLE users(id INTEGER PRIMARY KEY);
+CREATE TABLE orders(id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id));
+ALTER TABLE users ADD COLUMN name TEXT;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("applied %d statements, want 3", n)
+	}
+	if got, want := tables(), []string{"orders", "users"}; !slices.Equal(got, want) {
+		t.Fatalf("tables %v, want %v", got, want)
+	}
+}
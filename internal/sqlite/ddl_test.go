@@ -0,0 +1,61 @@
+package sqlite_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "statements",
+			script: "CREATE TABLE a(id INTEGER);\nALTER TABLE a ADD COLUMN b TEXT;\n",
+			want:   []string{"CREATE TABLE a(id INTEGER)", "ALTER TABLE a ADD COLUMN b TEXT"},
+		},
+		{
+			name:   "last statement without semicolon",
+			script: "DROP TABLE a; DROP TABLE b",
+			want:   []string{"DROP TABLE a", "DROP TABLE b"},
+		},
+		{
+			name:   "quoted semicolons",
+			script: `CREATE TABLE "a;b"(c TEXT DEFAULT 'x;''y', [d;e] INTEGER); DROP TABLE c`,
+			want:   []string{`CREATE TABLE "a;b"(c TEXT DEFAULT 'x;''y', [d;e] INTEGER)`, "DROP TABLE c"},
+		},
+		{
+			name:   "comments",
+			script: "-- the users; table\nCREATE TABLE users(id INTEGER); /* done; */ -- end",
+			want:   []string{"-- the users; table\nCREATE TABLE users(id INTEGER)"},
+		},
+		{
+			name: "trigger",
+			script: `CREATE TRIGGER t AFTER INSERT ON a BEGIN
+  UPDATE b SET n = CASE WHEN n > 0 THEN n + 1 ELSE 1 END;
+  DELETE FROM c;
+END;
+CREATE INDEX i ON a(id);`,
+			want: []string{`CREATE TRIGGER t AFTER INSERT ON a BEGIN
+  UPDATE b SET n = CASE WHEN n > 0 THEN n + 1 ELSE 1 END;
+  DELETE FROM c;
+END`, "CREATE INDEX i ON a(id)"},
+		},
+		{
+			name:   "empty",
+			script: " ;\n; -- nothing",
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sqlite.SplitStatements(tt.script); !slices.Equal(got, tt.want) {
+				t.Errorf("SplitStatements() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
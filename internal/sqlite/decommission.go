@@ -0,0 +1,89 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrDecommissioning is returned when the writes of the node were already
+// stopped to decommission it.
+var ErrDecommissioning = errors.New("node is decommissioning")
+
+// writesStopped rejects the writes of every database on this node only,
+// unlike SetReadOnly the flag is not replicated.
+var writesStopped atomic.Bool
+
+// StopWrites makes every database read-only on this node, the other nodes
+// keep accepting writes.
+func StopWrites() error {
+	if !writesStopped.CompareAndSwap(false, true) {
+		return ErrDecommissioning
+	}
+	return nil
+}
+
+// ResumeWrites undoes StopWrites.
+func ResumeWrites() {
+	writesStopped.Store(false)
+}
+
+// WaitOutboxes waits for the async replication outboxes to be published.
+func WaitOutboxes(ctx context.Context) error {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var pending int64
+		muDBs.Lock()
+		list := make(map[string]*connectorDB, len(dbs))
+		for id, connDB := range dbs {
+			if connDB.outbox != "" {
+				list[id] = connDB
+			}
+		}
+		muDBs.Unlock()
+		for id, connDB := range list {
+			depth, err := outboxDepth(ctx, connDB)
+			if err != nil {
+				return fmt.Errorf("%s: outbox depth: %w", id, err)
+			}
+			pending += depth
+		}
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d changesets still in the outbox: %w", pending, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// RemoveConsumers deletes the durable consumers this node applies the
+// replicated changes from. The subscribers stop receiving, so it is only
+// called before shutting down a decommissioned node.
+func RemoveConsumers(ctx context.Context) error {
+	muDBs.Lock()
+	list := make(map[string]*connectorDB, len(dbs))
+	for id, connDB := range dbs {
+		list[id] = connDB
+	}
+	muDBs.Unlock()
+	var errs []error
+	for id, connDB := range list {
+		name := ConsumerName(id, connDB.connector.NodeName())
+		err := connDB.connector.RemoveConsumer(ctx, name)
+		if err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+			errs = append(errs, fmt.Errorf("%s: remove consumer %q: %w", id, name, err))
+			continue
+		}
+		slog.Info("replication consumer removed", "id", id, "consumer", name)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,379 @@
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+)
+
+const flagsTableName = "ha_flags"
+
+var ErrInvalidFlag = errors.New("invalid feature flag")
+
+const createFlagsTable = `CREATE TABLE IF NOT EXISTS ` + flagsTableName + `(
+	name TEXT PRIMARY KEY,
+	enabled INTEGER NOT NULL DEFAULT 0,
+	rollout INTEGER NOT NULL DEFAULT 100 CHECK (rollout BETWEEN 0 AND 100),
+	value TEXT,
+	description TEXT,
+	updated_at TEXT
+)`
+
+// Flag is a feature flag of the ha_flags table in the default database.
+// Rollout is the percentage of subjects the flag is enabled for and Value an
+// optional JSON payload.
+type Flag struct {
+	Name        string          `json:"name"`
+	Enabled     bool            `json:"enabled"`
+	Rollout     int             `json:"rollout"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	Description string          `json:"description,omitempty"`
+	UpdatedAt   string          `json:"updated_at,omitempty"`
+}
+
+// flags mirrors the table in memory, so the SQL functions never query the
+// database. It is updated from the published and applied changesets.
+var flags = struct {
+	sync.RWMutex
+	db      string
+	values  map[string]Flag
+	version uint64
+	changed chan struct{}
+}{
+	values:  make(map[string]Flag),
+	changed: make(chan struct{}),
+}
+
+// Flags returns the feature flags ordered by name and the version of the
+// list, incremented on every change.
+func Flags() ([]Flag, uint64) {
+	flags.RLock()
+	defer flags.RUnlock()
+	list := make([]Flag, 0, len(flags.values))
+	for _, flag := range flags.values {
+		list = append(list, flag)
+	}
+	slices.SortFunc(list, func(a, b Flag) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return list, flags.version
+}
+
+// WaitFlags blocks until the flags version differs from version or the
+// context is done, and returns the current version.
+func WaitFlags(ctx context.Context, version uint64) uint64 {
+	for {
+		flags.RLock()
+		current, changed := flags.version, flags.changed
+		flags.RUnlock()
+		if current != version {
+			return current
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return current
+		}
+	}
+}
+
+// FlagEnabled reports whether the flag is enabled for the subject. Without a
+// subject only the flags rolled out to everyone are enabled, otherwise the
+// subject is hashed into one of 100 buckets, stable across nodes.
+func FlagEnabled(name, subject string) bool {
+	flags.RLock()
+	flag, ok := flags.values[name]
+	flags.RUnlock()
+	if !ok || !flag.Enabled {
+		return false
+	}
+	if flag.Rollout >= 100 {
+		return true
+	}
+	if subject == "" {
+		return false
+	}
+	return flagBucket(name, subject) < flag.Rollout
+}
+
+func flagBucket(name, subject string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(subject))
+	return int(h.Sum32() % 100)
+}
+
+// FlagValue returns the payload of the flag when it is enabled.
+func FlagValue(name string) (json.RawMessage, bool) {
+	flags.RLock()
+	defer flags.RUnlock()
+	flag, ok := flags.values[name]
+	if !ok || !flag.Enabled || flag.Value == nil {
+		return nil, false
+	}
+	return flag.Value, true
+}
+
+// SetFlag creates or replaces the flag in the default database.
+func SetFlag(ctx context.Context, flag Flag) (Flag, error) {
+	if flag.Name == "" {
+		return Flag{}, fmt.Errorf("flag name %w", ErrMissingParameter)
+	}
+	if flag.Rollout < 0 || flag.Rollout > 100 {
+		return Flag{}, fmt.Errorf("%w: rollout must be between 0 and 100", ErrInvalidFlag)
+	}
+	if flag.Value != nil && !json.Valid(flag.Value) {
+		return Flag{}, fmt.Errorf("%w: value is not valid JSON", ErrInvalidFlag)
+	}
+	db, err := DB("")
+	if err != nil {
+		return Flag{}, err
+	}
+	// written and published by this node like SetReadOnly
+	ctx = ha.ContextLocalDB(ctx, true)
+	if _, err := db.ExecContext(ctx, createFlagsTable); err != nil {
+		return Flag{}, fmt.Errorf("create flags table: %w", err)
+	}
+	flag.UpdatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	var value any
+	if flag.Value != nil {
+		value = string(flag.Value)
+	}
+	res, err := db.ExecContext(ctx, "UPDATE "+flagsTableName+" SET enabled = ?, rollout = ?, value = ?, description = ?, updated_at = ? WHERE name = ?",
+		flag.Enabled, flag.Rollout, value, flag.Description, flag.UpdatedAt, flag.Name)
+	if err != nil {
+		return Flag{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = db.ExecContext(ctx, "INSERT INTO "+flagsTableName+"(name, enabled, rollout, value, description, updated_at) VALUES(?, ?, ?, ?, ?, ?)",
+			flag.Name, flag.Enabled, flag.Rollout, value, flag.Description, flag.UpdatedAt)
+		if err != nil {
+			return Flag{}, err
+		}
+	}
+	storeFlag(flag)
+	return flag, nil
+}
+
+// DeleteFlag removes the flag from the default database.
+func DeleteFlag(ctx context.Context, name string) error {
+	db, err := DB("")
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ha.ContextLocalDB(ctx, true), "DELETE FROM "+flagsTableName+" WHERE name = ?", name)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return fmt.Errorf("flag %q %w", name, ErrNotFound)
+		}
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("flag %q %w", name, ErrNotFound)
+	}
+	removeFlag(name)
+	return nil
+}
+
+func storeFlag(flag Flag) {
+	flags.Lock()
+	defer flags.Unlock()
+	if current, ok := flags.values[flag.Name]; ok && flagEqual(current, flag) {
+		return
+	}
+	flags.values[flag.Name] = flag
+	flagsChanged()
+}
+
+func removeFlag(name string) {
+	flags.Lock()
+	defer flags.Unlock()
+	if _, ok := flags.values[name]; !ok {
+		return
+	}
+	delete(flags.values, name)
+	flagsChanged()
+}
+
+func flagEqual(a, b Flag) bool {
+	return a.Name == b.Name && a.Enabled == b.Enabled && a.Rollout == b.Rollout && string(a.Value) == string(b.Value) &&
+		a.Description == b.Description && a.UpdatedAt == b.UpdatedAt
+}
+
+// flagsChanged must be called with the lock held.
+func flagsChanged() {
+	flags.version++
+	close(flags.changed)
+	flags.changed = make(chan struct{})
+}
+
+// loadFlags fills the cache from the database, the first loaded database is
+// the default one holding the flags.
+func loadFlags(ctx context.Context, id string, querier querier) error {
+	rows, err := querier.QueryContext(ctx, "SELECT name, enabled, rollout, value, description, updated_at FROM "+flagsTableName)
+	if err != nil && !strings.Contains(err.Error(), "no such table") {
+		return err
+	}
+	values := make(map[string]Flag)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				flag                          Flag
+				value, description, updatedAt sql.NullString
+			)
+			if err := rows.Scan(&flag.Name, &flag.Enabled, &flag.Rollout, &value, &description, &updatedAt); err != nil {
+				return err
+			}
+			if value.Valid {
+				flag.Value = flagValue(value.String)
+			}
+			flag.Description, flag.UpdatedAt = description.String, updatedAt.String
+			values[flag.Name] = flag
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	flags.Lock()
+	defer flags.Unlock()
+	flags.db = id
+	flags.values = values
+	flagsChanged()
+	return nil
+}
+
+// flagValue keeps a value written with plain SQL as a JSON string when it is
+// not a JSON document.
+func flagValue(s string) json.RawMessage {
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// applyFlagChanges updates the cache from the row changes of the ha_flags
+// table, written locally or replicated from another node.
+func applyFlagChanges(cs *ha.ChangeSet) {
+	flags.RLock()
+	db := flags.db
+	flags.RUnlock()
+	if db == "" || cs.Filename != db {
+		return
+	}
+	for _, change := range cs.Changes {
+		if change.Table != flagsTableName {
+			continue
+		}
+		switch change.Operation {
+		case "INSERT":
+			storeFlag(flagFromRow(change.Columns, change.NewValues))
+		case "UPDATE":
+			old, flag := flagFromRow(change.Columns, change.OldValues), flagFromRow(change.Columns, change.NewValues)
+			if old.Name != flag.Name {
+				removeFlag(old.Name)
+			}
+			storeFlag(flag)
+		case "DELETE":
+			removeFlag(flagFromRow(change.Columns, change.OldValues).Name)
+		}
+	}
+}
+
+func flagFromRow(columns []string, values []any) Flag {
+	var flag Flag
+	for i, column := range columns {
+		if i >= len(values) || values[i] == nil {
+			continue
+		}
+		switch column {
+		case "name":
+			flag.Name = flagText(values[i])
+		case "enabled":
+			flag.Enabled = flagInt(values[i]) != 0
+		case "rollout":
+			flag.Rollout = flagInt(values[i])
+		case "value":
+			flag.Value = flagValue(flagText(values[i]))
+		case "description":
+			flag.Description = flagText(values[i])
+		case "updated_at":
+			flag.UpdatedAt = flagText(values[i])
+		}
+	}
+	return flag
+}
+
+func flagText(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// flagInt converts the local integers and the float64 or json.Number of the
+// replicated messages.
+func flagInt(v any) int {
+	switch v := v.(type) {
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	default:
+		n, _ := strconv.Atoi(flagText(v))
+		return n
+	}
+}
+
+// FlagsInterceptor updates the feature flags when a change to the ha_flags
+// table is replicated from another node.
+type FlagsInterceptor struct{}
+
+func (FlagsInterceptor) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	if !touchesTable(cs, flagsTableName) {
+		return false, nil
+	}
+	// the DDL is not replicated with --disable-ddl-sync
+	_, err := conn.ExecContext(ha.ContextLocalDB(context.Background(), true), createFlagsTable)
+	return false, err
+}
+
+func (FlagsInterceptor) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if err == nil && touchesTable(cs, flagsTableName) {
+		applyFlagChanges(cs)
+		slog.Debug("feature flags replicated", "id", cs.Filename, "node", cs.Node)
+	}
+	return err
+}
+
+func touchesTable(cs *ha.ChangeSet, table string) bool {
+	for _, change := range cs.Changes {
+		if change.Table == table {
+			return true
+		}
+	}
+	return false
+}
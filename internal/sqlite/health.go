@@ -0,0 +1,88 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type Health struct {
+	ID          string `json:"id"`
+	Leader      bool   `json:"leader"`
+	AppliedSeq  uint64 `json:"applied_seq"`
+	Pending     uint64 `json:"pending"`
+	OutboxDepth int64  `json:"outbox_depth"`
+	ReadOnly    bool   `json:"read_only,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// DatabasesHealth reports the replication state of every database: the last
+// applied stream sequence, the number of stream messages not yet applied by
+// this node and, with async replication, the changesets waiting in the outbox.
+func DatabasesHealth(ctx context.Context) []Health {
+	ids := Databases()
+	slices.Sort(ids)
+	list := make([]Health, 0, len(ids))
+	for _, id := range ids {
+		h := Health{ID: id}
+		if err := databaseHealth(ctx, id, &h); err != nil {
+			h.Error = err.Error()
+		}
+		list = append(list, h)
+	}
+	return list
+}
+
+func databaseHealth(ctx context.Context, id string, h *Health) error {
+	muDBs.Lock()
+	connDB, ok := lookup(id)
+	muDBs.Unlock()
+	if !ok {
+		return fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	connector := connDB.connector
+	h.Leader = connector.LeaderProvider().IsLeader()
+	h.ReadOnly = connDB.readOnly.Load()
+	h.AppliedSeq = connector.LatestSeq()
+
+	info, err := connector.DeliveredInfo(ctx, ConsumerName(id, connector.NodeName()))
+	if err != nil {
+		return fmt.Errorf("consumer info: %w", err)
+	}
+	if ci, ok := info.(*jetstream.ConsumerInfo); ok {
+		h.Pending = ci.NumPending + uint64(ci.NumAckPending)
+	}
+
+	if connDB.outbox != "" {
+		depth, err := outboxDepth(ctx, connDB)
+		if err != nil {
+			return fmt.Errorf("outbox depth: %w", err)
+		}
+		h.OutboxDepth = depth
+	}
+	return nil
+}
+
+func outboxDepth(ctx context.Context, connDB *connectorDB) (int64, error) {
+	if _, err := os.Stat(connDB.outbox); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	conn, err := connDB.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	ctx = ha.ContextLocalDB(ctx, true)
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS ha_outbox_health", connDB.outbox); err != nil {
+		return 0, err
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE ha_outbox_health")
+	var depth int64
+	err = conn.QueryRowContext(ctx, "SELECT count(*) FROM ha_outbox_health.ha_outbox").Scan(&depth)
+	return depth, err
+}
@@ -0,0 +1,176 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+)
+
+var ErrImportRow = errors.New("invalid import row")
+
+// ImportConflict is the handling of the imported rows violating a uniqueness
+// constraint.
+type ImportConflict string
+
+const (
+	// ImportFail stops the import at the row, its batch is rolled back.
+	ImportFail ImportConflict = "fail"
+	// ImportIgnore keeps the existing row.
+	ImportIgnore ImportConflict = "ignore"
+	// ImportReplace deletes the existing row before inserting the new one.
+	ImportReplace ImportConflict = "replace"
+)
+
+// DefaultImportBatchSize is the rows committed per transaction by Import.
+const DefaultImportBatchSize = 1000
+
+// ParseImportConflict parses fail, ignore or replace, case insensitive. An
+// empty string is fail.
+func ParseImportConflict(s string) (ImportConflict, error) {
+	switch conflict := ImportConflict(strings.ToLower(strings.TrimSpace(s))); conflict {
+	case "":
+		return ImportFail, nil
+	case ImportFail, ImportIgnore, ImportReplace:
+		return conflict, nil
+	default:
+		return "", fmt.Errorf("invalid conflict handling %q, use fail, ignore or replace: %w", s, ErrMissingParameter)
+	}
+}
+
+// ImportRow is a row to insert, the values of its columns.
+type ImportRow struct {
+	Columns []string
+	Values  []any
+}
+
+type ImportResult struct {
+	// Rows is the number of rows committed, Changed the rows inserted or
+	// replaced among them.
+	Rows    int64 `json:"rows"`
+	Changed int64 `json:"changed"`
+	Batches int   `json:"batches"`
+}
+
+// Import inserts the rows in the table, batchSize rows per transaction: each
+// batch is committed, and replicated, as one changeset. A failed row rolls
+// back its batch only, the previous batches stay committed.
+func Import(ctx context.Context, id, table string, conflict ImportConflict, batchSize int, rows iter.Seq2[ImportRow, error]) (ImportResult, error) {
+	var result ImportResult
+	if table == "" {
+		return result, fmt.Errorf("table is required: %w", ErrMissingParameter)
+	}
+	db, err := DB(id)
+	if err != nil {
+		return result, err
+	}
+	if id == "" {
+		id = DefaultDatabase()
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultImportBatchSize
+	}
+
+	var (
+		tx      *sql.Tx
+		read    int64
+		pending int64
+		changed int64
+		// queries holds the intercepted INSERT of each list of columns,
+		// stmts the statements prepared in the batch.
+		queries = make(map[string]string)
+		stmts   map[string]*sql.Stmt
+	)
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	commit := func() error {
+		err := Commit(ctx, db, tx)
+		tx = nil
+		if err != nil {
+			return err
+		}
+		result.Rows += pending
+		result.Changed += changed
+		result.Batches++
+		pending, changed = 0, 0
+		return nil
+	}
+	for row, err := range rows {
+		read++
+		if err != nil {
+			return result, fmt.Errorf("%w %d: %w", ErrImportRow, read, err)
+		}
+		if len(row.Columns) == 0 || len(row.Columns) != len(row.Values) {
+			return result, fmt.Errorf("%w %d: %d columns and %d values", ErrImportRow, read, len(row.Columns), len(row.Values))
+		}
+		key := strings.Join(row.Columns, "\x00")
+		query, ok := queries[key]
+		if !ok {
+			if query, err = InterceptQuery(ctx, id, insertStatement(table, conflict, row.Columns)); err != nil {
+				return result, err
+			}
+			if err := CheckWritable(ctx, id, query); err != nil {
+				return result, err
+			}
+			queries[key] = query
+		}
+		if tx == nil {
+			if tx, err = BeginTx(ctx, db, BeginImmediate); err != nil {
+				return result, err
+			}
+			stmts = make(map[string]*sql.Stmt)
+		}
+		stmt, ok := stmts[key]
+		if !ok {
+			if stmt, err = tx.PrepareContext(ctx, query); err != nil {
+				return result, fmt.Errorf("%w %d: %w", ErrImportRow, read, err)
+			}
+			stmts[key] = stmt
+		}
+		res, err := stmt.ExecContext(ctx, row.Values...)
+		if err != nil {
+			return result, fmt.Errorf("%w %d: %w", ErrImportRow, read, err)
+		}
+		n, _ := res.RowsAffected()
+		changed += n
+		pending++
+		if pending == int64(batchSize) {
+			if err := commit(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if tx != nil {
+		if err := commit(); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func insertStatement(table string, conflict ImportConflict, columns []string) string {
+	var sb strings.Builder
+	sb.WriteString("INSERT")
+	if conflict == ImportIgnore || conflict == ImportReplace {
+		sb.WriteString(" OR ")
+		sb.WriteString(strings.ToUpper(string(conflict)))
+	}
+	sb.WriteString(" INTO ")
+	sb.WriteString(quoteIdentifier(table))
+	sb.WriteString(" (")
+	for i, column := range columns {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(quoteIdentifier(column))
+	}
+	sb.WriteString(") VALUES (")
+	sb.WriteString(strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+	sb.WriteString(")")
+	return sb.String()
+}
@@ -0,0 +1,86 @@
+package sqlite
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// JSONUpdate is a partial update of the JSON documents stored in a column:
+// the merge patch (RFC 7396) is applied first, then the values are set at
+// their paths and the paths are removed. A NULL document is an empty object.
+type JSONUpdate struct {
+	Table  string                     `json:"table"`
+	Column string                     `json:"column"`
+	Patch  json.RawMessage            `json:"patch,omitempty"`
+	Set    map[string]json.RawMessage `json:"set,omitempty"`
+	Remove []string                   `json:"remove,omitempty"`
+	// Where selects the rows to update, with the named parameters in Params.
+	Where  string         `json:"where"`
+	Params map[string]any `json:"params,omitempty"`
+}
+
+// Statement returns the UPDATE statement and its parameters. The document is
+// computed by the SQLite JSON functions on this node and replicated as the
+// new value of the whole column, so every node stores the same document.
+func (u JSONUpdate) Statement() (string, map[string]any, error) {
+	if u.Table == "" || u.Column == "" {
+		return "", nil, fmt.Errorf("table and column are required: %w", ErrMissingParameter)
+	}
+	if strings.TrimSpace(u.Where) == "" {
+		return "", nil, fmt.Errorf("where is required, use 1 to update every row: %w", ErrMissingParameter)
+	}
+	if len(u.Patch) == 0 && len(u.Set) == 0 && len(u.Remove) == 0 {
+		return "", nil, fmt.Errorf("patch, set or remove is required: %w", ErrMissingParameter)
+	}
+	params := make(map[string]any, len(u.Params)+len(u.Set)*2+len(u.Remove)+1)
+	for k, v := range u.Params {
+		name := strings.TrimLeft(k, ":@$")
+		if k != "" && k[0] == '$' || strings.HasPrefix(name, "ha_json_") {
+			return "", nil, fmt.Errorf("invalid parameter %q, use a named parameter not starting with ha_json_", k)
+		}
+		params[name] = v
+	}
+
+	column := quoteIdentifier(u.Column)
+	expr := column
+	if len(u.Patch) > 0 {
+		if !json.Valid(u.Patch) {
+			return "", nil, fmt.Errorf("patch is not valid JSON")
+		}
+		expr = fmt.Sprintf("json_patch(coalesce(%s, '{}'), :ha_json_patch)", expr)
+		params["ha_json_patch"] = string(u.Patch)
+	}
+	if len(u.Set) > 0 {
+		paths := make([]string, 0, len(u.Set))
+		for path := range u.Set {
+			paths = append(paths, path)
+		}
+		slices.Sort(paths)
+		args := make([]string, 0, len(paths))
+		for i, path := range paths {
+			if !json.Valid(u.Set[path]) {
+				return "", nil, fmt.Errorf("value of %q is not valid JSON", path)
+			}
+			args = append(args, fmt.Sprintf(":ha_json_path_%d, json(:ha_json_value_%d)", i, i))
+			params[fmt.Sprintf("ha_json_path_%d", i)] = path
+			params[fmt.Sprintf("ha_json_value_%d", i)] = string(u.Set[path])
+		}
+		expr = fmt.Sprintf("json_set(coalesce(%s, '{}'), %s)", expr, strings.Join(args, ", "))
+	}
+	if len(u.Remove) > 0 {
+		args := make([]string, 0, len(u.Remove))
+		for i, path := range u.Remove {
+			args = append(args, fmt.Sprintf(":ha_json_remove_%d", i))
+			params[fmt.Sprintf("ha_json_remove_%d", i)] = path
+		}
+		expr = fmt.Sprintf("json_remove(%s, %s)", expr, strings.Join(args, ", "))
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s", quoteIdentifier(u.Table), column, expr, u.Where)
+	return query, params, nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,152 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/litesql/go-ha"
+	_ "github.com/litesql/go-sqlite3"
+	sqlite3ha "github.com/litesql/go-sqlite3-ha"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// recorder keeps the changesets encoded as they are published to the stream.
+type recorder struct {
+	messages [][]byte
+}
+
+func (r *recorder) Publish(cs *ha.ChangeSet) error {
+	data, err := json.Marshal(cs)
+	if err != nil {
+		return err
+	}
+	r.messages = append(r.messages, data)
+	return nil
+}
+
+func (r *recorder) Sequence() uint64 {
+	return uint64(len(r.messages))
+}
+
+type noHooks struct{}
+
+func (noHooks) RegisterHooks(conn driver.Conn, _ *ha.Connector) (driver.Conn, error) {
+	return conn, nil
+}
+
+func (noHooks) DisableHooks(*sql.Conn) error { return nil }
+
+func (noHooks) EnableHooks(*sql.Conn) error { return nil }
+
+// TestJSONReplication captures the changes of JSON documents on a node and
+// applies them on another one, which must store the same documents.
+func TestJSONReplication(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	pub := new(recorder)
+	connector, err := sqlite3ha.NewConnector("file:"+filepath.Join(dir, "src.db"),
+		ha.WithName("node1"), ha.WithReplicationPublisher(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := sql.OpenDB(connector)
+	defer src.Close()
+	dst, err := sql.Open("sqlite3", filepath.Join(dir, "dst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	const schema = "CREATE TABLE docs (id INTEGER PRIMARY KEY, doc TEXT)"
+	for _, db := range []*sql.DB{src, dst} {
+		if _, err := db.Exec(schema); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statements := []sqlite.Request{
+		{Sql: "INSERT INTO docs (id, doc) VALUES (1, :doc)", Params: map[string]any{
+			"doc": `{"name":"Zoë 🚀","big":9007199254740993,"ratio":0.1,"nested":{"a":[1,{"b":null}],"s":"line\nbreak \"quoted\""}}`,
+		}},
+		{Sql: "INSERT INTO docs (id, doc) VALUES (2, NULL)"},
+		{Sql: "INSERT INTO docs (id, doc) VALUES (3, json_array(1, 'two', json('{\"x\":3}')))"},
+		{Sql: "UPDATE docs SET doc = json_insert(doc, '$[#]', json('[true,false]')) WHERE id = 3"},
+	}
+	updates := []sqlite.JSONUpdate{
+		{Table: "docs", Column: "doc", Patch: json.RawMessage(`{"nested":{"s":null,"t":"日本"},"big":18446744073709551615}`), Where: "id = :id", Params: map[string]any{"id": 1}},
+		{Table: "docs", Column: "doc", Set: map[string]json.RawMessage{"$.nested.a[0]": json.RawMessage(`{"deep":[[]]}`), "$.tags": json.RawMessage(`["x"]`)}, Where: "id = :id", Params: map[string]any{"id": 1}},
+		{Table: "docs", Column: "doc", Remove: []string{"$.ratio"}, Where: "id = 1"},
+		{Table: "docs", Column: "doc", Patch: json.RawMessage(`{"created":true}`), Set: map[string]json.RawMessage{"$.n": json.RawMessage(`-0.5e-3`)}, Where: "id = 2"},
+	}
+	for _, update := range updates {
+		query, params, err := update.Statement()
+		if err != nil {
+			t.Fatalf("Statement(%+v): %v", update, err)
+		}
+		statements = append(statements, sqlite.Request{Sql: query, Params: params})
+	}
+	for _, stmt := range statements {
+		if _, err := sqlite.Exec(ctx, src, stmt.Sql, stmt.Params); err != nil {
+			t.Fatalf("%s: %v", stmt.Sql, err)
+		}
+	}
+
+	if len(pub.messages) == 0 {
+		t.Fatal("no changeset published")
+	}
+	for _, data := range pub.messages {
+		cs := ha.NewChangeSet("node2", "")
+		if err := json.Unmarshal(data, cs); err != nil {
+			t.Fatal(err)
+		}
+		cs.SetConnProvider(noHooks{})
+		if err := cs.Apply(dst); err != nil {
+			t.Fatalf("apply %s: %v", data, err)
+		}
+	}
+
+	const query = "SELECT id, doc, json_valid(doc) FROM docs ORDER BY id"
+	want, got := rows(t, src, query), rows(t, dst, query)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replicated documents = %v, want %v", got, want)
+	}
+	if len(want) != 3 || want[0][2] != int64(1) || want[1][1] != `{"created":true,"n":-0.5e-3}` {
+		t.Errorf("documents = %v", want)
+	}
+}
+
+func rows(t *testing.T, db *sql.DB, query string) [][]any {
+	t.Helper()
+	rs, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	columns, err := rs.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list [][]any
+	for rs.Next() {
+		row := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rs.Scan(dest...); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, row)
+	}
+	if err := rs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
@@ -0,0 +1,54 @@
+package sqlite_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestJSONUpdateStatement(t *testing.T) {
+	update := sqlite.JSONUpdate{
+		Table:  `my"docs`,
+		Column: "doc",
+		Patch:  json.RawMessage(`{"a":null}`),
+		Set:    map[string]json.RawMessage{"$.z": json.RawMessage(`1`), "$.b": json.RawMessage(`"x"`)},
+		Remove: []string{"$.c"},
+		Where:  "id = :id",
+		Params: map[string]any{":id": 7},
+	}
+	query, params, err := update.Statement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `UPDATE "my""docs" SET "doc" = json_remove(json_set(coalesce(json_patch(coalesce("doc", '{}'), :ha_json_patch), '{}'), ` +
+		`:ha_json_path_0, json(:ha_json_value_0), :ha_json_path_1, json(:ha_json_value_1)), :ha_json_remove_0) WHERE id = :id`
+	if query != want {
+		t.Errorf("query = %s, want %s", query, want)
+	}
+	if params["id"] != 7 || params["ha_json_path_0"] != "$.b" || params["ha_json_value_1"] != "1" || params["ha_json_remove_0"] != "$.c" {
+		t.Errorf("params = %v", params)
+	}
+
+	invalid := []sqlite.JSONUpdate{
+		{Table: "docs", Column: "doc", Patch: json.RawMessage(`{}`)},
+		{Table: "docs", Column: "doc", Where: "1"},
+		{Column: "doc", Patch: json.RawMessage(`{}`), Where: "1"},
+	}
+	for _, update := range invalid {
+		if _, _, err := update.Statement(); !errors.Is(err, sqlite.ErrMissingParameter) {
+			t.Errorf("Statement(%+v) = %v, want ErrMissingParameter", update, err)
+		}
+	}
+	for _, update := range []sqlite.JSONUpdate{
+		{Table: "docs", Column: "doc", Patch: json.RawMessage(`{`), Where: "1"},
+		{Table: "docs", Column: "doc", Set: map[string]json.RawMessage{"$.a": json.RawMessage(`x`)}, Where: "1"},
+		{Table: "docs", Column: "doc", Remove: []string{"$.a"}, Where: "id = $1", Params: map[string]any{"$1": 1}},
+		{Table: "docs", Column: "doc", Remove: []string{"$.a"}, Where: "id = :ha_json_patch", Params: map[string]any{"ha_json_patch": 1}},
+	} {
+		if _, _, err := update.Statement(); err == nil {
+			t.Errorf("Statement(%+v) succeeded, want an error", update)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// LintPolicy is what happens to the statements flagged by the SQL lint.
+type LintPolicy int
+
+const (
+	// LintOff doesn't check the statements.
+	LintOff LintPolicy = iota
+	// LintWarn executes the statements and returns the warnings with their
+	// result.
+	LintWarn
+	// LintReject fails the statements with warnings before executing them.
+	LintReject
+)
+
+// ParseLintPolicy parses off, warn or reject, case insensitive. An empty
+// string is off.
+func ParseLintPolicy(s string) (LintPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "off":
+		return LintOff, nil
+	case "warn":
+		return LintWarn, nil
+	case "reject":
+		return LintReject, nil
+	default:
+		return LintOff, fmt.Errorf("invalid lint policy %q, use off, warn or reject", s)
+	}
+}
+
+// The lint rules.
+const (
+	LintNoWhere    = "no-where"
+	LintSelectStar = "select-star"
+	LintCrossJoin  = "cross-join"
+	LintNoLimit    = "no-limit"
+)
+
+var LintRules = []string{LintNoWhere, LintSelectStar, LintCrossJoin, LintNoLimit}
+
+var ErrLintRejected = errors.New("statement rejected by the SQL lint")
+
+// LintWarning is a risky pattern found in a statement.
+type LintWarning struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+var (
+	lintPolicy LintPolicy
+	lintRules  = LintRules
+)
+
+// SetLint sets the policy of the statements sent to the HTTP API and the
+// rules checked by Lint, all of them when empty.
+func SetLint(policy LintPolicy, rules []string) error {
+	for _, rule := range rules {
+		if !slices.Contains(LintRules, rule) {
+			return fmt.Errorf("invalid lint rule %q, use %s", rule, strings.Join(LintRules, ", "))
+		}
+	}
+	lintPolicy = policy
+	lintRules = LintRules
+	if len(rules) > 0 {
+		lintRules = rules
+	}
+	return nil
+}
+
+// DefaultLintPolicy returns the policy set by SetLint.
+func DefaultLintPolicy() LintPolicy {
+	return lintPolicy
+}
+
+// CheckLint lints the statement under the policy, the warnings are returned
+// as an ErrLintRejected error by LintReject.
+func CheckLint(query string, policy LintPolicy) ([]LintWarning, error) {
+	if policy == LintOff {
+		return nil, nil
+	}
+	warnings := Lint(query)
+	if policy == LintReject && len(warnings) > 0 {
+		messages := make([]string, len(warnings))
+		for i, warning := range warnings {
+			messages[i] = fmt.Sprintf("%s: %s", warning.Rule, warning.Message)
+		}
+		return warnings, fmt.Errorf("%w: %s", ErrLintRejected, strings.Join(messages, "; "))
+	}
+	return warnings, nil
+}
+
+// Lint returns the risky patterns of the statements: UPDATE or DELETE
+// without WHERE, SELECT *, tables joined without a condition and SELECT
+// without LIMIT. Only the top level of the statements is checked, not the
+// subqueries, and the statements that fail to tokenize are not flagged.
+func Lint(query string) []LintWarning {
+	tokens, ok := topLevelTokens(query)
+	if !ok {
+		return nil
+	}
+	var warnings []LintWarning
+	add := func(rule, message string) {
+		if !slices.Contains(lintRules, rule) {
+			return
+		}
+		for _, warning := range warnings {
+			if warning.Rule == rule {
+				return
+			}
+		}
+		warnings = append(warnings, LintWarning{Rule: rule, Message: message})
+	}
+	for statement := range splitTokens(tokens, func(t sqlToken) bool { return t.text == ";" }) {
+		lintStatement(statement, add)
+	}
+	return warnings
+}
+
+func lintStatement(tokens []sqlToken, add func(rule, message string)) {
+	if len(tokens) == 0 || tokens[0].upper == "EXPLAIN" {
+		return
+	}
+	// the CTE bodies are in parentheses, the main statement starts at the
+	// first keyword after them
+	i := 0
+	if tokens[0].upper == "WITH" {
+		for i < len(tokens) && !slices.Contains([]string{"SELECT", "VALUES", "INSERT", "REPLACE", "UPDATE", "DELETE"}, tokens[i].upper) {
+			i++
+		}
+		if i == len(tokens) {
+			return
+		}
+	}
+	tokens = tokens[i:]
+	switch tokens[0].upper {
+	case "UPDATE", "DELETE":
+		if !hasToken(tokens, "WHERE") {
+			add(LintNoWhere, fmt.Sprintf("%s without WHERE changes every row of the table", tokens[0].upper))
+		}
+	case "SELECT":
+		lintSelect(tokens, add)
+	}
+}
+
+var aggregateFunctions = []string{"COUNT", "SUM", "TOTAL", "AVG", "MIN", "MAX", "GROUP_CONCAT", "STRING_AGG"}
+
+func lintSelect(tokens []sqlToken, add func(rule, message string)) {
+	needsLimit := false
+	compound := func(t sqlToken) bool {
+		return t.upper == "UNION" || t.upper == "INTERSECT" || t.upper == "EXCEPT"
+	}
+	for core := range splitTokens(tokens, compound) {
+		if len(core) > 0 && core[0].upper == "ALL" {
+			core = core[1:]
+		}
+		if len(core) == 0 || core[0].upper != "SELECT" {
+			continue
+		}
+		from := len(core)
+		for i, token := range core {
+			if token.upper == "FROM" {
+				from = i
+				break
+			}
+		}
+
+		columns := core[1:from]
+		if len(columns) > 0 && (columns[0].upper == "DISTINCT" || columns[0].upper == "ALL") {
+			columns = columns[1:]
+		}
+		aggregates := true
+		for column := range splitTokens(columns, func(t sqlToken) bool { return t.text == "," }) {
+			if len(column) == 0 {
+				continue
+			}
+			if column[0].text == "*" || len(column) >= 3 && column[1].text == "." && column[2].text == "*" {
+				add(LintSelectStar, "SELECT * returns every column, list the columns needed")
+			}
+			if len(column) < 2 || !slices.Contains(aggregateFunctions, column[0].upper) || column[1].text != "(" {
+				aggregates = false
+			}
+		}
+		if from == len(core) {
+			continue
+		}
+
+		// an aggregate without GROUP BY returns a single row
+		if !aggregates || hasToken(core, "GROUP") {
+			needsLimit = true
+		}
+		lintJoins(core[from+1:], hasToken(core, "WHERE"), add)
+	}
+	if needsLimit && !hasToken(tokens, "LIMIT") {
+		add(LintNoLimit, "SELECT without LIMIT may return every row of the table")
+	}
+}
+
+// lintJoins flags the tables of the FROM clause joined without a condition:
+// the comma joins of a SELECT without WHERE and the joins without ON or
+// USING, except the NATURAL and CROSS joins.
+func lintJoins(tokens []sqlToken, where bool, add func(rule, message string)) {
+	const message = "implicit cross join, the tables are joined without a condition"
+	pending := false
+	for i, token := range tokens {
+		switch token.upper {
+		case "WHERE", "GROUP", "HAVING", "WINDOW", "ORDER", "LIMIT":
+			if pending {
+				add(LintCrossJoin, message)
+			}
+			return
+		case "JOIN":
+			if pending {
+				add(LintCrossJoin, message)
+			}
+			pending = !(i > 0 && tokens[i-1].upper == "CROSS") && !slices.ContainsFunc(tokens[max(i-3, 0):i], func(t sqlToken) bool {
+				return t.upper == "NATURAL"
+			})
+		case "ON", "USING":
+			pending = false
+		}
+		if token.text == "," {
+			if pending || !where {
+				add(LintCrossJoin, message)
+			}
+			pending = false
+		}
+	}
+	if pending {
+		add(LintCrossJoin, message)
+	}
+}
+
+func hasToken(tokens []sqlToken, upper string) bool {
+	return slices.ContainsFunc(tokens, func(t sqlToken) bool { return t.upper == upper })
+}
+
+// splitTokens yields the tokens between the separators.
+func splitTokens(tokens []sqlToken, sep func(sqlToken) bool) func(yield func([]sqlToken) bool) {
+	return func(yield func([]sqlToken) bool) {
+		start := 0
+		for i, token := range tokens {
+			if sep(token) {
+				if !yield(tokens[start:i]) {
+					return
+				}
+				start = i + 1
+			}
+		}
+		yield(tokens[start:])
+	}
+}
@@ -0,0 +1,49 @@
+package sqlite_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		sql   string
+		rules []string
+	}{
+		{sql: "DELETE FROM logs", rules: []string{sqlite.LintNoWhere}},
+		{sql: "delete from logs where ts < :ts"},
+		{sql: "UPDATE users SET note = 'where' -- where", rules: []string{sqlite.LintNoWhere}},
+		{sql: "UPDATE users SET n = (SELECT count(*) FROM x WHERE x.u = users.id)", rules: []string{sqlite.LintNoWhere}},
+		{sql: "WITH old AS (SELECT id FROM users WHERE age > 99) DELETE FROM users", rules: []string{sqlite.LintNoWhere}},
+		{sql: "INSERT INTO users SELECT * FROM staging"},
+		{sql: "SELECT * FROM users LIMIT 10", rules: []string{sqlite.LintSelectStar}},
+		{sql: "SELECT u.*, o.id FROM users u JOIN orders o ON o.user_id = u.id LIMIT 10", rules: []string{sqlite.LintSelectStar}},
+		{sql: "SELECT a * b FROM t LIMIT 1"},
+		{sql: "SELECT id FROM users", rules: []string{sqlite.LintNoLimit}},
+		{sql: "SELECT count(*), max(age) FROM users"},
+		{sql: "SELECT age, count(*) FROM users GROUP BY age", rules: []string{sqlite.LintNoLimit}},
+		{sql: "SELECT 1"},
+		{sql: "SELECT id FROM a UNION ALL SELECT id FROM b LIMIT 5"},
+		{sql: "SELECT a.id FROM a, b LIMIT 1", rules: []string{sqlite.LintCrossJoin}},
+		{sql: "SELECT a.id FROM a, b WHERE a.id = b.id LIMIT 1"},
+		{sql: "SELECT a.id FROM a JOIN b LIMIT 1", rules: []string{sqlite.LintCrossJoin}},
+		{sql: "SELECT a.id FROM a LEFT JOIN b USING (id) JOIN c ON c.id = a.id LIMIT 1"},
+		{sql: "SELECT a.id FROM a CROSS JOIN b NATURAL LEFT JOIN c LIMIT 1"},
+		{sql: "SELECT * FROM a, b", rules: []string{sqlite.LintSelectStar, sqlite.LintNoLimit, sqlite.LintCrossJoin}},
+		{sql: "EXPLAIN QUERY PLAN SELECT * FROM users"},
+		{sql: "SELECT id FROM users LIMIT 1; DELETE FROM users", rules: []string{sqlite.LintNoWhere}},
+	}
+	for _, tt := range tests {
+		var rules []string
+		for _, warning := range sqlite.Lint(tt.sql) {
+			rules = append(rules, warning.Rule)
+		}
+		slices.Sort(rules)
+		slices.Sort(tt.rules)
+		if !slices.Equal(rules, tt.rules) {
+			t.Errorf("Lint(%q) = %v, want %v", tt.sql, rules, tt.rules)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// lockTimeout bounds the NATS requests of the lock SQL functions, the
+// statement waits for them.
+const lockTimeout = 5 * time.Second
+
+var errLocksDisabled = errors.New("distributed locks are disabled, inform flag --locks-bucket at startup")
+
+// Locker takes and frees the distributed locks of the SQL functions ha_lock
+// and ha_unlock.
+type Locker interface {
+	// TryLock returns the token of the lock taken, empty while another owner
+	// holds it. A zero ttl is the default one.
+	TryLock(ctx context.Context, name string, ttl time.Duration) (string, error)
+	Unlock(ctx context.Context, name, token string) (bool, error)
+}
+
+var locker Locker
+
+// SetLocker sets the distributed locks of the SQL functions.
+func SetLocker(l Locker) {
+	locker = l
+}
+
+// lockFunc implements ha_lock(name [, ttl_seconds]), returning the token of
+// the lock taken or NULL while another owner holds it.
+func lockFunc(name, ttl any) (any, error) {
+	if locker == nil {
+		return nil, errLocksDisabled
+	}
+	if isNull(name) {
+		return nil, nil
+	}
+	var seconds float64
+	switch v := ttl.(type) {
+	case int64:
+		seconds = float64(v)
+	case float64:
+		seconds = v
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	token, err := locker.TryLock(ctx, toText(name), time.Duration(seconds*float64(time.Second)))
+	if err != nil || token == "" {
+		return nil, err
+	}
+	return token, nil
+}
+
+// unlockFunc implements ha_unlock(name, token), true when the lock was held
+// with token and released.
+func unlockFunc(name, token any) (any, error) {
+	if locker == nil {
+		return nil, errLocksDisabled
+	}
+	if isNull(name) || isNull(token) {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	return locker.Unlock(ctx, toText(name), toText(token))
+}
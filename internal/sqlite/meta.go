@@ -0,0 +1,247 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// ColumnMeta describes a result column. Table and Column are the origin of
+// the value when it is read straight from a table column, empty for
+// expressions. Nullable is nil when unknown.
+type ColumnMeta struct {
+	Name     string `json:"name"`
+	DeclType string `json:"decltype"`
+	Table    string `json:"table,omitempty"`
+	Column   string `json:"column,omitempty"`
+	Nullable *bool  `json:"nullable,omitempty"`
+}
+
+type columnMetaKey struct{}
+
+// ContextColumnMeta enables (meta=full) the result column metadata in the
+// query responses.
+func ContextColumnMeta(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, columnMetaKey{}, enabled)
+}
+
+func columnMetaEnabled(ctx context.Context) bool {
+	enabled, _ := ctx.Value(columnMetaKey{}).(bool)
+	return enabled
+}
+
+type columnOrigin struct {
+	cursor int64
+	column int64 // -1 for rowid
+}
+
+// queryColumnMeta resolves the metadata of the result columns. The database
+// /sql drivers do not expose sqlite3_column_table_name and friends, so the
+// origin is found in the query bytecode (EXPLAIN): the Column and Rowid
+// instructions loading the registers of the first ResultRow, through the
+// cursors opened on the table (or index) b-trees.
+func queryColumnMeta(ctx context.Context, querier querier, query string, args []any, columnTypes []*sql.ColumnType) ([]ColumnMeta, error) {
+	meta := make([]ColumnMeta, len(columnTypes))
+	for i, ct := range columnTypes {
+		meta[i] = ColumnMeta{Name: ct.Name(), DeclType: ct.DatabaseTypeName()}
+		if nullable, ok := ct.Nullable(); ok {
+			meta[i].Nullable = &nullable
+		}
+	}
+
+	origins, cursors, err := explainOrigins(ctx, querier, query, args, len(columnTypes))
+	if err != nil {
+		return nil, err
+	}
+	schema, err := loadSchemaObjects(ctx, querier)
+	if err != nil {
+		return nil, err
+	}
+	for i, origin := range origins {
+		if origin == nil {
+			continue
+		}
+		obj, ok := schema[cursors[origin.cursor]]
+		if !ok {
+			continue
+		}
+		column := origin.column
+		if obj.typ == "index" {
+			if column < 0 {
+				column = -1
+			} else if column, err = indexColumn(ctx, querier, obj.name, column); err != nil {
+				return nil, err
+			}
+			if column < -1 {
+				continue
+			}
+		} else if obj.withoutRowid {
+			// the table b-tree is keyed by the primary key, the column
+			// positions do not match the declared order
+			continue
+		}
+		col, err := tableColumn(ctx, querier, obj.table, column)
+		if err != nil {
+			return nil, err
+		}
+		if col == nil {
+			continue
+		}
+		meta[i].Table = obj.table
+		meta[i].Column = col.name
+		if meta[i].DeclType == "" {
+			meta[i].DeclType = col.typ
+		}
+		nullable := !col.notNull
+		meta[i].Nullable = &nullable
+	}
+	return meta, nil
+}
+
+func explainOrigins(ctx context.Context, querier querier, query string, args []any, count int) ([]*columnOrigin, map[int64]int64, error) {
+	rows, err := querier.QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	cursors := make(map[int64]int64) // cursor -> root page
+	registers := make(map[int64]*columnOrigin)
+	origins := make([]*columnOrigin, count)
+	for rows.Next() {
+		var (
+			addr, p1, p2, p3, p5 int64
+			opcode               string
+			p4, comment          any
+		)
+		if err := rows.Scan(&addr, &opcode, &p1, &p2, &p3, &p4, &p5, &comment); err != nil {
+			return nil, nil, err
+		}
+		switch opcode {
+		case "OpenRead", "OpenWrite", "ReopenIdx":
+			if p3 == 0 { // main schema
+				cursors[p1] = p2
+			}
+		case "Column":
+			registers[p3] = &columnOrigin{cursor: p1, column: p2}
+		case "Rowid", "IdxRowid":
+			registers[p2] = &columnOrigin{cursor: p1, column: -1}
+		case "Copy", "SCopy":
+			registers[p2] = registers[p1]
+		case "Move":
+			for i := range p3 {
+				registers[p2+i] = registers[p1+i]
+				delete(registers, p1+i)
+			}
+		case "Integer", "Int64", "Real", "String8", "String", "Null", "Blob", "Variable":
+			delete(registers, p2)
+		case "Function", "PureFunc", "Add", "Subtract", "Multiply", "Divide", "Remainder", "Concat",
+			"BitAnd", "BitOr", "ShiftLeft", "ShiftRight", "And", "Or", "AggValue":
+			delete(registers, p3)
+		case "Not", "BitNot":
+			delete(registers, p2)
+		case "Cast", "AggFinal":
+			delete(registers, p1)
+		case "ResultRow":
+			for i := int64(0); i < p2 && int(i) < count; i++ {
+				origins[i] = registers[p1+i]
+			}
+			return origins, cursors, rows.Err()
+		}
+	}
+	return origins, cursors, rows.Err()
+}
+
+type schemaObject struct {
+	typ          string
+	name         string
+	table        string
+	withoutRowid bool
+}
+
+func loadSchemaObjects(ctx context.Context, querier querier) (map[int64]schemaObject, error) {
+	rows, err := querier.QueryContext(ctx, "SELECT type, name, tbl_name, rootpage, coalesce(sql, '') FROM sqlite_schema WHERE type IN ('table', 'index') AND rootpage > 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objects := make(map[int64]schemaObject)
+	for rows.Next() {
+		var (
+			obj      schemaObject
+			rootpage int64
+			ddl      string
+		)
+		if err := rows.Scan(&obj.typ, &obj.name, &obj.table, &rootpage, &ddl); err != nil {
+			return nil, err
+		}
+		obj.withoutRowid = obj.typ == "table" && strings.Contains(strings.ToUpper(ddl), "WITHOUT ROWID")
+		objects[rootpage] = obj
+	}
+	return objects, rows.Err()
+}
+
+// indexColumn maps the position in the index record to the table column id:
+// -1 for the rowid, -2 for expressions.
+func indexColumn(ctx context.Context, querier querier, index string, seqno int64) (int64, error) {
+	rows, err := querier.QueryContext(ctx, "SELECT cid FROM pragma_index_xinfo(?) WHERE seqno = ?", index, seqno)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cid := int64(-2)
+	if rows.Next() {
+		if err := rows.Scan(&cid); err != nil {
+			return 0, err
+		}
+	}
+	return cid, rows.Err()
+}
+
+type tableColumnInfo struct {
+	name    string
+	typ     string
+	notNull bool
+}
+
+// tableColumn returns the column by its position in the table record, or the
+// INTEGER PRIMARY KEY (rowid alias) when cid is -1.
+func tableColumn(ctx context.Context, querier querier, table string, cid int64) (*tableColumnInfo, error) {
+	rows, err := querier.QueryContext(ctx, `SELECT name, type, "notnull", pk FROM pragma_table_xinfo(?) ORDER BY cid`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var (
+		columns []tableColumnInfo
+		pks     []int
+	)
+	for rows.Next() {
+		var (
+			col tableColumnInfo
+			pk  int
+		)
+		if err := rows.Scan(&col.name, &col.typ, &col.notNull, &pk); err != nil {
+			return nil, err
+		}
+		if pk > 0 {
+			pks = append(pks, len(columns))
+		}
+		columns = append(columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if cid == -1 {
+		if len(pks) == 1 && strings.EqualFold(columns[pks[0]].typ, "INTEGER") {
+			col := columns[pks[0]]
+			col.notNull = true
+			return &col, nil
+		}
+		return &tableColumnInfo{name: "rowid", typ: "INTEGER", notNull: true}, nil
+	}
+	if cid < 0 || int(cid) >= len(columns) {
+		return nil, nil
+	}
+	return &columns[cid], nil
+}
@@ -0,0 +1,223 @@
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/litesql/go-ha"
+)
+
+const migrationsTableName = "schema_migrations"
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS ` + migrationsTableName + `(
+	version INTEGER PRIMARY KEY,
+	name TEXT,
+	checksum TEXT NOT NULL,
+	node TEXT,
+	applied_at TEXT
+)`
+
+var (
+	ErrMigrationConflict = errors.New("migration already applied with a different SQL")
+	ErrDDLSyncDisabled   = errors.New("DDL sync is disabled, the migration would only change this node")
+)
+
+var ddlSyncDisabled bool
+
+// SetDDLSyncDisabled records that the DDL statements are not replicated, the
+// migrations are then refused.
+func SetDDLSyncDisabled(disabled bool) {
+	ddlSyncDisabled = disabled
+}
+
+// Migration is a versioned schema change. NoTransaction runs the SQL outside
+// a transaction, for the statements SQLite refuses in one like VACUUM.
+type Migration struct {
+	Version       int64  `json:"version"`
+	Name          string `json:"name,omitempty"`
+	SQL           string `json:"sql"`
+	NoTransaction bool   `json:"no_transaction,omitempty"`
+}
+
+// AppliedMigration is a row of the schema_migrations table.
+type AppliedMigration struct {
+	Version   int64  `json:"version"`
+	Name      string `json:"name,omitempty"`
+	Checksum  string `json:"checksum"`
+	Node      string `json:"node,omitempty"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+type MigrateResult struct {
+	Version int64   `json:"version"`
+	Applied []int64 `json:"applied"`
+	Skipped []int64 `json:"skipped"`
+	// Sequence is the replication stream sequence of the last published
+	// changeset, the replicas run the migrations once they applied it.
+	Sequence uint64 `json:"sequence"`
+}
+
+func (m Migration) checksum() string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(m.SQL)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Migrate applies the migrations not yet recorded in the schema_migrations
+// table, in version order. The consecutive migrations run in a single
+// transaction, published with the DDL so the replicas apply the same schema
+// version atomically. A recorded version with a different SQL is a conflict.
+func Migrate(ctx context.Context, id string, migrations []Migration) (*MigrateResult, error) {
+	if ddlSyncDisabled {
+		return nil, ErrDDLSyncDisabled
+	}
+	muDBs.Lock()
+	connDB, ok := lookup(id)
+	muDBs.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("migrations %w", ErrMissingParameter)
+	}
+	migrations = slices.Clone(migrations)
+	slices.SortStableFunc(migrations, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	for i, m := range migrations {
+		if m.Version <= 0 || strings.TrimSpace(m.SQL) == "" {
+			return nil, fmt.Errorf("migration %d: version and sql %w", i, ErrMissingParameter)
+		}
+		if i > 0 && migrations[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migration version %d is duplicated", m.Version)
+		}
+	}
+
+	// written and published by this node like SetReadOnly
+	ctx = ha.ContextLocalDB(ctx, true)
+	if _, err := connDB.db.ExecContext(ctx, createMigrationsTable); err != nil {
+		return nil, fmt.Errorf("create migrations table: %w", err)
+	}
+	applied, err := appliedMigrations(ctx, connDB.db)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[int64]string, len(applied))
+	for _, m := range applied {
+		checksums[m.Version] = m.Checksum
+	}
+
+	var (
+		result MigrateResult
+		tx     *sql.Tx
+	)
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	commit := func() error {
+		if tx == nil {
+			return nil
+		}
+		err := tx.Commit()
+		tx = nil
+		return CommitError(err)
+	}
+	node, now := connDB.connector.NodeName(), time.Now().UTC().Format(time.RFC3339Nano)
+	for _, m := range migrations {
+		checksum := m.checksum()
+		if recorded, ok := checksums[m.Version]; ok {
+			if recorded != checksum {
+				return nil, fmt.Errorf("version %d: %w", m.Version, ErrMigrationConflict)
+			}
+			result.Skipped = append(result.Skipped, m.Version)
+			continue
+		}
+		var ex execer
+		if m.NoTransaction {
+			if err := commit(); err != nil {
+				return nil, err
+			}
+			if _, err := connDB.db.ExecContext(ctx, m.SQL); err != nil {
+				return nil, fmt.Errorf("migration %d: %w", m.Version, CommitError(err))
+			}
+			ex = connDB.db
+		} else {
+			if tx == nil {
+				if tx, err = connDB.db.BeginTx(ctx, nil); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+				return nil, fmt.Errorf("migration %d: %w", m.Version, err)
+			}
+			ex = tx
+		}
+		_, err := ex.ExecContext(ctx, "INSERT INTO "+migrationsTableName+"(version, name, checksum, node, applied_at) VALUES(?, ?, ?, ?, ?)",
+			m.Version, m.Name, checksum, node, now)
+		if err != nil {
+			return nil, fmt.Errorf("record migration %d: %w", m.Version, CommitError(err))
+		}
+		result.Applied = append(result.Applied, m.Version)
+	}
+	if err := commit(); err != nil {
+		return nil, err
+	}
+	result.Version = max(migrations[len(migrations)-1].Version, lastVersion(applied))
+	result.Sequence = connDB.connector.Publisher().Sequence()
+	if len(result.Applied) > 0 {
+		slog.Info("schema migrated", "id", id, "version", result.Version, "applied", result.Applied)
+	}
+	return &result, nil
+}
+
+// Migrations returns the migrations recorded in the database, an empty list
+// when it was never migrated.
+func Migrations(ctx context.Context, id string) ([]AppliedMigration, error) {
+	db, err := DB(id)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return []AppliedMigration{}, nil
+	}
+	return applied, err
+}
+
+func appliedMigrations(ctx context.Context, db *sql.DB) ([]AppliedMigration, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version, name, checksum, node, applied_at FROM "+migrationsTableName+" ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]AppliedMigration, 0)
+	for rows.Next() {
+		var (
+			m                     AppliedMigration
+			name, node, appliedAt sql.NullString
+		)
+		if err := rows.Scan(&m.Version, &name, &m.Checksum, &node, &appliedAt); err != nil {
+			return nil, err
+		}
+		m.Name, m.Node, m.AppliedAt = name.String, node.String, appliedAt.String
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+func lastVersion(applied []AppliedMigration) int64 {
+	if len(applied) == 0 {
+		return 0
+	}
+	return applied[len(applied)-1].Version
+}
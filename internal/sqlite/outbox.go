@@ -0,0 +1,206 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// OutboxMessage is a changeset of the async replication outbox, waiting to
+// be published.
+type OutboxMessage struct {
+	ID        int64     `json:"id"`
+	Subject   string    `json:"subject"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int64     `json:"size"`
+	// Attempts and Error are the failed publishes of a quarantined message
+	Attempts      int        `json:"attempts,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	QuarantinedAt *time.Time `json:"quarantined_at,omitempty"`
+}
+
+// Outbox is the state of the async replication outbox of a database, the
+// messages are listed oldest first, in publish order.
+type Outbox struct {
+	Pending          int64           `json:"pending"`
+	Oldest           *time.Time      `json:"oldest,omitempty"`
+	OldestAgeSeconds float64         `json:"oldest_age_seconds"`
+	Messages         []OutboxMessage `json:"messages"`
+	// Quarantined are the messages the stream kept refusing, set aside
+	Quarantined         int64           `json:"quarantined"`
+	QuarantinedMessages []OutboxMessage `json:"quarantined_messages"`
+}
+
+const (
+	outboxOrder = "ORDER BY timestamp, rowid"
+
+	outboxSchema = `CREATE TABLE IF NOT EXISTS ha_outbox(subject TEXT, changeset BLOB, timestamp DATETIME);
+CREATE TABLE IF NOT EXISTS ha_outbox_quarantine(subject TEXT, changeset BLOB, timestamp DATETIME, attempts INTEGER, error TEXT, quarantined_at DATETIME);`
+)
+
+// openOutbox opens the outbox file of the database, written by its
+// AsyncPublisher. The outbox is nil when nothing was published yet.
+func openOutbox(ctx context.Context, id string) (*sql.DB, error) {
+	muDBs.Lock()
+	connDB, ok := lookup(id)
+	muDBs.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	if connDB.outbox == "" {
+		return nil, fmt.Errorf("async replication outbox of %q %w", id, ErrNotFound)
+	}
+	return openOutboxFile(ctx, connDB.outbox)
+}
+
+// openOutboxFile opens the outbox file, nil when it does not exist.
+func openOutboxFile(ctx context.Context, file string) (*sql.DB, error) {
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	db, err := OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA busy_timeout = 5000", outboxSchema} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// InspectOutbox returns the pending and the quarantined messages of the
+// async replication outbox, up to limit each.
+func InspectOutbox(ctx context.Context, id string, limit int) (*Outbox, error) {
+	db, err := openOutbox(ctx, id)
+	if err != nil || db == nil {
+		return &Outbox{Messages: []OutboxMessage{}, QuarantinedMessages: []OutboxMessage{}}, err
+	}
+	defer db.Close()
+	var outbox Outbox
+	err = db.QueryRowContext(ctx, "SELECT (SELECT count(*) FROM ha_outbox), (SELECT count(*) FROM ha_outbox_quarantine)").
+		Scan(&outbox.Pending, &outbox.Quarantined)
+	if err != nil {
+		return nil, err
+	}
+	outbox.Messages, err = outboxMessages(ctx, db, "SELECT rowid, subject, timestamp, length(changeset), 0, '', NULL FROM ha_outbox "+outboxOrder+" LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	outbox.QuarantinedMessages, err = outboxMessages(ctx, db, "SELECT rowid, subject, timestamp, length(changeset), attempts, error, quarantined_at FROM ha_outbox_quarantine "+outboxOrder+" LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(outbox.Messages) > 0 {
+		oldest := outbox.Messages[0].Timestamp
+		outbox.Oldest = &oldest
+		outbox.OldestAgeSeconds = time.Since(oldest).Seconds()
+	}
+	return &outbox, nil
+}
+
+func outboxMessages(ctx context.Context, db *sql.DB, query string, limit int) ([]OutboxMessage, error) {
+	rows, err := db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make([]OutboxMessage, 0)
+	for rows.Next() {
+		var (
+			msg           OutboxMessage
+			quarantinedAt sql.NullTime
+		)
+		if err := rows.Scan(&msg.ID, &msg.Subject, &msg.Timestamp, &msg.Size, &msg.Attempts, &msg.Error, &quarantinedAt); err != nil {
+			return nil, err
+		}
+		if quarantinedAt.Valid {
+			msg.QuarantinedAt = &quarantinedAt.Time
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// DeleteOutboxMessage removes a message from the outbox, or from its
+// quarantine, like a poisoned changeset the stream keeps rejecting. Its
+// changes are not replicated.
+func DeleteOutboxMessage(ctx context.Context, id string, msgID int64, quarantined bool) error {
+	db, err := openOutbox(ctx, id)
+	if err != nil {
+		return err
+	}
+	if db == nil {
+		return fmt.Errorf("outbox message %d %w", msgID, ErrNotFound)
+	}
+	defer db.Close()
+	table := "ha_outbox"
+	if quarantined {
+		table = "ha_outbox_quarantine"
+	}
+	res, err := db.ExecContext(ctx, "DELETE FROM "+table+" WHERE rowid = ?", msgID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("outbox message %d %w", msgID, ErrNotFound)
+	}
+	return nil
+}
+
+// RequeueOutboxMessage moves a quarantined message back to the outbox, at
+// its place in publish order, to publish it again once the cause is fixed.
+func RequeueOutboxMessage(ctx context.Context, id string, msgID int64) error {
+	db, err := openOutbox(ctx, id)
+	if err != nil {
+		return err
+	}
+	if db == nil {
+		return fmt.Errorf("quarantined outbox message %d %w", msgID, ErrNotFound)
+	}
+	defer db.Close()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "INSERT INTO ha_outbox(subject, changeset, timestamp) SELECT subject, changeset, timestamp FROM ha_outbox_quarantine WHERE rowid = ?", msgID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("quarantined outbox message %d %w", msgID, ErrNotFound)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM ha_outbox_quarantine WHERE rowid = ?", msgID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// FlushOutbox publishes the pending messages in order without waiting for
+// the background relay, and returns how many were published. It stops at the
+// first message the stream rejects.
+func FlushOutbox(ctx context.Context, id string) (int, error) {
+	muDBs.Lock()
+	connDB, ok := lookup(id)
+	muDBs.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	var pub *AsyncPublisher
+	if connDB.publisher != nil {
+		connDB.publisher.mu.RLock()
+		pub, _ = connDB.publisher.pub.(*AsyncPublisher)
+		connDB.publisher.mu.RUnlock()
+	}
+	if pub == nil {
+		return 0, fmt.Errorf("async replication outbox of %q %w", id, ErrNotFound)
+	}
+	return pub.Flush(ctx)
+}
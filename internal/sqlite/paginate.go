@@ -0,0 +1,153 @@
+package sqlite
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	sqlparser "github.com/rqlite/sql"
+)
+
+var ErrInvalidPage = errors.New("invalid page")
+
+// Page is the window of the rows of a query returned by a request.
+type Page struct {
+	Limit  int
+	Offset int
+	// query identifies the statement the cursors are valid for
+	query string
+}
+
+type cursor struct {
+	Limit  int    `json:"l"`
+	Offset int    `json:"o"`
+	Query  string `json:"q"`
+}
+
+// Paginate wraps the query with the window of rows the request asks with
+// limit, offset or cursor, bounded by maxRows (0 is unlimited). It returns a
+// nil page for the statements not paginated: the writes, and the queries
+// without a window to apply; the queries starting with WITH, that may be
+// writes, are only paginated when asked. One more row than the limit is read
+// to know whether a next page exists.
+func Paginate(req Request, maxRows int) (Request, *Page, error) {
+	paginated := req.Limit != nil || req.Offset > 0 || req.Cursor != ""
+	query := strings.TrimRight(strings.TrimSpace(req.Sql), "; \t\r\n")
+	upper := strings.ToUpper(query)
+	selects := strings.HasPrefix(upper, "SELECT") || strings.HasPrefix(upper, "VALUES") || paginated && strings.HasPrefix(upper, "WITH")
+	if !selects || multipleStatements(query) {
+		if paginated {
+			return req, nil, fmt.Errorf("%w: limit, offset and cursor apply to a single SELECT statement", ErrInvalidPage)
+		}
+		return req, nil, nil
+	}
+	if !paginated && maxRows <= 0 {
+		return req, nil, nil
+	}
+	page := &Page{query: queryHash(query, req.Params)}
+	if req.Cursor != "" {
+		c, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return req, nil, err
+		}
+		if c.Query != page.query {
+			return req, nil, fmt.Errorf("%w: the cursor belongs to another query", ErrInvalidPage)
+		}
+		page.Limit, page.Offset = c.Limit, c.Offset
+	}
+	if req.Limit != nil {
+		if *req.Limit <= 0 {
+			return req, nil, fmt.Errorf("%w: limit must be positive", ErrInvalidPage)
+		}
+		page.Limit = *req.Limit
+	}
+	if req.Offset < 0 {
+		return req, nil, fmt.Errorf("%w: offset must not be negative", ErrInvalidPage)
+	}
+	if req.Cursor == "" {
+		page.Offset = req.Offset
+	}
+	if maxRows > 0 && (page.Limit <= 0 || page.Limit > maxRows) {
+		page.Limit = maxRows
+	}
+	if page.Limit <= 0 {
+		// an offset alone returns all the following rows
+		req.Sql = window(query, -1, page.Offset)
+		return req, nil, nil
+	}
+	req.Sql = window(query, page.Limit+1, page.Offset)
+	return req, page, nil
+}
+
+// window returns the query limited to the rows. A SELECT without its own
+// LIMIT takes the clause, after a newline ending a trailing comment; the
+// other queries are wrapped in a subquery, which renames their duplicate
+// columns.
+func window(query string, limit, offset int) string {
+	stmt, err := sqlparser.NewParser(strings.NewReader(query)).ParseStatement()
+	if sel, ok := stmt.(*sqlparser.SelectStatement); err == nil && ok && sel.LimitExpr == nil {
+		return fmt.Sprintf("%s\nLIMIT %d OFFSET %d", query, limit, offset)
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) LIMIT %d OFFSET %d", query, limit, offset)
+}
+
+// multipleStatements reports whether the query, without its trailing
+// semicolons, has several statements: the semicolons of the string literals,
+// quoted identifiers and comments don't separate statements.
+func multipleStatements(query string) bool {
+	if !strings.Contains(query, ";") {
+		return false
+	}
+	scanner := sqlparser.NewScanner(strings.NewReader(query))
+	for {
+		_, tok, _ := scanner.Scan()
+		switch tok {
+		case sqlparser.EOF:
+			return false
+		case sqlparser.SEMI:
+			return true
+		}
+	}
+}
+
+// Apply drops the extra row read by the paginated query, and returns the
+// cursor of the next page, empty on the last one.
+func (p *Page) Apply(res *Response) string {
+	if p == nil || len(res.Rows) <= p.Limit {
+		return ""
+	}
+	res.Rows = res.Rows[:p.Limit]
+	return encodeCursor(cursor{Limit: p.Limit, Offset: p.Offset + p.Limit, Query: p.query})
+}
+
+func queryHash(query string, params map[string]any) string {
+	h := fnv.New64a()
+	h.Write([]byte(query))
+	if len(params) > 0 {
+		// map keys are encoded sorted
+		b, _ := json.Marshal(params)
+		h.Write(b)
+	}
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil || c.Limit <= 0 || c.Offset < 0 {
+		return c, fmt.Errorf("%w: malformed cursor", ErrInvalidPage)
+	}
+	return c, nil
+}
@@ -0,0 +1,75 @@
+package sqlite_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestPaginate(t *testing.T) {
+	limit := 2
+	req, page, err := sqlite.Paginate(sqlite.Request{Sql: "SELECT * FROM users ORDER BY id;", Limit: &limit}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SELECT * FROM users ORDER BY id\nLIMIT 3 OFFSET 0"; req.Sql != want {
+		t.Errorf("got %q, want %q", req.Sql, want)
+	}
+	res := &sqlite.Response{Rows: [][]any{{1}, {2}, {3}}}
+	cursor := page.Apply(res)
+	if len(res.Rows) != 2 || cursor == "" {
+		t.Fatalf("got %d rows and cursor %q, want 2 rows and a cursor", len(res.Rows), cursor)
+	}
+
+	req, page, err = sqlite.Paginate(sqlite.Request{Sql: "SELECT * FROM users ORDER BY id", Cursor: cursor}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SELECT * FROM users ORDER BY id\nLIMIT 3 OFFSET 2"; req.Sql != want {
+		t.Errorf("got %q, want %q", req.Sql, want)
+	}
+	if cursor := page.Apply(&sqlite.Response{Rows: [][]any{{3}}}); cursor != "" {
+		t.Errorf("got cursor %q on the last page", cursor)
+	}
+
+	if _, _, err := sqlite.Paginate(sqlite.Request{Sql: "SELECT * FROM orders", Cursor: cursor}, 0); !errors.Is(err, sqlite.ErrInvalidPage) {
+		t.Errorf("cursor of another query: got %v, want %v", err, sqlite.ErrInvalidPage)
+	}
+	if _, _, err := sqlite.Paginate(sqlite.Request{Sql: "DELETE FROM users", Limit: &limit}, 0); !errors.Is(err, sqlite.ErrInvalidPage) {
+		t.Errorf("paginated write: got %v, want %v", err, sqlite.ErrInvalidPage)
+	}
+
+	// the server cap applies without a window asked, but not to the writes
+	if _, page, _ = sqlite.Paginate(sqlite.Request{Sql: "SELECT * FROM users"}, 100); page == nil || page.Limit != 100 {
+		t.Errorf("got page %+v, want the limit capped to 100", page)
+	}
+	if _, page, _ = sqlite.Paginate(sqlite.Request{Sql: "WITH x AS (SELECT 1) INSERT INTO t SELECT * FROM x"}, 100); page != nil {
+		t.Errorf("write paginated by the cap")
+	}
+
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		// the duplicate columns keep their names
+		{sql: "SELECT u.id, o.id FROM users u JOIN orders o ON o.user_id = u.id", want: "SELECT u.id, o.id FROM users u JOIN orders o ON o.user_id = u.id\nLIMIT 101 OFFSET 0"},
+		{sql: "SELECT * FROM users -- all of them", want: "SELECT * FROM users -- all of them\nLIMIT 101 OFFSET 0"},
+		{sql: "SELECT 'a;b' AS s;", want: "SELECT 'a;b' AS s\nLIMIT 101 OFFSET 0"},
+		{sql: "SELECT \"a;b\" FROM t /* ; */", want: "SELECT \"a;b\" FROM t /* ; */\nLIMIT 101 OFFSET 0"},
+		{sql: "SELECT * FROM users LIMIT 500", want: "SELECT * FROM (SELECT * FROM users LIMIT 500) LIMIT 101 OFFSET 0"},
+	}
+	for _, tt := range tests {
+		req, page, err := sqlite.Paginate(sqlite.Request{Sql: tt.sql}, 100)
+		if err != nil || page == nil {
+			t.Errorf("%s: got page %v, error %v", tt.sql, page, err)
+			continue
+		}
+		if req.Sql != tt.want {
+			t.Errorf("got %q, want %q", req.Sql, tt.want)
+		}
+	}
+	if _, _, err := sqlite.Paginate(sqlite.Request{Sql: "SELECT 1; SELECT 2", Limit: &limit}, 0); !errors.Is(err, sqlite.ErrInvalidPage) {
+		t.Errorf("paginated statements: got %v, want %v", err, sqlite.ErrInvalidPage)
+	}
+}
@@ -0,0 +1,59 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/litesql/go-ha"
+)
+
+// ErrMissingParameter is returned when a statement references a parameter not
+// present in the request. A parameter explicitly set to null (JSON null, a
+// NULL pgwire parameter) is bound as SQL NULL, while an absent one is an error
+// instead of being silently bound as NULL.
+var ErrMissingParameter = errors.New("missing parameter")
+
+// CheckParameters verifies that every bind parameter name has a value in
+// params. Anonymous (?) and numbered (?NNN) parameters are not checked.
+func CheckParameters(names []string, params map[string]any) error {
+	for _, name := range names {
+		if len(name) < 2 || name[0] == '?' {
+			continue
+		}
+		if _, ok := params[name]; ok {
+			continue
+		}
+		if name[0] == '$' {
+			if _, err := strconv.Atoi(name[1:]); err == nil {
+				return fmt.Errorf("%w %q", ErrMissingParameter, name)
+			}
+		}
+		if _, ok := params[name[1:]]; !ok {
+			return fmt.Errorf("%w %q", ErrMissingParameter, name)
+		}
+	}
+	return nil
+}
+
+// checkStatementParameters checks the parameters of every statement of the
+// query. ha.Parse caches the statements, the driver then executes them
+// without parsing the query again.
+func checkStatementParameters(ctx context.Context, query string, params map[string]any) error {
+	if !strings.ContainsAny(query, ":@$") {
+		return nil
+	}
+	stmts, err := ha.Parse(ctx, query)
+	if err != nil {
+		// let SQLite report the syntax error
+		return nil
+	}
+	for _, stmt := range stmts {
+		if err := CheckParameters(stmt.Parameters(), params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
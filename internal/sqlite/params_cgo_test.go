@@ -0,0 +1,94 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/litesql/go-ha"
+	sqlite3ha "github.com/litesql/go-sqlite3-ha"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// TestNullReplication binds a null, an empty string and a missing parameter,
+// and applies the changesets on another node: NULL and the empty string stay
+// distinct in the NewValues and in the replica, the missing parameter is
+// refused.
+func TestNullReplication(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	pub := new(recorder)
+	connector, err := sqlite3ha.NewConnector("file:"+filepath.Join(dir, "src.db"),
+		ha.WithName("node1"), ha.WithReplicationPublisher(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := sql.OpenDB(connector)
+	defer src.Close()
+	dst, err := sql.Open("sqlite3", filepath.Join(dir, "dst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	const schema = "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT DEFAULT 'unset')"
+	for _, db := range []*sql.DB{src, dst} {
+		if _, err := db.Exec(schema); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statements := []sqlite.Request{
+		{Sql: "INSERT INTO items (id, name) VALUES (1, :name)", Params: map[string]any{"name": nil}},
+		{Sql: "INSERT INTO items (id, name) VALUES (2, :name)", Params: map[string]any{"name": ""}},
+		{Sql: "INSERT INTO items (id, name) VALUES (3, 'x')"},
+		{Sql: "UPDATE items SET name = :name WHERE id = 3", Params: map[string]any{"name": nil}},
+	}
+	for _, stmt := range statements {
+		if _, err := sqlite.Exec(ctx, src, stmt.Sql, stmt.Params); err != nil {
+			t.Fatalf("%s: %v", stmt.Sql, err)
+		}
+	}
+	for _, stmt := range []sqlite.Request{
+		{Sql: "INSERT INTO items (id, name) VALUES (4, :name)", Params: map[string]any{}},
+		{Sql: "INSERT INTO items (id) VALUES (:id); INSERT INTO items (id, name) VALUES (5, :name)", Params: map[string]any{"id": 4}},
+	} {
+		if _, err := sqlite.Exec(ctx, src, stmt.Sql, stmt.Params); !errors.Is(err, sqlite.ErrMissingParameter) {
+			t.Errorf("%s: got %v, want ErrMissingParameter", stmt.Sql, err)
+		}
+	}
+
+	var values []any
+	for _, data := range pub.messages {
+		cs := ha.NewChangeSet("node2", "")
+		if err := json.Unmarshal(data, cs); err != nil {
+			t.Fatal(err)
+		}
+		for _, change := range cs.Changes {
+			if change.Operation == "INSERT" || change.Operation == "UPDATE" {
+				values = append(values, change.NewValues[1])
+			}
+		}
+		cs.SetConnProvider(noHooks{})
+		if err := cs.Apply(dst); err != nil {
+			t.Fatalf("apply %s: %v", data, err)
+		}
+	}
+	if want := []any{nil, "", "x", nil}; !reflect.DeepEqual(values, want) {
+		t.Errorf("published name values = %#v, want %#v", values, want)
+	}
+
+	const query = "SELECT id, name, typeof(name) FROM items ORDER BY id"
+	want := [][]any{{int64(1), nil, "null"}, {int64(2), "", "text"}, {int64(3), nil, "null"}}
+	for name, db := range map[string]*sql.DB{"source": src, "replica": dst} {
+		if got := rows(t, db, query); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s rows = %#v, want %#v", name, got, want)
+		}
+	}
+}
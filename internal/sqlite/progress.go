@@ -0,0 +1,309 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRunning is returned when a statement is started with the request id of a
+// running one.
+var ErrRunning = errors.New("a statement is already running with this request id")
+
+var progressChunkSize = 10000
+
+// SetProgressChunkSize sets the number of table rows read by each range of a
+// chunked statement.
+func SetProgressChunkSize(size int) {
+	if size > 0 {
+		progressChunkSize = size
+	}
+}
+
+// Progress is the status of a running statement. For the chunked statements
+// the estimated rows extrapolates the rows affected so far to the whole table.
+type Progress struct {
+	ID            string    `json:"id"`
+	Database      string    `json:"database"`
+	SQL           string    `json:"sql"`
+	StartedAt     time.Time `json:"started_at"`
+	ElapsedMs     int64     `json:"elapsed_ms"`
+	Chunked       bool      `json:"chunked"`
+	TotalRows     int64     `json:"total_rows,omitempty"`
+	ScannedRows   int64     `json:"scanned_rows,omitempty"`
+	RowsAffected  int64     `json:"rows_affected"`
+	EstimatedRows int64     `json:"estimated_rows,omitempty"`
+	Percent       float64   `json:"percent,omitempty"`
+	RemainingMs   int64     `json:"remaining_ms,omitempty"`
+	Canceled      bool      `json:"canceled,omitempty"`
+}
+
+type runningStatement struct {
+	mu       sync.Mutex
+	progress Progress
+	cancel   context.CancelFunc
+}
+
+func (r *runningStatement) update(fn func(p *Progress)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.progress)
+}
+
+func (r *runningStatement) status() Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.progress
+	elapsed := time.Since(p.StartedAt)
+	p.ElapsedMs = elapsed.Milliseconds()
+	if p.Chunked && p.TotalRows > 0 && p.ScannedRows > 0 {
+		done := min(float64(p.ScannedRows)/float64(p.TotalRows), 1)
+		p.Percent = math.Round(done*1000) / 10
+		p.EstimatedRows = int64(float64(p.RowsAffected) / done)
+		p.RemainingMs = int64(float64(p.ElapsedMs) * (1 - done) / done)
+	}
+	return p
+}
+
+var (
+	muRunning sync.Mutex
+	running   = make(map[string]*runningStatement)
+)
+
+// Running returns the statements executed with a request id, oldest first.
+func Running() []Progress {
+	muRunning.Lock()
+	list := make([]Progress, 0, len(running))
+	for _, r := range running {
+		list = append(list, r.status())
+	}
+	muRunning.Unlock()
+	slices.SortFunc(list, func(a, b Progress) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+	return list
+}
+
+// RunningStatus returns the progress of the statement with the request id.
+func RunningStatus(id string) (Progress, error) {
+	muRunning.Lock()
+	defer muRunning.Unlock()
+	r, ok := running[id]
+	if !ok {
+		return Progress{}, fmt.Errorf("statement %q %w", id, ErrNotFound)
+	}
+	return r.status(), nil
+}
+
+// Cancel interrupts the statement with the request id. Its transaction is
+// rolled back.
+func Cancel(id string) (Progress, error) {
+	muRunning.Lock()
+	defer muRunning.Unlock()
+	r, ok := running[id]
+	if !ok {
+		return Progress{}, fmt.Errorf("statement %q %w", id, ErrNotFound)
+	}
+	r.update(func(p *Progress) {
+		p.Canceled = true
+	})
+	r.cancel()
+	return r.status(), nil
+}
+
+// ExecProgress executes a statement tracked by the request id until it
+// returns, so its progress can be read and the statement canceled. A single
+// table UPDATE or DELETE runs in a transaction by rowid ranges of
+// SetProgressChunkSize rows; other statements only report the elapsed time.
+// The ranges stand for the SQLite progress handler, which the driver does not
+// expose and which counts instructions rather than rows.
+func ExecProgress(ctx context.Context, id, dbID string, db *sql.DB, query string, params map[string]any) (*Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := &runningStatement{
+		progress: Progress{
+			ID:        id,
+			Database:  dbID,
+			SQL:       query,
+			StartedAt: time.Now(),
+		},
+		cancel: cancel,
+	}
+	muRunning.Lock()
+	if _, ok := running[id]; ok {
+		muRunning.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrRunning, id)
+	}
+	running[id] = r
+	muRunning.Unlock()
+	defer func() {
+		muRunning.Lock()
+		delete(running, id)
+		muRunning.Unlock()
+	}()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = QueryContext(ctx, 0)
+		defer cancelTimeout()
+	}
+	if err := checkStatementParameters(ctx, query, params); err != nil {
+		return nil, err
+	}
+	if c, ok := ChunkStatement(query); ok {
+		res, err := execChunked(ctx, db, c, params, r)
+		if !errors.Is(err, errNotChunkable) {
+			return res, canceledError(ctx, r, err)
+		}
+	}
+	res, err := Exec(ctx, db, query, params)
+	return res, canceledError(ctx, r, err)
+}
+
+func canceledError(ctx context.Context, r *runningStatement, err error) error {
+	if err != nil && r.status().Canceled && errors.Is(ctx.Err(), context.Canceled) {
+		return fmt.Errorf("statement canceled: %w", context.Canceled)
+	}
+	return err
+}
+
+var errNotChunkable = errors.New("statement not chunkable")
+
+func execChunked(ctx context.Context, db *sql.DB, c *Chunked, params map[string]any, r *runningStatement) (*Response, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rowid, err := chunkRowid(ctx, conn, c)
+	if err != nil {
+		return nil, err
+	}
+	if rowid == "" {
+		return nil, errNotChunkable
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var total, lo int64
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT count(*), coalesce(min(%s), 0) FROM %s", rowid, c.Name)).Scan(&total, &lo); err != nil {
+		return nil, err
+	}
+	r.update(func(p *Progress) {
+		p.Chunked = true
+		p.TotalRows = total
+	})
+
+	args := getArgs(params)
+	boundary := fmt.Sprintf("SELECT %s FROM %s WHERE %s >= ? ORDER BY %s LIMIT 1 OFFSET ?", rowid, c.Name, rowid, rowid)
+	var affected int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var hi int64
+		last := false
+		err := tx.QueryRowContext(ctx, boundary, lo, progressChunkSize-1).Scan(&hi)
+		if errors.Is(err, sql.ErrNoRows) {
+			hi, last = math.MaxInt64, true
+		} else if err != nil {
+			return nil, err
+		}
+		res, err := tx.ExecContext(ctx, c.Range(rowid, lo, hi), args...)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := res.RowsAffected()
+		affected += n
+		r.update(func(p *Progress) {
+			p.RowsAffected = affected
+			p.ScannedRows = min(p.ScannedRows+int64(progressChunkSize), total)
+		})
+		if last || hi == math.MaxInt64 {
+			break
+		}
+		lo = hi + 1
+	}
+	if err := WithIdentity(ctx, db, tx.Commit); err != nil {
+		return nil, err
+	}
+	r.update(func(p *Progress) {
+		p.ScannedRows = total
+	})
+	res := &Response{
+		Columns:      []string{"rows_affected", "last_insert_id"},
+		Rows:         [][]any{{affected, int64(0)}},
+		RowsAffected: affected,
+		NoReturning:  true,
+	}
+	if typedValuesEnabled(ctx) {
+		typeValues(res, nil)
+	}
+	return res, nil
+}
+
+// chunkRowid returns the name of the rowid of an ordinary rowid table not
+// shadowed by a column, or empty when the statement must not be chunked: an
+// UPDATE of the primary key or rowid could move rows to the next ranges.
+func chunkRowid(ctx context.Context, conn *sql.Conn, c *Chunked) (string, error) {
+	schema := c.Schema
+	if schema == "" {
+		schema = "main"
+	}
+	var (
+		typ          string
+		withoutRowid bool
+	)
+	err := conn.QueryRowContext(ctx, "SELECT type, wr FROM pragma_table_list WHERE schema = ? AND name = ?", schema, c.Table).Scan(&typ, &withoutRowid)
+	if errors.Is(err, sql.ErrNoRows) {
+		// temp table or unknown, let SQLite report it
+		return "", nil
+	}
+	if err != nil || typ != "table" || withoutRowid {
+		return "", err
+	}
+	rows, err := conn.QueryContext(ctx, "SELECT name, pk FROM pragma_table_info(?, ?)", c.Table, schema)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var columns, pk []string
+	for rows.Next() {
+		var (
+			name string
+			key  int
+		)
+		if err := rows.Scan(&name, &key); err != nil {
+			return "", err
+		}
+		columns = append(columns, strings.ToLower(name))
+		if key > 0 {
+			pk = append(pk, strings.ToLower(name))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	aliases := []string{"rowid", "_rowid_", "oid"}
+	for _, assigned := range c.Assigned {
+		assigned = strings.ToLower(assigned)
+		if slices.Contains(pk, assigned) || slices.Contains(aliases, assigned) {
+			return "", nil
+		}
+	}
+	for _, alias := range aliases {
+		if !slices.Contains(columns, alias) {
+			return alias, nil
+		}
+	}
+	return "", nil
+}
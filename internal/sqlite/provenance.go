@@ -0,0 +1,54 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/litesql/go-ha"
+)
+
+var (
+	// node name and release returned by ha_node() and ha_version()
+	provenanceNode    string
+	provenanceVersion string
+	// connectors of the loaded databases by id for ha_seq(), read without
+	// muDBs: a trigger may call it while a database is loading
+	connectors sync.Map
+)
+
+// SetNodeInfo sets the node name and the release returned by the SQL
+// functions ha_node() and ha_version().
+func SetNodeInfo(node, version string) {
+	provenanceNode = node
+	provenanceVersion = version
+}
+
+func nodeFunc() string {
+	return provenanceNode
+}
+
+func versionFunc() string {
+	return provenanceVersion
+}
+
+// databaseOf returns the database id of the file of a connection, nil for
+// the private databases.
+func databaseOf(filename string) any {
+	if filename == "" {
+		return nil
+	}
+	return filepath.Base(filename)
+}
+
+// seqFunc implements ha_seq(database), the last stream sequence the node
+// applied to the database, NULL when it is not loaded.
+func seqFunc(id any) any {
+	if isNull(id) {
+		return nil
+	}
+	connector, ok := connectors.Load(toText(id))
+	if !ok {
+		return nil
+	}
+	return int64(connector.(*ha.Connector).LatestSeq())
+}
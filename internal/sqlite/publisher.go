@@ -0,0 +1,216 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/litesql/go-ha"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/litesql/ha/internal/session"
+	"github.com/litesql/ha/internal/tracing"
+)
+
+// PublisherFactory creates the replication publisher of a database. It is
+// called after the connector is created, so the embedded NATS server is
+// already running.
+type PublisherFactory func(replicationID, stream string) (ha.Publisher, error)
+
+var natsIdentifierNormalizer = regexp.MustCompile(`[.\/\s*>*]`)
+
+// NatsSubject returns the replication subject of the database, the same used
+// by the go-ha NATS publisher and subscriber.
+func NatsSubject(stream, replicationID string) string {
+	return fmt.Sprintf("%s.%s", stream, natsIdentifier(replicationID))
+}
+
+// ConsumerName returns the durable JetStream consumer name the node uses to
+// apply the database changes.
+func ConsumerName(replicationID, node string) string {
+	return natsIdentifier(replicationID + "_" + node)
+}
+
+func natsIdentifier(name string) string {
+	s := natsIdentifierNormalizer.ReplaceAllString(name, "_")
+	s = strings.Trim(s, "_")
+	if len(s) > 32 {
+		s = s[len(s)-32:]
+	}
+	return s
+}
+
+// ErrRebuilding is returned by the commits while the database is replaced
+// by a snapshot, see Resync.
+var ErrRebuilding = errors.New("the database is being rebuilt from a snapshot")
+
+// ErrRolledBack wraps the cause of a commit rolled back by the publisher.
+var ErrRolledBack = errors.New("transaction rolled back")
+
+// lastPublishError is the cause of the last changeset the publisher refused,
+// SQLite only reports a failed commit hook to the committing statement.
+var lastPublishError atomic.Pointer[error]
+
+// CommitError returns the cause of a commit rolled back because the
+// changeset was not published, instead of the opaque commit hook error.
+func CommitError(err error) error {
+	if err == nil || !isCommitHookError(err) {
+		return err
+	}
+	if cause := lastPublishError.Load(); cause != nil {
+		return fmt.Errorf("%w: %w", ErrRolledBack, *cause)
+	}
+	return err
+}
+
+var publishHooks []func(*ha.ChangeSet)
+
+// OnPublish registers fn to be called with the changesets published by this
+// node, before the databases are loaded. With --async-replication it is
+// called once the changeset is written to the outbox.
+func OnPublish(fn func(*ha.ChangeSet)) {
+	publishHooks = append(publishHooks, fn)
+}
+
+type lazyPublisher struct {
+	mu       sync.RWMutex
+	pub      ha.Publisher
+	paused   bool
+	readOnly *atomic.Bool
+	// identity of the session committing, see WithIdentity
+	commitMu sync.Mutex
+	identity atomic.Pointer[session.Identity]
+	// databases attached to the transaction committing, see
+	// AttachedTransaction
+	routes atomic.Pointer[map[string]*attachedDB]
+	// statements of the transaction committing, see withStatements
+	statements atomic.Pointer[[]ha.Change]
+	// span of the statement committing, the parent of the publish span
+	spanContext atomic.Pointer[trace.SpanContext]
+}
+
+func (p *lazyPublisher) start(factory PublisherFactory, replicationID, stream string) error {
+	pub, err := factory(replicationID, stream)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pub = pub
+	return nil
+}
+
+func (p *lazyPublisher) Publish(cs *ha.ChangeSet) (err error) {
+	parent := p.spanContext.Load()
+	if parent == nil {
+		return p.publish(context.Background(), cs)
+	}
+	ctx, span := tracing.StartKind(trace.ContextWithSpanContext(context.Background(), *parent), "replication publish", trace.SpanKindProducer,
+		attribute.String("ha.database", cs.Filename),
+	)
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("ha.changes", len(cs.Changes)),
+			attribute.Int64("ha.stream_seq", int64(p.Sequence())),
+		)
+		tracing.End(span, err)
+	}()
+	return p.publish(ctx, cs)
+}
+
+// publish publishes the changeset, with the trace context of ctx.
+func (p *lazyPublisher) publish(ctx context.Context, cs *ha.ChangeSet) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.pub == nil {
+		return errors.New("replication publisher not started")
+	}
+	if p.paused {
+		err := fmt.Errorf("%s: %w", cs.Filename, ErrRebuilding)
+		lastPublishError.Store(&err)
+		return err
+	}
+	// rejecting the changeset rolls back the local transaction, whatever
+	// frontend executed it
+	if (p.readOnly != nil && p.readOnly.Load() || writesStopped.Load()) && !allowedOnReadOnly(cs) {
+		err := fmt.Errorf("%s: %w", cs.Filename, ErrReadOnly)
+		lastPublishError.Store(&err)
+		return err
+	}
+	retract := func() error { return nil }
+	if routes := p.routes.Load(); routes != nil {
+		var err error
+		if retract, err = publishLinked(cs, *routes, p.identity.Load()); err != nil {
+			lastPublishError.Store(&err)
+			return err
+		}
+		if len(cs.Changes) == 0 {
+			return nil
+		}
+	}
+	if statements := p.statements.Load(); statements != nil {
+		replaceWithStatements(cs, *statements)
+	}
+	if id := p.identity.Load(); id != nil {
+		session.Attach(cs, *id)
+	}
+	// the replicas apply the changes in the trace of the publish span
+	tracing.Attach(ctx, cs)
+	if err := p.pub.Publish(cs); err != nil {
+		err = errors.Join(err, retract())
+		lastPublishError.Store(&err)
+		return err
+	}
+	applyFlagChanges(cs)
+	for _, fn := range publishHooks {
+		fn(cs)
+	}
+	return nil
+}
+
+// async reports whether the changesets are relayed to the stream after the
+// commit, by an AsyncPublisher.
+func (p *lazyPublisher) async() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.pub.(*AsyncPublisher)
+	return ok
+}
+
+// pause makes the publishes fail until resumed, once the running ones
+// returned. A nil publisher is ignored.
+func (p *lazyPublisher) pause(paused bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+}
+
+func (p *lazyPublisher) Sequence() uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.pub == nil {
+		return 0
+	}
+	return p.pub.Sequence()
+}
+
+func (p *lazyPublisher) Close() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if closer, ok := p.pub.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
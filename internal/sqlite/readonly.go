@@ -0,0 +1,156 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/litesql/go-ha"
+)
+
+const readOnlyTableName = "ha_readonly"
+
+// ErrReadOnly is returned for the write statements on a read-only database.
+var ErrReadOnly = errors.New("database is read-only")
+
+const createReadOnlyTable = `CREATE TABLE IF NOT EXISTS ` + readOnlyTableName + `(
+	read_only INTEGER NOT NULL,
+	node TEXT,
+	updated_at TEXT,
+	CHECK (rowid = 1)
+)`
+
+// ReadOnly reports whether the database rejects writes.
+func ReadOnly(id string) bool {
+	muDBs.Lock()
+	connDB, ok := lookup(id)
+	muDBs.Unlock()
+	return ok && (connDB.readOnly.Load() || writesStopped.Load())
+}
+
+// SetReadOnly flips the write acceptance of the database. The flag is stored
+// in the ha_readonly table, so it survives restarts and snapshots and reaches
+// the other nodes as a replicated change.
+func SetReadOnly(ctx context.Context, id string, readOnly bool) error {
+	muDBs.Lock()
+	connDB, ok := lookup(id)
+	muDBs.Unlock()
+	if !ok {
+		return fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	// the change is written and published by this node even on a follower,
+	// a redirect to the leader would not update the flag here
+	ctx = ha.ContextLocalDB(ctx, true)
+	var exists bool
+	err := connDB.db.QueryRowContext(ctx, "SELECT count(*) > 0 FROM sqlite_schema WHERE type = 'table' AND name = ?", readOnlyTableName).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if !readOnly {
+			return nil
+		}
+		// a missing table means writable, creating it is still allowed
+		if _, err := connDB.db.ExecContext(ctx, createReadOnlyTable); err != nil {
+			return fmt.Errorf("create read-only table: %w", err)
+		}
+	}
+	node, now := connDB.connector.NodeName(), time.Now().UTC().Format(time.RFC3339Nano)
+	res, err := connDB.db.ExecContext(ctx, "UPDATE "+readOnlyTableName+" SET read_only = ?, node = ?, updated_at = ?", readOnly, node, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = connDB.db.ExecContext(ctx, "INSERT INTO "+readOnlyTableName+"(read_only, node, updated_at) VALUES(?, ?, ?)", readOnly, node, now)
+		if err != nil {
+			return err
+		}
+	}
+	connDB.readOnly.Store(readOnly)
+	slog.Info("database write acceptance changed", "id", id, "read_only", readOnly)
+	return nil
+}
+
+// CheckWritable returns ErrReadOnly if the query modifies a read-only
+// database. Queries the parser rejects are left to SQLite.
+func CheckWritable(ctx context.Context, id, query string) error {
+	if !ReadOnly(id) {
+		return nil
+	}
+	stmts, err := ha.Parse(ctx, query)
+	if err != nil {
+		return nil
+	}
+	for _, stmt := range stmts {
+		if stmt.ModifiesDatabase() {
+			return fmt.Errorf("database %q: %w", id, ErrReadOnly)
+		}
+	}
+	return nil
+}
+
+func loadReadOnly(ctx context.Context, querier querier) (bool, error) {
+	var readOnly bool
+	rows, err := querier.QueryContext(ctx, "SELECT read_only FROM "+readOnlyTableName)
+	if err != nil {
+		// the table is created by the first toggle
+		if strings.Contains(err.Error(), "no such table") {
+			return false, nil
+		}
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := rows.Scan(&readOnly); err != nil {
+			return false, err
+		}
+	}
+	return readOnly, rows.Err()
+}
+
+// allowedOnReadOnly reports whether the changeset only toggles the read-only
+// flag or replicates the planner statistics.
+func allowedOnReadOnly(cs *ha.ChangeSet) bool {
+	for _, change := range cs.Changes {
+		if change.Table != readOnlyTableName && change.Table != statsTableName {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadOnlyInterceptor reloads the read-only flag when a toggle is replicated
+// from another node.
+type ReadOnlyInterceptor struct{}
+
+func (ReadOnlyInterceptor) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	if !touchesTable(cs, readOnlyTableName) {
+		return false, nil
+	}
+	// the DDL is not replicated with --disable-ddl-sync
+	_, err := conn.ExecContext(ha.ContextLocalDB(context.Background(), true), createReadOnlyTable)
+	return false, err
+}
+
+func (ReadOnlyInterceptor) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if err != nil || !touchesTable(cs, readOnlyTableName) {
+		return err
+	}
+	readOnly, loadErr := loadReadOnly(ha.ContextLocalDB(context.Background(), true), conn)
+	if loadErr != nil {
+		slog.Warn("failed to read replicated read-only flag", "id", cs.Filename, "error", loadErr)
+		return nil
+	}
+	muDBs.Lock()
+	connDB, ok := lookup(cs.Filename)
+	muDBs.Unlock()
+	if ok {
+		connDB.readOnly.Store(readOnly)
+		slog.Info("database write acceptance changed", "id", cs.Filename, "read_only", readOnly, "node", cs.Node)
+	}
+	return nil
+}
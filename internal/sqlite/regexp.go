@@ -0,0 +1,48 @@
+package sqlite
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// regexps caches the compiled patterns of the REGEXP operator.
+var regexps sync.Map
+
+// regexpMatch implements the regexp(pattern, value) SQL function behind the
+// REGEXP operator, X REGEXP Y calls regexp(Y, X).
+func regexpMatch(pattern, value any) (any, error) {
+	if isNull(pattern) || isNull(value) {
+		return nil, nil
+	}
+	p := toText(pattern)
+	re, ok := regexps.Load(p)
+	if !ok {
+		compiled, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("regexp: %w", err)
+		}
+		re, _ = regexps.LoadOrStore(p, compiled)
+	}
+	if re.(*regexp.Regexp).MatchString(toText(value)) {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+func isNull(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case []byte:
+		return v == nil
+	}
+	return false
+}
+
+func toText(v any) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
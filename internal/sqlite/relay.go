@@ -0,0 +1,306 @@
+package sqlite
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats.go"
+
+	"github.com/litesql/ha/internal/metrics"
+)
+
+// OutboxSyncModes are the PRAGMA synchronous modes of the outbox, from the
+// fastest to the most durable.
+var OutboxSyncModes = []string{"off", "normal", "full", "extra"}
+
+const (
+	// relayInterval is how often the relay looks for messages written by
+	// other connections, like the requeued ones
+	relayInterval = time.Second
+
+	quarantinedName = "ha_outbox_quarantined_total"
+)
+
+// OutboxConfig is the durability and the retry policy of the async
+// replication outbox.
+type OutboxConfig struct {
+	// Dir holds the outbox file of each database.
+	Dir string
+	// Sync is the PRAGMA synchronous of the outbox, one of OutboxSyncModes.
+	// With full and extra a commit is acknowledged once its changeset is
+	// synced to disk, normal may lose the last ones on a power loss and off
+	// on an OS crash.
+	Sync string
+	// RetryBackoff is the wait after a failed publish, doubling after each
+	// consecutive failure up to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// MaxAttempts is the number of publishes of a message the stream refuses
+	// before it is quarantined, 0 retries forever. The attempts made while
+	// NATS is disconnected don't count.
+	MaxAttempts int
+}
+
+// OutboxFile returns the outbox file of the database in dir.
+func OutboxFile(dir, id string) string {
+	return filepath.Join(dir, strings.TrimSuffix(id, ".db")+"_outbox.db")
+}
+
+// AsyncPublisher writes the changesets to the outbox of the database within
+// the commit, which fails when the changeset is not stored, and relays them
+// to the stream in commit order in the background. A message is published
+// at least once: it is deleted from the outbox after the stream
+// acknowledged it.
+type AsyncPublisher struct {
+	db        *sql.DB
+	id        string
+	subject   string
+	pub       ha.Publisher
+	connected func() bool
+	cfg       OutboxConfig
+	sequence  atomic.Uint64
+
+	// mu serializes the relay and the flushes, a message is never published
+	// twice at once
+	mu sync.Mutex
+	// head is the message retried, failures the consecutive failed
+	// publishes and attempts the ones counting toward the quarantine
+	head     int64
+	failures int
+	attempts int
+
+	wake      chan struct{}
+	close     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewAsyncPublisher opens the outbox file and starts the relay, publishing
+// with pub. connected reports whether the stream can be reached, a nil one
+// counts every failed publish.
+func NewAsyncPublisher(cfg OutboxConfig, id, subject string, pub ha.Publisher, connected func() bool) (*AsyncPublisher, error) {
+	mode := strings.ToLower(cmp.Or(cfg.Sync, "full"))
+	if !slices.Contains(OutboxSyncModes, mode) {
+		return nil, fmt.Errorf("invalid outbox sync mode %q, use one of %s", cfg.Sync, strings.Join(OutboxSyncModes, ", "))
+	}
+	db, err := OpenFile(OutboxFile(cfg.Dir, id))
+	if err != nil {
+		return nil, err
+	}
+	// the pragmas are set on the connection
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+	for _, stmt := range []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA synchronous = " + mode,
+		"PRAGMA busy_timeout = 5000",
+		outboxSchema,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("open outbox: %w", err)
+		}
+	}
+	p := &AsyncPublisher{
+		db:        db,
+		id:        id,
+		subject:   subject,
+		pub:       pub,
+		connected: connected,
+		cfg:       cfg,
+		wake:      make(chan struct{}, 1),
+		close:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *AsyncPublisher) Publish(cs *ha.ChangeSet) error {
+	data, err := json.Marshal(cs)
+	if err != nil {
+		return err
+	}
+	if _, err := p.db.Exec("INSERT INTO ha_outbox(subject, changeset, timestamp) VALUES (?, ?, ?)", p.subject, data, time.Now()); err != nil {
+		return fmt.Errorf("write changeset to the outbox: %w", err)
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Sequence returns the stream sequence of the last changeset relayed.
+func (p *AsyncPublisher) Sequence() uint64 {
+	return p.sequence.Load()
+}
+
+// Close stops the relay, the pending messages are published on the next
+// start.
+func (p *AsyncPublisher) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.close)
+		<-p.done
+	})
+	return p.db.Close()
+}
+
+// Flush publishes the pending messages right away, without waiting for the
+// backoff of the relay, and returns how many were published. It stops at the
+// first message the stream refuses.
+func (p *AsyncPublisher) Flush(ctx context.Context) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var published int
+	for {
+		ok, quarantined, err := p.publishNext(ctx)
+		if err != nil || !ok {
+			return published, err
+		}
+		if !quarantined {
+			published++
+		}
+	}
+}
+
+func (p *AsyncPublisher) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+	for {
+		if backoff := p.relay(); backoff > 0 {
+			select {
+			case <-p.close:
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		select {
+		case <-p.close:
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay publishes the pending messages, and returns how long to wait before
+// retrying a failure.
+func (p *AsyncPublisher) relay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		ok, _, err := p.publishNext(context.Background())
+		if err != nil {
+			slog.Error("async replication relay", "error", err, "id", p.id, "failures", p.failures)
+			return p.backoff()
+		}
+		if !ok {
+			return 0
+		}
+	}
+}
+
+func (p *AsyncPublisher) backoff() time.Duration {
+	backoff := max(p.cfg.RetryBackoff, time.Millisecond)
+	for i := 1; i < p.failures && backoff < p.cfg.MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if p.cfg.MaxRetryBackoff > 0 {
+		backoff = min(backoff, p.cfg.MaxRetryBackoff)
+	}
+	return backoff
+}
+
+// publishNext publishes the oldest message of the outbox, p.mu held. It
+// returns false when the outbox is empty, quarantined when the message was
+// moved to the quarantine instead.
+func (p *AsyncPublisher) publishNext(ctx context.Context) (ok, quarantined bool, err error) {
+	var (
+		msgID int64
+		data  []byte
+	)
+	err = p.db.QueryRowContext(ctx, "SELECT rowid, changeset FROM ha_outbox "+outboxOrder+" LIMIT 1").Scan(&msgID, &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if msgID != p.head {
+		p.head, p.failures, p.attempts = msgID, 0, 0
+	}
+	cs, err := decodeOutboxMessage(data)
+	if err != nil {
+		// it can never be published
+		return true, true, p.quarantine(ctx, msgID, err)
+	}
+	if err := p.pub.Publish(cs); err != nil {
+		p.failures++
+		if p.connected == nil || p.connected() {
+			p.attempts++
+		}
+		if errors.Is(err, nats.ErrMaxPayload) || p.cfg.MaxAttempts > 0 && p.attempts >= p.cfg.MaxAttempts {
+			return true, true, p.quarantine(ctx, msgID, err)
+		}
+		return false, false, fmt.Errorf("publish outbox message %d: %w", msgID, err)
+	}
+	p.sequence.Store(p.pub.Sequence())
+	p.failures, p.attempts = 0, 0
+	if _, err := p.db.ExecContext(ctx, "DELETE FROM ha_outbox WHERE rowid = ?", msgID); err != nil {
+		return false, false, fmt.Errorf("remove published outbox message %d: %w", msgID, err)
+	}
+	return true, false, nil
+}
+
+// quarantine moves a message the stream keeps refusing out of the outbox, so
+// it no longer blocks the ones behind it.
+func (p *AsyncPublisher) quarantine(ctx context.Context, msgID int64, cause error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `INSERT INTO ha_outbox_quarantine(subject, changeset, timestamp, attempts, error, quarantined_at)
+		SELECT subject, changeset, timestamp, ?, ?, ? FROM ha_outbox WHERE rowid = ?`, p.attempts, cause.Error(), time.Now(), msgID)
+	if err != nil {
+		return fmt.Errorf("quarantine outbox message %d: %w", msgID, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM ha_outbox WHERE rowid = ?", msgID); err != nil {
+		return fmt.Errorf("quarantine outbox message %d: %w", msgID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("quarantine outbox message %d: %w", msgID, err)
+	}
+	slog.Error("outbox message quarantined, its changes are not replicated", "id", p.id, "message", msgID, "attempts", p.attempts, "error", cause)
+	metrics.AddCounter(quarantinedName, "Async replication outbox messages quarantined", metrics.Labels{"database": p.id}, 1)
+	p.failures, p.attempts = 0, 0
+	return nil
+}
+
+// decodeOutboxMessage decodes a changeset of the outbox to publish it again,
+// the numbers kept as written.
+func decodeOutboxMessage(data []byte) (*ha.ChangeSet, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var cs ha.ChangeSet
+	if err := dec.Decode(&cs); err != nil {
+		return nil, fmt.Errorf("malformed changeset: %w", err)
+	}
+	return &cs, nil
+}
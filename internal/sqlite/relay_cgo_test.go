@@ -0,0 +1,134 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// refusingPublisher logs the inserts it publishes, and refuses the ones of
+// the refused table while refusing is set, a "!" suffix in the log.
+type refusingPublisher struct {
+	mu       sync.Mutex
+	refusing bool
+	log      []string
+}
+
+func (p *refusingPublisher) Publish(cs *ha.ChangeSet) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, change := range cs.Changes {
+		if change.Operation != "INSERT" {
+			continue
+		}
+		if change.Table == "refused" && p.refusing {
+			p.log = append(p.log, change.Table+"!")
+			return errors.New("refused by the stream")
+		}
+		p.log = append(p.log, change.Table)
+	}
+	return nil
+}
+
+func (p *refusingPublisher) Sequence() uint64 { return 0 }
+
+func (p *refusingPublisher) Log() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.log)
+}
+
+// TestOutboxRelay quarantines a message the stream refused MaxAttempts times,
+// without publishing the ones behind it before, and publishes it again once
+// requeued.
+func TestOutboxRelay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	pub := &refusingPublisher{refusing: true}
+	cfg := sqlite.OutboxConfig{
+		Dir:             dir,
+		RetryBackoff:    time.Millisecond,
+		MaxRetryBackoff: 10 * time.Millisecond,
+		MaxAttempts:     3,
+	}
+	err := sqlite.Load(ctx, "file:"+filepath.Join(dir, "relay.db"), sqlite.LoadConfig{
+		MaxConns:  1,
+		OutboxDir: dir,
+		Publisher: func(replicationID, stream string) (ha.Publisher, error) {
+			asyncPub, err := sqlite.NewAsyncPublisher(cfg, replicationID, stream, pub, nil)
+			if err != nil {
+				return nil, err
+			}
+			return asyncPub, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB("relay.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE items(id INTEGER PRIMARY KEY)",
+		"CREATE TABLE refused(id INTEGER PRIMARY KEY)",
+		"INSERT INTO items VALUES (1)",
+		"INSERT INTO refused VALUES (1)",
+		"INSERT INTO items VALUES (2)",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	// relayed waits for the outbox to be empty and checks the publishes
+	relayed := func(want []string) *sqlite.Outbox {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			outbox, err := sqlite.InspectOutbox(ctx, "relay.db", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outbox.Pending == 0 {
+				if got := pub.Log(); !slices.Equal(got, want) {
+					t.Fatalf("published %v, want %v", got, want)
+				}
+				return outbox
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("outbox %+v not relayed, published %v", outbox, pub.Log())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// the second item waits for the quarantine of the refused message
+	outbox := relayed([]string{"items", "refused!", "refused!", "refused!", "items"})
+	if outbox.Quarantined != 1 || outbox.QuarantinedMessages[0].Attempts != 3 {
+		t.Fatalf("outbox %+v, want the refused message quarantined after 3 attempts", outbox)
+	}
+
+	pub.mu.Lock()
+	pub.refusing = false
+	pub.mu.Unlock()
+	if err := sqlite.RequeueOutboxMessage(ctx, "relay.db", outbox.QuarantinedMessages[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlite.FlushOutbox(ctx, "relay.db"); err != nil {
+		t.Fatal(err)
+	}
+	outbox = relayed([]string{"items", "refused!", "refused!", "refused!", "items", "refused"})
+	if outbox.Quarantined != 0 {
+		t.Errorf("outbox %+v, want the requeued message published", outbox)
+	}
+}
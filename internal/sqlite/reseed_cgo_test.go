@@ -0,0 +1,181 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func runJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+// TestReseed repairs the rows of a database diverged from the stream: it is
+// rebuilt from the latest snapshot and the changesets after it are applied
+// again.
+func TestReseed(t *testing.T) {
+	ctx := context.Background()
+	js := runJetStream(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "reseed.db")
+	snapshot := filepath.Join(dir, "snapshot.db")
+	var snapshotSeq atomic.Uint64
+	err := sqlite.Load(ctx, "file:"+file, sqlite.LoadConfig{
+		MaxConns: 2,
+		Stream:   "reseed",
+		Options: []ha.Option{
+			ha.WithName("node1"),
+			ha.WithReplicationURL(js.Conn().ConnectedUrl()),
+			ha.WithReplicationStream("reseed"),
+		},
+		SnapshotSource: func(context.Context, string) (uint64, io.ReadCloser, error) {
+			if snapshotSeq.Load() == 0 {
+				return 0, nil, nil
+			}
+			f, err := os.Open(snapshot)
+			return snapshotSeq.Load(), f, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, subject, err := sqlite.ReplicationSubject("reseed.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// publish publishes the statements as another node and waits until the
+	// database applied them
+	publish := func(statements ...string) uint64 {
+		t.Helper()
+		cs := ha.ChangeSet{Node: "node2", Filename: "reseed.db", Timestamp: time.Now().UnixNano()}
+		for _, s := range statements {
+			cs.Changes = append(cs.Changes, ha.Change{Operation: "SQL", Command: s})
+		}
+		data, err := json.Marshal(cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, err := js.Publish(ctx, subject, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			applied, err := sqlite.AppliedSeq("reseed.db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied >= ack.Sequence {
+				return ack.Sequence
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("applied the stream up to %d, want %d", applied, ack.Sequence)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// local runs the statement on the database file, without replicating it
+	local := func(query string, args ...any) {
+		t.Helper()
+		db, err := sql.Open("sqlite3", "file:"+file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	rows := func() map[int]string {
+		t.Helper()
+		db, err := sqlite.DB("reseed.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs, err := db.QueryContext(ctx, "SELECT id, name FROM items")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Close()
+		got := make(map[int]string)
+		for rs.Next() {
+			var (
+				id   int
+				name string
+			)
+			if err := rs.Scan(&id, &name); err != nil {
+				t.Fatal(err)
+			}
+			got[id] = name
+		}
+		return got
+	}
+
+	seq := publish("CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT)", "INSERT INTO items VALUES (1, 'a')")
+	local("VACUUM INTO ?", snapshot)
+	snapshotSeq.Store(seq)
+	publish("UPDATE items SET name = 'b' WHERE id = 1")
+	// the rows diverge
+	local("UPDATE items SET name = 'x' WHERE id = 1")
+	local("INSERT INTO items VALUES (9, 'z')")
+
+	sequence, err := sqlite.Reseed(ctx, "reseed.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence != seq {
+		t.Errorf("reseeded from %d, want the snapshot %d", sequence, seq)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := rows()
+		if len(got) == 1 && got[1] == "b" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rows %v, want the rows of the stream", got)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,167 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Restore replaces the content of the database by the snapshot in a single
+// replicated transaction: the user tables, views and triggers are dropped and
+// recreated from the snapshot schema, and the rows are copied from it. The
+// sqlite_ and ha_ internal tables are kept.
+func Restore(ctx context.Context, id string, snapshot io.Reader) error {
+	db, err := DB(id)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "ha-restore-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// the snapshot is read with its own connection, go-ha doesn't run the
+	// ATTACH statements of a replicated connection
+	source, err := OpenFile(f.Name())
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	objects, err := restoreObjects(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	dropped, err := dropSchema(ctx, tx)
+	if err != nil {
+		return err
+	}
+	// tables are filled before the indexes and triggers are created
+	var tables int
+	for _, obj := range objects {
+		if obj.typ != "table" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, obj.sql); err != nil {
+			return fmt.Errorf("create table %q: %w", obj.name, err)
+		}
+		if err := restoreRows(ctx, source, tx, obj.name); err != nil {
+			return fmt.Errorf("copy table %q: %w", obj.name, err)
+		}
+		tables++
+	}
+	for _, obj := range objects {
+		if obj.typ == "table" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, obj.sql); err != nil {
+			return fmt.Errorf("create %s %q: %w", obj.typ, obj.name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("database restored", "id", id, "dropped", dropped, "tables", tables)
+	return nil
+}
+
+type restoreObject struct {
+	typ    string
+	name   string
+	sql    string
+	shadow bool
+}
+
+func restoreObjects(ctx context.Context, querier querier) ([]restoreObject, error) {
+	rows, err := querier.QueryContext(ctx, `SELECT s.type, s.name, s.sql, coalesce(t.type = 'shadow', false)
+		FROM sqlite_schema s LEFT JOIN pragma_table_list t ON t.schema = 'main' AND t.name = s.name
+		WHERE s.sql IS NOT NULL AND s.name NOT GLOB 'sqlite_*' AND s.name NOT GLOB 'ha_*'
+		ORDER BY CASE s.type WHEN 'table' THEN 0 WHEN 'index' THEN 1 WHEN 'view' THEN 2 ELSE 3 END, s.rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var objects []restoreObject
+	for rows.Next() {
+		var obj restoreObject
+		if err := rows.Scan(&obj.typ, &obj.name, &obj.sql, &obj.shadow); err != nil {
+			return nil, err
+		}
+		if obj.shadow {
+			// created by the virtual table
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	return objects, rows.Err()
+}
+
+// restoreRows copies the rows of the snapshot table to the transaction.
+func restoreRows(ctx context.Context, source *sql.DB, tx *sql.Tx, table string) error {
+	columns, err := restoreColumns(ctx, source, table)
+	if err != nil || len(columns) == 0 {
+		return err
+	}
+	list := strings.Join(columns, ", ")
+	rows, err := source.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %q", list, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	insert, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %q(%s) VALUES(%s)", table, list, placeholders))
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	values := make([]any, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if _, err := insert.ExecContext(ctx, values...); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// restoreColumns lists the stored columns of the snapshot table, generated
+// columns cannot be inserted.
+func restoreColumns(ctx context.Context, querier querier, table string) ([]string, error) {
+	rows, err := querier.QueryContext(ctx, "SELECT name FROM pragma_table_xinfo(?) WHERE hidden = 0 ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, fmt.Sprintf("%q", name))
+	}
+	return columns, rows.Err()
+}
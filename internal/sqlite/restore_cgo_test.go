@@ -0,0 +1,98 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	_ "github.com/litesql/go-sqlite3"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// TestRestoreSnapshot replaces the content of a database by a snapshot,
+// through the go-ha driver.
+func TestRestoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "snapshot.db")
+	snapshot, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE users(id INTEGER PRIMARY KEY, name TEXT)",
+		"CREATE INDEX users_name ON users(name)",
+		"INSERT INTO users(name) VALUES('snapshot')",
+		"CREATE VIEW names AS SELECT name FROM users",
+	} {
+		if _, err := snapshot.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	snapshot.Close()
+
+	if err := sqlite.Load(ctx, "file:"+filepath.Join(dir, "restore.db"), sqlite.LoadConfig{MaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB("restore.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE users(id INTEGER PRIMARY KEY, name TEXT, email TEXT)",
+		"INSERT INTO users(name) VALUES('current')",
+		"CREATE TABLE extra(x)",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := sqlite.Restore(ctx, "restore.db", f); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_schema WHERE name NOT GLOB 'sqlite_*' AND name NOT GLOB 'ha_*' ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"names", "users", "users_name"}; !slices.Equal(names, want) {
+		t.Fatalf("schema %v after the restore, want %v", names, want)
+	}
+	var columns int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM pragma_table_info('users')").Scan(&columns); err != nil {
+		t.Fatal(err)
+	}
+	if columns != 2 {
+		t.Errorf("users restored with %d columns, want 2", columns)
+	}
+	var name string
+	if err := db.QueryRowContext(ctx, "SELECT name FROM users").Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "snapshot" {
+		t.Errorf("restored user %q, want snapshot", name)
+	}
+}
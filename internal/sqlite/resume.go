@@ -0,0 +1,101 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// RecordedPosition is the last stream sequence the previous run of the node
+// applied to a database.
+type RecordedPosition struct {
+	Sequence uint64
+	// Stopped is set for the final position of a run, recorded once its
+	// clients were gone.
+	Stopped bool
+}
+
+// ResumePosition returns the position the previous run of the node recorded
+// for the database, false when it was not recorded.
+type ResumePosition func(ctx context.Context, id string) (RecordedPosition, bool)
+
+// resumePolicy returns the deliver policy of a durable consumer created
+// again, after the position of the previous run instead of the start of the
+// stream.
+func resumePolicy(ctx context.Context, id, dsn string, memDB bool, resume ResumePosition) (string, bool) {
+	seq, ok := ResumeAfter(ctx, id, dsn, memDB, resume)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("by_start_sequence=%d", seq+1), true
+}
+
+// ResumeAfter returns the stream sequence a durable consumer created again
+// resumes after, false to replay the stream. The positions are taken in
+// this order:
+//
+//   - an in-memory database, or an empty or missing file, replays the
+//     stream: it holds none of the changes before the recorded position;
+//   - the final recorded position, when newer than the sequence applied by
+//     the database file: the stopped run acknowledged the messages in
+//     between without changing the database, like the changes of the tables
+//     filtered out;
+//   - the sequence applied by the database file, otherwise: after a crash
+//     the file may have lost the last transactions the running position
+//     counts;
+//   - the recorded position, when the file can't be read.
+func ResumeAfter(ctx context.Context, id, dsn string, memDB bool, resume ResumePosition) (uint64, bool) {
+	local, known := localPosition(ctx, filenameFromDSN(dsn))
+	switch {
+	case known && local > 0:
+		recorded, ok := resume(ctx, id)
+		switch {
+		case !ok || recorded.Sequence == local:
+		case recorded.Stopped && recorded.Sequence > local:
+			slog.Info("resuming after the final recorded replication position", "id", id, "recorded", recorded.Sequence, "applied", local)
+			return recorded.Sequence, true
+		default:
+			slog.Warn("the database is not at the recorded replication position, resuming after its own", "id", id, "recorded", recorded.Sequence, "stopped", recorded.Stopped, "applied", local)
+		}
+		return local, true
+	case known || memDB:
+		return 0, false
+	}
+	if recorded, ok := resume(ctx, id); ok && recorded.Sequence > 0 {
+		return recorded.Sequence, true
+	}
+	return 0, false
+}
+
+// localPosition reads the last stream sequence applied to the database file,
+// known is false when the file can't be read. A missing file is at 0.
+func localPosition(ctx context.Context, filename string) (seq uint64, known bool) {
+	if filename == "" || strings.HasPrefix(filename, ":memory:") {
+		return 0, false
+	}
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return 0, true
+	}
+	db, err := OpenFile("file:" + filename + "?mode=ro")
+	if err != nil {
+		return 0, false
+	}
+	defer db.Close()
+	var exists bool
+	err = db.QueryRowContext(ctx, "SELECT count(*) > 0 FROM sqlite_schema WHERE type = 'table' AND name = ?", controlTableName).Scan(&exists)
+	if err != nil {
+		return 0, false
+	}
+	if !exists {
+		return 0, true
+	}
+	var received sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT max(received_seq) FROM "+controlTableName).Scan(&received); err != nil {
+		return 0, false
+	}
+	return uint64(max(received.Int64, 0)), true
+}
@@ -0,0 +1,110 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// TestResumeEmptyDatabase restarts databases holding no change after a
+// handoff recorded a position: they must replay the stream instead of
+// resuming after the recorded position.
+func TestResumeEmptyDatabase(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "resume_empty.db")
+	db, err := sql.Open("sqlite3", empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE items(id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	tests := []struct {
+		name string
+		dsn  string
+		cfg  sqlite.LoadConfig
+	}{
+		{name: "in memory", dsn: "file:/resume_memory.db?vfs=memdb", cfg: sqlite.LoadConfig{MemDB: true}},
+		{name: "missing file", dsn: "file:" + filepath.Join(dir, "resume_missing.db")},
+		{name: "file without position", dsn: "file:" + empty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.MaxConns = 1
+			cfg.ResumePosition = func(_ context.Context, id string) (sqlite.RecordedPosition, bool) {
+				t.Errorf("the position recorded for %s was used", id)
+				return sqlite.RecordedPosition{Sequence: 42, Stopped: true}, true
+			}
+			if err := sqlite.Load(ctx, tt.dsn, cfg); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestResumeAfter resumes a database file after its own position unless the
+// final position of the stopped run is newer, or after the recorded
+// position when the file can't be read.
+func TestResumeAfter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	applied := filepath.Join(dir, "applied.db")
+	db, err := sql.Open("sqlite3", applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE ha_stats(subject TEXT PRIMARY KEY, received_seq INTEGER, updated_at DATETIME)",
+		"INSERT INTO ha_stats VALUES ('ha.applied', 5, CURRENT_TIMESTAMP)",
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	db.Close()
+	unreadable := filepath.Join(dir, "unreadable.db")
+	if err := os.WriteFile(unreadable, []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		recorded *sqlite.RecordedPosition
+		want     uint64
+		wantOK   bool
+	}{
+		{name: "not recorded", filename: applied, want: 5, wantOK: true},
+		{name: "same position", filename: applied, recorded: &sqlite.RecordedPosition{Sequence: 5, Stopped: true}, want: 5, wantOK: true},
+		{name: "stopped newer", filename: applied, recorded: &sqlite.RecordedPosition{Sequence: 9, Stopped: true}, want: 9, wantOK: true},
+		{name: "running newer", filename: applied, recorded: &sqlite.RecordedPosition{Sequence: 9}, want: 5, wantOK: true},
+		{name: "stopped older", filename: applied, recorded: &sqlite.RecordedPosition{Sequence: 3, Stopped: true}, want: 5, wantOK: true},
+		{name: "unreadable file", filename: unreadable, recorded: &sqlite.RecordedPosition{Sequence: 9}, want: 9, wantOK: true},
+		{name: "unreadable file not recorded", filename: unreadable},
+		{name: "missing file", filename: filepath.Join(dir, "missing.db"), recorded: &sqlite.RecordedPosition{Sequence: 9, Stopped: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resume := func(context.Context, string) (sqlite.RecordedPosition, bool) {
+				if tt.recorded == nil {
+					return sqlite.RecordedPosition{}, false
+				}
+				return *tt.recorded, true
+			}
+			got, ok := sqlite.ResumeAfter(ctx, "applied.db", "file:"+tt.filename, false, resume)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %d %v, want %d %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
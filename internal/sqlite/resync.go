@@ -0,0 +1,295 @@
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrSnapshotTooOld is returned by Resync when the latest snapshot does not
+// reach the first message the stream still holds, the changes in between
+// can't be recovered.
+var ErrSnapshotTooOld = errors.New("no snapshot reaches the replication stream")
+
+// ErrNoSnapshot is returned by Reseed when the database has no snapshot.
+var ErrNoSnapshot = errors.New("no snapshot of the database")
+
+// ErrOwnChanges is returned when rebuilding the database would lose changes
+// this process published after the snapshot: the go-ha subscriber skips the
+// changesets published by its own process, the replay of the stream would
+// not apply them. A restarted node applies them again.
+var ErrOwnChanges = errors.New("the node published changes after the snapshot")
+
+var (
+	// muRebuild serializes the rebuilds, the snapshot is downloaded without
+	// muDBs held
+	muRebuild sync.Mutex
+	// ownPublished keeps the last stream sequence published by this process
+	// for each database rebuilt, under muDBs
+	ownPublished = make(map[string]uint64)
+)
+
+// AppliedSeq returns the stream sequence of the last replication message
+// applied to the database by this node.
+func AppliedSeq(id string) (uint64, error) {
+	muDBs.Lock()
+	defer muDBs.Unlock()
+	connDB, ok := lookup(id)
+	if !ok {
+		return 0, fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	return connDB.connector.LatestSeq(), nil
+}
+
+// Resync rebuilds the database from the latest snapshot when the node missed
+// changes the replication stream no longer holds: the local database is
+// replaced (nothing is replicated), the durable consumer is recreated and
+// the subscription restarts after the snapshot sequence. The connections
+// opened on the previous database fail and have to be opened again. The
+// snapshot sequence must be at least minSequence, it is returned.
+func Resync(ctx context.Context, id string, minSequence uint64) (uint64, error) {
+	muRebuild.Lock()
+	defer muRebuild.Unlock()
+	id, connDB, err := rebuildTarget(id, "resynced")
+	if err != nil {
+		return 0, err
+	}
+	options, _ := replicationOptions(id, connDB.cfg)
+	sequence, reader, err := latestSnapshot(ctx, id, connDB.dsn, connDB.cfg, options)
+	if err != nil {
+		return 0, fmt.Errorf("latest snapshot: %w", err)
+	}
+	if reader == nil || sequence < minSequence {
+		if reader != nil {
+			reader.Close()
+		}
+		return 0, fmt.Errorf("%w: the sequence %d is needed", ErrSnapshotTooOld, minSequence)
+	}
+	slog.Warn("resyncing database from the latest snapshot", "id", id, "applied_seq", connDB.connector.LatestSeq(), "snapshot_seq", sequence)
+	if err := rebuild(ctx, id, connDB, sequence, reader); err != nil {
+		return 0, err
+	}
+	return sequence, nil
+}
+
+// Reseed rebuilds the database from the latest snapshot, like Resync, to
+// repair a node whose rows diverged from the other nodes: the changes applied
+// since the snapshot are applied again from the stream. The snapshot sequence
+// is returned.
+func Reseed(ctx context.Context, id string) (uint64, error) {
+	muRebuild.Lock()
+	defer muRebuild.Unlock()
+	id, connDB, err := rebuildTarget(id, "reseeded")
+	if err != nil {
+		return 0, err
+	}
+	options, _ := replicationOptions(id, connDB.cfg)
+	sequence, reader, err := latestSnapshot(ctx, id, connDB.dsn, connDB.cfg, options)
+	if err != nil {
+		return 0, fmt.Errorf("latest snapshot: %w", err)
+	}
+	if reader == nil {
+		return 0, fmt.Errorf("%w %q", ErrNoSnapshot, id)
+	}
+	slog.Warn("reseeding database from the latest snapshot", "id", id, "applied_seq", connDB.connector.LatestSeq(), "snapshot_seq", sequence)
+	if err := rebuild(ctx, id, connDB, sequence, reader); err != nil {
+		return 0, err
+	}
+	return sequence, nil
+}
+
+// Rewind rebuilds the database from the snapshot taken at the sequence, like
+// Resync: the subscription restarts after the snapshot sequence and applies
+// the following changesets again, through the interceptors configured now.
+// The reader is closed.
+func Rewind(ctx context.Context, id string, sequence uint64, reader io.ReadCloser) error {
+	muRebuild.Lock()
+	defer muRebuild.Unlock()
+	id, connDB, err := rebuildTarget(id, "rewound")
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	slog.Warn("rewinding database to a snapshot", "id", id, "applied_seq", connDB.connector.LatestSeq(), "snapshot_seq", sequence)
+	return rebuild(ctx, id, connDB, sequence, reader)
+}
+
+// rebuildTarget returns the database to rebuild, the default one for the
+// empty id.
+func rebuildTarget(id, action string) (string, *connectorDB, error) {
+	muDBs.Lock()
+	defer muDBs.Unlock()
+	id = cmp.Or(id, DefaultDatabase())
+	connDB, ok := dbs[id]
+	if !ok {
+		return "", nil, fmt.Errorf("database with id %q %w", id, ErrNotFound)
+	}
+	if _, proxied := proxiedSubscription[id]; proxied {
+		return "", nil, fmt.Errorf("database %q replicates from a proxied source and can't be %s", id, action)
+	}
+	return id, connDB, nil
+}
+
+// rebuild replaces the database by the snapshot and reloads it, muRebuild
+// held. The snapshot is downloaded first, muDBs is only held to swap the
+// database.
+func rebuild(ctx context.Context, id string, connDB *connectorDB, sequence uint64, reader io.ReadCloser) error {
+	muDBs.Lock()
+	err := ownChanges(ctx, id, connDB, sequence)
+	muDBs.Unlock()
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	// downloaded before the database is closed: a failed download leaves it
+	// as it was
+	filename := filenameFromDSN(connDB.dsn)
+	if connDB.cfg.MemDB {
+		filename = filepath.Join(os.TempDir(), "ha-"+filepath.Base(id))
+	}
+	reader, err = spool(filename, reader)
+	if err != nil {
+		return fmt.Errorf("download snapshot: %w", err)
+	}
+
+	muDBs.Lock()
+	defer muDBs.Unlock()
+	if dbs[id] != connDB {
+		reader.Close()
+		return fmt.Errorf("database %q was reloaded during the snapshot download", id)
+	}
+	// the changesets committed during the download are checked, no other
+	// one is published until the database is replaced
+	connDB.publisher.pause(true)
+	if err := ownChanges(ctx, id, connDB, sequence); err != nil {
+		connDB.publisher.pause(false)
+		reader.Close()
+		return err
+	}
+	err = connDB.connector.RemoveConsumer(ctx, ConsumerName(id, connDB.connector.NodeName()))
+	if err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		connDB.publisher.pause(false)
+		reader.Close()
+		return fmt.Errorf("remove consumer: %w", err)
+	}
+	ownPublished[id] = max(ownPublished[id], connDB.publishedSeq())
+	connDB.connector.Close()
+	connDB.db.Close()
+	delete(dbs, id)
+	connectors.Delete(id)
+	if !connDB.cfg.MemDB {
+		// a stale WAL would be replayed over the snapshot
+		for _, name := range []string{filename + "-wal", filename + "-shm"} {
+			if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				reader.Close()
+				return err
+			}
+		}
+	}
+
+	cfg := connDB.cfg
+	cfg.FromLatestSnapshot = true
+	cfg.DeliverPolicy = ""
+	cfg.snapshot = &loadedSnapshot{sequence: sequence, reader: reader}
+	if err := load(ctx, connDB.dsn, cfg); err != nil {
+		return fmt.Errorf("reload %q: %w", id, err)
+	}
+	return nil
+}
+
+// publishedSeq returns the stream sequence of the last changeset this
+// process published for the database. The connector only reports the
+// sequence of its publisher once started.
+func (c *connectorDB) publishedSeq() uint64 {
+	if c.publisher != nil {
+		return c.publisher.Sequence()
+	}
+	return c.connector.PubSeq()
+}
+
+// ownChanges returns ErrOwnChanges when this process published changesets of
+// the database after the snapshot sequence, or still has some in the async
+// replication outbox, muDBs held.
+func ownChanges(ctx context.Context, id string, connDB *connectorDB, sequence uint64) error {
+	if published := max(ownPublished[id], connDB.publishedSeq()); published > sequence {
+		return fmt.Errorf("%w: published up to the sequence %d, the snapshot is at %d, restart the node to rebuild %q", ErrOwnChanges, published, sequence, id)
+	}
+	if connDB.outbox == "" {
+		return nil
+	}
+	outbox, err := openOutboxFile(ctx, connDB.outbox)
+	if err != nil || outbox == nil {
+		return err
+	}
+	defer outbox.Close()
+	var pending int64
+	if err := outbox.QueryRowContext(ctx, "SELECT count(*) FROM ha_outbox").Scan(&pending); err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("%w: %d changesets wait in the async replication outbox, restart the node to rebuild %q", ErrOwnChanges, pending, id)
+	}
+	return nil
+}
+
+// spooledSnapshot is a snapshot downloaded next to the database, renamed over
+// it by replaceFile.
+type spooledSnapshot struct {
+	*os.File
+}
+
+func (s spooledSnapshot) Close() error {
+	err := s.File.Close()
+	// nothing left to remove once renamed
+	os.Remove(s.Name())
+	return err
+}
+
+// spool downloads the snapshot to a temporary file in the directory of the
+// database. The reader is closed.
+func spool(filename string, reader io.ReadCloser) (io.ReadCloser, error) {
+	defer reader.Close()
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".snapshot-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := spooledSnapshot{f}
+	if _, err := io.Copy(f, reader); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+// replaceFile atomically replaces the file by the content of the reader: it
+// is written to a temporary file renamed over it, unless already spooled.
+func replaceFile(filename string, reader io.Reader) error {
+	spooled, ok := reader.(spooledSnapshot)
+	if !ok {
+		f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".snapshot-*")
+		if err != nil {
+			return err
+		}
+		spooled = spooledSnapshot{f}
+		defer spooled.Close()
+		if _, err := io.Copy(f, reader); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(spooled.Name(), filename)
+}
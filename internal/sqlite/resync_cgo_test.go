@@ -0,0 +1,141 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// streamPublisher numbers the changesets like a stream shared by the
+// publishers of the database, its sequence is the last one it published.
+type streamPublisher struct {
+	stream   *atomic.Uint64
+	sequence atomic.Uint64
+}
+
+func (p *streamPublisher) Publish(*ha.ChangeSet) error {
+	p.sequence.Store(p.stream.Add(1))
+	return nil
+}
+
+func (p *streamPublisher) Sequence() uint64 { return p.sequence.Load() }
+
+// TestRebuildOwnChanges refuses to rebuild a database from a snapshot older
+// than the changesets this process published: the replay of the stream
+// skips them, they would be lost.
+func TestRebuildOwnChanges(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "snapshot.db")
+	db, err := sql.Open("sqlite3", snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE items(id INTEGER PRIMARY KEY)",
+		"INSERT INTO items VALUES (1)",
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	db.Close()
+
+	var snapshotSeq atomic.Uint64
+	open := func() io.ReadCloser {
+		f, err := os.Open(snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	stream := new(atomic.Uint64)
+	err = sqlite.Load(ctx, "file:"+filepath.Join(dir, "rebuild.db"), sqlite.LoadConfig{
+		MaxConns: 1,
+		Publisher: func(string, string) (ha.Publisher, error) {
+			return &streamPublisher{stream: stream}, nil
+		},
+		SnapshotSource: func(context.Context, string) (uint64, io.ReadCloser, error) {
+			return snapshotSeq.Load(), open(), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = sqlite.DB("rebuild.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE items(id INTEGER PRIMARY KEY)",
+		"INSERT INTO items VALUES (1)",
+		"INSERT INTO items VALUES (2)",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	// the snapshot holds the first two changesets, not the last insert
+	snapshotSeq.Store(2)
+
+	rebuilds := []struct {
+		name    string
+		rebuild func() error
+	}{
+		{name: "resync", rebuild: func() error {
+			_, err := sqlite.Resync(ctx, "rebuild.db", 0)
+			return err
+		}},
+		{name: "reseed", rebuild: func() error {
+			_, err := sqlite.Reseed(ctx, "rebuild.db")
+			return err
+		}},
+		{name: "rewind", rebuild: func() error {
+			return sqlite.Rewind(ctx, "rebuild.db", snapshotSeq.Load(), open())
+		}},
+	}
+	for _, tt := range rebuilds {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rebuild(); !errors.Is(err, sqlite.ErrOwnChanges) {
+				t.Fatalf("got %v, want ErrOwnChanges", err)
+			}
+			// the database is kept, and still replicated
+			if _, err := db.ExecContext(ctx, "UPDATE items SET id = id WHERE id = 2"); err != nil {
+				t.Fatal(err)
+			}
+			snapshotSeq.Store(stream.Load() - 1)
+		})
+	}
+
+	snapshotSeq.Store(stream.Load())
+	if err := sqlite.Rewind(ctx, "rebuild.db", snapshotSeq.Load(), open()); err != nil {
+		t.Fatal(err)
+	}
+	db, err = sqlite.DB("rebuild.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM items").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d rows after the rewind, want the row of the snapshot", count)
+	}
+	// the publisher of the rebuilt database published nothing yet, the
+	// sequences of the previous one still count
+	if err := sqlite.Rewind(ctx, "rebuild.db", snapshotSeq.Load()-1, open()); !errors.Is(err, sqlite.ErrOwnChanges) {
+		t.Errorf("rewind before the previous publishes: got %v, want ErrOwnChanges", err)
+	}
+}
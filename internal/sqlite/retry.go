@@ -0,0 +1,62 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// SQLite primary result codes of the lock conflicts.
+const (
+	codeBusy   = 5
+	codeLocked = 6
+)
+
+const maxRetryBackoff = time.Second
+
+var (
+	transactionRetries int
+	retryBackoff       time.Duration
+)
+
+// SetTransactionRetries sets how many times RetryTransaction runs again a
+// transaction failing with SQLITE_BUSY or SQLITE_LOCKED, the backoff doubling
+// after each attempt.
+func SetTransactionRetries(retries int, backoff time.Duration) {
+	transactionRetries = retries
+	retryBackoff = backoff
+}
+
+// IsBusy reports whether err is a SQLITE_BUSY or SQLITE_LOCKED error, another
+// connection holding the lock.
+func IsBusy(err error) bool {
+	code, ok := ErrorCode(err)
+	return ok && (code&0xff == codeBusy || code&0xff == codeLocked)
+}
+
+// RetryTransaction runs the queries in a transaction like Transaction, and
+// runs the whole batch again when it fails on a lock conflict: it was rolled
+// back and is self-contained. It returns the number of retries.
+func RetryTransaction(ctx context.Context, db *sql.DB, queries []Request) ([]*Response, int, error) {
+	return retry(ctx, func() ([]*Response, error) {
+		return Transaction(ctx, db, queries)
+	})
+}
+
+func retry(ctx context.Context, transaction func() ([]*Response, error)) ([]*Response, int, error) {
+	backoff := retryBackoff
+	for retries := 0; ; retries++ {
+		list, err := transaction()
+		if err == nil || !IsBusy(err) || retries >= transactionRetries {
+			return list, retries, err
+		}
+		slog.Debug("transaction busy, retrying", "attempt", retries+1, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, retries, err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
@@ -0,0 +1,151 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Table describes a user table or view. The sqlite_ and ha_ internal tables
+// are not listed.
+type Table struct {
+	Name        string       `json:"name"`
+	Type        string       `json:"type"`
+	SQL         string       `json:"sql,omitempty"`
+	Columns     []Column     `json:"columns"`
+	Indexes     []Index      `json:"indexes,omitempty"`
+	ForeignKeys []ForeignKey `json:"foreign_keys,omitempty"`
+}
+
+type Column struct {
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	NotNull    bool    `json:"not_null"`
+	Default    *string `json:"default,omitempty"`
+	PrimaryKey int     `json:"primary_key,omitempty"`
+}
+
+// Index lists the indexed columns, an expression column is empty. The SQL
+// is only set on the indexes created by CREATE INDEX.
+type Index struct {
+	Name    string   `json:"name"`
+	Unique  bool     `json:"unique"`
+	Origin  string   `json:"origin"`
+	Columns []string `json:"columns"`
+	SQL     string   `json:"sql,omitempty"`
+}
+
+// ForeignKey references the columns of another table, an empty referenced
+// column is the primary key of the table.
+type ForeignKey struct {
+	Columns    []string `json:"columns"`
+	Table      string   `json:"table"`
+	References []string `json:"references"`
+	OnUpdate   string   `json:"on_update,omitempty"`
+	OnDelete   string   `json:"on_delete,omitempty"`
+}
+
+// Schema returns the tables and views of the database ordered by name.
+func Schema(ctx context.Context, querier querier) ([]Table, error) {
+	rows, err := querier.QueryContext(ctx, `SELECT m.name, m.type, COALESCE(m.sql, ''), p.name, p.type, p."notnull", p.dflt_value, p.pk
+		FROM sqlite_schema m JOIN pragma_table_info(m.name) p
+		WHERE m.type IN ('table', 'view') AND m.name NOT GLOB 'sqlite_*' AND m.name NOT GLOB 'ha_*'
+		ORDER BY m.name, p.cid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []Table
+	index := make(map[string]int)
+	for rows.Next() {
+		var (
+			table, typ, ddl string
+			column          Column
+			dflt            sql.NullString
+		)
+		if err := rows.Scan(&table, &typ, &ddl, &column.Name, &column.Type, &column.NotNull, &dflt, &column.PrimaryKey); err != nil {
+			return nil, err
+		}
+		if dflt.Valid {
+			column.Default = &dflt.String
+		}
+		i, ok := index[table]
+		if !ok {
+			i = len(tables)
+			index[table] = i
+			tables = append(tables, Table{Name: table, Type: typ, SQL: ddl})
+		}
+		tables[i].Columns = append(tables[i].Columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = querier.QueryContext(ctx, `SELECT m.name, il.name, il."unique", il.origin, ii.name,
+			COALESCE((SELECT s.sql FROM sqlite_schema s WHERE s.type = 'index' AND s.name = il.name), '')
+		FROM sqlite_schema m JOIN pragma_index_list(m.name) il JOIN pragma_index_info(il.name) ii
+		WHERE m.type = 'table' AND m.name NOT GLOB 'sqlite_*' AND m.name NOT GLOB 'ha_*'
+		ORDER BY m.name, il.seq, ii.seqno`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			table, name, origin, ddl string
+			unique                   bool
+			column                   sql.NullString
+		)
+		if err := rows.Scan(&table, &name, &unique, &origin, &column, &ddl); err != nil {
+			return nil, err
+		}
+		i, ok := index[table]
+		if !ok {
+			continue
+		}
+		indexes := tables[i].Indexes
+		if n := len(indexes); n == 0 || indexes[n-1].Name != name {
+			indexes = append(indexes, Index{Name: name, Unique: unique, Origin: origin, SQL: ddl})
+		}
+		indexes[len(indexes)-1].Columns = append(indexes[len(indexes)-1].Columns, column.String)
+		tables[i].Indexes = indexes
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = querier.QueryContext(ctx, `SELECT m.name, fk.id, fk."table", fk."from", fk."to", fk.on_update, fk.on_delete
+		FROM sqlite_schema m JOIN pragma_foreign_key_list(m.name) fk
+		WHERE m.type = 'table' AND m.name NOT GLOB 'sqlite_*' AND m.name NOT GLOB 'ha_*'
+		ORDER BY m.name, fk.id, fk.seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	last := make(map[string]int)
+	for rows.Next() {
+		var (
+			table, ref, from, onUpdate, onDelete string
+			id                                   int
+			to                                   sql.NullString
+		)
+		if err := rows.Scan(&table, &id, &ref, &from, &to, &onUpdate, &onDelete); err != nil {
+			return nil, err
+		}
+		i, ok := index[table]
+		if !ok {
+			continue
+		}
+		fks := tables[i].ForeignKeys
+		if n, ok := last[table]; !ok || n != id {
+			fks = append(fks, ForeignKey{Table: ref, OnUpdate: onUpdate, OnDelete: onDelete})
+			last[table] = id
+		}
+		fk := &fks[len(fks)-1]
+		fk.Columns = append(fk.Columns, from)
+		fk.References = append(fk.References, to.String)
+		tables[i].ForeignKeys = fks
+	}
+	return tables, rows.Err()
+}
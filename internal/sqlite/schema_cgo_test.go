@@ -0,0 +1,66 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/litesql/go-ha"
+	sqlite3ha "github.com/litesql/go-sqlite3-ha"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// nopPublisher discards the changesets.
+type nopPublisher struct{}
+
+func (nopPublisher) Publish(*ha.ChangeSet) error { return nil }
+
+func (nopPublisher) Sequence() uint64 { return 0 }
+
+// TestSchemaHADB describes the schema through the go-ha driver, which parses
+// every statement.
+func TestSchemaHADB(t *testing.T) {
+	ctx := context.Background()
+	connector, err := sqlite3ha.NewConnector("file:"+filepath.Join(t.TempDir(), "schema.db"),
+		ha.WithName("node1"), ha.WithReplicationPublisher(nopPublisher{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	for _, s := range []string{
+		"CREATE TABLE users(id INTEGER PRIMARY KEY, name TEXT NOT NULL)",
+		"CREATE TABLE orders(id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id))",
+		"CREATE INDEX orders_user ON orders(user_id)",
+		"CREATE TABLE ha_internal(x)",
+		"CREATE TABLE hat(x)",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	tables, err := sqlite.Schema(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, table := range tables {
+		names = append(names, table.Name)
+	}
+	if want := []string{"hat", "orders", "users"}; !slices.Equal(names, want) {
+		t.Fatalf("tables %v, want %v", names, want)
+	}
+	orders := tables[1]
+	if len(orders.Indexes) != 1 || orders.Indexes[0].Name != "orders_user" {
+		t.Errorf("orders indexes %+v", orders.Indexes)
+	}
+	if len(orders.ForeignKeys) != 1 || orders.ForeignKeys[0].Table != "users" {
+		t.Errorf("orders foreign keys %+v", orders.ForeignKeys)
+	}
+}
@@ -0,0 +1,315 @@
+package sqlite
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var reCreateTableName = regexp.MustCompile("(?is)^\\s*CREATE\\s+TABLE\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?(?:\"(?:[^\"]|\"\")*\"|`[^`]*`|\\[[^\\]]*\\]|[^\\s(]+)")
+
+// SchemaFingerprint returns a hash of the schema, equal on the nodes with the
+// same tables, columns, indexes and views however their SQL was written.
+func SchemaFingerprint(tables []Table) string {
+	normalized := make([]Table, len(tables))
+	for i, t := range tables {
+		// the SQL of a table changes with the ALTER TABLE statements, its
+		// description is enough
+		if t.Type == "table" {
+			t.SQL = ""
+		}
+		t.SQL = normalizeSQL(t.SQL)
+		t.Indexes = slices.Clone(t.Indexes)
+		for j := range t.Indexes {
+			t.Indexes[j].SQL = normalizeSQL(t.Indexes[j].SQL)
+		}
+		normalized[i] = t
+	}
+	slices.SortFunc(normalized, func(a, b Table) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+	data, _ := json.Marshal(normalized)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// DiffSchema returns the statements converging the current schema to the
+// target one, in the order they must run. The columns added with ALTER TABLE
+// ADD COLUMN and removed with DROP COLUMN keep the data of the table, the
+// other changes of a table rebuild it, copying the data of the columns kept.
+func DiffSchema(current, target []Table) []string {
+	var (
+		statements      []string
+		currentByName   = byName(current)
+		targetByName    = byName(target)
+		createdIndexes  []Index
+		createdViews    []Table
+		droppedTables   []string
+		rebuilt         = make(map[string]bool)
+		alteredExisting []Table
+	)
+	for _, t := range current {
+		want, ok := targetByName[strings.ToLower(t.Name)]
+		switch {
+		case t.Type == "view" && (!ok || want.Type != "view" || normalizeSQL(t.SQL) != normalizeSQL(want.SQL)):
+			statements = append(statements, "DROP VIEW IF EXISTS "+quoteIdentifier(t.Name))
+		case t.Type == "table" && (!ok || want.Type != "table"):
+			droppedTables = append(droppedTables, t.Name)
+		case t.Type == "table" && needsRebuild(t, want):
+			rebuilt[strings.ToLower(t.Name)] = true
+		case t.Type == "table":
+			alteredExisting = append(alteredExisting, t)
+			for _, idx := range explicitIndexes(t) {
+				if i := slices.IndexFunc(want.Indexes, func(w Index) bool { return strings.EqualFold(w.Name, idx.Name) }); i < 0 || !sameIndex(idx, want.Indexes[i]) {
+					statements = append(statements, "DROP INDEX IF EXISTS "+quoteIdentifier(idx.Name))
+				}
+			}
+		}
+	}
+
+	for _, want := range target {
+		t, ok := currentByName[strings.ToLower(want.Name)]
+		switch {
+		case want.Type == "view":
+			if !ok || t.Type != "view" || normalizeSQL(t.SQL) != normalizeSQL(want.SQL) {
+				createdViews = append(createdViews, want)
+			}
+		case !ok || t.Type != "table":
+			statements = append(statements, createTable(want, want.Name))
+			createdIndexes = append(createdIndexes, explicitIndexes(want)...)
+		case rebuilt[strings.ToLower(want.Name)]:
+			statements = append(statements, rebuildTable(t, want)...)
+			createdIndexes = append(createdIndexes, explicitIndexes(want)...)
+		}
+	}
+
+	for _, t := range alteredExisting {
+		want := targetByName[strings.ToLower(t.Name)]
+		for _, c := range want.Columns {
+			if !slices.ContainsFunc(t.Columns, func(have Column) bool { return strings.EqualFold(have.Name, c.Name) }) {
+				statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", quoteIdentifier(t.Name), columnDefinition(c)))
+			}
+		}
+		for _, c := range t.Columns {
+			if !slices.ContainsFunc(want.Columns, func(w Column) bool { return strings.EqualFold(w.Name, c.Name) }) {
+				statements = append(statements, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", quoteIdentifier(t.Name), quoteIdentifier(c.Name)))
+			}
+		}
+		for _, idx := range explicitIndexes(want) {
+			if i := slices.IndexFunc(t.Indexes, func(have Index) bool { return strings.EqualFold(have.Name, idx.Name) }); i < 0 || !sameIndex(t.Indexes[i], idx) {
+				createdIndexes = append(createdIndexes, idx)
+			}
+		}
+	}
+
+	for _, name := range droppedTables {
+		statements = append(statements, "DROP TABLE IF EXISTS "+quoteIdentifier(name))
+	}
+	for _, idx := range createdIndexes {
+		if stmt := createIndex(idx, targetTableOf(target, idx)); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	for _, v := range createdViews {
+		if v.SQL != "" {
+			statements = append(statements, v.SQL)
+		}
+	}
+	return statements
+}
+
+func byName(tables []Table) map[string]Table {
+	m := make(map[string]Table, len(tables))
+	for _, t := range tables {
+		m[strings.ToLower(t.Name)] = t
+	}
+	return m
+}
+
+func normalizeSQL(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// explicitIndexes returns the indexes created by CREATE INDEX, the others
+// come with the table definition.
+func explicitIndexes(t Table) []Index {
+	var list []Index
+	for _, idx := range t.Indexes {
+		if idx.Origin == "c" {
+			list = append(list, idx)
+		}
+	}
+	return list
+}
+
+// constraintIndexes returns the indexes of the PRIMARY KEY and UNIQUE
+// constraints of the table.
+func constraintIndexes(t Table) []Index {
+	var list []Index
+	for _, idx := range t.Indexes {
+		if idx.Origin != "c" {
+			list = append(list, idx)
+		}
+	}
+	return list
+}
+
+func sameIndex(a, b Index) bool {
+	if a.Unique != b.Unique || !slices.EqualFunc(a.Columns, b.Columns, strings.EqualFold) {
+		return false
+	}
+	return a.SQL == "" || b.SQL == "" || strings.EqualFold(normalizeSQL(a.SQL), normalizeSQL(b.SQL))
+}
+
+func sameColumn(a, b Column) bool {
+	return strings.EqualFold(a.Type, b.Type) && a.NotNull == b.NotNull && a.PrimaryKey == b.PrimaryKey &&
+		(a.Default == nil) == (b.Default == nil) && (a.Default == nil || *a.Default == *b.Default)
+}
+
+// needsRebuild reports whether the table can not be converged with ADD and
+// DROP COLUMN: a column, constraint or foreign key changed, a primary key or a NOT NULL
+// column without default added, a primary key column removed.
+func needsRebuild(t, want Table) bool {
+	for _, c := range want.Columns {
+		i := slices.IndexFunc(t.Columns, func(have Column) bool { return strings.EqualFold(have.Name, c.Name) })
+		if i < 0 {
+			if c.PrimaryKey > 0 || c.NotNull && c.Default == nil {
+				return true
+			}
+			continue
+		}
+		if !sameColumn(t.Columns[i], c) {
+			return true
+		}
+	}
+	for _, c := range t.Columns {
+		if c.PrimaryKey > 0 && !slices.ContainsFunc(want.Columns, func(w Column) bool { return strings.EqualFold(w.Name, c.Name) }) {
+			return true
+		}
+	}
+	if !slices.EqualFunc(constraintIndexes(t), constraintIndexes(want), sameIndex) {
+		return true
+	}
+	return !slices.EqualFunc(t.ForeignKeys, want.ForeignKeys, func(a, b ForeignKey) bool {
+		return strings.EqualFold(a.Table, b.Table) && slices.EqualFunc(a.Columns, b.Columns, strings.EqualFold) &&
+			slices.EqualFunc(a.References, b.References, strings.EqualFold) &&
+			strings.EqualFold(a.OnUpdate, b.OnUpdate) && strings.EqualFold(a.OnDelete, b.OnDelete)
+	})
+}
+
+// rebuildTable creates the target table aside, copies the columns kept and
+// replaces the current table with it, the way SQLite documents to make the
+// changes ALTER TABLE does not support.
+func rebuildTable(t, want Table) []string {
+	tmp := "ha_rebuild_" + want.Name
+	var columns []string
+	for _, c := range want.Columns {
+		if slices.ContainsFunc(t.Columns, func(have Column) bool { return strings.EqualFold(have.Name, c.Name) }) {
+			columns = append(columns, quoteIdentifier(c.Name))
+		}
+	}
+	statements := []string{createTable(want, tmp)}
+	if len(columns) > 0 {
+		list := strings.Join(columns, ", ")
+		statements = append(statements, fmt.Sprintf("INSERT INTO %s(%s) SELECT %s FROM %s", quoteIdentifier(tmp), list, list, quoteIdentifier(t.Name)))
+	}
+	return append(statements,
+		"DROP TABLE "+quoteIdentifier(t.Name),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteIdentifier(tmp), quoteIdentifier(want.Name)))
+}
+
+// createTable returns the statement creating the table with the name, from
+// its SQL or, for a schema described without it, from its columns.
+func createTable(t Table, name string) string {
+	if t.SQL != "" {
+		return reCreateTableName.ReplaceAllLiteralString(t.SQL, "CREATE TABLE "+quoteIdentifier(name))
+	}
+	var (
+		defs []string
+		pk   []Column
+	)
+	for _, c := range t.Columns {
+		defs = append(defs, columnDefinition(c))
+		if c.PrimaryKey > 0 {
+			pk = append(pk, c)
+		}
+	}
+	if len(pk) > 0 {
+		slices.SortFunc(pk, func(a, b Column) int { return a.PrimaryKey - b.PrimaryKey })
+		names := make([]string, len(pk))
+		for i, c := range pk {
+			names[i] = c.Name
+		}
+		defs = append(defs, "PRIMARY KEY("+quoteIdentifiers(names)+")")
+	}
+	for _, idx := range t.Indexes {
+		if idx.Origin == "u" {
+			defs = append(defs, "UNIQUE("+quoteIdentifiers(idx.Columns)+")")
+		}
+	}
+	for _, fk := range t.ForeignKeys {
+		def := fmt.Sprintf("FOREIGN KEY(%s) REFERENCES %s", quoteIdentifiers(fk.Columns), quoteIdentifier(fk.Table))
+		if !slices.Contains(fk.References, "") {
+			def += "(" + quoteIdentifiers(fk.References) + ")"
+		}
+		if fk.OnUpdate != "" && fk.OnUpdate != "NO ACTION" {
+			def += " ON UPDATE " + fk.OnUpdate
+		}
+		if fk.OnDelete != "" && fk.OnDelete != "NO ACTION" {
+			def += " ON DELETE " + fk.OnDelete
+		}
+		defs = append(defs, def)
+	}
+	return fmt.Sprintf("CREATE TABLE %s(%s)", quoteIdentifier(name), strings.Join(defs, ", "))
+}
+
+func columnDefinition(c Column) string {
+	def := quoteIdentifier(c.Name)
+	if c.Type != "" {
+		def += " " + c.Type
+	}
+	if c.NotNull {
+		def += " NOT NULL"
+	}
+	if c.Default != nil {
+		def += " DEFAULT " + *c.Default
+	}
+	return def
+}
+
+// createIndex returns the statement creating the index, empty for an index
+// on expressions described without its SQL.
+func createIndex(idx Index, table string) string {
+	if idx.SQL != "" {
+		return idx.SQL
+	}
+	if table == "" || slices.Contains(idx.Columns, "") {
+		return ""
+	}
+	unique := ""
+	if idx.Unique {
+		unique = "UNIQUE "
+	}
+	return fmt.Sprintf("CREATE %sINDEX %s ON %s(%s)", unique, quoteIdentifier(idx.Name), quoteIdentifier(table), quoteIdentifiers(idx.Columns))
+}
+
+func targetTableOf(target []Table, idx Index) string {
+	for _, t := range target {
+		if slices.ContainsFunc(t.Indexes, func(i Index) bool { return i.Name == idx.Name }) {
+			return t.Name
+		}
+	}
+	return ""
+}
+
+func quoteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdentifier(name)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,79 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/litesql/go-sqlite3"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestDiffSchema(t *testing.T) {
+	ctx := context.Background()
+	open := func(name string, statements ...string) *sql.DB {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		for _, s := range statements {
+			if _, err := db.Exec(s); err != nil {
+				t.Fatalf("%s: %v", s, err)
+			}
+		}
+		return db
+	}
+	current := open("current.db",
+		"CREATE TABLE users(id INTEGER PRIMARY KEY, name TEXT, phone TEXT)",
+		"CREATE TABLE orders(id INTEGER PRIMARY KEY, total INTEGER)",
+		"INSERT INTO orders VALUES(1, 10)",
+		"CREATE TABLE old(x)",
+		"CREATE INDEX users_name ON users(name)",
+		"CREATE VIEW names AS SELECT name FROM users",
+	)
+	target := open("target.db",
+		"CREATE TABLE users(id INTEGER PRIMARY KEY, name TEXT, email TEXT DEFAULT '')",
+		"CREATE TABLE orders(id INTEGER PRIMARY KEY, total REAL NOT NULL, user_id INTEGER REFERENCES users(id), UNIQUE(user_id))",
+		"CREATE TABLE logs(id INTEGER PRIMARY KEY, msg TEXT)",
+		"CREATE UNIQUE INDEX users_name ON users(name)",
+		"CREATE INDEX logs_msg ON logs(msg)",
+		"CREATE VIEW names AS SELECT id, name FROM users",
+	)
+	want, err := sqlite.Schema(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := sqlite.Schema(ctx, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqlite.SchemaFingerprint(have) == sqlite.SchemaFingerprint(want) {
+		t.Fatal("different schemas have the same fingerprint")
+	}
+
+	for _, s := range sqlite.DiffSchema(have, want) {
+		if _, err := current.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	have, err = sqlite.Schema(ctx, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := sqlite.DiffSchema(have, want); len(diff) > 0 {
+		t.Errorf("schema not converged, still needs %q", diff)
+	}
+	if sqlite.SchemaFingerprint(have) != sqlite.SchemaFingerprint(want) {
+		t.Error("converged schemas have different fingerprints")
+	}
+	// the rebuilt table keeps its rows
+	var total float64
+	if err := current.QueryRow("SELECT total FROM orders WHERE id = 1").Scan(&total); err != nil || total != 10 {
+		t.Errorf("got total %v, error %v, want 10", total, err)
+	}
+}
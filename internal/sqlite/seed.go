@@ -0,0 +1,182 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const seedTableName = "ha_seed"
+
+// Seed executes the *.sql files from dir not yet applied to the database,
+// in lexical order. Files in dir are applied to the default database and files
+// in dir/<id> to the database id. Only the leader runs the seeds; the applied
+// files are recorded in the replicated ha_seed table so they run once per cluster.
+func Seed(ctx context.Context, id, dir string) error {
+	files, err := seedFiles(id, dir)
+	if err != nil {
+		return err
+	}
+	return SeedFiles(ctx, id, files)
+}
+
+// SeedFiles executes the seed files not yet applied to the database like
+// Seed, in the order given.
+func SeedFiles(ctx context.Context, id string, files []string) error {
+	connector, err := Connector(id)
+	if err != nil {
+		return err
+	}
+	if !connector.LeaderProvider().IsLeader() || len(files) == 0 {
+		return nil
+	}
+	db, err := DB(id)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+seedTableName+"(file TEXT PRIMARY KEY, applied_at TEXT NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("create seed table: %w", err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := applySeeds(ctx, tx, files); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reset drops every user table, view and trigger of the database in a single
+// replicated transaction, optionally applying the seed files again.
+func Reset(ctx context.Context, id, dir string, seed bool) error {
+	db, err := DB(id)
+	if err != nil {
+		return err
+	}
+	var files []string
+	if seed {
+		files, err = seedFiles(id, dir)
+		if err != nil {
+			return err
+		}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dropped, err := dropSchema(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+seedTableName+"(file TEXT PRIMARY KEY, applied_at TEXT NOT NULL)"); err != nil {
+		return fmt.Errorf("create seed table: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+seedTableName); err != nil {
+		return err
+	}
+	if err := applySeeds(ctx, tx, files); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("database reset", "id", id, "dropped", dropped, "seeds", len(files))
+	return nil
+}
+
+// dropSchema drops every user table, view and trigger, keeping the sqlite_ and
+// ha_ internal tables.
+func dropSchema(ctx context.Context, tx *sql.Tx) (int, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT type, name FROM sqlite_schema
+		WHERE type IN ('table', 'view', 'trigger') AND name NOT GLOB 'sqlite_*' AND name NOT GLOB 'ha_*'
+		ORDER BY CASE type WHEN 'trigger' THEN 0 WHEN 'view' THEN 1 ELSE 2 END`)
+	if err != nil {
+		return 0, err
+	}
+	var drops []string
+	for rows.Next() {
+		var typ, name string
+		if err := rows.Scan(&typ, &name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		drops = append(drops, fmt.Sprintf("DROP %s IF EXISTS %q", strings.ToUpper(typ), name))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "PRAGMA defer_foreign_keys = 1"); err != nil {
+		return 0, err
+	}
+	for _, drop := range drops {
+		if _, err := tx.ExecContext(ctx, drop); err != nil {
+			return 0, fmt.Errorf("%s: %w", drop, err)
+		}
+	}
+	return len(drops), nil
+}
+
+func applySeeds(ctx context.Context, tx *sql.Tx, files []string) error {
+	for _, file := range files {
+		name := filepath.Base(file)
+		var applied int
+		err := tx.QueryRowContext(ctx, "SELECT count(*) FROM "+seedTableName+" WHERE file = ?", name).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		slog.Info("applying seed", "file", file)
+		if _, err := tx.ExecContext(ctx, string(data)); err != nil {
+			return fmt.Errorf("seed %q: %w", file, err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO "+seedTableName+"(file, applied_at) VALUES(?, ?)", name, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func seedFiles(id, dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	isDefault := id == "" || id == DefaultDatabase()
+	var patterns []string
+	if id != "" {
+		patterns = append(patterns, filepath.Join(dir, id, "*.sql"))
+	}
+	if isDefault {
+		patterns = append(patterns, filepath.Join(dir, "*.sql"))
+	}
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	slices.SortFunc(files, func(a, b string) int {
+		return strings.Compare(filepath.Base(a), filepath.Base(b))
+	})
+	return files, nil
+}
@@ -0,0 +1,84 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// TestResetSeeded drops the tables of a seeded database and applies the seed
+// files again, through the go-ha driver.
+func TestResetSeeded(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	seeds := filepath.Join(dir, "seeds")
+	if err := os.MkdirAll(filepath.Join(seeds, "reset.db"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(seeds, "reset.db", "001_users.sql"), []byte(`CREATE TABLE users(id INTEGER PRIMARY KEY, name TEXT);
+INSERT INTO users(name) VALUES('seeded');`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlite.Load(ctx, "file:"+filepath.Join(dir, "reset.db"), sqlite.LoadConfig{MaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlite.Seed(ctx, "reset.db", seeds); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB("reset.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"INSERT INTO users(name) VALUES('added')",
+		"CREATE TABLE extra(x)",
+		"CREATE VIEW names AS SELECT name FROM users",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	if err := sqlite.Reset(ctx, "reset.db", seeds, true); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_schema WHERE type IN ('table', 'view') AND name NOT GLOB 'sqlite_*' AND name NOT GLOB 'ha_*' ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if want := []string{"users"}; !slices.Equal(names, want) {
+		t.Fatalf("tables %v after the reset, want %v", names, want)
+	}
+	var users []string
+	rows, err = db.QueryContext(ctx, "SELECT name FROM users ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, name)
+	}
+	if want := []string{"seeded"}; !slices.Equal(users, want) {
+		t.Fatalf("users %v after the reset, want %v", users, want)
+	}
+}
@@ -0,0 +1,135 @@
+package sqlite
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/litesql/go-ha"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/litesql/ha/internal/session"
+)
+
+var ErrQueryRejected = errors.New("statement rejected by the query interceptor")
+
+var (
+	queryInterceptor session.QueryInterceptor
+	queryObserver    session.QueryObserver
+	publishIdentity  bool
+)
+
+// SetQueryInterceptor sets the interceptor of the statements sent by the
+// clients.
+func SetQueryInterceptor(interceptor session.QueryInterceptor) {
+	queryInterceptor = interceptor
+}
+
+// InterceptQuery returns the statement to execute on the database for the
+// session in ctx, or an ErrQueryRejected error.
+func InterceptQuery(ctx context.Context, id, query string) (string, error) {
+	if queryInterceptor == nil {
+		return query, nil
+	}
+	rewritten, err := queryInterceptor(ctx, cmp.Or(id, DefaultDatabase()), query)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrQueryRejected, err)
+	}
+	return rewritten, nil
+}
+
+// SetQueryObserver sets the observer of the statements executed for the
+// clients.
+func SetQueryObserver(observer session.QueryObserver) {
+	queryObserver = observer
+}
+
+// AfterQuery reports the execution of the statement, returned by
+// InterceptQuery, to the query observer.
+func AfterQuery(ctx context.Context, id, query string, err error) {
+	if queryObserver == nil {
+		return
+	}
+	queryObserver(ctx, cmp.Or(id, DefaultDatabase()), query, err)
+}
+
+// SetPublishIdentity publishes the identity of the sessions with the
+// changesets they commit.
+func SetPublishIdentity(enabled bool) {
+	publishIdentity = enabled
+}
+
+// WithIdentity runs fn, which may commit a transaction on db, so its
+// changeset is published with the identity of the session in ctx. The
+// commits of the sessions are serialized, the identity is held by the
+// publisher of the database until fn returns.
+func WithIdentity(ctx context.Context, db *sql.DB, fn func() error) error {
+	return withStatements(ctx, db, nil, fn)
+}
+
+// withStatements runs fn like WithIdentity, and replicates the changeset as
+// the statements when every table changed is replicated as statements, see
+// replaceWithStatements.
+func withStatements(ctx context.Context, db *sql.DB, statements []ha.Change, fn func() error) error {
+	traced := trace.SpanContextFromContext(ctx)
+	if !publishIdentity && statements == nil && !traced.IsSampled() {
+		return fn()
+	}
+	pub := publisherOf(db)
+	if pub == nil {
+		return fn()
+	}
+	pub.commitMu.Lock()
+	defer pub.commitMu.Unlock()
+	if id, ok := session.FromContext(ctx); ok && publishIdentity {
+		pub.identity.Store(&id)
+		defer pub.identity.Store(nil)
+	}
+	if traced.IsSampled() {
+		pub.spanContext.Store(&traced)
+		defer pub.spanContext.Store(nil)
+	}
+	if statements != nil {
+		pub.statements.Store(&statements)
+		defer pub.statements.Store(nil)
+	}
+	return fn()
+}
+
+// Commit commits the transaction of the session in ctx started on db.
+func Commit(ctx context.Context, db *sql.DB, tx *sql.Tx) error {
+	err := WithIdentity(ctx, db, tx.Commit)
+	return CommitError(err)
+}
+
+// execWithIdentity executes the statement, committed with the identity of
+// the session when it runs outside of a transaction.
+func execWithIdentity(ctx context.Context, eq execerQuerier, query string, params map[string]any) (*Response, error) {
+	db, ok := eq.(*sql.DB)
+	if !ok {
+		return doExec(ctx, eq, query, params)
+	}
+	var statements []ha.Change
+	if statementReplication() {
+		if stmt, ok := statementChange(ctx, db, query, params); ok {
+			statements = []ha.Change{stmt}
+		}
+	}
+	var res *Response
+	err := withStatements(ctx, db, statements, func() (err error) {
+		res, err = doExec(ctx, eq, query, params)
+		return err
+	})
+	return res, err
+}
+
+func publisherOf(db *sql.DB) *lazyPublisher {
+	for _, connDB := range dbs {
+		if connDB.db == db {
+			return connDB.publisher
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/litesql/go-ha"
+	sqlparser "github.com/rqlite/sql"
+)
+
+// statementModes chooses how the changes of each table are replicated: the
+// values of the rows changed (the default), or the text of the statements
+// executed, for the tables matching a statement pattern and no value pattern.
+var statementModes struct {
+	statement []string
+	value     []string
+}
+
+// SetReplicationModes parses a comma separated list of table=statement or
+// table=value, table being a glob pattern. The value patterns win over the
+// statement patterns, e.g. "*=statement,audit_*=value".
+func SetReplicationModes(spec string) error {
+	var statement, value []string
+	for item := range strings.SplitSeq(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, mode, ok := strings.Cut(item, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !ok || pattern == "" {
+			return fmt.Errorf("invalid replication mode %q, use table=statement or table=value", item)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid table pattern %q: %w", pattern, err)
+		}
+		switch strings.ToLower(strings.TrimSpace(mode)) {
+		case "statement":
+			statement = append(statement, pattern)
+		case "value":
+			value = append(value, pattern)
+		default:
+			return fmt.Errorf("invalid replication mode %q for table %s, use statement or value", mode, pattern)
+		}
+	}
+	statementModes.statement, statementModes.value = statement, value
+	return nil
+}
+
+func statementReplication() bool {
+	return len(statementModes.statement) > 0
+}
+
+// statementTable reports whether the changes of the table may be replicated
+// as statements. The tables of the node (ha_*) and of SQLite are mirrored
+// from the values and always replicated as values.
+func statementTable(table string) bool {
+	table = strings.ToLower(table)
+	if table == "" || strings.HasPrefix(table, "ha_") || strings.HasPrefix(table, "sqlite_") {
+		return false
+	}
+	for _, pattern := range statementModes.value {
+		if ok, _ := path.Match(pattern, table); ok {
+			return false
+		}
+	}
+	for _, pattern := range statementModes.statement {
+		if ok, _ := path.Match(pattern, table); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nonDeterministic matches the functions and keywords giving a different
+// result on each node, a statement using them is replicated as values. The
+// date and time functions without a time value, or strftime with only the
+// format, read the current time like 'now'.
+var nonDeterministic = regexp.MustCompile(`(?i)\b(random|randomblob|changes|total_changes|last_insert_rowid|ha_flag|ha_flag_value)\s*\(|\bcurrent_(timestamp|date|time)\b|'now'|\b(date|time|datetime|julianday|unixepoch)\s*\(\s*\)|\bstrftime\s*\(\s*'([^']|'')*'\s*\)`)
+
+// statementChange returns the change replicating the statement, false when it
+// can't be replicated as text: named parameters are not kept by the
+// changeset encoding, and the nodes would store different rows from a
+// non-deterministic default or a trigger of the table changed.
+func statementChange(ctx context.Context, querier querier, query string, params map[string]any) (ha.Change, bool) {
+	if nonDeterministic.MatchString(query) {
+		return ha.Change{}, false
+	}
+	for k := range params {
+		if k == "" || !isPositional(rune(k[0])) {
+			return ha.Change{}, false
+		}
+	}
+	table, insert, ok := statementTarget(query)
+	if !ok || !deterministicTable(ctx, querier, table, insert) {
+		return ha.Change{}, false
+	}
+	return ha.Change{Operation: "SQL", Command: query, Args: getArgs(params)}, true
+}
+
+// statementTarget returns the table of the main database changed by the
+// single INSERT, UPDATE or DELETE of the query, and whether it inserts.
+func statementTarget(query string) (table string, insert bool, ok bool) {
+	stmts, err := sqlparser.NewParser(strings.NewReader(query)).ParseStatements()
+	if err != nil || len(stmts) != 1 {
+		return "", false, false
+	}
+	var schema *sqlparser.Ident
+	switch stmt := stmts[0].(type) {
+	case *sqlparser.InsertStatement:
+		schema, table, insert = stmt.Schema, stmt.Table.Name, true
+	case *sqlparser.UpdateStatement:
+		schema, table = stmt.Table.Schema, stmt.Table.Name.Name
+	case *sqlparser.DeleteStatement:
+		schema, table = stmt.Table.Schema, stmt.Table.Name.Name
+	default:
+		return "", false, false
+	}
+	if schema != nil && !strings.EqualFold(schema.Name, "main") {
+		return "", false, false
+	}
+	return table, insert, true
+}
+
+// deterministicTable reports whether a statement changing the table gives
+// the same rows on every node: the table has no trigger and, for an insert,
+// no column default like CURRENT_TIMESTAMP or random().
+func deterministicTable(ctx context.Context, querier querier, table string, insert bool) bool {
+	rows, err := querier.QueryContext(ctx, `SELECT 'trigger', name FROM sqlite_schema WHERE type = 'trigger' AND tbl_name = ? COLLATE NOCASE
+		UNION ALL SELECT 'default', dflt_value FROM pragma_table_xinfo(?) WHERE dflt_value IS NOT NULL AND ?`, table, table, insert)
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, value string
+		if err := rows.Scan(&kind, &value); err != nil {
+			return false
+		}
+		if kind == "trigger" || nonDeterministic.MatchString(value) {
+			slog.Debug("statement replicated as values", "table", table, kind, value)
+			return false
+		}
+	}
+	return rows.Err() == nil
+}
+
+// replaceWithStatements replaces the row changes of cs by the statements
+// that made them, when every change is a row change of a table replicated as
+// statements. Otherwise the changeset is left as values: a statement can't be
+// split between the tables it changed.
+func replaceWithStatements(cs *ha.ChangeSet, statements []ha.Change) {
+	if len(statements) == 0 || len(cs.Changes) == 0 {
+		return
+	}
+	var table string
+	for _, change := range cs.Changes {
+		switch change.Operation {
+		case "INSERT", "UPDATE", "DELETE":
+		default:
+			return
+		}
+		if !statementTable(change.Table) {
+			slog.Debug("changeset replicated as values", "db", cs.Filename, "table", change.Table)
+			return
+		}
+		if table == "" {
+			table = change.Table
+		} else if !strings.EqualFold(table, change.Table) {
+			table = "-"
+		}
+	}
+	ts := cs.Changes[len(cs.Changes)-1].TsNs
+	changes := make([]ha.Change, len(statements))
+	for i, stmt := range statements {
+		stmt.TsNs = ts
+		if table != "-" {
+			stmt.Table = table
+		}
+		changes[i] = stmt
+	}
+	slog.Debug("changeset replicated as statements", "db", cs.Filename, "rows", len(cs.Changes), "statements", len(changes))
+	cs.Changes = changes
+}
@@ -0,0 +1,104 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// TestStatementReplication replicates the statements changing a table as
+// text, unless a node would store other rows running it: a default like
+// CURRENT_TIMESTAMP or a trigger of the table.
+func TestStatementReplication(t *testing.T) {
+	ctx := context.Background()
+	if err := sqlite.SetReplicationModes("*=statement"); err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.SetReplicationModes("")
+	pub := new(recorder)
+	err := sqlite.Load(ctx, "file:"+filepath.Join(t.TempDir(), "statement.db"), sqlite.LoadConfig{
+		MaxConns: 1,
+		Publisher: func(string, string) (ha.Publisher, error) {
+			return pub, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB("statement.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE plain(id INTEGER PRIMARY KEY, name TEXT DEFAULT 'none')",
+		"CREATE TABLE stamped(id INTEGER PRIMARY KEY, created TEXT DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE TABLE keyed(id INTEGER PRIMARY KEY, token BLOB DEFAULT (randomblob(8)))",
+		"CREATE TABLE dated(id INTEGER PRIMARY KEY, at TEXT DEFAULT (date()))",
+		"CREATE TABLE timed(id INTEGER PRIMARY KEY, at TEXT DEFAULT (time( )))",
+		"CREATE TABLE datetimed(id INTEGER PRIMARY KEY, at TEXT DEFAULT (datetime()))",
+		"CREATE TABLE julian(id INTEGER PRIMARY KEY, at REAL DEFAULT (julianday()))",
+		"CREATE TABLE epoch(id INTEGER PRIMARY KEY, at INTEGER DEFAULT (unixepoch()))",
+		"CREATE TABLE formatted(id INTEGER PRIMARY KEY, at TEXT DEFAULT (strftime('%s')))",
+		"CREATE TABLE fixed(id INTEGER PRIMARY KEY, at TEXT DEFAULT (strftime('%Y', '2024-01-01')))",
+		"CREATE TABLE audited(id INTEGER PRIMARY KEY)",
+		"CREATE TABLE audit_log(at TEXT)",
+		"CREATE TRIGGER audited_insert AFTER INSERT ON audited BEGIN INSERT INTO audit_log VALUES (datetime('now')); END",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	tests := []struct {
+		query     string
+		statement bool
+	}{
+		{query: "INSERT INTO plain (id) VALUES (1)", statement: true},
+		{query: "INSERT INTO stamped (id) VALUES (1)"},
+		{query: "UPDATE stamped SET id = 2 WHERE id = 1", statement: true},
+		{query: "INSERT INTO keyed (id) VALUES (1)"},
+		{query: "INSERT INTO dated (id) VALUES (1)"},
+		{query: "INSERT INTO timed (id) VALUES (1)"},
+		{query: "INSERT INTO datetimed (id) VALUES (1)"},
+		{query: "INSERT INTO julian (id) VALUES (1)"},
+		{query: "INSERT INTO epoch (id) VALUES (1)"},
+		{query: "INSERT INTO formatted (id) VALUES (1)"},
+		{query: "INSERT INTO fixed (id) VALUES (1)", statement: true},
+		{query: "UPDATE plain SET name = date() WHERE id = 1"},
+		{query: "UPDATE plain SET name = time() WHERE id = 1"},
+		{query: "UPDATE plain SET name = DATETIME () WHERE id = 1"},
+		{query: "UPDATE plain SET name = julianday() WHERE id = 1"},
+		{query: "UPDATE plain SET name = unixepoch() WHERE id = 1"},
+		{query: "UPDATE plain SET name = strftime('%s') WHERE id = 1"},
+		{query: "UPDATE plain SET name = strftime('%Y-%m-%d', '2024-01-01') WHERE id = 1", statement: true},
+		{query: "UPDATE plain SET name = date('2024-01-01') WHERE id = 1", statement: true},
+		{query: "INSERT INTO audited (id) VALUES (1)"},
+		{query: "DELETE FROM audited"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			published := len(pub.messages)
+			if _, err := sqlite.Exec(ctx, db, tt.query, nil); err != nil {
+				t.Fatal(err)
+			}
+			if len(pub.messages) != published+1 {
+				t.Fatalf("published %d changesets, want 1", len(pub.messages)-published)
+			}
+			cs := ha.NewChangeSet("node2", "")
+			if err := json.Unmarshal(pub.messages[published], cs); err != nil {
+				t.Fatal(err)
+			}
+			statement := len(cs.Changes) == 1 && cs.Changes[0].Operation == "SQL"
+			if statement != tt.statement {
+				t.Errorf("replicated as statement %v, want %v: %+v", statement, tt.statement, cs.Changes)
+			}
+		})
+	}
+}
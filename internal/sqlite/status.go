@@ -0,0 +1,87 @@
+package sqlite
+
+import (
+	"context"
+	"slices"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// DatabaseStatus is the state of a database reported by /status: its health,
+// size, stream sequences and replication consumer.
+type DatabaseStatus struct {
+	Health
+	SizeBytes    int64  `json:"size_bytes"`
+	PublishedSeq uint64 `json:"published_seq"`
+	// SnapshotSeq is the stream sequence of the latest snapshot in the
+	// JetStream Object Store, 0 when there is none.
+	SnapshotSeq uint64          `json:"snapshot_seq,omitempty"`
+	Consumer    *ConsumerStatus `json:"consumer,omitempty"`
+}
+
+// ConsumerStatus is the state of the JetStream consumer applying the changes
+// of the other nodes.
+type ConsumerStatus struct {
+	Name          string `json:"name"`
+	DeliveredSeq  uint64 `json:"delivered_seq"`
+	AckFloorSeq   uint64 `json:"ack_floor_seq"`
+	NumPending    uint64 `json:"num_pending"`
+	NumAckPending int    `json:"num_ack_pending"`
+	Redelivered   int    `json:"redelivered"`
+	Paused        bool   `json:"paused,omitempty"`
+}
+
+type snapshotSequencer interface {
+	LatestSnapshotSequence(ctx context.Context) (uint64, error)
+}
+
+// DatabasesStatus reports the state of every database. The failures are
+// reported in the Error of each database, like DatabasesHealth.
+func DatabasesStatus(ctx context.Context) []DatabaseStatus {
+	ids := Databases()
+	slices.Sort(ids)
+	list := make([]DatabaseStatus, 0, len(ids))
+	for _, id := range ids {
+		s := DatabaseStatus{Health: Health{ID: id}}
+		if err := databaseHealth(ctx, id, &s.Health); err != nil {
+			s.Error = err.Error()
+		}
+		databaseStatus(ctx, id, &s)
+		list = append(list, s)
+	}
+	return list
+}
+
+func databaseStatus(ctx context.Context, id string, s *DatabaseStatus) {
+	muDBs.Lock()
+	connDB, ok := lookup(id)
+	muDBs.Unlock()
+	if !ok {
+		return
+	}
+	connector := connDB.connector
+	s.PublishedSeq = connector.Publisher().Sequence()
+	// the database can be swapped by a restore, the size is best effort
+	_ = connDB.db.QueryRowContext(ha.ContextLocalDB(ctx, true),
+		"SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&s.SizeBytes)
+	if snapshotter, ok := connector.Snapshotter().(snapshotSequencer); ok {
+		// no snapshot taken yet is an error of the object store
+		s.SnapshotSeq, _ = snapshotter.LatestSnapshotSequence(ctx)
+	}
+	info, err := connector.DeliveredInfo(ctx, ConsumerName(id, connector.NodeName()))
+	if err != nil {
+		return
+	}
+	if ci, ok := info.(*jetstream.ConsumerInfo); ok {
+		s.Consumer = &ConsumerStatus{
+			Name:          ci.Name,
+			DeliveredSeq:  ci.Delivered.Stream,
+			AckFloorSeq:   ci.AckFloor.Stream,
+			NumPending:    ci.NumPending,
+			NumAckPending: ci.NumAckPending,
+			Redelivered:   ci.NumRedelivered,
+			Paused:        ci.Paused,
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// IsQuery reports whether the statement is executed as a query returning rows.
+func IsQuery(sql string) bool {
+	upper := strings.ToUpper(strings.TrimSpace(sql))
+	return strings.HasPrefix(upper, "SELECT") || strings.HasPrefix(upper, "EXPLAIN")
+}
+
+// Columns returns the result columns of the query with their declared type.
+// The rows are opened but never read: SQLite prepares the statement and
+// stops before running it.
+func Columns(ctx context.Context, querier querier, query string) ([]ColumnMeta, error) {
+	rows, err := querier.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]ColumnMeta, len(types))
+	for i, t := range types {
+		columns[i] = ColumnMeta{Name: t.Name(), DeclType: t.DatabaseTypeName()}
+	}
+	return columns, nil
+}
+
+// Stream executes the query calling fn for each row as soon as it is read,
+// instead of buffering the whole result like Exec. It stops when fn fails or
+// the context is done, and returns the number of rows sent to fn.
+func Stream(ctx context.Context, querier querier, query string, params map[string]any, fn func(row []any) error) (int64, error) {
+	if err := checkStatementParameters(ctx, query, params); err != nil {
+		return 0, err
+	}
+	rows, err := querier.QueryContext(ctx, query, getArgs(params)...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("zero columns")
+	}
+	var count int64
+	values := make([]any, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return count, err
+		}
+		if err := fn(values); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
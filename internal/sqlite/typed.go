@@ -0,0 +1,113 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type typedValuesKey struct{}
+
+// ContextTypedValues enables (types=true) the typed query responses: the
+// type of each column is returned and the values keep it in the JSON.
+func ContextTypedValues(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, typedValuesKey{}, enabled)
+}
+
+func typedValuesEnabled(ctx context.Context) bool {
+	enabled, _ := ctx.Value(typedValuesKey{}).(bool)
+	return enabled
+}
+
+// The column types of the typed responses. The values of an integer column
+// are JSON integers, of a real column numbers with a decimal point (or
+// "Infinity", "-Infinity"), of a boolean column true or false, of a blob
+// column base64 strings and of a datetime column RFC 3339 strings. A column
+// whose rows have different types is any, and null when every value is NULL.
+const (
+	TypeInteger  = "integer"
+	TypeReal     = "real"
+	TypeText     = "text"
+	TypeBlob     = "blob"
+	TypeBoolean  = "boolean"
+	TypeDatetime = "datetime"
+	TypeAny      = "any"
+	TypeNull     = "null"
+)
+
+// realValue is a float encoded with a decimal point, so the JSON decoders do
+// not read it as an integer.
+type realValue float64
+
+func (r realValue) MarshalJSON() ([]byte, error) {
+	f := float64(r)
+	switch {
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	case math.IsNaN(f):
+		return []byte("null"), nil
+	}
+	b := strconv.AppendFloat(nil, f, 'g', -1, 64)
+	if !strings.ContainsAny(string(b), ".e") {
+		b = append(b, ".0"...)
+	}
+	return b, nil
+}
+
+// valueType returns the type of a value scanned from SQLite.
+func valueType(v any) string {
+	switch v.(type) {
+	case nil:
+		return TypeNull
+	case int64:
+		return TypeInteger
+	case float64:
+		return TypeReal
+	case []byte:
+		return TypeBlob
+	case bool:
+		return TypeBoolean
+	case time.Time:
+		return TypeDatetime
+	default:
+		return TypeText
+	}
+}
+
+// typeValues sets the types of the columns of the response and converts its
+// values to keep them. The type of a column comes from its values, the
+// declared type only tells the booleans (BOOL, BOOLEAN) from the integers.
+func typeValues(res *Response, columnTypes []*sql.ColumnType) {
+	res.Types = make([]string, len(res.Columns))
+	for i := range res.Columns {
+		typ := TypeNull
+		for _, row := range res.Rows {
+			switch t := valueType(row[i]); {
+			case t == TypeNull:
+			case typ == TypeNull:
+				typ = t
+			case typ != t:
+				typ = TypeAny
+			}
+		}
+		if typ == TypeInteger && i < len(columnTypes) && strings.Contains(strings.ToUpper(columnTypes[i].DatabaseTypeName()), "BOOL") {
+			typ = TypeBoolean
+		}
+		res.Types[i] = typ
+		for _, row := range res.Rows {
+			switch v := row[i].(type) {
+			case int64:
+				if typ == TypeBoolean {
+					row[i] = v != 0
+				}
+			case float64:
+				row[i] = realValue(v)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+//go:build cgo
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	_ "github.com/litesql/go-sqlite3"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func TestTypedValues(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE products(id INTEGER PRIMARY KEY, price REAL, active BOOLEAN, photo BLOB, note TEXT, extra);
+		INSERT INTO products VALUES(1, 10, 1, x'0102', NULL, 1), (2, 2.5, 0, NULL, NULL, 'a')`); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := sqlite.ContextTypedValues(context.Background(), true)
+	res, err := sqlite.Exec(ctx, db, "SELECT id, price, active, photo, note, extra FROM products ORDER BY id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTypes := []string{"integer", "real", "boolean", "blob", "null", "any"}
+	if !slices.Equal(res.Types, wantTypes) {
+		t.Errorf("Types = %v, want %v", res.Types, wantTypes)
+	}
+	got, err := json.Marshal(res.Rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[[1,10.0,true,"AQI=",null,1],[2,2.5,false,null,null,"a"]]`; string(got) != want {
+		t.Errorf("rows = %s, want %s", got, want)
+	}
+
+	res, err = sqlite.Exec(context.Background(), db, "SELECT price FROM products ORDER BY id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Types != nil {
+		t.Errorf("Types = %v without types=true, want none", res.Types)
+	}
+}
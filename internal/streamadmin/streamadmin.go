@@ -0,0 +1,261 @@
+// Package streamadmin manages the JetStream replication streams of the node
+// databases and their consumers, so the operators don't need the nats CLI
+// and separate credentials.
+package streamadmin
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+var (
+	// ErrUnknownStream is returned for the streams not replicating a
+	// database of the node.
+	ErrUnknownStream = errors.New("not a replication stream of this node")
+	// ErrNotApplied is returned when a purge would remove messages a
+	// consumer has not acknowledged yet.
+	ErrNotApplied = errors.New("messages not applied by every consumer")
+)
+
+type Stream struct {
+	Name      string    `json:"name"`
+	Databases []string  `json:"databases"`
+	Subjects  []string  `json:"subjects"`
+	MaxAge    string    `json:"max_age"`
+	MaxBytes  int64     `json:"max_bytes"`
+	MaxMsgs   int64     `json:"max_msgs"`
+	Replicas  int       `json:"replicas"`
+	Storage   string    `json:"storage"`
+	Messages  uint64    `json:"messages"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeq  uint64    `json:"first_seq"`
+	FirstTime time.Time `json:"first_time"`
+	LastSeq   uint64    `json:"last_seq"`
+	LastTime  time.Time `json:"last_time"`
+	Consumers int       `json:"consumers"`
+}
+
+type Consumer struct {
+	Name       string     `json:"name"`
+	Created    time.Time  `json:"created"`
+	Delivered  uint64     `json:"delivered_seq"`
+	AckFloor   uint64     `json:"ack_floor_seq"`
+	Pending    uint64     `json:"pending"`
+	AckPending int        `json:"ack_pending"`
+	LastActive *time.Time `json:"last_active,omitempty"`
+}
+
+// Update changes the retention of a stream, the nil fields are kept. A zero
+// value removes the limit.
+type Update struct {
+	MaxAge   *string `json:"max_age,omitempty"`
+	MaxBytes *int64  `json:"max_bytes,omitempty"`
+	MaxMsgs  *int64  `json:"max_msgs,omitempty"`
+}
+
+type Admin struct {
+	js jetstream.JetStream
+}
+
+func New(js jetstream.JetStream) *Admin {
+	return &Admin{js: js}
+}
+
+// Streams returns the replication streams of the node databases.
+func (a *Admin) Streams(ctx context.Context) ([]Stream, error) {
+	databases := streamDatabases()
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	list := make([]Stream, 0, len(names))
+	for _, name := range names {
+		s, err := a.Stream(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("stream %q: %w", name, err)
+		}
+		list = append(list, *s)
+	}
+	return list, nil
+}
+
+// Stream returns the config, the state and the storage usage of the stream.
+func (a *Admin) Stream(ctx context.Context, name string) (*Stream, error) {
+	stream, databases, err := a.stream(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{
+		Name:      info.Config.Name,
+		Databases: databases,
+		Subjects:  info.Config.Subjects,
+		MaxAge:    info.Config.MaxAge.String(),
+		MaxBytes:  info.Config.MaxBytes,
+		MaxMsgs:   info.Config.MaxMsgs,
+		Replicas:  info.Config.Replicas,
+		Storage:   info.Config.Storage.String(),
+		Messages:  info.State.Msgs,
+		Bytes:     info.State.Bytes,
+		FirstSeq:  info.State.FirstSeq,
+		FirstTime: info.State.FirstTime,
+		LastSeq:   info.State.LastSeq,
+		LastTime:  info.State.LastTime,
+		Consumers: info.State.Consumers,
+	}, nil
+}
+
+// Update changes the retention of the stream. The messages beyond the new
+// limits are discarded by JetStream, the nodes that did not apply them yet
+// resync from a snapshot.
+func (a *Admin) Update(ctx context.Context, name string, update Update) (*Stream, error) {
+	stream, _, err := a.stream(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg := info.Config
+	if update.MaxAge != nil {
+		cfg.MaxAge, err = time.ParseDuration(*update.MaxAge)
+		if err != nil || cfg.MaxAge < 0 {
+			return nil, fmt.Errorf("invalid max_age %q", *update.MaxAge)
+		}
+	}
+	if update.MaxBytes != nil {
+		cfg.MaxBytes = *update.MaxBytes
+		if cfg.MaxBytes <= 0 {
+			cfg.MaxBytes = -1
+		}
+	}
+	if update.MaxMsgs != nil {
+		cfg.MaxMsgs = *update.MaxMsgs
+		if cfg.MaxMsgs <= 0 {
+			cfg.MaxMsgs = -1
+		}
+	}
+	if _, err := a.js.UpdateStream(ctx, cfg); err != nil {
+		return nil, err
+	}
+	return a.Stream(ctx, name)
+}
+
+// Purge removes the messages of the stream up to the sequence, included, and
+// returns how many were removed. Unless forced, the purge fails when a
+// consumer has not acknowledged them yet.
+func (a *Admin) Purge(ctx context.Context, name string, sequence uint64, force bool) (uint64, error) {
+	stream, _, err := a.stream(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if !force {
+		consumers, err := a.consumers(ctx, stream)
+		if err != nil {
+			return 0, err
+		}
+		for _, c := range consumers {
+			// the ack floor of a consumer filtering a shared stream lags
+			// behind the messages of the other subjects
+			if c.AckFloor < sequence && (c.Pending > 0 || c.AckPending > 0) {
+				return 0, fmt.Errorf("%w: consumer %q acknowledged up to the sequence %d, purge with force to resync it from a snapshot",
+					ErrNotApplied, c.Name, c.AckFloor)
+			}
+		}
+	}
+	before, err := stream.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := stream.Purge(ctx, jetstream.WithPurgeSequence(sequence+1)); err != nil {
+		return 0, err
+	}
+	after, err := stream.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return before.State.Msgs - after.State.Msgs, nil
+}
+
+// Consumers returns the consumers of the stream, sorted by name.
+func (a *Admin) Consumers(ctx context.Context, name string) ([]Consumer, error) {
+	stream, _, err := a.stream(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return a.consumers(ctx, stream)
+}
+
+// DeleteConsumer removes the consumer from the stream. A node whose durable
+// consumer is deleted resyncs from a snapshot.
+func (a *Admin) DeleteConsumer(ctx context.Context, name, consumer string) error {
+	stream, _, err := a.stream(ctx, name)
+	if err != nil {
+		return err
+	}
+	return stream.DeleteConsumer(ctx, consumer)
+}
+
+func (a *Admin) consumers(ctx context.Context, stream jetstream.Stream) ([]Consumer, error) {
+	list := make([]Consumer, 0)
+	lister := stream.ListConsumers(ctx)
+	for info := range lister.Info() {
+		list = append(list, Consumer{
+			Name:       info.Name,
+			Created:    info.Created,
+			Delivered:  info.Delivered.Stream,
+			AckFloor:   info.AckFloor.Stream,
+			Pending:    info.NumPending,
+			AckPending: info.NumAckPending,
+			LastActive: info.Delivered.Last,
+		})
+	}
+	if err := lister.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(list, func(a, b Consumer) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return list, nil
+}
+
+// stream returns the stream when it replicates databases of the node, the
+// other streams of the JetStream account are not managed.
+func (a *Admin) stream(ctx context.Context, name string) (jetstream.Stream, []string, error) {
+	databases, ok := streamDatabases()[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("stream %q: %w", name, ErrUnknownStream)
+	}
+	stream, err := a.js.Stream(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stream, databases, nil
+}
+
+func streamDatabases() map[string][]string {
+	databases := make(map[string][]string)
+	ids := sqlite.Databases()
+	slices.Sort(ids)
+	for _, id := range ids {
+		stream, _, err := sqlite.ReplicationSubject(id)
+		if err != nil || stream == "" {
+			continue
+		}
+		databases[stream] = append(databases[stream], id)
+	}
+	return databases
+}
@@ -0,0 +1,161 @@
+//go:build cgo
+
+package streamadmin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/streamadmin"
+)
+
+func runJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+func consumerNames(consumers []streamadmin.Consumer) []string {
+	names := make([]string, 0, len(consumers))
+	for _, c := range consumers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestAdmin(t *testing.T) {
+	ctx := context.Background()
+	js := runJetStream(t)
+	err := sqlite.Load(ctx, "file:"+filepath.Join(t.TempDir(), "admin.db"), sqlite.LoadConfig{
+		MaxConns: 1,
+		Stream:   "admin",
+		Options: []ha.Option{
+			ha.WithName("node1"),
+			ha.WithReplicationURL(js.Conn().ConnectedUrl()),
+			ha.WithReplicationStream("admin"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, subject, err := sqlite.ReplicationSubject("admin.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// node2 is a replica that applied nothing yet
+	if _, err := js.CreateOrUpdateConsumer(ctx, "admin", jetstream.ConsumerConfig{
+		Durable:       "node2",
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		FilterSubject: subject,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var last uint64
+	for range 3 {
+		data, err := json.Marshal(ha.ChangeSet{Node: "node3", Filename: "admin.db"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, err := js.Publish(ctx, subject, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = ack.Sequence
+	}
+	a := streamadmin.New(js)
+
+	streams, err := a.Streams(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0].Name != "admin" || !slices.Equal(streams[0].Databases, []string{"admin.db"}) {
+		t.Fatalf("got streams %+v, want the stream of admin.db", streams)
+	}
+	if streams[0].Messages != 3 || streams[0].LastSeq != last {
+		t.Errorf("got %d messages up to %d, want 3 up to %d", streams[0].Messages, streams[0].LastSeq, last)
+	}
+	if _, err := a.Stream(ctx, "other"); !errors.Is(err, streamadmin.ErrUnknownStream) {
+		t.Errorf("other stream: got %v, want ErrUnknownStream", err)
+	}
+
+	maxAge, maxMsgs := "1h0m0s", int64(100)
+	stream, err := a.Update(ctx, "admin", streamadmin.Update{MaxAge: &maxAge, MaxMsgs: &maxMsgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.MaxAge != maxAge || stream.MaxMsgs != maxMsgs {
+		t.Errorf("got max age %s and max msgs %d, want %s and %d", stream.MaxAge, stream.MaxMsgs, maxAge, maxMsgs)
+	}
+	invalid := "-1h"
+	if _, err := a.Update(ctx, "admin", streamadmin.Update{MaxAge: &invalid}); err == nil {
+		t.Error("negative max age accepted")
+	}
+
+	if _, err := a.Purge(ctx, "admin", last, false); !errors.Is(err, streamadmin.ErrNotApplied) {
+		t.Errorf("purge of the messages node2 did not apply: got %v, want ErrNotApplied", err)
+	}
+	purged, err := a.Purge(ctx, "admin", last-1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("purged %d messages, want 2", purged)
+	}
+
+	consumers, err := a.Consumers(ctx, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeConsumer := sqlite.ConsumerName("admin.db", "node1")
+	if names := consumerNames(consumers); !slices.Equal(names, []string{nodeConsumer, "node2"}) {
+		t.Fatalf("got consumers %v, want %s and node2", names, nodeConsumer)
+	}
+	if err := a.DeleteConsumer(ctx, "admin", "node2"); err != nil {
+		t.Fatal(err)
+	}
+	consumers, err = a.Consumers(ctx, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := consumerNames(consumers); !slices.Equal(names, []string{nodeConsumer}) {
+		t.Errorf("got consumers %v after the deletion, want %s", names, nodeConsumer)
+	}
+	if err := a.DeleteConsumer(ctx, "admin", "node2"); !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		t.Errorf("deleted consumer: got %v, want ErrConsumerNotFound", err)
+	}
+}
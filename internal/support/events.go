@@ -0,0 +1,136 @@
+package support
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Event is a warning or an error logged by the node.
+type Event struct {
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"message"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// EventLog is a slog.Handler keeping the last warnings and errors, and
+// passing every record to the handler it wraps.
+type EventLog struct {
+	next   slog.Handler
+	attrs  []slog.Attr
+	prefix string
+	events *events
+}
+
+type events struct {
+	mu       sync.Mutex
+	list     []Event
+	capacity int
+}
+
+// InstallEventLog wraps the default slog handler with an EventLog keeping the
+// last capacity events.
+func InstallEventLog(capacity int) *EventLog {
+	// slog.SetDefault sends the output of the log package to the new
+	// handler, which would loop through the wrapped default handler writing
+	// to the log package: its writer and flags are restored.
+	w, flags := log.Writer(), log.Flags()
+	l := &EventLog{
+		next:   slog.Default().Handler(),
+		events: &events{capacity: max(capacity, 1)},
+	}
+	slog.SetDefault(slog.New(l))
+	log.SetOutput(w)
+	log.SetFlags(flags)
+	return l
+}
+
+// Events returns the events kept, the oldest first.
+func (l *EventLog) Events() []Event {
+	if l == nil {
+		return nil
+	}
+	l.events.mu.Lock()
+	defer l.events.mu.Unlock()
+	return slices.Clone(l.events.list)
+}
+
+func (l *EventLog) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || l.next.Enabled(ctx, level)
+}
+
+func (l *EventLog) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		event := Event{
+			Time:    r.Time.UTC(),
+			Level:   r.Level.String(),
+			Message: r.Message,
+		}
+		if len(l.attrs) > 0 || r.NumAttrs() > 0 {
+			event.Attrs = make(map[string]any)
+			for _, a := range l.attrs {
+				addAttr(event.Attrs, "", a)
+			}
+			r.Attrs(func(a slog.Attr) bool {
+				addAttr(event.Attrs, l.prefix, a)
+				return true
+			})
+		}
+		l.events.mu.Lock()
+		if len(l.events.list) == l.events.capacity {
+			l.events.list = slices.Delete(l.events.list, 0, 1)
+		}
+		l.events.list = append(l.events.list, event)
+		l.events.mu.Unlock()
+	}
+	if !l.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return l.next.Handle(ctx, r)
+}
+
+func (l *EventLog) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *l
+	c.next = l.next.WithAttrs(attrs)
+	c.attrs = slices.Clone(l.attrs)
+	for _, a := range attrs {
+		a.Key = l.prefix + a.Key
+		c.attrs = append(c.attrs, a)
+	}
+	return &c
+}
+
+func (l *EventLog) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return l
+	}
+	c := *l
+	c.next = l.next.WithGroup(name)
+	c.prefix = l.prefix + name + "."
+	return &c
+}
+
+func addAttr(m map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindGroup:
+		for _, ga := range v.Group() {
+			addAttr(m, prefix+a.Key+".", ga)
+		}
+	case slog.KindDuration:
+		m[prefix+a.Key] = v.Duration().String()
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			m[prefix+a.Key] = err.Error()
+			return
+		}
+		m[prefix+a.Key] = fmt.Sprint(v.Any())
+	default:
+		m[prefix+a.Key] = v.Any()
+	}
+}
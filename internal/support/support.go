@@ -0,0 +1,268 @@
+// Package support collects the state of a node into a tarball attached to the
+// bug reports: its status, streams and consumers, recent events, redacted
+// flags and cluster config, metrics and slow statements.
+package support
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/litesql/ha/internal/querylog"
+)
+
+// Redacted replaces the secrets in the bundle.
+const Redacted = "REDACTED"
+
+// Report is the state of the node only known by the node itself, served to
+// the bundle by the support endpoint.
+type Report struct {
+	Node      string    `json:"node"`
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit"`
+	GoVersion string    `json:"go_version"`
+	StartedAt time.Time `json:"started_at"`
+	// Flags are the values of the flags, with the secrets redacted.
+	Flags          map[string]string        `json:"flags"`
+	Events         []Event                  `json:"events"`
+	SlowStatements []querylog.SlowStatement `json:"slow_statements"`
+}
+
+var (
+	// secretName matches the names of the flags and config keys holding
+	// credentials.
+	secretName = regexp.MustCompile(`(?i)(token|pass|password|secret|credentials|creds|nkey|[-_]key)$`)
+	// urlPassword matches the password of the user info of a URL.
+	urlPassword = regexp.MustCompile(`(://[^/:@\s]*:)[^@\s]*@`)
+	// paramPassword matches the password parameters of a DSN.
+	paramPassword = regexp.MustCompile(`(?i)\b((?:password|passwd|pwd|secret|token)=)[^&;\s]*`)
+)
+
+// RedactFlag returns the value of the flag without its secrets: the whole
+// value of a credential flag, the passwords of the URLs and DSNs.
+func RedactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretName.MatchString(name) {
+		return Redacted
+	}
+	value = urlPassword.ReplaceAllString(value, "${1}"+Redacted+"@")
+	return paramPassword.ReplaceAllString(value, "${1}"+Redacted)
+}
+
+// redactJSON redacts the values of the secret keys and the strings holding
+// passwords in the document.
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if s, ok := e.(string); ok {
+				v[k] = RedactFlag(k, s)
+				continue
+			}
+			if secretName.MatchString(k) && e != nil {
+				v[k] = Redacted
+				continue
+			}
+			v[k] = redactJSON(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = redactJSON(e)
+		}
+	case string:
+		return RedactFlag("", v)
+	}
+	return v
+}
+
+type Config struct {
+	// Remote is the URL of the HTTP API of the node.
+	Remote string
+	// Token is sent in the Authorization header, the admin token to collect
+	// the admin endpoints.
+	Token string
+	// Output is the tarball written, ha-support-<time>.tar.gz when empty.
+	Output string
+}
+
+// file is a file of the bundle and the endpoint it is read from.
+type file struct {
+	name string
+	path string
+	// redact parses the JSON response and redacts its secrets.
+	redact bool
+}
+
+var files = []file{
+	{name: "support.json", path: "/admin/support"},
+	{name: "status.json", path: "/status"},
+	{name: "healthz.json", path: "/healthz"},
+	{name: "cluster.json", path: "/cluster"},
+	{name: "databases.json", path: "/databases"},
+	{name: "apply.json", path: "/apply"},
+	{name: "streams.json", path: "/admin/replication"},
+	{name: "config.json", path: "/config", redact: true},
+	{name: "metrics.txt", path: "/metrics"},
+}
+
+// Bundle collects the state of the node into the tarball and returns its
+// path. The endpoints failing, e.g. disabled on the node, are listed in
+// errors.txt instead of failing the bundle.
+func Bundle(ctx context.Context, cfg Config) (string, error) {
+	if cfg.Remote == "" {
+		return "", fmt.Errorf("--remote is required")
+	}
+	output := cfg.Output
+	if output == "" {
+		output = fmt.Sprintf("ha-support-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	}
+	c := &collector{cfg: cfg, contents: make(map[string][]byte)}
+	for _, f := range files {
+		c.collect(ctx, f)
+	}
+	c.collectDatabases(ctx)
+	c.collectStreams(ctx)
+	if len(c.names) == 0 {
+		return "", fmt.Errorf("node unreachable: %s", c.errors[0])
+	}
+	if len(c.errors) > 0 {
+		c.add("errors.txt", []byte(strings.Join(c.errors, "\n")+"\n"))
+	}
+	if err := writeTarball(output, c.names, c.contents); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+type collector struct {
+	cfg      Config
+	names    []string
+	contents map[string][]byte
+	errors   []string
+}
+
+func (c *collector) add(name string, data []byte) {
+	c.names = append(c.names, name)
+	c.contents[name] = data
+}
+
+func (c *collector) collect(ctx context.Context, f file) {
+	data, err := c.get(ctx, f.path)
+	if err == nil && f.redact {
+		var v any
+		if err = json.Unmarshal(data, &v); err == nil {
+			data, err = json.MarshalIndent(redactJSON(v), "", "  ")
+		}
+	}
+	if err != nil {
+		c.errors = append(c.errors, fmt.Sprintf("%s: %v", f.path, err))
+		return
+	}
+	c.add(f.name, data)
+}
+
+// collectDatabases adds the replication consumers of each database.
+func (c *collector) collectDatabases(ctx context.Context) {
+	var dbs struct {
+		Databases []string `json:"databases"`
+	}
+	if json.Unmarshal(c.contents["databases.json"], &dbs) != nil {
+		return
+	}
+	for _, id := range dbs.Databases {
+		c.collect(ctx, file{
+			name: "databases/" + safeName(id) + "/replications.json",
+			path: "/databases/" + url.PathEscape(id) + "/replications",
+		})
+	}
+}
+
+// collectStreams adds the consumers of each replication stream.
+func (c *collector) collectStreams(ctx context.Context) {
+	var streams struct {
+		Streams []struct {
+			Name string `json:"name"`
+		} `json:"streams"`
+	}
+	if json.Unmarshal(c.contents["streams.json"], &streams) != nil {
+		return
+	}
+	for _, stream := range streams.Streams {
+		c.collect(ctx, file{
+			name: "streams/" + safeName(stream.Name) + "/consumers.json",
+			path: "/admin/replication/" + url.PathEscape(stream.Name) + "/consumers",
+		})
+	}
+}
+
+func (c *collector) get(ctx context.Context, path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.cfg.Remote, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", c.cfg.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func safeName(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(name)
+}
+
+func writeTarball(output string, names []string, contents map[string][]byte) error {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	dir := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(output), ".gz"), ".tar")
+	for _, name := range names {
+		data := contents[name]
+		hdr := &tar.Header{
+			Name:    dir + "/" + name,
+			Mode:    0o600,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(output, buf.Bytes(), 0o600)
+}
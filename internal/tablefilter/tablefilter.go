@@ -0,0 +1,145 @@
+package tablefilter
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/litesql/go-ha"
+)
+
+const (
+	controlTableName  = "ha_stats"
+	readOnlyTableName = "ha_readonly"
+)
+
+// Filter selects the tables to be replicated using glob patterns.
+type Filter struct {
+	// patterns are replaced by Set while the changesets are filtered
+	patterns atomic.Pointer[patterns]
+}
+
+type patterns struct {
+	include []string
+	exclude []string
+}
+
+// New creates a filter from comma separated lists of glob patterns. An empty
+// include list matches all tables.
+func New(include, exclude string) (*Filter, error) {
+	var f Filter
+	if err := f.Set(include, exclude); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Set replaces the patterns of the filter, they apply to the next
+// changesets.
+func (f *Filter) Set(include, exclude string) error {
+	p := patterns{
+		include: splitPatterns(include),
+		exclude: splitPatterns(exclude),
+	}
+	for _, pattern := range append(slices.Clone(p.include), p.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid table pattern %q: %w", pattern, err)
+		}
+	}
+	f.patterns.Store(&p)
+	return nil
+}
+
+func splitPatterns(s string) []string {
+	var list []string
+	for pattern := range strings.SplitSeq(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			list = append(list, strings.ToLower(pattern))
+		}
+	}
+	return list
+}
+
+func (f *Filter) Empty() bool {
+	p := f.patterns.Load()
+	return len(p.include) == 0 && len(p.exclude) == 0
+}
+
+// Match reports whether changes to the table must be replicated.
+func (f *Filter) Match(table string) bool {
+	if table == "" || table == controlTableName || table == readOnlyTableName {
+		return true
+	}
+	p := f.patterns.Load()
+	table = strings.ToLower(table)
+	for _, pattern := range p.exclude {
+		if ok, _ := path.Match(pattern, table); ok {
+			return false
+		}
+	}
+	if len(p.include) == 0 {
+		return true
+	}
+	for _, pattern := range p.include {
+		if ok, _ := path.Match(pattern, table); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes returns the changes of the matched tables. Statements without a
+// table (DDL) are always kept.
+func (f *Filter) Changes(changes []ha.Change) []ha.Change {
+	if f.Empty() {
+		return changes
+	}
+	filtered := changes[:0:0]
+	for _, change := range changes {
+		if f.Match(change.Table) {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered
+}
+
+func (f *Filter) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	cs.Changes = f.Changes(cs.Changes)
+	return false, nil
+}
+
+func (f *Filter) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	return err
+}
+
+type publisher struct {
+	ha.Publisher
+	filter *Filter
+}
+
+// Publisher wraps the publisher to only publish changes of the matched tables.
+func Publisher(pub ha.Publisher, f *Filter) ha.Publisher {
+	return &publisher{
+		Publisher: pub,
+		filter:    f,
+	}
+}
+
+func (p *publisher) Publish(cs *ha.ChangeSet) error {
+	if p.filter.Empty() {
+		return p.Publisher.Publish(cs)
+	}
+	changes := p.filter.Changes(cs.Changes)
+	if len(changes) == 0 {
+		return nil
+	}
+	if len(changes) == len(cs.Changes) {
+		return p.Publisher.Publish(cs)
+	}
+	filtered := *cs
+	filtered.Changes = changes
+	return p.Publisher.Publish(&filtered)
+}
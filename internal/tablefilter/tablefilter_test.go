@@ -0,0 +1,92 @@
+package tablefilter_test
+
+import (
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/tablefilter"
+)
+
+func TestMatch(t *testing.T) {
+	f, err := tablefilter.New("users, orders_*", "orders_tmp*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"users":          true,
+		"USERS":          true,
+		"orders_2025":    true,
+		"orders_tmp_1":   false,
+		"cache":          false,
+		"ha_stats":       true,
+		"ha_readonly":    true,
+		"":               true,
+		"users_archived": false,
+	}
+	for table, want := range tests {
+		if got := f.Match(table); got != want {
+			t.Errorf("Match(%q) = %v, want %v", table, got, want)
+		}
+	}
+}
+
+type recorder struct {
+	published []*ha.ChangeSet
+}
+
+func (r *recorder) Publish(cs *ha.ChangeSet) error {
+	r.published = append(r.published, cs)
+	return nil
+}
+
+func (r *recorder) Sequence() uint64 {
+	return uint64(len(r.published))
+}
+
+func TestPublisher(t *testing.T) {
+	f, err := tablefilter.New("", "scratch_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recorder{}
+	pub := tablefilter.Publisher(rec, f)
+
+	pub.Publish(&ha.ChangeSet{Changes: []ha.Change{{Table: "scratch_1", Operation: "INSERT"}}})
+	if len(rec.published) != 0 {
+		t.Fatalf("expected changeset with only excluded tables to be dropped")
+	}
+	pub.Publish(&ha.ChangeSet{Changes: []ha.Change{
+		{Table: "scratch_1", Operation: "INSERT"},
+		{Table: "users", Operation: "INSERT"},
+	}})
+	if len(rec.published) != 1 || len(rec.published[0].Changes) != 1 || rec.published[0].Changes[0].Table != "users" {
+		t.Fatalf("unexpected published changesets: %+v", rec.published)
+	}
+	if _, err := tablefilter.New("[", ""); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestSet(t *testing.T) {
+	f, err := tablefilter.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := []ha.Change{{Table: "users"}, {Table: "cache"}}
+	if got := f.Changes(changes); len(got) != 2 {
+		t.Fatalf("empty filter kept %d changes, want 2", len(got))
+	}
+	if err := f.Set("", "cache"); err != nil {
+		t.Fatal(err)
+	}
+	if f.Empty() || f.Match("cache") || !f.Match("users") {
+		t.Error("the new patterns are not applied")
+	}
+	if err := f.Set("[", ""); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+	if f.Match("cache") {
+		t.Error("an invalid pattern replaced the patterns")
+	}
+}
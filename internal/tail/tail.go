@@ -0,0 +1,118 @@
+// Package tail reads the replication messages of a database from its
+// JetStream stream, for the consumers without NATS credentials.
+package tail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/changeset"
+)
+
+const pollInterval = 200 * time.Millisecond
+
+// Message is a replication message, ChangeSet holds the JSON published by
+// the node that committed the transaction, with the changes compressed in
+// format 4 expanded. The binary values stay tagged as in format 3.
+type Message struct {
+	Sequence  uint64          `json:"sequence"`
+	Subject   string          `json:"subject"`
+	Time      time.Time       `json:"time"`
+	ChangeSet json.RawMessage `json:"changeset"`
+}
+
+type Reader struct {
+	js jetstream.JetStream
+
+	mu      sync.Mutex
+	streams map[string]jetstream.Stream
+}
+
+func New(nc *nats.Conn) (*Reader, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		js:      js,
+		streams: make(map[string]jetstream.Stream),
+	}, nil
+}
+
+// Read returns up to limit messages of the subject with a sequence from from
+// on, without waiting. The messages removed from the stream by its retention
+// are skipped.
+func (r *Reader) Read(ctx context.Context, stream, subject string, from uint64, limit int) ([]Message, error) {
+	s, err := r.stream(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Message, 0)
+	for seq := max(from, 1); len(list) < limit; {
+		msg, err := s.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(subject))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data := json.RawMessage(msg.Data)
+		if !json.Valid(data) {
+			data, _ = json.Marshal(msg.Data)
+		} else if expanded, err := changeset.Expand(data); err == nil {
+			data = expanded
+		}
+		list = append(list, Message{
+			Sequence:  msg.Sequence,
+			Subject:   msg.Subject,
+			Time:      msg.Time,
+			ChangeSet: data,
+		})
+		seq = msg.Sequence + 1
+	}
+	return list, nil
+}
+
+// Wait is Read waiting until a message is published or ctx is done, which
+// returns an empty list.
+func (r *Reader) Wait(ctx context.Context, stream, subject string, from uint64, limit int) ([]Message, error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		list, err := r.Read(ctx, stream, subject, from, limit)
+		if err != nil {
+			if ctx.Err() != nil {
+				return []Message{}, nil
+			}
+			return nil, err
+		}
+		if len(list) > 0 {
+			return list, nil
+		}
+		select {
+		case <-ctx.Done():
+			return list, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reader) stream(ctx context.Context, name string) (jetstream.Stream, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.streams[name]; ok {
+		return s, nil
+	}
+	s, err := r.js.Stream(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r.streams[name] = s
+	return s, nil
+}
@@ -0,0 +1,178 @@
+package tail_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/changeset"
+	"github.com/litesql/ha/internal/compress"
+	"github.com/litesql/ha/internal/tail"
+)
+
+func runJetStream(t *testing.T) *nats.Conn {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestRead(t *testing.T) {
+	ctx := context.Background()
+	nc := runJetStream(t)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "tail", Subjects: []string{"tail.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []struct{ subject, data string }{
+		{"tail.a", `{"node":"node1","changes":[]}`},
+		{"tail.b", `{"node":"node2","changes":[]}`},
+		{"tail.a", `not json`},
+		{"tail.a", `{"node":"node1","changes":[{"operation":"SQL","command":"SELECT 1"}]}`},
+	} {
+		if _, err := js.Publish(ctx, m.subject, []byte(m.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := tail.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := r.Read(ctx, "tail", "tail.a", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Sequence != 1 || list[1].Sequence != 3 {
+		t.Fatalf("got %+v, want the messages 1 and 3 of the subject", list)
+	}
+	var data []byte
+	if err := json.Unmarshal(list[1].ChangeSet, &data); err != nil || string(data) != "not json" {
+		t.Errorf("got changeset %s, want the invalid JSON in base64", list[1].ChangeSet)
+	}
+
+	list, err = r.Read(ctx, "tail", "tail.a", 4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Sequence != 4 {
+		t.Fatalf("got %+v, want the message 4", list)
+	}
+	if list, err := r.Read(ctx, "tail", "tail.a", 5, 10); err != nil || len(list) != 0 {
+		t.Errorf("got %+v, %v after the last message, want none", list, err)
+	}
+}
+
+// TestReadCompressed expands the changes compressed in changeset format 4.
+func TestReadCompressed(t *testing.T) {
+	ctx := context.Background()
+	nc := runJetStream(t)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "compressed", Subjects: []string{"compressed.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	cs := &ha.ChangeSet{Node: "node1"}
+	for i := range 100 {
+		cs.Changes = append(cs.Changes, ha.Change{Table: "items", Operation: "INSERT", Columns: []string{"id"}, NewValues: []any{i}})
+	}
+	compressed, err := changeset.Compress(cs, compress.Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed.Changes) != 1 {
+		t.Fatalf("got %d changes, want them compressed", len(compressed.Changes))
+	}
+	data, err := json.Marshal(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.Publish(ctx, "compressed.a", data); err != nil {
+		t.Fatal(err)
+	}
+	r, err := tail.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := r.Read(ctx, "compressed", "compressed.a", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("got %+v, want the message", list)
+	}
+	var got ha.ChangeSet
+	if err := json.Unmarshal(list[0].ChangeSet, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Changes) != 100 || got.Changes[0].Table != "items" {
+		t.Errorf("got %d changes, want the 100 changes expanded", len(got.Changes))
+	}
+}
+
+func TestWait(t *testing.T) {
+	ctx := context.Background()
+	nc := runJetStream(t)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "wait", Subjects: []string{"wait.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := tail.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if list, err := r.Wait(timeout, "wait", "wait.a", 1, 10); err != nil || len(list) != 0 {
+		t.Errorf("got %+v, %v on timeout, want an empty list", list, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		js.Publish(ctx, "wait.a", []byte(`{}`))
+	}()
+	timeout, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	list, err := r.Wait(timeout, "wait", "wait.a", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("got %+v, want the message published while waiting", list)
+	}
+}
@@ -0,0 +1,373 @@
+// Package tenant provisions a database per tenant: each one is created from a
+// schema template, seeded, and given its own PostgreSQL login. Dropping a
+// tenant takes a final snapshot of its database first.
+package tenant
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+var (
+	ErrNotFound = errors.New("tenant not found")
+	ErrExists   = errors.New("tenant already exists")
+	ErrInvalid  = errors.New("invalid tenant")
+)
+
+const (
+	registryTable = "ha_tenants"
+	// usersTable is the table of the PostgreSQL logins read with --pg-users-db.
+	usersTable = "ha_pg_users"
+)
+
+var reTenantID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+type Config struct {
+	// Templates is the directory with a sub directory of *.sql files per
+	// template, applied as versioned migrations in lexical order. The files
+	// of its seed sub directory are applied once after them.
+	Templates string
+	// Create is the configuration of the tenant databases, like POST /databases.
+	Create    sqlite.LoadConfig
+	DSNParams string
+	// UsersDB is the database id with the ha_pg_users table the tenant
+	// logins are added to. The tenants are registered in its ha_tenants
+	// table, in the default database when empty.
+	UsersDB string
+	// Secret returns the password stored for a login.
+	Secret func(user, password string) string
+	// ArchiveDir keeps a copy of the database of the dropped tenants.
+	ArchiveDir string
+	// Uploads receive the final snapshot, like POST /snapshot.
+	Uploads []func(ctx context.Context, id string) (uint64, error)
+}
+
+type Tenant struct {
+	ID        string `json:"id"`
+	Database  string `json:"database"`
+	Template  string `json:"template"`
+	User      string `json:"user,omitempty"`
+	CreatedAt string `json:"created_at"`
+	// Version is the schema version applied by the template.
+	Version int64 `json:"version,omitempty"`
+}
+
+type CreateRequest struct {
+	ID       string `json:"id"`
+	Template string `json:"template"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Archive describes the final snapshot of a dropped tenant.
+type Archive struct {
+	ID       string `json:"id"`
+	Sequence uint64 `json:"sequence"`
+	File     string `json:"file,omitempty"`
+}
+
+type Manager struct {
+	cfg Config
+}
+
+func New(cfg Config) *Manager {
+	return &Manager{cfg: cfg}
+}
+
+// Create creates the database of the tenant from the template and registers
+// its login. The database is dropped again if any step fails.
+func (m *Manager) Create(ctx context.Context, req CreateRequest) (_ *Tenant, err error) {
+	if !reTenantID.MatchString(req.ID) {
+		return nil, fmt.Errorf("%w: the id must contain only letters, digits, _ and -", ErrInvalid)
+	}
+	if !reTenantID.MatchString(req.Template) {
+		return nil, fmt.Errorf("%w: invalid template %q", ErrInvalid, req.Template)
+	}
+	if req.User != "" && m.cfg.UsersDB == "" {
+		return nil, fmt.Errorf("%w: the tenant logins require --pg-users-db", ErrInvalid)
+	}
+	if req.User != "" && req.Password == "" {
+		return nil, fmt.Errorf("%w: password is required", ErrInvalid)
+	}
+	if !m.cfg.Create.MemDB && m.cfg.Create.Dir == "" {
+		return nil, errors.New("create database is disabled, inform flag --create-db-dir at startup")
+	}
+	migrations, seeds, err := m.template(req.Template)
+	if err != nil {
+		return nil, err
+	}
+	db, err := m.registry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.get(ctx, db, req.ID); err == nil {
+		return nil, fmt.Errorf("%w: %q", ErrExists, req.ID)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	dsn := "file:" + filepath.Join(m.cfg.Create.Dir, req.ID+".db") + "?" + m.cfg.DSNParams
+	if err := sqlite.Load(ctx, dsn, m.cfg.Create); err != nil {
+		return nil, err
+	}
+	t := &Tenant{
+		ID:        req.ID,
+		Database:  sqlite.IdFromDSN(dsn),
+		Template:  req.Template,
+		User:      req.User,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	defer func() {
+		if err != nil {
+			if errDrop := drop(context.Background(), t.Database); errDrop != nil {
+				slog.Warn("failed to drop the database of the tenant not created", "tenant", t.ID, "error", errDrop)
+			}
+		}
+	}()
+	if len(migrations) > 0 {
+		res, err := sqlite.Migrate(ctx, t.Database, migrations)
+		if err != nil {
+			return nil, fmt.Errorf("apply template %q: %w", req.Template, err)
+		}
+		t.Version = res.Version
+	}
+	if err := sqlite.SeedFiles(ctx, t.Database, seeds); err != nil {
+		return nil, fmt.Errorf("seed template %q: %w", req.Template, err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if req.User != "" {
+		if _, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+usersTable+"(name TEXT PRIMARY KEY, password TEXT NOT NULL, databases TEXT)"); err != nil {
+			return nil, err
+		}
+		var exists int
+		if err := tx.QueryRowContext(ctx, "SELECT count(*) FROM "+usersTable+" WHERE name = ?", req.User).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if exists > 0 {
+			return nil, fmt.Errorf("%w: the login %q is already used", ErrExists, req.User)
+		}
+		password := req.Password
+		if m.cfg.Secret != nil {
+			password = m.cfg.Secret(req.User, password)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+usersTable+"(name, password, databases) VALUES(?, ?, ?)", req.User, password, t.Database); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO "+registryTable+"(id, database_id, template, user, created_at) VALUES(?, ?, ?, ?, ?)",
+		t.ID, t.Database, t.Template, sql.NullString{String: t.User, Valid: t.User != ""}, t.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	slog.Info("tenant created", "tenant", t.ID, "database", t.Database, "template", t.Template, "version", t.Version)
+	return t, nil
+}
+
+func (m *Manager) List(ctx context.Context) ([]Tenant, error) {
+	db, err := m.registry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id, database_id, template, user, created_at FROM "+registryTable+" ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]Tenant, 0)
+	for rows.Next() {
+		var t Tenant
+		var user sql.NullString
+		if err := rows.Scan(&t.ID, &t.Database, &t.Template, &user, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.User = user.String
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// Drop takes a final snapshot of the tenant database, archives a copy when
+// configured, and then drops the database, its login and registration.
+func (m *Manager) Drop(ctx context.Context, id string) (*Archive, error) {
+	db, err := m.registry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t, err := m.get(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+	archive := &Archive{ID: t.ID}
+	if _, err := sqlite.DB(t.Database); err == nil {
+		if archive.Sequence, archive.File, err = m.archive(ctx, t); err != nil {
+			return nil, fmt.Errorf("archive tenant %q: %w", t.ID, err)
+		}
+		if err := drop(ctx, t.Database); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, sqlite.ErrNotFound) {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if t.User != "" {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+usersTable+" WHERE name = ? AND databases = ?", t.User, t.Database); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+registryTable+" WHERE id = ?", t.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	slog.Info("tenant dropped", "tenant", t.ID, "database", t.Database, "snapshot_seq", archive.Sequence, "archive", archive.File)
+	return archive, nil
+}
+
+func (m *Manager) archive(ctx context.Context, t *Tenant) (uint64, string, error) {
+	connector, err := sqlite.Connector(t.Database)
+	if err != nil {
+		return 0, "", err
+	}
+	sequence, err := connector.TakeSnapshot(ctx)
+	if err != nil {
+		return 0, "", fmt.Errorf("take snapshot: %w", err)
+	}
+	for _, upload := range m.cfg.Uploads {
+		uploaded, err := upload(ctx, t.Database)
+		if err != nil {
+			return 0, "", fmt.Errorf("upload snapshot: %w", err)
+		}
+		sequence = max(sequence, uploaded)
+	}
+	if m.cfg.ArchiveDir == "" {
+		return sequence, "", nil
+	}
+	if err := os.MkdirAll(m.cfg.ArchiveDir, 0o755); err != nil {
+		return 0, "", err
+	}
+	file := filepath.Join(m.cfg.ArchiveDir, fmt.Sprintf("%s-%s.db", t.ID, time.Now().UTC().Format("20060102T150405Z")))
+	db, err := sqlite.DB(t.Database)
+	if err != nil {
+		return 0, "", err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	if err := sqlite.Backup(ctx, db, f); err != nil {
+		os.Remove(file)
+		return 0, "", fmt.Errorf("copy to %q: %w", file, err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, "", err
+	}
+	return sequence, file, nil
+}
+
+// template returns the migrations and seed files of the template.
+func (m *Manager) template(name string) ([]sqlite.Migration, []string, error) {
+	if m.cfg.Templates == "" {
+		return nil, nil, fmt.Errorf("%w: the templates are disabled, inform flag --tenant-templates at startup", ErrInvalid)
+	}
+	dir := filepath.Join(m.cfg.Templates, name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, nil, fmt.Errorf("%w: template %q not found", ErrInvalid, name)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, nil, err
+	}
+	slices.Sort(files)
+	migrations := make([]sqlite.Migration, 0, len(files))
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		migrations = append(migrations, sqlite.Migration{
+			Version: int64(i + 1),
+			Name:    name + "/" + filepath.Base(file),
+			SQL:     string(data),
+		})
+	}
+	seeds, err := filepath.Glob(filepath.Join(dir, "seed", "*.sql"))
+	if err != nil {
+		return nil, nil, err
+	}
+	slices.Sort(seeds)
+	if len(migrations) == 0 && len(seeds) == 0 {
+		return nil, nil, fmt.Errorf("%w: template %q has no *.sql files", ErrInvalid, name)
+	}
+	return migrations, seeds, nil
+}
+
+func (m *Manager) registry(ctx context.Context) (*sql.DB, error) {
+	db, err := sqlite.DB(m.cfg.UsersDB)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+registryTable+`(
+		id TEXT PRIMARY KEY,
+		database_id TEXT NOT NULL,
+		template TEXT NOT NULL,
+		user TEXT,
+		created_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("create %s table: %w", registryTable, err)
+	}
+	return db, nil
+}
+
+func (m *Manager) get(ctx context.Context, db *sql.DB, id string) (*Tenant, error) {
+	var t Tenant
+	var user sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT id, database_id, template, user, created_at FROM "+registryTable+" WHERE id = ?", id).
+		Scan(&t.ID, &t.Database, &t.Template, &user, &t.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.User = user.String
+	return &t, nil
+}
+
+// drop drops the database and removes its files.
+func drop(ctx context.Context, id string) error {
+	filename, err := sqlite.Drop(ctx, id)
+	if err != nil || filename == "" {
+		return err
+	}
+	for _, name := range []string{filename, filename + "-shm", filename + "-wal"} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) && name == filename {
+			return fmt.Errorf("failed to remove database file: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+//go:build cgo
+
+package tenant_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats-server/v2/server"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/tenant"
+)
+
+func runJetStream(t *testing.T) string {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s.ClientURL()
+}
+
+func writeTemplate(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTenant(t *testing.T) {
+	ctx := context.Background()
+	url := runJetStream(t)
+	dir := t.TempDir()
+	if err := sqlite.Load(ctx, "file:"+filepath.Join(dir, "tenants.db"), sqlite.LoadConfig{MaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	templates := filepath.Join(dir, "templates")
+	writeTemplate(t, templates, map[string]string{
+		"crm/001_items.sql":  "CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT);",
+		"crm/002_notes.sql":  "CREATE TABLE notes(id INTEGER PRIMARY KEY, item_id INTEGER REFERENCES items(id));",
+		"crm/seed/items.sql": "INSERT INTO items VALUES (1, 'welcome');",
+		"empty/README.md":    "no sql",
+	})
+	tenantsDir := filepath.Join(dir, "tenants")
+	if err := os.Mkdir(tenantsDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	m := tenant.New(tenant.Config{
+		Templates: templates,
+		Create: sqlite.LoadConfig{
+			Dir:            tenantsDir,
+			MaxConns:       1,
+			StreamTemplate: "tenant_{db}",
+			Options: []ha.Option{
+				ha.WithName("node1"),
+				ha.WithReplicationURL(url),
+			},
+		},
+		UsersDB:    "tenants.db",
+		Secret:     func(user, password string) string { return "stored:" + password },
+		ArchiveDir: filepath.Join(dir, "archive"),
+	})
+
+	created, err := m.Create(ctx, tenant.CreateRequest{ID: "acme", Template: "crm", User: "acme_user", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Database != "acme.db" || created.Version != 2 {
+		t.Errorf("got %+v, want the database acme.db at the version 2", created)
+	}
+	db, err := sqlite.DB("acme.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := db.QueryRowContext(ctx, "SELECT name FROM items WHERE id = 1").Scan(&name); err != nil || name != "welcome" {
+		t.Errorf("got the seed %q, %v, want welcome", name, err)
+	}
+	users, err := sqlite.DB("tenants.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var password, databases string
+	if err := users.QueryRowContext(ctx, "SELECT password, databases FROM ha_pg_users WHERE name = 'acme_user'").Scan(&password, &databases); err != nil {
+		t.Fatal(err)
+	}
+	if password != "stored:secret" || databases != "acme.db" {
+		t.Errorf("got the login %q on %q, want the stored password on acme.db", password, databases)
+	}
+
+	for _, tt := range []struct {
+		req tenant.CreateRequest
+		err error
+	}{
+		{req: tenant.CreateRequest{ID: "acme", Template: "crm"}, err: tenant.ErrExists},
+		{req: tenant.CreateRequest{ID: "other", Template: "crm", User: "acme_user", Password: "secret"}, err: tenant.ErrExists},
+		{req: tenant.CreateRequest{ID: "../other", Template: "crm"}, err: tenant.ErrInvalid},
+		{req: tenant.CreateRequest{ID: "other", Template: "missing"}, err: tenant.ErrInvalid},
+		{req: tenant.CreateRequest{ID: "other", Template: "empty"}, err: tenant.ErrInvalid},
+		{req: tenant.CreateRequest{ID: "other", Template: "crm", User: "other_user"}, err: tenant.ErrInvalid},
+	} {
+		if _, err := m.Create(ctx, tt.req); !errors.Is(err, tt.err) {
+			t.Errorf("create %+v: got %v, want %v", tt.req, err, tt.err)
+		}
+	}
+	// the database of the tenant not created is dropped
+	if _, err := sqlite.DB("other.db"); !errors.Is(err, sqlite.ErrNotFound) {
+		t.Errorf("the database of the tenant not created was kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tenantsDir, "other.db")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the file of the tenant not created was kept: %v", err)
+	}
+
+	list, err := m.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "acme" || list[0].User != "acme_user" {
+		t.Errorf("got %+v, want the tenant acme", list)
+	}
+
+	archive, err := m.Drop(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.Sequence == 0 || archive.File == "" {
+		t.Fatalf("got %+v, want the final snapshot and its copy", archive)
+	}
+	copied, err := sql.Open("sqlite3", "file:"+archive.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	if err := copied.QueryRowContext(ctx, "SELECT name FROM items WHERE id = 1").Scan(&name); err != nil || name != "welcome" {
+		t.Errorf("got %q, %v in the archived copy, want welcome", name, err)
+	}
+	if _, err := sqlite.DB("acme.db"); !errors.Is(err, sqlite.ErrNotFound) {
+		t.Errorf("the database of the dropped tenant was kept: %v", err)
+	}
+	var logins int
+	if err := users.QueryRowContext(ctx, "SELECT count(*) FROM ha_pg_users").Scan(&logins); err != nil || logins != 0 {
+		t.Errorf("got %d logins, %v after the drop, want none", logins, err)
+	}
+	if _, err := m.Drop(ctx, "acme"); !errors.Is(err, tenant.ErrNotFound) {
+		t.Errorf("drop of a dropped tenant: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Package timetravel queries a database as it was at a past time: the most
+// recent snapshot before that time is restored in a temporary database and
+// the replication stream is replayed on it up to that time.
+package timetravel
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/changeset"
+	"github.com/litesql/ha/internal/resync"
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/verify"
+)
+
+var ErrInvalidTime = errors.New("invalid as of timestamp")
+
+// sqliteReadOnly is the SQLITE_READONLY result code of the writes refused by
+// PRAGMA query_only.
+const sqliteReadOnly = 8
+
+type Request struct {
+	Time time.Time
+	// Tables restricts the reconstruction to these tables, the other ones
+	// are dropped from the temporary database. Empty keeps every table.
+	Tables []string
+	Query  sqlite.Request
+}
+
+type Result struct {
+	*sqlite.Response
+	Time time.Time `json:"timestamp"`
+	// Sequence is the last stream sequence published at or before Time.
+	Sequence    uint64 `json:"sequence"`
+	SnapshotSeq uint64 `json:"snapshot_seq"`
+	// Replayed is the number of changesets applied over the snapshot.
+	Replayed int `json:"replayed"`
+}
+
+// Query reconstructs the database at the time of the request from the most
+// recent snapshot found by the finders and runs the read-only query of the
+// request on it. The stream must still hold the messages between the
+// snapshot and that time. The temporary database is removed afterwards.
+func Query(ctx context.Context, js jetstream.JetStream, id string, req Request, finders ...resync.SnapshotFinder) (*Result, error) {
+	if req.Time.IsZero() || req.Time.After(time.Now()) {
+		return nil, fmt.Errorf("%w: use a past RFC 3339 timestamp", ErrInvalidTime)
+	}
+	streamName, subject, err := sqlite.ReplicationSubject(id)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sequence, err := sequenceAt(ctx, stream, req.Time, info.State)
+	if err != nil {
+		return nil, err
+	}
+	snapshotSeq, reader, err := resync.FindSnapshot(ctx, id, sequence, finders...)
+	if err != nil {
+		return nil, err
+	}
+	// the messages before the first one are gone
+	if snapshotSeq+1 < info.State.FirstSeq && snapshotSeq < sequence {
+		reader.Close()
+		return nil, fmt.Errorf("%w: the snapshot %d is before the stream first sequence %d", sqlite.ErrSnapshotTooOld, snapshotSeq, info.State.FirstSeq)
+	}
+
+	f, err := os.CreateTemp("", "ha-asof-*.db")
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, reader)
+	reader.Close()
+	if err := errors.Join(err, f.Close()); err != nil {
+		return nil, fmt.Errorf("download snapshot: %w", err)
+	}
+	db, err := sqlite.OpenFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	res := Result{
+		Time:        req.Time,
+		Sequence:    sequence,
+		SnapshotSeq: snapshotSeq,
+	}
+	for seq := snapshotSeq + 1; seq <= sequence; {
+		msg, err := stream.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(subject))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if msg.Sequence > sequence {
+			break
+		}
+		var cs ha.ChangeSet
+		if err := json.Unmarshal(msg.Data, &cs); err != nil {
+			return nil, fmt.Errorf("invalid changeset %d: %w", msg.Sequence, err)
+		}
+		if err := changeset.Decode(&cs); err != nil {
+			return nil, fmt.Errorf("invalid changeset %d: %w", msg.Sequence, err)
+		}
+		changes := cs.Changes
+		if len(req.Tables) > 0 {
+			// the statements without a table, like the DDL, are replayed
+			changes = slices.DeleteFunc(slices.Clone(changes), func(change ha.Change) bool {
+				return change.Table != "" && !hasTable(req.Tables, change.Table)
+			})
+		}
+		if err := verify.Apply(ctx, db, changes); err != nil {
+			return nil, fmt.Errorf("replay changeset %d: %w", msg.Sequence, err)
+		}
+		res.Replayed++
+		seq = msg.Sequence + 1
+	}
+	if len(req.Tables) > 0 {
+		if err := dropTablesExcept(ctx, db, req.Tables); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return nil, err
+	}
+	queryCtx, cancel := sqlite.QueryContext(ctx, time.Duration(req.Query.TimeoutMs)*time.Millisecond)
+	defer cancel()
+	res.Response, err = sqlite.Exec(queryCtx, db, req.Query.Sql, req.Query.Params)
+	if code, ok := sqlite.ErrorCode(err); ok && code&0xff == sqliteReadOnly {
+		return nil, fmt.Errorf("%w: the past of a database can't be written", sqlite.ErrReadOnly)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// sequenceAt returns the last stream sequence published at or before t: the
+// one before the first message published after t, read by an ephemeral
+// consumer.
+func sequenceAt(ctx context.Context, stream jetstream.Stream, t time.Time, state jetstream.StreamState) (uint64, error) {
+	if !state.LastTime.After(t) {
+		return state.LastSeq, nil
+	}
+	start := t.Add(time.Nanosecond)
+	consumer, err := stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		DeliverPolicy:     jetstream.DeliverByStartTimePolicy,
+		OptStartTime:      &start,
+		HeadersOnly:       true,
+		InactiveThreshold: time.Second,
+	})
+	if err != nil {
+		return 0, err
+	}
+	msg, err := consumer.Next(jetstream.FetchMaxWait(5 * time.Second))
+	if err != nil {
+		return 0, fmt.Errorf("find the stream sequence at %s: %w", t.Format(time.RFC3339Nano), err)
+	}
+	meta, err := msg.Metadata()
+	if err != nil {
+		return 0, err
+	}
+	return meta.Sequence.Stream - 1, nil
+}
+
+// dropTablesExcept drops the tables not reconstructed, so the query never
+// reads rows of another time.
+func dropTablesExcept(ctx context.Context, db *sql.DB, tables []string) error {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_schema WHERE type = 'table' AND name NOT LIKE 'sqlite\\_%' ESCAPE '\\'")
+	if err != nil {
+		return err
+	}
+	var drop []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if !hasTable(tables, name) {
+			drop = append(drop, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range drop {
+		if _, err := db.ExecContext(ctx, `DROP TABLE "`+strings.ReplaceAll(name, `"`, `""`)+`"`); err != nil {
+			return fmt.Errorf("drop table %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func hasTable(tables []string, name string) bool {
+	return slices.ContainsFunc(tables, func(table string) bool {
+		return strings.EqualFold(table, name)
+	})
+}
@@ -0,0 +1,134 @@
+//go:build cgo
+
+package timetravel_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/timetravel"
+)
+
+func runJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("the NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+// emptySnapshot is the snapshot of the database before its first change, an
+// empty file is an empty SQLite database.
+func emptySnapshot(context.Context, string, uint64) (uint64, io.ReadCloser, error) {
+	return 0, io.NopCloser(strings.NewReader("")), nil
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	js := runJetStream(t)
+	err := sqlite.Load(ctx, "file:"+filepath.Join(t.TempDir(), "asof.db"), sqlite.LoadConfig{
+		MaxConns: 1,
+		Stream:   "asof",
+		Options: []ha.Option{
+			ha.WithName("node1"),
+			ha.WithReplicationURL(js.Conn().ConnectedUrl()),
+			ha.WithReplicationStream("asof"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sqlite.DB("asof.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT)",
+		"CREATE TABLE other(id INTEGER PRIMARY KEY)",
+		"INSERT INTO items VALUES (1, 'a')",
+		"INSERT INTO other VALUES (1)",
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	past := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := db.ExecContext(ctx, "UPDATE items SET name = 'b' WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := timetravel.Query(ctx, js, "asof.db", timetravel.Request{
+		Time:  past,
+		Query: sqlite.Request{Sql: "SELECT name FROM items WHERE id = 1"},
+	}, emptySnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Sequence != 4 || res.SnapshotSeq != 0 || res.Replayed != 4 {
+		t.Errorf("got sequence %d, snapshot %d and %d replayed, want the 4 changesets before the update", res.Sequence, res.SnapshotSeq, res.Replayed)
+	}
+	if len(res.Rows) != 1 || res.Rows[0][0] != "a" {
+		t.Errorf("got rows %v, want the name before the update", res.Rows)
+	}
+
+	// only the requested tables are reconstructed
+	_, err = timetravel.Query(ctx, js, "asof.db", timetravel.Request{
+		Time:   past,
+		Tables: []string{"items"},
+		Query:  sqlite.Request{Sql: "SELECT count(*) FROM other"},
+	}, emptySnapshot)
+	if err == nil || !strings.Contains(err.Error(), "no such table") {
+		t.Errorf("query of a table not reconstructed: got %v", err)
+	}
+
+	_, err = timetravel.Query(ctx, js, "asof.db", timetravel.Request{
+		Time:  past,
+		Query: sqlite.Request{Sql: "DELETE FROM items"},
+	}, emptySnapshot)
+	if !errors.Is(err, sqlite.ErrReadOnly) {
+		t.Errorf("write to the past: got %v, want ErrReadOnly", err)
+	}
+
+	_, err = timetravel.Query(ctx, js, "asof.db", timetravel.Request{
+		Time:  time.Now().Add(time.Hour),
+		Query: sqlite.Request{Sql: "SELECT 1"},
+	}, emptySnapshot)
+	if !errors.Is(err, timetravel.ErrInvalidTime) {
+		t.Errorf("future time: got %v, want ErrInvalidTime", err)
+	}
+}
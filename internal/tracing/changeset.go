@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/litesql/go-ha"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The trace context is published as a change of the go-ha control table,
+// which every release skips when applying the changeset.
+const (
+	controlTableName = "ha_stats"
+	operation        = "TRACE"
+)
+
+// Attach adds the trace context of ctx to the changeset, before its changes.
+// Nothing is added without a sampled span.
+func Attach(ctx context.Context, cs *ha.ChangeSet) {
+	if !trace.SpanContextFromContext(ctx).IsSampled() {
+		return
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if carrier["traceparent"] == "" {
+		return
+	}
+	change := ha.Change{
+		Table:     controlTableName,
+		Operation: operation,
+		Columns:   []string{"traceparent", "tracestate"},
+		NewValues: []any{carrier["traceparent"], carrier["tracestate"]},
+	}
+	cs.Changes = append([]ha.Change{change}, cs.Changes...)
+}
+
+// FromChangeSet returns a context with the trace context published with the
+// changeset, ctx when there is none.
+func FromChangeSet(ctx context.Context, cs *ha.ChangeSet) context.Context {
+	for _, change := range cs.Changes {
+		if change.Table != controlTableName || change.Operation != operation || len(change.NewValues) != 2 {
+			continue
+		}
+		carrier := propagation.MapCarrier{
+			"traceparent": fmt.Sprint(change.NewValues[0]),
+		}
+		if state, _ := change.NewValues[1].(string); state != "" {
+			carrier["tracestate"] = state
+		}
+		return otel.GetTextMapPropagator().Extract(ctx, carrier)
+	}
+	return ctx
+}
+
+// ApplyInterceptor traces the apply of the replicated changesets, as a child
+// of the span that published them. It must be the first interceptor, so the
+// span covers the other ones.
+type ApplyInterceptor struct {
+	spans sync.Map
+}
+
+func (i *ApplyInterceptor) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	if !Enabled() {
+		return false, nil
+	}
+	_, span := StartKind(FromChangeSet(context.Background(), cs), "replication apply", trace.SpanKindConsumer,
+		attribute.String("ha.database", cs.Filename),
+		attribute.String("ha.origin", cs.Node),
+		attribute.Int64("ha.stream_seq", int64(cs.StreamSeq)),
+		attribute.String("messaging.destination.name", cs.Subject),
+		attribute.Int("ha.changes", len(cs.Changes)),
+	)
+	i.spans.Store(cs, span)
+	return false, nil
+}
+
+func (i *ApplyInterceptor) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	if span, ok := i.spans.LoadAndDelete(cs); ok {
+		End(span.(trace.Span), err)
+	}
+	return err
+}
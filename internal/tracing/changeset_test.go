@@ -0,0 +1,45 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/litesql/go-ha"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/litesql/ha/internal/tracing"
+)
+
+func TestChangeSetTraceContext(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	cs := ha.ChangeSet{Changes: []ha.Change{{Table: "users", Operation: "INSERT"}}}
+
+	tracing.Attach(context.Background(), &cs)
+	if len(cs.Changes) != 1 {
+		t.Fatalf("attached a trace context without a span: %v", cs.Changes)
+	}
+
+	tracing.Attach(trace.ContextWithSpanContext(context.Background(), sc), &cs)
+	if len(cs.Changes) != 2 || cs.Changes[1].Table != "users" {
+		t.Fatalf("unexpected changes: %v", cs.Changes)
+	}
+	got := trace.SpanContextFromContext(tracing.FromChangeSet(context.Background(), &cs))
+	if got.TraceID() != sc.TraceID() || got.SpanID() != sc.SpanID() || !got.IsSampled() || !got.IsRemote() {
+		t.Fatalf("got span context %v, want %v", got, sc)
+	}
+}
+
+func TestChangeSetWithoutTraceContext(t *testing.T) {
+	cs := ha.ChangeSet{Changes: []ha.Change{{Table: "users", Operation: "INSERT"}}}
+	ctx := context.Background()
+	if got := tracing.FromChangeSet(ctx, &cs); got != ctx {
+		t.Fatal("expected the same context without a trace context")
+	}
+}
@@ -0,0 +1,107 @@
+// Package tracing exports OpenTelemetry spans of the statements of the
+// clients, from the HTTP, PostgreSQL and MySQL interfaces to the replicas
+// applying their changes. The trace context of a write is published in its
+// changeset, so the apply on every replica is part of the trace of the
+// client request.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/litesql/ha"
+
+type Config struct {
+	// Endpoint is the URL of the OTLP HTTP collector, like
+	// http://localhost:4318.
+	Endpoint    string
+	ServiceName string
+	Node        string
+	Version     string
+	// SampleRatio is the fraction of the traces started by the node that
+	// are exported, the traces of the clients follow their own decision.
+	SampleRatio float64
+}
+
+var (
+	enabled atomic.Bool
+	tracer  = otel.Tracer(instrumentationName)
+)
+
+// Setup exports the spans to the OTLP endpoint of the configuration. The
+// returned function flushes the spans not exported yet.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("otel exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+		semconv.ServiceVersion(cfg.Version),
+		semconv.ServiceInstanceID(cfg.Node),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracer = provider.Tracer(instrumentationName)
+	enabled.Store(true)
+	return func(ctx context.Context) error {
+		enabled.Store(false)
+		return provider.Shutdown(ctx)
+	}, nil
+}
+
+// Enabled reports whether the spans are exported.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Start starts a span, a child of the span of ctx. The span does nothing when
+// the tracing is disabled.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !enabled.Load() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartKind starts a span of the kind, like a server span of a client
+// request.
+func StartKind(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !enabled.Load() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// End ends the span started by Start, recording err.
+func End(span trace.Span, err error) {
+	if !enabled.Load() {
+		return
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,228 @@
+package transform
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litesql/go-ha"
+)
+
+const anyTable = "*"
+
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	time.DateTime,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.DateOnly,
+}
+
+type Rule struct {
+	Table     string `json:"table"`
+	Column    string `json:"column"`
+	Transform string `json:"transform"`
+	// Format is the Go time layout used by the timestamp transform.
+	Format string `json:"format,omitempty"`
+
+	fn func(any) (any, error)
+}
+
+// Transformer applies per-column value transformations to the replicated
+// changes before they are applied to the local database.
+type Transformer struct {
+	rules []Rule
+}
+
+// Load reads the transformation rules from a JSON file.
+func Load(path string) (*Transformer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", path, err)
+	}
+	return New(rules)
+}
+
+func New(rules []Rule) (*Transformer, error) {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Column == "" {
+			return nil, fmt.Errorf("rule %d: column is required", i)
+		}
+		if rule.Table == "" {
+			rule.Table = anyTable
+		}
+		switch strings.ToLower(rule.Transform) {
+		case "trim":
+			rule.fn = stringFn(strings.TrimSpace)
+		case "lower":
+			rule.fn = stringFn(strings.ToLower)
+		case "upper":
+			rule.fn = stringFn(strings.ToUpper)
+		case "null_if_empty":
+			rule.fn = nullIfEmpty
+		case "integer":
+			rule.fn = toInteger
+		case "real":
+			rule.fn = toReal
+		case "text":
+			rule.fn = toText
+		case "timestamp":
+			format := rule.Format
+			if format == "" {
+				format = time.DateTime
+			}
+			rule.fn = toTimestamp(format)
+		default:
+			return nil, fmt.Errorf("rule %d: invalid transform %q. Valid values: trim, lower, upper, null_if_empty, integer, real, text, timestamp", i, rule.Transform)
+		}
+	}
+	return &Transformer{rules: rules}, nil
+}
+
+func (t *Transformer) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	for i := range cs.Changes {
+		if err := t.Transform(&cs.Changes[i]); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func (t *Transformer) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	return err
+}
+
+// Transform rewrites the old and new values of the change in place.
+func (t *Transformer) Transform(change *ha.Change) error {
+	if change.Table == "" {
+		return nil
+	}
+	for _, rule := range t.rules {
+		if rule.Table != anyTable && !strings.EqualFold(rule.Table, change.Table) {
+			continue
+		}
+		for i, column := range change.Columns {
+			if !strings.EqualFold(rule.Column, column) {
+				continue
+			}
+			if i < len(change.NewValues) {
+				v, err := rule.fn(change.NewValues[i])
+				if err != nil {
+					return fmt.Errorf("transform %s.%s: %w", change.Table, column, err)
+				}
+				change.NewValues[i] = v
+			}
+			if i < len(change.OldValues) {
+				v, err := rule.fn(change.OldValues[i])
+				if err != nil {
+					return fmt.Errorf("transform %s.%s: %w", change.Table, column, err)
+				}
+				change.OldValues[i] = v
+			}
+		}
+	}
+	return nil
+}
+
+func stringFn(fn func(string) string) func(any) (any, error) {
+	return func(v any) (any, error) {
+		if s, ok := v.(string); ok {
+			return fn(s), nil
+		}
+		return v, nil
+	}
+}
+
+func nullIfEmpty(v any) (any, error) {
+	if s, ok := v.(string); ok && strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	return v, nil
+}
+
+func toInteger(v any) (any, error) {
+	switch x := v.(type) {
+	case string:
+		s := strings.TrimSpace(x)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f != math.Trunc(f) {
+			return nil, fmt.Errorf("%q is not an integer", x)
+		}
+		return int64(f), nil
+	case float64:
+		if x != math.Trunc(x) {
+			return nil, fmt.Errorf("%v is not an integer", x)
+		}
+		return int64(x), nil
+	case bool:
+		if x {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return v, nil
+}
+
+func toReal(v any) (any, error) {
+	switch x := v.(type) {
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", x)
+		}
+		return f, nil
+	case int64:
+		return float64(x), nil
+	}
+	return v, nil
+}
+
+func toText(v any) (any, error) {
+	switch x := v.(type) {
+	case nil, string:
+		return v, nil
+	case []byte:
+		return string(x), nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), nil
+	default:
+		return fmt.Sprint(x), nil
+	}
+}
+
+func toTimestamp(format string) func(any) (any, error) {
+	return func(v any) (any, error) {
+		switch x := v.(type) {
+		case string:
+			s := strings.TrimSpace(x)
+			for _, layout := range timestampLayouts {
+				if t, err := time.Parse(layout, s); err == nil {
+					return t.UTC().Format(format), nil
+				}
+			}
+			if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return time.Unix(secs, 0).UTC().Format(format), nil
+			}
+			return nil, fmt.Errorf("%q is not a timestamp", x)
+		case float64:
+			return time.Unix(int64(x), 0).UTC().Format(format), nil
+		case int64:
+			return time.Unix(x, 0).UTC().Format(format), nil
+		}
+		return v, nil
+	}
+}
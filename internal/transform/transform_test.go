@@ -0,0 +1,54 @@
+package transform_test
+
+import (
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/transform"
+)
+
+func TestTransform(t *testing.T) {
+	tr, err := transform.New([]transform.Rule{
+		{Table: "users", Column: "name", Transform: "trim"},
+		{Table: "users", Column: "age", Transform: "integer"},
+		{Column: "created_at", Transform: "timestamp"},
+		{Table: "users", Column: "nickname", Transform: "null_if_empty"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := ha.Change{
+		Table:     "users",
+		Operation: "UPDATE",
+		Columns:   []string{"name", "age", "created_at", "nickname"},
+		OldValues: []any{"john", "41", "2025-01-02T03:04:05Z", "jj"},
+		NewValues: []any{"  john doe ", "42", "2025-01-02T03:04:05-03:00", " "},
+	}
+	if err := tr.Transform(&change); err != nil {
+		t.Fatal(err)
+	}
+	want := []any{"john doe", int64(42), "2025-01-02 06:04:05", nil}
+	for i, v := range want {
+		if change.NewValues[i] != v {
+			t.Errorf("new value %s = %#v, want %#v", change.Columns[i], change.NewValues[i], v)
+		}
+	}
+	if change.OldValues[1] != int64(41) || change.OldValues[2] != "2025-01-02 03:04:05" {
+		t.Errorf("unexpected old values: %#v", change.OldValues)
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	if _, err := transform.New([]transform.Rule{{Column: "x", Transform: "unknown"}}); err == nil {
+		t.Error("expected error for invalid transform")
+	}
+	tr, err := transform.New([]transform.Rule{{Column: "age", Transform: "integer"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := ha.Change{Table: "t", Columns: []string{"age"}, NewValues: []any{"forty"}}
+	if err := tr.Transform(&change); err == nil {
+		t.Error("expected error coercing non numeric text")
+	}
+}
@@ -0,0 +1,168 @@
+package txlimit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/litesql/go-ha"
+)
+
+var ErrMissingChunks = errors.New("missing chunks of a transaction")
+
+// chunksTable keeps the chunks received before the last one of their
+// transaction, on the subscriber connection: it is not replicated.
+const (
+	chunksTable       = "ha_chunks"
+	createChunksTable = `CREATE TABLE IF NOT EXISTS ` + chunksTable + `(
+	tx TEXT NOT NULL,
+	chunk INTEGER NOT NULL,
+	changes TEXT NOT NULL,
+	timestamp_ns INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY(tx, chunk)
+)`
+)
+
+// chunkExpiry is how long before a chunk the chunks of another transaction
+// are kept. The chunks of a transaction are published one after the other,
+// older ones belong to a transaction whose publish failed halfway: the leader
+// rolled it back and never sends the rest.
+const chunkExpiry = 10 * time.Minute
+
+// Assembler is a ha.ChangeSetInterceptor applying the chunks of a transaction
+// atomically: the chunks before the last one are stored and skipped, the last
+// one is applied with the changes of all of them. The chunks are stored as the
+// consumer acknowledges them: a restart does not read them again. It goes
+// first in the interceptor chain, so the others see the whole transaction.
+type Assembler struct {
+	assembled sync.Map // *ha.ChangeSet of a last chunk -> transaction
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{}
+}
+
+func (a *Assembler) BeforeApply(cs *ha.ChangeSet, conn *sql.Conn) (bool, error) {
+	tx, chunk, chunks, ok := chunkOf(cs)
+	if !ok {
+		return false, nil
+	}
+	ctx := ha.ContextLocalDB(context.Background(), true)
+	if _, err := conn.ExecContext(ctx, createChunksTable); err != nil {
+		return false, err
+	}
+	// the time of the stream, a node catching up keeps the chunks it has
+	// not received yet
+	timestamp := cs.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().UnixNano()
+	}
+	if err := expireChunks(ctx, conn, tx, timestamp); err != nil {
+		return false, err
+	}
+	changes := cs.Changes[1:]
+	if chunk < chunks {
+		data, err := json.Marshal(changes)
+		if err != nil {
+			return false, err
+		}
+		if _, err := conn.ExecContext(ctx, "REPLACE INTO "+chunksTable+"(tx, chunk, changes, timestamp_ns) VALUES(?, ?, ?, ?)", tx, chunk, string(data), timestamp); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT changes FROM "+chunksTable+" WHERE tx = ? ORDER BY chunk", tx)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	var (
+		all    []ha.Change
+		stored int
+	)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return false, err
+		}
+		var part []ha.Change
+		if err := json.Unmarshal([]byte(data), &part); err != nil {
+			return false, fmt.Errorf("chunk of transaction %s: %w", tx, err)
+		}
+		all = append(all, part...)
+		stored++
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if stored != chunks-1 {
+		return false, fmt.Errorf("%w: %d of the %d chunks of transaction %s received before the last one", ErrMissingChunks, stored, chunks-1, tx)
+	}
+	cs.Changes = append(all, changes...)
+	a.assembled.Store(cs, tx)
+	return false, nil
+}
+
+func (a *Assembler) AfterApply(cs *ha.ChangeSet, conn *sql.Conn, err error) error {
+	tx, ok := a.assembled.LoadAndDelete(cs)
+	if !ok || err != nil {
+		return err
+	}
+	ctx := ha.ContextLocalDB(context.Background(), true)
+	if _, err := conn.ExecContext(ctx, "DELETE FROM "+chunksTable+" WHERE tx = ?", tx); err != nil {
+		slog.Warn("failed to remove the applied chunks", "tx", tx, "error", err)
+	}
+	return nil
+}
+
+// expireChunks removes the chunks of the other transactions stored more than
+// chunkExpiry before the timestamp.
+func expireChunks(ctx context.Context, conn *sql.Conn, tx string, timestamp int64) error {
+	res, err := conn.ExecContext(ctx, "DELETE FROM "+chunksTable+" WHERE tx <> ? AND timestamp_ns < ?", tx, timestamp-chunkExpiry.Nanoseconds())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Warn("removed the chunks of incomplete transactions", "chunks", n, "expiry", chunkExpiry)
+	}
+	return nil
+}
+
+// IsChunk reports whether the changeset is a chunk of a transaction.
+func IsChunk(cs *ha.ChangeSet) bool {
+	_, _, _, ok := chunkOf(cs)
+	return ok
+}
+
+// chunkOf returns the marker of a chunk, the first change of the changeset.
+// The numbers are float64 once decoded from the message.
+func chunkOf(cs *ha.ChangeSet) (tx string, chunk, chunks int, ok bool) {
+	if len(cs.Changes) == 0 {
+		return "", 0, 0, false
+	}
+	m := cs.Changes[0]
+	if m.Table != controlTableName || m.Operation != chunkOperation || len(m.NewValues) != 3 {
+		return "", 0, 0, false
+	}
+	tx, _ = m.NewValues[0].(string)
+	chunk, chunks = number(m.NewValues[1]), number(m.NewValues[2])
+	return tx, chunk, chunks, tx != "" && chunk > 0 && chunk <= chunks
+}
+
+func number(v any) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
@@ -0,0 +1,156 @@
+//go:build cgo
+
+package txlimit_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+	_ "github.com/litesql/go-sqlite3"
+
+	"github.com/litesql/ha/internal/txlimit"
+)
+
+func openConn(t *testing.T) *sql.Conn {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "ha.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// received splits the changeset in chunks of 10 changes decoded like the
+// subscribers do from the messages.
+func received(t *testing.T, cs *ha.ChangeSet) []*ha.ChangeSet {
+	t.Helper()
+	chunks, err := txlimit.Split(cs, txlimit.Limits{MaxChanges: 10, Chunk: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := make([]*ha.ChangeSet, len(chunks))
+	for i, chunk := range chunks {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded[i] = new(ha.ChangeSet)
+		if err := json.Unmarshal(data, decoded[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return decoded
+}
+
+func TestAssembler(t *testing.T) {
+	conn := openConn(t)
+	received := received(t, changeSet(25))
+	if len(received) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(received))
+	}
+
+	a := txlimit.NewAssembler()
+	if _, err := a.BeforeApply(received[2], conn); !errors.Is(err, txlimit.ErrMissingChunks) {
+		t.Fatalf("last chunk alone got error %v, want %v", err, txlimit.ErrMissingChunks)
+	}
+	for _, cs := range received[:2] {
+		skip, err := a.BeforeApply(cs, conn)
+		if err != nil || !skip {
+			t.Fatalf("chunk got skip %v, error %v, want skipped", skip, err)
+		}
+		if err := a.AfterApply(cs, conn, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := received[2]
+	skip, err := a.BeforeApply(last, conn)
+	if err != nil || skip {
+		t.Fatalf("last chunk got skip %v, error %v, want applied", skip, err)
+	}
+	if len(last.Changes) != 25 {
+		t.Fatalf("last chunk has %d changes, want the 25 of the transaction", len(last.Changes))
+	}
+	for i, change := range last.Changes {
+		if change.NewValues[0] != float64(i) {
+			t.Fatalf("changes out of order")
+		}
+	}
+	if err := a.AfterApply(last, conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	var stored int
+	if err := conn.QueryRowContext(context.Background(), "SELECT count(*) FROM ha_chunks").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 0 {
+		t.Errorf("%d chunks stored after the transaction was applied", stored)
+	}
+}
+
+func TestAssemblerExpiry(t *testing.T) {
+	conn := openConn(t)
+	a := txlimit.NewAssembler()
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	// the publish of the first transaction failed after 2 of its 3 chunks
+	partial := changeSet(25)
+	partial.Timestamp = start.UnixNano()
+	chunks := received(t, partial)
+	for _, cs := range chunks[:2] {
+		if skip, err := a.BeforeApply(cs, conn); err != nil || !skip {
+			t.Fatalf("chunk got skip %v, error %v, want skipped", skip, err)
+		}
+	}
+
+	// the chunks of a transaction published shortly after are kept
+	next := changeSet(15)
+	next.Timestamp = start.Add(time.Minute).UnixNano()
+	if skip, err := a.BeforeApply(received(t, next)[0], conn); err != nil || !skip {
+		t.Fatalf("chunk got skip %v, error %v, want skipped", skip, err)
+	}
+	if got := storedChunks(t, conn); got != 3 {
+		t.Fatalf("%d chunks stored, want 3", got)
+	}
+
+	// until a chunk published after the expiry
+	later := changeSet(15)
+	later.Timestamp = start.Add(time.Hour).UnixNano()
+	laterChunks := received(t, later)
+	if skip, err := a.BeforeApply(laterChunks[0], conn); err != nil || !skip {
+		t.Fatalf("chunk got skip %v, error %v, want skipped", skip, err)
+	}
+	if got := storedChunks(t, conn); got != 1 {
+		t.Fatalf("%d chunks stored, want the 1 of the last transaction", got)
+	}
+	last := laterChunks[1]
+	if skip, err := a.BeforeApply(last, conn); err != nil || skip || len(last.Changes) != 15 {
+		t.Fatalf("last chunk got skip %v, error %v, %d changes, want the 15 changes applied", skip, err, len(last.Changes))
+	}
+	if err := a.AfterApply(last, conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedChunks(t, conn); got != 0 {
+		t.Errorf("%d chunks stored after the transaction was applied", got)
+	}
+}
+
+func storedChunks(t *testing.T, conn *sql.Conn) int {
+	t.Helper()
+	var stored int
+	if err := conn.QueryRowContext(context.Background(), "SELECT count(*) FROM ha_chunks").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
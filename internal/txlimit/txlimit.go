@@ -0,0 +1,168 @@
+// Package txlimit checks the size of the replicated transactions at commit
+// time, so an oversized transaction fails with an error naming the limit
+// instead of timing out in the NATS publish.
+package txlimit
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/litesql/go-ha"
+)
+
+var ErrTooLarge = errors.New("transaction too large to replicate")
+
+type Limits struct {
+	// MaxChanges is the number of row changes of a transaction, 0 disables.
+	MaxChanges int
+	// MaxBytes is the size of the replication message, 0 disables.
+	MaxBytes int
+	// Chunk publishes an oversized transaction as several messages within
+	// the limits instead of rejecting it. The subscribers apply the messages
+	// together, see Assembler.
+	Chunk bool
+}
+
+func (l Limits) Enabled() bool {
+	return l.MaxChanges > 0 || l.MaxBytes > 0
+}
+
+type publisher struct {
+	ha.Publisher
+	limits Limits
+}
+
+// Publisher wraps the publisher to enforce the limits. Rejecting the
+// changeset rolls back the local transaction.
+func Publisher(pub ha.Publisher, limits Limits) ha.Publisher {
+	return &publisher{
+		Publisher: pub,
+		limits:    limits,
+	}
+}
+
+func (p *publisher) Publish(cs *ha.ChangeSet) error {
+	chunks, err := Split(cs, p.limits)
+	if err != nil {
+		return err
+	}
+	// a failed chunk rolls back the transaction, the subscribers expire the
+	// chunks published before it
+	for _, chunk := range chunks {
+		if err := p.Publisher.Publish(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Split returns the changeset, or its chunks when Chunk is set, checked
+// against the limits. Each chunk starts with the control change naming the
+// transaction, its position and the number of chunks.
+func Split(cs *ha.ChangeSet, limits Limits) ([]*ha.ChangeSet, error) {
+	if limits.MaxChanges > 0 && len(cs.Changes) > limits.MaxChanges && !limits.Chunk {
+		return nil, fmt.Errorf("%w: %d changes exceed --max-changeset-changes=%d, commit it in smaller transactions or raise the limit",
+			ErrTooLarge, len(cs.Changes), limits.MaxChanges)
+	}
+	tx := rand.Text()
+	if limits.MaxBytes <= 0 {
+		if limits.MaxChanges <= 0 || len(cs.Changes) <= limits.MaxChanges {
+			return []*ha.ChangeSet{cs}, nil
+		}
+		return mark(chunk(cs, func(changes, _ int) bool { return changes > limits.MaxChanges }, nil), tx), nil
+	}
+
+	// the message is the JSON encoding of the changeset
+	envelope := *cs
+	envelope.Changes = nil
+	b, err := json.Marshal(&envelope)
+	if err != nil {
+		return nil, err
+	}
+	overhead := len(b)
+	size := overhead
+	if limits.Chunk {
+		// the marker of a chunk is at most as long as the one numbered with
+		// the count of changes
+		b, err := json.Marshal(marker(tx, len(cs.Changes), len(cs.Changes)))
+		if err != nil {
+			return nil, err
+		}
+		overhead += len(b) + 1
+	}
+	sizes := make([]int, len(cs.Changes))
+	for i, change := range cs.Changes {
+		b, err := json.Marshal(change)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = len(b) + 1
+		size += sizes[i]
+		if overhead+sizes[i] > limits.MaxBytes {
+			return nil, fmt.Errorf("%w: a change of table %q is %d bytes, over --max-changeset-bytes=%d", ErrTooLarge, change.Table, sizes[i], limits.MaxBytes)
+		}
+	}
+	if size > limits.MaxBytes && !limits.Chunk {
+		return nil, fmt.Errorf("%w: %d bytes exceed --max-changeset-bytes=%d, commit it in smaller transactions or raise the limit",
+			ErrTooLarge, size, limits.MaxBytes)
+	}
+	if size <= limits.MaxBytes && (limits.MaxChanges <= 0 || len(cs.Changes) <= limits.MaxChanges) {
+		return []*ha.ChangeSet{cs}, nil
+	}
+	return mark(chunk(cs, func(changes, bytes int) bool {
+		return limits.MaxChanges > 0 && changes > limits.MaxChanges || overhead+bytes > limits.MaxBytes
+	}, sizes), tx), nil
+}
+
+// The chunks are marked by a change of the go-ha control table, which every
+// release skips when applying the changeset.
+const (
+	controlTableName = "ha_stats"
+	chunkOperation   = "CHUNK"
+)
+
+func marker(tx string, chunk, chunks int) ha.Change {
+	return ha.Change{
+		Table:     controlTableName,
+		Operation: chunkOperation,
+		Columns:   []string{"tx", "chunk", "chunks"},
+		NewValues: []any{tx, chunk, chunks},
+	}
+}
+
+// mark adds the marker of the transaction to its chunks, numbered from 1.
+func mark(chunks []*ha.ChangeSet, tx string) []*ha.ChangeSet {
+	for i, c := range chunks {
+		c.Changes = append([]ha.Change{marker(tx, i+1, len(chunks))}, c.Changes...)
+	}
+	return chunks
+}
+
+// chunk splits the changes before the change that makes full report true.
+func chunk(cs *ha.ChangeSet, full func(changes, bytes int) bool, sizes []int) []*ha.ChangeSet {
+	var (
+		chunks       []*ha.ChangeSet
+		start, bytes int
+	)
+	for i := range cs.Changes {
+		if sizes != nil {
+			bytes += sizes[i]
+		}
+		if i > start && full(i-start+1, bytes) {
+			chunks = append(chunks, slice(cs, start, i))
+			start = i
+			if sizes != nil {
+				bytes = sizes[i]
+			}
+		}
+	}
+	return append(chunks, slice(cs, start, len(cs.Changes)))
+}
+
+func slice(cs *ha.ChangeSet, start, end int) *ha.ChangeSet {
+	c := *cs
+	c.Changes = cs.Changes[start:end:end]
+	return &c
+}
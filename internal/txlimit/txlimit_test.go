@@ -0,0 +1,101 @@
+package txlimit_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/txlimit"
+)
+
+type recorder struct {
+	published []*ha.ChangeSet
+}
+
+func (r *recorder) Publish(cs *ha.ChangeSet) error {
+	r.published = append(r.published, cs)
+	return nil
+}
+
+func (r *recorder) Sequence() uint64 {
+	return uint64(len(r.published))
+}
+
+func changeSet(n int) *ha.ChangeSet {
+	cs := &ha.ChangeSet{Node: "node1", Filename: "ha.db"}
+	for i := range n {
+		cs.Changes = append(cs.Changes, ha.Change{
+			Table:     "users",
+			Operation: "INSERT",
+			Columns:   []string{"id", "name"},
+			NewValues: []any{i, "user"},
+		})
+	}
+	return cs
+}
+
+func TestPublisher(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits txlimit.Limits
+		n      int
+		chunks int
+		err    error
+	}{
+		{"within changes", txlimit.Limits{MaxChanges: 10}, 10, 1, nil},
+		{"reject changes", txlimit.Limits{MaxChanges: 10}, 11, 0, txlimit.ErrTooLarge},
+		{"chunk changes", txlimit.Limits{MaxChanges: 10, Chunk: true}, 25, 3, nil},
+		{"within bytes", txlimit.Limits{MaxBytes: 1 << 20}, 100, 1, nil},
+		{"reject bytes", txlimit.Limits{MaxBytes: 1024}, 100, 0, txlimit.ErrTooLarge},
+		{"chunk bytes", txlimit.Limits{MaxBytes: 1024, Chunk: true}, 100, 2, nil},
+		{"change over bytes", txlimit.Limits{MaxBytes: 64, Chunk: true}, 1, 0, txlimit.ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{}
+			err := txlimit.Publisher(rec, tt.limits).Publish(changeSet(tt.n))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				if len(rec.published) > 0 {
+					t.Errorf("published %d messages of a rejected changeset", len(rec.published))
+				}
+				return
+			}
+			if tt.chunks == 1 && len(rec.published) != 1 || tt.chunks > 1 && len(rec.published) < 2 {
+				t.Fatalf("got %d messages, want %d", len(rec.published), tt.chunks)
+			}
+			var changes int
+			for i, cs := range rec.published {
+				if txlimit.IsChunk(cs) != (len(rec.published) > 1) {
+					t.Errorf("message %d: got IsChunk %v", i+1, txlimit.IsChunk(cs))
+				}
+				if b, _ := json.Marshal(cs); tt.limits.MaxBytes > 0 && len(b) > tt.limits.MaxBytes {
+					t.Errorf("chunk of %d bytes", len(b))
+				}
+				if len(rec.published) > 1 {
+					marker := cs.Changes[0]
+					if marker.Table != "ha_stats" || marker.Operation != "CHUNK" || marker.NewValues[1] != i+1 || marker.NewValues[2] != len(rec.published) {
+						t.Fatalf("chunk %d starts with %+v, want its marker", i+1, marker)
+					}
+					cs.Changes = cs.Changes[1:]
+				}
+				if tt.limits.MaxChanges > 0 && len(cs.Changes) > tt.limits.MaxChanges {
+					t.Errorf("chunk of %d changes", len(cs.Changes))
+				}
+				for i, change := range cs.Changes {
+					if change.NewValues[0] != changes+i {
+						t.Fatalf("changes out of order")
+					}
+				}
+				changes += len(cs.Changes)
+			}
+			if changes != tt.n {
+				t.Errorf("published %d changes, want %d", changes, tt.n)
+			}
+		})
+	}
+}
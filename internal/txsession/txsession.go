@@ -0,0 +1,272 @@
+// Package txsession keeps the interactive transactions of the HTTP API open
+// between requests: a transaction is begun, identified by a token, receives
+// the statements of the next requests and is committed or rolled back by the
+// client, or rolled back once idle for too long.
+package txsession
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/litesql/ha/internal/session"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+var (
+	ErrNotFound = errors.New("transaction not found")
+	ErrTooMany  = errors.New("too many open transactions")
+)
+
+type Config struct {
+	// IdleTimeout rolls back the transactions without request for longer,
+	// 30s when 0.
+	IdleTimeout time.Duration
+	// Max bounds the transactions open at once, 0 is unlimited.
+	Max int
+	// Connections is the size of the connection pool of a database: each
+	// transaction holds a connection, at most Connections-1 are open on a
+	// database so its other requests keep one. 0 is unlimited.
+	Connections int
+}
+
+type Tx struct {
+	Token     string    `json:"token"`
+	DB        string    `json:"database"`
+	StartedAt time.Time `json:"started_at"`
+
+	// mu serializes the requests of the transaction.
+	mu       sync.Mutex
+	ctx      context.Context
+	db       *sql.DB
+	tx       *sql.Tx
+	done     bool
+	lastUsed time.Time
+}
+
+type Manager struct {
+	cfg Config
+
+	mu  sync.Mutex
+	txs map[string]*Tx
+	// open counts the transactions of each database, with the ones beginning
+	open  map[string]int
+	total int
+}
+
+func New(cfg Config) *Manager {
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 30 * time.Second
+	}
+	return &Manager{
+		cfg:  cfg,
+		txs:  make(map[string]*Tx),
+		open: make(map[string]int),
+	}
+}
+
+func (m *Manager) IdleTimeout() time.Duration {
+	return m.cfg.IdleTimeout
+}
+
+// Begin begins a transaction on the database. It outlives the request, only
+// the values of ctx are kept: the session identity commits the changes.
+func (m *Manager) Begin(ctx context.Context, id string, mode sqlite.BeginMode) (*Tx, error) {
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		id = sqlite.DefaultDatabase()
+	}
+	// counted before waiting for a connection
+	if err := m.reserve(id); err != nil {
+		return nil, err
+	}
+	ctx = context.WithoutCancel(ctx)
+	tx, err := sqlite.BeginTx(ctx, db, mode)
+	if err != nil {
+		m.mu.Lock()
+		m.release(id)
+		m.mu.Unlock()
+		return nil, err
+	}
+	now := time.Now()
+	t := &Tx{
+		Token:     rand.Text(),
+		DB:        id,
+		StartedAt: now.UTC(),
+		ctx:       ctx,
+		db:        db,
+		tx:        tx,
+		lastUsed:  now,
+	}
+	m.mu.Lock()
+	m.txs[t.Token] = t
+	m.mu.Unlock()
+	slog.Debug("transaction session begun", "token", t.Token, "database", id)
+	return t, nil
+}
+
+// reserve counts a transaction beginning on the database id, or fails with
+// ErrTooMany.
+func (m *Manager) reserve(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cfg.Max > 0 && m.total >= m.cfg.Max {
+		return fmt.Errorf("%w, the limit is %d", ErrTooMany, m.cfg.Max)
+	}
+	if m.cfg.Connections > 0 && m.open[id] >= m.cfg.Connections-1 {
+		return fmt.Errorf("%w on database %q, the limit is %d", ErrTooMany, id, m.cfg.Connections-1)
+	}
+	m.open[id]++
+	m.total++
+	return nil
+}
+
+// release uncounts a transaction of the database id, under m.mu.
+func (m *Manager) release(id string) {
+	m.total--
+	if m.open[id]--; m.open[id] <= 0 {
+		delete(m.open, id)
+	}
+}
+
+// Get returns the transaction of the token. id is the database of the
+// request, empty for any database.
+func (m *Manager) Get(ctx context.Context, token, id string) (*Tx, error) {
+	t, err := m.get(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" && id != t.DB {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// get returns the transaction of the token, only to the user that began it.
+func (m *Manager) get(ctx context.Context, token string) (*Tx, error) {
+	m.mu.Lock()
+	t, ok := m.txs[token]
+	m.mu.Unlock()
+	if !ok || session.User(ctx) != session.User(t.ctx) {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// Exec runs the queries in the transaction. A failed statement leaves the
+// transaction open, the client decides to go on or to roll back.
+func (m *Manager) Exec(ctx context.Context, token string, queries []sqlite.Request) ([]*sqlite.Response, error) {
+	t, err := m.get(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return nil, ErrNotFound
+	}
+	defer func() { t.lastUsed = time.Now() }()
+	var list []*sqlite.Response
+	for _, query := range queries {
+		queryCtx, cancel := sqlite.QueryContext(ctx, time.Duration(query.TimeoutMs)*time.Millisecond)
+		res, err := sqlite.Exec(queryCtx, t.tx, query.Sql, query.Params)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, res)
+	}
+	return list, nil
+}
+
+// Commit commits the transaction with the identity of the session that began
+// it. The transaction is finished even when the commit fails.
+func (m *Manager) Commit(ctx context.Context, token string) error {
+	t, err := m.finish(ctx, token)
+	if err != nil {
+		return err
+	}
+	defer t.mu.Unlock()
+	return sqlite.Commit(t.ctx, t.db, t.tx)
+}
+
+func (m *Manager) Rollback(ctx context.Context, token string) error {
+	t, err := m.finish(ctx, token)
+	if err != nil {
+		return err
+	}
+	defer t.mu.Unlock()
+	return t.tx.Rollback()
+}
+
+// finish removes the transaction and returns it locked.
+func (m *Manager) finish(ctx context.Context, token string) (*Tx, error) {
+	t, err := m.get(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	t.done = true
+	m.mu.Lock()
+	delete(m.txs, token)
+	m.release(t.DB)
+	m.mu.Unlock()
+	return t, nil
+}
+
+// Start rolls back the transactions idle for longer than the idle timeout
+// until ctx is done, and then all of them.
+func (m *Manager) Start(ctx context.Context) {
+	ticker := time.NewTicker(max(m.cfg.IdleTimeout/4, 100*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			m.expire(time.Time{})
+			return
+		case <-ticker.C:
+		}
+		m.expire(time.Now())
+	}
+}
+
+// expire rolls back the idle transactions, all of them when now is zero.
+// The transactions running a request are not idle.
+func (m *Manager) expire(now time.Time) {
+	m.mu.Lock()
+	var expired []*Tx
+	for token, t := range m.txs {
+		if !t.mu.TryLock() {
+			continue
+		}
+		if now.IsZero() || now.Sub(t.lastUsed) > m.cfg.IdleTimeout {
+			t.done = true
+			delete(m.txs, token)
+			m.release(t.DB)
+			expired = append(expired, t)
+			continue
+		}
+		t.mu.Unlock()
+	}
+	m.mu.Unlock()
+	for _, t := range expired {
+		if err := t.tx.Rollback(); err != nil {
+			slog.Warn("failed to roll back an idle transaction session", "token", t.Token, "database", t.DB, "error", err)
+		} else {
+			slog.Info("idle transaction session rolled back", "token", t.Token, "database", t.DB)
+		}
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,136 @@
+package txsession_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/txsession"
+)
+
+func TestMain(m *testing.M) {
+	err := sqlite.Load(context.TODO(), "file:/tx.db?vfs=memdb", sqlite.LoadConfig{
+		MemDB:    true,
+		MaxConns: 3,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load sqlite databases: %v\n", err)
+		os.Exit(1)
+	}
+	defer ha.Shutdown()
+	os.Exit(m.Run())
+}
+
+func TestLimits(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		cfg  txsession.Config
+		want int
+	}{
+		{name: "max", cfg: txsession.Config{Max: 1, Connections: 3}, want: 1},
+		{name: "connections", cfg: txsession.Config{Max: 10, Connections: 3}, want: 2},
+		{name: "single connection", cfg: txsession.Config{Connections: 1}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := txsession.New(tt.cfg)
+			var tokens []string
+			for range tt.want {
+				tx, err := m.Begin(ctx, "tx.db", sqlite.BeginDeferred)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tokens = append(tokens, tx.Token)
+			}
+			// refused before waiting for a connection of the pool
+			if _, err := m.Begin(ctx, "tx.db", sqlite.BeginDeferred); !errors.Is(err, txsession.ErrTooMany) {
+				t.Fatalf("Begin over the limit: got %v, want ErrTooMany", err)
+			}
+			for _, token := range tokens {
+				if err := m.Rollback(ctx, token); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.want == 0 {
+				return
+			}
+			tx, err := m.Begin(ctx, "", sqlite.BeginDeferred)
+			if err != nil {
+				t.Fatalf("Begin after the rollbacks: %v", err)
+			}
+			if err := m.Commit(ctx, tx.Token); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStart(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.DB("tx.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS items(id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	m := txsession.New(txsession.Config{IdleTimeout: 100 * time.Millisecond, Connections: 3})
+	startCtx, stop := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		m.Start(startCtx)
+	}()
+
+	begin := func() *txsession.Tx {
+		t.Helper()
+		tx, err := m.Begin(ctx, "tx.db", sqlite.BeginDeferred)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Exec(ctx, tx.Token, []sqlite.Request{{Sql: "INSERT INTO items DEFAULT VALUES"}}); err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	idle := begin()
+	time.Sleep(500 * time.Millisecond)
+	if _, err := m.Get(ctx, idle.Token, ""); !errors.Is(err, txsession.ErrNotFound) {
+		t.Errorf("idle transaction: got %v, want ErrNotFound", err)
+	}
+
+	open := begin()
+	stop()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return once its context was cancelled")
+	}
+	if err := m.Commit(ctx, open.Token); !errors.Is(err, txsession.ErrNotFound) {
+		t.Errorf("commit after stop: got %v, want ErrNotFound", err)
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM items").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d rows committed, want the transactions rolled back", count)
+	}
+	// the connections are back in the pool
+	for range 2 {
+		tx, err := m.Begin(ctx, "tx.db", sqlite.BeginDeferred)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Rollback(ctx, tx.Token)
+	}
+}
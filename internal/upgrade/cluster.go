@@ -0,0 +1,160 @@
+package upgrade
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Affinity of a node relative to this one, from its region and zone labels.
+const (
+	AffinityLocal  = "local"
+	AffinityZone   = "zone"
+	AffinityRegion = "region"
+	AffinityRemote = "remote"
+)
+
+var reLabelKey = regexp.MustCompile(`^[a-z0-9]([a-z0-9_.-]*[a-z0-9])?$`)
+
+// ParseLabels parses a comma separated list of key=value labels, like
+// region=eu-west,zone=eu-west-1a,tier=hot.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, label := range strings.Split(s, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(label, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("label %q must be key=value", label)
+		}
+		if !reLabelKey.MatchString(key) {
+			return nil, fmt.Errorf("invalid label key %q", key)
+		}
+		labels[key] = value
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
+
+// Affinity classifies the node labels relative to the local ones. A zone
+// only matches within the same region.
+func Affinity(local, node map[string]string) string {
+	region := local["region"] != "" && local["region"] == node["region"]
+	if local["zone"] != "" && local["zone"] == node["zone"] && (region || local["region"] == "" && node["region"] == "") {
+		return AffinityZone
+	}
+	if region {
+		return AffinityRegion
+	}
+	return AffinityRemote
+}
+
+func affinityRank(affinity string) int {
+	switch affinity {
+	case AffinityLocal:
+		return 0
+	case AffinityZone:
+		return 1
+	case AffinityRegion:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// Node is a cluster member seen through its heartbeats.
+type Node struct {
+	Capabilities
+	Affinity string `json:"affinity"`
+}
+
+// Registry keeps the last heartbeat of each node, to list the cluster
+// members nearest first.
+type Registry struct {
+	local Capabilities
+	ttl   time.Duration
+
+	mu    sync.RWMutex
+	nodes map[string]Capabilities
+}
+
+// Watch subscribes to the heartbeats until the context is done. The nodes
+// without a heartbeat for longer than ttl are no longer listed.
+func Watch(ctx context.Context, nc *nats.Conn, subject string, local Capabilities, ttl time.Duration) (*Registry, error) {
+	r := &Registry{
+		local: local,
+		ttl:   ttl,
+		nodes: make(map[string]Capabilities),
+	}
+	sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		var node Capabilities
+		if err := json.Unmarshal(msg.Data, &node); err != nil || node.Node == "" {
+			slog.Debug("ignoring invalid heartbeat", "error", err)
+			return
+		}
+		node.Time = time.Now().UTC()
+		r.mu.Lock()
+		r.nodes[node.Node] = node
+		r.mu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(ctx, func() {
+		sub.Unsubscribe()
+	})
+	return r, nil
+}
+
+// Nodes lists the live nodes, this one first, then by affinity and name.
+func (r *Registry) Nodes() []Node {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]Node, 0, len(r.nodes))
+	for name, node := range r.nodes {
+		if time.Since(node.Time) > r.ttl {
+			continue
+		}
+		affinity := Affinity(r.local.Labels, node.Labels)
+		if name == r.local.Node {
+			affinity = AffinityLocal
+		}
+		list = append(list, Node{Capabilities: node, Affinity: affinity})
+	}
+	slices.SortFunc(list, func(a, b Node) int {
+		return cmp.Or(cmp.Compare(affinityRank(a.Affinity), affinityRank(b.Affinity)), strings.Compare(a.Node, b.Node))
+	})
+	return list
+}
+
+// Nearest returns the URL of the node nearest to the labels, the same zone
+// first, then the same region. Only the nodes advertising a URL are chosen.
+func Nearest(labels map[string]string, nodes []Node) (string, bool) {
+	var (
+		url  string
+		rank = affinityRank(AffinityRemote) + 1
+	)
+	for _, node := range nodes {
+		if node.URL == "" {
+			continue
+		}
+		if r := affinityRank(Affinity(labels, node.Labels)); r < rank {
+			url, rank = node.URL, r
+		}
+	}
+	return url, url != ""
+}
@@ -0,0 +1,56 @@
+package upgrade_test
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/litesql/ha/internal/upgrade"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := upgrade.ParseLabels(" region=eu-west, zone = eu-west-1a,tier=hot,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"region": "eu-west", "zone": "eu-west-1a", "tier": "hot"}
+	if !maps.Equal(labels, want) {
+		t.Errorf("ParseLabels = %v, want %v", labels, want)
+	}
+	for _, invalid := range []string{"region", "region=", "Region=x", "=x"} {
+		if _, err := upgrade.ParseLabels(invalid); err == nil {
+			t.Errorf("ParseLabels(%q) should fail", invalid)
+		}
+	}
+}
+
+func TestNearest(t *testing.T) {
+	local := map[string]string{"region": "eu-west", "zone": "a"}
+	node := func(name, url, region, zone string) upgrade.Node {
+		return upgrade.Node{Capabilities: upgrade.Capabilities{
+			Node:   name,
+			URL:    url,
+			Labels: map[string]string{"region": region, "zone": zone},
+		}}
+	}
+	nodes := []upgrade.Node{
+		node("us", "http://us:8080", "us-east", "a"),
+		node("eu-b", "http://eu-b:8080", "eu-west", "b"),
+		node("eu-a", "", "eu-west", "a"),
+	}
+	if got := upgrade.Affinity(local, nodes[0].Labels); got != upgrade.AffinityRemote {
+		t.Errorf("Affinity(us) = %q, the zone must not match across regions", got)
+	}
+	if got := upgrade.Affinity(local, nodes[2].Labels); got != upgrade.AffinityZone {
+		t.Errorf("Affinity(eu-a) = %q, want %q", got, upgrade.AffinityZone)
+	}
+	// the same zone node has no URL
+	if url, ok := upgrade.Nearest(local, nodes); !ok || url != "http://eu-b:8080" {
+		t.Errorf("Nearest = %q, %v", url, ok)
+	}
+	if url, ok := upgrade.Nearest(map[string]string{"region": "ap"}, nodes); !ok || url != "http://us:8080" {
+		t.Errorf("Nearest without a near node = %q, %v", url, ok)
+	}
+	if _, ok := upgrade.Nearest(local, nodes[2:]); ok {
+		t.Error("Nearest without URLs should fail")
+	}
+}
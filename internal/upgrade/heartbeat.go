@@ -0,0 +1,112 @@
+// Package upgrade advertises the replication capabilities of each node on a
+// NATS heartbeat subject and checks them before a rolling upgrade.
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/litesql/ha/internal/changeset"
+)
+
+// Features lists the replication features of this build that peers must
+// understand. A feature removed from a release must be drained from the
+// cluster before the upgrade.
+var Features = []string{
+	"changeset-negotiation",
+	"snapshot-history",
+}
+
+// Capabilities is the heartbeat payload.
+type Capabilities struct {
+	Node              string            `json:"node"`
+	Version           string            `json:"version"`
+	Commit            string            `json:"commit"`
+	ChangeSetVersion  int               `json:"changeset_version"`
+	ChangeSetVersions []int             `json:"changeset_versions"`
+	Features          []string          `json:"features"`
+	Flags             map[string]string `json:"flags,omitempty"`
+	Leader            []string          `json:"leader,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	URL               string            `json:"url,omitempty"`
+	Time              time.Time         `json:"time"`
+}
+
+// Local returns the capabilities of this binary with the replication flags
+// that must match across the cluster.
+func Local(node, version, commit string, flags map[string]string) Capabilities {
+	return Capabilities{
+		Node:              node,
+		Version:           version,
+		Commit:            commit,
+		ChangeSetVersion:  changeset.Version,
+		ChangeSetVersions: slices.Clone(changeset.Supported),
+		Features:          slices.Clone(Features),
+		Flags:             flags,
+	}
+}
+
+// Heartbeat publishes the capabilities on the subject on each interval. The
+// leader function reports the databases this node currently leads.
+func Heartbeat(ctx context.Context, nc *nats.Conn, subject string, interval time.Duration, local Capabilities, leader func() []string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		hb := local
+		hb.Leader = leader()
+		hb.Time = time.Now().UTC()
+		data, err := json.Marshal(hb)
+		if err == nil {
+			err = nc.Publish(subject, data)
+		}
+		if err != nil {
+			slog.Warn("failed to publish heartbeat", "error", err, "subject", subject)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Peers collects the heartbeats published on the subject during wait, the
+// most recent one of each node.
+func Peers(ctx context.Context, nc *nats.Conn, subject string, wait time.Duration) ([]Capabilities, error) {
+	ch := make(chan *nats.Msg, 64)
+	sub, err := nc.ChanSubscribe(subject, ch)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	peers := make(map[string]Capabilities)
+	for {
+		select {
+		case <-ctx.Done():
+			list := make([]Capabilities, 0, len(peers))
+			for _, peer := range peers {
+				list = append(list, peer)
+			}
+			slices.SortFunc(list, func(a, b Capabilities) int {
+				return strings.Compare(a.Node, b.Node)
+			})
+			return list, nil
+		case msg := <-ch:
+			var peer Capabilities
+			if err := json.Unmarshal(msg.Data, &peer); err != nil || peer.Node == "" {
+				slog.Debug("ignoring invalid heartbeat", "error", err)
+				continue
+			}
+			peers[peer.Node] = peer
+		}
+	}
+}
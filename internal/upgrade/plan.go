@@ -0,0 +1,141 @@
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/litesql/ha/internal/changeset"
+)
+
+type Step struct {
+	Node   string `json:"node"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// Plan is the ordered rolling upgrade of the peers to the target binary.
+// Problems block the upgrade; Flags must be set on the upgraded nodes.
+type Plan struct {
+	Target   Capabilities `json:"target"`
+	Steps    []Step       `json:"steps"`
+	Flags    []string     `json:"flags,omitempty"`
+	Problems []string     `json:"problems,omitempty"`
+	Notes    []string     `json:"notes,omitempty"`
+}
+
+func (p Plan) Safe() bool {
+	return len(p.Problems) == 0
+}
+
+// NewPlan checks the target binary against the peers. During the rollout the
+// leaders keep running the current release and writing its changeset format,
+// so the followers are upgraded first and the leaders last. Once every node
+// runs the target, the publishers negotiate the newest common format.
+func NewPlan(target Capabilities, peers []Capabilities) Plan {
+	plan := Plan{Target: target}
+	if len(peers) == 0 {
+		plan.Problems = append(plan.Problems, "no heartbeat received from peers, check --heartbeat-subject and that the nodes run with --heartbeat-interval")
+		return plan
+	}
+
+	var (
+		followers, leaders []Step
+		maxWritten         int
+	)
+	peerFlags := make(map[string][]string)
+	for _, peer := range peers {
+		maxWritten = max(maxWritten, peer.ChangeSetVersion)
+		if !slices.Contains(target.ChangeSetVersions, peer.ChangeSetVersion) {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("node %s writes changeset format %d, not applied by the target (applies %s): upgrade through an intermediate release first",
+				peer.Node, peer.ChangeSetVersion, formatInts(target.ChangeSetVersions)))
+		}
+		if _, err := changeset.Negotiate(target.ChangeSetVersions, [][]int{peer.ChangeSetVersions}); err != nil {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("node %s applies changeset formats %s, the target writes none of them (writes %s): a target leader could not publish",
+				peer.Node, formatInts(peer.ChangeSetVersions), formatInts(target.ChangeSetVersions)))
+		}
+		for _, feature := range peer.Features {
+			if !slices.Contains(target.Features, feature) {
+				plan.Notes = append(plan.Notes, fmt.Sprintf("node %s uses feature %q not supported by the target", peer.Node, feature))
+			}
+		}
+		for flag, value := range peer.Flags {
+			if !slices.Contains(peerFlags[flag], value) {
+				peerFlags[flag] = append(peerFlags[flag], value)
+			}
+		}
+
+		step := Step{Node: peer.Node, Action: "upgrade"}
+		switch {
+		case peer.Version == target.Version && peer.Commit == target.Commit:
+			step.Action = "skip"
+			step.Reason = "already running the target release"
+			followers = append(followers, step)
+		case len(peer.Leader) > 0:
+			step.Reason = "leader of " + strings.Join(peer.Leader, ", ") + ", upgrade last so the followers already apply its changes"
+			leaders = append(leaders, step)
+		default:
+			step.Reason = "follower"
+			followers = append(followers, step)
+		}
+	}
+	plan.Steps = append(followers, leaders...)
+
+	for flag, values := range peerFlags {
+		switch {
+		case len(values) > 1:
+			slices.Sort(values)
+			plan.Problems = append(plan.Problems, fmt.Sprintf("peers disagree on --%s (%s)", flag, strings.Join(values, ", ")))
+		case target.Flags[flag] != values[0]:
+			plan.Flags = append(plan.Flags, fmt.Sprintf("--%s=%s", flag, values[0]))
+		}
+	}
+	slices.Sort(plan.Flags)
+	slices.Sort(plan.Problems)
+
+	if target.ChangeSetVersion > maxWritten {
+		plan.Notes = append(plan.Notes, fmt.Sprintf("changeset format %d is used only after every node is upgraded", target.ChangeSetVersion))
+	}
+	return plan
+}
+
+func formatInts(values []int) string {
+	list := make([]string, len(values))
+	for i, v := range values {
+		list[i] = fmt.Sprint(v)
+	}
+	return "[" + strings.Join(list, ",") + "]"
+}
+
+// Print writes the plan in a human readable form.
+func (p Plan) Print(w io.Writer) {
+	fmt.Fprintf(w, "Target: version %s (commit %s), changeset format %d, applies %s\n",
+		p.Target.Version, p.Target.Commit, p.Target.ChangeSetVersion, formatInts(p.Target.ChangeSetVersions))
+	if len(p.Steps) > 0 {
+		fmt.Fprintln(w, "\nRolling upgrade plan:")
+		for i, step := range p.Steps {
+			fmt.Fprintf(w, "  %d. %s %s (%s)\n", i+1, step.Action, step.Node, step.Reason)
+		}
+	}
+	if len(p.Flags) > 0 {
+		fmt.Fprintln(w, "\nRequired flags on the upgraded nodes:")
+		for _, flag := range p.Flags {
+			fmt.Fprintf(w, "  %s\n", flag)
+		}
+	}
+	if len(p.Notes) > 0 {
+		fmt.Fprintln(w, "\nNotes:")
+		for _, note := range p.Notes {
+			fmt.Fprintf(w, "  - %s\n", note)
+		}
+	}
+	if len(p.Problems) > 0 {
+		fmt.Fprintln(w, "\nUpgrade is NOT safe:")
+		for _, problem := range p.Problems {
+			fmt.Fprintf(w, "  - %s\n", problem)
+		}
+		return
+	}
+	fmt.Fprintln(w, "\nUpgrade is safe.")
+}
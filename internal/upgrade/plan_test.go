@@ -0,0 +1,58 @@
+package upgrade_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/litesql/ha/internal/upgrade"
+)
+
+func TestNewPlan(t *testing.T) {
+	target := upgrade.Capabilities{
+		Node:              "new",
+		Version:           "v2",
+		ChangeSetVersion:  2,
+		ChangeSetVersions: []int{1, 2},
+		Flags:             map[string]string{"row-identify": "pk"},
+	}
+	peers := []upgrade.Capabilities{
+		{Node: "a", Version: "v1", ChangeSetVersion: 1, ChangeSetVersions: []int{1}, Leader: []string{"ha.db"}, Flags: map[string]string{"row-identify": "rowid"}},
+		{Node: "b", Version: "v1", ChangeSetVersion: 1, ChangeSetVersions: []int{1}, Flags: map[string]string{"row-identify": "rowid"}},
+		{Node: "c", Version: "v2", ChangeSetVersion: 2, ChangeSetVersions: []int{1, 2}, Flags: map[string]string{"row-identify": "rowid"}},
+	}
+	plan := upgrade.NewPlan(target, peers)
+	if !plan.Safe() {
+		t.Fatalf("unexpected problems: %v", plan.Problems)
+	}
+	var order []string
+	for _, step := range plan.Steps {
+		order = append(order, step.Action+" "+step.Node)
+	}
+	if want := []string{"upgrade b", "skip c", "upgrade a"}; !slices.Equal(order, want) {
+		t.Errorf("got steps %v, want %v", order, want)
+	}
+	if want := []string{"--row-identify=rowid"}; !slices.Equal(plan.Flags, want) {
+		t.Errorf("got flags %v, want %v", plan.Flags, want)
+	}
+}
+
+func TestNewPlanIncompatible(t *testing.T) {
+	target := upgrade.Capabilities{Node: "new", Version: "v3", ChangeSetVersion: 3, ChangeSetVersions: []int{3}}
+	peers := []upgrade.Capabilities{
+		{Node: "a", Version: "v1", ChangeSetVersion: 1, ChangeSetVersions: []int{1}},
+		{Node: "b", Version: "v1", ChangeSetVersion: 1, ChangeSetVersions: []int{1}, Flags: map[string]string{"async-replication": "true"}},
+		{Node: "c", Version: "v1", ChangeSetVersion: 1, ChangeSetVersions: []int{1}, Flags: map[string]string{"async-replication": "false"}},
+	}
+	plan := upgrade.NewPlan(target, peers)
+	if plan.Safe() {
+		t.Fatal("expected an unsafe plan")
+	}
+	// format written and applied by each peer, plus the flag disagreement
+	if len(plan.Problems) != 7 {
+		t.Errorf("got %d problems: %v", len(plan.Problems), plan.Problems)
+	}
+
+	if plan := upgrade.NewPlan(target, nil); plan.Safe() {
+		t.Error("expected an unsafe plan without peers")
+	}
+}
@@ -0,0 +1,490 @@
+// Package verify validates a snapshot and an exported replication stream
+// offline: the changes are replayed onto a copy of the snapshot and the result
+// is checked with the SQLite integrity checks.
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/litesql/go-ha"
+
+	"github.com/litesql/ha/internal/changeset"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// ChecksumFile lists the SHA-256 of the exported files, in the sha256sum
+// format. A snapshot checksum is read from the snapshot file name with the
+// .sha256 suffix.
+const ChecksumFile = "SHA256SUMS"
+
+const controlTableName = "ha_stats"
+
+// Message is a line of an exported stream file. A line without the data field
+// is the changeset itself, as printed by nats sub --raw.
+type Message struct {
+	Sequence uint64          `json:"seq,omitempty"`
+	Subject  string          `json:"subject,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+type Config struct {
+	Snapshot     string
+	StreamExport string
+	// FromSequence skips the messages already in the snapshot. Defaults to
+	// the sequence recorded in the snapshot ha_stats table.
+	FromSequence uint64
+	// Output keeps the replayed database.
+	Output string
+}
+
+type Report struct {
+	SnapshotSequence uint64
+	Files            int
+	Checksums        int
+	Messages         int
+	Skipped          int
+	Applied          int
+	Changes          int
+	FirstSequence    uint64
+	LastSequence     uint64
+	Warnings         []string
+	Problems         []string
+}
+
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) warn(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Print writes the report in a human readable form.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "Snapshot sequence: %d\n", r.SnapshotSequence)
+	fmt.Fprintf(w, "Checksums verified: %d\n", r.Checksums)
+	fmt.Fprintf(w, "Stream files: %d, messages: %d, skipped: %d, applied: %d (%d changes)\n",
+		r.Files, r.Messages, r.Skipped, r.Applied, r.Changes)
+	if r.LastSequence > 0 {
+		fmt.Fprintf(w, "Replayed sequences: %d to %d\n", r.FirstSequence, r.LastSequence)
+	}
+	if len(r.Warnings) > 0 {
+		fmt.Fprintln(w, "\nWarnings:")
+		for _, warning := range r.Warnings {
+			fmt.Fprintf(w, "  - %s\n", warning)
+		}
+	}
+	if len(r.Problems) > 0 {
+		fmt.Fprintln(w, "\nVerification FAILED:")
+		for _, problem := range r.Problems {
+			fmt.Fprintf(w, "  - %s\n", problem)
+		}
+		return
+	}
+	fmt.Fprintln(w, "\nVerification passed.")
+}
+
+// Run verifies the checksums, replays the stream export onto a copy of the
+// snapshot and checks the integrity of the result. The snapshot and the
+// export are never modified. The error reports a failure to run the checks,
+// the verification failures are the report problems.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	var report Report
+	files, err := streamFiles(cfg.StreamExport)
+	if err != nil {
+		return nil, err
+	}
+	report.Files = len(files)
+	if err := checkSnapshotChecksum(cfg.Snapshot, &report); err != nil {
+		return nil, err
+	}
+	if cfg.StreamExport != "" {
+		if err := checkExportChecksums(cfg.StreamExport, files, &report); err != nil {
+			return nil, err
+		}
+	}
+	if !report.OK() {
+		return &report, nil
+	}
+
+	work := cfg.Output
+	if work == "" {
+		f, err := os.CreateTemp("", "ha-verify-*.db")
+		if err != nil {
+			return nil, err
+		}
+		work = f.Name()
+		f.Close()
+		defer os.Remove(work)
+	}
+	if err := copyFile(cfg.Snapshot, work); err != nil {
+		return nil, err
+	}
+	db, err := sqlite.OpenFile(work)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if err := checkIntegrity(ctx, db, "snapshot", &report); err != nil {
+		return nil, err
+	}
+	if !report.OK() {
+		return &report, nil
+	}
+
+	report.SnapshotSequence = cfg.FromSequence
+	if report.SnapshotSequence == 0 {
+		report.SnapshotSequence = snapshotSequence(ctx, db)
+	}
+	for _, file := range files {
+		if err := replayFile(ctx, db, file, &report); err != nil {
+			return nil, err
+		}
+		if !report.OK() {
+			return &report, nil
+		}
+	}
+	if err := checkIntegrity(ctx, db, "replayed database", &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// streamFiles returns the exported stream files in replay order.
+func streamFiles(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".json", ".jsonl", ".ndjson":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	slices.Sort(files)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .jsonl stream files in %s", dir)
+	}
+	return files, nil
+}
+
+func checkSnapshotChecksum(snapshot string, report *Report) error {
+	data, err := os.ReadFile(snapshot + ".sha256")
+	if errors.Is(err, os.ErrNotExist) {
+		report.warn("no checksum for the snapshot (%s.sha256)", filepath.Base(snapshot))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	want, _, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	return checkChecksum(snapshot, want, report)
+}
+
+func checkExportChecksums(dir string, files []string, report *Report) error {
+	f, err := os.Open(filepath.Join(dir, ChecksumFile))
+	if errors.Is(err, os.ErrNotExist) {
+		report.warn("no %s in the stream export", ChecksumFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	listed := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok {
+			report.problem("invalid %s line %q", ChecksumFile, line)
+			continue
+		}
+		// sha256sum marks the files read in binary mode with *
+		name = strings.TrimPrefix(strings.TrimSpace(name), "*")
+		path := filepath.Join(dir, name)
+		listed[path] = true
+		if err := checkChecksum(path, sum, report); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !listed[file] {
+			report.warn("%s not listed in %s", filepath.Base(file), ChecksumFile)
+		}
+	}
+	return nil
+}
+
+func checkChecksum(path, want string, report *Report) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		report.problem("%s is missing", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, want) {
+		report.problem("checksum mismatch for %s: got %s, want %s", path, got, want)
+		return nil
+	}
+	report.Checksums++
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(in, header); err != nil || string(header) != "SQLite format 3\x00" {
+		return fmt.Errorf("%s is not a SQLite database", src)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func checkIntegrity(ctx context.Context, db *sql.DB, name string, report *Report) error {
+	rows, err := db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	var results []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			rows.Close()
+			return err
+		}
+		if result != "ok" {
+			results = append(results, result)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, result := range results {
+		report.problem("%s integrity: %s", name, result)
+	}
+
+	rows, err = db.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			table, parent string
+			rowid         sql.NullInt64
+			fkid          int64
+		)
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return err
+		}
+		report.problem("%s foreign key: row %d of %s references a missing %s row", name, rowid.Int64, table, parent)
+	}
+	return rows.Err()
+}
+
+// snapshotSequence returns the last stream sequence applied to the snapshot.
+func snapshotSequence(ctx context.Context, db *sql.DB) uint64 {
+	var seq sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT max(received_seq) FROM "+controlTableName).Scan(&seq); err != nil {
+		return 0
+	}
+	return uint64(seq.Int64)
+}
+
+func replayFile(ctx context.Context, db *sql.DB, file string, report *Report) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			position := fmt.Sprintf("%s:%d", filepath.Base(file), line)
+			if !replayMessage(ctx, db, position, data, report) {
+				return nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replayMessage applies a message, it returns false on a problem.
+func replayMessage(ctx context.Context, db *sql.DB, position string, data []byte, report *Report) bool {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		report.problem("%s: invalid message: %v", position, err)
+		return false
+	}
+	if len(msg.Data) == 0 {
+		msg.Data = data
+	}
+	var cs ha.ChangeSet
+	if err := json.Unmarshal(msg.Data, &cs); err != nil {
+		report.problem("%s: invalid changeset: %v", position, err)
+		return false
+	}
+	if err := changeset.Decode(&cs); err != nil {
+		report.problem("%s: invalid changeset: %v", position, err)
+		return false
+	}
+	report.Messages++
+	if msg.Sequence > 0 {
+		if msg.Sequence <= report.SnapshotSequence {
+			report.Skipped++
+			return true
+		}
+		switch {
+		case report.LastSequence == 0 && report.SnapshotSequence > 0 && msg.Sequence > report.SnapshotSequence+1:
+			report.warn("%s: sequences %d to %d between the snapshot and the export are missing or belong to other databases",
+				position, report.SnapshotSequence+1, msg.Sequence-1)
+		case report.LastSequence > 0 && msg.Sequence <= report.LastSequence:
+			report.problem("%s: sequence %d out of order after %d", position, msg.Sequence, report.LastSequence)
+			return false
+		case report.LastSequence > 0 && msg.Sequence > report.LastSequence+1:
+			report.warn("%s: sequences %d to %d are missing or belong to other databases", position, report.LastSequence+1, msg.Sequence-1)
+		}
+		if report.FirstSequence == 0 {
+			report.FirstSequence = msg.Sequence
+		}
+		report.LastSequence = msg.Sequence
+	}
+	if err := Apply(ctx, db, cs.Changes); err != nil {
+		report.problem("%s: %v", position, err)
+		return false
+	}
+	report.Applied++
+	report.Changes += len(cs.Changes)
+	return true
+}
+
+// Apply runs the changes in a transaction with the statements of the pk row
+// identification, falling back to the rowid for tables without primary key.
+func Apply(ctx context.Context, db *sql.DB, changes []ha.Change) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, change := range changes {
+		if change.Table == controlTableName {
+			continue
+		}
+		query, args := statement(change)
+		if query == "" {
+			continue
+		}
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("apply %s change to %s: %w", change.Operation, change.Table, err)
+		}
+		if change.Operation != "UPDATE" {
+			continue
+		}
+		// like the subscribers, an update of a missing row inserts it
+		if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+			change.Operation = "INSERT"
+			query, args = statement(change)
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return fmt.Errorf("apply %s change to %s: %w", change.Operation, change.Table, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func statement(change ha.Change) (string, []any) {
+	table := change.Table
+	if change.Database != "" {
+		table = change.Database + "." + table
+	}
+	switch change.Operation {
+	case "INSERT":
+		return fmt.Sprintf("REPLACE INTO %s (%s) VALUES (%s)", table, strings.Join(change.Columns, ", "), placeholders(len(change.NewValues))), change.NewValues
+	case "UPDATE":
+		set := make([]string, len(change.Columns))
+		for i, col := range change.Columns {
+			set[i] = col + " = ?"
+		}
+		return fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(set, ", "), where(change.PKColumnsNames())),
+			append(slices.Clone(change.NewValues), change.PKOldValues()...)
+	case "DELETE":
+		return fmt.Sprintf("DELETE FROM %s WHERE %s", table, where(change.PKColumnsNames())), change.PKOldValues()
+	case "SQL":
+		return change.Command, change.Args
+	}
+	return "", nil
+}
+
+func where(columns []string) string {
+	list := make([]string, len(columns))
+	for i, col := range columns {
+		list[i] = col + " = ?"
+	}
+	return strings.Join(list, " AND ")
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
@@ -0,0 +1,166 @@
+//go:build cgo
+
+package verify_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/litesql/ha/internal/verify"
+)
+
+// writeSnapshot creates a snapshot holding the row 1 of items, applied up to
+// the sequence 2.
+func writeSnapshot(t *testing.T, dir string) string {
+	t.Helper()
+	snapshot := filepath.Join(dir, "snapshot.db")
+	db, err := sql.Open("sqlite3", "file:"+snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, s := range []string{
+		"CREATE TABLE ha_stats(subject TEXT UNIQUE, received_seq INTEGER, updated_at DATETIME)",
+		"INSERT INTO ha_stats VALUES ('ha.snapshot', 2, CURRENT_TIMESTAMP)",
+		"CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT)",
+		"INSERT INTO items VALUES (1, 'a')",
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	return snapshot
+}
+
+func writeExport(t *testing.T, dir string, lines ...string) string {
+	t.Helper()
+	export := filepath.Join(dir, "export")
+	if err := os.Mkdir(export, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	if err := os.WriteFile(filepath.Join(export, "01.jsonl"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	sums := fmt.Sprintf("%s  01.jsonl\n", hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(filepath.Join(export, verify.ChecksumFile), []byte(sums), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return export
+}
+
+func message(seq int, changes string) string {
+	return fmt.Sprintf(`{"seq":%d,"subject":"ha.snapshot","data":{"node":"node1","changes":[%s]}}`, seq, changes)
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	snapshot := writeSnapshot(t, dir)
+	export := writeExport(t, dir,
+		message(2, `{"table":"items","operation":"INSERT","columns":["id","name"],"new_values":[1,"a"]}`),
+		message(3, `{"table":"items","operation":"INSERT","columns":["id","name"],"new_values":[2,"b"]}`),
+		// an update of a missing row inserts it
+		message(5, `{"table":"items","operation":"UPDATE","columns":["id","name"],"pk_columns":["id"],"old_values":[3,"c"],"new_values":[3,"d"]}`),
+		// a changeset printed by nats sub --raw
+		`{"node":"node1","changes":[{"table":"items","operation":"DELETE","columns":["id","name"],"pk_columns":["id"],"old_values":[1,"a"]}]}`,
+	)
+	output := filepath.Join(dir, "replayed.db")
+
+	report, err := verify.Run(ctx, verify.Config{Snapshot: snapshot, StreamExport: export, Output: output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("problems %v", report.Problems)
+	}
+	if report.SnapshotSequence != 2 || report.Messages != 4 || report.Skipped != 1 || report.Applied != 3 {
+		t.Errorf("got %+v, want the message 2 skipped and the 3 others applied", report)
+	}
+	if report.FirstSequence != 3 || report.LastSequence != 5 || report.Checksums != 1 {
+		t.Errorf("got %+v, want the sequences 3 to 5 and the export checksum", report)
+	}
+	// the snapshot has no checksum, the sequence 4 is missing
+	if len(report.Warnings) != 2 {
+		t.Errorf("got warnings %v, want the missing checksum and sequence", report.Warnings)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var names string
+	if err := db.QueryRow("SELECT group_concat(name, ',' ORDER BY id) FROM items").Scan(&names); err != nil {
+		t.Fatal(err)
+	}
+	if names != "b,d" {
+		t.Errorf("got the rows %q, want b,d", names)
+	}
+}
+
+func TestRunProblems(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		lines   []string
+		corrupt bool
+		problem string
+	}{
+		{
+			name:    "out of order",
+			lines:   []string{message(4, ""), message(3, "")},
+			problem: "out of order",
+		},
+		{
+			name:    "invalid change",
+			lines:   []string{message(3, `{"table":"missing","operation":"INSERT","columns":["id"],"new_values":[1]}`)},
+			problem: "no such table",
+		},
+		{
+			name:    "checksum mismatch",
+			lines:   []string{message(3, "")},
+			corrupt: true,
+			problem: "checksum mismatch",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			snapshot := writeSnapshot(t, dir)
+			export := writeExport(t, dir, tt.lines...)
+			if tt.corrupt {
+				f, err := os.OpenFile(filepath.Join(export, "01.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteString("\n")
+				f.Close()
+			}
+			report, err := verify.Run(ctx, verify.Config{Snapshot: snapshot, StreamExport: export})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.OK() || !strings.Contains(strings.Join(report.Problems, "\n"), tt.problem) {
+				t.Errorf("got problems %v, want %q", report.Problems, tt.problem)
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	notDB := filepath.Join(dir, "snapshot.db")
+	if err := os.WriteFile(notDB, []byte("not a database, long enough"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify.Run(ctx, verify.Config{Snapshot: notDB}); err == nil {
+		t.Error("a file that is not a SQLite database was verified")
+	}
+}
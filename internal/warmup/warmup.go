@@ -0,0 +1,195 @@
+// Package warmup runs a list of queries once the node caught up with the
+// replication stream and before it reports ready, so the first clients after
+// a restart do not pay for the cold SQLite page caches.
+package warmup
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// maxConns bounds the pooled connections warmed per database, each SQLite
+// connection has its own page cache.
+const maxConns = 16
+
+type Query struct {
+	// DB is the database id, the default database when empty.
+	DB  string
+	SQL string
+}
+
+// Load reads one query per line. A "-- db: <id>" line selects the database
+// of the following queries, the other comments and blank lines are skipped.
+func Load(path string) ([]Query, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		queries []Query
+		db      string
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if comment, ok := strings.CutPrefix(line, "--"); ok {
+			if id, ok := strings.CutPrefix(strings.TrimSpace(comment), "db:"); ok {
+				db = strings.TrimSpace(id)
+			}
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimSuffix(line, ";"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !sqlite.IsQuery(line) {
+			return nil, fmt.Errorf("%s: warm-up statements must be read only: %q", path, line)
+		}
+		queries = append(queries, Query{DB: db, SQL: line})
+	}
+	return queries, scanner.Err()
+}
+
+// Warmer reports the node not ready until the warm-up queries ran or the
+// timeout elapsed.
+type Warmer struct {
+	queries []Query
+	timeout time.Duration
+
+	done atomic.Bool
+}
+
+func New(queries []Query, timeout time.Duration) *Warmer {
+	w := &Warmer{
+		queries: queries,
+		timeout: timeout,
+	}
+	w.done.Store(len(queries) == 0)
+	return w
+}
+
+// Ready fails while the warm-up is running.
+func (w *Warmer) Ready() error {
+	if !w.done.Load() {
+		return errors.New("warming up")
+	}
+	return nil
+}
+
+// Run waits for the databases to apply the pending replication messages and
+// runs the queries on the pooled connections of each database.
+func (w *Warmer) Run(ctx context.Context) {
+	defer w.done.Store(true)
+	if len(w.queries) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	start := time.Now()
+	if err := waitCaughtUp(ctx); err != nil {
+		slog.Warn("warm-up started before the replication caught up", "error", err)
+	}
+	byDB := make(map[string][]string)
+	for _, q := range w.queries {
+		byDB[q.DB] = append(byDB[q.DB], q.SQL)
+	}
+	var wg sync.WaitGroup
+	for id, queries := range byDB {
+		wg.Go(func() {
+			if err := warm(ctx, id, queries); err != nil {
+				slog.Warn("warm-up failed", "id", id, "error", err)
+			}
+		})
+	}
+	wg.Wait()
+	slog.Info("warm-up finished", "queries", len(w.queries), "duration", time.Since(start).Truncate(time.Millisecond))
+}
+
+func waitCaughtUp(ctx context.Context) error {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := false
+		for _, h := range sqlite.DatabasesHealth(ctx) {
+			if h.Pending > 0 {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func warm(ctx context.Context, id string, queries []string) error {
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return err
+	}
+	n := db.Stats().MaxOpenConnections
+	if n <= 0 || n > maxConns {
+		n = maxConns
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errs   []error
+		failed = make(map[string]bool)
+	)
+	// the connections are held together, so each query warms a different
+	// connection of the pool
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for range n {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		wg.Go(func() {
+			for _, query := range queries {
+				rows, err := conn.QueryContext(ctx, query)
+				if err == nil {
+					for rows.Next() {
+					}
+					err = errors.Join(rows.Err(), rows.Close())
+				}
+				if err != nil {
+					mu.Lock()
+					if !failed[query] {
+						failed[query] = true
+						errs = append(errs, fmt.Errorf("%q: %w", query, err))
+					}
+					mu.Unlock()
+				}
+			}
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package warmup_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/litesql/ha/internal/warmup"
+)
+
+func writeFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "warmup.sql")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	queries, err := warmup.Load(writeFile(t,
+		"-- the hot tables",
+		"SELECT count(*) FROM items;",
+		"",
+		"# skipped",
+		"-- db: other.db",
+		"SELECT * FROM orders WHERE id > 0",
+		"EXPLAIN QUERY PLAN SELECT * FROM orders;",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []warmup.Query{
+		{SQL: "SELECT count(*) FROM items"},
+		{DB: "other.db", SQL: "SELECT * FROM orders WHERE id > 0"},
+		{DB: "other.db", SQL: "EXPLAIN QUERY PLAN SELECT * FROM orders"},
+	}
+	if !slices.Equal(queries, want) {
+		t.Errorf("got %+v, want %+v", queries, want)
+	}
+
+	if _, err := warmup.Load(writeFile(t, "SELECT 1", "DELETE FROM items")); err == nil {
+		t.Error("a DELETE was loaded as a warm-up query")
+	}
+	if _, err := warmup.Load(filepath.Join(t.TempDir(), "missing.sql")); err == nil {
+		t.Error("a missing file was loaded")
+	}
+}
+
+func TestReady(t *testing.T) {
+	if err := warmup.New(nil, time.Second).Ready(); err != nil {
+		t.Errorf("ready without warm-up queries: %v", err)
+	}
+	w := warmup.New([]warmup.Query{{DB: "missing.db", SQL: "SELECT 1"}}, time.Second)
+	if err := w.Ready(); err == nil {
+		t.Error("ready before the warm-up")
+	}
+	// a failed warm-up does not keep the node unready
+	w.Run(context.Background())
+	if err := w.Ready(); err != nil {
+		t.Errorf("ready after the warm-up: %v", err)
+	}
+}
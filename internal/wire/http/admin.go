@@ -0,0 +1,211 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/handoff"
+	"github.com/litesql/ha/internal/streamadmin"
+)
+
+// DecommissionHandler retires the node: decommission stops its writes,
+// publishes the async outbox and takes the final snapshots, then the node
+// shuts down and removes its replication consumers.
+func DecommissionHandler(adminToken string, decommission func(context.Context) (map[string]uint64, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedAdmin(w, r, adminToken) {
+			return
+		}
+		snapshots, err := decommission(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "decommission", "error", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":    "decommissioning",
+			"snapshots": snapshots,
+		})
+	}
+}
+
+// ReloadHandler reads the configuration again and applies the settings
+// changeable at runtime, like SIGHUP. It returns the flags changed.
+func ReloadHandler(adminToken string, reload func() ([]string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedAdmin(w, r, adminToken) {
+			return
+		}
+		changed, err := reload()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "reload", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"changed": append(make([]string, 0), changed...),
+		})
+	}
+}
+
+// HandoffHandler lists the replication positions recorded by the nodes for
+// their restart.
+func HandoffHandler(adminToken string, h *handoff.Handoff) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedAdmin(w, r, adminToken) {
+			return
+		}
+		if h == nil {
+			http.Error(w, "the restart handoff is disabled, inform flag --handoff-bucket at startup", http.StatusNotFound)
+			return
+		}
+		list, err := h.List(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "handoff records", "error", err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		writeJSON(w, map[string]any{
+			"nodes": list,
+		})
+	}
+}
+
+func authorizedAdmin(w http.ResponseWriter, r *http.Request, adminToken string) bool {
+	if adminToken != "" && r.Header.Get("Authorization") != adminToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// adminHandler checks the admin token and that the replication streams are
+// managed by the node before calling fn.
+func adminHandler(adminToken string, admin *streamadmin.Admin, fn func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedAdmin(w, r, adminToken) {
+			return
+		}
+		if admin == nil {
+			http.Error(w, "replication is disabled", http.StatusNotFound)
+			return
+		}
+		if err := fn(w, r); err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, streamadmin.ErrUnknownStream), errors.Is(err, jetstream.ErrStreamNotFound),
+				errors.Is(err, jetstream.ErrConsumerNotFound):
+				status = http.StatusNotFound
+			case errors.Is(err, streamadmin.ErrNotApplied):
+				status = http.StatusConflict
+			}
+			slog.ErrorContext(r.Context(), "replication admin", "error", err, "stream", r.PathValue("stream"))
+			http.Error(w, err.Error(), status)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// ReplicationStreamsHandler lists the replication streams of the node
+// databases with their config and storage usage.
+func ReplicationStreamsHandler(adminToken string, admin *streamadmin.Admin) http.HandlerFunc {
+	return adminHandler(adminToken, admin, func(w http.ResponseWriter, r *http.Request) error {
+		list, err := admin.Streams(r.Context())
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, map[string]any{
+			"streams": list,
+		})
+	})
+}
+
+func ReplicationStreamHandler(adminToken string, admin *streamadmin.Admin) http.HandlerFunc {
+	return adminHandler(adminToken, admin, func(w http.ResponseWriter, r *http.Request) error {
+		stream, err := admin.Stream(r.Context(), r.PathValue("stream"))
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, stream)
+	})
+}
+
+// UpdateReplicationStreamHandler changes the retention of the stream, the
+// body has the max_age, max_bytes and max_msgs to change.
+func UpdateReplicationStreamHandler(adminToken string, admin *streamadmin.Admin) http.HandlerFunc {
+	return adminHandler(adminToken, admin, func(w http.ResponseWriter, r *http.Request) error {
+		var update streamadmin.Update
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		stream, err := admin.Update(r.Context(), r.PathValue("stream"), update)
+		if err != nil {
+			return err
+		}
+		slog.WarnContext(r.Context(), "replication stream updated", "stream", stream.Name, "max_age", stream.MaxAge,
+			"max_bytes", stream.MaxBytes, "max_msgs", stream.MaxMsgs)
+		return writeJSON(w, stream)
+	})
+}
+
+// PurgeReplicationStreamHandler removes the messages of the stream up to the
+// sequence parameter, refused while a consumer has not acknowledged them
+// unless force=true.
+func PurgeReplicationStreamHandler(adminToken string, admin *streamadmin.Admin) http.HandlerFunc {
+	return adminHandler(adminToken, admin, func(w http.ResponseWriter, r *http.Request) error {
+		sequence, err := strconv.ParseUint(r.URL.Query().Get("sequence"), 10, 64)
+		if err != nil || sequence == 0 {
+			http.Error(w, "invalid sequence", http.StatusBadRequest)
+			return nil
+		}
+		name := r.PathValue("stream")
+		purged, err := admin.Purge(r.Context(), name, sequence, r.URL.Query().Get("force") == "true")
+		if err != nil {
+			return err
+		}
+		slog.WarnContext(r.Context(), "replication stream purged", "stream", name, "sequence", sequence, "purged", purged)
+		return writeJSON(w, map[string]any{
+			"stream": name,
+			"purged": purged,
+		})
+	})
+}
+
+func ReplicationConsumersHandler(adminToken string, admin *streamadmin.Admin) http.HandlerFunc {
+	return adminHandler(adminToken, admin, func(w http.ResponseWriter, r *http.Request) error {
+		list, err := admin.Consumers(r.Context(), r.PathValue("stream"))
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, map[string]any{
+			"consumers": list,
+		})
+	})
+}
+
+func DeleteReplicationConsumerHandler(adminToken string, admin *streamadmin.Admin) http.HandlerFunc {
+	return adminHandler(adminToken, admin, func(w http.ResponseWriter, r *http.Request) error {
+		name, consumer := r.PathValue("stream"), r.PathValue("name")
+		if err := admin.DeleteConsumer(r.Context(), name, consumer); err != nil {
+			return fmt.Errorf("delete consumer %q: %w", consumer, err)
+		}
+		slog.WarnContext(r.Context(), "replication consumer deleted", "stream", name, "consumer", consumer)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/litesql/ha/internal/flowcontrol"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func ApplyStatusHandler(c *flowcontrol.Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	}
+}
+
+// PauseApplyHandler stops applying the replicated changesets of the
+// database, of every database without id, until resumed.
+func PauseApplyHandler(c *flowcontrol.Controller) http.HandlerFunc {
+	return applyHandler(c, c.Pause)
+}
+
+func ResumeApplyHandler(c *flowcontrol.Controller) http.HandlerFunc {
+	return applyHandler(c, c.Resume)
+}
+
+func applyHandler(c *flowcontrol.Controller, fn func(id string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id != "" {
+			if _, err := sqlite.DB(id); err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+		}
+		fn(id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	}
+}
+
+// ApplyWindowsHandler lists the scheduled windows pausing or throttling the
+// apply.
+func ApplyWindowsHandler(adminToken string, c *flowcontrol.Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedAdmin(w, r, adminToken) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"windows": c.Status().Windows,
+		})
+	}
+}
+
+// SetApplyWindowsHandler replaces the scheduled windows with the JSON array
+// of the request body. They are not persisted, a restart uses --apply-windows.
+func SetApplyWindowsHandler(adminToken string, c *flowcontrol.Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedAdmin(w, r, adminToken) {
+			return
+		}
+		var windows []flowcontrol.Window
+		if err := json.NewDecoder(r.Body).Decode(&windows); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.SetWindows(windows)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"windows": c.Status().Windows,
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/timetravel"
+)
+
+type asOfRequest struct {
+	Timestamp time.Time `json:"timestamp"`
+	Tables    []string  `json:"tables"`
+}
+
+// AsOfHandler runs a query on the database as it was at the timestamp of the
+// request body, reconstructed from a snapshot and the replication stream.
+// The body is a query request plus the timestamp and the optional tables to
+// reconstruct.
+func AsOfHandler(asOf func(ctx context.Context, id string, req timetravel.Request) (*timetravel.Result, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var (
+			req   asOfRequest
+			query sqlite.Request
+		)
+		if err := errors.Join(json.Unmarshal(body, &req), json.Unmarshal(body, &query)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if query.Sql == "" {
+			http.Error(w, "sql is required", http.StatusBadRequest)
+			return
+		}
+		query, page, err := sqlite.Paginate(query, maxRows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := r.PathValue("id")
+		res, err := asOf(r.Context(), id, timetravel.Request{
+			Time:   req.Timestamp,
+			Tables: req.Tables,
+			Query:  query,
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "as of query", "error", err, "id", id, "timestamp", req.Timestamp)
+			http.Error(w, err.Error(), asOfStatus(err))
+			return
+		}
+		res.NextCursor = page.Apply(res.Response)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func asOfStatus(err error) int {
+	if errors.Is(err, timetravel.ErrInvalidTime) {
+		return http.StatusBadRequest
+	}
+	return rewindStatus(err)
+}
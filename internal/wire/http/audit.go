@@ -0,0 +1,90 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/litesql/ha/internal/audit"
+)
+
+const (
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+// AuditHandler searches the audit log, the most recent entries first. The
+// query parameters database, user, protocol, node, q (part of the statement),
+// since and until (RFC 3339), failed and limit filter the entries, before
+// returns the page after next_before.
+func AuditHandler(log *audit.Log, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedAdmin(w, r, adminToken) {
+			return
+		}
+		q := r.URL.Query()
+		f := audit.Filter{
+			Database: q.Get("database"),
+			User:     q.Get("user"),
+			Protocol: q.Get("protocol"),
+			Node:     q.Get("node"),
+			SQL:      q.Get("q"),
+			Limit:    auditDefaultLimit,
+		}
+		var err error
+		if v := q.Get("since"); v != "" {
+			if f.Since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				http.Error(w, "invalid since, use a RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("until"); v != "" {
+			if f.Until, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				http.Error(w, "invalid until, use a RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("failed"); v != "" {
+			if f.Failed, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "invalid failed, use true or false", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("before"); v != "" {
+			if f.Before, err = strconv.ParseInt(v, 10, 64); err != nil || f.Before <= 0 {
+				http.Error(w, "invalid before, use the next_before of the previous page", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+				http.Error(w, "invalid limit, use a positive number", http.StatusBadRequest)
+				return
+			}
+			f.Limit = min(f.Limit, auditMaxLimit)
+		}
+		// one more entry tells whether there is a next page
+		f.Limit++
+		entries, err := log.Search(r.Context(), f)
+		if errors.Is(err, audit.ErrDisabled) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := struct {
+			Entries    []audit.Entry `json:"entries"`
+			NextBefore int64         `json:"next_before,omitempty"`
+		}{Entries: entries}
+		if len(entries) == f.Limit {
+			res.Entries = entries[:f.Limit-1]
+			res.NextBefore = res.Entries[len(res.Entries)-1].ID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
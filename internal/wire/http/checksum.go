@@ -0,0 +1,59 @@
+package http
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/litesql/ha/internal/consistency"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+const (
+	defaultRefreshWait = 5 * time.Second
+	maxRefreshWait     = time.Minute
+)
+
+// ConsistencyHandler compares the checksums of the tables of the database
+// with the ones published by the other nodes. With the refresh query
+// parameter, the checksums are computed again on this node and the peers,
+// waiting up to the timeout parameter for their answer.
+func ConsistencyHandler(checker *consistency.Checker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := cmp.Or(r.PathValue("id"), sqlite.DefaultDatabase())
+		if _, err := sqlite.DB(id); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		_, err := checker.Comparison(id)
+		switch {
+		case r.URL.Query().Get("refresh") == "true":
+			timeout := defaultRefreshWait
+			if v := r.URL.Query().Get("timeout"); v != "" {
+				timeout, err = time.ParseDuration(v)
+				if err != nil || timeout <= 0 {
+					http.Error(w, "timeout must be a positive duration like 10s", http.StatusBadRequest)
+					return
+				}
+				timeout = min(timeout, maxRefreshWait)
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			err = checker.Refresh(ctx, id)
+		case err != nil:
+			// nothing computed yet, the peers are compared on their next report
+			_, err = checker.Check(r.Context(), id)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		comparison, err := checker.Comparison(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, comparison)
+	}
+}
@@ -0,0 +1,99 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/litesql/ha/internal/clusterconfig"
+)
+
+const configDisabled = "cluster config is disabled, inform flag --config-bucket at startup"
+
+const maxConfigValue = 1 << 20
+
+// ConfigHandler serves the cluster config. GET /config lists the entries
+// with the optional prefix query parameter, PUT /config/{key} stores the JSON
+// body, only replacing the revision of the If-Match header when informed, and
+// DELETE /config/{key} removes the key. Every node serves the same values.
+func ConfigHandler(store *clusterconfig.Store, adminToken string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"entries": store.List(r.URL.Query().Get("prefix")),
+		})
+	})
+	mux.HandleFunc("GET /config/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := store.Get(r.PathValue("key"))
+		if !ok {
+			http.Error(w, clusterconfig.ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", strconv.FormatUint(entry.Revision, 10))
+		json.NewEncoder(w).Encode(entry)
+	})
+	mux.HandleFunc("PUT /config/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		var revision uint64
+		if match := r.Header.Get("If-Match"); match != "" {
+			var err error
+			revision, err = strconv.ParseUint(match, 10, 64)
+			if err != nil {
+				http.Error(w, "If-Match must be the revision of the entry", http.StatusBadRequest)
+				return
+			}
+		}
+		value, err := io.ReadAll(io.LimitReader(r.Body, maxConfigValue+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(value) > maxConfigValue {
+			http.Error(w, fmt.Sprintf("config value exceeds %d bytes", maxConfigValue), http.StatusRequestEntityTooLarge)
+			return
+		}
+		entry, err := store.Put(r.Context(), r.PathValue("key"), value, revision)
+		if err != nil {
+			http.Error(w, err.Error(), configErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", strconv.FormatUint(entry.Revision, 10))
+		json.NewEncoder(w).Encode(entry)
+	})
+	mux.HandleFunc("DELETE /config/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		if err := store.Delete(r.Context(), r.PathValue("key")); err != nil {
+			http.Error(w, err.Error(), configErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			http.Error(w, configDisabled, http.StatusNotFound)
+			return
+		}
+		if adminToken != "" && r.Header.Get("Authorization") != adminToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func configErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, clusterconfig.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, clusterconfig.ErrConflict):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, clusterconfig.ErrInvalidKey), errors.Is(err, clusterconfig.ErrInvalidValue):
+		return http.StatusBadRequest
+	default:
+		return errorStatus(err)
+	}
+}
@@ -0,0 +1,38 @@
+package http
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// minSeq returns the stream sequence the read must see, from the X-HA-Min-Seq
+// header or the min_seq parameter, 0 when not given.
+func minSeq(r *http.Request) (uint64, error) {
+	v := cmp.Or(r.Header.Get("X-HA-Min-Seq"), r.URL.Query().Get("min_seq"))
+	if v == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid min_seq %q", v)
+	}
+	return seq, nil
+}
+
+// writeSeq sets the X-HA-Seq header to the sequence published by the
+// statements changing the database, the min_seq of the next reads.
+func writeSeq(w http.ResponseWriter, dbID string, queries []sqlite.Request) {
+	for _, query := range queries {
+		if sqlite.IsQuery(query.Sql) {
+			continue
+		}
+		if seq := sqlite.PublishedSeq(dbID); seq > 0 {
+			w.Header().Set("X-HA-Seq", strconv.FormatUint(seq, 10))
+		}
+		return
+	}
+}
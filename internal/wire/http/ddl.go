@@ -0,0 +1,35 @@
+package http
+
+import (
+	"cmp"
+	"net/http"
+
+	"github.com/litesql/ha/internal/ddlconflict"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// DDLConflictsHandler reports the divergence of the schema of the database
+// from the other nodes: the replicated DDL statements that conflicted with it,
+// and the one the replication is halted on.
+func DDLConflictsHandler(guard *ddlconflict.Guard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		db, err := sqlite.DB(id)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		conflicts, err := ddlconflict.List(r.Context(), db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := map[string]any{
+			"conflicts": conflicts,
+		}
+		if halted, ok := guard.Halted(cmp.Or(id, sqlite.DefaultDatabase())); ok {
+			res["halted"] = halted
+		}
+		writeJSON(w, res)
+	}
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// DDLHandler applies the DDL script of the request body in a single
+// transaction, replicated as one changeset. The body is the SQL script, or a
+// JSON object with the script in its sql field.
+func DDLHandler(disableDDLSync bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if disableDDLSync {
+			http.Error(w, "DDL sync is disabled by flag --disable-ddl-sync, the script would only change this node", http.StatusConflict)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		script := string(body)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var req sqlite.Request
+			if err := json.Unmarshal(body, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			script = req.Sql
+		}
+		statements, err := sqlite.ApplyDDL(r.Context(), r.PathValue("id"), script)
+		if err != nil {
+			status := errorStatus(err)
+			if errors.Is(err, sqlite.ErrNotDDL) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{
+			"statements": statements,
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package http
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	runtimepprof "runtime/pprof"
+	"time"
+)
+
+// DebugHandler serves pprof, expvar and dump endpoints under /debug/ for
+// requests with the admin token in the Authorization header.
+func DebugHandler(adminToken, dumpDir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("POST /debug/dump/{profile}", dumpHandler(dumpDir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != adminToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func dumpHandler(dumpDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("profile")
+		var debug int
+		switch name {
+		case "goroutine":
+			debug = 2
+		case "heap", "allocs", "block", "mutex", "threadcreate":
+		default:
+			http.Error(w, fmt.Sprintf("invalid profile %q. Valid values: goroutine, heap, allocs, block, mutex, threadcreate", name), http.StatusBadRequest)
+			return
+		}
+		filename := filepath.Join(dumpDir, fmt.Sprintf("ha-%s-%s.pprof", name, time.Now().UTC().Format("20060102T150405")))
+		if debug > 0 {
+			filename = filename[:len(filename)-len(".pprof")] + ".txt"
+		}
+		f, err := os.Create(filename)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		if err := runtimepprof.Lookup(name).WriteTo(f, debug); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"file": filename,
+		})
+	}
+}
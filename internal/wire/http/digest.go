@@ -0,0 +1,50 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// resultDigest returns the FNV-1a hash of the columns and rows of the
+// results. The same rows read in the same order have the same digest on
+// every node.
+func resultDigest(results []*sqlite.Response) string {
+	h := fnv.New64a()
+	enc := json.NewEncoder(h)
+	for _, res := range results {
+		enc.Encode(res.Columns)
+		enc.Encode(res.Rows)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// writeDigest sets the result digest as the ETag and the sequence of the
+// last replication message applied to the database, when the client asked
+// for them with digest=true or If-None-Match. It answers 304 Not Modified
+// without the rows when If-None-Match has the digest, and reports whether
+// the response was written.
+func writeDigest(w http.ResponseWriter, r *http.Request, dbID string, results []*sqlite.Response) bool {
+	match := r.Header.Get("If-None-Match")
+	if match == "" && r.URL.Query().Get("digest") != "true" {
+		return false
+	}
+	etag := strconv.Quote(resultDigest(results))
+	w.Header().Set("ETag", etag)
+	if seq, err := sqlite.AppliedSeq(dbID); err == nil {
+		w.Header().Set("X-Applied-Seq", strconv.FormatUint(seq, 10))
+	}
+	for tag := range strings.SplitSeq(match, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
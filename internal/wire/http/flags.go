@@ -0,0 +1,139 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+const (
+	defaultFlagsWait = 30 * time.Second
+	maxFlagsWait     = 5 * time.Minute
+	flagsKeepAlive   = 15 * time.Second
+)
+
+type flagsResponse struct {
+	Flags   []sqlite.Flag `json:"flags"`
+	Version uint64        `json:"version"`
+}
+
+// FlagsHandler lists the feature flags and the version to watch for changes.
+func FlagsHandler(w http.ResponseWriter, r *http.Request) {
+	list, version := sqlite.Flags()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flagsResponse{Flags: list, Version: version})
+}
+
+func FlagHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	list, _ := sqlite.Flags()
+	for _, flag := range list {
+		if flag.Name == name {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(flag)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("flag %q %v", name, sqlite.ErrNotFound), http.StatusNotFound)
+}
+
+// SetFlagHandler creates or replaces the flag with the JSON body, the name
+// comes from the path.
+func SetFlagHandler(w http.ResponseWriter, r *http.Request) {
+	flag := sqlite.Flag{Rollout: 100}
+	if err := json.NewDecoder(r.Body).Decode(&flag); err != nil {
+		http.Error(w, fmt.Sprintf("invalid flag: %v", err), http.StatusBadRequest)
+		return
+	}
+	flag.Name = r.PathValue("name")
+	flag, err := sqlite.SetFlag(r.Context(), flag)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flag)
+}
+
+func DeleteFlagHandler(w http.ResponseWriter, r *http.Request) {
+	if err := sqlite.DeleteFlag(r.Context(), r.PathValue("name")); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WatchFlagsHandler waits for the flags to change from the version query
+// parameter and returns the new list, or 304 when the timeout query parameter
+// elapses first. With Accept: text/event-stream the list is streamed as
+// server-sent events on every change instead.
+func WatchFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	var version uint64
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		version, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "version must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamFlags(w, r, version)
+		return
+	}
+	timeout := defaultFlagsWait
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		var err error
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			http.Error(w, "timeout must be a positive duration like 30s", http.StatusBadRequest)
+			return
+		}
+		timeout = min(timeout, maxFlagsWait)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	if sqlite.WaitFlags(ctx, version) == version {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	FlagsHandler(w, r)
+}
+
+func streamFlags(w http.ResponseWriter, r *http.Request, version uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), flagsKeepAlive)
+		current := sqlite.WaitFlags(ctx, version)
+		cancel()
+		if r.Context().Err() != nil {
+			return
+		}
+		if current == version {
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			continue
+		}
+		list, current := sqlite.Flags()
+		data, _ := json.Marshal(flagsResponse{Flags: list, Version: current})
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: flags\ndata: %s\n\n", current, data); err != nil {
+			return
+		}
+		flusher.Flush()
+		version = current
+	}
+}
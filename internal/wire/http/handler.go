@@ -1,6 +1,8 @@
 package http
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -16,18 +19,39 @@ import (
 	"github.com/litesql/go-ha"
 	haconnect "github.com/litesql/go-ha/connect"
 
+	"github.com/litesql/ha/internal/accesslog"
+	"github.com/litesql/ha/internal/audit"
+	"github.com/litesql/ha/internal/querylog"
+	"github.com/litesql/ha/internal/session"
 	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/txlimit"
 )
 
 func DatabasesHandler(w http.ResponseWriter, r *http.Request) {
 	dbs := sqlite.Databases()
+	slices.Sort(dbs)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string][]string{
+	json.NewEncoder(w).Encode(map[string]any{
 		"databases": dbs,
+		"default":   sqlite.DefaultDatabase(),
+	})
+}
+
+// DefaultDatabaseHandler makes the database the default one of the node,
+// used by the requests without a database id.
+func DefaultDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := sqlite.SetDefaultDatabase(id); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"default": id,
 	})
 }
 
-func CreateDatabaseHandler(createDatabaseDir string, memDB bool, defaultDSNOpts string, fromLatestSnapshot bool, deliverPolicy string, maxConns int, proxiedConfig sqlite.ProxiedDBConfig, opts ...ha.Option) http.HandlerFunc {
+func CreateDatabaseHandler(defaultDSNOpts string, cfg sqlite.LoadConfig) http.HandlerFunc {
 	type request struct {
 		DSN string `json:"dsn"`
 	}
@@ -42,30 +66,30 @@ func CreateDatabaseHandler(createDatabaseDir string, memDB bool, defaultDSNOpts
 			http.Error(w, "DSN is required", http.StatusBadRequest)
 			return
 		}
-		if !memDB && createDatabaseDir == "" {
+		if !cfg.MemDB && cfg.Dir == "" {
 			http.Error(w, "create database is disabled, inform flag --create-db-dir at startup", http.StatusInternalServerError)
 			return
 		}
+		if name, _, _ := strings.Cut(req.DSN, "?"); !filepath.IsLocal(name) {
+			http.Error(w, "DSN must be a file name relative to the database directory", http.StatusBadRequest)
+			return
+		}
 
-		dsn := fmt.Sprintf("file:%s", filepath.Join(createDatabaseDir, req.DSN))
+		dsn := fmt.Sprintf("file:%s", filepath.Join(cfg.Dir, req.DSN))
 		if !strings.Contains(dsn, "?") {
 			dsn += "?" + defaultDSNOpts
 		}
 
-		err = sqlite.Load(r.Context(), dsn, sqlite.LoadConfig{
-			Dir:                createDatabaseDir,
-			MemDB:              memDB,
-			FromLatestSnapshot: fromLatestSnapshot,
-			DeliverPolicy:      deliverPolicy,
-			MaxConns:           maxConns,
-			ProxiedDBConfig:    proxiedConfig,
-			Options:            opts,
-		})
+		err = sqlite.Load(r.Context(), dsn, cfg)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err))
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"id": sqlite.IdFromDSN(dsn),
+		})
 	}
 }
 
@@ -74,7 +98,7 @@ func DropDatabaseHandler() http.HandlerFunc {
 		id := r.PathValue("id")
 		dbfile, err := sqlite.Drop(r.Context(), id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err))
 			return
 		}
 		if dbfile != "" {
@@ -89,6 +113,104 @@ func DropDatabaseHandler() http.HandlerFunc {
 	}
 }
 
+// statusClientClosedRequest is returned for the canceled statements.
+const statusClientClosedRequest = 499
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, sqlite.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sqlite.ErrAlreadyAdded), errors.Is(err, sqlite.ErrDropDefaultDB), errors.Is(err, sqlite.ErrRunning),
+		errors.Is(err, sqlite.ErrMigrationConflict), errors.Is(err, sqlite.ErrDDLSyncDisabled), errors.Is(err, sqlite.ErrDecommissioning):
+		return http.StatusConflict
+	case errors.Is(err, sqlite.ErrMissingParameter), errors.Is(err, sqlite.ErrInvalidFlag), errors.Is(err, sqlite.ErrLintRejected),
+		errors.Is(err, sqlite.ErrCrossDatabase):
+		return http.StatusBadRequest
+	case errors.Is(err, sqlite.ErrReadOnly), errors.Is(err, sqlite.ErrQueryRejected):
+		return http.StatusForbidden
+	case errors.Is(err, txlimit.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, sqlite.ErrSeqNotApplied):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ReadOnlyHandler sets the database read-only, the request body is a JSON
+// boolean.
+func ReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	var readOnly bool
+	if err := json.NewDecoder(r.Body).Decode(&readOnly); err != nil {
+		http.Error(w, fmt.Sprintf("the body must be true or false: %v", err), http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	if err := sqlite.SetReadOnly(r.Context(), id, readOnly); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":        id,
+		"read_only": readOnly,
+	})
+}
+
+type migrateRequest struct {
+	Migrations []sqlite.Migration `json:"migrations"`
+}
+
+// MigrateHandler applies the versioned migrations of the request body that
+// the database did not record yet.
+func MigrateHandler(w http.ResponseWriter, r *http.Request) {
+	var req migrateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid migrations: %v", err), http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	res, err := sqlite.Migrate(r.Context(), id, req.Migrations)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// MigrationsHandler lists the migrations recorded by the database, compare
+// the lists of the nodes to check they converged.
+func MigrationsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := sqlite.Migrations(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	var version int64
+	if len(list) > 0 {
+		version = list[len(list)-1].Version
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version":    version,
+		"migrations": list,
+	})
+}
+
+// maxRows bounds the rows returned by a query, 0 is unlimited.
+var maxRows int
+
+// SetMaxRows sets the maximum number of rows returned by a query of the HTTP
+// API, the next rows are read with the cursor of the response.
+func SetMaxRows(n int) {
+	maxRows = max(n, 0)
+}
+
 type QueriesRequest struct {
 	Queries []sqlite.Request
 	slice   bool
@@ -134,15 +256,79 @@ func QueryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	lintPolicy, err := lintPolicyOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	ctx := r.Context()
+	warnings, err := checkQueries(ctx, dbID, req.Queries, lintPolicy)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	seq, err := minSeq(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := sqlite.WaitApplied(ctx, dbID, seq); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	pages := make([]*sqlite.Page, len(req.Queries))
+	for i, query := range req.Queries {
+		if req.Queries[i], pages[i], err = sqlite.Paginate(query, maxRows); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 	if r.URL.Query().Get("local") == "true" {
 		ctx = ha.ContextLocalDB(ctx, true)
 	}
+	if r.URL.Query().Get("meta") == "full" {
+		ctx = sqlite.ContextColumnMeta(ctx, true)
+	}
+	if r.URL.Query().Get("types") == "true" {
+		ctx = sqlite.ContextTypedValues(ctx, true)
+	}
+	if v := r.URL.Query().Get("begin"); v != "" {
+		mode, err := sqlite.ParseBeginMode(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx = sqlite.ContextBeginMode(ctx, mode)
+	}
+	var attach []string
+	if v := r.URL.Query().Get("attach"); v != "" {
+		for id := range strings.SplitSeq(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				attach = append(attach, id)
+			}
+		}
+	}
 
-	if len(req.Queries) == 1 {
-		res, err := sqlite.Exec(ctx, db, req.Queries[0].Sql, req.Queries[0].Params)
+	if len(req.Queries) == 1 && len(attach) == 0 {
+		queryCtx, cancel := sqlite.QueryContext(ctx, time.Duration(req.Queries[0].TimeoutMs)*time.Millisecond)
+		defer cancel()
+		var res *sqlite.Response
+		start := time.Now()
+		if id := requestID(r); id != "" {
+			res, err = sqlite.ExecProgress(queryCtx, id, dbID, db, req.Queries[0].Sql, req.Queries[0].Params)
+		} else {
+			res, err = sqlite.Exec(queryCtx, db, req.Queries[0].Sql, req.Queries[0].Params)
+		}
+		logStatements(r, dbID, req.Queries, []*sqlite.Response{res}, start, err)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		res.NextCursor = pages[0].Apply(res)
+		accesslog.SetRows(ctx, responseRows(res))
+		res.Warnings = warnings[0]
+		writeSeq(w, dbID, req.Queries)
+		if writeDigest(w, r, dbID, []*sqlite.Response{res}) {
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -156,17 +342,141 @@ func QueryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := sqlite.Transaction(ctx, db, req.Queries)
+	var (
+		res     []*sqlite.Response
+		retries int
+	)
+	start := time.Now()
+	if len(attach) > 0 {
+		res, retries, err = sqlite.RetryAttachedTransaction(ctx, dbID, attach, req.Queries)
+	} else {
+		res, retries, err = sqlite.RetryTransaction(ctx, db, req.Queries)
+	}
+	logStatements(r, dbID, req.Queries, res, start, err)
+	if retries > 0 {
+		w.Header().Set("X-Retries", strconv.Itoa(retries))
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	var rows int64
+	for i, r := range res {
+		if i < len(pages) {
+			r.NextCursor = pages[i].Apply(r)
+		}
+		rows += responseRows(r)
+		r.Warnings = warnings[i]
+	}
+	accesslog.SetRows(ctx, rows)
+	writeSeq(w, dbID, req.Queries)
+	if writeDigest(w, r, dbID, res) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string][]*sqlite.Response{
-		"results": res,
+	json.NewEncoder(w).Encode(transactionResponse{
+		Results: res,
+		Retries: retries,
 	})
 }
 
+// lintPolicyOf returns the lint policy of the server, tightened by the lint
+// parameter of the request.
+func lintPolicyOf(r *http.Request) (sqlite.LintPolicy, error) {
+	lintPolicy := sqlite.DefaultLintPolicy()
+	if v := r.URL.Query().Get("lint"); v != "" {
+		policy, err := sqlite.ParseLintPolicy(v)
+		if err != nil {
+			return lintPolicy, err
+		}
+		// the request can only tighten the policy of the server
+		lintPolicy = max(lintPolicy, policy)
+	}
+	return lintPolicy, nil
+}
+
+// checkQueries rewrites the queries with the query interceptor and checks
+// them before they are executed, it returns the lint warnings of each one.
+func checkQueries(ctx context.Context, dbID string, queries []sqlite.Request, lintPolicy sqlite.LintPolicy) ([][]sqlite.LintWarning, error) {
+	warnings := make([][]sqlite.LintWarning, len(queries))
+	for i, query := range queries {
+		var err error
+		if query.Sql, err = sqlite.InterceptQuery(ctx, dbID, query.Sql); err != nil {
+			return nil, err
+		}
+		queries[i].Sql = query.Sql
+		if warnings[i], err = sqlite.CheckLint(query.Sql, lintPolicy); err != nil {
+			return nil, err
+		}
+		if err := sqlite.CheckWritable(ctx, dbID, query.Sql); err != nil {
+			return nil, err
+		}
+	}
+	return warnings, nil
+}
+
+// transactionResponse is the response of an array of queries, Retries
+// counts the runs of the transaction that failed on a lock conflict.
+type transactionResponse struct {
+	Results []*sqlite.Response `json:"results"`
+	Retries int                `json:"retries,omitempty"`
+}
+
+func responseRows(res *sqlite.Response) int64 {
+	if res.NoReturning {
+		return res.RowsAffected
+	}
+	return int64(len(res.Rows))
+}
+
+// logStatements logs the statements of the request and reports them to the
+// query observer and the audit log, the queries of a transaction share its
+// duration. results are the responses of the statements, nil when they failed.
+func logStatements(r *http.Request, dbID string, queries []sqlite.Request, results []*sqlite.Response, start time.Time, err error) {
+	for _, query := range queries {
+		sqlite.AfterQuery(r.Context(), dbID, query.Sql, err)
+	}
+	if audit.Enabled() {
+		user := session.User(r.Context())
+		for i, query := range queries {
+			var res *sqlite.Response
+			if i < len(results) {
+				res = results[i]
+			}
+			entry := audit.Entry{
+				Protocol:     "http",
+				Database:     cmp.Or(dbID, sqlite.DefaultDatabase()),
+				User:         user,
+				Remote:       r.RemoteAddr,
+				SQL:          query.Sql,
+				RowsAffected: audit.RowsAffected(res),
+				Error:        audit.ErrorString(err),
+			}
+			if len(query.Params) > 0 {
+				entry.Params = query.Params
+			}
+			audit.Record(entry)
+		}
+	}
+	if !querylog.Enabled() {
+		return
+	}
+	duration := time.Since(start)
+	user := session.User(r.Context())
+	for _, query := range queries {
+		querylog.Log(querylog.Entry{
+			Protocol: "http",
+			Database: cmp.Or(dbID, sqlite.DefaultDatabase()),
+			User:     user,
+			Remote:   r.RemoteAddr,
+			SQL:      query.Sql,
+			Params:   query.Params,
+			Duration: duration,
+			Error:    err,
+		})
+	}
+}
+
 func UndoHandler(undoType haconnect.UndoFilter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		dbID := r.PathValue("id")
@@ -272,22 +582,37 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func TakeSnapshotHandler(w http.ResponseWriter, r *http.Request) {
-	dbID := r.PathValue("id")
-	connector, err := sqlite.Connector(dbID)
-	if err != nil {
-		slog.Error("get connector", "error", err)
-		http.Error(w, fmt.Sprintf("failed to get connector: %v", err), http.StatusInternalServerError)
-		return
-	}
-	sequence, err := connector.TakeSnapshot(r.Context())
-	if err != nil {
-		slog.Error("take snapshot", "error", err)
-		http.Error(w, fmt.Sprintf("failed to take snapshot: %v", err), http.StatusInternalServerError)
-		return
+// TakeSnapshotHandler stores a snapshot in the NATS JetStream Object Store and
+// then calls each upload function to push it to additional storages.
+func TakeSnapshotHandler(uploads ...func(ctx context.Context, id string) (uint64, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbID := r.PathValue("id")
+		sequence, err := sqlite.TakeSnapshot(r.Context(), dbID)
+		if errors.Is(err, sqlite.ErrNotFound) {
+			slog.Error("get connector", "error", err)
+			http.Error(w, fmt.Sprintf("failed to get connector: %v", err), errorStatus(err))
+			return
+		}
+		if err != nil {
+			slog.Error("take snapshot", "error", err)
+			http.Error(w, fmt.Sprintf("failed to take snapshot: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if dbID == "" {
+			dbID = sqlite.DefaultDatabase()
+		}
+		for _, upload := range uploads {
+			uploaded, err := upload(r.Context(), dbID)
+			if err != nil {
+				slog.Error("upload snapshot", "error", err)
+				http.Error(w, fmt.Sprintf("failed to upload snapshot: %v", err), http.StatusInternalServerError)
+				return
+			}
+			sequence = max(sequence, uploaded)
+		}
+		w.Header().Set("X-Sequence", fmt.Sprint(sequence))
+		w.WriteHeader(http.StatusOK)
 	}
-	w.Header().Set("X-Sequence", fmt.Sprint(sequence))
-	w.WriteHeader(http.StatusOK)
 }
 
 func DownloadSnapshotHandler(w http.ResponseWriter, r *http.Request) {
@@ -358,3 +683,20 @@ func DeleteReplicationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func ResetHandler(seedDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbID := r.PathValue("id")
+		seed := r.URL.Query().Get("seed") == "true"
+		if seed && seedDir == "" {
+			http.Error(w, "seed is disabled, inform flag --seed-sql at startup", http.StatusBadRequest)
+			return
+		}
+		err := sqlite.Reset(r.Context(), dbID, seedDir, seed)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,211 @@
+package http
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/litesql/ha/internal/accesslog"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// ImportHandler inserts in the table the rows of the CSV and JSONL files of
+// the multipart body, batch_size rows per transaction. The header of a CSV
+// file names the columns, the keys of a JSONL object name them.
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	conflict, err := sqlite.ParseImportConflict(query.Get("on_conflict"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var batchSize int
+	if s := query.Get("batch_size"); s != "" {
+		if batchSize, err = strconv.Atoi(s); err != nil || batchSize <= 0 {
+			http.Error(w, "batch_size must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	format := strings.ToLower(query.Get("format"))
+	if format != "" && format != "csv" && format != "jsonl" {
+		http.Error(w, "invalid format, use csv or jsonl", http.StatusBadRequest)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "the body must be multipart/form-data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	res, err := sqlite.Import(ctx, r.PathValue("id"), r.PathValue("table"), conflict, batchSize, importRows(mr, format))
+	accesslog.SetRows(ctx, res.Changed)
+	if err != nil {
+		status := errorStatus(err)
+		if errors.Is(err, sqlite.ErrImportRow) {
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, fmt.Sprintf("%v (%d rows committed in %d batches)", err, res.Rows, res.Batches), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// importRows reads the rows of the files of the multipart body, in the format
+// given or else from the file extension or content type.
+func importRows(mr *multipart.Reader, format string) iter.Seq2[sqlite.ImportRow, error] {
+	return func(yield func(sqlite.ImportRow, error) bool) {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(sqlite.ImportRow{}, err)
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+			var rows iter.Seq2[sqlite.ImportRow, error]
+			switch importFormat(format, part) {
+			case "csv":
+				rows = csvRows(part)
+			case "jsonl":
+				rows = jsonlRows(part)
+			default:
+				yield(sqlite.ImportRow{}, fmt.Errorf("unknown format of %s, use a .csv or .jsonl file or the format parameter", part.FileName()))
+				return
+			}
+			for row, err := range rows {
+				if err != nil {
+					err = fmt.Errorf("%s: %w", part.FileName(), err)
+				}
+				if !yield(row, err) || err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func importFormat(format string, part *multipart.Part) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(part.FileName())) {
+	case ".csv":
+		return "csv"
+	case ".jsonl", ".ndjson":
+		return "jsonl"
+	}
+	mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return "csv"
+	case "application/jsonl", "application/x-ndjson", "application/x-jsonlines":
+		return "jsonl"
+	}
+	return ""
+}
+
+// csvRows reads the records as text values, SQLite converts them following
+// the affinity of the columns.
+func csvRows(r io.Reader) iter.Seq2[sqlite.ImportRow, error] {
+	return func(yield func(sqlite.ImportRow, error) bool) {
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("missing CSV header")
+			}
+			yield(sqlite.ImportRow{}, err)
+			return
+		}
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(sqlite.ImportRow{}, err)
+				return
+			}
+			values := make([]any, len(record))
+			for i, v := range record {
+				values[i] = v
+			}
+			if !yield(sqlite.ImportRow{Columns: header, Values: values}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// jsonlRows reads one JSON object per row: the numbers are integers or reals,
+// the booleans 1 or 0, and the objects and arrays their JSON text.
+func jsonlRows(r io.Reader) iter.Seq2[sqlite.ImportRow, error] {
+	return func(yield func(sqlite.ImportRow, error) bool) {
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		for line := 1; ; line++ {
+			var object map[string]any
+			err := dec.Decode(&object)
+			if err == io.EOF {
+				return
+			}
+			if err == nil && len(object) == 0 {
+				err = errors.New("empty object")
+			}
+			if err != nil {
+				yield(sqlite.ImportRow{}, fmt.Errorf("object %d: %w", line, err))
+				return
+			}
+			columns := make([]string, 0, len(object))
+			for column := range object {
+				columns = append(columns, column)
+			}
+			slices.Sort(columns)
+			values := make([]any, len(columns))
+			for i, column := range columns {
+				if values[i], err = jsonValue(object[column]); err != nil {
+					yield(sqlite.ImportRow{}, fmt.Errorf("object %d: %s: %w", line, column, err))
+					return
+				}
+			}
+			if !yield(sqlite.ImportRow{Columns: columns, Values: values}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func jsonValue(v any) (any, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		return string(b), err
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,48 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// JSONPatchHandler applies a partial update to the JSON documents of a
+// column. The documents are replicated whole, as computed by this node.
+func JSONPatchHandler(w http.ResponseWriter, r *http.Request) {
+	var update sqlite.JSONUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, params, err := update.Statement()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dbID := r.PathValue("id")
+	db, err := sqlite.DB(dbID)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	ctx := r.Context()
+	if query, err = sqlite.InterceptQuery(ctx, dbID, query); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if err := sqlite.CheckWritable(ctx, dbID, query); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	start := time.Now()
+	res, err := sqlite.Exec(ctx, db, query, params)
+	logStatements(r, dbID, []sqlite.Request{{Sql: query, Params: params}}, []*sqlite.Response{res}, start, err)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
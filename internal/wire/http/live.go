@@ -0,0 +1,147 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litesql/ha/internal/livequery"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+type liveQueryResponse struct {
+	*livequery.Query
+	Result *livequery.Result `json:"result"`
+}
+
+// RegisterLiveQueryHandler registers a SELECT re-executed when the tables it
+// reads change, the token of the response reads its results.
+func RegisterLiveQueryHandler(m *livequery.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req sqlite.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		q, err := m.Register(r.Context(), r.PathValue("id"), req.Sql, req.Params)
+		if err != nil {
+			http.Error(w, err.Error(), liveQueryStatus(err))
+			return
+		}
+		result, _ := q.Result()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/live/"+q.Token)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(liveQueryResponse{Query: q, Result: result})
+	}
+}
+
+// LiveQueryHandler returns the result of the live query once its version
+// differs from the version parameter (long polling, 304 on timeout), or
+// streams the results as server-sent events. With diff=true the events carry
+// the rows added and removed since the previous event.
+func LiveQueryHandler(m *livequery.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := m.Get(r.PathValue("token"))
+		if err != nil {
+			http.Error(w, err.Error(), liveQueryStatus(err))
+			return
+		}
+		query := r.URL.Query()
+		var version uint64
+		if v := query.Get("version"); v != "" {
+			version, err = strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "version must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			withDiff, _ := strconv.ParseBool(query.Get("diff"))
+			streamLiveQuery(w, r, q, version, withDiff)
+			return
+		}
+		timeout := defaultFlagsWait
+		if v := query.Get("timeout"); v != "" {
+			timeout, err = time.ParseDuration(v)
+			if err != nil || timeout < 0 {
+				http.Error(w, "timeout must be a duration like 30s", http.StatusBadRequest)
+				return
+			}
+			timeout = min(timeout, maxFlagsWait)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		result, _ := q.Wait(ctx, version)
+		if result.Version == version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func streamLiveQuery(w http.ResponseWriter, r *http.Request, q *livequery.Query, version uint64, withDiff bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), flagsKeepAlive)
+		result, diff := q.Wait(ctx, version)
+		cancel()
+		if r.Context().Err() != nil {
+			return
+		}
+		if result.Version == version {
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			continue
+		}
+		event, data := "result", any(result)
+		// a diff only applies to the previous version the client has
+		if withDiff && diff != nil && diff.Version == result.Version && version == result.Version-1 && result.Error == "" {
+			event, data = "diff", diff
+		}
+		b, _ := json.Marshal(data)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", result.Version, event, b); err != nil {
+			return
+		}
+		flusher.Flush()
+		version = result.Version
+	}
+}
+
+func DeleteLiveQueryHandler(m *livequery.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Remove(r.PathValue("token")); err != nil {
+			http.Error(w, err.Error(), liveQueryStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func liveQueryStatus(err error) int {
+	switch {
+	case errors.Is(err, livequery.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, livequery.ErrTooMany):
+		return http.StatusTooManyRequests
+	case errors.Is(err, livequery.ErrNotQuery):
+		return http.StatusBadRequest
+	default:
+		return errorStatus(err)
+	}
+}
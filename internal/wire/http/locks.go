@@ -0,0 +1,91 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/litesql/ha/internal/locks"
+)
+
+const locksDisabled = "distributed locks are disabled, inform flag --locks-bucket at startup"
+
+// LocksHandler serves the distributed locks. POST /locks/{name} acquires the
+// lock for the ttl of the JSON body, or renews it with the token of the
+// X-Lock-Token header, GET /locks/{name} returns the holder and
+// DELETE /locks/{name} releases the lock of the X-Lock-Token header.
+func LocksHandler(manager *locks.Manager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /locks/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Owner string `json:"owner"`
+			TTL   string `json:"ttl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := locks.Request{
+			Owner: body.Owner,
+			Token: r.Header.Get("X-Lock-Token"),
+		}
+		if body.TTL != "" {
+			var err error
+			req.TTL, err = time.ParseDuration(body.TTL)
+			if err != nil || req.TTL <= 0 {
+				http.Error(w, "invalid ttl, use a positive duration like 30s", http.StatusBadRequest)
+				return
+			}
+		}
+		lock, err := manager.Acquire(r.Context(), r.PathValue("name"), req)
+		if err != nil {
+			http.Error(w, err.Error(), lockErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lock)
+	})
+	mux.HandleFunc("GET /locks/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		lock, err := manager.Get(r.Context(), r.PathValue("name"))
+		if err != nil {
+			http.Error(w, err.Error(), lockErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lock)
+	})
+	mux.HandleFunc("DELETE /locks/{name...}", func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Lock-Token")
+		if token == "" {
+			http.Error(w, "the X-Lock-Token header is required", http.StatusBadRequest)
+			return
+		}
+		if err := manager.Release(r.Context(), r.PathValue("name"), token); err != nil {
+			http.Error(w, err.Error(), lockErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if manager == nil {
+			http.Error(w, locksDisabled, http.StatusNotFound)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func lockErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, locks.ErrLocked):
+		return http.StatusConflict
+	case errors.Is(err, locks.ErrNotHeld):
+		return http.StatusNotFound
+	case errors.Is(err, locks.ErrInvalidName):
+		return http.StatusBadRequest
+	default:
+		return errorStatus(err)
+	}
+}
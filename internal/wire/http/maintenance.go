@@ -0,0 +1,34 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/litesql/ha/internal/maintenance"
+)
+
+func MaintenanceHandler(s *maintenance.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Status())
+	}
+}
+
+// RunMaintenanceHandler runs a maintenance task on the database now and
+// returns its result, a failed task is reported in the result.
+func RunMaintenanceHandler(s *maintenance.Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := s.Run(r.Context(), r.PathValue("id"), r.PathValue("task"))
+		if err != nil {
+			status := errorStatus(err)
+			if errors.Is(err, maintenance.ErrInvalid) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/litesql/ha/internal/matview"
+)
+
+// CreateMaterializedViewHandler creates a materialized view, its table is
+// filled with the rows of the query.
+func CreateMaterializedViewHandler(m *matview.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var def matview.View
+		if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		v, err := m.Create(r.Context(), r.PathValue("id"), def)
+		if err != nil {
+			http.Error(w, err.Error(), materializedViewStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func MaterializedViewsHandler(m *matview.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := m.List(r.Context(), r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), materializedViewStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// RefreshMaterializedViewHandler refreshes the view now, without waiting for
+// a change of the tables it reads.
+func RefreshMaterializedViewHandler(m *matview.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, err := m.Refresh(r.Context(), r.PathValue("id"), r.PathValue("name"))
+		if err != nil {
+			http.Error(w, err.Error(), materializedViewStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func DropMaterializedViewHandler(m *matview.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Drop(r.Context(), r.PathValue("id"), r.PathValue("name")); err != nil {
+			http.Error(w, err.Error(), materializedViewStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func materializedViewStatus(err error) int {
+	switch {
+	case errors.Is(err, matview.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, matview.ErrExists):
+		return http.StatusConflict
+	case errors.Is(err, matview.ErrInvalid):
+		return http.StatusBadRequest
+	default:
+		return errorStatus(err)
+	}
+}
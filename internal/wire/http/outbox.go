@@ -0,0 +1,106 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+const defaultOutboxLimit = 100
+
+// OutboxHandler reports the changesets waiting in the async replication
+// outbox of the database, the oldest first.
+func OutboxHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, err := snapshotDatabase(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	limit := defaultOutboxLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	outbox, err := sqlite.InspectOutbox(r.Context(), dbID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outbox)
+}
+
+// FlushOutboxHandler publishes the outbox of the database right away,
+// reporting how many changesets were published before any failure.
+func FlushOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, err := snapshotDatabase(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	published, err := sqlite.FlushOutbox(r.Context(), dbID)
+	w.Header().Set("X-Published", fmt.Sprint(published))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "flush outbox", "error", err, "id", dbID, "published", published)
+		http.Error(w, fmt.Sprintf("failed to flush outbox: %v", err), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":        dbID,
+		"published": published,
+	})
+}
+
+// DeleteOutboxMessageHandler drops a poisoned changeset from the outbox of
+// the database, or from its quarantine, its changes are never replicated.
+func DeleteOutboxMessageHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, msgID, ok := outboxMessage(w, r)
+	if !ok {
+		return
+	}
+	quarantined := strings.Contains(r.URL.Path, "/outbox/quarantine/")
+	if err := sqlite.DeleteOutboxMessage(r.Context(), dbID, msgID, quarantined); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	slog.WarnContext(r.Context(), "outbox message deleted", "id", dbID, "message", msgID, "quarantined", quarantined)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequeueOutboxMessageHandler moves a quarantined changeset back to the
+// outbox of the database, to be published again.
+func RequeueOutboxMessageHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, msgID, ok := outboxMessage(w, r)
+	if !ok {
+		return
+	}
+	if err := sqlite.RequeueOutboxMessage(r.Context(), dbID, msgID); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	slog.InfoContext(r.Context(), "outbox message requeued", "id", dbID, "message", msgID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func outboxMessage(w http.ResponseWriter, r *http.Request) (string, int64, bool) {
+	dbID, err := snapshotDatabase(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return "", 0, false
+	}
+	msgID, err := strconv.ParseInt(r.PathValue("msg"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid outbox message id", http.StatusBadRequest)
+		return "", 0, false
+	}
+	return dbID, msgID, true
+}
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/litesql/ha/internal/resync"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+type rewindRequest struct {
+	Sequence *uint64 `json:"sequence"`
+}
+
+// RewindHandler rebuilds the database of this node from the most recent
+// retained snapshot at or before the sequence and replays the replication
+// stream forward from it.
+func RewindHandler(rewind func(ctx context.Context, id string, sequence uint64) (uint64, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req rewindRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Sequence == nil {
+			http.Error(w, fmt.Sprintf(`the body must be {"sequence": N}: %v`, err), http.StatusBadRequest)
+			return
+		}
+		id := r.PathValue("id")
+		snapshotSeq, err := rewind(r.Context(), id, *req.Sequence)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "rewind database", "error", err, "id", id, "sequence", *req.Sequence)
+			http.Error(w, err.Error(), rewindStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":           id,
+			"sequence":     *req.Sequence,
+			"snapshot_seq": snapshotSeq,
+		})
+	}
+}
+
+// ReseedHandler rebuilds the database of this node from the latest snapshot,
+// to repair a replica diverging from the other nodes.
+func ReseedHandler(reseed func(ctx context.Context, id string) (uint64, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		snapshotSeq, err := reseed(r.Context(), id)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "reseed database", "error", err, "id", id)
+			http.Error(w, err.Error(), rewindStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":           id,
+			"snapshot_seq": snapshotSeq,
+		})
+	}
+}
+
+func rewindStatus(err error) int {
+	switch {
+	case errors.Is(err, resync.ErrInvalidSequence):
+		return http.StatusBadRequest
+	case errors.Is(err, resync.ErrNoSnapshot), errors.Is(err, sqlite.ErrNoSnapshot):
+		return http.StatusNotFound
+	case errors.Is(err, sqlite.ErrSnapshotTooOld), errors.Is(err, sqlite.ErrOwnChanges):
+		return http.StatusConflict
+	default:
+		return errorStatus(err)
+	}
+}
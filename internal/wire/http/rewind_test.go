@@ -0,0 +1,65 @@
+package http_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/litesql/ha/internal/resync"
+	"github.com/litesql/ha/internal/sqlite"
+	hahttp "github.com/litesql/ha/internal/wire/http"
+)
+
+func TestRewindHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  error
+		want int
+	}{
+		{name: "rewound", body: `{"sequence": 42}`, want: http.StatusOK},
+		{name: "no sequence", body: `{}`, want: http.StatusBadRequest},
+		{name: "invalid sequence", body: `{"sequence": 42}`, err: resync.ErrInvalidSequence, want: http.StatusBadRequest},
+		{name: "no snapshot", body: `{"sequence": 42}`, err: sqlite.ErrNoSnapshot, want: http.StatusNotFound},
+		{name: "own changes", body: `{"sequence": 42}`, err: fmt.Errorf("%w: published up to the sequence 50", sqlite.ErrOwnChanges), want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := hahttp.RewindHandler(func(context.Context, string, uint64) (uint64, error) {
+				return 40, tt.err
+			})
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodPost, "/databases/app.db/rewind", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestReseedHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "reseeded", want: http.StatusOK},
+		{name: "no snapshot", err: sqlite.ErrNoSnapshot, want: http.StatusNotFound},
+		{name: "own changes", err: fmt.Errorf("%w: published up to the sequence 50", sqlite.ErrOwnChanges), want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := hahttp.ReseedHandler(func(context.Context, string) (uint64, error) {
+				return 40, tt.err
+			})
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodPost, "/databases/app.db/reseed", nil))
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package http
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/upgrade"
+)
+
+// SchemaResponse is the normalized description of the schema of a database,
+// the fingerprint is equal on the nodes with the same schema.
+type SchemaResponse struct {
+	Database    string         `json:"database"`
+	Fingerprint string         `json:"fingerprint"`
+	Tables      []sqlite.Table `json:"tables"`
+}
+
+// SchemaDiffRequest sets the schema to compare with: the tables of an
+// uploaded schema, or the node of the cluster to fetch it from.
+type SchemaDiffRequest struct {
+	Tables []sqlite.Table `json:"tables"`
+	Node   string         `json:"node"`
+}
+
+func SchemaHandler(w http.ResponseWriter, r *http.Request) {
+	id := cmp.Or(r.PathValue("id"), sqlite.DefaultDatabase())
+	res, err := schema(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, res)
+}
+
+// SchemaDiffHandler returns the statements converging the schema of the
+// database to the uploaded one or to the one of another node, to detect the
+// drift of the nodes. The statements are not run.
+func SchemaDiffHandler(registry *upgrade.Registry, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := cmp.Or(r.PathValue("id"), sqlite.DefaultDatabase())
+		var req SchemaDiffRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		local, err := schema(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		source := "upload"
+		target := req.Tables
+		if req.Node != "" {
+			source = req.Node
+			nodeURL, err := nodeURL(registry, req.Node)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			remote, err := remoteSchema(r.Context(), nodeURL, token, id)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to get the schema of node %q: %v", req.Node, err), http.StatusBadGateway)
+				return
+			}
+			target = remote.Tables
+		}
+		statements := sqlite.DiffSchema(local.Tables, target)
+		if statements == nil {
+			statements = []string{}
+		}
+		targetFingerprint := sqlite.SchemaFingerprint(target)
+		writeJSON(w, map[string]any{
+			"database":           id,
+			"source":             source,
+			"fingerprint":        local.Fingerprint,
+			"target_fingerprint": targetFingerprint,
+			"in_sync":            local.Fingerprint == targetFingerprint,
+			"statements":         statements,
+		})
+	}
+}
+
+func schema(ctx context.Context, id string) (SchemaResponse, error) {
+	db, err := sqlite.DB(id)
+	if err != nil {
+		return SchemaResponse{}, err
+	}
+	tables, err := sqlite.Schema(ctx, db)
+	if err != nil {
+		return SchemaResponse{}, err
+	}
+	if tables == nil {
+		tables = []sqlite.Table{}
+	}
+	return SchemaResponse{
+		Database:    id,
+		Fingerprint: sqlite.SchemaFingerprint(tables),
+		Tables:      tables,
+	}, nil
+}
+
+// nodeURL returns the URL advertised on the heartbeats of the node.
+func nodeURL(registry *upgrade.Registry, name string) (string, error) {
+	if registry == nil {
+		return "", errors.New("the cluster nodes are unknown without heartbeats, upload the schema instead")
+	}
+	for _, node := range registry.Nodes() {
+		if node.Node != name {
+			continue
+		}
+		if node.URL == "" {
+			return "", fmt.Errorf("node %q does not advertise its URL, set its --advertise-url", name)
+		}
+		return node.URL, nil
+	}
+	return "", fmt.Errorf("node %q not found in the cluster", name)
+}
+
+func remoteSchema(ctx context.Context, nodeURL, token, id string) (SchemaResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(nodeURL, "/")+"/databases/"+url.PathEscape(id)+"/schema", nil)
+	if err != nil {
+		return SchemaResponse{}, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return SchemaResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return SchemaResponse{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var res SchemaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return SchemaResponse{}, err
+	}
+	return res, nil
+}
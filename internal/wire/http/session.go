@@ -0,0 +1,20 @@
+package http
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/litesql/ha/internal/session"
+)
+
+// Identified sets the user of the basic authorization as the identity of the
+// requests, seen by the interceptors, once verify accepts its password. The
+// requests with an unverified authorization have no identity.
+func Identified(verify func(ctx context.Context, user, password string) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); ok && user != "" && verify(r.Context(), user, password) {
+			r = r.WithContext(session.NewContext(r.Context(), session.Identity{User: user, Protocol: "http"}))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
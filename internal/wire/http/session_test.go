@@ -0,0 +1,56 @@
+package http_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/litesql/ha/internal/session"
+	hahttp "github.com/litesql/ha/internal/wire/http"
+	"github.com/litesql/ha/internal/wire/postgresql"
+)
+
+func TestIdentified(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	users := "admin " + postgresql.SCRAMSecret("admin-pass") + "\napp md56a422f785c9e20873908ce25d1736ae2\n"
+	if err := os.WriteFile(usersFile, []byte(users), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	lookup, err := postgresql.UsersFromFile(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	handler := hahttp.Identified(postgresql.NewReloadableUsers(lookup).Verify, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = session.User(r.Context())
+	}))
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		want     string
+	}{
+		{name: "scram", user: "admin", password: "admin-pass", want: "admin"},
+		{name: "md5", user: "app", password: "secret", want: "app"},
+		{name: "wrong password", user: "admin", password: "secret"},
+		{name: "unknown user", user: "root", password: "secret"},
+		{name: "no password", user: "app"},
+		{name: "no authorization"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = "unset"
+			r := httptest.NewRequest(http.MethodPost, "/query", nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("got identity %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
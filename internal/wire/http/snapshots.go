@@ -0,0 +1,126 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/litesql/ha/internal/snapshots"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+const historyDisabled = "snapshot history is disabled, inform flag --snapshot-history at startup"
+
+// SnapshotsHandler lists the retained snapshots of the database, most recent
+// first.
+func SnapshotsHandler(history *snapshots.History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if history == nil {
+			http.Error(w, historyDisabled, http.StatusNotFound)
+			return
+		}
+		dbID, err := snapshotDatabase(r)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		list, err := history.List(r.Context(), dbID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "list snapshots", "error", err, "id", dbID)
+			http.Error(w, fmt.Sprintf("failed to list snapshots: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if list == nil {
+			list = []snapshots.Snapshot{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":        dbID,
+			"snapshots": list,
+		})
+	}
+}
+
+// DownloadRetainedSnapshotHandler sends the retained snapshot with the
+// sequence informed in the path.
+func DownloadRetainedSnapshotHandler(history *snapshots.History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbID, sequence, reader, ok := retainedSnapshot(w, r, history)
+		if !ok {
+			return
+		}
+		defer reader.Close()
+		filename := fmt.Sprintf("%s_ha_snapshot_%d.db", time.Now().UTC().Format(time.DateTime), sequence)
+		w.Header().Set("X-Sequence", fmt.Sprint(sequence))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := io.Copy(w, reader); err != nil {
+			slog.ErrorContext(r.Context(), "send snapshot", "error", err, "id", dbID, "sequence", sequence)
+		}
+	}
+}
+
+// RestoreSnapshotHandler replaces the database content by the retained
+// snapshot with the sequence informed in the path. The restore is replicated
+// to the whole cluster.
+func RestoreSnapshotHandler(history *snapshots.History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbID, sequence, reader, ok := retainedSnapshot(w, r, history)
+		if !ok {
+			return
+		}
+		defer reader.Close()
+		if err := sqlite.Restore(r.Context(), dbID, reader); err != nil {
+			slog.ErrorContext(r.Context(), "restore snapshot", "error", err, "id", dbID, "sequence", sequence)
+			http.Error(w, fmt.Sprintf("failed to restore snapshot: %v", err), errorStatus(err))
+			return
+		}
+		w.Header().Set("X-Sequence", fmt.Sprint(sequence))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func retainedSnapshot(w http.ResponseWriter, r *http.Request, history *snapshots.History) (string, uint64, io.ReadCloser, bool) {
+	if history == nil {
+		http.Error(w, historyDisabled, http.StatusNotFound)
+		return "", 0, nil, false
+	}
+	dbID, err := snapshotDatabase(r)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return "", 0, nil, false
+	}
+	sequence, err := strconv.ParseUint(r.PathValue("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid snapshot sequence", http.StatusBadRequest)
+		return "", 0, nil, false
+	}
+	reader, err := history.Get(r.Context(), dbID, sequence)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, snapshots.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("failed to get snapshot: %v", err), status)
+		return "", 0, nil, false
+	}
+	return dbID, sequence, reader, true
+}
+
+// snapshotDatabase resolves the database id from the path, the default
+// database when empty.
+func snapshotDatabase(r *http.Request) (string, error) {
+	dbID := r.PathValue("id")
+	if _, err := sqlite.DB(dbID); err != nil {
+		return "", err
+	}
+	if dbID == "" {
+		dbID = sqlite.DefaultDatabase()
+	}
+	return dbID, nil
+}
@@ -0,0 +1,53 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// RequestIDHeader tracks a statement of the query endpoints with the request
+// id it holds, its progress is read with StatementHandler and it is canceled
+// with CancelStatementHandler. It is specific to HA: the proxies add the
+// usual X-Request-Id to every request.
+const RequestIDHeader = "X-HA-Progress"
+
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("request_id")
+}
+
+// StatementsHandler lists the statements running with a request id.
+func StatementsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]sqlite.Progress{
+		"statements": sqlite.Running(),
+	})
+}
+
+// StatementHandler returns the progress of the statement running with the
+// request id informed in the path.
+func StatementHandler(w http.ResponseWriter, r *http.Request) {
+	progress, err := sqlite.RunningStatus(r.PathValue("request_id"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
+
+// CancelStatementHandler interrupts the statement running with the request
+// id informed in the path, its transaction is rolled back.
+func CancelStatementHandler(w http.ResponseWriter, r *http.Request) {
+	progress, err := sqlite.Cancel(r.PathValue("request_id"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
@@ -0,0 +1,205 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/litesql/ha/internal/flowcontrol"
+	"github.com/litesql/ha/internal/metrics"
+	"github.com/litesql/ha/internal/snapshots"
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/upgrade"
+)
+
+// StatusConfig is the state of the node reported by /status besides its
+// databases.
+type StatusConfig struct {
+	Node      string
+	Version   string
+	Commit    string
+	Date      string
+	StartedAt time.Time
+	ApplyFlow *flowcontrol.Controller
+	// NATS reports the connection to NATS, nil without replication.
+	NATS func() NATSStatus
+	// History lists the versioned snapshots, nil without --snapshot-history.
+	History *snapshots.History
+}
+
+// NATSStatus is the state of the connection to NATS.
+type NATSStatus struct {
+	Connected  bool   `json:"connected"`
+	Status     string `json:"status"`
+	URL        string `json:"url,omitempty"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+// StatusHandler reports the node in a single document for the monitoring
+// agents: build, uptime, NATS connection, and the size, replication and
+// snapshots of each database.
+func StatusHandler(cfg StatusConfig) http.HandlerFunc {
+	type latency struct {
+		Database   string  `json:"database"`
+		Origin     string  `json:"origin"`
+		Count      uint64  `json:"count"`
+		P50Seconds float64 `json:"p50_seconds"`
+		P99Seconds float64 `json:"p99_seconds"`
+	}
+	type database struct {
+		sqlite.DatabaseStatus
+		LatestSnapshot *snapshots.Snapshot `json:"latest_snapshot,omitempty"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		histograms := metrics.Histograms(metrics.ReplicationLatency)
+		latencies := make([]latency, 0, len(histograms))
+		for _, h := range histograms {
+			latencies = append(latencies, latency{
+				Database:   h.Labels["database"],
+				Origin:     h.Labels["origin"],
+				Count:      h.Count,
+				P50Seconds: h.P50,
+				P99Seconds: h.P99,
+			})
+		}
+		statuses := sqlite.DatabasesStatus(r.Context())
+		databases := make([]database, 0, len(statuses))
+		for _, s := range statuses {
+			db := database{DatabaseStatus: s}
+			if cfg.History != nil {
+				if list, err := cfg.History.List(r.Context(), s.ID); err == nil && len(list) > 0 {
+					db.LatestSnapshot = &list[0]
+				}
+			}
+			databases = append(databases, db)
+		}
+		var nats *NATSStatus
+		if cfg.NATS != nil {
+			status := cfg.NATS()
+			nats = &status
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"node": cfg.Node,
+			"build": map[string]string{
+				"version":    cfg.Version,
+				"commit":     cfg.Commit,
+				"date":       cfg.Date,
+				"go_version": runtime.Version(),
+			},
+			"started_at":          cfg.StartedAt,
+			"uptime_seconds":      int64(time.Since(cfg.StartedAt).Seconds()),
+			"nats":                nats,
+			"databases":           databases,
+			"replication_latency": latencies,
+			"apply":               cfg.ApplyFlow.Status(),
+		})
+	}
+}
+
+// ClusterHandler lists the nodes seen through their heartbeats, this node
+// first, then the same zone, the same region and the remote ones.
+func ClusterHandler(node string, labels map[string]string, registry *upgrade.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodes := []upgrade.Node{}
+		if registry != nil {
+			nodes = registry.Nodes()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"node":   node,
+			"labels": labels,
+			"nodes":  nodes,
+		})
+	}
+}
+
+// ReadyHandler responds 503 Service Unavailable while any check fails.
+func ReadyHandler(checks ...func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// HealthConfig sets the thresholds that turn a node unhealthy. Zero values
+// disable the threshold.
+type HealthConfig struct {
+	MaxPending uint64
+	MaxOutbox  int64
+	NATS       func() error
+	// Warnings are reported by /healthz without turning the node unhealthy.
+	Warnings func() []string
+}
+
+func (cfg HealthConfig) check(ctx context.Context) ([]sqlite.Health, []string) {
+	var problems []string
+	if cfg.NATS != nil {
+		if err := cfg.NATS(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	list := sqlite.DatabasesHealth(ctx)
+	for _, h := range list {
+		switch {
+		case h.Error != "":
+			problems = append(problems, fmt.Sprintf("database %q: %s", h.ID, h.Error))
+		case cfg.MaxPending > 0 && h.Pending > cfg.MaxPending:
+			problems = append(problems, fmt.Sprintf("database %q has %d pending changesets (max %d)", h.ID, h.Pending, cfg.MaxPending))
+		case cfg.MaxOutbox > 0 && h.OutboxDepth > cfg.MaxOutbox:
+			problems = append(problems, fmt.Sprintf("database %q has %d changesets in the outbox (max %d)", h.ID, h.OutboxDepth, cfg.MaxOutbox))
+		}
+	}
+	return list, problems
+}
+
+// Ready fails when NATS is disconnected or any database exceeds a threshold.
+func (cfg HealthConfig) Ready() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, problems := cfg.check(ctx)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// HealthHandler reports the replication state of each database and the
+// problems failing /readyz. It is the liveness probe of the node and always
+// responds 200 OK: a lagging replica stops receiving traffic, it is not
+// restarted.
+func HealthHandler(cfg HealthConfig, checks ...func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, problems := cfg.check(r.Context())
+		for _, check := range checks {
+			if err := check(); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		status := "ok"
+		if len(problems) > 0 {
+			status = "degraded"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		var warnings []string
+		if cfg.Warnings != nil {
+			warnings = cfg.Warnings()
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":    status,
+			"databases": list,
+			"problems":  problems,
+			"warnings":  warnings,
+		})
+	}
+}
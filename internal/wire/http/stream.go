@@ -0,0 +1,131 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/tail"
+)
+
+const (
+	defaultStreamLimit = 100
+	maxStreamLimit     = 1000
+)
+
+type streamResponse struct {
+	Messages []tail.Message `json:"messages"`
+	// NextSeq is the from_seq of the next request.
+	NextSeq uint64 `json:"next_seq"`
+}
+
+// StreamHandler serves the replication messages of the database from the
+// from_seq stream sequence on. It waits up to timeout for the first message
+// (long polling), or with follow=true streams the messages as newline
+// delimited JSON until the client disconnects.
+func StreamHandler(reader *tail.Reader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reader == nil {
+			http.Error(w, "the replication stream is not available, inform --replication-url or --nats-port", http.StatusNotFound)
+			return
+		}
+		stream, subject, err := sqlite.ReplicationSubject(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		query := r.URL.Query()
+		from := uint64(1)
+		if v := query.Get("from_seq"); v != "" {
+			from, err = strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "from_seq must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		limit := defaultStreamLimit
+		if v := query.Get("limit"); v != "" {
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit <= 0 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = min(limit, maxStreamLimit)
+		}
+		if follow, _ := strconv.ParseBool(query.Get("follow")); follow {
+			followStream(w, r, reader, stream, subject, from)
+			return
+		}
+		timeout := defaultFlagsWait
+		if v := query.Get("timeout"); v != "" {
+			timeout, err = time.ParseDuration(v)
+			if err != nil || timeout < 0 {
+				http.Error(w, "timeout must be a duration like 30s", http.StatusBadRequest)
+				return
+			}
+			timeout = min(timeout, maxFlagsWait)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		list, err := reader.Wait(ctx, stream, subject, from, limit)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "read replication stream", "error", err, "stream", stream, "subject", subject)
+			http.Error(w, fmt.Sprintf("failed to read the replication stream: %v", err), http.StatusBadGateway)
+			return
+		}
+		next := from
+		if len(list) > 0 {
+			next = list[len(list)-1].Sequence + 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(streamResponse{
+			Messages: list,
+			NextSeq:  next,
+		})
+	}
+}
+
+func followStream(w http.ResponseWriter, r *http.Request, reader *tail.Reader, stream, subject string, from uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), flagsKeepAlive)
+		list, err := reader.Wait(ctx, stream, subject, from, maxStreamLimit)
+		cancel()
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "follow replication stream", "error", err, "stream", stream, "subject", subject)
+			return
+		}
+		if len(list) == 0 {
+			// keep-alive, the empty lines are not messages
+			if _, err := fmt.Fprintln(w); err != nil {
+				return
+			}
+			flusher.Flush()
+			continue
+		}
+		for _, msg := range list {
+			if err := enc.Encode(msg); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		from = list[len(list)-1].Sequence + 1
+	}
+}
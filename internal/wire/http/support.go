@@ -0,0 +1,18 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/litesql/ha/internal/support"
+)
+
+// SupportHandler serves the report of the node collected by ha
+// support-bundle: flags, recent events and slow statements.
+func SupportHandler(adminToken string, report func() support.Report) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedAdmin(w, r, adminToken) {
+			return
+		}
+		writeJSON(w, report())
+	}
+}
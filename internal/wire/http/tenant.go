@@ -0,0 +1,69 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/litesql/ha/internal/tenant"
+)
+
+// CreateTenantHandler creates the database of a tenant from a schema
+// template and registers its login.
+func CreateTenantHandler(m *tenant.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req tenant.CreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		t, err := m.Create(r.Context(), req)
+		if err != nil {
+			http.Error(w, err.Error(), tenantStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+func TenantsHandler(m *tenant.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := m.List(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), tenantStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// DropTenantHandler archives a final snapshot of the tenant database before
+// dropping it.
+func DropTenantHandler(m *tenant.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		archive, err := m.Drop(r.Context(), r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), tenantStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(archive)
+	}
+}
+
+func tenantStatus(err error) int {
+	switch {
+	case errors.Is(err, tenant.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, tenant.ErrExists):
+		return http.StatusConflict
+	case errors.Is(err, tenant.ErrInvalid):
+		return http.StatusBadRequest
+	default:
+		return errorStatus(err)
+	}
+}
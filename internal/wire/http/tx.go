@@ -0,0 +1,133 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/litesql/ha/internal/accesslog"
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/txsession"
+)
+
+type beginResponse struct {
+	*txsession.Tx
+	IdleTimeoutMs int64 `json:"idle_timeout_ms"`
+}
+
+// BeginHandler begins a transaction kept open between the requests, the
+// token of the response runs the next queries in it.
+func BeginHandler(m *txsession.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mode, err := sqlite.ParseBeginMode(r.URL.Query().Get("begin"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tx, err := m.Begin(r.Context(), r.PathValue("id"), mode)
+		if err != nil {
+			http.Error(w, err.Error(), txStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/tx/"+tx.Token)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(beginResponse{Tx: tx, IdleTimeoutMs: m.IdleTimeout().Milliseconds()})
+	}
+}
+
+// TxQueryHandler runs the queries of the request body, a query or an array,
+// in the transaction of the token.
+func TxQueryHandler(m *txsession.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req QueriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Queries) == 0 {
+			http.Error(w, "no queries found", http.StatusBadRequest)
+			return
+		}
+		tx, err := m.Get(r.Context(), r.PathValue("token"), r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), txStatus(err))
+			return
+		}
+		lintPolicy, err := lintPolicyOf(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		warnings, err := checkQueries(ctx, tx.DB, req.Queries, lintPolicy)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		if r.URL.Query().Get("types") == "true" {
+			ctx = sqlite.ContextTypedValues(ctx, true)
+		}
+		start := time.Now()
+		res, err := m.Exec(ctx, tx.Token, req.Queries)
+		logStatements(r, tx.DB, req.Queries, res, start, err)
+		if err != nil {
+			http.Error(w, err.Error(), txStatus(err))
+			return
+		}
+		var rows int64
+		for i, r := range res {
+			rows += responseRows(r)
+			r.Warnings = warnings[i]
+		}
+		accesslog.SetRows(ctx, rows)
+		w.Header().Set("Content-Type", "application/json")
+		if !req.slice {
+			json.NewEncoder(w).Encode(res[0])
+			return
+		}
+		json.NewEncoder(w).Encode(transactionResponse{Results: res})
+	}
+}
+
+// CommitHandler commits the transaction of the token.
+func CommitHandler(m *txsession.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := m.Get(r.Context(), r.PathValue("token"), r.PathValue("id")); err != nil {
+			http.Error(w, err.Error(), txStatus(err))
+			return
+		}
+		if err := m.Commit(r.Context(), r.PathValue("token")); err != nil {
+			http.Error(w, err.Error(), txStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RollbackHandler rolls back the transaction of the token.
+func RollbackHandler(m *txsession.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := m.Get(r.Context(), r.PathValue("token"), r.PathValue("id")); err != nil {
+			http.Error(w, err.Error(), txStatus(err))
+			return
+		}
+		if err := m.Rollback(r.Context(), r.PathValue("token")); err != nil {
+			http.Error(w, err.Error(), txStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func txStatus(err error) int {
+	switch {
+	case errors.Is(err, txsession.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, txsession.ErrTooMany):
+		return http.StatusTooManyRequests
+	default:
+		return errorStatus(err)
+	}
+}
@@ -17,6 +17,10 @@ import (
 	"github.com/litesql/go-ha"
 	haconnect "github.com/litesql/go-ha/connect"
 
+	"github.com/litesql/ha/internal/accesslog"
+	"github.com/litesql/ha/internal/audit"
+	"github.com/litesql/ha/internal/querylog"
+	"github.com/litesql/ha/internal/session"
 	"github.com/litesql/ha/internal/sqlite"
 )
 
@@ -27,6 +31,11 @@ type Handler struct {
 	dbProvider            DBProvider
 	connectorProvider     ConnectorProvider
 	createDatabaseOptions sqlite.LoadConfig
+	dbName                string
+	user                  string
+	remote                string
+	// ctx has the span of the statement executing
+	ctx context.Context
 }
 
 type DBProvider func(dbName string) (*sql.DB, bool)
@@ -38,6 +47,7 @@ func (h *Handler) UseDB(dbName string) error {
 	db, ok := h.dbProvider(dbName)
 	if ok {
 		h.db = db
+		h.dbName = dbName
 	}
 	connector, ok := h.connectorProvider(dbName)
 	if ok {
@@ -53,6 +63,17 @@ var (
 )
 
 func (h *Handler) HandleQuery(query string) (*mysql.Result, error) {
+	start := time.Now()
+	span := h.startSpan("mysql query", query)
+	res, err := h.handleQuery(query)
+	h.endSpan(span, err)
+	h.logAccess(query, start, res, err)
+	h.logStatement(query, nil, start, err)
+	h.auditStatement(query, nil, res, err)
+	return res, err
+}
+
+func (h *Handler) handleQuery(query string) (*mysql.Result, error) {
 	slog.Debug("Received: Query", "query", query)
 	cleanQuery := reComments.ReplaceAllString(query, "")
 	keepCaseQuery := strings.TrimSpace(cleanQuery)
@@ -104,6 +125,14 @@ func (h *Handler) HandleQuery(query string) (*mysql.Result, error) {
 		return mysql.NewResult(resultSet), nil
 	}
 
+	if match := reShowCreateTable.FindStringSubmatch(keepCaseQuery); match != nil {
+		return h.showCreateTable(match[1], match[2])
+	}
+
+	if isSelect(cleanQuery) && (reInformationSchema.MatchString(cleanQuery) || reSchemaFunction.MatchString(cleanQuery)) {
+		return h.informationSchema(keepCaseQuery)
+	}
+
 	if strings.HasPrefix(cleanQuery, "CREATE DATABASE ") {
 		if !h.createDatabaseOptions.MemDB && h.createDatabaseOptions.Dir == "" {
 			return nil, fmt.Errorf("create database is disabled, inform flag --create-db-dir at startup")
@@ -234,6 +263,10 @@ func (h *Handler) HandleQuery(query string) (*mysql.Result, error) {
 		return mysql.NewResult(resultSet), nil
 	}
 
+	query, err := h.intercept(query)
+	if err != nil {
+		return nil, err
+	}
 	if isSelect(cleanQuery) {
 		rows, err := h.query(query)
 		if err != nil {
@@ -248,6 +281,9 @@ func (h *Handler) HandleQuery(query string) (*mysql.Result, error) {
 		return mysql.NewResult(resultSet), nil
 	}
 
+	if err := h.checkWritable(query); err != nil {
+		return nil, err
+	}
 	res, err := h.exec(query)
 	if err != nil {
 		slog.Debug("Exec error", "error", err)
@@ -282,6 +318,10 @@ func (h *Handler) HandleStmtPrepare(query string) (int, int, any, error) {
 	if h.db == nil {
 		return 0, 0, nil, fmt.Errorf("no database selected")
 	}
+	query, err := h.intercept(query)
+	if err != nil {
+		return 0, 0, nil, err
+	}
 	stmt, err := h.db.Prepare(query)
 	if err != nil {
 		return 0, 0, nil, err
@@ -295,6 +335,17 @@ func (h *Handler) HandleStmtPrepare(query string) (int, int, any, error) {
 }
 
 func (h *Handler) HandleStmtExecute(context any, query string, args []any) (*mysql.Result, error) {
+	start := time.Now()
+	span := h.startSpan("mysql execute", query)
+	res, err := h.handleStmtExecute(context, query, args)
+	h.endSpan(span, err)
+	h.logAccess(query, start, res, err)
+	h.logStatement(query, args, start, err)
+	h.auditStatement(query, args, res, err)
+	return res, err
+}
+
+func (h *Handler) handleStmtExecute(context any, query string, args []any) (*mysql.Result, error) {
 	slog.Debug("Received: StmtExecute", "query", query, "args", args, "context", context)
 	switch stmt := context.(type) {
 	case *sql.Stmt:
@@ -309,7 +360,14 @@ func (h *Handler) HandleStmtExecute(context any, query string, args []any) (*mys
 			}
 			return mysql.NewResult(resultSet), nil
 		}
-		res, err := stmt.Exec(args...)
+		if err := h.checkWritable(query); err != nil {
+			return nil, err
+		}
+		var res sql.Result
+		err := sqlite.WithIdentity(h.sessionContext(), h.db, func() (err error) {
+			res, err = stmt.Exec(args...)
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -361,6 +419,15 @@ func (r *sqlResult) RowsAffected() (int64, error) {
 	return int64(r.affectedRows), nil
 }
 
+// checkWritable rejects the write statements on a read-only database with the
+// error MySQL returns when running with --read-only.
+func (h *Handler) checkWritable(query string) error {
+	if err := sqlite.CheckWritable(context.Background(), h.dbName, query); err != nil {
+		return mysql.NewError(mysql.ER_OPTION_PREVENTS_STATEMENT, err.Error())
+	}
+	return nil
+}
+
 func (h *Handler) exec(query string) (sql.Result, error) {
 	if strings.HasPrefix(strings.ToUpper(query), "BEGIN") {
 		if h.tx != nil {
@@ -379,7 +446,7 @@ func (h *Handler) exec(query string) (sql.Result, error) {
 		if h.tx == nil {
 			return nil, fmt.Errorf("no transaction started")
 		}
-		err := h.tx.Commit()
+		err := sqlite.Commit(h.sessionContext(), h.db, h.tx)
 		if err != nil {
 			return nil, err
 		}
@@ -404,7 +471,31 @@ func (h *Handler) exec(query string) (sql.Result, error) {
 	if h.db == nil {
 		return nil, fmt.Errorf("no database selected")
 	}
-	return h.db.Exec(query)
+	var res sql.Result
+	err := sqlite.WithIdentity(h.sessionContext(), h.db, func() (err error) {
+		res, err = h.db.Exec(query)
+		return err
+	})
+	return res, err
+}
+
+// sessionContext returns the context of the session statements, with the
+// identity of the user and the span of the statement.
+func (h *Handler) sessionContext() context.Context {
+	ctx := h.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return session.NewContext(ctx, session.Identity{User: h.user, Protocol: "mysql"})
+}
+
+// intercept returns the statement to execute for the session user.
+func (h *Handler) intercept(query string) (string, error) {
+	query, err := sqlite.InterceptQuery(h.sessionContext(), h.dbName, query)
+	if err != nil {
+		return "", mysql.NewError(mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR, err.Error())
+	}
+	return query, nil
 }
 
 func (h *Handler) query(query string) (*sql.Rows, error) {
@@ -417,6 +508,84 @@ func (h *Handler) query(query string) (*sql.Rows, error) {
 	return h.db.Query(query)
 }
 
+func (h *Handler) logAccess(query string, start time.Time, res *mysql.Result, err error) {
+	if !accesslog.Enabled() {
+		return
+	}
+	entry := accesslog.Entry{
+		Protocol: "mysql",
+		Database: h.dbName,
+		User:     h.user,
+		Remote:   h.remote,
+		Status:   "OK",
+		Duration: time.Since(start),
+		Error:    err,
+	}
+	if fields := strings.Fields(query); len(fields) > 0 {
+		entry.Method = strings.ToUpper(strings.TrimSuffix(fields[0], ";"))
+	}
+	if err != nil {
+		entry.Status = "ERROR"
+	}
+	if res != nil {
+		if res.Resultset != nil {
+			entry.Rows = int64(len(res.Resultset.RowDatas))
+		} else {
+			entry.Rows = int64(res.AffectedRows)
+		}
+	}
+	accesslog.Log(entry)
+}
+
+func (h *Handler) logStatement(query string, args []any, start time.Time, err error) {
+	sqlite.AfterQuery(h.sessionContext(), h.dbName, query, err)
+	if !querylog.Enabled() {
+		return
+	}
+	querylog.Log(querylog.Entry{
+		Protocol: "mysql",
+		Database: h.dbName,
+		User:     h.user,
+		Remote:   h.remote,
+		SQL:      query,
+		Params:   args,
+		Duration: time.Since(start),
+		Error:    err,
+	})
+}
+
+func (h *Handler) auditStatement(query string, args []any, res *mysql.Result, err error) {
+	if !audit.Enabled() {
+		return
+	}
+	entry := audit.Entry{
+		Protocol: "mysql",
+		Database: h.dbName,
+		User:     h.user,
+		Remote:   h.remote,
+		SQL:      query,
+		Error:    audit.ErrorString(err),
+	}
+	if len(args) > 0 {
+		entry.Params = args
+	}
+	if res != nil {
+		if res.Resultset != nil {
+			entry.RowsAffected = int64(len(res.Resultset.RowDatas))
+		} else {
+			entry.RowsAffected = int64(res.AffectedRows)
+		}
+	}
+	audit.Record(entry)
+}
+
+func (h *Handler) closeTx() {
+	if h.tx != nil {
+		h.tx.Rollback()
+		h.tx = nil
+	}
+}
+
 func rowsToResultset(rows *sql.Rows, binary bool) (*mysql.Resultset, error) {
 	defer rows.Close()
 	cols, err := rows.Columns()
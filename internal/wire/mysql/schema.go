@@ -0,0 +1,378 @@
+package mysql
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+var (
+	// reInformationSchema matches the statements reading INFORMATION_SCHEMA,
+	// they run on a catalog built from the SQLite schema of the databases.
+	reInformationSchema = regexp.MustCompile(`(?i)\binformation_schema\b`)
+	reSchemaFunction    = regexp.MustCompile(`(?i)\b(DATABASE|SCHEMA)\(\s*\)`)
+	reShowCreateTable   = regexp.MustCompile("(?i)^SHOW\\s+CREATE\\s+(?:TABLE|VIEW)\\s+(?:`?([^`.\\s]+)`?\\.)?`?([^`;\\s]+)`?\\s*;?$")
+	reTypeLength        = regexp.MustCompile(`\(\s*(\d+)`)
+)
+
+// informationSchemaTables are the INFORMATION_SCHEMA tables with the columns
+// read by the migration tools. The routines, triggers and events are always
+// empty.
+var informationSchemaTables = []string{
+	`ATTACH DATABASE ':memory:' AS information_schema`,
+	`CREATE TABLE information_schema.SCHEMATA(CATALOG_NAME TEXT, SCHEMA_NAME TEXT, DEFAULT_CHARACTER_SET_NAME TEXT, DEFAULT_COLLATION_NAME TEXT, SQL_PATH TEXT, DEFAULT_ENCRYPTION TEXT)`,
+	`CREATE TABLE information_schema.TABLES(TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT, TABLE_TYPE TEXT, ENGINE TEXT, VERSION INTEGER, ROW_FORMAT TEXT, TABLE_ROWS INTEGER, AVG_ROW_LENGTH INTEGER, DATA_LENGTH INTEGER, MAX_DATA_LENGTH INTEGER, INDEX_LENGTH INTEGER, DATA_FREE INTEGER, AUTO_INCREMENT INTEGER, CREATE_TIME TEXT, UPDATE_TIME TEXT, CHECK_TIME TEXT, TABLE_COLLATION TEXT, CHECKSUM INTEGER, CREATE_OPTIONS TEXT, TABLE_COMMENT TEXT)`,
+	`CREATE TABLE information_schema.COLUMNS(TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT, COLUMN_NAME TEXT, ORDINAL_POSITION INTEGER, COLUMN_DEFAULT TEXT, IS_NULLABLE TEXT, DATA_TYPE TEXT, CHARACTER_MAXIMUM_LENGTH INTEGER, CHARACTER_OCTET_LENGTH INTEGER, NUMERIC_PRECISION INTEGER, NUMERIC_SCALE INTEGER, DATETIME_PRECISION INTEGER, CHARACTER_SET_NAME TEXT, COLLATION_NAME TEXT, COLUMN_TYPE TEXT, COLUMN_KEY TEXT, EXTRA TEXT, PRIVILEGES TEXT, COLUMN_COMMENT TEXT, GENERATION_EXPRESSION TEXT, SRS_ID INTEGER)`,
+	`CREATE TABLE information_schema.STATISTICS(TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT, NON_UNIQUE INTEGER, INDEX_SCHEMA TEXT, INDEX_NAME TEXT, SEQ_IN_INDEX INTEGER, COLUMN_NAME TEXT, COLLATION TEXT, CARDINALITY INTEGER, SUB_PART INTEGER, PACKED TEXT, NULLABLE TEXT, INDEX_TYPE TEXT, COMMENT TEXT, INDEX_COMMENT TEXT, IS_VISIBLE TEXT, EXPRESSION TEXT)`,
+	`CREATE TABLE information_schema.TABLE_CONSTRAINTS(CONSTRAINT_CATALOG TEXT, CONSTRAINT_SCHEMA TEXT, CONSTRAINT_NAME TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT, CONSTRAINT_TYPE TEXT, ENFORCED TEXT)`,
+	`CREATE TABLE information_schema.KEY_COLUMN_USAGE(CONSTRAINT_CATALOG TEXT, CONSTRAINT_SCHEMA TEXT, CONSTRAINT_NAME TEXT, TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT, COLUMN_NAME TEXT, ORDINAL_POSITION INTEGER, POSITION_IN_UNIQUE_CONSTRAINT INTEGER, REFERENCED_TABLE_SCHEMA TEXT, REFERENCED_TABLE_NAME TEXT, REFERENCED_COLUMN_NAME TEXT)`,
+	`CREATE TABLE information_schema.VIEWS(TABLE_CATALOG TEXT, TABLE_SCHEMA TEXT, TABLE_NAME TEXT, VIEW_DEFINITION TEXT, CHECK_OPTION TEXT, IS_UPDATABLE TEXT, DEFINER TEXT, SECURITY_TYPE TEXT, CHARACTER_SET_CLIENT TEXT, COLLATION_CONNECTION TEXT)`,
+	`CREATE TABLE information_schema.ROUTINES(SPECIFIC_NAME TEXT, ROUTINE_CATALOG TEXT, ROUTINE_SCHEMA TEXT, ROUTINE_NAME TEXT, ROUTINE_TYPE TEXT, DATA_TYPE TEXT, ROUTINE_DEFINITION TEXT, DEFINER TEXT)`,
+	`CREATE TABLE information_schema.TRIGGERS(TRIGGER_CATALOG TEXT, TRIGGER_SCHEMA TEXT, TRIGGER_NAME TEXT, EVENT_MANIPULATION TEXT, EVENT_OBJECT_SCHEMA TEXT, EVENT_OBJECT_TABLE TEXT, ACTION_STATEMENT TEXT, ACTION_TIMING TEXT, DEFINER TEXT)`,
+	`CREATE TABLE information_schema.EVENTS(EVENT_CATALOG TEXT, EVENT_SCHEMA TEXT, EVENT_NAME TEXT, DEFINER TEXT, EVENT_DEFINITION TEXT, STATUS TEXT)`,
+}
+
+// informationSchema runs the query on the INFORMATION_SCHEMA of all the
+// databases, DATABASE() is the current one.
+func (h *Handler) informationSchema(query string) (*mysql.Result, error) {
+	ctx := context.Background()
+	db, err := sqlite.OpenMemory()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for _, stmt := range informationSchemaTables {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+	databases := sqlite.Databases()
+	slices.Sort(databases)
+	for _, id := range databases {
+		source, err := sqlite.DB(id)
+		if err != nil {
+			continue
+		}
+		tables, err := sqlite.Schema(ctx, source)
+		if err != nil {
+			return nil, fmt.Errorf("schema of %q: %w", id, err)
+		}
+		if err := writeInformationSchema(ctx, conn, id, tables); err != nil {
+			return nil, err
+		}
+	}
+
+	current := "NULL"
+	if h.dbName != "" {
+		current = "'" + strings.ReplaceAll(h.dbName, "'", "''") + "'"
+	}
+	rows, err := conn.QueryContext(ctx, reSchemaFunction.ReplaceAllLiteralString(query, current))
+	if err != nil {
+		return nil, err
+	}
+	resultSet, err := rowsToResultset(rows, false)
+	if err != nil {
+		return nil, err
+	}
+	return mysql.NewResult(resultSet), nil
+}
+
+func writeInformationSchema(ctx context.Context, conn *sql.Conn, schema string, tables []sqlite.Table) error {
+	var err error
+	insert := func(table string, values ...any) {
+		if err != nil {
+			return
+		}
+		_, err = conn.ExecContext(ctx, "INSERT INTO information_schema."+table+" VALUES ("+strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")+")", values...)
+	}
+	insert("SCHEMATA", "def", schema, "utf8mb4", "utf8mb4_bin", nil, "NO")
+	for _, t := range tables {
+		if t.Type == "view" {
+			insert("TABLES", "def", schema, t.Name, "VIEW", nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, "VIEW")
+			insert("VIEWS", "def", schema, t.Name, viewDefinition(t.SQL), "NONE", "NO", "", "DEFINER", "utf8mb4", "utf8mb4_bin")
+		} else {
+			insert("TABLES", "def", schema, t.Name, "BASE TABLE", "InnoDB", 10, "Dynamic", 0, 0, 0, 0, 0, 0, nil, nil, nil, nil, "utf8mb4_bin", nil, "", "")
+		}
+		keys := columnKeys(t)
+		for i, col := range t.Columns {
+			columnType, dataType := mysqlType(col.Type)
+			nullable := "YES"
+			if col.NotNull || col.PrimaryKey > 0 {
+				nullable = "NO"
+			}
+			var length any
+			if m := reTypeLength.FindStringSubmatch(columnType); m != nil && strings.Contains(dataType, "char") {
+				length, _ = strconv.Atoi(m[1])
+			}
+			var dflt any
+			if col.Default != nil {
+				dflt = unquote(*col.Default)
+			}
+			insert("COLUMNS", "def", schema, t.Name, col.Name, i+1, dflt, nullable, dataType, length, length, nil, nil, nil, nil, nil,
+				columnType, keys[col.Name], extra(t, col), "select,insert,update,references", "", "", nil)
+		}
+		for _, index := range indexes(t) {
+			nonUnique := 1
+			if index.Unique {
+				nonUnique = 0
+			}
+			for i, column := range index.Columns {
+				insert("STATISTICS", "def", schema, t.Name, nonUnique, schema, index.Name, i+1, column, "A", 0, nil, nil, "YES", "BTREE", "", "", "YES", nil)
+			}
+			if !index.Unique {
+				continue
+			}
+			kind := "UNIQUE"
+			if index.Origin == "pk" {
+				kind = "PRIMARY KEY"
+			}
+			if index.Origin == "pk" || index.Origin == "u" {
+				insert("TABLE_CONSTRAINTS", "def", schema, index.Name, schema, t.Name, kind, "YES")
+				for i, column := range index.Columns {
+					insert("KEY_COLUMN_USAGE", "def", schema, index.Name, "def", schema, t.Name, column, i+1, nil, nil, nil, nil)
+				}
+			}
+		}
+		for i, fk := range t.ForeignKeys {
+			name := foreignKeyName(t, i)
+			insert("TABLE_CONSTRAINTS", "def", schema, name, schema, t.Name, "FOREIGN KEY", "YES")
+			references := referencedColumns(tables, fk)
+			for j, column := range fk.Columns {
+				insert("KEY_COLUMN_USAGE", "def", schema, name, "def", schema, t.Name, column, j+1, j+1, schema, fk.Table, references[j])
+			}
+		}
+	}
+	return err
+}
+
+// showCreateTable synthesizes the MySQL CREATE TABLE (or VIEW) statement of
+// the table from its SQLite schema, for the dump and migration tools.
+func (h *Handler) showCreateTable(schema, name string) (*mysql.Result, error) {
+	schema = strings.Trim(schema, "`")
+	db := h.db
+	if schema != "" && schema != h.dbName {
+		var ok bool
+		db, ok = h.dbProvider(schema)
+		if !ok {
+			return nil, mysql.NewError(mysql.ER_BAD_DB_ERROR, fmt.Sprintf("Unknown database '%s'", schema))
+		}
+	}
+	if db == nil {
+		return nil, mysql.NewError(mysql.ER_NO_DB_ERROR, "No database selected")
+	}
+	tables, err := sqlite.Schema(context.Background(), db)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(tables, func(t sqlite.Table) bool { return strings.EqualFold(t.Name, name) })
+	if i < 0 {
+		return nil, mysql.NewError(mysql.ER_NO_SUCH_TABLE, fmt.Sprintf("Table '%s.%s' doesn't exist", cmp.Or(schema, h.dbName), name))
+	}
+	t := tables[i]
+	var resultSet *mysql.Resultset
+	if t.Type == "view" {
+		resultSet, err = mysql.BuildSimpleResultset([]string{"View", "Create View", "character_set_client", "collation_connection"}, [][]any{
+			{t.Name, fmt.Sprintf("CREATE VIEW %s AS %s", quoteIdent(t.Name), viewDefinition(t.SQL)), "utf8mb4", "utf8mb4_bin"},
+		}, false)
+	} else {
+		resultSet, err = mysql.BuildSimpleResultset([]string{"Table", "Create Table"}, [][]any{
+			{t.Name, createTable(tables, t)},
+		}, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mysql.NewResult(resultSet), nil
+}
+
+func createTable(tables []sqlite.Table, t sqlite.Table) string {
+	var lines []string
+	for _, col := range t.Columns {
+		columnType, _ := mysqlType(col.Type)
+		line := quoteIdent(col.Name) + " " + columnType
+		if col.NotNull || col.PrimaryKey > 0 {
+			line += " NOT NULL"
+		}
+		if col.Default != nil {
+			line += " DEFAULT " + *col.Default
+		}
+		if e := extra(t, col); e != "" {
+			line += " " + strings.ToUpper(e)
+		}
+		lines = append(lines, line)
+	}
+	for _, index := range indexes(t) {
+		switch {
+		case index.Origin == "pk":
+			lines = append(lines, fmt.Sprintf("PRIMARY KEY (%s)", quoteIdents(index.Columns)))
+		case index.Unique:
+			lines = append(lines, fmt.Sprintf("UNIQUE KEY %s (%s)", quoteIdent(index.Name), quoteIdents(index.Columns)))
+		default:
+			lines = append(lines, fmt.Sprintf("KEY %s (%s)", quoteIdent(index.Name), quoteIdents(index.Columns)))
+		}
+	}
+	for i, fk := range t.ForeignKeys {
+		line := fmt.Sprintf("CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s)", quoteIdent(foreignKeyName(t, i)),
+			quoteIdents(fk.Columns), quoteIdent(fk.Table), quoteIdents(referencedColumns(tables, fk)))
+		if fk.OnDelete != "" && fk.OnDelete != "NO ACTION" {
+			line += " ON DELETE " + fk.OnDelete
+		}
+		if fk.OnUpdate != "" && fk.OnUpdate != "NO ACTION" {
+			line += " ON UPDATE " + fk.OnUpdate
+		}
+		lines = append(lines, line)
+	}
+	return fmt.Sprintf("CREATE TABLE %s (\n  %s\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4", quoteIdent(t.Name), strings.Join(lines, ",\n  "))
+}
+
+// indexes lists the indexes named like MySQL does, the primary key first as
+// PRIMARY even when it is the rowid. The expression indexes are left out.
+func indexes(t sqlite.Table) []sqlite.Index {
+	var list []sqlite.Index
+	if pk := primaryKey(t); len(pk) > 0 {
+		list = append(list, sqlite.Index{Name: "PRIMARY", Unique: true, Origin: "pk", Columns: pk})
+	}
+	for _, index := range t.Indexes {
+		if index.Origin == "pk" || slices.Contains(index.Columns, "") {
+			continue
+		}
+		if index.Origin == "u" {
+			index.Name = strings.Join(index.Columns, "_")
+		}
+		list = append(list, index)
+	}
+	return list
+}
+
+func primaryKey(t sqlite.Table) []string {
+	columns := slices.Clone(t.Columns)
+	columns = slices.DeleteFunc(columns, func(col sqlite.Column) bool { return col.PrimaryKey == 0 })
+	slices.SortFunc(columns, func(a, b sqlite.Column) int { return a.PrimaryKey - b.PrimaryKey })
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// columnKeys returns the COLUMN_KEY of the first columns of the indexes.
+func columnKeys(t sqlite.Table) map[string]string {
+	keys := make(map[string]string)
+	for _, index := range indexes(t) {
+		first := index.Columns[0]
+		switch {
+		case index.Origin == "pk":
+			keys[first] = "PRI"
+		case index.Unique && len(index.Columns) == 1 && keys[first] == "":
+			keys[first] = "UNI"
+		case keys[first] == "":
+			keys[first] = "MUL"
+		}
+	}
+	return keys
+}
+
+// extra reports the INTEGER PRIMARY KEY as auto_increment, it is the rowid.
+func extra(t sqlite.Table, col sqlite.Column) string {
+	if col.PrimaryKey > 0 && strings.EqualFold(col.Type, "INTEGER") && len(primaryKey(t)) == 1 {
+		return "auto_increment"
+	}
+	return ""
+}
+
+func foreignKeyName(t sqlite.Table, i int) string {
+	return fmt.Sprintf("%s_ibfk_%d", t.Name, i+1)
+}
+
+// referencedColumns resolves the columns of the primary key referenced
+// implicitly.
+func referencedColumns(tables []sqlite.Table, fk sqlite.ForeignKey) []string {
+	references := slices.Clone(fk.References)
+	var pk []string
+	if i := slices.IndexFunc(tables, func(t sqlite.Table) bool { return strings.EqualFold(t.Name, fk.Table) }); i >= 0 {
+		pk = primaryKey(tables[i])
+	}
+	for i, column := range references {
+		if column == "" && i < len(pk) {
+			references[i] = pk[i]
+		}
+	}
+	return references
+}
+
+// mysqlType returns the column type and data type of the SQLite declared
+// type. The types MySQL doesn't know are mapped from the SQLite affinity.
+func mysqlType(declared string) (string, string) {
+	columnType := strings.ToLower(strings.TrimSpace(declared))
+	dataType, _, _ := strings.Cut(columnType, "(")
+	dataType, _, _ = strings.Cut(strings.TrimSpace(dataType), " ")
+	switch dataType {
+	case "integer":
+		return "int" + strings.TrimPrefix(columnType, "integer"), "int"
+	case "real":
+		return "double" + strings.TrimPrefix(columnType, "real"), "double"
+	case "numeric":
+		return "decimal" + strings.TrimPrefix(columnType, "numeric"), "decimal"
+	case "bool", "boolean":
+		return "tinyint(1)", "tinyint"
+	case "tinyint", "smallint", "mediumint", "int", "bigint", "decimal", "float", "double",
+		"bit", "date", "datetime", "timestamp", "time", "year", "char", "varchar", "binary", "varbinary",
+		"tinyblob", "blob", "mediumblob", "longblob", "tinytext", "text", "mediumtext", "longtext", "enum", "set", "json":
+		return columnType, dataType
+	}
+	switch {
+	case strings.Contains(columnType, "int"):
+		return "bigint", "bigint"
+	case strings.Contains(columnType, "char") || strings.Contains(columnType, "clob") || strings.Contains(columnType, "text") || columnType == "":
+		return "text", "text"
+	case strings.Contains(columnType, "blob"):
+		return "blob", "blob"
+	case strings.Contains(columnType, "real") || strings.Contains(columnType, "floa") || strings.Contains(columnType, "doub"):
+		return "double", "double"
+	default:
+		return "decimal", "decimal"
+	}
+}
+
+// viewDefinition returns the SELECT of the CREATE VIEW statement.
+func viewDefinition(ddl string) string {
+	if i := strings.Index(strings.ToUpper(ddl), " AS "); i >= 0 {
+		return strings.TrimSpace(ddl[i+4:])
+	}
+	return ddl
+}
+
+// unquote returns the value of a string literal default, MySQL shows it
+// without quotes.
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func quoteIdents(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdent(name)
+	}
+	return strings.Join(quoted, ",")
+}
@@ -1,10 +1,16 @@
 package mysql
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/go-mysql-org/go-mysql/server"
 	"github.com/litesql/ha/internal/sqlite"
 )
@@ -13,6 +19,8 @@ type Config struct {
 	Port                  int
 	User                  string
 	Pass                  string
+	TLSCert               string
+	TLSKey                string
 	ConnectorProvider     ConnectorProvider
 	DBProvider            DBProvider
 	CreateDatabaseOptions sqlite.LoadConfig
@@ -26,17 +34,36 @@ type Server struct {
 	Pass              string
 
 	createDatabaseOptions sqlite.LoadConfig
+	mysqlServer           *server.Server
 	listener              net.Listener
-	closed                bool
+	closed                atomic.Bool
+	mu                    sync.Mutex
+	conns                 map[net.Conn]struct{}
+	wg                    sync.WaitGroup
 }
 
 func NewServer(cfg Config) (*Server, error) {
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, errors.New("the TLS certificate and key must be set together")
+	}
+	mysqlServer := server.NewDefaultServer()
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		mysqlServer = server.NewServer("8.0.11", gomysql.DEFAULT_COLLATION_ID, gomysql.AUTH_NATIVE_PASSWORD, nil, config)
+	}
 	return &Server{
+		ConnectorProvider:     cfg.ConnectorProvider,
 		DBProvider:            cfg.DBProvider,
 		Port:                  cfg.Port,
 		User:                  cfg.User,
 		Pass:                  cfg.Pass,
 		createDatabaseOptions: cfg.CreateDatabaseOptions,
+		mysqlServer:           mysqlServer,
+		conns:                 make(map[net.Conn]struct{}),
 	}, nil
 }
 
@@ -49,34 +76,50 @@ func (s *Server) ListenAndServe() error {
 
 	go func() {
 		slog.Info("MySQL server listening", "port", s.Port)
-		mysqlServer := server.NewDefaultServer()
 		for {
 			c, err := l.Accept()
 			if err != nil {
-				if s.closed {
+				if s.closed.Load() {
 					return
 				}
 				slog.Error("Accept conn", "error", err)
 				continue
 			}
-
+			s.track(c, true)
+			s.wg.Add(1)
 			go func(c net.Conn) {
+				defer s.wg.Done()
+				defer s.track(c, false)
 				defer c.Close()
 
 				slog.Debug("New mysql connection", "remote", c.RemoteAddr().String())
-				slog.Info("MySQL user/pass", "user", s.User, "pass", s.Pass)
-				conn, err := mysqlServer.NewConn(c, s.User, s.Pass, &Handler{
+				user, pass := s.credentials()
+				h := &Handler{
 					connectorProvider:     s.ConnectorProvider,
 					dbProvider:            s.DBProvider,
 					createDatabaseOptions: s.createDatabaseOptions,
-				})
+					user:                  user,
+					remote:                c.RemoteAddr().String(),
+				}
+				defer h.closeTx()
+				conn, err := s.mysqlServer.NewConn(c, user, pass, h)
 				if err != nil {
 					slog.Error("New conn", "error", err)
 					return
 				}
 				for {
 					if err := conn.HandleCommand(); err != nil {
-						slog.Error("HandleCommand", "error", err)
+						if !s.closed.Load() && !conn.Closed() {
+							slog.Error("HandleCommand", "error", err)
+						}
+						return
+					}
+					if conn.Closed() {
+						return
+					}
+					// shutting down: the connection is released between
+					// transactions
+					if s.closed.Load() && h.tx == nil {
 						return
 					}
 				}
@@ -86,10 +129,71 @@ func (s *Server) ListenAndServe() error {
 	return nil
 }
 
+// SetCredentials replaces the user and password of the new connections, the
+// open ones are kept.
+func (s *Server) SetCredentials(user, pass string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.User, s.Pass = user, pass
+}
+
+func (s *Server) credentials() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.User, s.Pass
+}
+
+func (s *Server) track(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+// Close stops accepting new connections, closes the active ones (rolling back
+// open transactions) and waits for their handlers to finish.
 func (s *Server) Close() error {
-	s.closed = true
-	if s.listener != nil {
-		return s.listener.Close()
+	s.closed.Store(true)
+	if s.listener == nil {
+		return nil
 	}
-	return nil
+	err := s.listener.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Shutdown stops accepting new connections and closes each active one once
+// its current transaction ends. The connections still open when ctx is done
+// are closed like Close does.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return errors.Join(err, ctx.Err())
 }
@@ -0,0 +1,35 @@
+package mysql
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/litesql/ha/internal/tracing"
+)
+
+// startSpan starts the span of the statement, the context of the session
+// statements until endSpan.
+func (h *Handler) startSpan(name, query string) trace.Span {
+	if !tracing.Enabled() {
+		return nil
+	}
+	ctx, span := tracing.StartKind(context.Background(), name, trace.SpanKindServer,
+		attribute.String("db.system.name", "mysql"),
+		attribute.String("db.query.text", query),
+		attribute.String("db.namespace", h.dbName),
+		attribute.String("db.user", h.user),
+		attribute.String("client.address", h.remote),
+	)
+	h.ctx = ctx
+	return span
+}
+
+func (h *Handler) endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	h.ctx = nil
+	tracing.End(span, err)
+}
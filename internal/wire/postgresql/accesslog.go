@@ -0,0 +1,76 @@
+package postgresql
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+
+	"github.com/litesql/ha/internal/accesslog"
+)
+
+type userContextKey struct{}
+
+// accessLogged creates the access log entry of the statement. A statement
+// failing to parse is logged at once, the others by their handler once the
+// statement is executed (newStatement): the queries and the prepared
+// statements run there.
+func accessLogged(parse wire.ParseFn) wire.ParseFn {
+	if !accesslog.Enabled() {
+		return parse
+	}
+	return func(ctx context.Context, sql string) (wire.PreparedStatements, error) {
+		start := time.Now()
+		entry := &accesslog.Entry{
+			Protocol: "postgresql",
+			Method:   statementType(sql),
+		}
+		if id, ok := wire.GetAttribute(ctx, databaseIDAttribute); ok {
+			entry.Database, _ = id.(string)
+		}
+		entry.User, _ = ctx.Value(userContextKey{}).(string)
+		if addr := wire.RemoteAddress(ctx); addr != nil {
+			entry.Remote = addr.String()
+		}
+		stmts, err := parse(accesslog.NewContext(ctx, entry), sql)
+		entry.Duration = time.Since(start)
+		if err != nil {
+			entry.Status = "ERROR"
+			entry.Error = err
+			accesslog.Log(*entry)
+		}
+		return stmts, err
+	}
+}
+
+// newStatement creates the statement logging the access log entry of the
+// parse context after each execution, with the rows set by the handler and
+// the parse time included in the duration.
+func newStatement(ctx context.Context, fn wire.PreparedStatementFn, options ...wire.PreparedOptionFn) *wire.PreparedStatement {
+	entry, ok := accesslog.FromContext(ctx)
+	if !ok {
+		return wire.NewStatement(fn, options...)
+	}
+	return wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		start := time.Now()
+		e := *entry
+		err := fn(accesslog.NewContext(ctx, &e), writer, parameters)
+		e.Duration += time.Since(start)
+		e.Status = "OK"
+		if err != nil {
+			e.Status = "ERROR"
+			e.Error = err
+		}
+		accesslog.Log(e)
+		return err
+	}, options...)
+}
+
+func statementType(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimSuffix(fields[0], ";"))
+}
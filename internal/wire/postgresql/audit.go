@@ -0,0 +1,37 @@
+package postgresql
+
+import (
+	"cmp"
+	"context"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+
+	"github.com/litesql/ha/internal/audit"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// auditStatement records the statement executed for the client of the
+// connection in the audit log.
+func auditStatement(ctx context.Context, sql string, params map[string]any, resp *sqlite.Response, err error) {
+	if !audit.Enabled() {
+		return
+	}
+	entry := audit.Entry{
+		Protocol:     "postgresql",
+		SQL:          sql,
+		RowsAffected: audit.RowsAffected(resp),
+		Error:        audit.ErrorString(err),
+	}
+	if len(params) > 0 {
+		entry.Params = params
+	}
+	if id, ok := wire.GetAttribute(ctx, databaseIDAttribute); ok {
+		entry.Database, _ = id.(string)
+	}
+	entry.Database = cmp.Or(entry.Database, sqlite.DefaultDatabase())
+	entry.User, _ = ctx.Value(userContextKey{}).(string)
+	if addr := wire.RemoteAddress(ctx); addr != nil {
+		entry.Remote = addr.String()
+	}
+	audit.Record(entry)
+}
@@ -0,0 +1,574 @@
+package postgresql
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/jeroenrinzema/psql-wire/pkg/buffer"
+	"github.com/jeroenrinzema/psql-wire/pkg/types"
+
+	"github.com/litesql/ha/internal/clusterconfig"
+	"github.com/litesql/ha/internal/session"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// Authentication methods announced to the clients.
+const (
+	AuthPassword    = "password"
+	AuthMD5         = "md5"
+	AuthSCRAMSHA256 = "scram-sha-256"
+)
+
+// UsersTable is read by UsersFromTable.
+const UsersTable = "ha_pg_users"
+
+// User is a PostgreSQL login. Password is the clear text password, the
+// "md5" prefixed hash of password+name or a SCRAM-SHA-256 secret in the
+// PostgreSQL pg_authid format.
+type User struct {
+	Name      string
+	Password  string
+	Databases []string
+}
+
+// allowed reports whether the user may use the database, no databases means
+// every database.
+func (u *User) allowed(id string) bool {
+	return len(u.Databases) == 0 || slices.Contains(u.Databases, id)
+}
+
+// Users looks up a login by name, a nil user means not found.
+type Users func(ctx context.Context, name string) (*User, error)
+
+// StaticUser is the single --pg-user/--pg-pass login.
+func StaticUser(name, password string) Users {
+	return func(_ context.Context, user string) (*User, error) {
+		if user != name {
+			return nil, nil
+		}
+		return &User{Name: name, Password: password}, nil
+	}
+}
+
+// ReloadableUsers looks the logins up in the Users last set, replaced when
+// the configuration is reloaded. The connections already authenticated are
+// kept.
+type ReloadableUsers struct {
+	users atomic.Pointer[Users]
+}
+
+func NewReloadableUsers(users Users) *ReloadableUsers {
+	r := new(ReloadableUsers)
+	r.Set(users)
+	return r
+}
+
+func (r *ReloadableUsers) Set(users Users) {
+	r.users.Store(&users)
+}
+
+func (r *ReloadableUsers) Lookup(ctx context.Context, name string) (*User, error) {
+	return (*r.users.Load())(ctx, name)
+}
+
+// Verify reports whether password is the one of the login name, in any of
+// the stored formats.
+func (r *ReloadableUsers) Verify(ctx context.Context, name, password string) bool {
+	user, err := r.Lookup(ctx, name)
+	return err == nil && user != nil && checkPassword(user, password)
+}
+
+// UsersFromFile reads one login per line with the name, the password and an
+// optional comma separated list of databases, separated by white space.
+// Empty lines and lines starting with # are ignored.
+func UsersFromFile(path string) (Users, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(f)
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected name, password and optional databases", path, line)
+		}
+		user := &User{Name: fields[0], Password: fields[1]}
+		if len(fields) == 3 {
+			user.Databases = splitDatabases(fields[2])
+		}
+		users[user.Name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return func(_ context.Context, name string) (*User, error) {
+		return users[name], nil
+	}, nil
+}
+
+// UsersFromTable reads the logins from the ha_pg_users table of the database,
+// so they are replicated to every node like any other row.
+func UsersFromTable(id string) Users {
+	return func(ctx context.Context, name string) (*User, error) {
+		db, err := sqlite.DB(id)
+		if err != nil {
+			return nil, err
+		}
+		user := User{Name: name}
+		var databases sql.NullString
+		err = db.QueryRowContext(ctx, "SELECT password, databases FROM "+UsersTable+" WHERE name = ?", name).Scan(&user.Password, &databases)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		user.Databases = splitDatabases(databases.String)
+		return &user, nil
+	}
+}
+
+// UsersConfigPrefix is followed by the login name in the cluster config keys,
+// the value is {"password": "...", "databases": ["..."]}.
+const UsersConfigPrefix = "pg.users."
+
+// UsersFromConfig looks the logins up in the cluster config before next, so
+// they can be changed at runtime through the /config API of any node.
+func UsersFromConfig(store *clusterconfig.Store, next Users) Users {
+	return func(ctx context.Context, name string) (*User, error) {
+		entry, ok := store.Get(UsersConfigPrefix + name)
+		if !ok {
+			return next(ctx, name)
+		}
+		var user struct {
+			Password  string   `json:"password"`
+			Databases []string `json:"databases"`
+		}
+		if err := json.Unmarshal(entry.Value, &user); err != nil {
+			return nil, fmt.Errorf("config %q: %w", entry.Key, err)
+		}
+		return &User{Name: name, Password: user.Password, Databases: user.Databases}, nil
+	}
+}
+
+func splitDatabases(list string) []string {
+	var databases []string
+	for id := range strings.SplitSeq(list, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			databases = append(databases, id)
+		}
+	}
+	return databases
+}
+
+func authStrategy(method string, users Users) (wire.AuthStrategy, error) {
+	switch method {
+	case "", AuthPassword:
+		return wire.ClearTextPassword(func(ctx context.Context, database, username, password string) (context.Context, bool, error) {
+			user, err := users(ctx, username)
+			if err != nil {
+				return ctx, false, err
+			}
+			if user == nil || !checkPassword(user, password) {
+				return ctx, false, nil
+			}
+			return authenticated(ctx, database, user), true, nil
+		}), nil
+	case AuthMD5:
+		return md5Auth(users), nil
+	case AuthSCRAMSHA256:
+		return scramAuth(users), nil
+	default:
+		return nil, fmt.Errorf("unsupported authentication method %q, use %s, %s or %s", method, AuthPassword, AuthMD5, AuthSCRAMSHA256)
+	}
+}
+
+func authenticated(ctx context.Context, database string, user *User) context.Context {
+	slog.InfoContext(ctx, "pg-wire: authenticated", "database", database, "user", user.Name, "remote", wire.RemoteAddress(ctx))
+	ctx = context.WithValue(ctx, userContextKey{}, user.Name)
+	ctx = newSessionContext(ctx, user.Name)
+	ctx = session.NewContext(ctx, session.Identity{User: user.Name, Protocol: "postgresql"})
+	return context.WithValue(ctx, grantsContextKey{}, user)
+}
+
+type grantsContextKey struct{}
+
+// checkAccess returns an insufficient privilege error if the session user
+// may not use the database.
+func checkAccess(ctx context.Context, id string) error {
+	user, _ := ctx.Value(grantsContextKey{}).(*User)
+	if user == nil {
+		return nil
+	}
+	if id == "" {
+		id = sqlite.DefaultDatabase()
+	}
+	if user.allowed(id) {
+		return nil
+	}
+	return psqlerr.WithCode(fmt.Errorf("permission denied for database %q", id), codes.InsufficientPrivilege)
+}
+
+// unrestricted reports whether the session user may use every database.
+func unrestricted(ctx context.Context) bool {
+	user, _ := ctx.Value(grantsContextKey{}).(*User)
+	return user == nil || len(user.Databases) == 0
+}
+
+const (
+	authOK           int32 = 0
+	authMD5Password  int32 = 5
+	authSASL         int32 = 10
+	authSASLContinue int32 = 11
+	authSASLFinal    int32 = 12
+)
+
+const (
+	scramSHA256     = "SCRAM-SHA-256"
+	scramIterations = 4096
+	scramSaltLen    = 16
+)
+
+func writeAuth(writer *buffer.Writer, status int32, data []byte) error {
+	writer.Start(types.ServerAuth)
+	writer.AddInt32(status)
+	if data != nil {
+		writer.AddBytes(data)
+	}
+	return writer.End()
+}
+
+func authFailed(writer *buffer.Writer, username string) error {
+	err := psqlerr.WithSeverity(psqlerr.WithCode(fmt.Errorf("password authentication failed for user %q", username), codes.InvalidPassword), psqlerr.LevelFatal)
+	if writeErr := wire.WriteUnterminatedError(writer, err); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+func readPassword(reader *buffer.Reader) error {
+	t, _, err := reader.ReadTypedMsg()
+	if err != nil {
+		return err
+	}
+	if t != types.ClientPassword {
+		return errors.New("unexpected password message")
+	}
+	return nil
+}
+
+func md5Auth(users Users) wire.AuthStrategy {
+	return func(ctx context.Context, writer *buffer.Writer, reader *buffer.Reader) (context.Context, error) {
+		params := wire.ClientParameters(ctx)
+		username := params[wire.ParamUsername]
+		salt := make([]byte, 4)
+		rand.Read(salt)
+		if err := writeAuth(writer, authMD5Password, salt); err != nil {
+			return ctx, err
+		}
+		if err := readPassword(reader); err != nil {
+			return ctx, err
+		}
+		response, err := reader.GetString()
+		if err != nil {
+			return ctx, err
+		}
+		user, err := users(ctx, username)
+		if err != nil {
+			return ctx, err
+		}
+		if user == nil {
+			return ctx, authFailed(writer, username)
+		}
+		hash, ok := md5Hash(user)
+		if !ok {
+			slog.WarnContext(ctx, "pg-wire: md5 authentication needs a clear text or md5 password", "user", username)
+			return ctx, authFailed(writer, username)
+		}
+		sum := md5.Sum(append([]byte(hash[len("md5"):]), salt...))
+		if subtle.ConstantTimeCompare([]byte(response), []byte("md5"+hex.EncodeToString(sum[:]))) != 1 {
+			return ctx, authFailed(writer, username)
+		}
+		return authenticated(ctx, params[wire.ParamDatabase], user), writeAuth(writer, authOK, nil)
+	}
+}
+
+// md5Hash returns the "md5" prefixed hash of password+name stored by
+// PostgreSQL, it can't be derived from a SCRAM secret.
+func md5Hash(user *User) (string, bool) {
+	if isMD5(user.Password) {
+		return user.Password, true
+	}
+	if _, ok := parseSCRAMSecret(user.Password); ok {
+		return "", false
+	}
+	sum := md5.Sum([]byte(user.Password + user.Name))
+	return "md5" + hex.EncodeToString(sum[:]), true
+}
+
+func isMD5(password string) bool {
+	if len(password) != 35 || !strings.HasPrefix(password, "md5") {
+		return false
+	}
+	_, err := hex.DecodeString(password[3:])
+	return err == nil
+}
+
+// checkPassword validates a clear text password against any stored format.
+func checkPassword(user *User, password string) bool {
+	if secret, ok := parseSCRAMSecret(user.Password); ok {
+		derived := newSCRAMSecret(password, secret.salt, secret.iterations)
+		return hmac.Equal(derived.storedKey, secret.storedKey)
+	}
+	if isMD5(user.Password) {
+		sum := md5.Sum([]byte(password + user.Name))
+		return subtle.ConstantTimeCompare([]byte(user.Password[3:]), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+}
+
+type scramSecret struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// parseSCRAMSecret parses SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>.
+func parseSCRAMSecret(s string) (scramSecret, bool) {
+	var secret scramSecret
+	rest, ok := strings.CutPrefix(s, scramSHA256+"$")
+	if !ok {
+		return secret, false
+	}
+	params, keys, ok := strings.Cut(rest, "$")
+	if !ok {
+		return secret, false
+	}
+	iterations, salt, ok1 := strings.Cut(params, ":")
+	storedKey, serverKey, ok2 := strings.Cut(keys, ":")
+	if !ok1 || !ok2 {
+		return secret, false
+	}
+	var err error
+	if secret.iterations, err = strconv.Atoi(iterations); err != nil || secret.iterations <= 0 {
+		return secret, false
+	}
+	if secret.salt, err = base64.StdEncoding.DecodeString(salt); err != nil {
+		return secret, false
+	}
+	if secret.storedKey, err = base64.StdEncoding.DecodeString(storedKey); err != nil || len(secret.storedKey) != sha256.Size {
+		return secret, false
+	}
+	if secret.serverKey, err = base64.StdEncoding.DecodeString(serverKey); err != nil || len(secret.serverKey) != sha256.Size {
+		return secret, false
+	}
+	return secret, true
+}
+
+func newSCRAMSecret(password string, salt []byte, iterations int) scramSecret {
+	salted, _ := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return scramSecret{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  hmacSHA256(salted, "Server Key"),
+	}
+}
+
+// SCRAMSecret returns the secret to store instead of the clear text password
+// in the users file or table.
+func SCRAMSecret(password string) string {
+	salt := make([]byte, scramSaltLen)
+	rand.Read(salt)
+	return newSCRAMSecret(password, salt, scramIterations).String()
+}
+
+// StoredPassword returns the password to store for a login checked with the
+// authentication method: the md5 hash for md5, a SCRAM secret otherwise.
+func StoredPassword(method, name, password string) string {
+	if method == AuthMD5 {
+		if hash, ok := md5Hash(&User{Name: name, Password: password}); ok {
+			return hash
+		}
+		return password
+	}
+	if _, ok := parseSCRAMSecret(password); ok || isMD5(password) {
+		return password
+	}
+	return SCRAMSecret(password)
+}
+
+func (s scramSecret) String() string {
+	enc := base64.StdEncoding
+	return fmt.Sprintf("%s$%d:%s$%s:%s", scramSHA256, s.iterations, enc.EncodeToString(s.salt), enc.EncodeToString(s.storedKey), enc.EncodeToString(s.serverKey))
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramAuth implements the server side of RFC 5802 with SHA-256, without
+// channel binding.
+func scramAuth(users Users) wire.AuthStrategy {
+	return func(ctx context.Context, writer *buffer.Writer, reader *buffer.Reader) (context.Context, error) {
+		params := wire.ClientParameters(ctx)
+		username := params[wire.ParamUsername]
+		if err := writeAuth(writer, authSASL, []byte(scramSHA256+"\x00\x00")); err != nil {
+			return ctx, err
+		}
+
+		if err := readPassword(reader); err != nil {
+			return ctx, err
+		}
+		mechanism, err := reader.GetString()
+		if err != nil {
+			return ctx, err
+		}
+		if mechanism != scramSHA256 {
+			return ctx, fmt.Errorf("unsupported SASL mechanism %q", mechanism)
+		}
+		size, err := reader.GetInt32()
+		if err != nil {
+			return ctx, err
+		}
+		clientFirst, err := reader.GetBytes(int(size))
+		if err != nil {
+			return ctx, err
+		}
+		gs2Header, clientFirstBare, clientNonce, err := parseClientFirst(string(clientFirst))
+		if err != nil {
+			return ctx, err
+		}
+
+		user, err := users(ctx, username)
+		if err != nil {
+			return ctx, err
+		}
+		var (
+			secret scramSecret
+			known  bool
+		)
+		if user != nil {
+			if secret, known = parseSCRAMSecret(user.Password); !known && !isMD5(user.Password) {
+				secret, known = newSCRAMSecret(user.Password, derivedSalt(username), scramIterations), true
+			}
+			if !known {
+				slog.WarnContext(ctx, "pg-wire: scram-sha-256 authentication needs a clear text password or a SCRAM secret", "user", username)
+			}
+		}
+		if !known {
+			// finish the exchange with a made up secret, so unknown users
+			// can't be told apart from a wrong password
+			secret = newSCRAMSecret(rand.Text(), derivedSalt(username), scramIterations)
+		}
+
+		nonce := make([]byte, 18)
+		rand.Read(nonce)
+		serverNonce := clientNonce + base64.StdEncoding.EncodeToString(nonce)
+		serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", serverNonce, base64.StdEncoding.EncodeToString(secret.salt), secret.iterations)
+		if err := writeAuth(writer, authSASLContinue, []byte(serverFirst)); err != nil {
+			return ctx, err
+		}
+
+		if err := readPassword(reader); err != nil {
+			return ctx, err
+		}
+		clientFinal := string(reader.Msg)
+		withoutProof, proof, ok := strings.Cut(clientFinal, ",p=")
+		if !ok {
+			return ctx, errors.New("malformed SCRAM client-final-message")
+		}
+		attrs := scramAttributes(withoutProof)
+		if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(gs2Header)) || attrs["r"] != serverNonce {
+			return ctx, authFailed(writer, username)
+		}
+		clientProof, err := base64.StdEncoding.DecodeString(proof)
+		if err != nil || len(clientProof) != sha256.Size {
+			return ctx, authFailed(writer, username)
+		}
+
+		authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+		clientSignature := hmacSHA256(secret.storedKey, authMessage)
+		clientKey := make([]byte, sha256.Size)
+		subtle.XORBytes(clientKey, clientProof, clientSignature)
+		storedKey := sha256.Sum256(clientKey)
+		if !known || !hmac.Equal(storedKey[:], secret.storedKey) {
+			return ctx, authFailed(writer, username)
+		}
+
+		serverSignature := hmacSHA256(secret.serverKey, authMessage)
+		if err := writeAuth(writer, authSASLFinal, []byte("v="+base64.StdEncoding.EncodeToString(serverSignature))); err != nil {
+			return ctx, err
+		}
+		return authenticated(ctx, params[wire.ParamDatabase], user), writeAuth(writer, authOK, nil)
+	}
+}
+
+// derivedSalt returns a stable salt for the logins without a stored SCRAM
+// secret, a random one would change on every attempt.
+func derivedSalt(username string) []byte {
+	sum := sha256.Sum256([]byte("ha-pg-scram:" + username))
+	return sum[:scramSaltLen]
+}
+
+// parseClientFirst splits the client-first-message, the username is taken
+// from the startup parameters as PostgreSQL does.
+func parseClientFirst(msg string) (gs2Header, bare, nonce string, err error) {
+	cbind, rest, ok := strings.Cut(msg, ",")
+	if !ok || (cbind != "n" && cbind != "y") {
+		return "", "", "", fmt.Errorf("unsupported SCRAM channel binding %q", cbind)
+	}
+	authzid, bare, ok := strings.Cut(rest, ",")
+	if !ok || authzid != "" {
+		return "", "", "", errors.New("malformed SCRAM client-first-message")
+	}
+	nonce = scramAttributes(bare)["r"]
+	if nonce == "" {
+		return "", "", "", errors.New("missing SCRAM client nonce")
+	}
+	return cbind + "," + authzid + ",", bare, nonce, nil
+}
+
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for attr := range strings.SplitSeq(msg, ",") {
+		if k, v, ok := strings.Cut(attr, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
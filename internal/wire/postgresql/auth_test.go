@@ -0,0 +1,94 @@
+package postgresql_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/litesql/ha/internal/wire/postgresql"
+)
+
+func TestAuth(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	users := fmt.Sprintf(`# name password databases
+admin %s
+app md56a422f785c9e20873908ce25d1736ae2
+report secret other.db
+`, postgresql.SCRAMSecret("admin-pass"))
+	if err := os.WriteFile(usersFile, []byte(users), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	lookup, err := postgresql.UsersFromFile(usersFile)
+	if err != nil {
+		t.Fatalf("failed to load users: %v", err)
+	}
+
+	tests := []struct {
+		method   string
+		user     string
+		password string
+		wantCode string
+	}{
+		{method: postgresql.AuthPassword, user: "admin", password: "admin-pass"},
+		{method: postgresql.AuthPassword, user: "app", password: "secret"},
+		{method: postgresql.AuthPassword, user: "app", password: "wrong", wantCode: "28P01"},
+		{method: postgresql.AuthMD5, user: "app", password: "secret"},
+		{method: postgresql.AuthMD5, user: "report", password: "secret", wantCode: "42501"},
+		{method: postgresql.AuthMD5, user: "admin", password: "admin-pass", wantCode: "28P01"},
+		{method: postgresql.AuthMD5, user: "unknown", password: "secret", wantCode: "28P01"},
+		{method: postgresql.AuthSCRAMSHA256, user: "admin", password: "admin-pass"},
+		{method: postgresql.AuthSCRAMSHA256, user: "admin", password: "wrong", wantCode: "28P01"},
+		{method: postgresql.AuthSCRAMSHA256, user: "report", password: "secret", wantCode: "42501"},
+		{method: postgresql.AuthSCRAMSHA256, user: "unknown", password: "secret", wantCode: "28P01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+"/"+tt.user+"/"+tt.password, func(t *testing.T) {
+			listener, err := net.Listen("tcp", ":0")
+			if err != nil {
+				t.Fatalf("failed to create listener: %v", err)
+			}
+			defer listener.Close()
+
+			server, err := postgresql.NewServer(postgresql.Config{
+				Auth:  tt.method,
+				Users: lookup,
+			})
+			if err != nil {
+				t.Fatalf("failed to create server: %v", err)
+			}
+			defer server.Shutdown(context.TODO())
+			go server.Serve(listener)
+
+			port := listener.Addr().(*net.TCPAddr).Port
+			connString := fmt.Sprintf("postgresql://%s:%s@localhost:%d/ha?sslmode=disable", tt.user, tt.password, port)
+			var code string
+			conn, err := pgx.Connect(context.TODO(), connString)
+			if err == nil {
+				defer conn.Close(context.TODO())
+				// the columns are sent as text
+				var one string
+				err = conn.QueryRow(context.TODO(), "SELECT 1").Scan(&one)
+			}
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				code = pgErr.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("got SQLSTATE %q (%v), want %q", code, err, tt.wantCode)
+			}
+		})
+	}
+
+	if _, err := postgresql.NewServer(postgresql.Config{Auth: "trust"}); err == nil {
+		t.Error("unsupported method: want error")
+	}
+}
@@ -0,0 +1,172 @@
+package postgresql
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+type backendContextKey struct{}
+
+// backend identifies a session for the cancellation of its statements: the
+// pid and secret key are sent to the client in the BackendKeyData message
+// and checked on a CancelRequest.
+type backend struct {
+	pid    int32
+	secret int32
+	user   string
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+var (
+	lastSessionID atomic.Int32
+	backends      = make(map[int32]*backend)
+	muBackends    sync.Mutex
+)
+
+var (
+	reBackendPID    = regexp.MustCompile(`(?i)^SELECT\s+pg_backend_pid\s*\(\s*\)\s*;?$`)
+	reCancelBackend = regexp.MustCompile(`(?i)^SELECT\s+pg_cancel_backend\s*\(\s*(\d+)\s*\)\s*;?$`)
+)
+
+// newSessionContext assigns the pid and a random secret key of the session
+// authenticated by user.
+func newSessionContext(ctx context.Context, user string) context.Context {
+	var secret [4]byte
+	rand.Read(secret[:])
+	return context.WithValue(ctx, backendContextKey{}, &backend{
+		pid:    lastSessionID.Add(1),
+		secret: int32(binary.BigEndian.Uint32(secret[:])),
+		user:   user,
+	})
+}
+
+func backendOf(ctx context.Context) *backend {
+	b, _ := ctx.Value(backendContextKey{}).(*backend)
+	return b
+}
+
+func sessionID(ctx context.Context) int32 {
+	if b := backendOf(ctx); b != nil {
+		return b.pid
+	}
+	return 0
+}
+
+// backendKeyData returns the pid and secret key sent to the client, used by
+// the CancelRequest of the session.
+func backendKeyData(ctx context.Context) (int32, int32) {
+	b := backendOf(ctx)
+	if b == nil {
+		return 0, 0
+	}
+	return b.pid, b.secret
+}
+
+// registerBackend makes the session cancellable until unregisterBackend.
+func registerBackend(ctx context.Context) {
+	b := backendOf(ctx)
+	if b == nil {
+		return
+	}
+	muBackends.Lock()
+	backends[b.pid] = b
+	muBackends.Unlock()
+}
+
+func unregisterBackend(ctx context.Context) error {
+	b := backendOf(ctx)
+	if b == nil {
+		return nil
+	}
+	muBackends.Lock()
+	delete(backends, b.pid)
+	muBackends.Unlock()
+	return nil
+}
+
+// cancelRequest handles the CancelRequest message sent on a new connection,
+// by psql on Ctrl-C or by the drivers when the context of a query is done.
+// Like PostgreSQL, a request with an unknown pid or a wrong secret key is
+// ignored.
+func cancelRequest(ctx context.Context, pid, secret int32) error {
+	muBackends.Lock()
+	b, ok := backends[pid]
+	muBackends.Unlock()
+	if !ok || subtle.ConstantTimeEq(b.secret, secret) != 1 {
+		slog.WarnContext(ctx, "pg-wire: invalid cancel request", "pid", pid)
+		return nil
+	}
+	b.cancelStatement()
+	return nil
+}
+
+// cancellable registers the statement so it can be aborted by a
+// CancelRequest or pg_cancel_backend from another session, and bounds it by
+// the statement_timeout of the session.
+func cancellable(ctx context.Context) (context.Context, context.CancelFunc) {
+	b := backendOf(ctx)
+	var cancel context.CancelFunc
+	if timeout := statementTimeout(ctx); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	if b == nil {
+		return ctx, cancel
+	}
+	b.mu.Lock()
+	b.cancel = cancel
+	b.mu.Unlock()
+	return ctx, func() {
+		b.mu.Lock()
+		b.cancel = nil
+		b.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancelStatement aborts the running statement of the session, reporting
+// whether there was one.
+func (b *backend) cancelStatement() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel == nil {
+		return false
+	}
+	b.cancel()
+	return true
+}
+
+var errCancelOtherUser = psqlerr.WithCode(errors.New("permission denied to cancel the statement of another user"), codes.InsufficientPrivilege)
+
+// cancelBackend aborts the running statement of the session pid, limited to
+// the sessions of the same user as ctx.
+func cancelBackend(ctx context.Context, pid string) (bool, error) {
+	id, err := strconv.ParseInt(pid, 10, 32)
+	if err != nil {
+		return false, nil
+	}
+	muBackends.Lock()
+	b, ok := backends[int32(id)]
+	muBackends.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if self := backendOf(ctx); self == nil || self.user != b.user {
+		return false, errCancelOtherUser
+	}
+	return b.cancelStatement(), nil
+}
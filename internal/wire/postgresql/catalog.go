@@ -0,0 +1,628 @@
+package postgresql
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// reCatalog matches the statements reading the PostgreSQL system catalogs,
+// like the ones of psql \d or of the GUI tools. They run on an emulated
+// catalog built from the SQLite schema of the database.
+var reCatalog = regexp.MustCompile(`(?i)\b(pg_catalog|information_schema|pg_class|pg_tables|pg_views|pg_indexes|pg_attribute|pg_namespace|pg_type|pg_database|pg_index|pg_roles|pg_user|pg_am|current_user|session_user|current_schema)\b|\b(version|current_database)\s*\(`)
+
+// reEmptyCatalog matches the catalogs without rows in the emulation. The
+// statements reading them that cannot run on SQLite return no rows.
+var reEmptyCatalog = regexp.MustCompile(`(?i)\bpg_(policy|trigger|inherits|statistic_ext|publication|publication_rel|rewrite|proc|description|partitioned_table|depend|extension|event_trigger|sequence)\b`)
+
+var reCatalogParam = regexp.MustCompile(`\$(\d+)`)
+
+// catalogRewrites translate the PostgreSQL syntax and functions of the
+// catalog queries to SQLite, in order.
+var catalogRewrites = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)'(?:[^'.]*\.)?"?([A-Za-z_][^'".]*)"?'\s*::\s*(?:pg_catalog\.)?regclass\b`), `(SELECT oid FROM pg_catalog.pg_class WHERE relname = '$1')`},
+	{regexp.MustCompile(`(?i)\s*::\s*(?:pg_catalog\.)?"?[A-Za-z_]\w*"?(?:\s*\(\s*\d+(?:\s*,\s*\d+)?\s*\))?(?:\[\])?`), ``},
+	{regexp.MustCompile(`(?i)\s+COLLATE\s+(?:pg_catalog\.)?"?(?:default|C)"?`), ``},
+	{regexp.MustCompile(`(?i)OPERATOR\s*\(\s*pg_catalog\.(!?~\*?)\s*\)`), ` $1 `},
+	{regexp.MustCompile(`\s*!~\*\s*`), ` NOT REGEXP '(?i)' || `},
+	{regexp.MustCompile(`\s*!~\s*`), ` NOT REGEXP `},
+	{regexp.MustCompile(`\s*~\*\s*`), ` REGEXP '(?i)' || `},
+	{regexp.MustCompile(`\s*~\s*`), ` REGEXP `},
+	{regexp.MustCompile(`(?i)\bpg_catalog\.(\w+)\s*\(`), `$1(`},
+	{regexp.MustCompile(`(?i)\bpg_get_userbyid\(([^()]*)\)`), `(SELECT rolname FROM pg_catalog.pg_roles WHERE oid = $1)`},
+	{regexp.MustCompile(`(?i)\b(pg_get_indexdef|pg_get_constraintdef|pg_get_viewdef|format_type)\(\s*([^(),]*?)\s*(,[^()]*)?\)`), `(SELECT definition FROM pg_catalog.ha_definitions WHERE defoid = $2)`},
+	{regexp.MustCompile(`(?i)\bpg_get_expr\(\s*([^(),]*?)\s*,[^()]*\)`), `$1`},
+	{regexp.MustCompile(`(?i)\b(pg_table_is_visible|pg_type_is_visible|pg_function_is_visible|has_\w+_privilege)\([^()]*\)`), `1`},
+	{regexp.MustCompile(`(?i)\b(obj_description|col_description|shobj_description)\([^()]*\)`), `NULL`},
+	{regexp.MustCompile(`(?i)\b(pg_relation_size|pg_total_relation_size|pg_table_size|pg_indexes_size|pg_database_size)\([^()]*\)`), `0`},
+	{regexp.MustCompile(`(?i)\bpg_size_pretty\(([^()]*)\)`), `(($1) || ' bytes')`},
+	{regexp.MustCompile(`(?i)\bpg_encoding_to_char\([^()]*\)`), `'UTF8'`},
+	{regexp.MustCompile(`(?i)\bpg_partition_ancestors\(([^()]*)\)`), `$1`},
+	{regexp.MustCompile(`(?i)\barray_to_string\(\s*([^(),]*?)\s*,[^()]*\)`), `$1`},
+	{regexp.MustCompile(`(?i)\barray_length\([^()]*\)`), `NULL`},
+	{regexp.MustCompile(`(?i)\bversion\(\s*\)`), `('PostgreSQL 17.0 (ha on SQLite ' || sqlite_version() || ')')`},
+	{regexp.MustCompile(`(?i)\bcurrent_schemas\([^()]*\)`), `'{pg_catalog,public}'`},
+	{regexp.MustCompile(`(?i)(^|[^"\w])current_schema\b(\s*\(\s*\))?`), `$1'public'`},
+	{regexp.MustCompile(`(?i)\bILIKE\b`), `LIKE`},
+	{reCatalogParam, `?$1`},
+}
+
+// reCatalogFunctionColumn matches the functions selected without an alias,
+// named after the function like PostgreSQL does once rewritten.
+var reCatalogFunctionColumn = regexp.MustCompile(`(?i)(\bSELECT\s+|,\s*)(?:pg_catalog\.)?(version|current_database|current_schema|current_user|session_user)(\s*\(\s*\))?(\s*(?:,|;|$|\bFROM\b))`)
+
+var (
+	reCurrentDatabase = regexp.MustCompile(`(?i)\bcurrent_database\(\s*\)`)
+	reCurrentUser     = regexp.MustCompile(`(?i)(^|[^"\w])(current_user|session_user|current_role)\b`)
+)
+
+// rewriteCatalogQuery translates the catalog query to SQLite and returns the
+// number of its parameters.
+func rewriteCatalogQuery(query, database, user string) (string, int) {
+	var params int
+	for _, match := range reCatalogParam.FindAllStringSubmatch(query, -1) {
+		n, _ := strconv.Atoi(match[1])
+		params = max(params, n)
+	}
+	query = strings.TrimSpace(query)
+	// the matches share the commas between the columns
+	for aliased := ""; aliased != query; {
+		aliased = query
+		query = reCatalogFunctionColumn.ReplaceAllString(query, `$1$2$3 AS "$2"$4`)
+	}
+	for _, r := range catalogRewrites {
+		query = r.re.ReplaceAllString(query, r.repl)
+	}
+	query = reCurrentDatabase.ReplaceAllLiteralString(query, quoteLiteral(database))
+	query = reCurrentUser.ReplaceAllString(query, "${1}"+strings.ReplaceAll(quoteLiteral(user), "$", "$$"))
+	return query, params
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// catalogQuery answers the query from a catalog of the database built on
+// every execution, so it always reflects the current schema.
+func catalogQuery(ctx context.Context, dbID, query string) (wire.PreparedStatements, error) {
+	source, err := sqlite.DB(dbID)
+	if err != nil {
+		return nil, err
+	}
+	database := cmp.Or(dbID, sqlite.DefaultDatabase())
+	user, _ := ctx.Value(userContextKey{}).(string)
+	user = cmp.Or(user, "ha")
+	rewritten, params := rewriteCatalogQuery(query, database, user)
+	databases := slices.DeleteFunc(sqlite.Databases(), func(id string) bool {
+		return checkAccess(ctx, id) != nil
+	})
+	slices.Sort(databases)
+	cat := catalogInfo{
+		database:  database,
+		user:      user,
+		superuser: unrestricted(ctx),
+		databases: databases,
+	}
+
+	// the columns are described before the execution
+	var columns wire.Columns
+	err = cat.query(ctx, source, rewritten, make([]any, params), func(rows *sql.Rows, _ []bool) error {
+		names, err := rows.Columns()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			columns = append(columns, wire.Column{
+				Table: 0,
+				Name:  name,
+				Oid:   pgtype.TextOID,
+				Width: columnWidth,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		if !reEmptyCatalog.MatchString(query) {
+			return nil, psqlerr.WithCode(fmt.Errorf("pg_catalog emulation: %w", err), codes.FeatureNotSupported)
+		}
+		slog.DebugContext(ctx, "pg-wire: unsupported catalog query, returning no rows", "error", err)
+		return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return writer.Complete("SELECT 0")
+		}, wire.WithParameters(make([]uint32, params)))), nil
+	}
+
+	handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		args := make([]any, params)
+		for i, p := range parameters {
+			if i >= params {
+				break
+			}
+			value, err := p.Scan(25) // postgresql OID type text -> oid.T_text
+			if err != nil {
+				return err
+			}
+			args[i] = value
+		}
+		var count int
+		err := cat.query(ctx, source, rewritten, args, func(rows *sql.Rows, booleans []bool) error {
+			values := make([]any, len(booleans))
+			dest := make([]any, len(values))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			for rows.Next() {
+				if err := rows.Scan(dest...); err != nil {
+					return err
+				}
+				for i, v := range values {
+					if !booleans[i] {
+						continue
+					}
+					switch v := v.(type) {
+					case bool:
+						values[i] = boolText(v)
+					case int64:
+						values[i] = boolText(v != 0)
+					}
+				}
+				if err := writeRow(ctx, writer, values); err != nil {
+					return err
+				}
+				count++
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "pg-wire: catalog query", "error", err, "query", rewritten)
+			return err
+		}
+		return writer.Complete(fmt.Sprintf("SELECT %d", count))
+	}
+	return wire.Prepared(newStatement(ctx, handle, wire.WithParameters(make([]uint32, params)), wire.WithColumns(columns))), nil
+}
+
+func boolText(b bool) string {
+	if b {
+		return "t"
+	}
+	return "f"
+}
+
+type catalogInfo struct {
+	database  string
+	user      string
+	superuser bool
+	databases []string
+}
+
+// query builds the catalog and runs the query on it. The booleans report the
+// columns declared BOOLEAN, sent as t or f like PostgreSQL does.
+func (c catalogInfo) query(ctx context.Context, source *sql.DB, query string, args []any, fn func(rows *sql.Rows, booleans []bool) error) error {
+	db, err := sqlite.OpenMemory()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := c.build(ctx, conn, source); err != nil {
+		return fmt.Errorf("build catalog: %w", err)
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	booleans := make([]bool, len(types))
+	for i, t := range types {
+		booleans[i] = strings.EqualFold(t.DatabaseTypeName(), "BOOLEAN")
+	}
+	return fn(rows, booleans)
+}
+
+const (
+	namespaceCatalog           = 11
+	namespacePublic            = 2200
+	namespaceInformationSchema = 13000
+	roleOID                    = 10
+	heapAM                     = 2
+	btreeAM                    = 403
+	// firstObjectOID is the first OID of the relations and constraints, like
+	// the first one of the user objects in PostgreSQL.
+	firstObjectOID = 16384
+)
+
+type pgType struct {
+	oid      int64
+	name     string
+	format   string
+	length   int
+	category string
+}
+
+var (
+	typeBool        = pgType{16, "bool", "boolean", 1, "B"}
+	typeBytea       = pgType{17, "bytea", "bytea", -1, "U"}
+	typeName        = pgType{19, "name", "name", 64, "S"}
+	typeInt8        = pgType{20, "int8", "bigint", 8, "N"}
+	typeInt2        = pgType{21, "int2", "smallint", 2, "N"}
+	typeInt4        = pgType{23, "int4", "integer", 4, "N"}
+	typeText        = pgType{25, "text", "text", -1, "S"}
+	typeOid         = pgType{26, "oid", "oid", 4, "N"}
+	typeJSON        = pgType{114, "json", "json", -1, "U"}
+	typeFloat4      = pgType{700, "float4", "real", 4, "N"}
+	typeFloat8      = pgType{701, "float8", "double precision", 8, "N"}
+	typeBpchar      = pgType{1042, "bpchar", "character", -1, "S"}
+	typeVarchar     = pgType{1043, "varchar", "character varying", -1, "S"}
+	typeDate        = pgType{1082, "date", "date", 4, "D"}
+	typeTime        = pgType{1083, "time", "time without time zone", 8, "D"}
+	typeTimestamp   = pgType{1114, "timestamp", "timestamp without time zone", 8, "D"}
+	typeTimestamptz = pgType{1184, "timestamptz", "timestamp with time zone", 8, "D"}
+	typeNumeric     = pgType{1700, "numeric", "numeric", -1, "N"}
+	typeUUID        = pgType{2950, "uuid", "uuid", 16, "U"}
+	typeJSONB       = pgType{3802, "jsonb", "jsonb", -1, "U"}
+
+	pgTypes = []pgType{typeBool, typeBytea, typeName, typeInt8, typeInt2, typeInt4, typeText, typeOid, typeJSON, typeFloat4,
+		typeFloat8, typeBpchar, typeVarchar, typeDate, typeTime, typeTimestamp, typeTimestamptz, typeNumeric, typeUUID, typeJSONB}
+)
+
+// typeOf maps the declared type of a SQLite column to a PostgreSQL type,
+// following the SQLite type affinity rules.
+func typeOf(declared string) pgType {
+	t := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(t, "BOOL"):
+		return typeBool
+	case strings.Contains(t, "INT") && !strings.Contains(t, "POINT"):
+		return typeInt8
+	case strings.Contains(t, "CHAR"):
+		return typeVarchar
+	case strings.Contains(t, "CLOB") || strings.Contains(t, "TEXT"):
+		return typeText
+	case strings.Contains(t, "BLOB"):
+		return typeBytea
+	case strings.Contains(t, "REAL") || strings.Contains(t, "FLOA") || strings.Contains(t, "DOUB"):
+		return typeFloat8
+	case strings.Contains(t, "TIMESTAMPTZ"):
+		return typeTimestamptz
+	case strings.Contains(t, "DATETIME") || strings.Contains(t, "TIMESTAMP"):
+		return typeTimestamp
+	case strings.Contains(t, "DATE"):
+		return typeDate
+	case strings.Contains(t, "TIME"):
+		return typeTime
+	case strings.Contains(t, "JSONB"):
+		return typeJSONB
+	case strings.Contains(t, "JSON"):
+		return typeJSON
+	case strings.Contains(t, "UUID"):
+		return typeUUID
+	case strings.Contains(t, "NUMERIC") || strings.Contains(t, "DECIMAL"):
+		return typeNumeric
+	default:
+		return typeText
+	}
+}
+
+// catalogSchema creates the emulated catalogs, with the columns read by the
+// common clients. ha_definitions holds the text returned by format_type and
+// the pg_get_*def functions.
+var catalogSchema = []string{
+	`ATTACH DATABASE ':memory:' AS pg_catalog`,
+	`ATTACH DATABASE ':memory:' AS information_schema`,
+	`CREATE TABLE pg_catalog.pg_namespace(oid INTEGER, nspname TEXT, nspowner INTEGER, nspacl TEXT)`,
+	`CREATE TABLE pg_catalog.pg_roles(oid INTEGER, rolname TEXT, rolsuper BOOLEAN, rolinherit BOOLEAN, rolcreaterole BOOLEAN, rolcreatedb BOOLEAN, rolcanlogin BOOLEAN, rolreplication BOOLEAN, rolconnlimit INTEGER, rolvaliduntil TEXT, rolbypassrls BOOLEAN, rolconfig TEXT)`,
+	`CREATE TABLE pg_catalog.pg_user(usename TEXT, usesysid INTEGER, usecreatedb BOOLEAN, usesuper BOOLEAN, userepl BOOLEAN, usebypassrls BOOLEAN, passwd TEXT, valuntil TEXT, useconfig TEXT)`,
+	`CREATE TABLE pg_catalog.pg_database(oid INTEGER, datname TEXT, datdba INTEGER, encoding INTEGER, datlocprovider TEXT, datistemplate BOOLEAN, datallowconn BOOLEAN, datconnlimit INTEGER, dattablespace INTEGER, datcollate TEXT, datctype TEXT, datlocale TEXT, daticurules TEXT, datacl TEXT)`,
+	`CREATE TABLE pg_catalog.pg_tablespace(oid INTEGER, spcname TEXT, spcowner INTEGER, spcacl TEXT, spcoptions TEXT)`,
+	`CREATE TABLE pg_catalog.pg_am(oid INTEGER, amname TEXT, amhandler TEXT, amtype TEXT)`,
+	`CREATE TABLE pg_catalog.pg_type(oid INTEGER, typname TEXT, typnamespace INTEGER, typowner INTEGER, typlen INTEGER, typbyval BOOLEAN, typtype TEXT, typcategory TEXT, typisdefined BOOLEAN, typdelim TEXT, typrelid INTEGER, typelem INTEGER, typarray INTEGER, typinput TEXT, typoutput TEXT, typnotnull BOOLEAN, typbasetype INTEGER, typtypmod INTEGER, typndims INTEGER, typcollation INTEGER, typdefault TEXT)`,
+	`CREATE TABLE pg_catalog.pg_class(oid INTEGER, relname TEXT, relnamespace INTEGER, reltype INTEGER, reloftype INTEGER, relowner INTEGER, relam INTEGER, relfilenode INTEGER, reltablespace INTEGER, relpages INTEGER, reltuples REAL, relallvisible INTEGER, reltoastrelid INTEGER, relhasindex BOOLEAN, relisshared BOOLEAN, relpersistence TEXT, relkind TEXT, relnatts INTEGER, relchecks INTEGER, relhasrules BOOLEAN, relhastriggers BOOLEAN, relhassubclass BOOLEAN, relrowsecurity BOOLEAN, relforcerowsecurity BOOLEAN, relispopulated BOOLEAN, relreplident TEXT, relispartition BOOLEAN, relacl TEXT, reloptions TEXT, relpartbound TEXT)`,
+	`CREATE TABLE pg_catalog.pg_attribute(attrelid INTEGER, attname TEXT, atttypid INTEGER, attlen INTEGER, attnum INTEGER, attcacheoff INTEGER, atttypmod INTEGER, attndims INTEGER, attbyval BOOLEAN, attalign TEXT, attstorage TEXT, attcompression TEXT, attnotnull BOOLEAN, atthasdef BOOLEAN, atthasmissing BOOLEAN, attidentity TEXT, attgenerated TEXT, attisdropped BOOLEAN, attislocal BOOLEAN, attinhcount INTEGER, attstattarget INTEGER, attcollation INTEGER, attacl TEXT, attoptions TEXT, attfdwoptions TEXT)`,
+	`CREATE TABLE pg_catalog.pg_attrdef(oid INTEGER, adrelid INTEGER, adnum INTEGER, adbin TEXT)`,
+	`CREATE TABLE pg_catalog.pg_index(indexrelid INTEGER, indrelid INTEGER, indnatts INTEGER, indnkeyatts INTEGER, indisunique BOOLEAN, indnullsnotdistinct BOOLEAN, indisprimary BOOLEAN, indisexclusion BOOLEAN, indimmediate BOOLEAN, indisclustered BOOLEAN, indisvalid BOOLEAN, indcheckxmin BOOLEAN, indisready BOOLEAN, indislive BOOLEAN, indisreplident BOOLEAN, indkey TEXT, indcollation TEXT, indclass TEXT, indoption TEXT, indexprs TEXT, indpred TEXT)`,
+	`CREATE TABLE pg_catalog.pg_constraint(oid INTEGER, conname TEXT, connamespace INTEGER, contype TEXT, condeferrable BOOLEAN, condeferred BOOLEAN, convalidated BOOLEAN, conrelid INTEGER, contypid INTEGER, conindid INTEGER, conparentid INTEGER, confrelid INTEGER, confupdtype TEXT, confdeltype TEXT, confmatchtype TEXT, conislocal BOOLEAN, coninhcount INTEGER, connoinherit BOOLEAN, conkey TEXT, confkey TEXT, conbin TEXT)`,
+	`CREATE TABLE pg_catalog.pg_tables(schemaname TEXT, tablename TEXT, tableowner TEXT, tablespace TEXT, hasindexes BOOLEAN, hasrules BOOLEAN, hastriggers BOOLEAN, rowsecurity BOOLEAN)`,
+	`CREATE TABLE pg_catalog.pg_views(schemaname TEXT, viewname TEXT, viewowner TEXT, definition TEXT)`,
+	`CREATE TABLE pg_catalog.pg_indexes(schemaname TEXT, tablename TEXT, indexname TEXT, tablespace TEXT, indexdef TEXT)`,
+	`CREATE TABLE pg_catalog.pg_collation(oid INTEGER, collname TEXT, collnamespace INTEGER, collowner INTEGER, collprovider TEXT, collisdeterministic BOOLEAN, collencoding INTEGER, collcollate TEXT, collctype TEXT)`,
+	`CREATE TABLE pg_catalog.pg_description(objoid INTEGER, classoid INTEGER, objsubid INTEGER, description TEXT)`,
+	`CREATE TABLE pg_catalog.pg_inherits(inhrelid INTEGER, inhparent INTEGER, inhseqno INTEGER, inhdetachpending BOOLEAN)`,
+	`CREATE TABLE pg_catalog.pg_trigger(oid INTEGER, tgrelid INTEGER, tgparentid INTEGER, tgname TEXT, tgfoid INTEGER, tgtype INTEGER, tgenabled TEXT, tgisinternal BOOLEAN)`,
+	`CREATE TABLE pg_catalog.pg_proc(oid INTEGER, proname TEXT, pronamespace INTEGER, proowner INTEGER, prolang INTEGER, prokind TEXT, prorettype INTEGER, proargtypes TEXT)`,
+	`CREATE TABLE pg_catalog.ha_definitions(defoid INTEGER PRIMARY KEY, definition TEXT)`,
+	`CREATE TABLE information_schema.schemata(catalog_name TEXT, schema_name TEXT, schema_owner TEXT)`,
+	`CREATE TABLE information_schema.tables(table_catalog TEXT, table_schema TEXT, table_name TEXT, table_type TEXT, is_insertable_into TEXT)`,
+	`CREATE TABLE information_schema.views(table_catalog TEXT, table_schema TEXT, table_name TEXT, view_definition TEXT)`,
+	`CREATE TABLE information_schema.columns(table_catalog TEXT, table_schema TEXT, table_name TEXT, column_name TEXT, ordinal_position INTEGER, column_default TEXT, is_nullable TEXT, data_type TEXT, character_maximum_length INTEGER, numeric_precision INTEGER, numeric_scale INTEGER, udt_catalog TEXT, udt_schema TEXT, udt_name TEXT, is_identity TEXT, is_generated TEXT)`,
+	`CREATE TABLE information_schema.table_constraints(constraint_catalog TEXT, constraint_schema TEXT, constraint_name TEXT, table_catalog TEXT, table_schema TEXT, table_name TEXT, constraint_type TEXT, is_deferrable TEXT, initially_deferred TEXT)`,
+	`CREATE TABLE information_schema.key_column_usage(constraint_catalog TEXT, constraint_schema TEXT, constraint_name TEXT, table_catalog TEXT, table_schema TEXT, table_name TEXT, column_name TEXT, ordinal_position INTEGER, position_in_unique_constraint INTEGER)`,
+}
+
+// catalogRelation is a table or view with its OID in the catalog.
+type catalogRelation struct {
+	sqlite.Table
+	oid int64
+}
+
+// catalogIndex refers to the columns by their attribute number, from 1. An
+// expression is 0.
+type catalogIndex struct {
+	name    string
+	unique  bool
+	origin  string
+	columns []int
+}
+
+func (r *catalogRelation) attnum(column string) int {
+	for i, col := range r.Columns {
+		if strings.EqualFold(col.Name, column) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (r *catalogRelation) attnums(columns []string) []int {
+	attnums := make([]int, len(columns))
+	for i, column := range columns {
+		attnums[i] = r.attnum(column)
+	}
+	return attnums
+}
+
+func (r *catalogRelation) primaryKey() []int {
+	var pk []int
+	for i, col := range r.Columns {
+		if col.PrimaryKey > 0 {
+			pk = append(pk, i+1)
+		}
+	}
+	slices.SortFunc(pk, func(a, b int) int {
+		return r.Columns[a-1].PrimaryKey - r.Columns[b-1].PrimaryKey
+	})
+	return pk
+}
+
+func (r *catalogRelation) columnNames(attnums []int) string {
+	names := make([]string, len(attnums))
+	for i, n := range attnums {
+		if n > 0 {
+			names[i] = r.Columns[n-1].Name
+		} else {
+			names[i] = "expr"
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// catalogWriter inserts the catalog rows, keeping the first error.
+type catalogWriter struct {
+	ctx  context.Context
+	conn *sql.Conn
+	err  error
+	oid  int64
+}
+
+func (w *catalogWriter) insert(table string, values ...any) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.conn.ExecContext(w.ctx, "INSERT INTO "+table+" VALUES ("+strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")+")", values...)
+}
+
+func (w *catalogWriter) nextOID() int64 {
+	w.oid++
+	return w.oid - 1
+}
+
+func (c catalogInfo) build(ctx context.Context, conn *sql.Conn, source *sql.DB) error {
+	for _, stmt := range catalogSchema {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	tables, err := sqlite.Schema(ctx, source)
+	if err != nil {
+		return err
+	}
+	w := catalogWriter{ctx: ctx, conn: conn, oid: firstObjectOID}
+
+	for _, ns := range []struct {
+		oid  int64
+		name string
+	}{{namespaceCatalog, "pg_catalog"}, {namespacePublic, "public"}, {namespaceInformationSchema, "information_schema"}} {
+		w.insert("pg_catalog.pg_namespace", ns.oid, ns.name, roleOID, nil)
+		w.insert("information_schema.schemata", c.database, ns.name, c.user)
+	}
+	w.insert("pg_catalog.pg_roles", roleOID, c.user, c.superuser, true, c.superuser, c.superuser, true, false, -1, nil, c.superuser, nil)
+	w.insert("pg_catalog.pg_user", c.user, roleOID, c.superuser, c.superuser, false, c.superuser, "********", nil, nil)
+	for i, id := range c.databases {
+		w.insert("pg_catalog.pg_database", i+1, id, roleOID, 6, "c", false, true, -1, 1663, "C", "C", nil, nil, nil)
+	}
+	w.insert("pg_catalog.pg_tablespace", 1663, "pg_default", roleOID, nil, nil)
+	w.insert("pg_catalog.pg_am", heapAM, "heap", "heap_tableam_handler", "t")
+	w.insert("pg_catalog.pg_am", btreeAM, "btree", "bthandler", "i")
+	w.insert("pg_catalog.pg_collation", 100, "default", namespaceCatalog, roleOID, "d", true, -1, nil, nil)
+	for _, t := range pgTypes {
+		w.insert("pg_catalog.pg_type", t.oid, t.name, namespaceCatalog, roleOID, t.length, t.length > 0, "b", t.category, true, ",", 0, 0, 0,
+			t.name+"in", t.name+"out", false, 0, -1, 0, 0, nil)
+		w.insert("pg_catalog.ha_definitions", t.oid, t.format)
+	}
+
+	relations := make(map[string]*catalogRelation, len(tables))
+	for _, table := range tables {
+		relations[strings.ToLower(table.Name)] = &catalogRelation{Table: table, oid: w.nextOID()}
+	}
+	for _, table := range tables {
+		c.writeRelation(&w, relations[strings.ToLower(table.Name)], relations)
+	}
+	return w.err
+}
+
+func (c catalogInfo) writeRelation(w *catalogWriter, r *catalogRelation, relations map[string]*catalogRelation) {
+	kind, am := "r", heapAM
+	if r.Type == "view" {
+		kind, am = "v", 0
+	}
+	pk := r.primaryKey()
+	hasIndexes := len(pk) > 0 || len(r.Indexes) > 0
+	w.insert("pg_catalog.pg_class", r.oid, r.Name, namespacePublic, 0, 0, roleOID, am, r.oid, 0, 0, -1, 0, 0,
+		hasIndexes, false, "p", kind, len(r.Columns), 0, false, false, false, false, false, true, "d", false, nil, nil, nil)
+	for i, col := range r.Columns {
+		t := typeOf(col.Type)
+		notNull := col.NotNull || col.PrimaryKey > 0
+		w.insert("pg_catalog.pg_attribute", r.oid, col.Name, t.oid, t.length, i+1, -1, -1, 0, t.length > 0, "i", "x", "",
+			notNull, col.Default != nil, false, "", "", false, true, 0, -1, 0, nil, nil, nil)
+		if col.Default != nil {
+			w.insert("pg_catalog.pg_attrdef", w.nextOID(), r.oid, i+1, *col.Default)
+		}
+		isNullable := "YES"
+		if notNull {
+			isNullable = "NO"
+		}
+		w.insert("information_schema.columns", c.database, "public", r.Name, col.Name, i+1, col.Default, isNullable, t.format,
+			nil, nil, nil, c.database, "pg_catalog", t.name, "NO", "NEVER")
+	}
+
+	if r.Type == "view" {
+		definition := r.SQL
+		if i := strings.Index(strings.ToUpper(definition), " AS "); i >= 0 {
+			definition = strings.TrimSpace(definition[i+4:])
+		}
+		w.insert("pg_catalog.pg_views", "public", r.Name, c.user, definition)
+		w.insert("pg_catalog.ha_definitions", r.oid, definition)
+		w.insert("information_schema.tables", c.database, "public", r.Name, "VIEW", "NO")
+		w.insert("information_schema.views", c.database, "public", r.Name, definition)
+		return
+	}
+	w.insert("pg_catalog.pg_tables", "public", r.Name, c.user, nil, hasIndexes, false, false, false)
+	w.insert("information_schema.tables", c.database, "public", r.Name, "BASE TABLE", "YES")
+
+	if len(pk) > 0 {
+		c.writeIndex(w, r, catalogIndex{name: r.Name + "_pkey", unique: true, origin: "pk", columns: pk})
+	}
+	for _, idx := range r.Indexes {
+		// the primary key is described from the columns, it may be the rowid
+		if idx.Origin == "pk" {
+			continue
+		}
+		index := catalogIndex{name: idx.Name, unique: idx.Unique, origin: idx.Origin, columns: r.attnums(idx.Columns)}
+		if index.origin == "u" {
+			// named like the PostgreSQL unique constraints, not the autoindex
+			index.name = fmt.Sprintf("%s_%s_key", r.Name, strings.Join(idx.Columns, "_"))
+		}
+		c.writeIndex(w, r, index)
+	}
+	for i, fk := range r.ForeignKeys {
+		ref, ok := relations[strings.ToLower(fk.Table)]
+		if !ok {
+			continue
+		}
+		from := r.attnums(fk.Columns)
+		to := make([]int, len(fk.References))
+		for j, name := range fk.References {
+			if name != "" {
+				to[j] = ref.attnum(name)
+			} else if refPK := ref.primaryKey(); j < len(refPK) {
+				to[j] = refPK[j]
+			}
+		}
+		name := fmt.Sprintf("%s_%s_fkey", r.Name, strings.Join(fk.Columns, "_"))
+		if slices.ContainsFunc(r.ForeignKeys[:i], func(other sqlite.ForeignKey) bool { return slices.Equal(other.Columns, fk.Columns) }) {
+			name = fmt.Sprintf("%s%d", name, i)
+		}
+		definition := fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s(%s)", r.columnNames(from), ref.Name, ref.columnNames(to))
+		c.writeConstraint(w, r, name, "f", 0, ref.oid, from, to, definition)
+	}
+}
+
+func (c catalogInfo) writeIndex(w *catalogWriter, r *catalogRelation, index catalogIndex) {
+	oid := w.nextOID()
+	w.insert("pg_catalog.pg_class", oid, index.name, namespacePublic, 0, 0, roleOID, btreeAM, oid, 0, 0, -1, 0, 0,
+		false, false, "p", "i", len(index.columns), 0, false, false, false, false, false, true, "n", false, nil, nil, nil)
+	for i, attnum := range index.columns {
+		name, t := "expr", typeText
+		if attnum > 0 {
+			name, t = r.Columns[attnum-1].Name, typeOf(r.Columns[attnum-1].Type)
+		}
+		w.insert("pg_catalog.pg_attribute", oid, name, t.oid, t.length, i+1, -1, -1, 0, t.length > 0, "i", "p", "",
+			false, false, false, "", "", false, true, 0, -1, 0, nil, nil, nil)
+	}
+	keys := make([]string, len(index.columns))
+	for i, attnum := range index.columns {
+		keys[i] = strconv.Itoa(attnum)
+	}
+	primary := index.origin == "pk"
+	w.insert("pg_catalog.pg_index", oid, r.oid, len(index.columns), len(index.columns), index.unique, false, primary, false, true,
+		false, true, false, true, true, false, strings.Join(keys, " "), nil, nil, nil, nil, nil)
+	unique := ""
+	if index.unique {
+		unique = "UNIQUE "
+	}
+	definition := fmt.Sprintf("CREATE %sINDEX %s ON public.%s USING btree (%s)", unique, index.name, r.Name, r.columnNames(index.columns))
+	w.insert("pg_catalog.pg_indexes", "public", r.Name, index.name, nil, definition)
+	w.insert("pg_catalog.ha_definitions", oid, definition)
+	switch index.origin {
+	case "pk":
+		c.writeConstraint(w, r, index.name, "p", oid, 0, index.columns, nil, fmt.Sprintf("PRIMARY KEY (%s)", r.columnNames(index.columns)))
+	case "u":
+		c.writeConstraint(w, r, index.name, "u", oid, 0, index.columns, nil, fmt.Sprintf("UNIQUE (%s)", r.columnNames(index.columns)))
+	}
+}
+
+func (c catalogInfo) writeConstraint(w *catalogWriter, r *catalogRelation, name, kind string, indexOID, refOID int64, key, refKey []int, definition string) {
+	oid := w.nextOID()
+	var confkey any
+	if refKey != nil {
+		confkey = intArray(refKey)
+	}
+	w.insert("pg_catalog.pg_constraint", oid, name, namespacePublic, kind, false, false, true, r.oid, 0, indexOID, 0, refOID,
+		"a", "a", "s", true, 0, true, intArray(key), confkey, nil)
+	w.insert("pg_catalog.ha_definitions", oid, definition)
+	constraintType := map[string]string{"p": "PRIMARY KEY", "u": "UNIQUE", "f": "FOREIGN KEY"}[kind]
+	w.insert("information_schema.table_constraints", c.database, "public", name, c.database, "public", r.Name, constraintType, "NO", "NO")
+	for i, attnum := range key {
+		if attnum == 0 {
+			continue
+		}
+		var position any
+		if kind == "f" {
+			position = i + 1
+		}
+		w.insert("information_schema.key_column_usage", c.database, "public", name, c.database, "public", r.Name,
+			r.Columns[attnum-1].Name, i+1, position)
+	}
+}
+
+// intArray formats the attribute numbers like a PostgreSQL array.
+func intArray(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(v)
+	}
+	return "{" + strings.Join(s, ",") + "}"
+}
@@ -0,0 +1,43 @@
+package postgresql
+
+import (
+	"context"
+	"strconv"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+func sessionDatabase(ctx context.Context) string {
+	id, _ := wire.GetAttribute(ctx, databaseIDAttribute)
+	dbID, _ := id.(string)
+	return dbID
+}
+
+// waitMinSeq blocks until the database of the session applied the ha.min_seq
+// of the session, the ha.seq of the last write read from another node.
+func waitMinSeq(ctx context.Context) error {
+	value, _ := settingValue(ctx, "ha.min_seq")
+	seq, _ := strconv.ParseUint(value, 10, 64)
+	return sqlite.WaitApplied(ctx, sessionDatabase(ctx), seq)
+}
+
+// recordSeq sets ha.seq to the sequence published by the write, once it is
+// committed.
+func recordSeq(ctx context.Context) {
+	if tx, ok := wire.GetAttribute(ctx, transactionAttribute); ok && tx != nil {
+		return
+	}
+	if seq := sqlite.PublishedSeq(sessionDatabase(ctx)); seq > 0 {
+		sessionSettingsOf(ctx).values["ha.seq"] = strconv.FormatUint(seq, 10)
+	}
+}
+
+func checkSeq(value string) (string, error) {
+	seq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(seq, 10), nil
+}
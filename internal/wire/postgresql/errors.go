@@ -0,0 +1,150 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/txlimit"
+)
+
+// SQLite result codes, https://sqlite.org/rescode.html
+const (
+	sqliteError      = 1
+	sqliteBusy       = 5
+	sqliteLocked     = 6
+	sqliteReadOnly   = 8
+	sqliteInterrupt  = 9
+	sqliteCorrupt    = 11
+	sqliteFull       = 13
+	sqliteTooBig     = 18
+	sqliteConstraint = 19
+	sqliteMismatch   = 20
+
+	sqliteConstraintCheck      = 275
+	sqliteConstraintForeignKey = 787
+	sqliteConstraintNotNull    = 1299
+	sqliteConstraintPrimaryKey = 1555
+	sqliteConstraintUnique     = 2067
+)
+
+var (
+	// UNIQUE constraint failed: users.email, users.tenant
+	reConstraintColumns = regexp.MustCompile(`constraint failed: (\w+\.\w+(?:, \w+\.\w+)*)`)
+)
+
+// pgError sets the SQLSTATE code of the errors sent to the clients, so the
+// drivers branch on unique violations or retry the serialization failures.
+// The errors with a code already set are kept.
+func pgError(err error) error {
+	if err == nil || psqlerr.GetCode(err) != codes.Uncategorized {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return psqlerr.WithCode(err, codes.QueryCanceled)
+	case errors.Is(err, sqlite.ErrReadOnly):
+		return psqlerr.WithCode(err, codes.ReadOnlySQLTransaction)
+	case errors.Is(err, sqlite.ErrSeqNotApplied):
+		return psqlerr.WithHint(psqlerr.WithCode(err, codes.ObjectNotInPrerequisiteState), "retry, or read from the node of the write")
+	case errors.Is(err, txlimit.ErrTooLarge):
+		return psqlerr.WithCode(err, codes.ProgramLimitExceeded)
+	case errors.Is(err, sqlite.ErrRolledBack):
+		// the changeset was not published, the transaction can be retried
+		return psqlerr.WithCode(err, codes.TransactionRollback)
+	}
+	code, ok := sqlite.ErrorCode(err)
+	if !ok {
+		return err
+	}
+	switch code & 0xff {
+	case sqliteConstraint:
+		return constraintError(err, code)
+	case sqliteBusy, sqliteLocked:
+		return psqlerr.WithHint(psqlerr.WithCode(err, codes.SerializationFailure), "retry the transaction")
+	case sqliteReadOnly:
+		return psqlerr.WithCode(err, codes.ReadOnlySQLTransaction)
+	case sqliteInterrupt:
+		return psqlerr.WithCode(err, codes.QueryCanceled)
+	case sqliteCorrupt:
+		return psqlerr.WithCode(err, codes.DataCorrupted)
+	case sqliteFull:
+		return psqlerr.WithCode(err, codes.DiskFull)
+	case sqliteTooBig:
+		return psqlerr.WithCode(err, codes.ProgramLimitExceeded)
+	case sqliteMismatch:
+		return psqlerr.WithCode(err, codes.DatatypeMismatch)
+	case sqliteError:
+		// SQLITE_ERROR is only classified by its message
+		msg := err.Error()
+		switch {
+		case strings.Contains(msg, "syntax error"), strings.Contains(msg, "incomplete input"):
+			return psqlerr.WithCode(err, codes.Syntax)
+		case strings.Contains(msg, "no such table"):
+			return psqlerr.WithCode(err, codes.UndefinedTable)
+		case strings.Contains(msg, "no such column"):
+			return psqlerr.WithCode(err, codes.UndefinedColumn)
+		case strings.Contains(msg, "no such function"):
+			return psqlerr.WithCode(err, codes.UndefinedFunction)
+		case strings.Contains(msg, "duplicate column name"):
+			return psqlerr.WithCode(err, codes.DuplicateColumn)
+		case strings.Contains(msg, "already exists"):
+			return psqlerr.WithCode(err, codes.DuplicateRelation)
+		}
+	}
+	return err
+}
+
+// constraintError details the violated key like PostgreSQL does when SQLite
+// reports the columns. psql-wire doesn't send the constraint name field, the
+// name of a CHECK constraint is in the SQLite message.
+func constraintError(err error, code int) error {
+	table, columns := constraintColumns(err.Error())
+	switch code {
+	case sqliteConstraintUnique, sqliteConstraintPrimaryKey:
+		err = psqlerr.WithCode(err, codes.UniqueViolation)
+		if table == "" {
+			return err
+		}
+		return psqlerr.WithDetail(err, fmt.Sprintf("Key (%s) already exists in table %q.", strings.Join(columns, ", "), table))
+	case sqliteConstraintNotNull:
+		err = psqlerr.WithCode(err, codes.NotNullViolation)
+		if table == "" {
+			return err
+		}
+		return psqlerr.WithDetail(err, fmt.Sprintf("Null value in column %q of table %q.", columns[0], table))
+	case sqliteConstraintForeignKey:
+		return psqlerr.WithCode(err, codes.ForeignKeyViolation)
+	case sqliteConstraintCheck:
+		return psqlerr.WithCode(err, codes.CheckViolation)
+	default:
+		return psqlerr.WithCode(err, codes.IntegrityConstraintViolation)
+	}
+}
+
+// constraintColumns parses the "table.column" list of the constraint errors.
+func constraintColumns(msg string) (string, []string) {
+	m := reConstraintColumns.FindStringSubmatch(msg)
+	if m == nil {
+		return "", nil
+	}
+	var (
+		table   string
+		columns []string
+	)
+	for _, name := range strings.Split(m[1], ", ") {
+		t, column, ok := strings.Cut(name, ".")
+		if !ok || table != "" && t != table {
+			return "", nil
+		}
+		table = t
+		columns = append(columns, column)
+	}
+	return table, columns
+}
@@ -0,0 +1,302 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	wire "github.com/jeroenrinzema/psql-wire"
+	sqlparser "github.com/rqlite/sql"
+)
+
+// paramHint is the context of a parameter giving its type: a column, by name
+// or by position in an INSERT without column list, or the type itself.
+type paramHint struct {
+	table    string
+	column   string
+	position int
+	oid      uint32
+}
+
+// paramTyper collects the tables of the statement and the context of its
+// parameters.
+type paramTyper struct {
+	// tables are the tables by name and alias, lower case.
+	tables map[string]string
+	order  []string
+	hints  map[string]paramHint
+}
+
+// parameterTypes infers the OIDs of the parameters of the statement from their
+// context: the column they are compared with, inserted in or assigned to, a
+// CAST or a LIMIT. The parameters without context are unspecified (0) and
+// read as text, like the columns of an unknown table.
+func parameterTypes(ctx context.Context, eq execerQuerier, query string, names []string) []uint32 {
+	oids := make([]uint32, len(names))
+	stmt, err := sqlparser.NewParser(strings.NewReader(query)).ParseStatement()
+	if err != nil {
+		return oids
+	}
+	t := &paramTyper{
+		tables: make(map[string]string),
+		hints:  make(map[string]paramHint),
+	}
+	if _, err := sqlparser.Walk(t, stmt); err != nil {
+		return oids
+	}
+	columns := make(map[string][]tableColumn)
+	for _, table := range t.order {
+		columns[table] = tableColumns(ctx, eq, table)
+	}
+	for i, name := range names {
+		hint, ok := t.hints[name]
+		if !ok {
+			continue
+		}
+		if hint.oid != 0 {
+			oids[i] = hint.oid
+			continue
+		}
+		tables := t.order
+		if hint.table != "" {
+			tables = []string{t.tables[strings.ToLower(hint.table)]}
+		}
+		for _, table := range tables {
+			if declared, ok := columnType(columns[table], hint); ok {
+				if declared != "" {
+					oids[i] = uint32(typeOf(declared).oid)
+				}
+				break
+			}
+		}
+	}
+	return oids
+}
+
+type tableColumn struct {
+	name     string
+	declared string
+}
+
+func tableColumns(ctx context.Context, eq execerQuerier, table string) []tableColumn {
+	rows, err := eq.QueryContext(ctx, "SELECT name, type FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var list []tableColumn
+	for rows.Next() {
+		var c tableColumn
+		if err := rows.Scan(&c.name, &c.declared); err != nil {
+			return nil
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+func columnType(columns []tableColumn, hint paramHint) (string, bool) {
+	if hint.column == "" {
+		if hint.position < len(columns) {
+			return columns[hint.position].declared, true
+		}
+		return "", false
+	}
+	for _, c := range columns {
+		if strings.EqualFold(c.name, hint.column) {
+			return c.declared, true
+		}
+	}
+	return "", false
+}
+
+func (t *paramTyper) addTable(name, alias *sqlparser.Ident) {
+	table := sqlparser.IdentName(name)
+	if table == "" {
+		return
+	}
+	if _, ok := t.tables[strings.ToLower(table)]; !ok {
+		t.order = append(t.order, table)
+	}
+	t.tables[strings.ToLower(table)] = table
+	if alias := sqlparser.IdentName(alias); alias != "" {
+		t.tables[strings.ToLower(alias)] = table
+	}
+}
+
+// hint keeps the first context of the parameter.
+func (t *paramTyper) hint(expr sqlparser.Expr, hint paramHint) {
+	bind, ok := expr.(*sqlparser.BindExpr)
+	if !ok {
+		return
+	}
+	if _, ok := t.hints[bind.Name]; !ok {
+		t.hints[bind.Name] = hint
+	}
+}
+
+// columnHint returns the column referenced by the expression.
+func columnHint(expr sqlparser.Expr) (paramHint, bool) {
+	switch expr := expr.(type) {
+	case *sqlparser.Ident:
+		return paramHint{column: expr.Name}, true
+	case *sqlparser.QualifiedRef:
+		if expr.Column == nil {
+			return paramHint{}, false
+		}
+		return paramHint{table: sqlparser.IdentName(expr.Table), column: expr.Column.Name}, true
+	}
+	return paramHint{}, false
+}
+
+func (t *paramTyper) compared(x, y sqlparser.Expr) {
+	column, ok := columnHint(x)
+	if !ok {
+		return
+	}
+	switch y := y.(type) {
+	case *sqlparser.ExprList:
+		for _, e := range y.Exprs {
+			t.hint(e, column)
+		}
+	case *sqlparser.Range:
+		t.hint(y.X, column)
+		t.hint(y.Y, column)
+	default:
+		t.hint(y, column)
+	}
+}
+
+func (t *paramTyper) limit(limit, offset sqlparser.Expr) {
+	t.hint(limit, paramHint{oid: pgtype.Int8OID})
+	t.hint(offset, paramHint{oid: pgtype.Int8OID})
+}
+
+func (t *paramTyper) Visit(n sqlparser.Node) (sqlparser.Visitor, sqlparser.Node, error) {
+	switch n := n.(type) {
+	case *sqlparser.InsertStatement:
+		t.addTable(n.Table, n.Alias)
+		table := sqlparser.IdentName(n.Table)
+		for _, list := range n.ValueLists {
+			for i, e := range list.Exprs {
+				hint := paramHint{table: table, position: i}
+				if len(n.Columns) > 0 {
+					if i >= len(n.Columns) {
+						break
+					}
+					hint.column = n.Columns[i].Name
+				}
+				t.hint(e, hint)
+			}
+		}
+	case *sqlparser.QualifiedTableName:
+		t.addTable(n.Name, n.Alias)
+	case *sqlparser.Assignment:
+		if len(n.Columns) == 1 {
+			t.hint(n.Expr, paramHint{column: n.Columns[0].Name})
+		}
+	case *sqlparser.BinaryExpr:
+		t.compared(n.X, n.Y)
+		t.compared(n.Y, n.X)
+	case *sqlparser.CastExpr:
+		if n.Type != nil && n.Type.Name != nil {
+			t.hint(n.X, paramHint{oid: uint32(typeOf(n.Type.Name.Name).oid)})
+		}
+	case *sqlparser.SelectStatement:
+		t.limit(n.LimitExpr, n.OffsetExpr)
+	case *sqlparser.DeleteStatement:
+		t.limit(n.LimitExpr, n.OffsetExpr)
+	}
+	return t, n, nil
+}
+
+func (t *paramTyper) VisitEnd(n sqlparser.Node) (sqlparser.Node, error) {
+	return n, nil
+}
+
+// parameterValue decodes the parameter, in the text or binary format of the
+// client, to the value bound to SQLite: booleans are 1 or 0, numbers integers
+// or reals, bytea blobs and the other types their PostgreSQL text.
+func parameterValue(oid uint32, p wire.Parameter) (any, error) {
+	if p.Value() == nil {
+		return nil, nil
+	}
+	if p.Format() == wire.TextFormat {
+		switch oid {
+		case pgtype.BoolOID, pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.Float4OID, pgtype.Float8OID, pgtype.ByteaOID:
+		default:
+			// the text is kept as sent, SQLite converts it following the
+			// affinity of the column
+			return p.Scan(pgtype.TextOID)
+		}
+	}
+	switch oid {
+	case 0, pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID, pgtype.NameOID:
+		return p.Scan(pgtype.TextOID)
+	case pgtype.JSONOID:
+		return string(p.Value()), nil
+	case pgtype.JSONBOID:
+		// the binary jsonb is its text after a version byte
+		value := p.Value()
+		if len(value) > 0 && value[0] == 1 {
+			value = value[1:]
+		}
+		return string(value), nil
+	}
+	v, err := p.Scan(binaryOID(oid, p))
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case time.Time:
+		switch oid {
+		case pgtype.DateOID:
+			return v.Format(time.DateOnly), nil
+		case pgtype.TimestamptzOID:
+			return v.Format(time.RFC3339Nano), nil
+		}
+		return v.Format("2006-01-02 15:04:05.999999999"), nil
+	case [16]byte:
+		s := hex.EncodeToString(v[:])
+		return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], nil
+	case driver.Valuer:
+		return v.Value()
+	case fmt.Stringer:
+		return v.String(), nil
+	}
+	return v, nil
+}
+
+// binaryOID returns the OID decoding the binary parameter. The types sent by
+// the client are not known, so the integers and reals follow the width of
+// the value: an int4 is accepted for an int8 column.
+func binaryOID(oid uint32, p wire.Parameter) uint32 {
+	if p.Format() != wire.BinaryFormat {
+		return oid
+	}
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID:
+		switch len(p.Value()) {
+		case 2:
+			return pgtype.Int2OID
+		case 4:
+			return pgtype.Int4OID
+		}
+		return pgtype.Int8OID
+	case pgtype.Float4OID, pgtype.Float8OID:
+		if len(p.Value()) == 4 {
+			return pgtype.Float4OID
+		}
+		return pgtype.Float8OID
+	}
+	return oid
+}
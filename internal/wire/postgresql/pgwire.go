@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -22,8 +23,12 @@ import (
 	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
 	"github.com/litesql/go-ha"
 	haconnect "github.com/litesql/go-ha/connect"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/litesql/ha/internal/accesslog"
+	"github.com/litesql/ha/internal/ratelimit"
 	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/tracing"
 )
 
 const (
@@ -32,34 +37,51 @@ const (
 )
 
 type Config struct {
-	User       string
-	Pass       string
+	User string
+	Pass string
+	// Auth is the authentication method, password (default), md5 or
+	// scram-sha-256.
+	Auth string
+	// Users replaces the User/Pass login when set.
+	Users      Users
 	TLSCert    string
 	TLSKey     string
 	CreateOpts sqlite.LoadConfig
+	FlushRows  int
+	// Limiter bounds the connections and the statements rate of each client.
+	Limiter *ratelimit.Limiter
 }
 
 const columnWidth = 256
 
 type Server struct {
 	*wire.Server
+	limiter *ratelimit.Limiter
 }
 
 func NewServer(cfg Config) (*Server, error) {
-	var server Server
+	server := Server{limiter: cfg.Limiter}
+	if cfg.FlushRows > 0 {
+		flushRows = cfg.FlushRows
+	}
+	users := cfg.Users
+	if users == nil {
+		users = StaticUser(cfg.User, cfg.Pass)
+	}
+	auth, err := authStrategy(cfg.Auth, users)
+	if err != nil {
+		return nil, err
+	}
 	opts := []wire.OptionFn{
 		wire.Version("17.0"),
 		wire.SessionMiddleware(server.session),
 		wire.TerminateConn(server.terminateConn),
+		wire.CloseConn(unregisterBackend),
+		wire.BackendKeyData(backendKeyData),
+		wire.CancelRequest(cancelRequest),
 		wire.Logger(slog.Default()),
-		wire.SessionAuthStrategy(
-			wire.ClearTextPassword(func(ctx context.Context, database, username, password string) (context.Context, bool, error) {
-				if username == cfg.User && password == cfg.Pass {
-					slog.InfoContext(ctx, "pg-wire: authenticated", "database", database, "user", username, "remote", wire.RemoteAddress(ctx))
-					return ctx, true, nil
-				}
-				return ctx, false, nil
-			})),
+		wire.SessionAuthStrategy(auth),
+		wire.ErrorSanitizer(pgError),
 	}
 
 	if cfg.TLSCert != "" && cfg.TLSKey != "" {
@@ -71,7 +93,7 @@ func NewServer(cfg Config) (*Server, error) {
 		opts = append(opts, wire.TLSConfig(config))
 	}
 
-	wireServer, err := wire.NewServer(parseFn(cfg.CreateOpts), opts...)
+	wireServer, err := wire.NewServer(rateLimited(cfg.Limiter, accessLogged(statementLogged(traced(parseFn(cfg.CreateOpts))))), opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -81,11 +103,15 @@ func NewServer(cfg Config) (*Server, error) {
 }
 
 func (s *Server) ListenAndServe(port int) error {
-	return s.Server.ListenAndServe(fmt.Sprintf(":%d", port))
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
 }
 
 func (s *Server) Serve(l net.Listener) error {
-	return s.Server.Serve(l)
+	return s.Server.Serve(s.limiter.Listener(l, "postgresql", rejectConn))
 }
 
 func (s *Server) Close() error {
@@ -93,7 +119,8 @@ func (s *Server) Close() error {
 }
 
 func (s *Server) session(ctx context.Context) (context.Context, error) {
-	slog.InfoContext(ctx, "pg-wire: new session established", "remote", wire.RemoteAddress(ctx))
+	registerBackend(ctx)
+	slog.InfoContext(ctx, "pg-wire: new session established", "remote", wire.RemoteAddress(ctx), "pid", sessionID(ctx))
 	return ctx, nil
 }
 
@@ -108,14 +135,46 @@ var reUndo = regexp.MustCompile(`(?i)^UNDO(\s|E|T)\s*([^;\s]+)`)
 
 func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 	return func(ctx context.Context, sql string) (wire.PreparedStatements, error) {
-		slog.InfoContext(ctx, "pg-wire: query received", "remote", wire.RemoteAddress(ctx), "sql", sql)
+		slog.DebugContext(ctx, "pg-wire: query received", "remote", wire.RemoteAddress(ctx), "sql", sql)
 		upper := strings.ToUpper(strings.TrimSpace(sql))
 		if strings.HasPrefix(upper, "-- PING") {
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Complete("pong")
 			})), nil
 		}
 
+		if reBackendPID.MatchString(strings.TrimSpace(sql)) {
+			pid := sessionID(ctx)
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+				writer.Row([]any{pid})
+				return writer.Complete("SELECT 1")
+			}, wire.WithColumns(wire.Columns{
+				wire.Column{
+					Table: 0,
+					Name:  "pg_backend_pid",
+					Oid:   pgtype.Int4OID,
+					Width: 4,
+				},
+			}))), nil
+		}
+		if match := reCancelBackend.FindStringSubmatch(strings.TrimSpace(sql)); len(match) == 2 {
+			cancelled, err := cancelBackend(ctx, match[1])
+			if err != nil {
+				return nil, err
+			}
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+				writer.Row([]any{cancelled})
+				return writer.Complete("SELECT 1")
+			}, wire.WithColumns(wire.Columns{
+				wire.Column{
+					Table: 0,
+					Name:  "pg_cancel_backend",
+					Oid:   pgtype.BoolOID,
+					Width: 1,
+				},
+			}))), nil
+		}
+
 		var dbID string
 		if id, ok := wire.GetAttribute(ctx, databaseIDAttribute); ok {
 			dbID = id.(string)
@@ -125,6 +184,9 @@ func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 			handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				var count int
 				for _, id := range sqlite.Databases() {
+					if checkAccess(ctx, id) != nil {
+						continue
+					}
 					count++
 					status := "0"
 					if id == dbID {
@@ -135,7 +197,7 @@ func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 				return writer.Complete(fmt.Sprintf("SELECT %d", count))
 			}
 
-			return wire.Prepared(wire.NewStatement(handle,
+			return wire.Prepared(newStatement(ctx, handle,
 				wire.WithColumns(wire.Columns{
 					wire.Column{
 						Table: 0,
@@ -155,18 +217,32 @@ func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 		if strings.HasPrefix(upper, "SET ") {
 			if match := reSetDatabase.FindStringSubmatch(sql); len(match) == 3 {
 				dbID := match[2]
+				if err := checkAccess(ctx, dbID); err != nil {
+					return nil, err
+				}
 				if slices.Contains((sqlite.Databases()), dbID) {
 					rollback(ctx)
 					wire.SetAttribute(ctx, databaseIDAttribute, dbID)
-					return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+					return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 						return writer.Complete("OK, " + dbID)
 					})), nil
 				}
 				return nil, fmt.Errorf("database %q not found", dbID)
 			}
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
-				return writer.Complete("ignored")
-			})), nil
+			return setSetting(ctx, sql)
+		}
+		if strings.HasPrefix(upper, "SHOW ") {
+			return showSetting(ctx, sql)
+		}
+		if strings.HasPrefix(upper, "RESET ") {
+			return resetSetting(ctx, sql)
+		}
+
+		if (strings.HasPrefix(upper, "CREATE DATABASE ") || strings.HasPrefix(upper, "DROP DATABASE ")) && !unrestricted(ctx) {
+			return nil, psqlerr.WithCode(errors.New("permission denied to create or drop databases"), codes.InsufficientPrivilege)
+		}
+		if err := checkAccess(ctx, dbID); err != nil {
+			return nil, err
 		}
 
 		if strings.HasPrefix(upper, "CREATE DATABASE ") {
@@ -192,7 +268,7 @@ func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 			dsn = fmt.Sprintf("file:%s%s", destPath, params)
 
 			err := sqlite.Load(ctx, dsn, createDatabaseOptions)
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				if err != nil {
 					return writer.Complete(fmt.Sprintf("failed to create database: %v", err))
 				}
@@ -214,7 +290,7 @@ func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 				os.Remove(dbfile + "-shm")
 				os.Remove(dbfile + "-wal")
 			}
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Complete("OK")
 			})), nil
 		}
@@ -256,7 +332,7 @@ func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 				if err != nil {
 					return nil, fmt.Errorf("undo failed: %v", err)
 				}
-				return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+				return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 					return writer.Complete(fmt.Sprintf("undone transactions in the last %s", duration))
 				})), nil
 			}
@@ -268,7 +344,7 @@ func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 			if err != nil {
 				return nil, fmt.Errorf("undo failed: %v", err)
 			}
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				if seq == 0 {
 					return writer.Complete("undone the last transaction")
 				}
@@ -344,34 +420,42 @@ func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 				}
 				return nil
 			}
-			return wire.Prepared(wire.NewStatement(handle, wire.WithColumns(columns))), nil
+			return wire.Prepared(newStatement(ctx, handle, wire.WithColumns(columns))), nil
+		}
+
+		if reCatalog.MatchString(sql) {
+			return catalogQuery(ctx, dbID, sql)
 		}
 
 		db, err := sqlite.DB(dbID)
 		if err != nil {
 			return nil, err
 		}
+		sql, err = sqlite.InterceptQuery(ctx, dbID, sql)
+		if err != nil {
+			return nil, psqlerr.WithCode(err, codes.InsufficientPrivilege)
+		}
 
 		stmt, err := ha.ParseStatement(ctx, sql)
 		if err != nil {
-			return nil, psqlerr.WithCode(err, codes.SyntaxErrorOrAccessRuleViolation)
+			return nil, psqlerr.WithCode(err, codes.Syntax)
 		}
 
 		switch {
 		case stmt.Begin():
-			err = begin(ctx, db)
+			err = begin(ctx, db, beginMode(sql))
 			if err != nil {
 				return nil, err
 			}
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Empty()
 			})), nil
 		case stmt.Commit():
-			err = commit(ctx)
+			err = commit(ctx, db)
 			if err != nil {
 				return nil, err
 			}
-			return wire.Prepared(wire.NewStatement(func(ctxHandler context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctxHandler context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Empty()
 			})), nil
 		case stmt.Rollback():
@@ -379,11 +463,16 @@ func parseFn(createDatabaseOptions sqlite.LoadConfig) wire.ParseFn {
 			if err != nil {
 				return nil, err
 			}
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Empty()
 			})), nil
+		case stmt.ModifiesDatabase() && sqlite.ReadOnly(dbID):
+			return nil, psqlerr.WithCode(fmt.Errorf("database %q: %w", dbID, sqlite.ErrReadOnly), codes.ReadOnlySQLTransaction)
 		}
-		return handler(ctx, stmt, db)
+		stmts, err := handler(ctx, stmt, db)
+		// the rows of a query are streamed later
+		sqlite.AfterQuery(ctx, dbID, sql, err)
+		return stmts, err
 	}
 }
 
@@ -392,48 +481,60 @@ type execerQuerier interface {
 	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
 }
 
+// executor returns the transaction of the session, or the database outside a
+// transaction.
+func executor(ctx context.Context, db *sql.DB) execerQuerier {
+	if tx, ok := wire.GetAttribute(ctx, transactionAttribute); ok && tx != nil {
+		return tx.(*sql.Tx)
+	}
+	return db
+}
+
 func handler(ctx context.Context, stmt *ha.Statement, db *sql.DB) (wire.PreparedStatements, error) {
 	if len(stmt.Parameters()) > 0 {
 		return handlerPrepared(ctx, stmt, db)
 	}
-	var (
-		eq  execerQuerier
-		err error
-	)
-	if tx, ok := wire.GetAttribute(ctx, transactionAttribute); ok && tx != nil {
-		ctxTx := tx.(*sql.Tx)
-		eq = ctxTx
-	} else {
-		eq = db
+	if sqlite.IsQuery(stmt.Source()) {
+		return streamQuery(ctx, stmt.Source(), db)
 	}
-	if eq == nil {
-		panic("eq nil")
+	eq := executor(ctx, db)
+	if err := waitMinSeq(ctx); err != nil {
+		return nil, err
 	}
-	resp, err := sqlite.Exec(ctx, eq, stmt.Source(), nil)
+	execCtx, cancel := cancellable(ctx)
+	resp, err := sqlite.Exec(execCtx, eq, stmt.Source(), nil)
+	cancel()
+	auditStatement(ctx, stmt.Source(), nil, resp, err)
 	if err != nil {
 		return nil, err
 	}
+	recordSeq(ctx)
+	if resp.NoReturning {
+		accesslog.SetRows(ctx, resp.RowsAffected)
+	} else {
+		accesslog.SetRows(ctx, int64(len(resp.Rows)))
+	}
 
 	if resp.NoReturning {
 		switch {
 		case stmt.IsInsert():
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Complete(fmt.Sprintf("INSERT 0 %d", resp.RowsAffected))
 			})), nil
 		case stmt.IsDelete():
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Complete(fmt.Sprintf("DELETE %d", resp.RowsAffected))
 			})), nil
 		case stmt.IsUpdate():
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Complete(fmt.Sprintf("UPDATE %d", resp.RowsAffected))
 			})), nil
 		case stmt.Type() != ha.TypeOther:
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Complete(stmt.Type())
 			})), nil
 		default:
-			return wire.Prepared(wire.NewStatement(func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 				return writer.Empty()
 			})), nil
 		}
@@ -451,7 +552,7 @@ func handler(ctx context.Context, stmt *ha.Statement, db *sql.DB) (wire.Prepared
 
 	handle := func(_ context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
 		for _, row := range resp.Rows {
-			err := writeRow(writer, row)
+			err := writeRow(ctx, writer, row)
 			if err != nil {
 				slog.ErrorContext(ctx, "pg-wire: write row", "error", err)
 				return err
@@ -464,15 +565,12 @@ func handler(ctx context.Context, stmt *ha.Statement, db *sql.DB) (wire.Prepared
 		}
 		return nil
 	}
-	return wire.Prepared(wire.NewStatement(handle, wire.WithColumns(columns))), nil
+	return wire.Prepared(newStatement(ctx, handle, wire.WithColumns(columns))), nil
 }
 
 func handlerPrepared(ctx context.Context, stmt *ha.Statement, db *sql.DB) (wire.PreparedStatements, error) {
 	bindParameters := stmt.Parameters()
-	parameters := make([]uint32, len(bindParameters))
-	for i := range parameters {
-		parameters[i] = 0
-	}
+	parameters := parameterTypes(ctx, executor(ctx, db), stmt.Source(), bindParameters)
 	options := []wire.PreparedOptionFn{wire.WithParameters(parameters)}
 
 	cols := stmt.Columns()
@@ -491,29 +589,44 @@ func handlerPrepared(ctx context.Context, stmt *ha.Statement, db *sql.DB) (wire.
 		}
 		options = append(options, wire.WithColumns(columns))
 	}
-	var (
-		eq execerQuerier
-	)
-	if tx, ok := wire.GetAttribute(ctx, transactionAttribute); ok && tx != nil {
-		eq = tx.(*sql.Tx)
-	} else {
-		eq = db
-	}
-	handle := func(ctxHandle context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+	oids := parameters
+	handle := func(ctxHandle context.Context, writer wire.DataWriter, parameters []wire.Parameter) (err error) {
+		ctxHandle, span := tracing.StartKind(ctxHandle, "pgwire execute", trace.SpanKindServer, statementAttributes(ctxHandle, stmt.Source())...)
+		defer func() { tracing.End(span, err) }()
 		params := make(map[string]any)
 		for i, p := range parameters {
-			value, err := p.Scan(25) // postgresql OID type text -> oid.T_text
+			var oid uint32
+			if i < len(oids) {
+				oid = oids[i]
+			}
+			value, err := parameterValue(oid, p)
 			if err != nil {
 				slog.ErrorContext(ctx, "pg-wire: parameter scan", "error", err)
 				return err
 			}
 			params[bindParameters[i]] = value
 		}
-		resp, err := sqlite.Exec(ctxHandle, eq, stmt.Source(), params)
+		eq := executor(ctxHandle, db)
+		if sqlite.IsQuery(stmt.Source()) {
+			return writeRows(ctxHandle, writer, eq, stmt.Source(), params)
+		}
+		if err := waitMinSeq(ctxHandle); err != nil {
+			return err
+		}
+		execCtx, cancel := cancellable(ctxHandle)
+		resp, err := sqlite.Exec(execCtx, eq, stmt.Source(), params)
+		cancel()
+		auditStatement(ctxHandle, stmt.Source(), params, resp, err)
 		if err != nil {
 			slog.ErrorContext(ctx, "pg-wire: local exec", "error", err, "query", stmt.Source())
 			return err
 		}
+		recordSeq(ctxHandle)
+		if resp.NoReturning {
+			accesslog.SetRows(ctxHandle, resp.RowsAffected)
+		} else {
+			accesslog.SetRows(ctxHandle, int64(len(resp.Rows)))
+		}
 
 		if resp.NoReturning {
 			switch {
@@ -531,7 +644,7 @@ func handlerPrepared(ctx context.Context, stmt *ha.Statement, db *sql.DB) (wire.
 		}
 
 		for _, row := range resp.Rows {
-			err := writeRow(writer, row)
+			err := writeRow(ctx, writer, row)
 			if err != nil {
 				slog.ErrorContext(ctx, "pg-wire: write row", "error", err)
 				return err
@@ -545,18 +658,33 @@ func handlerPrepared(ctx context.Context, stmt *ha.Statement, db *sql.DB) (wire.
 		return nil
 	}
 
-	return wire.Prepared(wire.NewStatement(handle, options...)), nil
+	return wire.Prepared(newStatement(ctx, handle, options...)), nil
+}
+
+var (
+	reBeginMode      = regexp.MustCompile(`(?i)^\s*BEGIN\s+(DEFERRED|IMMEDIATE|EXCLUSIVE)\b`)
+	reBeginIsolation = regexp.MustCompile(`(?i)\bISOLATION\s+LEVEL\s+(SERIALIZABLE|REPEATABLE\s+READ)\b`)
+)
+
+// beginMode returns the mode of BEGIN DEFERRED, IMMEDIATE or EXCLUSIVE. The
+// serializable and repeatable read isolation levels begin immediate, so the
+// transaction holds the write lock from its start.
+func beginMode(query string) sqlite.BeginMode {
+	if match := reBeginMode.FindStringSubmatch(query); match != nil {
+		return sqlite.BeginMode(strings.ToLower(match[1]))
+	}
+	if reBeginIsolation.MatchString(query) {
+		return sqlite.BeginImmediate
+	}
+	return sqlite.BeginDeferred
 }
 
-func begin(ctx context.Context, db *sql.DB) error {
+func begin(ctx context.Context, db *sql.DB, mode sqlite.BeginMode) error {
 	existsTx, ok := wire.GetAttribute(ctx, transactionAttribute)
 	if ok && existsTx != nil {
 		return nil
 	}
-	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{
-		Isolation: sql.LevelReadCommitted,
-		ReadOnly:  false,
-	})
+	tx, err := sqlite.BeginTx(context.Background(), db, mode)
 	if err != nil {
 		return err
 	}
@@ -564,15 +692,16 @@ func begin(ctx context.Context, db *sql.DB) error {
 	return nil
 }
 
-func commit(ctx context.Context) error {
+func commit(ctx context.Context, db *sql.DB) error {
 	txContext, ok := wire.GetAttribute(ctx, transactionAttribute)
 	if ok && txContext != nil {
 		tx := txContext.(*sql.Tx)
 		wire.SetAttribute(ctx, transactionAttribute, nil)
-		err := tx.Commit()
-		if err != nil {
+		endTransactionSettings(ctx)
+		if err := sqlite.Commit(ctx, db, tx); err != nil {
 			return err
 		}
+		recordSeq(ctx)
 	}
 	return nil
 }
@@ -582,6 +711,7 @@ func rollback(ctx context.Context) error {
 	if ok && txContext != nil {
 		tx := txContext.(*sql.Tx)
 		wire.SetAttribute(ctx, transactionAttribute, nil)
+		endTransactionSettings(ctx)
 		err := tx.Rollback()
 		if err != nil {
 			return err
@@ -590,18 +720,38 @@ func rollback(ctx context.Context) error {
 	return nil
 }
 
-func writeRow(writer wire.DataWriter, row []any) error {
-	strs := make([]any, len(row))
+func writeRow(ctx context.Context, writer wire.DataWriter, row []any) error {
+	loc := timeZone(ctx)
+	values := make([]any, len(row))
 	for i, v := range row {
-		if row == nil {
-			continue
-		}
-		switch v := v.(type) {
-		case *any:
-			strs[i] = fmt.Sprintf("%v", *v)
-			continue
+		values[i] = textValue(v, loc)
+	}
+	return writer.Row(values)
+}
+
+// textValue converts a SQLite value to the text format of the columns. NULL
+// is kept as nil so it is sent as a SQL NULL (not the "<nil>" string), blobs
+// use the PostgreSQL bytea hex format and timestamps RFC 3339 in the TimeZone
+// of the session.
+func textValue(v any, loc *time.Location) any {
+	if p, ok := v.(*any); ok {
+		if p == nil {
+			return nil
 		}
-		strs[i] = fmt.Sprintf("%v", v)
+		v = *p
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return v
+	case []byte:
+		return `\x` + hex.EncodeToString(v)
+	case time.Time:
+		return v.In(loc).Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
 	}
-	return writer.Row(strs)
 }
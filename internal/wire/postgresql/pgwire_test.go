@@ -2,12 +2,16 @@ package postgresql_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/litesql/go-ha"
@@ -398,3 +402,430 @@ func TestTransactionPrepared(t *testing.T) {
 		t.Fatalf("unexpected name: want %q got %q", name, name2)
 	}
 }
+
+func TestNullValues(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	server, err := postgresql.NewServer(postgresql.Config{
+		User: "test", Pass: "test",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer server.Shutdown(context.TODO())
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	connString := fmt.Sprintf("postgresql://%s:%s@localhost:%d/ha", "test", "test", port)
+
+	pgPool, err := pgxpool.New(context.TODO(), connString)
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pgPool.Close()
+
+	_, err = pgPool.Exec(context.TODO(), "CREATE TABLE user_null(ID INT, Name TEXT, Data BLOB)")
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	_, err = pgPool.Exec(context.TODO(), "INSERT INTO user_null VALUES(1, NULL, x'0102'), (2, '', NULL)")
+	if err != nil {
+		t.Fatalf("failed to insert rows: %v", err)
+	}
+
+	rows, err := pgPool.Query(context.TODO(), "SELECT name, data FROM user_null ORDER BY id")
+	if err != nil {
+		t.Fatalf("failed to select rows: %v", err)
+	}
+	var got [][2]*string
+	for rows.Next() {
+		var name, data *string
+		if err := rows.Scan(&name, &data); err != nil {
+			t.Fatalf("failed to scan row: %v", err)
+		}
+		got = append(got, [2]*string{name, data})
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("rows error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("unexpected number of rows: want 2 got %d", len(got))
+	}
+	if got[0][0] != nil || got[0][1] == nil || *got[0][1] != `\x0102` {
+		t.Errorf("unexpected first row: name=%v data=%v", got[0][0], got[0][1])
+	}
+	if got[1][0] == nil || *got[1][0] != "" || got[1][1] != nil {
+		t.Errorf("unexpected second row: name=%v data=%v", got[1][0], got[1][1])
+	}
+}
+
+func TestParameterTypes(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	server, err := postgresql.NewServer(postgresql.Config{
+		User: "test", Pass: "test",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer server.Shutdown(context.TODO())
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	connString := fmt.Sprintf("postgresql://%s:%s@localhost:%d/ha", "test", "test", port)
+
+	pgPool, err := pgxpool.New(context.TODO(), connString)
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pgPool.Close()
+
+	_, err = pgPool.Exec(context.TODO(), "CREATE TABLE typed_params(id INTEGER, active BOOLEAN, score REAL, created DATETIME, data BLOB)")
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	created := time.Date(2026, 10, 16, 12, 30, 0, 0, time.UTC)
+	for i := range 3 {
+		_, err = pgPool.Exec(context.TODO(), "INSERT INTO typed_params(id, active, score, created, data) VALUES ($1, $2, $3, $4, $5)",
+			i+1, i%2 == 0, 1.5, created, []byte{1, 2})
+		if err != nil {
+			t.Fatalf("failed to insert row: %v", err)
+		}
+	}
+
+	var id, active, score, createdText, data string
+	err = pgPool.QueryRow(context.TODO(), "SELECT typeof(id), active, typeof(score), created, hex(data) FROM typed_params WHERE id > $1 AND active = $2 LIMIT $3",
+		1, true, 1).Scan(&id, &active, &score, &createdText, &data)
+	if err != nil {
+		t.Fatalf("failed to select row: %v", err)
+	}
+	// the BOOLEAN and DATETIME columns are read as Go values and sent in text
+	if id != "integer" || active != "true" || score != "real" || createdText != "2026-10-16T12:30:00Z" || data != "0102" {
+		t.Errorf("unexpected row: id=%s active=%s score=%s created=%s data=%s", id, active, score, createdText, data)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	server, err := postgresql.NewServer(postgresql.Config{
+		User: "test", Pass: "test",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer server.Shutdown(context.TODO())
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	connString := fmt.Sprintf("postgresql://%s:%s@localhost:%d/ha", "test", "test", port)
+
+	conn, err := pgx.Connect(context.TODO(), connString)
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	defer conn.Close(context.TODO())
+
+	show := func(name string) string {
+		t.Helper()
+		var value string
+		if err := conn.QueryRow(context.TODO(), "SHOW "+name).Scan(&value); err != nil {
+			t.Fatalf("SHOW %s: %v", name, err)
+		}
+		return value
+	}
+	for _, sql := range []string{"SET TimeZone TO 'America/Sao_Paulo'", "SET statement_timeout = 5000", "SET search_path TO public"} {
+		if _, err := conn.Exec(context.TODO(), sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	if got := show("timezone"); got != "America/Sao_Paulo" {
+		t.Errorf("TimeZone = %q", got)
+	}
+	if got := show("statement_timeout"); got != "5000" {
+		t.Errorf("statement_timeout = %q", got)
+	}
+	if got := show("client_encoding"); got != "UTF8" {
+		t.Errorf("client_encoding = %q", got)
+	}
+
+	errorCodes := map[string]string{
+		"SET search_path TO app":        "22023",
+		"SET client_encoding TO LATIN1": "22023",
+		"SET server_version = '9.6'":    "55P02",
+		"SHOW missing_setting":          "42704",
+	}
+	for sql, code := range errorCodes {
+		_, err := conn.Exec(context.TODO(), sql)
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != code {
+			t.Errorf("%s: want code %s got %v", sql, code, err)
+		}
+	}
+
+	if _, err := conn.Exec(context.TODO(), "RESET ALL"); err != nil {
+		t.Fatalf("RESET ALL: %v", err)
+	}
+	if got := show("timezone"); got != "UTC" {
+		t.Errorf("TimeZone after RESET = %q", got)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	server, err := postgresql.NewServer(postgresql.Config{
+		User: "test", Pass: "test",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer server.Shutdown(context.TODO())
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	connString := fmt.Sprintf("postgresql://%s:%s@localhost:%d/ha", "test", "test", port)
+
+	pgPool, err := pgxpool.New(context.TODO(), connString)
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pgPool.Close()
+
+	if _, err := pgPool.Exec(context.TODO(), "CREATE TABLE frozen(ID INT)"); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := sqlite.SetReadOnly(context.TODO(), "", true); err != nil {
+		t.Fatalf("failed to set read-only: %v", err)
+	}
+	defer sqlite.SetReadOnly(context.TODO(), "", false)
+
+	_, err = pgPool.Exec(context.TODO(), "INSERT INTO frozen VALUES(1)")
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "25006" {
+		t.Fatalf("insert on a read-only database: want SQLSTATE 25006, got %v", err)
+	}
+	var count string
+	if err := pgPool.QueryRow(context.TODO(), "SELECT count(*) FROM frozen").Scan(&count); err != nil {
+		t.Fatalf("query on a read-only database: %v", err)
+	}
+
+	if err := sqlite.SetReadOnly(context.TODO(), "", false); err != nil {
+		t.Fatalf("failed to unset read-only: %v", err)
+	}
+	if _, err := pgPool.Exec(context.TODO(), "INSERT INTO frozen VALUES(1)"); err != nil {
+		t.Fatalf("insert after unfreezing: %v", err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	server, err := postgresql.NewServer(postgresql.Config{
+		User: "test", Pass: "test",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer server.Shutdown(context.TODO())
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	connString := fmt.Sprintf("postgresql://%s:%s@localhost:%d/ha", "test", "test", port)
+
+	pgPool, err := pgxpool.New(context.TODO(), connString)
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pgPool.Close()
+
+	_, err = pgPool.Exec(context.TODO(), `CREATE TABLE accounts(
+		id INTEGER PRIMARY KEY,
+		email TEXT NOT NULL UNIQUE,
+		balance INTEGER CONSTRAINT positive_balance CHECK (balance >= 0)
+	)`)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if _, err := pgPool.Exec(context.TODO(), "INSERT INTO accounts VALUES(1, 'a@ha', 10)"); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	// psql-wire doesn't send the constraint name field, the violated key is
+	// in the detail
+	tests := []struct {
+		name   string
+		sql    string
+		code   string
+		detail string
+	}{
+		{"primary key", "INSERT INTO accounts VALUES(1, 'b@ha', 10)", "23505", `Key (id) already exists in table "accounts".`},
+		{"unique", "INSERT INTO accounts VALUES(2, 'a@ha', 10)", "23505", `Key (email) already exists in table "accounts".`},
+		{"not null", "INSERT INTO accounts VALUES(2, NULL, 10)", "23502", `Null value in column "email" of table "accounts".`},
+		{"check", "INSERT INTO accounts VALUES(2, 'b@ha', -1)", "23514", ""},
+		{"syntax", "INSERT INTO accounts VALUE(2)", "42601", ""},
+		{"undefined table", "DELETE FROM missing", "42P01", ""},
+		{"undefined column", "UPDATE accounts SET missing = 1", "42703", ""},
+		{"duplicate table", "CREATE TABLE accounts(id INTEGER)", "42P07", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pgPool.Exec(context.TODO(), tt.sql)
+			var pgErr *pgconn.PgError
+			if !errors.As(err, &pgErr) {
+				t.Fatalf("want a PostgreSQL error, got %v", err)
+			}
+			if pgErr.Code != tt.code {
+				t.Errorf("got SQLSTATE %s, want %s: %v", pgErr.Code, tt.code, err)
+			}
+			if pgErr.Detail != tt.detail {
+				t.Errorf("got detail %q, want %q", pgErr.Detail, tt.detail)
+			}
+		})
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	server, err := postgresql.NewServer(postgresql.Config{
+		User: "test", Pass: "test",
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer server.Shutdown(context.TODO())
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	connString := fmt.Sprintf("postgresql://%s:%s@localhost:%d/ha", "test", "test", port)
+
+	pgPool, err := pgxpool.New(context.TODO(), connString)
+	if err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	defer pgPool.Close()
+
+	if _, err := pgPool.Exec(context.TODO(), "CREATE TABLE catalog_items(id INTEGER PRIMARY KEY, name VARCHAR(20) NOT NULL UNIQUE, price REAL)"); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	var database, version string
+	if err := pgPool.QueryRow(context.TODO(), "SELECT current_database(), version()").Scan(&database, &version); err != nil {
+		t.Fatalf("current_database: %v", err)
+	}
+	if database != "test.db" || !strings.HasPrefix(version, "PostgreSQL ") {
+		t.Errorf("got database %q and version %q", database, version)
+	}
+
+	collect := func(sql string, args ...any) [][]string {
+		t.Helper()
+		rows, err := pgPool.Query(context.TODO(), sql, args...)
+		if err != nil {
+			t.Fatalf("query %q: %v", sql, err)
+		}
+		defer rows.Close()
+		var list [][]string
+		for rows.Next() {
+			values, err := rows.Values()
+			if err != nil {
+				t.Fatalf("query %q: %v", sql, err)
+			}
+			row := make([]string, len(values))
+			for i, v := range values {
+				row[i] = fmt.Sprint(v)
+			}
+			list = append(list, row)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("query %q: %v", sql, err)
+		}
+		return list
+	}
+
+	columns := collect(`SELECT column_name, data_type, is_nullable FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name = $1 ORDER BY ordinal_position`, "catalog_items")
+	want := [][]string{
+		{"id", "bigint", "NO"},
+		{"name", "character varying", "NO"},
+		{"price", "double precision", "YES"},
+	}
+	if fmt.Sprint(columns) != fmt.Sprint(want) {
+		t.Errorf("got columns %v, want %v", columns, want)
+	}
+
+	// the query of psql \d catalog_items
+	var oid, relname string
+	err = pgPool.QueryRow(context.TODO(), `SELECT c.oid, c.relname FROM pg_catalog.pg_class c
+		LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relname OPERATOR(pg_catalog.~) '^(catalog_items)$' COLLATE pg_catalog.default
+		AND pg_catalog.pg_table_is_visible(c.oid) ORDER BY 2`).Scan(&oid, &relname)
+	if err != nil {
+		t.Fatalf("pg_class: %v", err)
+	}
+	indexes := collect(`SELECT c2.relname, i.indisprimary, pg_catalog.pg_get_indexdef(i.indexrelid, 0, true)
+		FROM pg_catalog.pg_class c, pg_catalog.pg_class c2, pg_catalog.pg_index i
+		WHERE c.oid = '` + oid + `' AND c.oid = i.indrelid AND i.indexrelid = c2.oid
+		ORDER BY i.indisprimary DESC, c2.relname`)
+	want = [][]string{
+		{"catalog_items_pkey", "t", "CREATE UNIQUE INDEX catalog_items_pkey ON public.catalog_items USING btree (id)"},
+		{"catalog_items_name_key", "f", "CREATE UNIQUE INDEX catalog_items_name_key ON public.catalog_items USING btree (name)"},
+	}
+	if fmt.Sprint(indexes) != fmt.Sprint(want) {
+		t.Errorf("got indexes %v, want %v", indexes, want)
+	}
+}
@@ -0,0 +1,37 @@
+package postgresql
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+
+	"github.com/litesql/ha/internal/querylog"
+)
+
+func statementLogged(parse wire.ParseFn) wire.ParseFn {
+	if !querylog.Enabled() {
+		return parse
+	}
+	return func(ctx context.Context, sql string) (wire.PreparedStatements, error) {
+		start := time.Now()
+		stmts, err := parse(ctx, sql)
+		entry := querylog.Entry{
+			Protocol: "postgresql",
+			Session:  strconv.Itoa(int(sessionID(ctx))),
+			SQL:      sql,
+			Duration: time.Since(start),
+			Error:    err,
+		}
+		if id, ok := wire.GetAttribute(ctx, databaseIDAttribute); ok {
+			entry.Database, _ = id.(string)
+		}
+		entry.User, _ = ctx.Value(userContextKey{}).(string)
+		if addr := wire.RemoteAddress(ctx); addr != nil {
+			entry.Remote = addr.String()
+		}
+		querylog.Log(entry)
+		return stmts, err
+	}
+}
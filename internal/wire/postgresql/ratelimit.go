@@ -0,0 +1,53 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+
+	"github.com/litesql/ha/internal/ratelimit"
+)
+
+var errTooManyRequests = errors.New("too many requests, slow down")
+
+// rateLimited refuses the statements of the clients above the rate limit.
+func rateLimited(limiter *ratelimit.Limiter, parse wire.ParseFn) wire.ParseFn {
+	if !limiter.Enabled() {
+		return parse
+	}
+	return func(ctx context.Context, sql string) (wire.PreparedStatements, error) {
+		if addr := wire.RemoteAddress(ctx); addr != nil && !limiter.Allow(addr.String()) {
+			ratelimit.Rejected("postgresql", "rate")
+			return nil, psqlerr.WithHint(psqlerr.WithCode(errTooManyRequests, codes.ConfigurationLimitExceeded), "retry later")
+		}
+		return parse(ctx, sql)
+	}
+}
+
+// rejectConn sends the FATAL too_many_connections error a PostgreSQL server
+// answers to a connection above its limit.
+func rejectConn(conn net.Conn) {
+	var fields []byte
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{
+		{'S', "FATAL"},
+		{'V', "FATAL"},
+		{'C', string(codes.TooManyConnections)},
+		{'M', "sorry, too many connections from this client"},
+	} {
+		fields = append(fields, field.kind)
+		fields = append(fields, field.value...)
+		fields = append(fields, 0)
+	}
+	fields = append(fields, 0)
+	msg := []byte{'E'}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(fields)+4))
+	conn.Write(append(msg, fields...))
+}
@@ -0,0 +1,348 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+const settingsAttribute = "settings"
+
+// setting is a session variable (GUC) with its default value. The value set
+// is checked and normalized by check, the read-only ones can't be set.
+type setting struct {
+	name     string
+	value    string
+	readOnly bool
+	check    func(value string) (string, error)
+}
+
+var settings = map[string]setting{
+	"search_path":                 {name: "search_path", value: `"$user", public`, check: checkSearchPath},
+	"timezone":                    {name: "TimeZone", value: "UTC", check: checkTimeZone},
+	"client_encoding":             {name: "client_encoding", value: "UTF8", check: checkClientEncoding},
+	"statement_timeout":           {name: "statement_timeout", value: "0", check: checkStatementTimeout},
+	"server_version":              {name: "server_version", value: "17.0", readOnly: true},
+	"server_encoding":             {name: "server_encoding", value: "UTF8", readOnly: true},
+	"standard_conforming_strings": {name: "standard_conforming_strings", value: "on", readOnly: true},
+	"transaction_isolation":       {name: "transaction_isolation", value: "serializable", readOnly: true},
+	"ha.min_seq":                  {name: "ha.min_seq", value: "0", check: checkSeq},
+	"ha.seq":                      {name: "ha.seq", value: "0", readOnly: true},
+}
+
+// sessionSettings are the values set in the session, by the lower case name.
+type sessionSettings struct {
+	// defaults are the values of the startup message, restored by RESET.
+	defaults map[string]string
+	values   map[string]string
+	// saved are the values before the first SET LOCAL of the transaction,
+	// restored when it ends.
+	saved map[string]string
+}
+
+// sessionSettingsOf returns the settings of the session, initialized with the
+// settings of the startup message, like TimeZone sent by JDBC.
+func sessionSettingsOf(ctx context.Context) *sessionSettings {
+	if s, ok := wire.GetAttribute(ctx, settingsAttribute); ok && s != nil {
+		return s.(*sessionSettings)
+	}
+	s := &sessionSettings{defaults: make(map[string]string)}
+	for key, value := range wire.ClientParameters(ctx) {
+		name := strings.ToLower(string(key))
+		if slices.Contains([]string{"user", "database", "options", "replication"}, name) {
+			continue
+		}
+		if value, err := checkSetting(name, value); err == nil {
+			s.defaults[name] = value
+		}
+	}
+	s.values = maps.Clone(s.defaults)
+	wire.SetAttribute(ctx, settingsAttribute, s)
+	return s
+}
+
+// settingValue returns the value of the setting in the session.
+func settingValue(ctx context.Context, name string) (string, bool) {
+	name = strings.ToLower(name)
+	if _, ok := wire.GetSession(ctx); ok {
+		if value, ok := sessionSettingsOf(ctx).values[name]; ok {
+			return value, true
+		}
+	}
+	s, ok := settings[name]
+	return s.value, ok
+}
+
+func checkSetting(name, value string) (string, error) {
+	s, ok := settings[name]
+	if !ok {
+		return value, nil
+	}
+	if s.readOnly {
+		return "", psqlerr.WithCode(fmt.Errorf("parameter %q cannot be changed", s.name), codes.CantChangeRuntimeParam)
+	}
+	if s.check == nil {
+		return value, nil
+	}
+	value, err := s.check(value)
+	if err != nil {
+		return "", psqlerr.WithCode(fmt.Errorf("invalid value for parameter %q: %w", s.name, err), codes.InvalidParameterValue)
+	}
+	return value, nil
+}
+
+func checkSearchPath(value string) (string, error) {
+	for schema := range strings.SplitSeq(value, ",") {
+		schema = strings.Trim(strings.TrimSpace(schema), `"`)
+		if !slices.Contains([]string{"$user", "public", "pg_catalog", "information_schema"}, strings.ToLower(schema)) {
+			return "", fmt.Errorf("schema %q does not exist, every table is in the public schema", schema)
+		}
+	}
+	return value, nil
+}
+
+func checkTimeZone(value string) (string, error) {
+	if strings.EqualFold(value, "utc") || strings.EqualFold(value, "gmt") || strings.EqualFold(value, "z") {
+		return "UTC", nil
+	}
+	if _, err := time.LoadLocation(value); err != nil {
+		return "", fmt.Errorf("unknown time zone %q", value)
+	}
+	return value, nil
+}
+
+func checkClientEncoding(value string) (string, error) {
+	switch strings.ToUpper(value) {
+	case "UTF8", "UTF-8", "UNICODE":
+		return "UTF8", nil
+	}
+	return "", fmt.Errorf("encoding %q is not supported, use UTF8", value)
+}
+
+func checkStatementTimeout(value string) (string, error) {
+	if _, err := parseTimeout(value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+var reTimeout = regexp.MustCompile(`^\s*(\d+)\s*(us|ms|s|min|h|d)?\s*$`)
+
+// parseTimeout parses a PostgreSQL duration, in milliseconds without unit.
+func parseTimeout(value string) (time.Duration, error) {
+	match := reTimeout.FindStringSubmatch(strings.ToLower(value))
+	if match == nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := map[string]time.Duration{"us": time.Microsecond, "": time.Millisecond, "ms": time.Millisecond, "s": time.Second, "min": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[match[2]]
+	return time.Duration(n) * unit, nil
+}
+
+// statementTimeout returns the statement_timeout of the session, 0 when
+// disabled.
+func statementTimeout(ctx context.Context) time.Duration {
+	value, _ := settingValue(ctx, "statement_timeout")
+	timeout, _ := parseTimeout(value)
+	return timeout
+}
+
+// timeZone returns the location of the TimeZone of the session, rendering
+// the timestamps.
+func timeZone(ctx context.Context) *time.Location {
+	value, _ := settingValue(ctx, "timezone")
+	loc, err := time.LoadLocation(value)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+var (
+	reSetting = regexp.MustCompile(`(?is)^SET\s+(?:(SESSION|LOCAL)\s+)?(?:TIME\s+ZONE\s+(.+?)|([\w.]+)\s*(?:=|\s+TO\s+)\s*(.+?))\s*;?\s*$`)
+	reShow    = regexp.MustCompile(`(?is)^SHOW\s+(ALL|TIME\s+ZONE|TRANSACTION\s+ISOLATION\s+LEVEL|[\w.]+)\s*;?\s*$`)
+	reReset   = regexp.MustCompile(`(?is)^RESET\s+(ALL|TIME\s+ZONE|[\w.]+)\s*;?\s*$`)
+)
+
+// settingName returns the name of the setting of SHOW and RESET.
+func settingName(name string) string {
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	switch name {
+	case "time zone":
+		return "timezone"
+	case "transaction isolation level":
+		return "transaction_isolation"
+	}
+	return name
+}
+
+// setSetting runs SET name TO value, SET name = value and SET TIME ZONE. The
+// value is checked when the statement is parsed and set when it runs, so a
+// prepared SET can be executed again. The statements not setting a variable,
+// like SET TRANSACTION, are ignored.
+func setSetting(ctx context.Context, query string) (wire.PreparedStatements, error) {
+	match := reSetting.FindStringSubmatch(strings.TrimSpace(query))
+	if match == nil {
+		return completed(ctx, "SET", nil), nil
+	}
+	name, value := strings.ToLower(match[3]), settingText(match[4])
+	if match[2] != "" {
+		name, value = "timezone", settingText(match[2])
+	}
+	local := strings.EqualFold(match[1], "LOCAL")
+	reset := strings.EqualFold(value, "DEFAULT") || (name == "timezone" && strings.EqualFold(value, "LOCAL"))
+	if s, ok := settings[name]; ok && s.readOnly {
+		return nil, psqlerr.WithCode(fmt.Errorf("parameter %q cannot be changed", s.name), codes.CantChangeRuntimeParam)
+	}
+	if !reset {
+		var err error
+		if value, err = checkSetting(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return completed(ctx, "SET", func(ctx context.Context) {
+		s := sessionSettingsOf(ctx)
+		if local {
+			if tx, ok := wire.GetAttribute(ctx, transactionAttribute); !ok || tx == nil {
+				// like PostgreSQL, SET LOCAL has no effect outside of a
+				// transaction
+				return
+			}
+			if s.saved == nil {
+				s.saved = maps.Clone(s.values)
+			}
+		}
+		if reset {
+			s.reset(name)
+			return
+		}
+		s.values[name] = value
+	}), nil
+}
+
+// settingText unquotes the value, keeping the quotes of the identifiers of a
+// list like search_path.
+func settingText(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' && !strings.Contains(value[1:len(value)-1], "'") {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func (s *sessionSettings) reset(name string) {
+	if value, ok := s.defaults[name]; ok {
+		s.values[name] = value
+		return
+	}
+	delete(s.values, name)
+}
+
+// endTransactionSettings restores the values set by SET LOCAL when the
+// transaction ends.
+func endTransactionSettings(ctx context.Context) {
+	s, ok := wire.GetAttribute(ctx, settingsAttribute)
+	if !ok || s == nil {
+		return
+	}
+	ss := s.(*sessionSettings)
+	if ss.saved != nil {
+		ss.values = ss.saved
+		ss.saved = nil
+	}
+}
+
+// resetSetting runs RESET name and RESET ALL.
+func resetSetting(ctx context.Context, query string) (wire.PreparedStatements, error) {
+	match := reReset.FindStringSubmatch(strings.TrimSpace(query))
+	if match == nil {
+		return nil, psqlerr.WithCode(errors.New("invalid RESET syntax"), codes.Syntax)
+	}
+	name := settingName(match[1])
+	if s, ok := settings[name]; ok && s.readOnly {
+		return nil, psqlerr.WithCode(fmt.Errorf("parameter %q cannot be changed", s.name), codes.CantChangeRuntimeParam)
+	}
+	return completed(ctx, "RESET", func(ctx context.Context) {
+		s := sessionSettingsOf(ctx)
+		if name == "all" {
+			s.values = maps.Clone(s.defaults)
+			return
+		}
+		s.reset(name)
+	}), nil
+}
+
+// showSetting runs SHOW name and SHOW ALL.
+func showSetting(ctx context.Context, query string) (wire.PreparedStatements, error) {
+	match := reShow.FindStringSubmatch(strings.TrimSpace(query))
+	if match == nil {
+		return nil, psqlerr.WithCode(errors.New("invalid SHOW syntax"), codes.Syntax)
+	}
+	name := settingName(match[1])
+	if name == "all" {
+		handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+			names := slices.Collect(maps.Keys(settings))
+			for name := range sessionSettingsOf(ctx).values {
+				if _, ok := settings[name]; !ok {
+					names = append(names, name)
+				}
+			}
+			slices.Sort(names)
+			for _, name := range names {
+				value, _ := settingValue(ctx, name)
+				if s, ok := settings[name]; ok {
+					name = s.name
+				}
+				if err := writer.Row([]any{name, value}); err != nil {
+					return err
+				}
+			}
+			return writer.Complete("SHOW")
+		}
+		return wire.Prepared(newStatement(ctx, handle, wire.WithColumns(wire.Columns{
+			{Name: "name", Oid: pgtype.TextOID, Width: columnWidth},
+			{Name: "setting", Oid: pgtype.TextOID, Width: columnWidth},
+		}))), nil
+	}
+	if _, ok := settingValue(ctx, name); !ok {
+		return nil, psqlerr.WithCode(fmt.Errorf("unrecognized configuration parameter %q", name), codes.UndefinedObject)
+	}
+	column := name
+	if s, ok := settings[name]; ok {
+		column = s.name
+	}
+	handle := func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		value, _ := settingValue(ctx, name)
+		if err := writer.Row([]any{value}); err != nil {
+			return err
+		}
+		return writer.Complete("SHOW")
+	}
+	return wire.Prepared(newStatement(ctx, handle, wire.WithColumns(wire.Columns{
+		{Name: column, Oid: pgtype.TextOID, Width: columnWidth},
+	}))), nil
+}
+
+// completed runs fn when the statement is executed, completing with the tag.
+func completed(ctx context.Context, tag string, fn func(ctx context.Context)) wire.PreparedStatements {
+	return wire.Prepared(newStatement(ctx, func(ctx context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		if fn != nil {
+			fn(ctx)
+		}
+		return writer.Complete(tag)
+	}))
+}
@@ -0,0 +1,76 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	wire "github.com/jeroenrinzema/psql-wire"
+
+	"github.com/litesql/ha/internal/accesslog"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// flushRows is the number of rows written between explicit flushes to the
+// client connection.
+var flushRows = 100
+
+type flusher interface {
+	Flush() error
+}
+
+// streamQuery describes the result columns without running the query and
+// streams the rows to the client when the statement is executed. The
+// statement can be executed again after the transaction where it was parsed
+// ends, so the executor is resolved by the handler.
+func streamQuery(ctx context.Context, query string, db *sql.DB) (wire.PreparedStatements, error) {
+	meta, err := sqlite.Columns(ctx, executor(ctx, db), query)
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]wire.Column, len(meta))
+	for i, col := range meta {
+		columns[i] = wire.Column{
+			Table: 0,
+			Name:  col.Name,
+			Oid:   pgtype.TextOID,
+			Width: columnWidth,
+		}
+	}
+	handle := func(ctxHandle context.Context, writer wire.DataWriter, parameters []wire.Parameter) error {
+		return writeRows(ctxHandle, writer, executor(ctxHandle, db), query, nil)
+	}
+	return wire.Prepared(newStatement(ctx, handle, wire.WithColumns(columns))), nil
+}
+
+// writeRows executes the query writing each row to the client as it is read
+// from SQLite, flushing every flushRows rows. It stops as soon as the client
+// goes away or the statement is cancelled.
+func writeRows(ctx context.Context, writer wire.DataWriter, eq execerQuerier, query string, params map[string]any) error {
+	if err := waitMinSeq(ctx); err != nil {
+		return err
+	}
+	execCtx, cancel := cancellable(ctx)
+	defer cancel()
+	var pending int
+	f, canFlush := writer.(flusher)
+	count, err := sqlite.Stream(execCtx, eq, query, params, func(row []any) error {
+		if err := writeRow(ctx, writer, row); err != nil {
+			return err
+		}
+		pending++
+		if canFlush && flushRows > 0 && pending >= flushRows {
+			pending = 0
+			return f.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "pg-wire: stream rows", "error", err, "rows", count, "query", query)
+		return err
+	}
+	accesslog.SetRows(ctx, count)
+	return writer.Complete(fmt.Sprintf("SELECT %d", count))
+}
@@ -0,0 +1,45 @@
+package postgresql
+
+import (
+	"context"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/litesql/ha/internal/tracing"
+)
+
+// traced starts a span for each statement of the sessions. The statements
+// with parameters are executed after the parse, in their own span.
+func traced(parse wire.ParseFn) wire.ParseFn {
+	if !tracing.Enabled() {
+		return parse
+	}
+	return func(ctx context.Context, sql string) (wire.PreparedStatements, error) {
+		ctx, span := tracing.StartKind(ctx, "pgwire "+statementType(sql), trace.SpanKindServer, statementAttributes(ctx, sql)...)
+		stmts, err := parse(ctx, sql)
+		tracing.End(span, err)
+		return stmts, err
+	}
+}
+
+func statementAttributes(ctx context.Context, sql string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system.name", "postgresql"),
+		attribute.String("db.query.text", sql),
+		attribute.Int("ha.session", int(sessionID(ctx))),
+	}
+	if id, ok := wire.GetAttribute(ctx, databaseIDAttribute); ok {
+		if id, ok := id.(string); ok {
+			attrs = append(attrs, attribute.String("db.namespace", id))
+		}
+	}
+	if user, ok := ctx.Value(userContextKey{}).(string); ok {
+		attrs = append(attrs, attribute.String("db.user", user))
+	}
+	if addr := wire.RemoteAddress(ctx); addr != nil {
+		attrs = append(attrs, attribute.String("client.address", addr.String()))
+	}
+	return attrs
+}
@@ -1,31 +1,79 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	_ "embed"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"connectrpc.com/connect"
 	ha "github.com/litesql/go-ha"
 	haconnect "github.com/litesql/go-ha/connect"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
 
+	"github.com/litesql/ha/internal/accesslog"
+	"github.com/litesql/ha/internal/audit"
+	"github.com/litesql/ha/internal/batch"
+	"github.com/litesql/ha/internal/changeset"
 	"github.com/litesql/ha/internal/cli"
+	"github.com/litesql/ha/internal/clusterconfig"
+	"github.com/litesql/ha/internal/compress"
+	"github.com/litesql/ha/internal/consistency"
+	"github.com/litesql/ha/internal/ddlconflict"
+	"github.com/litesql/ha/internal/flowcontrol"
+	"github.com/litesql/ha/internal/handoff"
 	"github.com/litesql/ha/internal/interceptor"
+	"github.com/litesql/ha/internal/invalidation"
+	"github.com/litesql/ha/internal/journal"
+	"github.com/litesql/ha/internal/livequery"
+	"github.com/litesql/ha/internal/locks"
+	"github.com/litesql/ha/internal/maintenance"
+	"github.com/litesql/ha/internal/matview"
 	"github.com/litesql/ha/internal/mcp"
+	"github.com/litesql/ha/internal/metrics"
+	"github.com/litesql/ha/internal/probe"
+	"github.com/litesql/ha/internal/projection"
+	"github.com/litesql/ha/internal/querylog"
+	"github.com/litesql/ha/internal/ratelimit"
+	"github.com/litesql/ha/internal/resync"
+	"github.com/litesql/ha/internal/rowidentify"
+	"github.com/litesql/ha/internal/s3backup"
+	"github.com/litesql/ha/internal/snapshots"
 	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/streamadmin"
+	"github.com/litesql/ha/internal/support"
+	"github.com/litesql/ha/internal/tablefilter"
+	"github.com/litesql/ha/internal/tail"
+	"github.com/litesql/ha/internal/tenant"
+	"github.com/litesql/ha/internal/timetravel"
+	"github.com/litesql/ha/internal/tracing"
+	"github.com/litesql/ha/internal/transform"
+	"github.com/litesql/ha/internal/txlimit"
+	"github.com/litesql/ha/internal/txsession"
+	"github.com/litesql/ha/internal/upgrade"
+	"github.com/litesql/ha/internal/verify"
+	"github.com/litesql/ha/internal/warmup"
 	hahttp "github.com/litesql/ha/internal/wire/http"
 	"github.com/litesql/ha/internal/wire/mysql"
 	"github.com/litesql/ha/internal/wire/postgresql"
@@ -38,19 +86,56 @@ var (
 )
 
 var (
-	flagSet  *ff.FlagSet
-	dbParams *string
-	name     *string
-	port     *uint
-	token    *string
-	logLevel *string
+	flagSet         *ff.FlagSet
+	dbParams        *string
+	name            *string
+	port            *uint
+	token           *string
+	maxConnections  *int
+	rateLimit       *int
+	logLevel        *string
+	skipSelfTest    *bool
+	accessLog       *string
+	accessLogSample *int
+	adminToken      *string
+	debugEndpoints  *bool
+	debugDumpDir    *string
+	otelEndpoint    *string
+	otelService     *string
+	otelSampleRatio *float64
+
+	queryLogSample     *int
+	slowQueryThreshold *time.Duration
+	queryLogValues     *bool
+	auditLog           *string
+	auditSubject       *string
 
 	createDatabaseDir *string
+	seedDir           *string
+	tenantTemplates   *string
+	tenantArchiveDir  *string
 
 	memDB              *bool
 	snapshotInterval   *time.Duration
 	fromLatestSnapshot *bool
 	disableDDLSync     *bool
+	ddlConflict        *string
+
+	snapshotS3Endpoint    *string
+	snapshotS3Region      *string
+	snapshotS3Bucket      *string
+	snapshotS3Prefix      *string
+	snapshotS3Credentials *string
+	snapshotS3Retention   *int
+	snapshotCompression   *string
+	snapshotHistory       *int
+	snapshotHistoryMaxAge *time.Duration
+	snapshotChunkSize     *int
+	snapshotChunkRetries  *int
+	s3GatewayPort         *int
+	s3GatewayBucket       *string
+	s3GatewayRegion       *string
+	s3GatewayCredentials  *string
 
 	staticRemoteLeaderAddr *string
 	dynamicLocalLeaderAddr *string
@@ -59,8 +144,12 @@ var (
 	pgPort            *int
 	pgUser            *string
 	pgPass            *string
+	pgAuth            *string
+	pgUsersFile       *string
+	pgUsersDB         *string
 	pgCert            *string
 	pgKey             *string
+	pgFlushRows       *int
 	pgProxied         *string
 	pgPublicationName *string
 	pgSlotName        *string
@@ -73,6 +162,8 @@ var (
 	mysqlPort              *int
 	mysqlUser              *string
 	mysqlPass              *string
+	mysqlCert              *string
+	mysqlKey               *string
 	mysqlProxied           *string
 	mysqlProxiedInclude    *string
 	mysqlProxiedExclude    *string
@@ -87,26 +178,129 @@ var (
 	debeziumSourceDSN *string
 
 	concurrentQueries *int
+	queryTimeout      *time.Duration
+	maxRows           *int
+	progressChunkSize *int
+	minSeqTimeout     *time.Duration
 	extensions        *string
 
+	txRetries      *int
+	txRetryBackoff *time.Duration
+
+	sqlLint      *string
+	sqlLintRules *string
+	mcpSQLLint   *string
+
 	natsLogs     *bool
 	natsPort     *int
 	natsUser     *string
 	natsPass     *string
 	natsStoreDir *string
 	natsConfig   *string
-
-	asyncReplication          *bool
-	asyncReplicationOutboxDir *string
-	replicationStream         *string
-	replicationTimeout        *time.Duration
-	replicationMaxAge         *time.Duration
-	replicationURL            *string
-	replicationPolicy         *string
-	replicas                  *int
-	rowIdentify               *string
-
-	interceptorPath *string
+	natsJSDomain *string
+
+	natsClusterName *string
+	natsClusterPort *int
+	natsRoutes      *string
+
+	asyncReplication              *bool
+	asyncReplicationOutboxDir     *string
+	outboxSync                    *string
+	outboxRetryBackoff            *time.Duration
+	outboxMaxRetryBackoff         *time.Duration
+	outboxMaxAttempts             *int
+	replicationStream             *string
+	replicationStreamTemplate     *string
+	analyzeSyncInterval           *time.Duration
+	maintenanceSchedule           *string
+	maintenanceDir                *string
+	replicationTimeout            *time.Duration
+	changeSetNegotiation          *time.Duration
+	changeSetCompression          *string
+	heartbeatSubject              *string
+	configBucket                  *string
+	locksBucket                   *string
+	locksDefaultTTL               *time.Duration
+	locksMaxTTL                   *time.Duration
+	handoffBucket                 *string
+	handoffInterval               *time.Duration
+	replicationBatchSize          *int
+	replicationBatchInterval      *time.Duration
+	maxChangesetChanges           *int
+	maxChangesetBytes             *int
+	maxChangesetPolicy            *string
+	applyConcurrency              *int
+	applyRateLimit                *int
+	applyBatchSize                *int
+	applyWindows                  *string
+	applyJournalDir               *string
+	applyJournalCompression       *string
+	applyJournalRotate            *time.Duration
+	applyJournalRetention         *time.Duration
+	heartbeatInterval             *time.Duration
+	labels                        *string
+	advertiseURL                  *string
+	verifySnapshot                *string
+	verifyStreamExport            *string
+	verifyFromSequence            *uint64
+	verifyOutput                  *string
+	oneShotDB                     *string
+	oneShotOutput                 *string
+	bundleOutput                  *string
+	replicationMaxAge             *time.Duration
+	replicationStorageCompression *string
+	replicationURL                *string
+	replicationUser               *string
+	replicationPass               *string
+	replicationToken              *string
+	replicationCreds              *string
+	replicationNKey               *string
+	replicationTLSCert            *string
+	replicationTLSKey             *string
+	replicationTLSCA              *string
+	replicationPolicy             *string
+	replicas                      *int
+	rowIdentify                   *string
+	rowIdentifyTables             *string
+	replicationModeTables         *string
+	replicateTables               *string
+	skipTables                    *string
+
+	interceptorPath   *string
+	interceptorRoutes *string
+	applyTransforms   *string
+	projections       *string
+	sessionIdentity   *bool
+
+	probeInterval *time.Duration
+	probeMaxDelay *time.Duration
+
+	gapCheckInterval *time.Duration
+
+	consistencySubject  *string
+	consistencyInterval *time.Duration
+
+	healthMaxPending *int
+	healthMaxOutbox  *int
+
+	warmupQueries *string
+	warmupTimeout *time.Duration
+
+	shutdownDrain   *time.Duration
+	shutdownTimeout *time.Duration
+	drainOnShutdown *bool
+
+	invalidationDebounce *time.Duration
+	invalidationMaxWait  *time.Duration
+	invalidationWebhook  *string
+	invalidationSubject  *string
+
+	liveQueryDebounce *time.Duration
+	liveQueryTTL      *time.Duration
+	liveQueryMax      *int
+
+	txIdleTimeout *time.Duration
+	txMax         *int
 
 	remote *string
 )
@@ -117,21 +311,64 @@ var openAPI []byte
 //go:embed docs.html
 var docsHTML []byte
 
+//go:embed console.html
+var consoleHTML []byte
+
 func main() {
 	flagSet = ff.NewFlagSet("ha")
 	dbParams = flagSet.StringLong("db-params", defaultDBOptions, "SQLite DSN parameters appended to each database file DSN unless already present")
 	name = flagSet.String('n', "name", "", "Node name")
 	port = flagSet.Uint('p', "port", 8080, "Server port for HTTP and gRPC endpoints")
 	token = flagSet.StringLong("token", "", "API auth token for HTTP and gRPC requests")
+	maxConnections = flagSet.IntLong("max-connections", 0, "Maximum connections open at once per client IP on the HTTP and PostgreSQL servers; 0 is unlimited")
+	rateLimit = flagSet.IntLong("rate-limit", 0, "Maximum HTTP requests and PostgreSQL statements per second per client IP; 0 is unlimited")
+	adminToken = flagSet.StringLong("admin-token", "", "Authorization header required by admin endpoints; defaults to --token")
+	debugEndpoints = flagSet.BoolLong("debug", "Enable pprof, expvar and dump endpoints under /debug/ (requires admin auth)")
+	debugDumpDir = flagSet.StringLong("debug-dump-dir", "", "Directory for goroutine/heap dumps triggered by POST /debug/dump/{profile}; defaults to the temp dir")
+	otelEndpoint = flagSet.StringLong("otel-endpoint", "", "OTLP HTTP endpoint receiving the OpenTelemetry traces of the statements and their replication, like http://localhost:4318; empty disables")
+	otelService = flagSet.StringLong("otel-service-name", "ha", "Service name of the OpenTelemetry traces")
+	otelSampleRatio = flagSet.Float64Long("otel-sample-ratio", 1, "Fraction of the traces started by the node exported, from 0 to 1; the traces started by the clients keep their sampling decision")
 	interceptorPath = flagSet.String('i', "interceptor", "", "Path to a Go script that customizes replication behavior")
+	interceptorRoutes = flagSet.StringLong("interceptor-routes", "", "Semicolon separated table:glob,node:glob=script.go routes sending the matching replicated changes to their own interceptor script")
+	sessionIdentity = flagSet.BoolLong("session-identity", "Publish the user committing each transaction with its changeset, for the interceptor scripts of the other nodes")
+	applyTransforms = flagSet.StringLong("apply-transforms", "", "Path to a JSON file with per-column value transformations (trim, lower, upper, null_if_empty, integer, real, text, timestamp) applied to replicated changes")
+	projections = flagSet.StringLong("projections", "", "Path to a JSON file with the SQL executed on the local database after the replicated changes of the matching tables are applied")
 	logLevel = flagSet.StringLong("log-level", "info", "Log verbosity level: info, warn, error, or debug")
+	skipSelfTest = flagSet.BoolLong("skip-self-test", "Start without checking the NATS server and the S3 bucket are reachable first")
+	accessLog = flagSet.StringLong("access-log", "", "File for the structured (JSON) access log of HTTP, PostgreSQL and MySQL requests; - for stdout, empty disables")
+	accessLogSample = flagSet.IntLong("access-log-sample", 100, "Percentage of successful requests written to the access log (errors are always logged)")
+	queryLogSample = flagSet.IntLong("query-log-sample", 0, "Percentage of the statements executed by the clients written to the log, with their connection; the failed ones are always logged once enabled, 0 disables")
+	slowQueryThreshold = flagSet.DurationLong("slow-query-threshold", 0, "Log the statements taking longer, regardless of --query-log-sample; 0 disables")
+	queryLogValues = flagSet.BoolLong("query-log-values", "Log the literal values and parameters of the statements instead of redacting them")
+	auditLog = flagSet.StringLong("audit-log", "", "SQLite database file of the append-only audit log recording the write statements of the clients, searched by GET /audit; empty disables")
+	auditSubject = flagSet.StringLong("audit-subject", "", "NATS JetStream subject where the audit log entries are published; empty disables")
 
 	createDatabaseDir = flagSet.StringLong("create-db-dir", "", "Directory where new database files are created")
+	seedDir = flagSet.StringLong("seed-sql", "", "Directory with *.sql seed files applied once per cluster by the leader (dir/*.sql to the default database, dir/<id>/*.sql to database id)")
+	tenantTemplates = flagSet.StringLong("tenant-templates", "", "Directory with a sub directory of *.sql schema files per tenant template; enables the /tenants API")
+	tenantArchiveDir = flagSet.StringLong("tenant-archive-dir", "", "Directory where a copy of the database of the dropped tenants is kept")
 
 	memDB = flagSet.Bool('m', "memory", "Store the database in memory instead of on disk")
-	fromLatestSnapshot = flagSet.BoolLong("from-latest-snapshot", "Load the latest database snapshot from NATS JetStream Object Store at startup if available")
+	fromLatestSnapshot = flagSet.BoolLong("from-latest-snapshot", "Load the latest database snapshot at startup if available, from S3 when --snapshot-s3-bucket is set and otherwise from NATS JetStream Object Store")
 	snapshotInterval = flagSet.DurationLong("snapshot-interval", 0, "Interval for automatic snapshots to NATS JetStream Object Store (0 disables)")
 	disableDDLSync = flagSet.BoolLong("disable-ddl-sync", "Disable publishing DDL commands")
+	ddlConflict = flagSet.StringLong("ddl-conflict", "halt", "Replicated DDL statements failing on the local schema: halt pauses the replication of the database, skip applies the changeset without them, reconcile skips the ones the schema already has and halts on the others")
+
+	snapshotHistory = flagSet.IntLong("snapshot-history", 0, "Number of versioned snapshots kept per database in the NATS JetStream Object Store, taken on each --snapshot-interval; 0 disables the history")
+	snapshotHistoryMaxAge = flagSet.DurationLong("snapshot-history-max-age", 0, "Remove the versioned snapshots older than this, the most recent is always kept; 0 disables")
+	snapshotChunkSize = flagSet.IntLong("snapshot-chunk-size", 16<<20, "Size in bytes of the parts the snapshot history is uploaded in, each retried on failure and kept when the upload is resumed; 0 uploads each snapshot at once")
+	snapshotChunkRetries = flagSet.IntLong("snapshot-chunk-retries", 5, "Retries of a failed snapshot part upload, with exponential backoff")
+	snapshotS3Endpoint = flagSet.StringLong("snapshot-s3-endpoint", "", "S3-compatible endpoint (AWS, MinIO, R2) where snapshots are also stored; defaults to AWS when only the bucket is set")
+	snapshotS3Region = flagSet.StringLong("snapshot-s3-region", "us-east-1", "S3 region used to sign the snapshot requests")
+	snapshotS3Bucket = flagSet.StringLong("snapshot-s3-bucket", "", "S3 bucket for database snapshots; empty disables S3 snapshots")
+	snapshotS3Prefix = flagSet.StringLong("snapshot-s3-prefix", "", "Key prefix for the snapshots in the S3 bucket")
+	snapshotS3Credentials = flagSet.StringLong("snapshot-s3-credentials", "", "S3 credentials as ACCESS_KEY:SECRET_KEY; defaults to AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	snapshotS3Retention = flagSet.IntLong("snapshot-s3-retention", 0, "Number of S3 snapshots kept per database; 0 keeps all")
+	snapshotCompression = flagSet.StringLong("snapshot-compression", "none", "Compression of the versioned and S3 snapshots: none, gzip, zstd or snappy")
+	s3GatewayPort = flagSet.IntLong("s3-gateway-port", 0, "Port of the read-only S3-compatible endpoint serving the latest and retained snapshots (0 disables)")
+	s3GatewayBucket = flagSet.StringLong("s3-gateway-bucket", "ha", "Bucket name of the S3-compatible snapshot endpoint")
+	s3GatewayRegion = flagSet.StringLong("s3-gateway-region", "us-east-1", "Region reported by the S3-compatible snapshot endpoint")
+	s3GatewayCredentials = flagSet.StringLong("s3-gateway-credentials", "", "Credentials of the S3-compatible snapshot endpoint as ACCESS_KEY:SECRET_KEY, required with --s3-gateway-port")
 
 	natsLogs = flagSet.BoolLong("nats-logs", "Enable logging for the embedded NATS server")
 	natsPort = flagSet.IntLong("nats-port", 4222, "Embedded NATS server port (0 disables embedded NATS)")
@@ -139,6 +376,10 @@ func main() {
 	natsUser = flagSet.StringLong("nats-user", "", "Embedded NATS server username")
 	natsPass = flagSet.StringLong("nats-pass", "", "Embedded NATS server password")
 	natsConfig = flagSet.StringLong("nats-config", "", "Embedded NATS server configuration file")
+	natsClusterName = flagSet.StringLong("nats-cluster-name", "", "Name of the JetStream cluster formed by the embedded NATS servers of the nodes")
+	natsClusterPort = flagSet.IntLong("nats-cluster-port", 6222, "Port of the embedded NATS server for the routes of the other servers of --nats-cluster-name")
+	natsRoutes = flagSet.StringLong("nats-routes", "", "Comma separated route URLs of the other embedded NATS servers of --nats-cluster-name (e.g. nats://node2:6222)")
+	natsJSDomain = flagSet.StringLong("nats-js-domain", "", "JetStream domain of the embedded NATS server")
 
 	dynamicLocalLeaderAddr = flagSet.StringLong("leader-addr", "", "Address used when this node becomes leader; enables leader election")
 	staticRemoteLeaderAddr = flagSet.StringLong("leader-static", "", "Static leader address; disables leader election")
@@ -147,6 +388,8 @@ func main() {
 	mysqlPort = flagSet.IntLong("mysql-port", 0, "Port for MySQL wire protocol server")
 	mysqlUser = flagSet.StringLong("mysql-user", "ha", "MySQL authentication user")
 	mysqlPass = flagSet.StringLong("mysql-pass", "", "MySQL authentication password")
+	mysqlCert = flagSet.StringLong("mysql-cert", "", "TLS certificate file for MySQL server")
+	mysqlKey = flagSet.StringLong("mysql-key", "", "TLS key file for MySQL server")
 	mysqlProxied = flagSet.StringLong("mysql-proxied", "", "Source MySQL DSN to replicate into the local HA instance and redirect writes")
 	mysqlProxiedInclude = flagSet.StringLong("mysql-include", "^db.*", "Regexp matching tables to include from the proxied MySQL source; empty includes all")
 	mysqlProxiedExclude = flagSet.StringLong("mysql-exclude", "", "Regexp matching tables to exclude from the proxied MySQL source")
@@ -158,8 +401,12 @@ func main() {
 	pgPort = flagSet.IntLong("pg-port", 0, "Port for PostgreSQL wire protocol server")
 	pgUser = flagSet.StringLong("pg-user", "ha", "PostgreSQL authentication user")
 	pgPass = flagSet.StringLong("pg-pass", "ha", "PostgreSQL authentication password")
+	pgAuth = flagSet.StringLong("pg-auth", postgresql.AuthPassword, "PostgreSQL authentication method: password, md5 or scram-sha-256")
+	pgUsersFile = flagSet.StringLong("pg-users-file", "", "File with one PostgreSQL login per line (name password [db1,db2]), replaces --pg-user and --pg-pass")
+	pgUsersDB = flagSet.StringLong("pg-users-db", "", "Database id whose ha_pg_users table holds the PostgreSQL logins, replaces --pg-user and --pg-pass")
 	pgCert = flagSet.StringLong("pg-cert", "", "TLS certificate file for PostgreSQL server")
 	pgKey = flagSet.StringLong("pg-key", "", "TLS key file for PostgreSQL server")
+	pgFlushRows = flagSet.IntLong("pg-flush-rows", 100, "Flush query results to the PostgreSQL client every N rows")
 	pgProxied = flagSet.StringLong("pg-proxied", "", "Source PostgreSQL DSN to replicate from and proxy to")
 	pgPublicationName = flagSet.StringLong("pg-publication", "ha_publication", "Publication name in the source PostgreSQL database for logical replication")
 	pgSlotName = flagSet.StringLong("pg-slot", "ha_slot", "Replication slot name to create in the source PostgreSQL database")
@@ -175,16 +422,103 @@ func main() {
 	debeziumSourceDSN = flagSet.StringLong("debezium-source-dsn", "", "Source DSN for Debezium write redirection")
 
 	concurrentQueries = flagSet.IntLong("concurrent-queries", 50, "Maximum number of concurrent queries")
+	queryTimeout = flagSet.DurationLong("query-timeout", 0, "Default timeout for each statement; 0 disables")
+	maxRows = flagSet.IntLong("max-rows", 0, "Maximum rows returned by a query of the HTTP API, the next ones are read with the next_cursor of the response; 0 is unlimited")
+	progressChunkSize = flagSet.IntLong("progress-chunk-size", 10000, "Rows read by each rowid range of an UPDATE or DELETE executed with a request id")
+	minSeqTimeout = flagSet.DurationLong("min-seq-timeout", 5*time.Second, "Maximum wait of a read for its min_seq (read-your-writes) to be applied; 0 waits for the statement timeout")
+	txRetries = flagSet.IntLong("tx-retries", 0, "Times an HTTP transaction (array of queries) failing with SQLITE_BUSY or SQLITE_LOCKED runs again; 0 disables")
+	txRetryBackoff = flagSet.DurationLong("tx-retry-backoff", 20*time.Millisecond, "Wait before the first retry of a busy transaction, doubled after each attempt")
+	sqlLint = flagSet.StringLong("sql-lint", "off", "Lint the statements of the HTTP API for risky patterns: off, warn (the warnings are returned with the results) or reject")
+	sqlLintRules = flagSet.StringLong("sql-lint-rules", "", "Comma separated lint rules checked: no-where, select-star, cross-join, no-limit; empty checks all")
+	mcpSQLLint = flagSet.StringLong("mcp-sql-lint", "warn", "Lint policy of the statements of the MCP tools: off, warn or reject")
 
 	asyncReplication = flagSet.BoolLong("async-replication", "Enable asynchronous replication message publishing")
 	asyncReplicationOutboxDir = flagSet.StringLong("async-replication-store-dir", "", "Directory for asynchronous replication outbox storage")
+	outboxSync = flagSet.StringLong("async-replication-sync", "full", "Durability of the asynchronous replication outbox, the PRAGMA synchronous of its file: off, normal, full or extra. With full and extra a commit is acknowledged once its changeset is synced to disk")
+	outboxRetryBackoff = flagSet.DurationLong("async-replication-retry-backoff", 100*time.Millisecond, "Wait before publishing again an outbox changeset the stream refused, doubling after each failure")
+	outboxMaxRetryBackoff = flagSet.DurationLong("async-replication-max-retry-backoff", 30*time.Second, "Maximum wait between the publishes of an outbox changeset")
+	outboxMaxAttempts = flagSet.IntLong("async-replication-max-attempts", 0, "Publishes of an outbox changeset the stream refuses before it is quarantined; 0 retries forever")
 	replicas = flagSet.IntLong("replicas", 1, "Number of JetStream replicas for stream and object store, from 1 to 5")
 	replicationTimeout = flagSet.DurationLong("replication-timeout", 15*time.Second, "Timeout for replication publisher operations")
+	changeSetNegotiation = flagSet.DurationLong("changeset-negotiate-interval", 30*time.Second, "How often the leader checks the changeset formats advertised by the subscribers before publishing")
+	changeSetCompression = flagSet.StringLong("changeset-compression", "none", "Compression of the changes of the replication messages over 1 KiB: none, gzip, zstd or snappy. Published once every subscriber applies the changeset format 4")
+	replicationBatchSize = flagSet.IntLong("replication-batch-size", 0, "Coalesce the changesets of small transactions into one replication message of up to N changes, a commit waiting for the stream acknowledgement of its batch; 0 disables")
+	replicationBatchInterval = flagSet.DurationLong("replication-batch-interval", 10*time.Millisecond, "Maximum time a changeset waits in the replication batch for others to merge, added to the latency of its commit")
+	maxChangesetChanges = flagSet.IntLong("max-changeset-changes", 0, "Maximum number of row changes of a replicated transaction, checked at commit; 0 disables")
+	maxChangesetBytes = flagSet.IntLong("max-changeset-bytes", 0, "Maximum size in bytes of the replication message of a transaction, checked at commit; 0 disables")
+	maxChangesetPolicy = flagSet.StringLong("max-changeset-policy", "reject", "Transactions over --max-changeset-changes or --max-changeset-bytes are rejected, or published in several messages applied atomically with chunk")
+	applyConcurrency = flagSet.IntLong("apply-concurrency", 0, "Number of replicated changesets applied at once across the databases; 0 is unlimited")
+	applyRateLimit = flagSet.IntLong("apply-rate-limit", 0, "Replicated row changes applied per second; 0 is unlimited")
+	applyBatchSize = flagSet.IntLong("apply-batch-size", 0, "Replicated row changes applied at full speed before --apply-rate-limit throttles; defaults to the rate limit")
+	applyWindows = flagSet.StringLong("apply-windows", "", "Semicolon separated windows pausing or throttling the apply, \"pause duration=cron\" or \"throttle rate duration=cron\" (e.g. pause 2h=0 1 * * *;throttle 100 8h=0 9 * * 1-5)")
+	applyJournalDir = flagSet.StringLong("apply-journal-dir", "", "Directory of the journal recording every replicated changeset applied by the node and its outcome; empty disables")
+	applyJournalCompression = flagSet.StringLong("apply-journal-compression", "gzip", "Compression of the apply journal files: none, gzip, zstd or snappy")
+	applyJournalRotate = flagSet.DurationLong("apply-journal-rotate", time.Hour, "Interval to start a new apply journal file")
+	applyJournalRetention = flagSet.DurationLong("apply-journal-retention", 7*24*time.Hour, "Age of the apply journal files removed; 0 keeps them all")
+	heartbeatSubject = flagSet.StringLong("heartbeat-subject", "ha.heartbeat", "NATS subject where nodes advertise their release and replication capabilities, read by upgrade-check")
+	configBucket = flagSet.StringLong("config-bucket", "", "NATS JetStream KV bucket holding the cluster config changed through the /config API; empty disables")
+	locksBucket = flagSet.StringLong("locks-bucket", "", "NATS JetStream KV bucket holding the distributed locks of the /locks API and the ha_lock SQL function; empty disables")
+	locksDefaultTTL = flagSet.DurationLong("locks-default-ttl", 30*time.Second, "TTL of the distributed locks acquired without one")
+	locksMaxTTL = flagSet.DurationLong("locks-max-ttl", time.Hour, "Maximum TTL of the distributed locks")
+	handoffBucket = flagSet.StringLong("handoff-bucket", "", "NATS JetStream KV bucket recording the replication position of the node, resumed on restart when its durable consumers are gone; empty disables")
+	handoffInterval = flagSet.DurationLong("handoff-interval", 10*time.Second, "Interval between the records of the replication position of the running node")
+	heartbeatInterval = flagSet.DurationLong("heartbeat-interval", 10*time.Second, "Interval between heartbeats; 0 disables")
+	labels = flagSet.StringLong("labels", "", "Comma separated key=value labels of the node, like region=eu-west,zone=eu-west-1a,tier=hot, advertised on the heartbeats. In client mode, --remote connects to the nearest node to these labels")
+	advertiseURL = flagSet.StringLong("advertise-url", "", "URL of the HTTP API of this node advertised on the heartbeats, so clients are routed to the nearest node")
+	verifySnapshot = flagSet.StringLong("snapshot", "", "Snapshot file checked by verify")
+	verifyStreamExport = flagSet.StringLong("stream-export", "", "Directory of exported replication messages (.jsonl) replayed by verify onto the snapshot")
+	verifyFromSequence = flagSet.Uint64Long("verify-from-sequence", 0, "Skip the exported messages up to this stream sequence; defaults to the sequence recorded in the snapshot")
+	verifyOutput = flagSet.StringLong("verify-output", "", "Keep the database replayed by verify in this file")
+	oneShotDB = flagSet.StringLong("db", "", "Database of query and exec: a SQLite file opened directly, or with --remote the database id on the node")
+	oneShotOutput = flagSet.StringLong("output", "table", "Output format of query and exec: table, json or csv")
+	bundleOutput = flagSet.StringLong("bundle-output", "", "Tarball written by support-bundle; defaults to ha-support-TIMESTAMP.tar.gz")
 	replicationStream = flagSet.StringLong("replication-stream", "ha_replication", "Replication stream name")
+	replicationStreamTemplate = flagSet.StringLong("replication-stream-template", "", "Per-database replication stream name template, {db} is replaced by the database id (e.g. ha_{db}); overrides --replication-stream")
 	replicationMaxAge = flagSet.DurationLong("replication-max-age", 24*time.Hour, "Maximum age for messages in the replication stream")
+	replicationStorageCompression = flagSet.StringLong("replication-storage-compression", "none", "JetStream storage compression of the replication stream: none or s2. The messages are published and delivered uncompressed")
 	replicationURL = flagSet.StringLong("replication-url", "", "NATS URL for replication; defaults to embedded NATS when empty")
+	replicationUser = flagSet.StringLong("replication-user", "", "User to authenticate to the NATS server of --replication-url")
+	replicationPass = flagSet.StringLong("replication-pass", "", "Password of --replication-user")
+	replicationToken = flagSet.StringLong("replication-token", "", "Token to authenticate to the NATS server of --replication-url")
+	replicationCreds = flagSet.StringLong("replication-creds", "", "NATS credentials file with the user JWT and nkey seed to authenticate to --replication-url")
+	replicationNKey = flagSet.StringLong("replication-nkey", "", "NATS nkey seed file to authenticate to --replication-url")
+	replicationTLSCert = flagSet.StringLong("replication-tls-cert", "", "Client certificate file for TLS connections to --replication-url")
+	replicationTLSKey = flagSet.StringLong("replication-tls-key", "", "Client private key file of --replication-tls-cert")
+	replicationTLSCA = flagSet.StringLong("replication-tls-ca", "", "CA certificate file verifying the NATS server of --replication-url")
 	replicationPolicy = flagSet.StringLong("replication-policy", "", "Replication subscriber delivery policy: all, last, new, by_start_sequence=X, or by_start_time=x")
 	rowIdentify = flagSet.StringLong("row-identify", "pk", "Row identification strategy for replication: pk, rowid, or full")
+	rowIdentifyTables = flagSet.StringLong("row-identify-tables", "", "Comma separated table=pk|rowid overrides of the pk row identification; tables without a primary key use the rowid")
+	replicationModeTables = flagSet.StringLong("replication-mode-tables", "", "Comma separated table=statement|value glob patterns; the statements only changing tables in statement mode are replicated as SQL text instead of the row values")
+	replicateTables = flagSet.StringLong("replicate-tables", "", "Comma separated glob patterns of the tables to replicate; empty replicates all tables")
+	skipTables = flagSet.StringLong("skip-tables", "", "Comma separated glob patterns of the tables not to publish nor apply")
+	analyzeSyncInterval = flagSet.DurationLong("analyze-sync-interval", 0, "Interval to check sqlite_stat1 and sqlite_stat4 planner statistics on the leader and replicate them after ANALYZE; 0 disables")
+	maintenanceSchedule = flagSet.StringLong("maintenance-schedule", "", "Semicolon separated task=cron schedules of the maintenance of every database, tasks: integrity_check, incremental_vacuum, vacuum_into, analyze (e.g. integrity_check=0 3 * * *;analyze=@daily)")
+	maintenanceDir = flagSet.StringLong("maintenance-dir", "", "Directory of the compacted copies written by the vacuum_into maintenance task")
+
+	probeInterval = flagSet.DurationLong("probe-interval", 0, "Interval of the canary write probe to the ha_probe table of every database the node leads; 0 disables")
+	probeMaxDelay = flagSet.DurationLong("probe-max-delay", 5*time.Second, "Maximum canary probe propagation delay before /readyz fails")
+	gapCheckInterval = flagSet.DurationLong("gap-check-interval", time.Minute, "Interval checking that the replication stream still holds the messages each database needs, resyncing it from the latest snapshot when its consumer was deleted or the messages discarded; 0 disables")
+	consistencySubject = flagSet.StringLong("consistency-subject", "ha.consistency", "NATS subject where nodes publish the checksums of their tables, compared by /consistency")
+	consistencyInterval = flagSet.DurationLong("consistency-interval", 0, "Interval computing and publishing the checksums of the tables of each database to detect replicas diverging; 0 computes them only on demand")
+
+	healthMaxPending = flagSet.IntLong("health-max-lag", 0, "Maximum replicated changesets pending to be applied by this node before /readyz fails; 0 disables")
+	healthMaxOutbox = flagSet.IntLong("health-max-outbox", 0, "Maximum changesets waiting in the async replication outbox before /readyz fails; 0 disables")
+	warmupQueries = flagSet.StringLong("warmup-queries", "", "File of read-only queries, one per line, run on the pooled connections after the node caught up and before /readyz succeeds; empty disables")
+	shutdownDrain = flagSet.DurationLong("shutdown-drain", 0, "On SIGTERM, time /readyz fails while the node keeps serving so the load balancers stop routing to it before the listeners close; a second signal ends it; 0 closes them right away")
+	drainOnShutdown = flagSet.BoolLong("drain-on-shutdown", "Decommission the node on SIGTERM like POST /admin/decommission: stop its writes, publish the async outbox, take final snapshots and remove its replication consumers")
+	shutdownTimeout = flagSet.DurationLong("shutdown-timeout", 15*time.Second, "Maximum time waiting for the in-flight requests and transactions once the listeners are closed")
+	warmupTimeout = flagSet.DurationLong("warmup-timeout", time.Minute, "Maximum time spent catching up and running the warm-up queries before the node reports ready anyway")
+
+	invalidationDebounce = flagSet.DurationLong("invalidation-debounce", 200*time.Millisecond, "Debounce interval for table invalidation events emitted after replicated changes are applied")
+	invalidationMaxWait = flagSet.DurationLong("invalidation-max-wait", time.Second, "Maximum time the table invalidation events are delayed while new changes keep resetting the debounce interval")
+	invalidationWebhook = flagSet.StringLong("invalidation-webhook", "", "URL notified (HTTP POST) with the affected tables after replicated changes are applied")
+	invalidationSubject = flagSet.StringLong("invalidation-subject", "", "NATS subject to publish the affected tables after replicated changes are applied")
+
+	liveQueryDebounce = flagSet.DurationLong("live-query-debounce", 100*time.Millisecond, "Time the changes are coalesced before the live queries reading the modified tables are executed again")
+	liveQueryTTL = flagSet.DurationLong("live-query-ttl", 5*time.Minute, "Live queries without clients waiting for longer are removed; 0 keeps them until deleted")
+	liveQueryMax = flagSet.IntLong("live-query-max", 1000, "Maximum number of registered live queries; 0 is unlimited")
+	txIdleTimeout = flagSet.DurationLong("tx-idle-timeout", 30*time.Second, "HTTP transaction sessions without request for longer are rolled back")
+	txMax = flagSet.IntLong("tx-max", 100, "Maximum number of open HTTP transaction sessions; 0 is unlimited")
 
 	remote = flagSet.String('r', "remote", "", "Remote HA server address for client mode instead of starting a local server")
 	initDynamicFlags()
@@ -192,7 +526,14 @@ func main() {
 	printVersion := flagSet.BoolLong("version", "Print version information and exit")
 	_ = flagSet.String('c', "config", "", "config file (optional)")
 
-	if err := ff.Parse(flagSet, os.Args[1:],
+	args := os.Args[1:]
+	var command string
+	if len(args) > 0 && slices.Contains([]string{"upgrade-check", "verify", "query", "exec", "support-bundle"}, args[0]) {
+		command, args = args[0], args[1:]
+	}
+	commandLine = args
+
+	if err := ff.Parse(flagSet, args,
 		ff.WithEnvVarPrefix("HA"),
 		ff.WithConfigFileFlag("config"),
 		ff.WithConfigFileParser(ff.PlainParser),
@@ -210,6 +551,39 @@ func main() {
 		return
 	}
 
+	switch command {
+	case "upgrade-check":
+		if err := runUpgradeCheck(); err != nil {
+			slog.Error("upgrade check", "error", err)
+			os.Exit(1)
+		}
+		return
+	case "verify":
+		if err := runVerify(); err != nil {
+			slog.Error("verify", "error", err)
+			os.Exit(1)
+		}
+		return
+	case "support-bundle":
+		output, err := support.Bundle(context.Background(), support.Config{
+			Remote: *remote,
+			Token:  cmp.Or(*adminToken, *token),
+			Output: *bundleOutput,
+		})
+		if err != nil {
+			slog.Error("support bundle", "error", err)
+			os.Exit(1)
+		}
+		fmt.Println("Support bundle written to", output)
+		return
+	case "query", "exec":
+		if err := runOneShot(command == "exec"); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := run(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("server error", "error", err)
 		os.Exit(1)
@@ -217,27 +591,89 @@ func main() {
 }
 
 func run() error {
-	switch strings.ToUpper(*logLevel) {
-	case "INFO":
-		slog.SetLogLoggerLevel(slog.LevelInfo)
-	case "DEBUG":
-		slog.SetLogLoggerLevel(slog.LevelDebug)
-	case "ERROR":
-		slog.SetLogLoggerLevel(slog.LevelError)
-	case "WARN":
-		slog.SetLogLoggerLevel(slog.LevelWarn)
-	default:
-		return fmt.Errorf("invalid log-level! Valid values: info, debug, error, warm")
+	startedAt := time.Now().UTC()
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetLogLoggerLevel(level)
+	eventLog := support.InstallEventLog(500)
+
+	nodeLabels, err := upgrade.ParseLabels(*labels)
+	if err != nil {
+		return fmt.Errorf("invalid --labels: %w", err)
 	}
 
 	if *remote != "" {
-		cli.Start(*remote, *token)
+		cli.Start(nearestRemote(*remote, *token, nodeLabels), *token)
 		return nil
 	}
 
+	warnings, err := validateFlags()
+	for _, w := range warnings {
+		slog.Warn(w)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid flags:\n%w", err)
+	}
+
 	if *concurrentQueries < 1 {
 		return fmt.Errorf("--concurrent-queries must be at least 1")
 	}
+	sqlite.SetQueryTimeout(*queryTimeout)
+	hahttp.SetMaxRows(*maxRows)
+	sqlite.SetProgressChunkSize(*progressChunkSize)
+	sqlite.SetMinSeqTimeout(*minSeqTimeout)
+	if *txRetries < 0 {
+		return fmt.Errorf("--tx-retries must not be negative")
+	}
+	sqlite.SetTransactionRetries(*txRetries, *txRetryBackoff)
+	httpLint, err := sqlite.ParseLintPolicy(*sqlLint)
+	if err != nil {
+		return fmt.Errorf("invalid --sql-lint: %w", err)
+	}
+	var lintRules []string
+	if *sqlLintRules != "" {
+		for _, rule := range strings.Split(*sqlLintRules, ",") {
+			lintRules = append(lintRules, strings.TrimSpace(rule))
+		}
+	}
+	if err := sqlite.SetLint(httpLint, lintRules); err != nil {
+		return fmt.Errorf("invalid --sql-lint-rules: %w", err)
+	}
+	mcpLint, err := sqlite.ParseLintPolicy(*mcpSQLLint)
+	if err != nil {
+		return fmt.Errorf("invalid --mcp-sql-lint: %w", err)
+	}
+	mcp.SetLintPolicy(mcpLint)
+
+	if *accessLog != "" {
+		if *accessLogSample < 0 || *accessLogSample > 100 {
+			return fmt.Errorf("--access-log-sample must be between 0 and 100")
+		}
+		w := os.Stdout
+		if *accessLog != "-" {
+			f, err := os.OpenFile(*accessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return fmt.Errorf("failed to open access log: %w", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		accesslog.Configure(w, float64(*accessLogSample)/100)
+	}
+	if *queryLogSample < 0 || *queryLogSample > 100 {
+		return fmt.Errorf("--query-log-sample must be between 0 and 100")
+	}
+	querylog.Configure(querylog.Config{
+		Sample:        float64(*queryLogSample) / 100,
+		SlowThreshold: *slowQueryThreshold,
+		Values:        *queryLogValues,
+	})
+
+	if *replicationStreamTemplate != "" && !strings.Contains(*replicationStreamTemplate, "{db}") {
+		return fmt.Errorf("--replication-stream-template must contain the {db} placeholder")
+	}
 
 	nodeName := *name
 	if nodeName == "" {
@@ -247,6 +683,27 @@ func run() error {
 			return fmt.Errorf("failed to get hostname: %w", err)
 		}
 	}
+	sqlite.SetNodeInfo(nodeName, version)
+
+	if *otelEndpoint != "" {
+		shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+			Endpoint:    *otelEndpoint,
+			ServiceName: *otelService,
+			Node:        nodeName,
+			Version:     version,
+			SampleRatio: *otelSampleRatio,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to start the tracing: %w", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				slog.Warn("failed to export the last spans", "error", err)
+			}
+		}()
+	}
 
 	dsnList := make([]string, 0)
 	dsnParams := *dbParams
@@ -305,20 +762,36 @@ func run() error {
 		ha.WithSnapshotInterval(*snapshotInterval),
 		ha.WithGrpcInsecure(*grpcInsecure),
 	}
+	natsOpts, err := replicationNATSOptions()
+	if err != nil {
+		return err
+	}
+	if len(natsOpts) > 0 {
+		opts = append(opts, ha.WithNatsOptions(slices.Concat(replicationConnDefaults, natsOpts)...))
+	}
 	if *disableDDLSync {
 		opts = append(opts, ha.WithDisableDDLSync())
+		sqlite.SetDDLSyncDisabled(true)
 	}
 	if extensions != nil && *extensions != "" {
 		opts = append(opts, ha.WithExtensions(strings.Split(*extensions, ",")...))
 	}
 	if *natsPort > 0 || *natsConfig != "" {
+		natsFile := *natsConfig
+		if natsFile == "" && (*natsJSDomain != "" || *natsClusterName != "") {
+			natsFile, err = embeddedNATSConfigFile(nodeName)
+			if err != nil {
+				return fmt.Errorf("failed to configure the embedded NATS server: %w", err)
+			}
+			defer os.Remove(natsFile)
+		}
 		opts = append(opts, ha.WithEmbeddedNatsConfig(&ha.EmbeddedNatsConfig{
 			Name:       nodeName,
 			Port:       *natsPort,
 			StoreDir:   *natsStoreDir,
 			User:       *natsUser,
 			Pass:       *natsPass,
-			File:       *natsConfig,
+			File:       natsFile,
 			EnableLogs: *natsLogs,
 		}))
 	}
@@ -331,18 +804,263 @@ func run() error {
 		opts = append(opts, ha.WithLeaderElectionLocalTarget(*dynamicLocalLeaderAddr))
 	}
 
+	var interceptors []ha.ChangeSetInterceptor
+	if tracing.Enabled() {
+		// the apply span covers the other interceptors
+		interceptors = append(interceptors, new(tracing.ApplyInterceptor))
+	}
+	// first, so the other interceptors see the whole chunked transactions
+	// with their binary values decoded
+	interceptors = append(interceptors, txlimit.NewAssembler(), changeset.Decoder{})
+	windows, err := flowcontrol.ParseWindows(*applyWindows)
+	if err != nil {
+		return fmt.Errorf("invalid --apply-windows: %w", err)
+	}
+	applyFlow := flowcontrol.New(flowcontrol.Config{
+		Concurrency: *applyConcurrency,
+		RateLimit:   *applyRateLimit,
+		BatchSize:   *applyBatchSize,
+		Windows:     windows,
+	})
+	interceptors = append(interceptors, applyFlow)
+	ddlPolicy, err := ddlconflict.ParsePolicy(*ddlConflict)
+	if err != nil {
+		return fmt.Errorf("invalid --ddl-conflict: %w", err)
+	}
+	ddlGuard := ddlconflict.New(ddlPolicy, applyFlow.Pause)
+	interceptors = append(interceptors, ddlGuard)
+	tableFilter, err := tablefilter.New(*replicateTables, *skipTables)
+	if err != nil {
+		return err
+	}
+	reload := new(reloader)
+	switch *replicationStorageCompression {
+	case "none":
+	case "s2":
+	default:
+		return fmt.Errorf("invalid --replication-storage-compression %q, use none or s2", *replicationStorageCompression)
+	}
+	var publisherFactory sqlite.PublisherFactory
+	var publisherWrappers []func(ha.Publisher) ha.Publisher
+	if !tableFilter.Empty() && *asyncReplication {
+		return fmt.Errorf("--replicate-tables and --skip-tables are not supported with --async-replication")
+	}
+	if !*asyncReplication {
+		// installed without patterns too, a reload may set them
+		interceptors = append(interceptors, tableFilter)
+		publisherWrappers = append(publisherWrappers, func(pub ha.Publisher) ha.Publisher {
+			return tablefilter.Publisher(pub, tableFilter)
+		})
+		reload.tableFilter = tableFilter
+	}
+	rowIdentifyOverrides, err := rowidentify.Parse(*rowIdentifyTables)
+	if err != nil {
+		return fmt.Errorf("invalid --row-identify-tables: %w", err)
+	}
+	if len(rowIdentifyOverrides) > 0 && *rowIdentify != string(ha.PK) {
+		return fmt.Errorf("--row-identify-tables requires --row-identify=pk")
+	}
+	if err := sqlite.SetReplicationModes(*replicationModeTables); err != nil {
+		return fmt.Errorf("invalid --replication-mode-tables: %w", err)
+	}
+	if *rowIdentify == string(ha.PK) && !*asyncReplication {
+		publisherWrappers = append(publisherWrappers, func(pub ha.Publisher) ha.Publisher {
+			return rowidentify.Publisher(pub, rowIdentifyOverrides)
+		})
+	}
+	txLimits := txlimit.Limits{
+		MaxChanges: *maxChangesetChanges,
+		MaxBytes:   *maxChangesetBytes,
+	}
+	switch *maxChangesetPolicy {
+	case "reject":
+	case "chunk":
+		txLimits.Chunk = true
+	default:
+		return fmt.Errorf("invalid --max-changeset-policy %q, use reject or chunk", *maxChangesetPolicy)
+	}
+	if txLimits.Enabled() {
+		if *asyncReplication {
+			return fmt.Errorf("--max-changeset-changes and --max-changeset-bytes are not supported with --async-replication")
+		}
+		// before the batch, so the committing transaction gets the error
+		publisherWrappers = append(publisherWrappers, func(pub ha.Publisher) ha.Publisher {
+			return txlimit.Publisher(pub, txLimits)
+		})
+	}
+	publisherNATS := new(sharedNATS)
+	defer publisherNATS.Close()
+	if *replicationBatchSize > 0 {
+		if *asyncReplication {
+			return fmt.Errorf("--replication-batch-size is not supported with --async-replication")
+		}
+		// a batch could start in the middle of the chunks of a transaction
+		if txLimits.Enabled() && txLimits.Chunk {
+			return fmt.Errorf("--replication-batch-size is not supported with --max-changeset-policy=chunk")
+		}
+		// a batch carries the identity of its first transaction
+		if *sessionIdentity {
+			return fmt.Errorf("--replication-batch-size is not supported with --session-identity")
+		}
+		publisherWrappers = append(publisherWrappers, func(pub ha.Publisher) ha.Publisher {
+			cfg := batch.Config{
+				Size:     *replicationBatchSize,
+				Interval: *replicationBatchInterval,
+				Timeout:  *replicationTimeout,
+			}
+			// the publisher factory is connected
+			if nc, err := publisherNATS.conn(); err == nil {
+				cfg.MaxBytes = int(nc.MaxPayload())
+			}
+			return batch.New(pub, cfg)
+		})
+	}
+	changeSetCodec, err := compress.Parse(*changeSetCompression)
+	if err != nil {
+		return fmt.Errorf("invalid --changeset-compression: %w", err)
+	}
+	// the changesets of the async outbox are relayed as written, the
+	// changeset format is not negotiated
+	if *asyncReplication && changeSetCodec != compress.None {
+		return fmt.Errorf("--changeset-compression is not supported with --async-replication")
+	}
+	if *asyncReplication {
+		publisherFactory = newAsyncPublisherFactory(publisherNATS, sqlite.OutboxConfig{
+			Dir:             cmp.Or(*asyncReplicationOutboxDir, "."),
+			Sync:            *outboxSync,
+			RetryBackoff:    *outboxRetryBackoff,
+			MaxRetryBackoff: *outboxMaxRetryBackoff,
+			MaxAttempts:     *outboxMaxAttempts,
+		})
+	} else {
+		publisherFactory = newPublisherFactory(nodeName, publisherNATS, changeSetCodec, func(pub ha.Publisher) ha.Publisher {
+			for _, wrap := range slices.Backward(publisherWrappers) {
+				pub = wrap(pub)
+			}
+			return pub
+		})
+	}
+	if *applyTransforms != "" {
+		transformer, err := transform.Load(*applyTransforms)
+		if err != nil {
+			return fmt.Errorf("failed to load apply transforms: %w", err)
+		}
+		interceptors = append(interceptors, transformer)
+	}
 	if *interceptorPath != "" {
 		changeSetInterceptor, err := interceptor.Load(*interceptorPath)
 		if err != nil {
 			return fmt.Errorf("failed to load custom interceptor: %w", err)
 		}
-		opts = append(opts, ha.WithChangeSetInterceptor(changeSetInterceptor))
+		interceptors = append(interceptors, changeSetInterceptor)
+		queryInterceptor, queryObserver, err := interceptor.LoadQuery(*interceptorPath)
+		if err != nil {
+			return fmt.Errorf("failed to load custom interceptor: %w", err)
+		}
+		sqlite.SetQueryInterceptor(queryInterceptor)
+		sqlite.SetQueryObserver(queryObserver)
 	}
-
-	if *asyncReplication {
-		opts = append(opts, ha.WithAsyncPublisher())
-		opts = append(opts, ha.WithAsyncPublisherOutboxDir(*asyncReplicationOutboxDir))
+	if *interceptorRoutes != "" {
+		routes, err := interceptor.ParseRoutes(*interceptorRoutes)
+		if err != nil {
+			return fmt.Errorf("invalid --interceptor-routes: %w", err)
+		}
+		interceptors = append(interceptors, interceptor.Router(routes))
 	}
+	if *sessionIdentity && *asyncReplication {
+		return fmt.Errorf("--session-identity is not supported with --async-replication")
+	}
+	// the writes can't return the sequence of a changeset not published yet
+	if f, ok := flagSet.GetFlag("min-seq-timeout"); ok && f.IsSet() && *asyncReplication {
+		return fmt.Errorf("--min-seq-timeout is not supported with --async-replication")
+	}
+	sqlite.SetPublishIdentity(*sessionIdentity)
+
+	invalidator := invalidation.New(invalidation.Config{
+		Node:       nodeName,
+		Debounce:   *invalidationDebounce,
+		MaxWait:    *invalidationMaxWait,
+		WebhookURL: *invalidationWebhook,
+		Subject:    *invalidationSubject,
+	})
+	liveQueries := livequery.New(livequery.Config{
+		Debounce: *liveQueryDebounce,
+		TTL:      *liveQueryTTL,
+		Max:      *liveQueryMax,
+	})
+	sqlite.OnPublish(liveQueries.Notify)
+	materializedViews := matview.New()
+	sqlite.OnPublish(materializedViews.Notify)
+	interceptors = append(interceptors, invalidator, liveQueries, materializedViews, metrics.LatencyInterceptor{}, sqlite.ReadOnlyInterceptor{}, sqlite.FlagsInterceptor{})
+	var draining atomic.Bool
+	readyChecks := []func() error{func() error {
+		if draining.Load() {
+			return errors.New("shutting down")
+		}
+		return nil
+	}}
+	snapshotCodec, err := compress.Parse(*snapshotCompression)
+	if err != nil {
+		return fmt.Errorf("invalid --snapshot-compression: %w", err)
+	}
+	var s3Backup *s3backup.Backup
+	if *snapshotS3Bucket != "" {
+		accessKey, secretKey, ok := strings.Cut(*snapshotS3Credentials, ":")
+		if !ok {
+			accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		s3Backup, err = s3backup.New(s3backup.Config{
+			Endpoint:    *snapshotS3Endpoint,
+			Region:      *snapshotS3Region,
+			Bucket:      *snapshotS3Bucket,
+			Prefix:      *snapshotS3Prefix,
+			AccessKey:   accessKey,
+			SecretKey:   secretKey,
+			Compression: snapshotCodec,
+		}, *snapshotS3Retention)
+		if err != nil {
+			return fmt.Errorf("invalid S3 snapshot config: %w", err)
+		}
+	}
+	var canary *probe.Probe
+	if *probeInterval > 0 {
+		canary = probe.New(nodeName, *probeInterval, *probeMaxDelay)
+		interceptors = append(interceptors, canary)
+		readyChecks = append(readyChecks, canary.Ready)
+	}
+	if *analyzeSyncInterval > 0 {
+		interceptors = append(interceptors, sqlite.StatsInterceptor{})
+	}
+	// The projector and the journal go last to see only the changesets no
+	// interceptor skipped, as the other interceptors left them.
+	if *projections != "" {
+		projector, err := projection.Load(*projections)
+		if err != nil {
+			return fmt.Errorf("failed to load projections: %w", err)
+		}
+		interceptors = append(interceptors, projector)
+	}
+	if *applyJournalDir != "" {
+		codec, err := compress.Parse(*applyJournalCompression)
+		if err != nil {
+			return fmt.Errorf("invalid --apply-journal-compression: %w", err)
+		}
+		applyJournal, err := journal.Open(journal.Config{
+			Dir:         *applyJournalDir,
+			Compression: codec,
+			Rotate:      *applyJournalRotate,
+			Retention:   *applyJournalRetention,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to open the apply journal: %w", err)
+		}
+		defer applyJournal.Close()
+		interceptors = append(interceptors, applyJournal)
+	}
+
+	// the WITHOUT ROWID tables are applied by primary key whatever the row
+	// identification, the interceptors see their changes as replicated
+	opts = append(opts, ha.WithChangeSetInterceptor(rowidentify.WithoutRowid(interceptor.Chain(interceptors...))))
 
 	if *rowIdentify != "" {
 		switch *rowIdentify {
@@ -378,20 +1096,414 @@ func run() error {
 		DisableRedirect:   *proxyDisableRedirect,
 		ReadYourWrites:    *proxyReadYourWrites,
 	}
-	for _, dsn := range dsnList {
-		err := sqlite.Load(context.Background(), dsn, sqlite.LoadConfig{
-			MemDB:              *memDB,
-			FromLatestSnapshot: *fromLatestSnapshot,
-			DeliverPolicy:      *replicationPolicy,
-			MaxConns:           *concurrentQueries,
-			ProxiedDBConfig:    proxyCfg,
-			Options:            opts,
+	loadCfg := sqlite.LoadConfig{
+		MemDB:              *memDB,
+		FromLatestSnapshot: *fromLatestSnapshot,
+		DeliverPolicy:      *replicationPolicy,
+		MaxConns:           *concurrentQueries,
+		Stream:             *replicationStream,
+		StreamTemplate:     *replicationStreamTemplate,
+		Publisher:          publisherFactory,
+		ProxiedDBConfig:    proxyCfg,
+		Options:            opts,
+	}
+	if s3Backup != nil {
+		loadCfg.SnapshotSource = s3Backup.Latest
+	}
+	if *asyncReplication {
+		loadCfg.OutboxDir = cmp.Or(*asyncReplicationOutboxDir, ".")
+	}
+
+	maintenanceJobs, err := maintenance.ParseJobs(*maintenanceSchedule)
+	if err != nil {
+		return fmt.Errorf("invalid --maintenance-schedule: %w", err)
+	}
+	maintainer, err := maintenance.New(maintenanceJobs, *maintenanceDir)
+	if err != nil {
+		return fmt.Errorf("invalid --maintenance-schedule: %w", err)
+	}
+
+	if !*skipSelfTest {
+		if err := selfTest(context.Background(), s3Backup); err != nil {
+			return err
+		}
+	}
+	var restart *handoff.Handoff
+	if *handoffBucket != "" {
+		nc, err := connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for the restart handoff: %w", err)
+		}
+		defer nc.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), *replicationTimeout)
+		restart, err = handoff.New(ctx, nc, handoff.Config{
+			Bucket:   *handoffBucket,
+			Replicas: *replicas,
+			Node:     nodeName,
 		})
+		if err != nil {
+			cancel()
+			return fmt.Errorf("failed to create the restart handoff: %w", err)
+		}
+		previous, found, err := restart.Load(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to read the restart handoff: %w", err)
+		}
+		if found {
+			slog.Info("previous replication position", "state", previous.State, "updated", previous.Updated, "sequences", previous.Sequences)
+			loadCfg.ResumePosition = func(_ context.Context, id string) (sqlite.RecordedPosition, bool) {
+				seq, ok := previous.Sequences[id]
+				return sqlite.RecordedPosition{Sequence: seq, Stopped: previous.State == handoff.StateStopped}, ok
+			}
+		}
+	}
+	for _, dsn := range dsnList {
+		err := sqlite.Load(context.Background(), dsn, loadCfg)
 		if err != nil {
 			return fmt.Errorf("failed to load database %q: %w", dsn, err)
 		}
 	}
 
+	if restart != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), *replicationTimeout)
+		if err := restart.Save(ctx, handoff.StateRunning, appliedSequences()); err != nil {
+			slog.Error("failed to record the replication position", "error", err)
+		}
+		cancel()
+		if *handoffInterval > 0 {
+			go restart.Start(context.Background(), *handoffInterval, appliedSequences)
+		}
+	}
+
+	if *invalidationSubject != "" {
+		nc, err := connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for invalidation events: %w", err)
+		}
+		defer nc.Close()
+		invalidator.SetNatsConn(nc)
+	}
+
+	var registry *upgrade.Registry
+	if *heartbeatInterval > 0 && (*replicationURL != "" || *natsPort > 0) {
+		nc, err := connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for heartbeats: %w", err)
+		}
+		defer nc.Close()
+		local := upgrade.Local(nodeName, version, commit, replicationFlags())
+		local.Labels, local.URL = nodeLabels, *advertiseURL
+		registry, err = upgrade.Watch(context.Background(), nc, *heartbeatSubject, local, 3**heartbeatInterval)
+		if err != nil {
+			return fmt.Errorf("failed to watch the heartbeats: %w", err)
+		}
+		go upgrade.Heartbeat(context.Background(), nc, *heartbeatSubject, *heartbeatInterval, local, func() []string {
+			var leader []string
+			for _, id := range sqlite.Databases() {
+				if connector, err := sqlite.Connector(id); err == nil && connector.LeaderProvider().IsLeader() {
+					leader = append(leader, id)
+				}
+			}
+			slices.Sort(leader)
+			return leader
+		})
+	}
+
+	healthCfg := hahttp.HealthConfig{
+		MaxPending: uint64(max(*healthMaxPending, 0)),
+		MaxOutbox:  int64(*healthMaxOutbox),
+	}
+	var natsStatus func() hahttp.NATSStatus
+	if *replicationURL != "" || *natsPort > 0 {
+		nc, err := connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for health checks: %w", err)
+		}
+		defer nc.Close()
+		healthCfg.NATS = func() error {
+			if !nc.IsConnected() {
+				return fmt.Errorf("NATS %s", strings.ToLower(nc.Status().String()))
+			}
+			return nil
+		}
+		natsStatus = func() hahttp.NATSStatus {
+			return hahttp.NATSStatus{
+				Connected:  nc.IsConnected(),
+				Status:     strings.ToLower(nc.Status().String()),
+				URL:        nc.ConnectedUrlRedacted(),
+				Reconnects: nc.Stats().Reconnects,
+			}
+		}
+	}
+
+	if *analyzeSyncInterval > 0 {
+		go sqlite.SyncStats(context.Background(), *analyzeSyncInterval)
+	}
+	var consistencyNATS *nats.Conn
+	if *replicationURL != "" || *natsPort > 0 {
+		consistencyNATS, err = connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for the consistency checks: %w", err)
+		}
+		defer consistencyNATS.Close()
+	}
+	checker, err := consistency.New(context.Background(), consistencyNATS, consistency.Config{
+		Node:      nodeName,
+		Subject:   *consistencySubject,
+		Interval:  *consistencyInterval,
+		Databases: sqlite.Databases,
+		DB:        sqlite.DB,
+		Seq: func(id string) uint64 {
+			applied, _ := sqlite.AppliedSeq(id)
+			return max(applied, sqlite.PublishedSeq(id))
+		},
+		Match: tableFilter.Match,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start the consistency checks: %w", err)
+	}
+	go checker.Start(context.Background())
+	healthCfg.Warnings = func() []string {
+		return slices.Concat(maintainer.Warnings(), ddlGuard.Warnings(), checker.Warnings())
+	}
+	go maintainer.Start(context.Background())
+
+	if canary != nil {
+		go canary.Start(context.Background())
+	}
+	if *gapCheckInterval > 0 && (*replicationURL != "" || *natsPort > 0) {
+		nc, err := connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for the gap checks: %w", err)
+		}
+		defer nc.Close()
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return err
+		}
+		go resync.New(js, nodeName, *gapCheckInterval).Start(context.Background())
+	}
+	go liveQueries.Start(context.Background())
+	txSessions := txsession.New(txsession.Config{
+		IdleTimeout: *txIdleTimeout,
+		Max:         *txMax,
+		Connections: *concurrentQueries,
+	})
+	txCtx, stopTxSessions := context.WithCancel(context.Background())
+	defer stopTxSessions()
+	txSessionsStopped := make(chan struct{})
+	go func() {
+		defer close(txSessionsStopped)
+		txSessions.Start(txCtx)
+	}()
+
+	if *warmupQueries != "" {
+		queries, err := warmup.Load(*warmupQueries)
+		if err != nil {
+			return fmt.Errorf("invalid --warmup-queries: %w", err)
+		}
+		warmer := warmup.New(queries, *warmupTimeout)
+		readyChecks = append(readyChecks, warmer.Ready)
+		go warmer.Run(context.Background())
+	}
+
+	var snapshotUploads []func(context.Context, string) (uint64, error)
+	if s3Backup != nil {
+		snapshotUploads = append(snapshotUploads, s3Backup.Upload)
+		reload.snapshots = append(reload.snapshots, s3Backup.Start)
+	}
+
+	var configStore *clusterconfig.Store
+	if *configBucket != "" {
+		nc, err := connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for the cluster config: %w", err)
+		}
+		defer nc.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), *replicationTimeout)
+		configStore, err = clusterconfig.New(ctx, nc, clusterconfig.Config{
+			Bucket:   *configBucket,
+			Replicas: *replicas,
+			History:  10,
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to load the cluster config: %w", err)
+		}
+		defer configStore.Close()
+	}
+
+	var lockManager *locks.Manager
+	if *locksBucket != "" {
+		nc, err := connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for the distributed locks: %w", err)
+		}
+		defer nc.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), *replicationTimeout)
+		lockManager, err = locks.New(ctx, nc, locks.Config{
+			Bucket:     *locksBucket,
+			Replicas:   *replicas,
+			Node:       nodeName,
+			DefaultTTL: *locksDefaultTTL,
+			MaxTTL:     *locksMaxTTL,
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to create the distributed locks: %w", err)
+		}
+		sqlite.SetLocker(lockManager)
+	}
+
+	var auditor *audit.Log
+	if *auditLog != "" || *auditSubject != "" {
+		var nc *nats.Conn
+		if *auditSubject != "" {
+			var err error
+			if nc, err = connectNATS(); err != nil {
+				return fmt.Errorf("failed to connect to NATS for the audit log: %w", err)
+			}
+			defer nc.Close()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *replicationTimeout)
+		var err error
+		auditor, err = audit.Open(ctx, audit.Config{
+			File:     *auditLog,
+			Subject:  *auditSubject,
+			Replicas: *replicas,
+			Node:     nodeName,
+		}, nc)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to open the audit log: %w", err)
+		}
+		defer auditor.Close()
+		audit.SetLog(auditor)
+	}
+
+	var history *snapshots.History
+	if *snapshotHistory > 0 || *snapshotHistoryMaxAge > 0 {
+		nc, err := connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for the snapshot history: %w", err)
+		}
+		defer nc.Close()
+		history, err = snapshots.New(nc, snapshots.Config{
+			Replicas:     *replicas,
+			Retention:    *snapshotHistory,
+			MaxAge:       *snapshotHistoryMaxAge,
+			Compression:  snapshotCodec,
+			ChunkSize:    int64(max(*snapshotChunkSize, 0)),
+			ChunkRetries: *snapshotChunkRetries,
+			Stream: func(id string) string {
+				if *replicationStreamTemplate != "" {
+					return sqlite.StreamName(*replicationStreamTemplate, id)
+				}
+				return *replicationStream
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create the snapshot history: %w", err)
+		}
+		snapshotUploads = append(snapshotUploads, history.Keep)
+		if configStore != nil {
+			configStore.Watch(snapshotRetentionKey, func(key string, value json.RawMessage) {
+				if key != snapshotRetentionKey {
+					return
+				}
+				retention, maxAge, err := snapshotRetention(value)
+				if err != nil {
+					slog.Error("invalid snapshot retention in the cluster config", "key", key, "error", err)
+					return
+				}
+				history.SetRetention(retention, maxAge)
+				slog.Info("snapshot retention changed", "retention", retention, "max_age", maxAge)
+			})
+		}
+		reload.snapshots = append(reload.snapshots, history.Start)
+	}
+	reload.startSnapshots(*snapshotInterval)
+
+	var (
+		streamReader     *tail.Reader
+		replicationAdmin *streamadmin.Admin
+		rewind           func(ctx context.Context, id string, sequence uint64) (uint64, error)
+		reseed           func(ctx context.Context, id string) (uint64, error)
+		asOf             func(ctx context.Context, id string, req timetravel.Request) (*timetravel.Result, error)
+	)
+	if *replicationURL != "" || *natsPort > 0 {
+		nc, err := connectNATS()
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS for the stream endpoint: %w", err)
+		}
+		defer nc.Close()
+		streamReader, err = tail.New(nc)
+		if err != nil {
+			return fmt.Errorf("failed to create the replication stream reader: %w", err)
+		}
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return err
+		}
+		replicationAdmin = streamadmin.New(js)
+
+		var finders []resync.SnapshotFinder
+		if history != nil {
+			finders = append(finders, history.Before)
+		}
+		if s3Backup != nil {
+			finders = append(finders, s3Backup.Before)
+		}
+		if len(finders) > 0 {
+			rewind = func(ctx context.Context, id string, sequence uint64) (uint64, error) {
+				return resync.Rewind(ctx, js, id, sequence, finders...)
+			}
+		}
+		// the latest snapshot serves the recent timestamps without a history
+		asOfFinders := append(slices.Clone(finders), resync.LatestSnapshot)
+		asOf = func(ctx context.Context, id string, req timetravel.Request) (*timetravel.Result, error) {
+			return timetravel.Query(ctx, js, cmp.Or(id, sqlite.DefaultDatabase()), req, asOfFinders...)
+		}
+		reseed = func(ctx context.Context, id string) (uint64, error) {
+			// no changeset is applied while the snapshot is downloaded, the
+			// subscription restarts from its sequence
+			id = cmp.Or(id, sqlite.DefaultDatabase())
+			applyFlow.Pause(id)
+			defer applyFlow.Resume(id)
+			return sqlite.Reseed(ctx, id)
+		}
+	}
+
+	if *s3GatewayPort > 0 {
+		accessKey, secretKey, _ := strings.Cut(*s3GatewayCredentials, ":")
+		gateway, err := s3backup.NewServer(s3backup.ServerConfig{
+			Bucket:    *s3GatewayBucket,
+			Region:    *s3GatewayRegion,
+			AccessKey: accessKey,
+			SecretKey: secretKey,
+		}, history)
+		if err != nil {
+			return fmt.Errorf("invalid S3 gateway config: %w", err)
+		}
+		defer gateway.Close()
+		slog.Info("starting S3 snapshot gateway", "port", *s3GatewayPort, "bucket", *s3GatewayBucket)
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%d", *s3GatewayPort), accesslog.Middleware(gateway))
+			if err != nil {
+				log.Fatalf("S3 gateway error: %v", err)
+			}
+		}()
+	}
+
+	if *seedDir != "" {
+		for _, id := range sqlite.Databases() {
+			if err := sqlite.Seed(context.Background(), id, *seedDir); err != nil {
+				return fmt.Errorf("failed to seed database %q: %w", id, err)
+			}
+		}
+	}
+
 	mux := http.NewServeMux()
 	mux.Handle("GET /openapi.yaml", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/yaml")
@@ -401,14 +1513,69 @@ func run() error {
 		w.Header().Set("Content-Type", "text/html")
 		w.Write(docsHTML)
 	}))
+	mux.Handle("GET /console", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(consoleHTML)
+	}))
 
-	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
+	mux.HandleFunc("GET /healthz", hahttp.HealthHandler(healthCfg, readyChecks...))
+	if *debugEndpoints {
+		adminToken := *adminToken
+		if adminToken == "" {
+			adminToken = *token
+		}
+		if adminToken == "" {
+			return fmt.Errorf("--debug requires --admin-token or --token")
+		}
+		dumpDir := *debugDumpDir
+		if dumpDir == "" {
+			dumpDir = os.TempDir()
+		}
+		mux.Handle("/debug/", hahttp.DebugHandler(adminToken, dumpDir))
+	}
+	configHandler := hahttp.ConfigHandler(configStore, cmp.Or(*adminToken, *token))
+	mux.Handle("/config", configHandler)
+	mux.Handle("/config/", configHandler)
+	mux.Handle("/locks/", hahttp.LocksHandler(lockManager))
+	mux.HandleFunc("GET /audit", hahttp.AuditHandler(auditor, cmp.Or(*adminToken, *token)))
+	mux.HandleFunc("GET /metrics", metrics.Handler)
+	mux.HandleFunc("GET /readyz", hahttp.ReadyHandler(append(readyChecks, healthCfg.Ready)...))
+	mux.HandleFunc("GET /status", hahttp.StatusHandler(hahttp.StatusConfig{
+		Node:      nodeName,
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		StartedAt: startedAt,
+		ApplyFlow: applyFlow,
+		NATS:      natsStatus,
+		History:   history,
+	}))
+	mux.HandleFunc("GET /cluster", hahttp.ClusterHandler(nodeName, nodeLabels, registry))
 	mux.HandleFunc("GET /databases", hahttp.DatabasesHandler)
-	mux.HandleFunc("POST /databases", hahttp.CreateDatabaseHandler(*createDatabaseDir,
-		*memDB, dsnParams, *fromLatestSnapshot, *replicationPolicy, *concurrentQueries, proxyCfg, opts...))
+	createCfg := loadCfg
+	createCfg.Dir = *createDatabaseDir
+	mux.HandleFunc("POST /databases", hahttp.CreateDatabaseHandler(dsnParams, createCfg))
 	mux.HandleFunc("DELETE /databases/{id}", hahttp.DropDatabaseHandler())
+	mux.HandleFunc("POST /databases/{id}/default", hahttp.DefaultDatabaseHandler)
+	if *tenantTemplates != "" {
+		tenants := tenant.New(tenant.Config{
+			Templates: *tenantTemplates,
+			Create:    createCfg,
+			DSNParams: dsnParams,
+			UsersDB:   *pgUsersDB,
+			Secret: func(user, password string) string {
+				return postgresql.StoredPassword(*pgAuth, user, password)
+			},
+			ArchiveDir: *tenantArchiveDir,
+			Uploads:    snapshotUploads,
+		})
+		mux.HandleFunc("GET /tenants", hahttp.TenantsHandler(tenants))
+		mux.HandleFunc("POST /tenants", hahttp.CreateTenantHandler(tenants))
+		mux.HandleFunc("DELETE /tenants/{id}", hahttp.DropTenantHandler(tenants))
+	}
 
 	mux.HandleFunc("POST /databases/{id}", hahttp.QueryHandler)
 	mux.HandleFunc("POST /databases/{id}/undo/{param}", hahttp.UndoHandler(haconnect.UndoFilterNone))
@@ -421,15 +1588,160 @@ func run() error {
 	mux.HandleFunc("POST /undot/{param}", hahttp.UndoHandler(haconnect.UndoFilterTransaction))
 	mux.HandleFunc("GET /history/{param}", hahttp.HistoryHandler)
 
+	mux.HandleFunc("GET /queries", hahttp.StatementsHandler)
+	mux.HandleFunc("GET /queries/{request_id}", hahttp.StatementHandler)
+	mux.HandleFunc("DELETE /queries/{request_id}", hahttp.CancelStatementHandler)
+
 	mux.HandleFunc("GET /databases/{id}", hahttp.DownloadHandler)
 	mux.HandleFunc("GET /download", hahttp.DownloadHandler)
 
-	mux.HandleFunc("POST /databases/{id}/snapshot", hahttp.TakeSnapshotHandler)
-	mux.HandleFunc("POST /snapshot", hahttp.TakeSnapshotHandler)
+	mux.HandleFunc("POST /databases/{id}/migrate", hahttp.MigrateHandler)
+	mux.HandleFunc("POST /migrate", hahttp.MigrateHandler)
+	mux.HandleFunc("GET /databases/{id}/migrations", hahttp.MigrationsHandler)
+	mux.HandleFunc("GET /migrations", hahttp.MigrationsHandler)
+	mux.HandleFunc("GET /databases/{id}/schema", hahttp.SchemaHandler)
+	mux.HandleFunc("GET /schema", hahttp.SchemaHandler)
+	mux.HandleFunc("POST /databases/{id}/schema/diff", hahttp.SchemaDiffHandler(registry, *token))
+	mux.HandleFunc("POST /schema/diff", hahttp.SchemaDiffHandler(registry, *token))
+
+	mux.HandleFunc("GET /flags", hahttp.FlagsHandler)
+	mux.HandleFunc("GET /flags/watch", hahttp.WatchFlagsHandler)
+	mux.HandleFunc("GET /flags/{name}", hahttp.FlagHandler)
+	mux.HandleFunc("PUT /flags/{name}", hahttp.SetFlagHandler)
+	mux.HandleFunc("DELETE /flags/{name}", hahttp.DeleteFlagHandler)
+
+	mux.HandleFunc("POST /databases/{id}/readonly", hahttp.ReadOnlyHandler)
+	mux.HandleFunc("POST /readonly", hahttp.ReadOnlyHandler)
+
+	mux.HandleFunc("POST /databases/{id}/reset", hahttp.ResetHandler(*seedDir))
+	mux.HandleFunc("POST /reset", hahttp.ResetHandler(*seedDir))
+
+	mux.HandleFunc("POST /databases/{id}/ddl", hahttp.DDLHandler(*disableDDLSync))
+	mux.HandleFunc("POST /ddl", hahttp.DDLHandler(*disableDDLSync))
+
+	mux.HandleFunc("POST /databases/{id}/snapshot", hahttp.TakeSnapshotHandler(snapshotUploads...))
+	mux.HandleFunc("POST /snapshot", hahttp.TakeSnapshotHandler(snapshotUploads...))
+	done := make(chan os.Signal, 1)
+	var decommissioned atomic.Bool
+	decommissionNode := func(ctx context.Context) (map[string]uint64, error) {
+		sequences, err := decommission(ctx, snapshotUploads)
+		if err != nil {
+			return nil, err
+		}
+		decommissioned.Store(true)
+		if restart != nil {
+			if err := restart.Forget(ctx); err != nil {
+				slog.Error("failed to remove the restart handoff record", "error", err)
+			}
+		}
+		return sequences, nil
+	}
+	mux.HandleFunc("POST /admin/reload", hahttp.ReloadHandler(cmp.Or(*adminToken, *token), reload.Reload))
+	mux.HandleFunc("GET /admin/handoff", hahttp.HandoffHandler(cmp.Or(*adminToken, *token), restart))
+	mux.HandleFunc("POST /admin/decommission", hahttp.DecommissionHandler(cmp.Or(*adminToken, *token), func(ctx context.Context) (map[string]uint64, error) {
+		sequences, err := decommissionNode(ctx)
+		if err == nil {
+			select {
+			case done <- syscall.SIGTERM:
+			default:
+			}
+		}
+		return sequences, err
+	}))
+
+	adminAuth := cmp.Or(*adminToken, *token)
+	mux.HandleFunc("GET /admin/replication", hahttp.ReplicationStreamsHandler(adminAuth, replicationAdmin))
+	mux.HandleFunc("GET /admin/replication/{stream}", hahttp.ReplicationStreamHandler(adminAuth, replicationAdmin))
+	mux.HandleFunc("PATCH /admin/replication/{stream}", hahttp.UpdateReplicationStreamHandler(adminAuth, replicationAdmin))
+	mux.HandleFunc("POST /admin/replication/{stream}/purge", hahttp.PurgeReplicationStreamHandler(adminAuth, replicationAdmin))
+	mux.HandleFunc("GET /admin/replication/{stream}/consumers", hahttp.ReplicationConsumersHandler(adminAuth, replicationAdmin))
+	mux.HandleFunc("DELETE /admin/replication/{stream}/consumers/{name}", hahttp.DeleteReplicationConsumerHandler(adminAuth, replicationAdmin))
+	mux.HandleFunc("GET /admin/support", hahttp.SupportHandler(adminAuth, func() support.Report {
+		return support.Report{
+			Node:           nodeName,
+			Version:        version,
+			Commit:         commit,
+			GoVersion:      runtime.Version(),
+			StartedAt:      startedAt,
+			Flags:          redactedFlags(),
+			Events:         eventLog.Events(),
+			SlowStatements: querylog.SlowStatements(),
+		}
+	}))
 
 	mux.HandleFunc("GET /databases/{id}/snapshot", hahttp.DownloadSnapshotHandler)
 	mux.HandleFunc("GET /snapshot", hahttp.DownloadSnapshotHandler)
 
+	mux.HandleFunc("GET /databases/{id}/stream", hahttp.StreamHandler(streamReader))
+	mux.HandleFunc("GET /stream", hahttp.StreamHandler(streamReader))
+	mux.HandleFunc("POST /databases/{id}/live", hahttp.RegisterLiveQueryHandler(liveQueries))
+	mux.HandleFunc("POST /live", hahttp.RegisterLiveQueryHandler(liveQueries))
+	mux.HandleFunc("GET /live/{token}", hahttp.LiveQueryHandler(liveQueries))
+	mux.HandleFunc("DELETE /live/{token}", hahttp.DeleteLiveQueryHandler(liveQueries))
+	mux.HandleFunc("POST /databases/{id}/tx", hahttp.BeginHandler(txSessions))
+	mux.HandleFunc("POST /tx", hahttp.BeginHandler(txSessions))
+	mux.HandleFunc("POST /databases/{id}/tx/{token}", hahttp.TxQueryHandler(txSessions))
+	mux.HandleFunc("POST /tx/{token}", hahttp.TxQueryHandler(txSessions))
+	mux.HandleFunc("POST /databases/{id}/tx/{token}/commit", hahttp.CommitHandler(txSessions))
+	mux.HandleFunc("POST /tx/{token}/commit", hahttp.CommitHandler(txSessions))
+	mux.HandleFunc("POST /databases/{id}/tx/{token}/rollback", hahttp.RollbackHandler(txSessions))
+	mux.HandleFunc("POST /tx/{token}/rollback", hahttp.RollbackHandler(txSessions))
+	mux.HandleFunc("GET /databases/{id}/matviews", hahttp.MaterializedViewsHandler(materializedViews))
+	mux.HandleFunc("GET /matviews", hahttp.MaterializedViewsHandler(materializedViews))
+	mux.HandleFunc("POST /databases/{id}/matviews", hahttp.CreateMaterializedViewHandler(materializedViews))
+	mux.HandleFunc("POST /matviews", hahttp.CreateMaterializedViewHandler(materializedViews))
+	mux.HandleFunc("POST /databases/{id}/matviews/{name}/refresh", hahttp.RefreshMaterializedViewHandler(materializedViews))
+	mux.HandleFunc("POST /matviews/{name}/refresh", hahttp.RefreshMaterializedViewHandler(materializedViews))
+	mux.HandleFunc("DELETE /databases/{id}/matviews/{name}", hahttp.DropMaterializedViewHandler(materializedViews))
+	mux.HandleFunc("DELETE /matviews/{name}", hahttp.DropMaterializedViewHandler(materializedViews))
+	mux.HandleFunc("GET /databases/{id}/snapshots", hahttp.SnapshotsHandler(history))
+	mux.HandleFunc("GET /snapshots", hahttp.SnapshotsHandler(history))
+	mux.HandleFunc("GET /databases/{id}/snapshots/{seq}", hahttp.DownloadRetainedSnapshotHandler(history))
+	mux.HandleFunc("GET /snapshots/{seq}", hahttp.DownloadRetainedSnapshotHandler(history))
+	mux.HandleFunc("POST /databases/{id}/snapshots/{seq}/restore", hahttp.RestoreSnapshotHandler(history))
+	mux.HandleFunc("POST /snapshots/{seq}/restore", hahttp.RestoreSnapshotHandler(history))
+	if rewind != nil {
+		mux.HandleFunc("POST /databases/{id}/rewind", hahttp.RewindHandler(rewind))
+		mux.HandleFunc("POST /rewind", hahttp.RewindHandler(rewind))
+	}
+	if reseed != nil {
+		mux.HandleFunc("POST /databases/{id}/reseed", hahttp.ReseedHandler(reseed))
+		mux.HandleFunc("POST /reseed", hahttp.ReseedHandler(reseed))
+	}
+	if asOf != nil {
+		mux.HandleFunc("POST /databases/{id}/asof", hahttp.AsOfHandler(asOf))
+		mux.HandleFunc("POST /asof", hahttp.AsOfHandler(asOf))
+	}
+
+	mux.HandleFunc("GET /databases/{id}/outbox", hahttp.OutboxHandler)
+	mux.HandleFunc("GET /outbox", hahttp.OutboxHandler)
+	mux.HandleFunc("POST /databases/{id}/outbox/flush", hahttp.FlushOutboxHandler)
+	mux.HandleFunc("POST /outbox/flush", hahttp.FlushOutboxHandler)
+	mux.HandleFunc("DELETE /databases/{id}/outbox/{msg}", hahttp.DeleteOutboxMessageHandler)
+	mux.HandleFunc("DELETE /outbox/{msg}", hahttp.DeleteOutboxMessageHandler)
+	mux.HandleFunc("POST /databases/{id}/outbox/quarantine/{msg}/requeue", hahttp.RequeueOutboxMessageHandler)
+	mux.HandleFunc("POST /outbox/quarantine/{msg}/requeue", hahttp.RequeueOutboxMessageHandler)
+	mux.HandleFunc("DELETE /databases/{id}/outbox/quarantine/{msg}", hahttp.DeleteOutboxMessageHandler)
+	mux.HandleFunc("DELETE /outbox/quarantine/{msg}", hahttp.DeleteOutboxMessageHandler)
+
+	mux.HandleFunc("POST /databases/{id}/json/patch", hahttp.JSONPatchHandler)
+	mux.HandleFunc("POST /json/patch", hahttp.JSONPatchHandler)
+	mux.HandleFunc("POST /databases/{id}/tables/{table}/import", hahttp.ImportHandler)
+	mux.HandleFunc("POST /tables/{table}/import", hahttp.ImportHandler)
+
+	mux.HandleFunc("GET /maintenance", hahttp.MaintenanceHandler(maintainer))
+	mux.HandleFunc("POST /databases/{id}/maintenance/{task}", hahttp.RunMaintenanceHandler(maintainer))
+	mux.HandleFunc("GET /apply", hahttp.ApplyStatusHandler(applyFlow))
+	mux.HandleFunc("POST /apply/pause", hahttp.PauseApplyHandler(applyFlow))
+	mux.HandleFunc("POST /apply/resume", hahttp.ResumeApplyHandler(applyFlow))
+	mux.HandleFunc("POST /databases/{id}/apply/pause", hahttp.PauseApplyHandler(applyFlow))
+	mux.HandleFunc("POST /databases/{id}/apply/resume", hahttp.ResumeApplyHandler(applyFlow))
+	mux.HandleFunc("GET /ddl-conflicts", hahttp.DDLConflictsHandler(ddlGuard))
+	mux.HandleFunc("GET /databases/{id}/ddl-conflicts", hahttp.DDLConflictsHandler(ddlGuard))
+	mux.HandleFunc("GET /consistency", hahttp.ConsistencyHandler(checker))
+	mux.HandleFunc("GET /databases/{id}/consistency", hahttp.ConsistencyHandler(checker))
+	mux.HandleFunc("GET /admin/apply/windows", hahttp.ApplyWindowsHandler(adminAuth, applyFlow))
+	mux.HandleFunc("PUT /admin/apply/windows", hahttp.SetApplyWindowsHandler(adminAuth, applyFlow))
 	mux.HandleFunc("GET /databases/{id}/replications", hahttp.ReplicationsHandler)
 	mux.HandleFunc("GET /replications", hahttp.ReplicationsHandler)
 	mux.HandleFunc("GET /databases/{id}/replications/{name}", hahttp.ReplicationsHandler)
@@ -441,9 +1753,11 @@ func run() error {
 	mux.Handle("/mcp", mcp.NewHTTPHandler())
 
 	mysqlServer, err := mysql.NewServer(mysql.Config{
-		Port: *mysqlPort,
-		User: *mysqlUser,
-		Pass: *mysqlPass,
+		Port:    *mysqlPort,
+		User:    *mysqlUser,
+		Pass:    *mysqlPass,
+		TLSCert: *mysqlCert,
+		TLSKey:  *mysqlKey,
 		ConnectorProvider: func(dbName string) (*ha.Connector, bool) {
 			connector, err := sqlite.Connector(dbName)
 			if err != nil {
@@ -458,15 +1772,7 @@ func run() error {
 			}
 			return db, true
 		},
-		CreateDatabaseOptions: sqlite.LoadConfig{
-			Dir:                *createDatabaseDir,
-			MemDB:              *memDB,
-			FromLatestSnapshot: *fromLatestSnapshot,
-			DeliverPolicy:      *replicationPolicy,
-			MaxConns:           *concurrentQueries,
-			ProxiedDBConfig:    proxyCfg,
-			Options:            opts,
-		},
+		CreateDatabaseOptions: createCfg,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create MySQL server: %w", err)
@@ -478,20 +1784,42 @@ func run() error {
 		}
 	}
 
+	reload.mysqlServer = mysqlServer
+	reload.loadPGUsers = func() (postgresql.Users, error) {
+		users := postgresql.StaticUser(*pgUser, *pgPass)
+		switch {
+		case *pgUsersFile != "":
+			var err error
+			if users, err = postgresql.UsersFromFile(*pgUsersFile); err != nil {
+				return nil, err
+			}
+		case *pgUsersDB != "":
+			users = postgresql.UsersFromTable(*pgUsersDB)
+		}
+		if configStore != nil {
+			users = postgresql.UsersFromConfig(configStore, users)
+		}
+		return users, nil
+	}
+	pgUsers, err := reload.loadPGUsers()
+	if err != nil {
+		return fmt.Errorf("failed to load PostgreSQL users: %w", err)
+	}
+	reload.pgUsers = postgresql.NewReloadableUsers(pgUsers)
+	limiter := ratelimit.New(ratelimit.Config{
+		MaxConnections: *maxConnections,
+		Rate:           *rateLimit,
+	})
 	pgServer, err := postgresql.NewServer(postgresql.Config{
-		User:    *pgUser,
-		Pass:    *pgPass,
-		TLSCert: *pgCert,
-		TLSKey:  *pgKey,
-		CreateOpts: sqlite.LoadConfig{
-			Dir:                *createDatabaseDir,
-			MemDB:              *memDB,
-			FromLatestSnapshot: *fromLatestSnapshot,
-			DeliverPolicy:      *replicationPolicy,
-			MaxConns:           *concurrentQueries,
-			ProxiedDBConfig:    proxyCfg,
-			Options:            opts,
-		},
+		User:       *pgUser,
+		Pass:       *pgPass,
+		Auth:       *pgAuth,
+		Users:      reload.pgUsers.Lookup,
+		TLSCert:    *pgCert,
+		TLSKey:     *pgKey,
+		CreateOpts: createCfg,
+		FlushRows:  *pgFlushRows,
+		Limiter:    limiter,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create PostgreSQL server: %w", err)
@@ -525,35 +1853,410 @@ func run() error {
 	if *token != "" {
 		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
-			if authHeader != *token && r.URL.Path != "/healthz" && r.URL.Path != "/openapi.yaml" && r.URL.Path != "/docs" {
+			if authHeader != *token && r.URL.Path != "/healthz" && r.URL.Path != "/livez" && r.URL.Path != "/readyz" && r.URL.Path != "/openapi.yaml" && r.URL.Path != "/docs" && r.URL.Path != "/console" && !strings.HasPrefix(r.URL.Path, "/debug/") && !strings.HasPrefix(r.URL.Path, "/admin/") && r.URL.Path != "/config" && !strings.HasPrefix(r.URL.Path, "/config/") {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 			mux.ServeHTTP(w, r)
 		})
 	}
+	server.Handler = accesslog.Middleware(hahttp.Identified(reload.pgUsers.Verify, ratelimit.Middleware(limiter, tracing.Middleware(mux, server.Handler))))
 
-	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if _, err := reload.Reload(); err != nil {
+				slog.Error("failed to reload the configuration", "error", err)
+			}
+		}
+	}()
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		sig := <-done
 		slog.Warn("signal detected...", "signal", sig)
-		if err := mysqlServer.Close(); err != nil {
-			slog.Error("MySQL server shutdown failed", "error", err)
+		draining.Store(true)
+		if restart != nil && !decommissioned.Load() {
+			ctx, cancel := context.WithTimeout(context.Background(), *replicationTimeout)
+			if err := restart.Save(ctx, handoff.StateRestarting, appliedSequences()); err != nil {
+				slog.Error("failed to announce the restart", "error", err)
+			}
+			cancel()
 		}
-		if err := pgServer.Close(); err != nil {
-			slog.Error("PostgreSQL server shutdown failed", "error", err)
+		if *shutdownDrain > 0 {
+			slog.Info("draining before closing the listeners", "period", *shutdownDrain)
+			select {
+			case <-time.After(*shutdownDrain):
+			case sig = <-done:
+				slog.Warn("drain interrupted", "signal", sig)
+			}
 		}
-		ha.Shutdown()
-		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		if *drainOnShutdown && !decommissioned.Load() {
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			if _, err := decommissionNode(ctx); err != nil {
+				slog.Error("decommission failed, the replication consumers are kept", "error", err)
+			}
+			cancel()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			slog.Error("HTTP server shutdown failed", "error", err)
+		var wg sync.WaitGroup
+		wg.Go(func() {
+			if err := mysqlServer.Shutdown(ctx); err != nil {
+				slog.Error("MySQL server shutdown failed", "error", err)
+			}
+		})
+		if *pgPort > 0 {
+			wg.Go(func() {
+				if err := pgServer.Shutdown(ctx); err != nil {
+					slog.Error("PostgreSQL server shutdown failed", "error", err)
+				}
+			})
 		}
+		wg.Go(func() {
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("HTTP server shutdown failed", "error", err)
+			}
+		})
+		wg.Wait()
+		// the transaction sessions left open are rolled back
+		stopTxSessions()
+		<-txSessionsStopped
+		if decommissioned.Load() {
+			if err := sqlite.RemoveConsumers(ctx); err != nil {
+				slog.Error("failed to remove the replication consumers", "error", err)
+			}
+		} else if restart != nil {
+			// the clients are gone, the final position of the databases
+			if err := restart.Save(ctx, handoff.StateStopped, appliedSequences()); err != nil {
+				slog.Error("failed to record the replication position", "error", err)
+			}
+		}
+		ha.Shutdown()
 	}()
 
 	slog.Info("starting HA HTTP server", "port", *port, "version", version, "commit", commit, "date", date)
-	return server.ListenAndServe()
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	err = server.Serve(limiter.Listener(listener, "http", ratelimit.RejectHTTP))
+	if errors.Is(err, http.ErrServerClosed) {
+		// the shutdown goroutine closes the databases
+		<-stopped
+	}
+	return err
+}
+
+// nearestRemote returns the node nearest to the labels among the comma
+// separated remotes and the cluster they belong to, or the first remote.
+func nearestRemote(remotes, token string, labels map[string]string) string {
+	list := strings.Split(remotes, ",")
+	if len(labels) == 0 {
+		return strings.TrimSpace(list[0])
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	for _, remote := range list {
+		remote = strings.TrimSpace(remote)
+		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(remote, "/")+"/cluster", nil)
+		if err != nil {
+			continue
+		}
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			slog.Warn("failed to list the cluster nodes", "remote", remote, "error", err)
+			continue
+		}
+		var cluster struct {
+			Nodes []upgrade.Node `json:"nodes"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&cluster)
+		resp.Body.Close()
+		if err != nil {
+			slog.Warn("failed to list the cluster nodes", "remote", remote, "error", err)
+			continue
+		}
+		if url, ok := upgrade.Nearest(labels, cluster.Nodes); ok {
+			return url
+		}
+		return remote
+	}
+	return strings.TrimSpace(list[0])
+}
+
+func connectNATS() (*nats.Conn, error) {
+	url := *replicationURL
+	opts, err := replicationNATSOptions()
+	if err != nil {
+		return nil, err
+	}
+	if url == "" {
+		if *natsPort <= 0 {
+			return nil, fmt.Errorf("inform --replication-url or --nats-port")
+		}
+		url = fmt.Sprintf("nats://localhost:%d", *natsPort)
+		if *natsUser != "" {
+			opts = append(opts, nats.UserInfo(*natsUser, *natsPass))
+		}
+	}
+	return nats.Connect(url, opts...)
+}
+
+// snapshotRetentionKey overrides --snapshot-history and
+// --snapshot-history-max-age through the cluster config.
+const snapshotRetentionKey = "snapshots.retention"
+
+// snapshotRetention parses {"retention": 10, "max_age": "72h"}, a deleted
+// key restores the flags.
+func snapshotRetention(value json.RawMessage) (int, time.Duration, error) {
+	if value == nil {
+		return *snapshotHistory, *snapshotHistoryMaxAge, nil
+	}
+	var cfg struct {
+		Retention int    `json:"retention"`
+		MaxAge    string `json:"max_age"`
+	}
+	if err := json.Unmarshal(value, &cfg); err != nil {
+		return 0, 0, err
+	}
+	var maxAge time.Duration
+	if cfg.MaxAge != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(cfg.MaxAge); err != nil {
+			return 0, 0, err
+		}
+	}
+	if cfg.Retention < 0 || maxAge < 0 {
+		return 0, 0, errors.New("retention and max_age must not be negative")
+	}
+	return cfg.Retention, maxAge, nil
+}
+
+// decommission stops the writes of the node, waits for the async outbox to be
+// published and takes a final snapshot of each database, so the consumers of
+// the node can be removed once it shuts down.
+func decommission(ctx context.Context, uploads []func(context.Context, string) (uint64, error)) (map[string]uint64, error) {
+	if err := sqlite.StopWrites(); err != nil {
+		return nil, err
+	}
+	slog.Warn("decommissioning the node, writes stopped")
+	sequences, err := finalSnapshots(ctx, uploads)
+	if err != nil {
+		sqlite.ResumeWrites()
+		return nil, err
+	}
+	return sequences, nil
+}
+
+// appliedSequences returns the last stream sequence applied to each database.
+func appliedSequences() map[string]uint64 {
+	sequences := make(map[string]uint64)
+	for _, id := range sqlite.Databases() {
+		if seq, err := sqlite.AppliedSeq(id); err == nil {
+			sequences[id] = seq
+		}
+	}
+	return sequences
+}
+
+func finalSnapshots(ctx context.Context, uploads []func(context.Context, string) (uint64, error)) (map[string]uint64, error) {
+	if err := sqlite.WaitOutboxes(ctx); err != nil {
+		return nil, fmt.Errorf("failed to publish the outbox: %w", err)
+	}
+	sequences := make(map[string]uint64)
+	for _, id := range sqlite.Databases() {
+		sequence, err := sqlite.TakeSnapshot(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to take the snapshot of %q: %w", id, err)
+		}
+		for _, upload := range uploads {
+			uploaded, err := upload(ctx, id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to upload the snapshot of %q: %w", id, err)
+			}
+			sequence = max(sequence, uploaded)
+		}
+		sequences[id] = sequence
+		slog.Info("final snapshot taken", "id", id, "sequence", sequence)
+	}
+	return sequences, nil
+}
+
+// replicationFlags are the flags changing the replicated data, they must be
+// the same on every node.
+func replicationFlags() map[string]string {
+	return map[string]string{
+		"row-identify":                *rowIdentify,
+		"row-identify-tables":         *rowIdentifyTables,
+		"async-replication":           strconv.FormatBool(*asyncReplication),
+		"disable-ddl-sync":            strconv.FormatBool(*disableDDLSync),
+		"replication-stream":          *replicationStream,
+		"replication-stream-template": *replicationStreamTemplate,
+	}
+}
+
+// runUpgradeCheck listens to the peers heartbeats and prints the rolling
+// upgrade plan of the cluster to this binary.
+func runUpgradeCheck() error {
+	nc, err := connectNATS()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	wait := 2**heartbeatInterval + time.Second
+	fmt.Printf("Waiting %s for heartbeats on %q...\n", wait, *heartbeatSubject)
+	peers, err := upgrade.Peers(context.Background(), nc, *heartbeatSubject, wait)
+	if err != nil {
+		return err
+	}
+	plan := upgrade.NewPlan(upgrade.Local(*name, version, commit, replicationFlags()), peers)
+	plan.Print(os.Stdout)
+	if !plan.Safe() {
+		return errors.New("upgrade is not safe")
+	}
+	return nil
+}
+
+// sharedNATS is the NATS connection of the replication publishers, shared
+// by the databases of the node: it is connected by the first publisher, once
+// the embedded NATS server is running, and outlives the databases dropped or
+// resynced.
+type sharedNATS struct {
+	mu sync.Mutex
+	nc *nats.Conn
+}
+
+func (s *sharedNATS) conn() (*nats.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nc != nil && !s.nc.IsClosed() {
+		return s.nc, nil
+	}
+	nc, err := connectNATS()
+	if err != nil {
+		return nil, err
+	}
+	s.nc = nc
+	return nc, nil
+}
+
+func (s *sharedNATS) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nc != nil {
+		s.nc.Close()
+	}
+}
+
+// newPublisherFactory creates NATS replication publishers like go-ha does,
+// decorated by wrap. The node subscriber advertises the changeset formats it
+// applies and the publisher only publishes a format every subscriber applies,
+// compressing the changes with codec in format 4.
+func newPublisherFactory(node string, shared *sharedNATS, codec compress.Codec, wrap func(ha.Publisher) ha.Publisher) sqlite.PublisherFactory {
+	return func(replicationID, stream string) (ha.Publisher, error) {
+		nc, err := shared.conn()
+		if err != nil {
+			return nil, err
+		}
+		subject := sqlite.NatsSubject(stream, replicationID)
+		pub, err := ha.NewNATSPublisher(nc, subject, *replicationTimeout, replicationStreamConfig(stream))
+		if err != nil {
+			return nil, err
+		}
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *replicationTimeout)
+		defer cancel()
+		if err := changeset.Advertise(ctx, js, stream, sqlite.ConsumerName(replicationID, node)); err != nil {
+			slog.Warn("failed to advertise changeset formats", "error", err, "id", replicationID)
+		}
+		negotiator := changeset.NewNegotiator(js, stream, subject, *changeSetNegotiation)
+		return wrap(changeset.Publisher(pub, negotiator, *replicationTimeout, codec)), nil
+	}
+}
+
+// newAsyncPublisherFactory creates the publishers writing the changesets to
+// the outbox of the database, relayed to the stream by a NATS publisher.
+func newAsyncPublisherFactory(shared *sharedNATS, cfg sqlite.OutboxConfig) sqlite.PublisherFactory {
+	return func(replicationID, stream string) (ha.Publisher, error) {
+		nc, err := shared.conn()
+		if err != nil {
+			return nil, err
+		}
+		subject := sqlite.NatsSubject(stream, replicationID)
+		pub, err := ha.NewNATSPublisher(nc, subject, *replicationTimeout, replicationStreamConfig(stream))
+		if err != nil {
+			return nil, err
+		}
+		asyncPub, err := sqlite.NewAsyncPublisher(cfg, replicationID, subject, pub, nc.IsConnected)
+		if err != nil {
+			return nil, err
+		}
+		return asyncPub, nil
+	}
+}
+
+func replicationStreamConfig(stream string) *jetstream.StreamConfig {
+	// compressed at rest by the server, the go-ha subscribers decode the
+	// JSON payload themselves so the messages can't carry their own codec
+	compression := jetstream.NoCompression
+	if *replicationStorageCompression == "s2" {
+		compression = jetstream.S2Compression
+	}
+	return &jetstream.StreamConfig{
+		Name:        stream,
+		Replicas:    *replicas,
+		Subjects:    []string{stream, fmt.Sprintf("%s.>", stream)},
+		Storage:     jetstream.FileStorage,
+		MaxAge:      *replicationMaxAge,
+		Discard:     jetstream.DiscardOld,
+		Retention:   jetstream.LimitsPolicy,
+		Compression: compression,
+	}
+}
+
+// runOneShot runs the statements of the arguments on a SQLite file or a
+// remote node and prints the results, without starting the servers.
+func runOneShot(write bool) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	remoteURL := *remote
+	if remoteURL != "" {
+		nodeLabels, err := upgrade.ParseLabels(*labels)
+		if err != nil {
+			return fmt.Errorf("invalid --labels: %w", err)
+		}
+		remoteURL = nearestRemote(remoteURL, *token, nodeLabels)
+	}
+	return cli.RunOnce(ctx, cli.OneShotConfig{
+		DB:     *oneShotDB,
+		Remote: remoteURL,
+		Token:  *token,
+		Output: *oneShotOutput,
+		Write:  write,
+	}, flagSet.GetArgs(), os.Stdout)
+}
+
+// redactedFlags returns the values of the flags without their secrets.
+func redactedFlags() map[string]string {
+	flags := make(map[string]string)
+	flagSet.WalkFlags(func(f ff.Flag) error {
+		name, ok := f.GetLongName()
+		if !ok {
+			short, _ := f.GetShortName()
+			name = string(short)
+		}
+		flags[name] = support.RedactFlag(name, f.GetValue())
+		return nil
+	})
+	return flags
 }
 
 func isSQLiteFile(path string) bool {
@@ -571,3 +2274,25 @@ func isSQLiteFile(path string) bool {
 
 	return string(header) == "SQLite format 3\x00"
 }
+
+// runVerify replays the stream export onto a copy of the snapshot, offline,
+// and prints the integrity report.
+func runVerify() error {
+	if *verifySnapshot == "" {
+		return errors.New("--snapshot is required")
+	}
+	report, err := verify.Run(context.Background(), verify.Config{
+		Snapshot:     *verifySnapshot,
+		StreamExport: *verifyStreamExport,
+		FromSequence: *verifyFromSequence,
+		Output:       *verifyOutput,
+	})
+	if err != nil {
+		return err
+	}
+	report.Print(os.Stdout)
+	if !report.OK() {
+		return errors.New("verification failed")
+	}
+	return nil
+}
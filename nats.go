@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// replicationNATSOptions returns the credentials and TLS settings used to
+// connect to --replication-url.
+func replicationNATSOptions() ([]nats.Option, error) {
+	var opts []nats.Option
+	switch {
+	case *replicationUser != "":
+		opts = append(opts, nats.UserInfo(*replicationUser, *replicationPass))
+	case *replicationToken != "":
+		opts = append(opts, nats.Token(*replicationToken))
+	case *replicationCreds != "":
+		opts = append(opts, nats.UserCredentials(*replicationCreds))
+	case *replicationNKey != "":
+		opt, err := nats.NkeyOptionFromSeed(*replicationNKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --replication-nkey: %w", err)
+		}
+		opts = append(opts, opt)
+	}
+	if *replicationTLSCert != "" {
+		opts = append(opts, nats.ClientCert(*replicationTLSCert, *replicationTLSKey))
+	}
+	if *replicationTLSCA != "" {
+		opts = append(opts, nats.RootCAs(*replicationTLSCA))
+	}
+	return opts, nil
+}
+
+// validateReplicationAuth reports the conflicting credentials flags.
+func validateReplicationAuth() error {
+	var errs []error
+	methods := 0
+	for _, set := range []bool{*replicationUser != "", *replicationToken != "", *replicationCreds != "", *replicationNKey != ""} {
+		if set {
+			methods++
+		}
+	}
+	if methods > 1 {
+		errs = append(errs, errors.New("--replication-user, --replication-token, --replication-creds and --replication-nkey are mutually exclusive"))
+	}
+	if *replicationPass != "" && *replicationUser == "" {
+		errs = append(errs, errors.New("--replication-pass needs --replication-user"))
+	}
+	if (*replicationTLSCert == "") != (*replicationTLSKey == "") {
+		errs = append(errs, errors.New("--replication-tls-cert and --replication-tls-key must be set together"))
+	}
+	if *replicationURL == "" && (methods > 0 || *replicationTLSCert != "" || *replicationTLSCA != "") {
+		errs = append(errs, errors.New("the --replication-* credentials and TLS flags secure the connection to --replication-url, set it too"))
+	}
+	return errors.Join(errs...)
+}
+
+// replicationConnDefaults are the options of the connector, which setting
+// any option replaces.
+var replicationConnDefaults = []nats.Option{
+	nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+		if err != nil {
+			slog.Error("NATS got disconnected!", "reason", err)
+		}
+	}),
+	nats.ReconnectHandler(func(nc *nats.Conn) {
+		slog.Info("NATS got reconnected!", "url", nc.ConnectedUrl())
+	}),
+	nats.ClosedHandler(func(nc *nats.Conn) {
+		if err := nc.LastError(); err != nil {
+			slog.Error("NATS connection closed.", "reason", err)
+		}
+	}),
+	nats.MaxReconnects(-1),
+}
+
+// embeddedNATSConfigFile writes the configuration of the embedded NATS server
+// set by the --nats-* flags to a file, adding the JetStream domain and the
+// cluster the connector has no option for. The caller removes the file.
+func embeddedNATSConfigFile(name string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "server_name: %s\nport: %d\n", strconv.Quote(name), *natsPort)
+	b.WriteString("jetstream {\n")
+	if *natsJSDomain != "" {
+		fmt.Fprintf(&b, "  domain: %s\n", strconv.Quote(*natsJSDomain))
+	}
+	if *natsStoreDir != "" {
+		fmt.Fprintf(&b, "  store_dir: %s\n", strconv.Quote(*natsStoreDir))
+	}
+	b.WriteString("}\n")
+	if *natsUser != "" && *natsPass != "" {
+		fmt.Fprintf(&b, "accounts {\n  app {\n    jetstream: enabled\n    users: [{user: %s, password: %s}]\n  }\n}\n",
+			strconv.Quote(*natsUser), strconv.Quote(*natsPass))
+	}
+	if *natsClusterName != "" {
+		fmt.Fprintf(&b, "cluster {\n  name: %s\n  port: %d\n", strconv.Quote(*natsClusterName), *natsClusterPort)
+		var routes []string
+		for _, route := range strings.Split(*natsRoutes, ",") {
+			if route = strings.TrimSpace(route); route != "" {
+				routes = append(routes, strconv.Quote(route))
+			}
+		}
+		if len(routes) > 0 {
+			fmt.Fprintf(&b, "  routes: [%s]\n", strings.Join(routes, ", "))
+		}
+		b.WriteString("}\n")
+	}
+	f, err := os.CreateTemp("", "ha-nats-*.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(b.String()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
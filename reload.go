@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+
+	"github.com/litesql/ha/internal/sqlite"
+	"github.com/litesql/ha/internal/tablefilter"
+	"github.com/litesql/ha/internal/wire/mysql"
+	"github.com/litesql/ha/internal/wire/postgresql"
+)
+
+// reloadFlags are read again from the environment and the config file by
+// SIGHUP and POST /admin/reload, and applied without a restart. The flags of
+// the command line keep their value.
+var reloadFlags = []string{
+	"log-level",
+	"query-timeout",
+	"min-seq-timeout",
+	"replicate-tables",
+	"skip-tables",
+	"snapshot-interval",
+	"pg-user",
+	"pg-pass",
+	"pg-users-file",
+	"pg-users-db",
+	"mysql-user",
+	"mysql-pass",
+}
+
+// commandLine are the arguments of the node, their flags are not reloaded.
+var commandLine []string
+
+type reloader struct {
+	mu sync.Mutex
+
+	// tableFilter is nil with the async replication, which can't filter
+	tableFilter *tablefilter.Filter
+	pgUsers     *postgresql.ReloadableUsers
+	loadPGUsers func() (postgresql.Users, error)
+	mysqlServer *mysql.Server
+
+	// snapshots take the periodic snapshots, restarted when the interval
+	// changes
+	snapshots     []func(context.Context, time.Duration)
+	stopSnapshots context.CancelFunc
+}
+
+// Reload reads the reloadable flags and applies them. It returns the flags
+// changed, none is changed when one of them is invalid.
+func (r *reloader) Reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values, err := readReloadFlags()
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[string]string)
+	restore := func() {
+		for name, value := range previous {
+			if f, ok := flagSet.GetFlag(name); ok {
+				f.SetValue(value)
+			}
+		}
+	}
+	var changed []string
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		f, ok := flagSet.GetFlag(name)
+		if !ok {
+			continue
+		}
+		before := f.GetValue()
+		if err := f.SetValue(values[name]); err != nil {
+			restore()
+			return nil, fmt.Errorf("invalid --%s: %w", name, err)
+		}
+		previous[name] = before
+		if f.GetValue() != before {
+			changed = append(changed, name)
+		}
+	}
+	// applied even without change, the users file is read again
+	if err := r.apply(changed); err != nil {
+		restore()
+		return nil, err
+	}
+	slog.Info("configuration reloaded", "changed", changed)
+	return changed, nil
+}
+
+func (r *reloader) apply(changed []string) error {
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	if r.tableFilter == nil && (*replicateTables != "" || *skipTables != "") {
+		return fmt.Errorf("--replicate-tables and --skip-tables are not supported with --async-replication")
+	}
+	if r.tableFilter != nil {
+		// checks the patterns before anything is applied
+		if _, err := tablefilter.New(*replicateTables, *skipTables); err != nil {
+			return err
+		}
+	}
+	var users postgresql.Users
+	if r.loadPGUsers != nil {
+		if users, err = r.loadPGUsers(); err != nil {
+			return fmt.Errorf("failed to load PostgreSQL users: %w", err)
+		}
+	}
+
+	slog.SetLogLoggerLevel(level)
+	sqlite.SetQueryTimeout(*queryTimeout)
+	sqlite.SetMinSeqTimeout(*minSeqTimeout)
+	if r.tableFilter != nil {
+		r.tableFilter.Set(*replicateTables, *skipTables)
+	}
+	if users != nil {
+		r.pgUsers.Set(users)
+	}
+	if r.mysqlServer != nil {
+		r.mysqlServer.SetCredentials(*mysqlUser, *mysqlPass)
+	}
+	if slices.Contains(changed, "snapshot-interval") {
+		r.startSnapshots(*snapshotInterval)
+	}
+	return nil
+}
+
+// startSnapshots restarts the periodic snapshots with the interval, 0 stops
+// them.
+func (r *reloader) startSnapshots(interval time.Duration) {
+	if r.stopSnapshots != nil {
+		r.stopSnapshots()
+		r.stopSnapshots = nil
+	}
+	if interval <= 0 || len(r.snapshots) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stopSnapshots = cancel
+	for _, start := range r.snapshots {
+		go start(ctx, interval)
+	}
+}
+
+// readReloadFlags parses the reloadable flags from the environment and the
+// config file, like at startup, except the ones of the command line.
+func readReloadFlags() (map[string]string, error) {
+	fs := ff.NewFlagSet("reload")
+	values := make(map[string]*string)
+	fromCommandLine := commandLineFlags()
+	for _, name := range reloadFlags {
+		f, ok := flagSet.GetFlag(name)
+		if !ok || fromCommandLine[name] {
+			continue
+		}
+		values[name] = fs.StringLong(name, f.GetDefault(), f.GetUsage())
+	}
+	opts := []ff.Option{
+		ff.WithEnvVarPrefix("HA"),
+		ff.WithConfigFileParser(ff.PlainParser),
+		ff.WithConfigIgnoreUndefinedFlags(),
+	}
+	if f, ok := flagSet.GetFlag("config"); ok && f.GetValue() != "" {
+		opts = append(opts, ff.WithConfigFile(f.GetValue()))
+	}
+	if err := ff.Parse(fs, nil, opts...); err != nil {
+		return nil, fmt.Errorf("read the config file: %w", err)
+	}
+	list := make(map[string]string, len(values))
+	for name, value := range values {
+		list[name] = *value
+	}
+	return list, nil
+}
+
+// commandLineFlags returns the long names of the flags of the command line.
+func commandLineFlags() map[string]bool {
+	names := make(map[string]bool)
+	for _, arg := range commandLine {
+		if arg == "--" {
+			break
+		}
+		name, ok := strings.CutPrefix(arg, "--")
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, "=")
+		names[name] = true
+	}
+	return names
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToUpper(level) {
+	case "INFO":
+		return slog.LevelInfo, nil
+	case "DEBUG":
+		return slog.LevelDebug, nil
+	case "ERROR":
+		return slog.LevelError, nil
+	case "WARN":
+		return slog.LevelWarn, nil
+	default:
+		return 0, errors.New("invalid log-level! Valid values: info, debug, error, warm")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/litesql/ha/internal/s3backup"
+	"github.com/litesql/ha/internal/sqlite"
+)
+
+// validateFlags checks the flags are consistent with each other before the
+// node starts anything. Every problem is reported at once; the warnings are
+// combinations that work but are probably not what was meant.
+func validateFlags() (warnings []string, err error) {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	embeddedNATS := *replicationURL == "" && (*natsPort > 0 || *natsConfig != "")
+
+	if *asyncReplicationOutboxDir != "" && !*asyncReplication {
+		fail("--async-replication-store-dir is only used with --async-replication: add --async-replication or remove the store dir")
+	}
+	if *asyncReplication && *asyncReplicationOutboxDir == "" {
+		warnings = append(warnings, "--async-replication without --async-replication-store-dir keeps the outbox in the working directory")
+	}
+	if !slices.Contains(sqlite.OutboxSyncModes, strings.ToLower(*outboxSync)) {
+		fail("invalid --async-replication-sync %q, use one of %s", *outboxSync, strings.Join(sqlite.OutboxSyncModes, ", "))
+	} else if *asyncReplication && strings.EqualFold(*outboxSync, "off") {
+		warnings = append(warnings, "--async-replication-sync=off acknowledges commits whose changesets an OS crash can lose before they are replicated")
+	}
+	if *outboxRetryBackoff <= 0 || *outboxMaxRetryBackoff < *outboxRetryBackoff {
+		fail("--async-replication-retry-backoff must be positive and not above --async-replication-max-retry-backoff")
+	}
+	if *outboxMaxAttempts < 0 {
+		fail("--async-replication-max-attempts must not be negative")
+	}
+	if *locksBucket != "" && (*locksDefaultTTL <= 0 || *locksMaxTTL < *locksDefaultTTL) {
+		fail("--locks-default-ttl must be positive and not above --locks-max-ttl")
+	}
+	if *otelSampleRatio < 0 || *otelSampleRatio > 1 {
+		fail("--otel-sample-ratio must be between 0 and 1")
+	}
+	if *handoffBucket != "" && *replicationURL == "" {
+		fail("--handoff-bucket needs --replication-url, the embedded NATS server starts after the databases resume their replication")
+	}
+	if *fromLatestSnapshot && *replicationURL == "" && !embeddedNATS && *snapshotS3Bucket == "" {
+		fail("--from-latest-snapshot needs a snapshot source: --replication-url, the embedded NATS server (--nats-port) or --snapshot-s3-bucket")
+	}
+	if *fromLatestSnapshot && embeddedNATS && *natsStoreDir == "" && *natsConfig == "" && *snapshotS3Bucket == "" {
+		warnings = append(warnings, "--from-latest-snapshot with the embedded NATS server and no --nats-store-dir only finds the snapshots of a previous run in the default store dir")
+	}
+	if *replicas < 1 || *replicas > 5 {
+		fail("--replicas must be between 1 and 5, got %d", *replicas)
+	} else if *replicas > 1 && embeddedNATS && *natsConfig == "" && *natsClusterName == "" {
+		fail("--replicas %d needs a JetStream cluster: cluster the embedded servers with --nats-cluster-name and --nats-routes, or connect to a cluster with --replication-url", *replicas)
+	}
+	if *natsClusterName != "" {
+		switch {
+		case *natsConfig != "":
+			fail("--nats-cluster-name does not apply to --nats-config: set the cluster block in the configuration file")
+		case !embeddedNATS:
+			fail("--nats-cluster-name clusters the embedded NATS server, which --replication-url or --nats-port 0 disables")
+		case *natsClusterPort <= 0:
+			fail("--nats-cluster-port must be positive")
+		}
+	} else if *natsRoutes != "" {
+		fail("--nats-routes needs --nats-cluster-name")
+	}
+	if *replicationURL != "" && (*natsUser != "" || *natsPass != "" || *natsStoreDir != "" || *natsConfig != "") {
+		warnings = append(warnings, "--nats-user, --nats-pass, --nats-store-dir and --nats-config configure the embedded NATS server and are ignored with --replication-url")
+	}
+	if *natsJSDomain != "" && *replicationURL != "" {
+		fail("--nats-js-domain sets the domain of the embedded NATS server, the replication uses the JetStream of the --replication-url server: connect to a server of the domain, e.g. its leaf node")
+	} else if *natsJSDomain != "" && *natsConfig != "" {
+		fail("--nats-js-domain does not apply to --nats-config: set the domain in the jetstream block of the configuration file")
+	} else if *natsJSDomain != "" && !embeddedNATS {
+		fail("--nats-js-domain needs the embedded NATS server (--nats-port)")
+	}
+	if *snapshotHistory > 0 && *snapshotInterval <= 0 {
+		warnings = append(warnings, "--snapshot-history keeps the snapshots taken on each --snapshot-interval, which is disabled: only the snapshots taken through the API are kept")
+	}
+	if *tenantTemplates != "" && *createDatabaseDir == "" && !*memDB {
+		fail("--tenant-templates creates the tenant databases in --create-db-dir, set it too")
+	}
+	if *pgUsersFile != "" && *pgUsersDB != "" {
+		fail("--pg-users-file and --pg-users-db are mutually exclusive")
+	}
+	if err := validateReplicationAuth(); err != nil {
+		errs = append(errs, err)
+	}
+	if *applyConcurrency < 0 || *applyRateLimit < 0 || *applyBatchSize < 0 {
+		fail("--apply-concurrency, --apply-rate-limit and --apply-batch-size must not be negative")
+	}
+	if *applyBatchSize > 0 && *applyRateLimit == 0 {
+		warnings = append(warnings, "--apply-batch-size is only used with --apply-rate-limit")
+	}
+	return warnings, errors.Join(errs...)
+}
+
+// selfTest checks the external services the flags point to are reachable
+// with the credentials given, so the node fails before loading any database.
+// The embedded NATS server is started with the databases and is not checked.
+func selfTest(ctx context.Context, s3 *s3backup.Backup) error {
+	ctx, cancel := context.WithTimeout(ctx, *replicationTimeout)
+	defer cancel()
+	if *replicationURL != "" {
+		natsOpts, err := replicationNATSOptions()
+		if err != nil {
+			return err
+		}
+		nc, err := nats.Connect(*replicationURL, append(natsOpts, nats.Timeout(*replicationTimeout))...)
+		if err != nil {
+			return fmt.Errorf("self-test: connect to NATS at --replication-url %q: %w", *replicationURL, err)
+		}
+		defer nc.Close()
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return fmt.Errorf("self-test: %w", err)
+		}
+		if _, err := js.AccountInfo(ctx); err != nil {
+			return fmt.Errorf("self-test: JetStream is not available at %q, enable it on the server (nats-server -js) or check the account permissions: %w", *replicationURL, err)
+		}
+		if *snapshotInterval > 0 || *snapshotHistory > 0 || *fromLatestSnapshot {
+			names := js.ObjectStoreNames(ctx)
+			for range names.Name() {
+			}
+			if err := names.Error(); err != nil {
+				return fmt.Errorf("self-test: the JetStream object store holding the snapshots is not accessible: %w", err)
+			}
+		}
+		slog.Info("self-test: NATS reachable", "url", *replicationURL)
+	}
+	if s3 != nil {
+		if err := s3.Check(ctx); err != nil {
+			return fmt.Errorf("self-test: list the S3 bucket %q: check --snapshot-s3-endpoint, --snapshot-s3-region and the credentials: %w", *snapshotS3Bucket, err)
+		}
+		slog.Info("self-test: S3 bucket reachable", "bucket", *snapshotS3Bucket)
+	}
+	return nil
+}